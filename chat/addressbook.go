@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// exportedContact is a contact in the address book file: a JSON array of
+// {"peer_id": "<hex>", "name": "<string>"} objects
+type exportedContact struct {
+	PeerID string `json:"peer_id"`
+	Name   string `json:"name"`
+}
+
+// ExportContacts writes the address book to w. Groups are not included
+func (s *Storage) ExportContacts(w io.Writer) error {
+	contacts, err := s.GetAllContacts()
+	if err != nil {
+		return fmt.Errorf("get contacts: %w", err)
+	}
+
+	exported := make([]exportedContact, 0, len(contacts))
+	for _, contact := range contacts {
+		exported = append(exported, exportedContact{
+			PeerID: hex.EncodeToString(contact.PeerID[:]),
+			Name:   contact.Name,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(exported)
+}
+
+// ImportContacts adds the contacts of an address book written by
+// ExportContacts. Existing contacts are renamed. Invalid entries are skipped
+// and reported in the returned error together with the number of imported
+// contacts
+func (s *Storage) ImportContacts(r io.Reader) (int, error) {
+	var entries []exportedContact
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return 0, fmt.Errorf("decode contacts: %w", err)
+	}
+
+	imported := 0
+	var errs []error
+	for i, entry := range entries {
+		peerID, err := parsePeerID(entry.PeerID)
+		if err == nil {
+			err = s.AddContact(peerID, entry.Name)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("contact %d: %w", i, err))
+			continue
+		}
+		imported++
+	}
+
+	return imported, errors.Join(errs...)
+}
+
+// ExportContacts writes the address book to w as JSON
+func (c *Chat) ExportContacts(w io.Writer) error {
+	return c.storage.ExportContacts(w)
+}
+
+// ImportContacts adds contacts from an address book written by
+// ExportContacts and returns how many were imported
+func (c *Chat) ImportContacts(r io.Reader) (int, error) {
+	imported, err := c.storage.ImportContacts(r)
+	slog.Info("Contacts imported", "imported", imported, "error", err)
+	return imported, err
+}
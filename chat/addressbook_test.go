@@ -0,0 +1,60 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/udisondev/sendy/router"
+)
+
+func TestExportImportContacts(t *testing.T) {
+	src := newTestStorage(t)
+	alice, bob := router.PeerID{1}, router.PeerID{2}
+	for peer, name := range map[router.PeerID]string{alice: "Alice", bob: "Bob \"the builder\""} {
+		if err := src.AddContact(peer, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := src.ExportContacts(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestStorage(t)
+	imported, err := dst.ImportContacts(&buf)
+	if err != nil || imported != 2 {
+		t.Fatalf("Expected 2 imported contacts, got %d, %v", imported, err)
+	}
+	for peer, name := range map[router.PeerID]string{alice: "Alice", bob: "Bob \"the builder\""} {
+		contact, err := dst.GetContact(peer)
+		if err != nil || contact.Name != name {
+			t.Fatalf("Expected contact %q, got %+v, %v", name, contact, err)
+		}
+	}
+}
+
+func TestImportInvalidContacts(t *testing.T) {
+	s := newTestStorage(t)
+	valid := hex.EncodeToString(bytes.Repeat([]byte{3}, router.PeerIDSize))
+
+	in := `[
+		{"peer_id": "` + valid + `", "name": "Carol"},
+		{"peer_id": "` + valid[:62] + `", "name": "Short"},
+		{"peer_id": "` + strings.Repeat("zz", router.PeerIDSize) + `", "name": "Not hex"},
+		{"peer_id": "` + valid + `", "name": ""}
+	]`
+	imported, err := s.ImportContacts(strings.NewReader(in))
+	if imported != 1 {
+		t.Fatalf("Expected 1 imported contact, got %d", imported)
+	}
+	if err == nil || strings.Count(err.Error(), "\n") != 2 {
+		t.Fatalf("Expected errors for 3 entries, got %v", err)
+	}
+
+	if _, err := s.ImportContacts(strings.NewReader(`{"peer_id": "` + valid + `"}`)); err == nil {
+		t.Fatal("Expected error for a file that is not an array")
+	}
+}
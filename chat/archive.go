@@ -0,0 +1,355 @@
+package chat
+
+import (
+	"archive/tar"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// archiveExt is appended to the name of a directory sent as an archive
+const archiveExt = ".tar"
+
+// SendDirectory sends a directory as a tar archive. The receiver gets it
+// extracted into a folder of the same name. Only regular files and
+// folders are sent, symlinks and special files are skipped. Together the
+// files must fit in MaxFileSize
+func (c *Chat) SendDirectory(peerID router.PeerID, dir string) error {
+	if _, ok := c.connector.GetPeer(peerID); !ok {
+		return fmt.Errorf("peer not connected")
+	}
+
+	ft, err := c.fileTransferMgr.StartSendingDirectory(peerID, dir)
+	if err != nil {
+		return fmt.Errorf("start sending directory: %w", err)
+	}
+
+	ft.logger().Info("Starting directory transfer", "dir", dir, "archive_size", ft.FileSize)
+	c.scheduleTransfer(ft, func() error { return c.offerFile(ft) })
+	return nil
+}
+
+// StartSendingDirectory packs dir into a tar in the data directory and
+// starts sending it. The tar stays there until the transfer completes or
+// is cancelled, so an interrupted transfer can resume
+func (ftm *FileTransferManager) StartSendingDirectory(peerID router.PeerID, dir string) (*FileTransfer, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("resolve directory: %w", err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("stat directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	fileName := filepath.Base(dir) + archiveExt
+	if err := ValidateFileName(fileName); err != nil {
+		return nil, err
+	}
+
+	// Fail before writing anything if the files alone are too large
+	size, err := directorySize(dir)
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxFileSize {
+		return nil, fmt.Errorf("directory too large: %d bytes (max %d)", size, MaxFileSize)
+	}
+
+	// The transfer ID names the folder of the tar, so a later start can
+	// tell whether it is still needed
+	transferID := GenerateTransferID(peerID, fileName)
+	archivePath := filepath.Join(ftm.archiveDir(), transferID, fileName)
+	if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+		return nil, fmt.Errorf("create archive dir: %w", err)
+	}
+	archiveSize, err := writeArchive(dir, archivePath)
+	if err != nil {
+		os.RemoveAll(filepath.Dir(archivePath))
+		return nil, err
+	}
+	// Headers count too
+	if archiveSize > MaxFileSize {
+		os.RemoveAll(filepath.Dir(archivePath))
+		return nil, fmt.Errorf("archive too large: %d bytes (max %d)", archiveSize, MaxFileSize)
+	}
+
+	ft, err := ftm.newOutgoing(peerID, transferID, archivePath, archiveSize)
+	if err != nil {
+		os.RemoveAll(filepath.Dir(archivePath))
+		return nil, err
+	}
+	ft.Archive = true
+	return ft, nil
+}
+
+// directorySize returns the total size of regular files in dir
+func directorySize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		if size > MaxFileSize {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("scan directory: %w", err)
+	}
+	return size, nil
+}
+
+// writeArchive streams the folders and regular files of dir into a tar at
+// path and returns its size. Entry names are relative to dir
+func writeArchive(dir, path string) (int64, error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("create archive: %w", err)
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			slog.Debug("Skipping special file in directory archive", "path", path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			header.Name += "/"
+		}
+		// Owner names mean nothing on the other side
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		// A file that grew meanwhile is cut to the size in the header
+		_, err = io.CopyN(tw, file, header.Size)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("write archive: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return 0, fmt.Errorf("write archive: %w", err)
+	}
+
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fmt.Errorf("write archive: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return 0, fmt.Errorf("close archive: %w", err)
+	}
+	return size, nil
+}
+
+// extractToDownloads extracts a verified incoming archive into a folder of
+// the download dir named after it and returns the folder path. Entries go
+// into a hidden temporary folder first, which is renamed once complete.
+// An entry with a path leaving the folder fails the whole archive
+func (ftm *FileTransferManager) extractToDownloads(ft *FileTransfer) (string, error) {
+	dir := ftm.DownloadDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("create download dir: %w", err)
+	}
+
+	tmp, err := os.MkdirTemp(dir, ".sendy-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("create temp dir: %w", err)
+	}
+	if err := extractArchive(ft.FilePath, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("chmod extracted folder: %w", err)
+	}
+
+	dst, err := renameUnique(tmp, dir, archiveFolderName(ft.FileName))
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+
+	if err := os.Remove(ft.FilePath); err != nil {
+		slog.Warn("Failed to delete partial file", "path", ft.FilePath, "error", err)
+	}
+	return dst, nil
+}
+
+// extractArchive extracts the folders and regular files of the tar at path
+// into dir. Other entry types are skipped
+func extractArchive(path, dir string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open archive: %w", err)
+	}
+	defer in.Close()
+
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read archive: %w", err)
+		}
+
+		// Nothing may land outside dir: no absolute paths, no "..", no
+		// reserved names. No symlinks are created, so a path cannot
+		// leave through one
+		name := filepath.FromSlash(strings.TrimSuffix(header.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("unsafe path in archive: %q", header.Name)
+		}
+		target := filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("create folder: %w", err)
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("create folder: %w", err)
+			}
+			if err := extractFile(tr, target); err != nil {
+				return err
+			}
+
+		default:
+			slog.Debug("Skipping archive entry", "name", header.Name, "type", header.Typeflag)
+		}
+	}
+}
+
+// extractFile writes the current tar entry to a new file at path
+func extractFile(r io.Reader, path string) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return fmt.Errorf("extract file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("close file: %w", err)
+	}
+	return nil
+}
+
+// renameUnique moves the folder src into dir under name or the first free
+// "name (n)"
+func renameUnique(src, dir, name string) (string, error) {
+	for n := range maxNameCollisions {
+		dst := filepath.Join(dir, collisionName(name, n))
+		if _, err := os.Lstat(dst); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return "", fmt.Errorf("check %s: %w", dst, err)
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return "", fmt.Errorf("move extracted folder: %w", err)
+		}
+		return dst, nil
+	}
+	return "", fmt.Errorf("no free name for %s in %s", name, dir)
+}
+
+// archiveFolderName returns the folder an archive is extracted into
+func archiveFolderName(fileName string) string {
+	return strings.TrimSuffix(fileName, archiveExt)
+}
+
+// archiveDir holds tars of directories being sent, one folder per transfer
+func (ftm *FileTransferManager) archiveDir() string {
+	return filepath.Join(ftm.dataDir, "archives")
+}
+
+// isArchive reports whether filePath is a tar made by StartSendingDirectory
+func (ftm *FileTransferManager) isArchive(filePath string) bool {
+	return filepath.Dir(filepath.Dir(filePath)) == ftm.archiveDir()
+}
+
+// removeArchive deletes the tar of an outgoing directory transfer
+func (ftm *FileTransferManager) removeArchive(ft *FileTransfer) {
+	if err := os.RemoveAll(filepath.Dir(ft.FilePath)); err != nil {
+		ft.logger().Warn("Failed to delete directory archive", "error", err)
+	}
+}
+
+// removeFinishedArchives deletes tars of directory transfers that can no
+// longer resume: completed, cancelled or never offered. A completed tar is
+// kept until the next start because missing chunks may still be asked for
+func (ftm *FileTransferManager) removeFinishedArchives() {
+	entries, err := os.ReadDir(ftm.archiveDir())
+	if err != nil || ftm.storage == nil {
+		return
+	}
+	for _, entry := range entries {
+		_, _, _, _, _, status, _, err := ftm.storage.GetFileTransfer(entry.Name())
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Failed to check directory archive", "transferID", entry.Name(), "error", err)
+			continue
+		}
+		if err == nil && status != string(FileTransferCompleted) && status != string(FileTransferCancelled) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(ftm.archiveDir(), entry.Name())); err != nil {
+			slog.Warn("Failed to delete directory archive", "transferID", entry.Name(), "error", err)
+		}
+	}
+}
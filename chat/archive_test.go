@@ -0,0 +1,126 @@
+package chat
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/udisondev/sendy/router"
+)
+
+func TestDirectoryArchive(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "photos")
+	files := map[string]string{
+		"a.jpg":           "first",
+		"trip/b.jpg":      "second",
+		"trip/deep/c.txt": "third",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(src, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := newTestStorage(t)
+	sender := NewFileTransferManager(storage, t.TempDir())
+	ft, err := sender.StartSendingDirectory(router.PeerID{1}, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ft.Archive || ft.FileName != "photos.tar" || !sender.isArchive(ft.FilePath) {
+		t.Fatalf("Unexpected archive transfer %s at %s", ft.FileName, ft.FilePath)
+	}
+
+	// The receiver extracts a copy of the tar next to an existing folder
+	receiver := NewFileTransferManager(storage, t.TempDir())
+	downloads := t.TempDir()
+	receiver.SetDownloadDir(downloads)
+	if err := os.Mkdir(filepath.Join(downloads, "photos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(ft.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(t.TempDir(), "partial")
+	if err := os.WriteFile(partial, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := receiver.extractToDownloads(&FileTransfer{FileName: ft.FileName, FilePath: partial, Archive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != filepath.Join(downloads, "photos (1)") {
+		t.Fatalf("Unexpected folder %s", dir)
+	}
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, content)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dir, "empty")); err != nil || !info.IsDir() {
+		t.Errorf("Empty folder not extracted: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "link")); !os.IsNotExist(err) {
+		t.Errorf("Symlink should be skipped, got %v", err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Partial archive left behind: %v", err)
+	}
+
+	// Cancelling deletes the sender's tar
+	if _, err := sender.cancelTransfer(ft.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(ft.FilePath)); !os.IsNotExist(err) {
+		t.Errorf("Archive left after cancel: %v", err)
+	}
+}
+
+func TestExtractArchiveRejectsTraversal(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "/etc/evil.txt", "ok/../../evil.txt"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "bad.tar")
+			out, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tw := tar.NewWriter(out)
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+			tw.Write([]byte("evil"))
+			tw.Close()
+			out.Close()
+
+			downloads := t.TempDir()
+			ftm := NewFileTransferManager(nil, t.TempDir())
+			ftm.SetDownloadDir(downloads)
+			_, err = ftm.extractToDownloads(&FileTransfer{FileName: "bad.tar", FilePath: path, Archive: true})
+			if err == nil || !strings.Contains(err.Error(), "unsafe path") {
+				t.Fatalf("Expected unsafe path error, got %v", err)
+			}
+
+			// Nothing is left in the download dir or next to it
+			entries, _ := os.ReadDir(downloads)
+			if len(entries) != 0 {
+				t.Errorf("Download dir not empty: %v", entries)
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(downloads), "evil.txt")); !os.IsNotExist(err) {
+				t.Errorf("File escaped the download dir: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Backups use the SQLite Online Backup API. The source database is locked
+// only while a step copies its pages, so the chat keeps reading and writing
+// between steps. A write during the backup makes SQLite restart the copy
+const (
+	backupStepPages = 256
+	backupStepPause = 10 * time.Millisecond
+)
+
+// Backup copies the live database to dstPath. The copy is written to a
+// temporary file next to dstPath and renamed when complete, so dstPath never
+// holds a partial backup
+func (s *Storage) Backup(dstPath string) error {
+	return writeAtomically(dstPath, func(tmpPath string) error {
+		return copyDatabase(s.db, tmpPath)
+	})
+}
+
+// Restore replaces the database with the backup at srcPath. The backup is
+// copied to a temporary file which is then renamed over the database file.
+// Restore must not run concurrently with other Storage methods
+func (s *Storage) Restore(srcPath string) error {
+	if _, err := os.Stat(srcPath); err != nil {
+		return fmt.Errorf("open backup: %w", err)
+	}
+	src, err := sql.Open("sqlite3", "file:"+srcPath+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("open backup: %w", err)
+	}
+	defer src.Close()
+
+	var result string
+	if err := src.QueryRow(`PRAGMA quick_check`).Scan(&result); err != nil {
+		return fmt.Errorf("check backup: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("backup is corrupted: %s", result)
+	}
+
+	if err := s.db.Close(); err != nil {
+		return fmt.Errorf("close database: %w", err)
+	}
+	restoreErr := writeAtomically(s.path, func(tmpPath string) error {
+		return copyDatabase(src, tmpPath)
+	})
+
+	// Reopen the database even if the restore failed, the old file is intact then
+	db, err := sql.Open("sqlite3", s.path)
+	if err != nil {
+		return errors.Join(restoreErr, fmt.Errorf("reopen database: %w", err))
+	}
+	s.db = db
+	if restoreErr != nil {
+		return restoreErr
+	}
+
+	// Older backups get the current schema
+	if err := s.init(); err != nil {
+		return fmt.Errorf("migrate restored database: %w", err)
+	}
+	return nil
+}
+
+// writeAtomically calls write with a temporary path in the directory of
+// path and renames the result to path on success
+func writeAtomically(path string, write func(tmpPath string) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath) // no-op after a successful rename
+
+	if err := write(tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("rename %s: %w", tmpPath, err)
+	}
+	return nil
+}
+
+// copyDatabase copies the main database of src into the file at dstPath
+func copyDatabase(src *sql.DB, dstPath string) error {
+	ctx := context.Background()
+
+	dst, err := sql.Open("sqlite3", dstPath)
+	if err != nil {
+		return fmt.Errorf("open destination: %w", err)
+	}
+	defer dst.Close()
+
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("open destination: %w", err)
+	}
+	defer dstConn.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("open source: %w", err)
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dstDriverConn any) error {
+		return srcConn.Raw(func(srcDriverConn any) error {
+			dstSQLite, ok := dstDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected driver connection %T", dstDriverConn)
+			}
+			srcSQLite, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected driver connection %T", srcDriverConn)
+			}
+
+			backup, err := dstSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return fmt.Errorf("start backup: %w", err)
+			}
+			for {
+				done, err := backup.Step(backupStepPages)
+				if err != nil {
+					backup.Close()
+					return fmt.Errorf("backup step: %w", err)
+				}
+				if done {
+					break
+				}
+				time.Sleep(backupStepPause)
+			}
+			if err := backup.Finish(); err != nil {
+				return fmt.Errorf("finish backup: %w", err)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,90 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+func TestBackupRestore(t *testing.T) {
+	s := newTestStorage(t)
+
+	alice := router.PeerID{1}
+	if err := s.AddContact(alice, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := s.SaveMessage(&Message{PeerID: alice, Content: "before backup", Timestamp: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	backupPath := filepath.Join(t.TempDir(), "backup.db")
+	if err := s.Backup(backupPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backup is a standalone database
+	backup, err := NewStorage(backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := backup.GetMessages(alice, 10)
+	backup.Close()
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "before backup" {
+		t.Fatalf("Unexpected messages in backup: %v, %v", msgs, err)
+	}
+
+	if err := s.SaveMessage(&Message{PeerID: alice, Content: "after backup", Timestamp: now.Add(time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Restore(backupPath); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err = s.GetMessages(alice, 10)
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "before backup" {
+		t.Fatalf("Unexpected messages after restore: %v, %v", msgs, err)
+	}
+	// Storage keeps working on the restored database
+	if err := s.SaveMessage(&Message{PeerID: alice, Content: "after restore", Timestamp: now.Add(2 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// No temporary files are left behind
+	for _, dir := range []string{filepath.Dir(backupPath), filepath.Dir(s.path)} {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+		if len(matches) > 0 {
+			t.Fatalf("Temporary files left: %v", matches)
+		}
+	}
+}
+
+func TestRestoreInvalidBackup(t *testing.T) {
+	s := newTestStorage(t)
+
+	alice := router.PeerID{1}
+	if err := s.AddContact(alice, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.db")
+	if err := os.WriteFile(garbage, []byte("definitely not a database, just some bytes"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{garbage, filepath.Join(dir, "missing.db")} {
+		if err := s.Restore(path); err == nil {
+			t.Fatalf("Expected error restoring %s", filepath.Base(path))
+		}
+	}
+
+	// The current database is untouched
+	contact, err := s.GetContact(alice)
+	if err != nil || contact == nil {
+		t.Fatalf("Contact lost after failed restore: %v, %v", contact, err)
+	}
+}
@@ -1,13 +1,22 @@
 package chat
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/pion/webrtc/v4"
 	"github.com/udisondev/sendy/p2p"
 	"github.com/udisondev/sendy/router"
 )
@@ -20,6 +29,7 @@ type ChatEvent struct {
 	Contact      *Contact
 	FileTransfer *FileTransfer
 	Error        error
+	Relayed      bool // ChatEventContactOnline: traffic goes through the router
 }
 
 // ChatEventType defines chat event type
@@ -37,18 +47,112 @@ const (
 	ChatEventFileTransferProgress
 	ChatEventFileTransferCompleted
 	ChatEventFileTransferFailed
+	ChatEventTypingStarted
+	ChatEventTypingStopped
+	ChatEventMessageEdited
+	ChatEventMessageDeleted
+	ChatEventContactReconnecting
+	ChatEventMessageRead
+	ChatEventGroupMessageReceived
+	ChatEventContactKeyChanged
+	ChatEventConnectionRequest
+	ChatEventContactConnecting
+	ChatEventPeerDiscovered       // Peer found on the local network, Contact is nil for strangers
+	ChatEventFileOfferReceived    // Incoming file waits for AcceptFileTransfer or RejectFileTransfer
+	ChatEventMessageStatusChanged // Message.Status of an outgoing message changed
+)
+
+const (
+	DefaultMinBackoff    = 5 * time.Second
+	DefaultMaxBackoff    = 5 * time.Minute
+	DefaultBackoffFactor = 2.0
+
+	// DefaultConnectTimeout bounds how long SendMessage waits for an offline
+	// contact to connect
+	DefaultConnectTimeout = 10 * time.Second
+
+	// DefaultReconnectCooldown pauses auto-reconnect to a contact who closed
+	// the connection on purpose
+	DefaultReconnectCooldown = 5 * time.Minute
+
+	reconnectCheckInterval = time.Second
+
+	// messageSendTimeout bounds sends started from the UI and JSON commands
+	messageSendTimeout = 10 * time.Second
 )
 
 type Chat struct {
-	connector       *p2p.Connector
+	connector       P2PConnector
 	storage         *Storage
 	fileTransferMgr *FileTransferManager
 	events          chan ChatEvent
 	mu              sync.Mutex
+
+	// Reconnect policy, protected by mu
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	backoffFactor  float64
+	contactBackoff sync.Map // map[router.PeerID]*reconnectBackoff
+	connectTimeout time.Duration
+	cooldown       time.Duration // after a user-initiated disconnect by the peer
+
+	// Typing indicators, protected by typingMu
+	typingMu      sync.Mutex
+	typingSent    map[router.PeerID]*typingSendState
+	typingRecv    map[router.PeerID]*time.Timer // auto-stop timers of typing peers
+	typingTimeout time.Duration                 // TypingTimeout if zero
+
+	missingChunksTimeout time.Duration // MissingChunksTimeout if zero
+
+	// Outgoing read receipts, protected by readMu
+	readMu   sync.Mutex
+	readSent map[router.PeerID]*readReceiptState
+
+	// Delivery acks, protected by deliveryMu
+	deliveryMu      sync.Mutex
+	deliveryTimers  map[string]*deliveryWatch // by message UUID
+	deliveryTimeout time.Duration             // DeliveryTimeout if zero
+
+	connectionMode  p2p.ConnectionMode // Incoming connection policy, protected by mu
+	connecting      sync.Map           // map[router.PeerID]struct{} - connections being established
+	onlinePeers     sync.Map           // map[router.PeerID]struct{} - written only by handleConnectorEvents
+	markdown        bool               // Render Markdown in the TUI, protected by mu
+	autoAcceptFiles bool               // Receive files from verified contacts without asking, protected by mu
+}
+
+// P2PConnector is the part of *p2p.Connector used by Chat. Tests replace it
+// with p2ptest.MockConnector to run without a WebRTC stack
+type P2PConnector interface {
+	LocalID() router.PeerID
+	EncryptionKey() *p2p.Curve25519PublicKey
+	PeerEncryptionKey(peerID router.PeerID) (*p2p.Curve25519PublicKey, bool)
+	ConnectContext(ctx context.Context, hexID string) <-chan error
+	WaitForPeer(ctx context.Context, peerID router.PeerID) (*p2p.Peer, error)
+	Disconnect(peerID router.PeerID) error
+	DisconnectAll()
+	GetPeer(peerID router.PeerID) (*p2p.Peer, bool)
+	GetPeerState(peerID router.PeerID) p2p.PeerState
+	GetActivePeers() []router.PeerID
+	SendAll(data []byte) map[router.PeerID]error
+	GetStats() map[router.PeerID]p2p.PeerStats
+	AddToBlacklist(peerID router.PeerID)
+	RemoveFromBlacklist(peerID router.PeerID)
+	IsBlacklisted(peerID router.PeerID) bool
+	SetConnectionPolicy(policy p2p.ConnectionPolicy)
+	Approve(peerID router.PeerID)
+	Reject(peerID router.PeerID)
+	Events() <-chan p2p.Event
+	Close() error
+}
+
+// reconnectBackoff holds reconnect state of an offline contact
+type reconnectBackoff struct {
+	delay       time.Duration
+	nextAttempt time.Time
 }
 
 // NewChat creates a new chat instance
-func NewChat(connector *p2p.Connector, storage *Storage, dataDir string) *Chat {
+func NewChat(connector P2PConnector, storage *Storage, dataDir string) *Chat {
 	slog.Info("Creating chat instance")
 
 	c := &Chat{
@@ -56,8 +160,18 @@ func NewChat(connector *p2p.Connector, storage *Storage, dataDir string) *Chat {
 		storage:         storage,
 		fileTransferMgr: NewFileTransferManager(storage, dataDir),
 		events:          make(chan ChatEvent, 100),
+		minBackoff:      DefaultMinBackoff,
+		maxBackoff:      DefaultMaxBackoff,
+		backoffFactor:   DefaultBackoffFactor,
+		connectTimeout:  DefaultConnectTimeout,
+		cooldown:        DefaultReconnectCooldown,
+		markdown:        true,
 	}
 
+	c.loadConnectionMode()
+	c.loadAutoAcceptFiles()
+	c.loadDownloadDir()
+
 	// Start connector events handler
 	go c.handleConnectorEvents()
 	slog.Debug("Started connector events handler")
@@ -81,8 +195,11 @@ func (c *Chat) handleConnectorEvents() {
 		hexID := hex.EncodeToString(event.PeerID[:8])
 
 		switch event.Type {
-		case p2p.EventConnected:
-			slog.Info("Peer connected", "peerID", hexID+"...")
+		case p2p.EventConnected, p2p.EventConnectedRelay:
+			relayed := event.Type == p2p.EventConnectedRelay
+			slog.Info("Peer connected", "peerID", hexID+"...", "relayed", relayed)
+			c.connecting.Delete(event.PeerID)
+			c.onlinePeers.Store(event.PeerID, struct{}{})
 
 			// Check if this peer is in our contacts
 			contact, err := c.storage.GetContact(event.PeerID)
@@ -108,16 +225,80 @@ func (c *Chat) handleConnectorEvents() {
 				}
 			}
 
+			// A key different from the saved one clears verification
+			c.checkContactKey(event.PeerID)
+
+			// Connected - next disconnect starts from minimal backoff
+			c.contactBackoff.Delete(event.PeerID)
+
 			// Update last activity time
 			c.storage.UpdateLastSeen(event.PeerID)
 
 			c.events <- ChatEvent{
-				Type:   ChatEventContactOnline,
+				Type:    ChatEventContactOnline,
+				PeerID:  event.PeerID,
+				Relayed: relayed,
+			}
+
+			// Continue file transfers interrupted by previous disconnect
+			go c.resumeFileTransfers(event.PeerID)
+			go c.retryUndelivered(event.PeerID)
+
+		case p2p.EventReconnecting:
+			// The peer stays online while the connection is being restored
+			slog.Info("Peer reconnecting", "peerID", hexID+"...")
+			c.events <- ChatEvent{
+				Type:   ChatEventContactReconnecting,
 				PeerID: event.PeerID,
 			}
 
+		case p2p.EventPeerDiscovered:
+			if c.connector.IsBlacklisted(event.PeerID) {
+				continue
+			}
+			slog.Info("Peer found on local network", "peerID", hexID+"...")
+			// Contacts are connected by auto-reconnect, strangers are offered
+			// to the user
+			contact, err := c.storage.GetContact(event.PeerID)
+			if err != nil {
+				contact = nil
+			}
+			c.events <- ChatEvent{
+				Type:    ChatEventPeerDiscovered,
+				PeerID:  event.PeerID,
+				Contact: contact,
+			}
+
+		case p2p.EventConnectionStateChanged, p2p.EventICEStateChanged:
+			connecting, ok := connectionProgress(event)
+			if !ok {
+				continue
+			}
+			if !connecting {
+				c.connecting.Delete(event.PeerID)
+				continue
+			}
+			if _, loaded := c.connecting.LoadOrStore(event.PeerID, struct{}{}); !loaded {
+				c.events <- ChatEvent{
+					Type:   ChatEventContactConnecting,
+					PeerID: event.PeerID,
+				}
+			}
+
 		case p2p.EventDisconnected:
-			slog.Info("Peer disconnected", "peerID", hexID+"...")
+			slog.Info("Peer disconnected", "peerID", hexID+"...", "reason", event.Reason)
+			c.connecting.Delete(event.PeerID)
+			c.onlinePeers.Delete(event.PeerID)
+			if event.Reason.UserInitiated() {
+				c.startCooldown(event.PeerID, time.Now())
+			}
+			c.setPeerTyping(event.PeerID, false)
+			c.typingMu.Lock()
+			delete(c.typingSent, event.PeerID)
+			c.typingMu.Unlock()
+			if err := c.fileTransferMgr.FlushProgress(&event.PeerID); err != nil {
+				slog.Warn("Failed to save transfer progress", "peerID", hexID+"...", "error", err)
+			}
 			c.events <- ChatEvent{
 				Type:   ChatEventContactOffline,
 				PeerID: event.PeerID,
@@ -126,6 +307,46 @@ func (c *Chat) handleConnectorEvents() {
 		case p2p.EventDataReceived:
 			slog.Debug("Received message from peer", "peerID", hexID+"...", "length", len(event.Data))
 
+			// Binary file chunks are the bulk of the traffic, check them
+			// before trying the JSON envelopes
+			if IsChunkFrame(event.Data) {
+				chunk, err := DecodeChunkFrame(event.Data)
+				if err != nil {
+					slog.Error("Invalid chunk frame", "peerID", hexID+"...", "error", err)
+					continue
+				}
+				c.handleFileTransferMessage(event.PeerID, chunk)
+				continue
+			}
+
+			// Typing indicators are not stored
+			if typingMsg, ok := parseTypingMessage(event.Data); ok {
+				c.handleTypingMessage(event.PeerID, typingMsg)
+				continue
+			}
+
+			// Edits change stored messages instead of adding new ones
+			if editEnv, ok := parseEditEnvelope(event.Data); ok {
+				c.handleEditEnvelope(event.PeerID, editEnv)
+				continue
+			}
+			if deleteEnv, ok := parseDeleteEnvelope(event.Data); ok {
+				c.handleDeleteEnvelope(event.PeerID, deleteEnv)
+				continue
+			}
+			if receipt, ok := parseReadReceipt(event.Data); ok {
+				c.handleReadReceipt(event.PeerID, receipt)
+				continue
+			}
+			if ack, ok := parseDeliveryAck(event.Data); ok {
+				c.handleDeliveryAck(event.PeerID, ack)
+				continue
+			}
+			if groupEnv, ok := parseGroupEnvelope(event.Data); ok {
+				c.handleGroupEnvelope(event.PeerID, groupEnv)
+				continue
+			}
+
 			// Check if sender is in our contacts
 			contact, err := c.storage.GetContact(event.PeerID)
 			if err != nil || contact == nil {
@@ -159,7 +380,11 @@ func (c *Chat) handleConnectorEvents() {
 				continue
 			}
 
-			// Regular text message
+			// A message ends the typing indicator
+			c.setPeerTyping(event.PeerID, false)
+
+			// Regular text message. Older versions send the bare text
+			// without an ID and get no ack
 			msg := &Message{
 				PeerID:     event.PeerID,
 				Content:    string(event.Data),
@@ -167,8 +392,20 @@ func (c *Chat) handleConnectorEvents() {
 				IsOutgoing: false,
 				IsRead:     false,
 			}
+			if env, ok := parseTextEnvelope(event.Data); ok {
+				msg.Content, msg.UUID = env.Content, env.ID
+			}
 
-			if err := c.storage.SaveMessage(msg); err != nil {
+			err = c.storage.SaveMessage(msg)
+			if errors.Is(err, ErrDuplicateMessage) {
+				slog.Debug("Dropping duplicate message", "peerID", hexID+"...")
+				// A resent message means our ack was lost
+				if msg.UUID != "" {
+					c.sendDeliveryAck(event.PeerID, msg.UUID)
+				}
+				continue
+			}
+			if err != nil {
 				slog.Error("Failed to save received message", "peerID", hexID+"...", "error", err)
 				c.events <- ChatEvent{
 					Type:  ChatEventError,
@@ -179,6 +416,15 @@ func (c *Chat) handleConnectorEvents() {
 
 			c.storage.UpdateLastSeen(event.PeerID)
 			slog.Debug("Message saved to storage", "peerID", hexID+"...")
+			if msg.UUID != "" {
+				c.sendDeliveryAck(event.PeerID, msg.UUID)
+			}
+
+			// Muted contacts don't notify, the message shows up as unread
+			if contact != nil && contact.IsMuted(msg.Timestamp) {
+				slog.Debug("Contact is muted, not notifying", "peerID", hexID+"...")
+				continue
+			}
 
 			c.events <- ChatEvent{
 				Type:    ChatEventMessageReceived,
@@ -186,8 +432,16 @@ func (c *Chat) handleConnectorEvents() {
 				Message: msg,
 			}
 
+		case p2p.EventConnectionRequest:
+			slog.Info("Incoming connection waits for approval", "peerID", hexID+"...")
+			c.events <- ChatEvent{
+				Type:   ChatEventConnectionRequest,
+				PeerID: event.PeerID,
+			}
+
 		case p2p.EventConnectionFailed:
 			slog.Error("Connection failed", "peerID", hexID+"...", "error", event.Error)
+			c.connecting.Delete(event.PeerID)
 			c.events <- ChatEvent{
 				Type:   ChatEventConnectionFailed,
 				PeerID: event.PeerID,
@@ -206,32 +460,36 @@ func (c *Chat) handleConnectorEvents() {
 	slog.Info("Connector events handler stopped")
 }
 
-// SendMessage sends message to contact
-func (c *Chat) SendMessage(peerID router.PeerID, content string) error {
+// SendMessage sends message to contact or group. Cancelling ctx stops
+// waiting for a stuck data channel; the message is then not saved.
+// A message to a contact is saved as MessageStatusSent and becomes
+// MessageStatusDelivered once the contact acks it, or MessageStatusFailed
+// if no ack comes within the delivery timeout. Unacked messages are resent
+// when the contact reconnects
+func (c *Chat) SendMessage(ctx context.Context, peerID router.PeerID, content string) error {
 	hexID := hex.EncodeToString(peerID[:8])
 	slog.Debug("Sending message", "peerID", hexID+"...", "length", len(content))
 
-	// Get peer
-	peer, ok := c.connector.GetPeer(peerID)
-	if !ok {
-		slog.Warn("Cannot send message: peer not connected", "peerID", hexID+"...")
-		return fmt.Errorf("peer not connected")
+	if group, err := c.storage.GetGroup(peerID); err == nil {
+		return c.sendGroupMessage(ctx, group, content)
 	}
 
-	// Send
-	if err := peer.Send([]byte(content)); err != nil {
-		slog.Error("Failed to send message", "peerID", hexID+"...", "error", err)
-		return fmt.Errorf("send: %w", err)
+	// Get peer, connecting first if the contact is offline
+	peer, err := c.connectedPeer(ctx, peerID)
+	if err != nil {
+		slog.Warn("Cannot send message: peer not connected", "peerID", hexID+"...", "error", err)
+		return fmt.Errorf("peer not connected: %w", err)
 	}
-	slog.Debug("Message sent via P2P", "peerID", hexID+"...")
 
-	// Save to history
+	// Save before sending: the ack may arrive before Send returns
 	msg := &Message{
 		PeerID:     peerID,
 		Content:    content,
 		Timestamp:  time.Now(),
 		IsOutgoing: true,
-		IsRead:     true, // Outgoing messages immediately marked as read
+		IsRead:     false, // Set by the contact's read receipt
+		UUID:       newMessageUUID(),
+		Status:     MessageStatusSending,
 	}
 
 	if err := c.storage.SaveMessage(msg); err != nil {
@@ -240,6 +498,24 @@ func (c *Chat) SendMessage(peerID router.PeerID, content string) error {
 	}
 	slog.Debug("Sent message saved to storage", "peerID", hexID+"...")
 
+	// Send
+	if err := c.sendText(ctx, peer, msg); err != nil {
+		slog.Error("Failed to send message", "peerID", hexID+"...", "error", err)
+		if err := c.storage.DeleteMessage(msg.ID); err != nil {
+			slog.Error("Failed to delete unsent message", "peerID", hexID+"...", "error", err)
+		}
+		return fmt.Errorf("send: %w", err)
+	}
+	slog.Debug("Message sent via P2P", "peerID", hexID+"...")
+
+	// An ack that came first already made it delivered
+	if sent, err := c.storage.UpdateMessageStatus(msg.ID, MessageStatusSending, MessageStatusSent); err == nil {
+		msg = sent
+		c.watchDelivery(msg)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		slog.Error("Failed to mark message sent", "peerID", hexID+"...", "error", err)
+	}
+
 	c.events <- ChatEvent{
 		Type:    ChatEventMessageSent,
 		PeerID:  peerID,
@@ -249,9 +525,83 @@ func (c *Chat) SendMessage(peerID router.PeerID, content string) error {
 	return nil
 }
 
-// Connect establishes connection with contact
-func (c *Chat) Connect(hexID string) error {
-	return c.connector.Connect(hexID)
+// BroadcastMessage sends message to every connected peer. The message is
+// saved once per peer it reached. Returns send and save errors by peer ID
+func (c *Chat) BroadcastMessage(content string) map[router.PeerID]error {
+	peers := c.connector.GetActivePeers()
+	slog.Debug("Broadcasting message", "peers", len(peers), "length", len(content))
+
+	failures := c.connector.SendAll([]byte(content))
+	for _, peerID := range peers {
+		if _, failed := failures[peerID]; failed {
+			continue
+		}
+		hexID := hex.EncodeToString(peerID[:8])
+
+		msg := &Message{
+			PeerID:     peerID,
+			Content:    content,
+			Timestamp:  time.Now(),
+			IsOutgoing: true,
+			IsRead:     false, // Set by the contact's read receipt
+		}
+		if err := c.storage.SaveMessage(msg); err != nil {
+			slog.Error("Failed to save broadcast message", "peerID", hexID+"...", "error", err)
+			failures[peerID] = fmt.Errorf("save message: %w", err)
+			continue
+		}
+
+		c.events <- ChatEvent{
+			Type:    ChatEventMessageSent,
+			PeerID:  peerID,
+			Message: msg,
+		}
+	}
+	slog.Debug("Message broadcast", "peers", len(peers), "failed", len(failures))
+
+	return failures
+}
+
+// Connect starts connecting to the contact. The returned channel receives
+// nil once the contact is online or the error the attempt failed with.
+// Cancelling ctx aborts the attempt
+func (c *Chat) Connect(ctx context.Context, hexID string) <-chan error {
+	return c.connector.ConnectContext(ctx, hexID)
+}
+
+// connectedPeer returns the connection to the peer. Without one it starts
+// connecting and waits up to the connect timeout
+func (c *Chat) connectedPeer(ctx context.Context, peerID router.PeerID) (*p2p.Peer, error) {
+	if peer, ok := c.connector.GetPeer(peerID); ok {
+		return peer, nil
+	}
+
+	slog.Info("Peer not connected, connecting before send", "peerID", hex.EncodeToString(peerID[:8])+"...")
+	// The attempt outlives the send: the contact may still come online
+	// after the send gave up
+	err := c.startConnect(context.Background(), hex.EncodeToString(peerID[:]))
+	if err != nil && !errors.Is(err, p2p.ErrConnectInProgress) {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	timeout := c.connectTimeout
+	c.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return c.connector.WaitForPeer(ctx, peerID)
+}
+
+// startConnect starts connecting without waiting for the result. It returns
+// the error of an attempt rejected right away, such as an invalid ID; later
+// outcomes arrive as chat events
+func (c *Chat) startConnect(ctx context.Context, hexID string) error {
+	select {
+	case err := <-c.Connect(ctx, hexID):
+		return err
+	default:
+		return nil
+	}
 }
 
 // Disconnect terminates connection with contact
@@ -320,6 +670,26 @@ func (c *Chat) UnblockContact(peerID router.PeerID) error {
 	return nil
 }
 
+// MuteContact blocks notifications from the contact until the given time,
+// zero time mutes it until UnmuteContact. Messages are still received and
+// saved, only ChatEventMessageReceived is not emitted for them
+func (c *Chat) MuteContact(peerID router.PeerID, until time.Time) error {
+	if err := c.storage.SetMutedUntil(peerID, until); err != nil {
+		return fmt.Errorf("mute contact: %w", err)
+	}
+	slog.Info("Contact muted", "peerID", hex.EncodeToString(peerID[:8])+"...", "until", until)
+	return nil
+}
+
+// UnmuteContact lifts the mute set by MuteContact
+func (c *Chat) UnmuteContact(peerID router.PeerID) error {
+	if err := c.storage.SetNotificationsBlocked(peerID, false); err != nil {
+		return fmt.Errorf("unmute contact: %w", err)
+	}
+	slog.Info("Contact unmuted", "peerID", hex.EncodeToString(peerID[:8])+"...")
+	return nil
+}
+
 // RenameContact renames a contact
 func (c *Chat) RenameContact(peerID router.PeerID, newName string) error {
 	return c.storage.UpdateContactName(peerID, newName)
@@ -336,7 +706,15 @@ func (c *Chat) DeleteContact(peerID router.PeerID) error {
 
 // GetContacts returns all contacts
 func (c *Chat) GetContacts() ([]*Contact, error) {
-	return c.storage.GetAllContacts()
+	contacts, err := c.storage.GetAllContacts()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := c.groupContacts()
+	if err != nil {
+		return nil, fmt.Errorf("get groups: %w", err)
+	}
+	return append(contacts, groups...), nil
 }
 
 // GetMessages returns messages with a contact
@@ -344,14 +722,20 @@ func (c *Chat) GetMessages(peerID router.PeerID, limit int) ([]*Message, error)
 	return c.storage.GetMessages(peerID, limit)
 }
 
+// ExportConversation writes the conversation with peer to w in format
+func (c *Chat) ExportConversation(peerID router.PeerID, format ExportFormat, w io.Writer) error {
+	return c.storage.ExportConversation(peerID, format, w)
+}
+
 // SearchMessages searches for messages containing the query string across all contacts
 func (c *Chat) SearchMessages(query string, limit int) ([]*SearchResult, error) {
 	return c.storage.SearchMessages(query, limit)
 }
 
-// MarkAsRead marks messages as read
-func (c *Chat) MarkAsRead(peerID router.PeerID) error {
-	return c.storage.MarkAsRead(peerID)
+// PurgeOldMessages permanently deletes messages and finished file
+// transfers older than olderThan and returns the number of deleted messages
+func (c *Chat) PurgeOldMessages(olderThan time.Duration) (int64, error) {
+	return c.storage.PurgeOldMessages(olderThan)
 }
 
 // GetUnreadCount returns the number of unread messages
@@ -359,20 +743,92 @@ func (c *Chat) GetUnreadCount(peerID router.PeerID) (int, error) {
 	return c.storage.GetUnreadCount(peerID)
 }
 
-// IsOnline checks if a contact is online
+// IsOnline checks if a contact is online. It follows connector events
+// rather than the connector's peer list, so a contact stays online until
+// ChatEventContactOffline is sent and the UI never sees the two disagree
 func (c *Chat) IsOnline(peerID router.PeerID) bool {
-	_, ok := c.connector.GetPeer(peerID)
+	_, ok := c.onlinePeers.Load(peerID)
 	return ok
 }
 
-// SendFile starts file sending to contact
-func (c *Chat) SendFile(peerID router.PeerID, filePath string) error {
-	hexID := hex.EncodeToString(peerID[:8])
-	slog.Info("Starting file transfer", "peerID", hexID+"...", "file", filePath)
+// GetOnlinePeers returns the contacts that are online, sorted by ID
+func (c *Chat) GetOnlinePeers() []router.PeerID {
+	var peers []router.PeerID
+	c.onlinePeers.Range(func(key, _ any) bool {
+		peers = append(peers, key.(router.PeerID))
+		return true
+	})
+	slices.SortFunc(peers, func(a, b router.PeerID) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	return peers
+}
 
-	// Check that peer is connected
+// IsReconnecting checks if the connection to the peer was interrupted and
+// is being restored
+func (c *Chat) IsReconnecting(peerID router.PeerID) bool {
 	peer, ok := c.connector.GetPeer(peerID)
-	if !ok {
+	return ok && peer.Reconnecting()
+}
+
+// IsConnecting checks if a connection to the peer is being established:
+// ICE candidates are checked or DTLS is negotiated
+func (c *Chat) IsConnecting(peerID router.PeerID) bool {
+	_, ok := c.connecting.Load(peerID)
+	return ok
+}
+
+// PeerState returns the connection state of a contact. A connection whose
+// ICE checks the chat has seen start counts as connecting too
+func (c *Chat) PeerState(peerID router.PeerID) p2p.PeerState {
+	state := c.connector.GetPeerState(peerID)
+	if state == p2p.PeerStateDisconnected && c.IsConnecting(peerID) {
+		return p2p.PeerStateConnecting
+	}
+	return state
+}
+
+// connectionProgress tells whether an informational state event means the
+// peer is connecting. ok is false for initial states that change nothing
+func connectionProgress(event p2p.Event) (connecting, ok bool) {
+	if event.Type == p2p.EventICEStateChanged {
+		switch event.ICEState {
+		case webrtc.ICEConnectionStateUnknown, webrtc.ICEConnectionStateNew:
+			return false, false
+		}
+		return event.ICEState == webrtc.ICEConnectionStateChecking, true
+	}
+	switch event.ConnectionState {
+	case webrtc.PeerConnectionStateUnknown, webrtc.PeerConnectionStateNew:
+		return false, false
+	}
+	return event.ConnectionState == webrtc.PeerConnectionStateConnecting, true
+}
+
+// IsRelayed checks if the peer is connected through the router relay
+// instead of a direct WebRTC connection
+func (c *Chat) IsRelayed(peerID router.PeerID) bool {
+	peer, ok := c.connector.GetPeer(peerID)
+	return ok && peer.Relayed()
+}
+
+// GetStats returns connection statistics of all connected peers
+func (c *Chat) GetStats() map[router.PeerID]p2p.PeerStats {
+	return c.connector.GetStats()
+}
+
+// GetPeerStats returns connection statistics of a connected peer
+func (c *Chat) GetPeerStats(peerID router.PeerID) (p2p.PeerStats, bool) {
+	stats, ok := c.connector.GetStats()[peerID]
+	return stats, ok
+}
+
+// SendFile starts file sending to contact. Beyond the limits of
+// SetTransferLimits the file waits in a queue and is offered once an
+// earlier transfer ends
+func (c *Chat) SendFile(peerID router.PeerID, filePath string) error {
+	// Check that peer is connected
+	if _, ok := c.connector.GetPeer(peerID); !ok {
 		return fmt.Errorf("peer not connected")
 	}
 
@@ -382,108 +838,103 @@ func (c *Chat) SendFile(peerID router.PeerID, filePath string) error {
 		return fmt.Errorf("start sending: %w", err)
 	}
 
+	ft.logger().Info("Starting file transfer", "file_path", filePath)
+	c.scheduleTransfer(ft, func() error { return c.offerFile(ft) })
+	return nil
+}
+
+// SendFiles sends several files to peer, each as its own transfer waiting
+// in the queue in the given order. Files that cannot be sent are reported
+// together, the others are sent anyway
+func (c *Chat) SendFiles(peerID router.PeerID, paths []string) error {
+	if _, ok := c.connector.GetPeer(peerID); !ok {
+		return fmt.Errorf("peer not connected")
+	}
+
+	var errs []error
+	for _, path := range paths {
+		if err := c.SendFile(peerID, path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", filepath.Base(path), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// offerFile sends the START of an outgoing transfer that got a slot
+func (c *Chat) offerFile(ft *FileTransfer) error {
+	// Cancelled between leaving the queue and now
+	if ft.isCancelled() {
+		return nil
+	}
+	log := ft.logger()
+
 	// Save to database
-	c.storage.SaveFileTransfer(ft.ID, peerID, ft.FileName, ft.FileSize, ft.FilePath, true, string(FileTransferPending))
+	c.storage.SaveFileTransfer(ft.ID, ft.PeerID, ft.FileName, ft.FileSize, ft.FilePath, true, string(FileTransferPending))
 
 	// Send START message
 	startMsg := &FileTransferMessage{
-		Type:        FileTransferStart,
-		TransferID:  ft.ID,
-		FileName:    ft.FileName,
-		FileSize:    ft.FileSize,
-		TotalChunks: ft.TotalChunks,
+		Type:         FileTransferStart,
+		TransferID:   ft.ID,
+		FileName:     ft.FileName,
+		FileSize:     ft.FileSize,
+		TotalChunks:  ft.TotalChunks,
+		BinaryChunks: true,
+		Archive:      ft.Archive,
 	}
 
-	data, err := json.Marshal(startMsg)
-	if err != nil {
-		return fmt.Errorf("marshal start message: %w", err)
-	}
-
-	if err := peer.Send(data); err != nil {
+	if err := c.sendFileMessage(ft.PeerID, startMsg); err != nil {
 		return fmt.Errorf("send start message: %w", err)
 	}
 
 	// Send event
 	c.events <- ChatEvent{
 		Type:         ChatEventFileTransferStarted,
-		PeerID:       peerID,
+		PeerID:       ft.PeerID,
 		FileTransfer: ft,
 	}
 
-	// Start goroutine for sending chunks
-	go c.sendFileChunks(peerID, ft)
-
+	// Chunks go after the receiver accepts with FileTransferAccept
+	log.Info("File offered, waiting for accept")
 	return nil
 }
 
 // sendFileChunks sends file chunks
 func (c *Chat) sendFileChunks(peerID router.PeerID, ft *FileTransfer) {
-	hexID := hex.EncodeToString(peerID[:8])
-	slog.Debug("Starting to send file chunks", "peerID", hexID+"...", "transferID", ft.ID, "totalChunks", ft.TotalChunks)
+	log := ft.logger()
+	log.Debug("Starting to send file chunks")
 
 	peer, ok := c.connector.GetPeer(peerID)
 	if !ok {
-		slog.Error("Peer disconnected during file transfer", "peerID", hexID+"...")
+		log.Error("Peer disconnected during file transfer")
 		c.handleFileTransferError(ft, fmt.Errorf("peer disconnected"))
 		return
 	}
 
-	// Update status
+	// Update status. The speed counts from the first chunk, not from the offer
+	ft.mu.Lock()
 	ft.Status = FileTransferTransferring
+	ft.StartedAt = time.Now()
+	ft.mu.Unlock()
 	c.storage.SaveFileTransfer(ft.ID, peerID, ft.FileName, ft.FileSize, ft.FilePath, true, string(FileTransferTransferring))
 
 	// Read and send chunks
-	buffer := make([]byte, ChunkSize)
-	for chunkIndex := 0; chunkIndex < ft.TotalChunks; chunkIndex++ {
-		n, err := ft.File.Read(buffer)
-		if err != nil && n == 0 {
-			slog.Error("Failed to read chunk", "peerID", hexID+"...", "transferID", ft.ID, "chunk", chunkIndex, "error", err)
-			c.handleFileTransferError(ft, err)
-			return
-		}
-
-		chunkMsg := &FileTransferMessage{
-			Type:        FileTransferChunk,
-			TransferID:  ft.ID,
-			ChunkIndex:  chunkIndex,
-			TotalChunks: ft.TotalChunks,
-			Data:        buffer[:n],
-		}
-
-		data, err := json.Marshal(chunkMsg)
-		if err != nil {
-			slog.Error("Failed to marshal chunk", "error", err)
-			c.handleFileTransferError(ft, err)
-			return
-		}
-
-		if err := peer.Send(data); err != nil {
-			slog.Error("Failed to send chunk", "peerID", hexID+"...", "transferID", ft.ID, "chunk", chunkIndex, "error", err)
-			c.handleFileTransferError(ft, err)
-			return
-		}
-
-		// Update progress
-		ft.UpdateProgress(chunkIndex + 1)
-		c.storage.UpdateFileTransferProgress(ft.ID, ft.Progress)
-
-		// Send progress event every 10%
-		if ft.Progress%10 == 0 {
-			c.events <- ChatEvent{
-				Type:         ChatEventFileTransferProgress,
-				PeerID:       peerID,
-				FileTransfer: ft,
-			}
-		}
-
-		slog.Debug("Sent chunk", "peerID", hexID+"...", "transferID", ft.ID, "chunk", chunkIndex, "progress", ft.Progress)
+	err := c.sendChunks(log, ft, c.fileTransferMgr.Concurrency(), func(ctx context.Context, data []byte) error {
+		return sendBulk(ctx, peer, data)
+	})
+	if ft.isCancelled() {
+		log.Info("Stopped sending cancelled file", ft.progressArgs()...)
+		return
+	}
+	if err != nil {
+		c.handleFileTransferError(ft, err)
+		return
 	}
 
 	// Calculate hash
 	ft.File.Close()
 	hash, err := CalculateFileHash(ft.FilePath)
 	if err != nil {
-		slog.Error("Failed to calculate file hash", "error", err)
+		log.Error("Failed to calculate file hash", "error", err)
 		c.handleFileTransferError(ft, err)
 		return
 	}
@@ -498,84 +949,217 @@ func (c *Chat) sendFileChunks(peerID router.PeerID, ft *FileTransfer) {
 
 	data, err := json.Marshal(endMsg)
 	if err != nil {
-		slog.Error("Failed to marshal end message", "error", err)
+		log.Error("Failed to marshal end message", "error", err)
 		c.handleFileTransferError(ft, err)
 		return
 	}
 
 	if err := peer.Send(data); err != nil {
-		slog.Error("Failed to send end message", "error", err)
+		log.Error("Failed to send end message", "error", err)
 		c.handleFileTransferError(ft, err)
 		return
 	}
 
-	// Complete
+	// Complete. The file may still be read again for missing chunks
+	ft.mu.Lock()
 	ft.Status = FileTransferCompleted
+	ft.mu.Unlock()
 	c.storage.UpdateFileTransferStatus(ft.ID, string(FileTransferCompleted), hash)
+	c.saveTransferRate(log, ft)
 
 	// Save message about file transfer
+	content := fmt.Sprintf("📎 Sent file: %s (%.1f MB)", ft.FileName, float64(ft.FileSize)/(1024*1024))
+	if ft.Archive {
+		content = fmt.Sprintf("📁 Sent folder: %s (%.1f MB)", archiveFolderName(ft.FileName), float64(ft.FileSize)/(1024*1024))
+	}
 	fileMsg := &Message{
 		PeerID:     peerID,
-		Content:    fmt.Sprintf("📎 Sent file: %s (%.1f MB)", ft.FileName, float64(ft.FileSize)/(1024*1024)),
+		Content:    content,
 		Timestamp:  time.Now(),
 		IsOutgoing: true,
 		IsRead:     true,
 	}
 	c.storage.SaveMessage(fileMsg)
 
-	slog.Info("File transfer completed", "peerID", hexID+"...", "transferID", ft.ID, "hash", hash[:16]+"...")
+	log.Info("File transfer completed", ft.progressArgs("hash", hash[:16]+"...")...)
 
 	c.events <- ChatEvent{
 		Type:         ChatEventFileTransferCompleted,
 		PeerID:       peerID,
 		FileTransfer: ft,
 	}
+	c.releaseTransfer(ft)
+}
+
+// sendChunks reads the chunks the receiver does not have yet and passes
+// them to send, up to concurrency at a time. The first error stops the
+// remaining chunks, cancelling the transfer stops them without an error
+func (c *Chat) sendChunks(log *slog.Logger, ft *FileTransfer, concurrency int, send func(ctx context.Context, data []byte) error) error {
+	ctx, cancel := context.WithCancel(ft.context())
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		sendErr error
+
+		progressMu sync.Mutex
+		completed  int
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			sendErr = err
+			cancel()
+		})
+	}
+	// chunkDone counts a chunk and reports progress every 10%
+	chunkDone := func(n int64, resumed bool) {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+
+		completed++
+		ft.UpdateProgress(completed)
+		if resumed {
+			ft.AddResumed(n)
+			return
+		}
+		ft.AddTransferred(n)
+		c.storage.UpdateFileTransferProgress(ft.ID, ft.Progress)
+		if ft.Progress%10 == 0 {
+			c.events <- ChatEvent{
+				Type:         ChatEventFileTransferProgress,
+				PeerID:       ft.PeerID,
+				FileTransfer: ft,
+			}
+		}
+	}
+
+	binaryChunks := ft.useBinaryChunks()
+
+	// Each buffer is a slot: a chunk is read only when one is free
+	buffers := make(chan []byte, concurrency)
+	for range concurrency {
+		buffers <- make([]byte, ChunkSize)
+	}
+
+	for chunkIndex := 0; chunkIndex < ft.TotalChunks; chunkIndex++ {
+		// Skip chunks the receiver already has (resumed transfer)
+		if ft.ChunksRecv[chunkIndex] {
+			chunkDone(ChunkSize, true)
+			continue
+		}
+
+		var buffer []byte
+		select {
+		case buffer = <-buffers:
+		case <-ctx.Done():
+		}
+		if buffer == nil || ctx.Err() != nil || ft.isCancelled() {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				buffers <- buffer
+				wg.Done()
+			}()
+
+			n, err := ft.File.ReadAt(buffer, int64(chunkIndex)*ChunkSize)
+			if err != nil && n == 0 {
+				log.Error("Failed to read chunk", "chunk", chunkIndex, "error", err)
+				fail(fmt.Errorf("read chunk %d: %w", chunkIndex, err))
+				return
+			}
+
+			data, err := ft.encodeChunk(binaryChunks, chunkIndex, buffer[:n])
+			if err != nil {
+				fail(fmt.Errorf("marshal chunk %d: %w", chunkIndex, err))
+				return
+			}
+
+			if err := c.fileTransferMgr.limiter.wait(ctx, n); err != nil {
+				return
+			}
+			// Send blocks while the channel buffer is full, so the chunks
+			// go at the speed of the link
+			sendCtx, cancelSend := context.WithTimeout(ctx, ChunkSendTimeout)
+			err = send(sendCtx, data)
+			cancelSend()
+			if err != nil {
+				log.Error("Failed to send chunk", "chunk", chunkIndex, "error", err)
+				fail(fmt.Errorf("send chunk %d: %w", chunkIndex, err))
+				return
+			}
+
+			chunkDone(int64(n), false)
+			log.Debug("Sent chunk", ft.progressArgs("chunk", chunkIndex)...)
+		}()
+	}
+
+	wg.Wait()
+	return sendErr
 }
 
 // handleFileTransferMessage handles file transfer messages
 func (c *Chat) handleFileTransferMessage(peerID router.PeerID, msg *FileTransferMessage) {
-	hexID := hex.EncodeToString(peerID[:8])
+	// Known transfers log with all their attributes
+	log := slog.With(transferLogGroup(peerID, msg.TransferID))
 
 	switch msg.Type {
 	case FileTransferStart:
-		slog.Info("Receiving file transfer request", "peerID", hexID+"...", "file", msg.FileName, "size", msg.FileSize)
+		log.Info("Receiving file transfer request", "file_name", msg.FileName, "file_size", msg.FileSize, "total_chunks", msg.TotalChunks)
+		c.handleFileOffer(peerID, msg)
 
-		ft, err := c.fileTransferMgr.StartReceiving(peerID, msg)
-		if err != nil {
-			slog.Error("Failed to start receiving", "error", err)
-			c.sendFileTransferCancel(peerID, msg.TransferID)
+	case FileTransferChunk:
+		ft, ok := c.fileTransferMgr.GetTransfer(msg.TransferID)
+		if !ok {
+			log.Error("Transfer not found", "chunk", msg.ChunkIndex)
 			return
 		}
+		log = ft.logger()
 
-		// Save to database
-		c.storage.SaveFileTransfer(ft.ID, peerID, ft.FileName, ft.FileSize, ft.FilePath, false, string(FileTransferTransferring))
-
-		c.events <- ChatEvent{
-			Type:         ChatEventFileTransferStarted,
-			PeerID:       peerID,
-			FileTransfer: ft,
+		// Chunks re-sent for a NACK may arrive after the file is complete
+		if !ft.isTransferring() {
+			log.Debug("Ignoring chunk of a finished transfer", "chunk", msg.ChunkIndex)
+			return
 		}
 
-	case FileTransferChunk:
-		ft, ok := c.fileTransferMgr.GetTransfer(msg.TransferID)
-		if !ok {
-			slog.Error("Transfer not found", "transferID", msg.TransferID)
+		if msg.ChunkIndex < 0 || msg.ChunkIndex >= ft.TotalChunks {
+			log.Error("Chunk index out of range", "chunk", msg.ChunkIndex)
+			c.handleFileTransferError(ft, fmt.Errorf("chunk index out of range: %d", msg.ChunkIndex))
 			return
 		}
 
-		// Write chunk
-		if _, err := ft.File.Write(msg.Data); err != nil {
-			slog.Error("Failed to write chunk", "error", err)
+		// Write chunk at its offset: chunks may be skipped on resume
+		if _, err := ft.File.WriteAt(msg.Data, int64(msg.ChunkIndex)*ChunkSize); err != nil {
+			log.Error("Failed to write chunk", "chunk", msg.ChunkIndex, "error", err)
 			c.handleFileTransferError(ft, err)
 			return
 		}
 
-		// Mark chunk as received
+		// Mark chunk as received, progress for resume is saved every few chunks
+		ft.mu.Lock()
+		duplicate := ft.ChunksRecv[msg.ChunkIndex]
 		ft.ChunksRecv[msg.ChunkIndex] = true
+		endHash := ft.endHash
+		complete := endHash != "" && len(ft.ChunksRecv) == ft.TotalChunks
+		if complete {
+			ft.endHash = ""
+		}
+		received := len(ft.ChunksRecv)
+		ft.mu.Unlock()
 
 		// Update progress
-		ft.UpdateProgress(len(ft.ChunksRecv))
-		c.storage.UpdateFileTransferProgress(ft.ID, ft.Progress)
+		ft.UpdateProgress(received)
+		if !duplicate {
+			ft.AddTransferred(int64(len(msg.Data)))
+		}
+		if !complete {
+			if err := c.fileTransferMgr.chunkReceived(ft); err != nil {
+				log.Warn("Failed to save transfer progress", "error", err)
+			}
+		}
 
 		// Send progress event every 10%
 		if ft.Progress%10 == 0 {
@@ -586,82 +1170,393 @@ func (c *Chat) handleFileTransferMessage(peerID router.PeerID, msg *FileTransfer
 			}
 		}
 
-		slog.Debug("Received chunk", "peerID", hexID+"...", "transferID", ft.ID, "chunk", msg.ChunkIndex, "progress", ft.Progress)
+		log.Debug("Received chunk", ft.progressArgs("chunk", msg.ChunkIndex)...)
+
+		if complete {
+			c.completeReceiving(log, peerID, ft, endHash)
+		} else if endHash != "" {
+			// Chunks still come after END, ask for the rest only once they stop
+			c.watchMissingChunks(ft)
+		}
 
 	case FileTransferEnd:
 		ft, ok := c.fileTransferMgr.GetTransfer(msg.TransferID)
 		if !ok {
-			slog.Error("Transfer not found", "transferID", msg.TransferID)
+			log.Error("Transfer not found")
 			return
 		}
+		log = ft.logger()
 
-		ft.File.Close()
+		// END is sent again after missing chunks, the file may be done
+		if !ft.isTransferring() {
+			log.Debug("Ignoring END of a finished transfer")
+			return
+		}
 
-		// Check hash
-		hash, err := CalculateFileHash(ft.FilePath)
-		if err != nil {
-			slog.Error("Failed to calculate hash", "error", err)
-			c.handleFileTransferError(ft, err)
+		// Chunks travel on the bulk channel and may arrive after END
+		ft.mu.Lock()
+		pending := ft.TotalChunks - len(ft.ChunksRecv)
+		if pending > 0 {
+			ft.endHash = msg.SHA256Hash
+		}
+		ft.mu.Unlock()
+		if pending > 0 {
+			log.Debug("END received before all chunks, waiting", "pending", pending)
+			c.watchMissingChunks(ft)
+			return
+		}
+
+		c.completeReceiving(log, peerID, ft, msg.SHA256Hash)
+
+	case FileTransferCancel:
+		// The sender may withdraw a file the user has not decided on yet
+		if offer, ok := c.fileTransferMgr.TakeOffer(msg.TransferID); ok {
+			log.Info("File offer withdrawn", "file_name", offer.FileName)
+			c.events <- ChatEvent{
+				Type:         ChatEventFileTransferFailed,
+				PeerID:       peerID,
+				FileTransfer: offer,
+				Error:        fmt.Errorf("transfer cancelled by peer"),
+			}
 			return
 		}
 
-		if hash != msg.SHA256Hash {
-			slog.Error("Hash mismatch", "expected", msg.SHA256Hash[:16]+"...", "got", hash[:16]+"...")
-			c.handleFileTransferError(ft, fmt.Errorf("hash mismatch"))
+		ft, ok := c.fileTransferMgr.GetTransfer(msg.TransferID)
+		if !ok {
 			return
 		}
 
-		// Successfully completed
-		ft.Status = FileTransferCompleted
-		ft.Hash = hash
-		c.storage.UpdateFileTransferStatus(ft.ID, string(FileTransferCompleted), hash)
+		log = ft.logger()
 
-		// Save message about received file
-		fileMsg := &Message{
-			PeerID:     peerID,
-			Content:    fmt.Sprintf("📎 Received file: %s (%.1f MB) → %s", ft.FileName, float64(ft.FileSize)/(1024*1024), ft.FilePath),
-			Timestamp:  time.Now(),
-			IsOutgoing: false,
-			IsRead:     false,
+		// Also stops our sending loop if we are the sender
+		if err := c.fileTransferMgr.CancelTransfer(ft.ID); err != nil {
+			log.Debug("Ignoring cancel of finished transfer", "error", err)
+			return
+		}
+		if !ft.IsOutgoing {
+			if err := c.fileTransferMgr.SaveProgress(ft); err != nil {
+				log.Warn("Failed to save transfer progress", "error", err)
+			}
 		}
-		c.storage.SaveMessage(fileMsg)
 
-		slog.Info("File transfer completed successfully", "peerID", hexID+"...", "transferID", ft.ID, "file", ft.FileName)
+		log.Info("File transfer cancelled by peer", ft.progressArgs()...)
 
 		c.events <- ChatEvent{
-			Type:         ChatEventFileTransferCompleted,
+			Type:         ChatEventFileTransferFailed,
 			PeerID:       peerID,
 			FileTransfer: ft,
+			Error:        fmt.Errorf("transfer cancelled by peer"),
 		}
+		c.releaseTransfer(ft)
 
-	case FileTransferCancel:
-		ft, ok := c.fileTransferMgr.GetTransfer(msg.TransferID)
-		if !ok {
+	case FileTransferResumeRequest:
+		log.Info("Received file transfer resume request", "file_name", msg.FileName, "file_size", msg.FileSize, "total_chunks", msg.TotalChunks)
+
+		// Only a file accepted before resumes without asking, an unknown
+		// transfer is a new offer
+		offerPeer, _, _, _, isOutgoing, _, _, err := c.storage.GetFileTransfer(msg.TransferID)
+		if err != nil || isOutgoing || offerPeer != peerID {
+			c.handleFileOffer(peerID, msg)
 			return
 		}
 
-		ft.Status = FileTransferCancelled
-		ft.File.Close()
-		c.storage.UpdateFileTransferStatus(ft.ID, string(FileTransferCancelled), "")
+		// Reopen partial file, progress is restored from sidecar
+		if old, ok := c.fileTransferMgr.GetTransfer(msg.TransferID); ok {
+			old.Close()
+		}
+		ft, err := c.fileTransferMgr.StartReceiving(peerID, msg)
+		if err != nil {
+			log.Error("Failed to resume receiving", "error", err)
+			c.sendFileTransferCancel(peerID, msg.TransferID)
+			return
+		}
+		c.storage.SaveFileTransfer(ft.ID, peerID, ft.FileName, ft.FileSize, ft.FilePath, false, string(FileTransferTransferring))
+		log = ft.logger()
+
+		ft.mu.Lock()
+		resumeMsg := &FileTransferMessage{
+			Type:           FileTransferResume,
+			TransferID:     ft.ID,
+			TotalChunks:    ft.TotalChunks,
+			ReceivedChunks: EncodeChunkBitset(ft.ChunksRecv, ft.TotalChunks),
+			BinaryChunks:   true,
+		}
+		received := len(ft.ChunksRecv)
+		ft.mu.Unlock()
 
-		slog.Info("File transfer cancelled", "peerID", hexID+"...", "transferID", ft.ID)
+		if err := c.sendFileMessage(peerID, resumeMsg); err != nil {
+			log.Error("Failed to send resume message", "error", err)
+			c.handleFileTransferError(ft, err)
+			return
+		}
+
+		log.Debug("Sent resume bitset", "received", received)
 
 		c.events <- ChatEvent{
-			Type:         ChatEventFileTransferFailed,
+			Type:         ChatEventFileTransferStarted,
 			PeerID:       peerID,
 			FileTransfer: ft,
-			Error:        fmt.Errorf("transfer cancelled by peer"),
 		}
+
+	case FileTransferResume:
+		ft, ok := c.fileTransferMgr.GetTransfer(msg.TransferID)
+		if !ok || !ft.IsOutgoing || ft.PeerID != peerID {
+			log.Error("Resumable transfer not found")
+			return
+		}
+		log = ft.logger()
+
+		// A repeated resume must not start a second sending loop
+		ft.mu.Lock()
+		resumed := ft.Status == FileTransferPending
+		if resumed {
+			ft.Status = FileTransferTransferring
+			ft.ChunksRecv = DecodeChunkBitset(msg.ReceivedChunks)
+			ft.binaryChunks = msg.BinaryChunks
+		}
+		received := len(ft.ChunksRecv)
+		ft.mu.Unlock()
+		if !resumed {
+			log.Debug("Ignoring resume of a running transfer")
+			return
+		}
+
+		log.Info("Resuming file transfer", "already_received", received)
+		go c.sendFileChunks(peerID, ft)
+
+	case FileTransferAccept:
+		ft, ok := c.fileTransferMgr.GetTransfer(msg.TransferID)
+		if !ok || !ft.IsOutgoing || ft.PeerID != peerID {
+			log.Error("Accepted transfer not found")
+			return
+		}
+		log = ft.logger()
+
+		// A repeated accept must not start a second sending loop
+		ft.mu.Lock()
+		accepted := ft.Status == FileTransferPending
+		if accepted {
+			ft.Status = FileTransferTransferring
+			ft.binaryChunks = msg.BinaryChunks
+		}
+		ft.mu.Unlock()
+		if !accepted {
+			log.Debug("Ignoring accept of a running transfer")
+			return
+		}
+
+		log.Info("File accepted by peer", "binary_chunks", msg.BinaryChunks)
+		go c.sendFileChunks(peerID, ft)
+
+	case FileTransferNack:
+		ft, ok := c.fileTransferMgr.GetTransfer(msg.TransferID)
+		if !ok || !ft.IsOutgoing || ft.PeerID != peerID {
+			log.Error("Transfer with missing chunks not found")
+			return
+		}
+		go c.retransmitChunks(peerID, ft, DecodeChunkBitset(msg.MissingChunks))
+	}
+}
+
+// ResumeFileTransfer resumes an interrupted outgoing transfer. The receiver
+// replies with the chunks it already has and only the rest is sent.
+func (c *Chat) ResumeFileTransfer(transferID string) error {
+	if ft, ok := c.fileTransferMgr.GetTransfer(transferID); ok {
+		if ft.Status == FileTransferQueued || ft.Status == FileTransferPending || ft.Status == FileTransferTransferring {
+			return fmt.Errorf("transfer already in progress")
+		}
+	}
+
+	peerID, _, _, filePath, isOutgoing, status, _, err := c.storage.GetFileTransfer(transferID)
+	if err != nil {
+		return fmt.Errorf("get file transfer: %w", err)
+	}
+	if !isOutgoing {
+		return fmt.Errorf("only outgoing transfers can be resumed")
+	}
+	if status == string(FileTransferCompleted) {
+		return fmt.Errorf("transfer already completed")
 	}
+
+	if _, ok := c.connector.GetPeer(peerID); !ok {
+		return fmt.Errorf("peer not connected")
+	}
+
+	ft, err := c.fileTransferMgr.ResumeSending(peerID, transferID, filePath)
+	if err != nil {
+		return fmt.Errorf("resume sending: %w", err)
+	}
+
+	// Waits in the queue like a new file
+	c.scheduleTransfer(ft, func() error { return c.requestResume(ft) })
+	return nil
+}
+
+// requestResume asks the receiver of a resumed transfer that got a slot
+// which chunks it already has
+func (c *Chat) requestResume(ft *FileTransfer) error {
+	if ft.isCancelled() {
+		return nil
+	}
+	peerID := ft.PeerID
+
+	c.storage.SaveFileTransfer(ft.ID, peerID, ft.FileName, ft.FileSize, ft.FilePath, true, string(FileTransferPending))
+
+	// Ask receiver which chunks it already has
+	resumeReq := &FileTransferMessage{
+		Type:         FileTransferResumeRequest,
+		TransferID:   ft.ID,
+		FileName:     ft.FileName,
+		FileSize:     ft.FileSize,
+		TotalChunks:  ft.TotalChunks,
+		BinaryChunks: true,
+		Archive:      ft.Archive,
+	}
+	if err := c.sendFileMessage(peerID, resumeReq); err != nil {
+		return fmt.Errorf("send resume request: %w", err)
+	}
+
+	c.events <- ChatEvent{
+		Type:         ChatEventFileTransferStarted,
+		PeerID:       peerID,
+		FileTransfer: ft,
+	}
+
+	return nil
+}
+
+// resumeFileTransfers resumes interrupted outgoing transfers to peer
+func (c *Chat) resumeFileTransfers(peerID router.PeerID) {
+	transfers, err := c.storage.GetFileTransfers(peerID, 100)
+	if err != nil {
+		slog.Error("Failed to get file transfers", "error", err)
+		return
+	}
+
+	for _, t := range transfers {
+		if !t.IsOutgoing {
+			continue
+		}
+		if t.Status != string(FileTransferFailed) && t.Status != string(FileTransferTransferring) {
+			continue
+		}
+		if err := c.ResumeFileTransfer(t.TransferID); err != nil {
+			slog.Debug("Failed to resume file transfer", transferLogGroup(peerID, t.TransferID), "error", err)
+		}
+	}
+}
+
+// completeReceiving verifies the received file against the sender's hash
+// and finalizes the transfer
+func (c *Chat) completeReceiving(log *slog.Logger, peerID router.PeerID, ft *FileTransfer, expectedHash string) {
+	ft.File.Close()
+
+	// Check hash
+	hash, err := CalculateFileHash(ft.FilePath)
+	if err != nil {
+		log.Error("Failed to calculate hash", "error", err)
+		c.handleFileTransferError(ft, err)
+		return
+	}
+
+	if hash != expectedHash {
+		log.Error("Hash mismatch", "expected", expectedHash[:16]+"...", "got", hash[:16]+"...")
+		c.handleFileTransferError(ft, fmt.Errorf("hash mismatch"))
+		return
+	}
+
+	// Only a verified file reaches the download folder
+	moveToDownloads := c.fileTransferMgr.moveToDownloads
+	if ft.Archive {
+		moveToDownloads = c.fileTransferMgr.extractToDownloads
+	}
+	filePath, err := moveToDownloads(ft)
+	if err != nil {
+		log.Error("Failed to move received file", "error", err)
+		c.handleFileTransferError(ft, err)
+		return
+	}
+
+	// Successfully completed
+	ft.mu.Lock()
+	ft.Status = FileTransferCompleted
+	ft.Hash = hash
+	ft.FilePath = filePath
+	ft.mu.Unlock()
+	if err := c.fileTransferMgr.RemoveProgress(ft.ID); err != nil {
+		log.Warn("Failed to remove transfer progress", "error", err)
+	}
+	c.storage.SaveFileTransfer(ft.ID, peerID, ft.FileName, ft.FileSize, filePath, false, string(FileTransferCompleted))
+	c.storage.UpdateFileTransferStatus(ft.ID, string(FileTransferCompleted), hash)
+	c.saveTransferRate(log, ft)
+
+	// Save message about received file
+	content := fmt.Sprintf("📎 Received file: %s (%.1f MB) → %s", ft.FileName, float64(ft.FileSize)/(1024*1024), filePath)
+	if ft.Archive {
+		content = fmt.Sprintf("📁 Received folder: %s (%.1f MB) → %s", archiveFolderName(ft.FileName), float64(ft.FileSize)/(1024*1024), filePath)
+	}
+	fileMsg := &Message{
+		PeerID:     peerID,
+		Content:    content,
+		Timestamp:  time.Now(),
+		IsOutgoing: false,
+		IsRead:     false,
+	}
+	c.storage.SaveMessage(fileMsg)
+
+	log.Info("File transfer completed successfully", ft.progressArgs("path", filePath)...)
+
+	c.events <- ChatEvent{
+		Type:         ChatEventFileTransferCompleted,
+		PeerID:       peerID,
+		FileTransfer: ft,
+	}
+}
+
+// sendBulk sends data on the bulk channel, falling back to the main channel
+// for peers that did not open one
+func sendBulk(ctx context.Context, peer *p2p.Peer, data []byte) error {
+	err := peer.SendOnWithContext(ctx, p2p.BulkChannelLabel, data)
+	if errors.Is(err, p2p.ErrChannelNotFound) {
+		return peer.SendWithContext(ctx, data)
+	}
+	return err
+}
+
+// sendFileMessage marshals and sends file transfer message to peer
+func (c *Chat) sendFileMessage(peerID router.PeerID, msg *FileTransferMessage) error {
+	peer, ok := c.connector.GetPeer(peerID)
+	if !ok {
+		return fmt.Errorf("peer not connected")
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal file message: %w", err)
+	}
+
+	return peer.Send(data)
 }
 
 // handleFileTransferError handles file transfer error
 func (c *Chat) handleFileTransferError(ft *FileTransfer, err error) {
+	// Closing the file of a cancelled transfer fails the read in progress
+	if ft.isCancelled() {
+		return
+	}
+
+	ft.logger().Error("File transfer failed", ft.progressArgs("error", err)...)
+
 	ft.mu.Lock()
 	ft.Status = FileTransferFailed
 	ft.File.Close()
 	ft.mu.Unlock()
 
+	if !ft.IsOutgoing {
+		if err := c.fileTransferMgr.SaveProgress(ft); err != nil {
+			ft.logger().Warn("Failed to save transfer progress", "error", err)
+		}
+	}
 	c.storage.UpdateFileTransferStatus(ft.ID, string(FileTransferFailed), "")
 	c.sendFileTransferCancel(ft.PeerID, ft.ID)
 
@@ -671,6 +1566,50 @@ func (c *Chat) handleFileTransferError(ft *FileTransfer, err error) {
 		FileTransfer: ft,
 		Error:        err,
 	}
+	c.releaseTransfer(ft)
+}
+
+// CancelFileTransfer aborts an outgoing or incoming file transfer and tells
+// the peer to stop. A queued transfer is just dropped, the peer never heard
+// of it. The partial file of an incoming transfer is deleted.
+// ChatEventFileTransferFailed reports ErrCancelledByUser
+func (c *Chat) CancelFileTransfer(transferID string) error {
+	ft, ok := c.fileTransferMgr.GetTransfer(transferID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTransferNotFound, transferID)
+	}
+	queued, err := c.fileTransferMgr.cancelTransfer(transferID)
+	if err != nil {
+		return err
+	}
+	if !queued {
+		c.sendFileTransferCancel(ft.PeerID, transferID)
+	}
+
+	log := ft.logger()
+	if !ft.IsOutgoing {
+		if err := os.Remove(ft.FilePath); err != nil && !os.IsNotExist(err) {
+			log.Warn("Failed to delete partial file", "error", err)
+		}
+		if err := c.fileTransferMgr.RemoveProgress(ft.ID); err != nil {
+			log.Warn("Failed to remove transfer progress", "error", err)
+		}
+	}
+	log.Info("File transfer cancelled", ft.progressArgs()...)
+
+	c.events <- ChatEvent{
+		Type:         ChatEventFileTransferFailed,
+		PeerID:       ft.PeerID,
+		FileTransfer: ft,
+		Error:        ErrCancelledByUser,
+	}
+	c.releaseTransfer(ft)
+	return nil
+}
+
+// ActiveFileTransfers returns pending and running file transfers, oldest first
+func (c *Chat) ActiveFileTransfers() []*FileTransfer {
+	return c.fileTransferMgr.ActiveTransfers()
 }
 
 // sendFileTransferCancel sends transfer cancellation message
@@ -693,27 +1632,127 @@ func (c *Chat) sendFileTransferCancel(peerID router.PeerID, transferID string) {
 	peer.Send(data)
 }
 
+// SetConnectTimeout sets how long SendMessage waits for an offline contact
+// to connect. Non-positive values restore DefaultConnectTimeout
+func (c *Chat) SetConnectTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+	c.mu.Lock()
+	c.connectTimeout = timeout
+	c.mu.Unlock()
+}
+
+// SetReconnectCooldown sets how long auto-reconnect leaves alone a contact
+// who disconnected or quit on purpose. Non-positive values restore
+// DefaultReconnectCooldown
+func (c *Chat) SetReconnectCooldown(cooldown time.Duration) {
+	if cooldown <= 0 {
+		cooldown = DefaultReconnectCooldown
+	}
+	c.mu.Lock()
+	c.cooldown = cooldown
+	c.mu.Unlock()
+}
+
+// SetFileConcurrency sets how many chunks of an outgoing file are sent at
+// once, 1 to MaxChunkConcurrency. Several chunks in flight help on links
+// with high latency
+func (c *Chat) SetFileConcurrency(n int) {
+	c.fileTransferMgr.SetConcurrency(n)
+}
+
+// SetTransferRateLimit caps how many bytes of file data per second all
+// outgoing transfers send together, so a large file does not saturate the
+// uplink. 0 or less removes the cap. Transfers in progress pick up the new
+// limit with their next chunk
+func (c *Chat) SetTransferRateLimit(bytesPerSec int64) {
+	c.fileTransferMgr.SetRateLimit(bytesPerSec)
+}
+
+// TransferRateLimit returns the cap on outgoing file data per second, 0 if
+// unlimited
+func (c *Chat) TransferRateLimit() int64 {
+	return c.fileTransferMgr.RateLimit()
+}
+
+// SetReconnectPolicy configures auto-reconnect backoff: first retry after
+// min, each failed attempt multiplies the delay by factor up to max.
+// Invalid values fall back to defaults.
+func (c *Chat) SetReconnectPolicy(min, max time.Duration, factor float64) {
+	if min <= 0 {
+		min = DefaultMinBackoff
+	}
+	if max < min {
+		max = min
+	}
+	if factor < 1 {
+		factor = DefaultBackoffFactor
+	}
+
+	c.mu.Lock()
+	c.minBackoff = min
+	c.maxBackoff = max
+	c.backoffFactor = factor
+	c.mu.Unlock()
+}
+
 // autoReconnect periodically attempts to reconnect to offline contacts
 func (c *Chat) autoReconnect() {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(reconnectCheckInterval)
 	defer ticker.Stop()
 
 	// First attempt immediately on startup
-	c.tryReconnectAll()
+	c.reconnectDueContacts()
 
 	for range ticker.C {
-		c.tryReconnectAll()
+		c.reconnectDueContacts()
+	}
+}
+
+// nextBackoff reports whether reconnect to peer is due and, if so,
+// schedules the next attempt with increased delay
+func (c *Chat) nextBackoff(peerID router.PeerID, now time.Time) (time.Duration, bool) {
+	c.mu.Lock()
+	minDelay, maxDelay, factor := c.minBackoff, c.maxBackoff, c.backoffFactor
+	c.mu.Unlock()
+
+	val, _ := c.contactBackoff.LoadOrStore(peerID, &reconnectBackoff{delay: minDelay})
+	b := val.(*reconnectBackoff)
+	if now.Before(b.nextAttempt) {
+		return 0, false
+	}
+
+	delay := b.delay
+	b.nextAttempt = now.Add(delay)
+	b.delay = time.Duration(float64(delay) * factor)
+	if b.delay > maxDelay {
+		b.delay = maxDelay
 	}
+	return delay, true
 }
 
-// tryReconnectAll attempts to connect to all offline contacts
-func (c *Chat) tryReconnectAll() {
+// startCooldown postpones auto-reconnect to peer, who closed the connection
+// on purpose, by the reconnect cooldown. Connecting by hand is not affected
+func (c *Chat) startCooldown(peerID router.PeerID, now time.Time) {
+	c.mu.Lock()
+	cooldown, minDelay := c.cooldown, c.minBackoff
+	c.mu.Unlock()
+
+	slog.Info("Peer closed the connection, pausing auto-reconnect", "peerID", hex.EncodeToString(peerID[:8])+"...", "cooldown", cooldown)
+	c.contactBackoff.Store(peerID, &reconnectBackoff{delay: minDelay, nextAttempt: now.Add(cooldown)})
+}
+
+// reconnectDueContacts attempts to connect to offline contacts whose
+// backoff timer has elapsed
+func (c *Chat) reconnectDueContacts() {
 	contacts, err := c.storage.GetAllContacts()
 	if err != nil {
 		slog.Error("Failed to get contacts for auto-reconnect", "error", err)
 		return
 	}
 
+	now := time.Now()
 	for _, contact := range contacts {
 		// Skip blocked contacts
 		if contact.IsBlocked {
@@ -725,12 +1764,17 @@ func (c *Chat) tryReconnectAll() {
 			continue
 		}
 
+		delay, due := c.nextBackoff(contact.PeerID, now)
+		if !due {
+			continue
+		}
+
 		// Attempt to connect
 		hexID := hex.EncodeToString(contact.PeerID[:])
 		hexShort := hex.EncodeToString(contact.PeerID[:8])
-		slog.Debug("Auto-reconnect attempt", "peerID", hexShort+"...", "name", contact.Name)
+		slog.Debug("Auto-reconnect attempt", "peerID", hexShort+"...", "name", contact.Name, "nextRetryIn", delay)
 
-		if err := c.Connect(hexID); err != nil {
+		if err := c.startConnect(context.Background(), hexID); err != nil {
 			slog.Debug("Auto-reconnect failed", "peerID", hexShort+"...", "error", err)
 		}
 	}
@@ -738,6 +1782,33 @@ func (c *Chat) tryReconnectAll() {
 
 // Close closes the chat
 func (c *Chat) Close() error {
-	c.connector.DisconnectAll()
+	c.typingMu.Lock()
+	for peerID, timer := range c.typingRecv {
+		timer.Stop()
+		delete(c.typingRecv, peerID)
+	}
+	c.typingMu.Unlock()
+
+	c.readMu.Lock()
+	for _, state := range c.readSent {
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+	}
+	c.readMu.Unlock()
+
+	c.deliveryMu.Lock()
+	for id, watch := range c.deliveryTimers {
+		watch.timer.Stop()
+		delete(c.deliveryTimers, id)
+	}
+	c.deliveryMu.Unlock()
+
+	if err := c.connector.Close(); err != nil {
+		slog.Error("Failed to close connector", "error", err)
+	}
+	if err := c.fileTransferMgr.FlushProgress(nil); err != nil {
+		slog.Warn("Failed to save transfer progress", "error", err)
+	}
 	return c.storage.Close()
 }
@@ -0,0 +1,976 @@
+package chat
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/udisondev/sendy/p2p"
+	p2ptest "github.com/udisondev/sendy/p2p/testing"
+	"github.com/udisondev/sendy/router"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	c := &Chat{}
+	c.SetReconnectPolicy(time.Second, 5*time.Second, 2)
+
+	peerID := router.PeerID{1}
+	now := time.Now()
+
+	// First attempt is immediate, then delays grow up to max
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, want := range expected {
+		delay, due := c.nextBackoff(peerID, now)
+		if !due {
+			t.Fatalf("attempt %d: expected reconnect to be due", i)
+		}
+		if delay != want {
+			t.Fatalf("attempt %d: expected delay %v, got %v", i, want, delay)
+		}
+
+		if _, due := c.nextBackoff(peerID, now.Add(delay-time.Millisecond)); due {
+			t.Fatalf("attempt %d: reconnect is due before backoff elapsed", i)
+		}
+		now = now.Add(delay)
+	}
+
+	// Successful connection resets backoff
+	c.contactBackoff.Delete(peerID)
+	if delay, due := c.nextBackoff(peerID, now); !due || delay != time.Second {
+		t.Fatalf("expected reset backoff, got delay=%v due=%v", delay, due)
+	}
+
+	// A peer who hung up on purpose is left alone for the cooldown
+	c.SetReconnectCooldown(time.Minute)
+	c.startCooldown(peerID, now)
+	if _, due := c.nextBackoff(peerID, now.Add(time.Minute-time.Millisecond)); due {
+		t.Fatal("reconnect is due during cooldown")
+	}
+	if delay, due := c.nextBackoff(peerID, now.Add(time.Minute)); !due || delay != time.Second {
+		t.Fatalf("expected reconnect after cooldown, got delay=%v due=%v", delay, due)
+	}
+}
+
+func TestParseTypingMessage(t *testing.T) {
+	msg, ok := parseTypingMessage([]byte(`{"type":"typing","state":"start"}`))
+	if !ok || msg.State != TypingStateStart {
+		t.Fatalf("Expected typing start, got %+v, %v", msg, ok)
+	}
+
+	for _, data := range []string{"hello", `{"type":2,"transfer_id":"abc"}`, `{"type":"other"}`} {
+		if _, ok := parseTypingMessage([]byte(data)); ok {
+			t.Errorf("Unexpected typing message for %q", data)
+		}
+	}
+}
+
+func TestHandleEditEnvelope(t *testing.T) {
+	c := &Chat{events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+
+	peer := router.PeerID{1}
+	if err := c.storage.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{PeerID: peer, Content: "helo", Timestamp: time.Now()}
+	if err := c.storage.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte(`{"type":"edit","orig_id":"` + MessageContentHash("helo") + `","content":"hello"}`)
+	env, ok := parseEditEnvelope(data)
+	if !ok {
+		t.Fatal("Expected edit envelope")
+	}
+	c.handleEditEnvelope(peer, env)
+
+	select {
+	case event := <-c.events:
+		if event.Type != ChatEventMessageEdited || event.Message.Content != "hello" || !event.Message.IsEdited() {
+			t.Fatalf("Unexpected event: %+v", event)
+		}
+	default:
+		t.Fatal("Expected ChatEventMessageEdited")
+	}
+
+	// Edits from another peer do not touch the message
+	c.handleEditEnvelope(router.PeerID{2}, &EditEnvelope{Type: EditMessageType, OrigID: MessageContentHash("helo"), Content: "hacked"})
+	stored, err := c.storage.GetMessage(msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Content != "hello" {
+		t.Fatalf("Unexpected content %q", stored.Content)
+	}
+}
+
+func TestTypingRateLimit(t *testing.T) {
+	c := &Chat{}
+	peerID := router.PeerID{1}
+	now := time.Now()
+
+	steps := []struct {
+		after  time.Duration
+		typing bool
+		sent   bool
+	}{
+		{0, false, false},                     // Stop without start is not sent
+		{0, true, true},                       // First start
+		{500 * time.Millisecond, true, false}, // Rate limited
+		{600 * time.Millisecond, false, true}, // Stop after start is always sent
+		{700 * time.Millisecond, true, false}, // Start within a second of the last one
+		{2 * time.Second, true, true},
+	}
+	for i, step := range steps {
+		if sent := c.shouldSendTyping(peerID, step.typing, now.Add(step.after)); sent != step.sent {
+			t.Errorf("Step %d: expected sent=%v, got %v", i, step.sent, sent)
+		}
+	}
+}
+
+func TestTypingAutoStop(t *testing.T) {
+	c := &Chat{events: make(chan ChatEvent, 10), typingTimeout: 50 * time.Millisecond}
+	peerID := router.PeerID{1}
+
+	c.handleTypingMessage(peerID, &TypingMessage{Type: TypingMessageType, State: TypingStateStart})
+	c.handleTypingMessage(peerID, &TypingMessage{Type: TypingMessageType, State: TypingStateStart})
+	if !c.IsTyping(peerID) {
+		t.Fatal("Expected peer to be typing")
+	}
+
+	// The lost "stop" is replaced by the timeout
+	for _, want := range []ChatEventType{ChatEventTypingStarted, ChatEventTypingStopped} {
+		select {
+		case event := <-c.events:
+			if event.Type != want || event.PeerID != peerID {
+				t.Fatalf("Expected event %v, got %+v", want, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for event %v", want)
+		}
+	}
+	if c.IsTyping(peerID) {
+		t.Fatal("Expected typing to stop after timeout")
+	}
+
+	// Explicit stop emits a single event
+	c.handleTypingMessage(peerID, &TypingMessage{Type: TypingMessageType, State: TypingStateStart})
+	c.handleTypingMessage(peerID, &TypingMessage{Type: TypingMessageType, State: TypingStateStop})
+	c.handleTypingMessage(peerID, &TypingMessage{Type: TypingMessageType, State: TypingStateStop})
+	if len(c.events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(c.events))
+	}
+}
+
+func TestRouterConnectionLost(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := router.NewRouter(router.RouterConfig{})
+	go r.Serve(lis)
+
+	pubKey, privKey, _ := ed25519.GenerateKey(nil)
+	var myID router.PeerID
+	copy(myID[:], pubKey)
+
+	client := router.NewClient(pubKey, privKey)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	income, err := client.Dial(ctx, lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connector, err := p2p.NewConnector(client, p2p.ConnectorConfig{}, income, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChat(connector, newTestStorage(t), t.TempDir())
+	defer c.Close()
+
+	// Останавливаем router посреди сессии
+	time.Sleep(100 * time.Millisecond)
+	lis.Close()
+	if err := r.Disconnect(myID); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-c.Events():
+			if event.Type != ChatEventError || !errors.Is(event.Error, p2p.ErrRouterDisconnected) {
+				continue
+			}
+			if want := "lost connection to router: EOF"; event.Error.Error() != want {
+				t.Fatalf("Expected %q, got %q", want, event.Error)
+			}
+			return
+		case <-timeout:
+			t.Fatal("Timeout waiting for router connection error")
+		}
+	}
+}
+
+func TestHandleDeleteEnvelope(t *testing.T) {
+	c := &Chat{events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+
+	peer := router.PeerID{1}
+	if err := c.storage.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{PeerID: peer, Content: "oops", Timestamp: time.Now()}
+	if err := c.storage.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deletes from another peer do not touch the message
+	c.handleDeleteEnvelope(router.PeerID{2}, &DeleteEnvelope{Type: DeleteMessageType, OrigID: MessageContentHash("oops")})
+	if _, err := c.storage.GetMessage(msg.ID); err != nil {
+		t.Fatalf("Message deleted by another peer: %v", err)
+	}
+
+	data := []byte(`{"type":"delete","orig_id":"` + MessageContentHash("oops") + `"}`)
+	env, ok := parseDeleteEnvelope(data)
+	if !ok {
+		t.Fatal("Expected delete envelope")
+	}
+	if _, ok := parseEditEnvelope(data); ok {
+		t.Fatal("Delete envelope parsed as edit")
+	}
+	c.handleDeleteEnvelope(peer, env)
+
+	select {
+	case event := <-c.events:
+		if event.Type != ChatEventMessageDeleted || event.Message.ID != msg.ID {
+			t.Fatalf("Unexpected event: %+v", event)
+		}
+	default:
+		t.Fatal("Expected ChatEventMessageDeleted")
+	}
+	if _, err := c.storage.GetMessage(msg.ID); err != sql.ErrNoRows {
+		t.Fatalf("Expected message to be deleted, got %v", err)
+	}
+}
+
+func TestHandleReadReceipt(t *testing.T) {
+	c := &Chat{events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+
+	peer := router.PeerID{1}
+	if err := c.storage.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{PeerID: peer, Content: "hi", Timestamp: time.Now(), IsOutgoing: true}
+	if err := c.storage.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte(`{"type":"read","ids":["` + MessageContentHash("hi") + `","` + MessageContentHash("unknown") + `"]}`)
+	receipt, ok := parseReadReceipt(data)
+	if !ok {
+		t.Fatal("Expected read receipt")
+	}
+	if _, ok := parseTypingMessage(data); ok {
+		t.Fatal("Read receipt parsed as typing message")
+	}
+	c.handleReadReceipt(peer, receipt)
+
+	select {
+	case event := <-c.events:
+		if event.Type != ChatEventMessageRead || event.Message.ID != msg.ID || event.Message.ReadAt == nil {
+			t.Fatalf("Unexpected event: %+v", event)
+		}
+	default:
+		t.Fatal("Expected ChatEventMessageRead")
+	}
+	select {
+	case event := <-c.events:
+		t.Fatalf("Unexpected event for unknown message: %+v", event)
+	default:
+	}
+}
+
+func TestReadReceiptRateLimit(t *testing.T) {
+	c := &Chat{connector: p2ptest.NewMockConnector()}
+	peer := router.PeerID{1}
+
+	pending := func() ([]string, bool) {
+		c.readMu.Lock()
+		defer c.readMu.Unlock()
+		state := c.readSent[peer]
+		return slices.Clone(state.pending), state.timer != nil
+	}
+
+	// The first receipt goes out at once
+	c.queueReadReceipt(peer, []string{"a"}, time.Now())
+	if ids, scheduled := pending(); len(ids) != 0 || scheduled {
+		t.Fatalf("Expected first receipt to be sent, pending %v, scheduled %v", ids, scheduled)
+	}
+
+	// Receipts within readReceiptInterval are batched
+	c.queueReadReceipt(peer, []string{"b"}, time.Now())
+	c.queueReadReceipt(peer, []string{"c"}, time.Now())
+	if ids, scheduled := pending(); !slices.Equal(ids, []string{"b", "c"}) || !scheduled {
+		t.Fatalf("Expected batched receipt, pending %v, scheduled %v", ids, scheduled)
+	}
+
+	deadline := time.Now().Add(2 * readReceiptInterval)
+	for {
+		if ids, scheduled := pending(); len(ids) == 0 && !scheduled {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Batched receipt was not flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleConnectorEvents(t *testing.T) {
+	peer := router.PeerID{1}
+	edit := `{"type":"edit","orig_id":"` + MessageContentHash("missing") + `","content":"x"}`
+
+	tests := []struct {
+		name   string
+		setup  func(t *testing.T, c *Chat)
+		events []p2p.Event
+		want   []ChatEventType
+		check  func(t *testing.T, events []ChatEvent)
+
+		connecting bool // IsConnecting after the events
+		online     bool // IsOnline after the events
+	}{
+		{
+			name:   "connected adds contact",
+			events: []p2p.Event{{Type: p2p.EventConnected, PeerID: peer}},
+			want:   []ChatEventType{ChatEventContactAdded, ChatEventContactOnline},
+			online: true,
+			check: func(t *testing.T, events []ChatEvent) {
+				if events[1].Relayed {
+					t.Error("Direct connection reported as relayed")
+				}
+			},
+		},
+		{
+			name:   "connected via relay",
+			events: []p2p.Event{{Type: p2p.EventConnectedRelay, PeerID: peer}},
+			want:   []ChatEventType{ChatEventContactAdded, ChatEventContactOnline},
+			online: true,
+			check: func(t *testing.T, events []ChatEvent) {
+				if !events[1].Relayed {
+					t.Error("Relay connection not reported as relayed")
+				}
+			},
+		},
+		{
+			name:   "disconnected",
+			events: []p2p.Event{{Type: p2p.EventDisconnected, PeerID: peer}},
+			want:   []ChatEventType{ChatEventContactOffline},
+		},
+		{
+			name: "connected then disconnected",
+			events: []p2p.Event{
+				{Type: p2p.EventConnected, PeerID: peer},
+				{Type: p2p.EventDisconnected, PeerID: peer},
+			},
+			want: []ChatEventType{ChatEventContactAdded, ChatEventContactOnline, ChatEventContactOffline},
+		},
+		{
+			name: "reconnecting then restored",
+			events: []p2p.Event{
+				{Type: p2p.EventConnected, PeerID: peer},
+				{Type: p2p.EventReconnecting, PeerID: peer},
+				{Type: p2p.EventConnected, PeerID: peer},
+			},
+			want:   []ChatEventType{ChatEventContactAdded, ChatEventContactOnline, ChatEventContactReconnecting, ChatEventContactOnline},
+			online: true,
+		},
+		{
+			name: "connecting",
+			events: []p2p.Event{
+				{Type: p2p.EventConnectionStateChanged, PeerID: peer, ConnectionState: webrtc.PeerConnectionStateNew},
+				{Type: p2p.EventICEStateChanged, PeerID: peer, ICEState: webrtc.ICEConnectionStateChecking},
+				{Type: p2p.EventConnectionStateChanged, PeerID: peer, ConnectionState: webrtc.PeerConnectionStateConnecting},
+			},
+			want:       []ChatEventType{ChatEventContactConnecting},
+			connecting: true,
+		},
+		{
+			name: "connecting then connected",
+			events: []p2p.Event{
+				{Type: p2p.EventICEStateChanged, PeerID: peer, ICEState: webrtc.ICEConnectionStateChecking},
+				{Type: p2p.EventICEStateChanged, PeerID: peer, ICEState: webrtc.ICEConnectionStateConnected},
+				{Type: p2p.EventConnectionStateChanged, PeerID: peer, ConnectionState: webrtc.PeerConnectionStateConnected},
+				{Type: p2p.EventConnected, PeerID: peer},
+			},
+			want:   []ChatEventType{ChatEventContactConnecting, ChatEventContactAdded, ChatEventContactOnline},
+			online: true,
+		},
+		{
+			name:   "stranger found on local network",
+			events: []p2p.Event{{Type: p2p.EventPeerDiscovered, PeerID: peer}},
+			want:   []ChatEventType{ChatEventPeerDiscovered},
+			check: func(t *testing.T, events []ChatEvent) {
+				if events[0].Contact != nil {
+					t.Errorf("Unexpected contact for a stranger: %+v", events[0].Contact)
+				}
+			},
+		},
+		{
+			name:   "text message",
+			events: []p2p.Event{{Type: p2p.EventDataReceived, PeerID: peer, Data: []byte("hello")}},
+			want:   []ChatEventType{ChatEventContactAdded, ChatEventMessageReceived},
+			check: func(t *testing.T, events []ChatEvent) {
+				if msg := events[1].Message; msg == nil || msg.Content != "hello" || msg.IsOutgoing {
+					t.Errorf("Unexpected message: %+v", msg)
+				}
+			},
+		},
+		{
+			name: "muted contact doesn't notify",
+			setup: func(t *testing.T, c *Chat) {
+				if err := c.storage.AddContact(peer, "peer"); err != nil {
+					t.Fatal(err)
+				}
+				if err := c.MuteContact(peer, time.Time{}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			events: []p2p.Event{
+				{Type: p2p.EventDataReceived, PeerID: peer, Data: []byte("hello")},
+				{Type: p2p.EventDisconnected, PeerID: peer},
+			},
+			want: []ChatEventType{ChatEventContactOffline},
+		},
+		{
+			name: "typing indicator",
+			events: []p2p.Event{
+				{Type: p2p.EventDataReceived, PeerID: peer, Data: []byte(`{"type":"typing","state":"start"}`)},
+				{Type: p2p.EventDataReceived, PeerID: peer, Data: []byte(`{"type":"typing","state":"stop"}`)},
+			},
+			want: []ChatEventType{ChatEventTypingStarted, ChatEventTypingStopped},
+		},
+		{
+			name: "edit of unknown message is dropped",
+			events: []p2p.Event{
+				{Type: p2p.EventDataReceived, PeerID: peer, Data: []byte(edit)},
+				{Type: p2p.EventDisconnected, PeerID: peer},
+			},
+			want: []ChatEventType{ChatEventContactOffline},
+		},
+		{
+			name:   "connection failed",
+			events: []p2p.Event{{Type: p2p.EventConnectionFailed, PeerID: peer, Error: p2p.ErrICEFailed}},
+			want:   []ChatEventType{ChatEventConnectionFailed},
+			check: func(t *testing.T, events []ChatEvent) {
+				if !errors.Is(events[0].Error, p2p.ErrICEFailed) {
+					t.Errorf("Unexpected error: %v", events[0].Error)
+				}
+			},
+		},
+		{
+			name:   "connection request",
+			events: []p2p.Event{{Type: p2p.EventConnectionRequest, PeerID: peer}},
+			want:   []ChatEventType{ChatEventConnectionRequest},
+		},
+		{
+			name:   "error",
+			events: []p2p.Event{{Type: p2p.EventError, Error: p2p.ErrRouterDisconnected}},
+			want:   []ChatEventType{ChatEventError},
+			check: func(t *testing.T, events []ChatEvent) {
+				if !errors.Is(events[0].Error, p2p.ErrRouterDisconnected) {
+					t.Errorf("Unexpected error: %v", events[0].Error)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connector := p2ptest.NewMockConnector()
+			c := &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: newTestStorage(t), fileTransferMgr: NewFileTransferManager(nil, t.TempDir())}
+			if tt.setup != nil {
+				tt.setup(t, c)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				c.handleConnectorEvents()
+				close(done)
+			}()
+			for _, event := range tt.events {
+				connector.Inject() <- event
+			}
+			connector.Close()
+			<-done
+			if c.IsConnecting(peer) != tt.connecting {
+				t.Errorf("Expected connecting %v", tt.connecting)
+			}
+			if tt.connecting && c.PeerState(peer) != p2p.PeerStateConnecting {
+				t.Errorf("Expected PeerStateConnecting, got %v", c.PeerState(peer))
+			}
+			if c.IsOnline(peer) != tt.online {
+				t.Errorf("Expected online %v", tt.online)
+			}
+			if online := c.GetOnlinePeers(); (len(online) == 1 && online[0] == peer) != tt.online || len(online) > 1 {
+				t.Errorf("Unexpected online peers %v", online)
+			}
+
+			var got []ChatEvent
+			var gotTypes []ChatEventType
+			for len(c.events) > 0 {
+				event := <-c.events
+				got = append(got, event)
+				gotTypes = append(gotTypes, event.Type)
+			}
+			if !slices.Equal(gotTypes, tt.want) {
+				t.Fatalf("Expected events %v, got %v", tt.want, gotTypes)
+			}
+			for _, event := range got {
+				if event.Type != ChatEventError && event.PeerID != peer {
+					t.Errorf("Event %v for unexpected peer %x", event.Type, event.PeerID[:4])
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, got)
+			}
+		})
+	}
+}
+
+func TestChatUsesConnector(t *testing.T) {
+	connector := p2ptest.NewMockConnector()
+	c := &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+
+	peer := router.PeerID{1}
+	if err := c.storage.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Online status follows connector events, not the connector's peers
+	connector.SetPeer(&p2p.Peer{ID: peer})
+	if c.IsOnline(peer) {
+		t.Fatal("Peer must stay offline until EventConnected")
+	}
+
+	connector.SetStats(peer, p2p.PeerStats{RTT: time.Millisecond, BufferedAmount: 42})
+	if stats, ok := c.GetPeerStats(peer); !ok || stats.RTT != time.Millisecond || stats.BufferedAmount != 42 {
+		t.Fatalf("Unexpected peer stats: %+v, %v", stats, ok)
+	}
+	if _, ok := c.GetPeerStats(router.PeerID{9}); ok {
+		t.Fatal("Expected no stats for unknown peer")
+	}
+
+	if err := c.BlockContact(peer); err != nil {
+		t.Fatal(err)
+	}
+	if !connector.IsBlacklisted(peer) {
+		t.Fatal("Blocked contact must be blacklisted")
+	}
+	if err := c.UnblockContact(peer); err != nil {
+		t.Fatal(err)
+	}
+	if connector.IsBlacklisted(peer) {
+		t.Fatal("Unblocked contact must be removed from the blacklist")
+	}
+
+	if err := c.Disconnect(peer); err != nil {
+		t.Fatal(err)
+	}
+	if calls := connector.CallsTo("Disconnect"); len(calls) != 1 || calls[0].Args[0] != peer {
+		t.Fatalf("Unexpected Disconnect calls: %+v", calls)
+	}
+
+	// Rejected attempts are reported right away, others through events
+	hexID := hex.EncodeToString(peer[:])
+	if err := c.startConnect(context.Background(), hexID); err != nil {
+		t.Fatalf("Unexpected connect error: %v", err)
+	}
+	connector.ConnectErr = errors.New("peer is blacklisted")
+	if err := c.startConnect(context.Background(), hexID); err != connector.ConnectErr {
+		t.Fatalf("Expected rejected attempt, got %v", err)
+	}
+	if calls := connector.CallsTo("ConnectContext"); len(calls) != 2 || calls[0].Args[0] != hexID {
+		t.Fatalf("Unexpected ConnectContext calls: %+v", calls)
+	}
+}
+
+func TestHandleGroupEnvelope(t *testing.T) {
+	connector := p2ptest.NewMockConnector()
+	connector.ID = router.PeerID{1}
+	c := &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+
+	self, alice, mallory := connector.ID, router.PeerID{2}, router.PeerID{3}
+	groupID := router.PeerID{9}
+	hexes := func(ids ...router.PeerID) []string {
+		var out []string
+		for _, id := range ids {
+			out = append(out, hex.EncodeToString(id[:]))
+		}
+		return out
+	}
+
+	// A group that doesn't list us is dropped
+	data := []byte(`{"group_id":"` + hex.EncodeToString(groupID[:]) + `","content":"hi"}`)
+	env, ok := parseGroupEnvelope(data)
+	if !ok {
+		t.Fatal("Expected group envelope")
+	}
+	if _, ok := parseReadReceipt(data); ok {
+		t.Fatal("Group envelope parsed as read receipt")
+	}
+	c.handleGroupEnvelope(alice, env)
+	if _, err := c.storage.GetGroup(groupID); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("Expected unknown group to be dropped, got %v", err)
+	}
+
+	// A group ID that is a peer's ID is dropped
+	if err := c.storage.AddContact(router.PeerID{4}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []router.PeerID{self, alice, mallory, {4}} {
+		spoof := &GroupEnvelope{GroupID: hex.EncodeToString(id[:]), Content: "hi", Members: hexes(alice, self, mallory)}
+		c.handleGroupEnvelope(alice, spoof)
+		if _, err := c.storage.GetGroup(id); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("Expected group %x to be dropped, got %v", id[:1], err)
+		}
+	}
+	if len(c.events) != 0 {
+		t.Fatalf("Unexpected event: %+v", <-c.events)
+	}
+
+	// The first message of a group listing us and the sender joins it
+	env.Name = "team"
+	env.Members = hexes(alice, self, mallory)
+	c.handleGroupEnvelope(alice, env)
+	select {
+	case event := <-c.events:
+		if event.Type != ChatEventGroupMessageReceived || event.PeerID != groupID || event.Message.SenderID != alice {
+			t.Fatalf("Unexpected event: %+v", event)
+		}
+	default:
+		t.Fatal("Expected ChatEventGroupMessageReceived")
+	}
+	group, err := c.storage.GetGroup(groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Name != "team" || !slices.Equal(group.Members, []router.PeerID{alice, mallory}) {
+		t.Fatalf("Unexpected group: %+v", group)
+	}
+
+	// Members listed in later messages don't change the group
+	if err := c.storage.SaveGroup(&Group{ID: groupID, Name: "team", Members: []router.PeerID{alice}}); err != nil {
+		t.Fatal(err)
+	}
+	c.handleGroupEnvelope(mallory, env)
+	select {
+	case event := <-c.events:
+		t.Fatalf("Unexpected event from non-member: %+v", event)
+	default:
+	}
+	msgs, err := c.storage.GetMessages(groupID, 10)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Expected one group message, got %d, %v", len(msgs), err)
+	}
+}
+
+func TestSendGroupMessage(t *testing.T) {
+	connector := p2ptest.NewMockConnector()
+	connector.ID = router.PeerID{1}
+	c := &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+
+	if _, err := c.CreateGroup("solo", []router.PeerID{connector.ID}); err == nil {
+		t.Fatal("Expected error for a group without other members")
+	}
+	group, err := c.CreateGroup("team", []router.PeerID{{2}, {3}, {2}, connector.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(group.Members, []router.PeerID{{2}, {3}}) {
+		t.Fatalf("Unexpected members: %v", group.Members)
+	}
+
+	if err := c.SendMessage(context.Background(), group.ID, "hi"); err == nil {
+		t.Fatal("Expected error with no members online")
+	}
+
+	contacts, err := c.GetContacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || !contacts[0].IsGroup || contacts[0].PeerID != group.ID {
+		t.Fatalf("Expected the group in contacts, got %+v", contacts)
+	}
+}
+
+// TestSendMessageConnects checks that sending to an offline contact starts
+// connecting and waits for the connection up to the connect timeout
+func TestSendMessageConnects(t *testing.T) {
+	connector := p2ptest.NewMockConnector()
+	c := &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+	c.SetConnectTimeout(50 * time.Millisecond)
+	peer := router.PeerID{2}
+
+	start := time.Now()
+	if err := c.SendMessage(context.Background(), peer, "hi"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected timeout waiting for the peer, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Connect timeout took %v", elapsed)
+	}
+	hexID := hex.EncodeToString(peer[:])
+	if calls := connector.CallsTo("ConnectContext"); len(calls) != 1 || calls[0].Args[0] != hexID {
+		t.Fatalf("Expected a connection attempt, got %+v", calls)
+	}
+	if calls := connector.CallsTo("WaitForPeer"); len(calls) != 1 || calls[0].Args[0] != peer {
+		t.Fatalf("Expected a wait for the peer, got %+v", calls)
+	}
+
+	// A failed attempt ends the wait with its error
+	connector.WaitErr = p2p.ErrConnectionFailed
+	if err := c.SendMessage(context.Background(), peer, "hi"); !errors.Is(err, p2p.ErrConnectionFailed) {
+		t.Fatalf("Expected ErrConnectionFailed, got %v", err)
+	}
+
+	// A rejected attempt is not waited for
+	connector.ConnectErr = errors.New("peer is blacklisted")
+	if err := c.SendMessage(context.Background(), peer, "hi"); !errors.Is(err, connector.ConnectErr) {
+		t.Fatalf("Expected rejected attempt, got %v", err)
+	}
+	if calls := connector.CallsTo("WaitForPeer"); len(calls) != 2 {
+		t.Fatalf("Expected no wait after a rejected attempt, got %d waits", len(calls))
+	}
+}
+
+func TestBroadcastMessage(t *testing.T) {
+	connector := p2ptest.NewMockConnector()
+	c := &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+
+	alice, bob, carol := router.PeerID{1}, router.PeerID{2}, router.PeerID{3}
+	for _, id := range []router.PeerID{alice, bob, carol} {
+		connector.SetPeer(&p2p.Peer{ID: id})
+	}
+	connector.SendErrs = map[router.PeerID]error{carol: p2p.ErrChannelNotFound}
+
+	failures := c.BroadcastMessage("hello all")
+	if len(failures) != 1 || !errors.Is(failures[carol], p2p.ErrChannelNotFound) {
+		t.Fatalf("Expected only carol to fail, got %v", failures)
+	}
+	if calls := connector.CallsTo("SendAll"); len(calls) != 1 || string(calls[0].Args[0].([]byte)) != "hello all" {
+		t.Fatalf("Expected one SendAll call, got %+v", calls)
+	}
+
+	// One saved message and one event per peer the message reached
+	var sent []router.PeerID
+	for range 2 {
+		event := <-c.events
+		if event.Type != ChatEventMessageSent || event.Message.Content != "hello all" {
+			t.Fatalf("Unexpected event: %+v", event)
+		}
+		sent = append(sent, event.PeerID)
+	}
+	if len(c.events) != 0 {
+		t.Fatalf("Expected no more events, got %d", len(c.events))
+	}
+	for _, id := range []router.PeerID{alice, bob} {
+		if !slices.Contains(sent, id) {
+			t.Fatalf("Expected sent event for peer %d", id[0])
+		}
+		msgs, err := c.storage.GetMessages(id, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 1 || !msgs[0].IsOutgoing || msgs[0].Content != "hello all" {
+			t.Fatalf("Expected one outgoing message for peer %d, got %+v", id[0], msgs)
+		}
+	}
+	if msgs, err := c.storage.GetMessages(carol, 10); err != nil || len(msgs) != 0 {
+		t.Fatalf("Expected no message for the failed peer, got %d, %v", len(msgs), err)
+	}
+}
+
+func TestContactVerification(t *testing.T) {
+	connector := p2ptest.NewMockConnector()
+	connector.ID = router.PeerID{1}
+	connector.EncKey = p2p.Curve25519PublicKey{1}
+	c := &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+
+	peer := router.PeerID{2}
+	if err := c.storage.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetSafetyNumber(peer); !errors.Is(err, ErrNoContactKey) {
+		t.Fatalf("Expected ErrNoContactKey before the first connection, got %v", err)
+	}
+	if err := c.SetContactVerified(peer, true); !errors.Is(err, ErrNoContactKey) {
+		t.Fatalf("Expected ErrNoContactKey when verifying without a key, got %v", err)
+	}
+
+	peerKey := p2p.Curve25519PublicKey{2}
+	connector.SetPeerKey(peer, peerKey)
+	c.checkContactKey(peer)
+	if len(c.events) != 0 {
+		t.Fatalf("Unexpected event for the first key: %+v", <-c.events)
+	}
+
+	// The contact computes the same number from its side
+	number, err := c.GetSafetyNumber(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := p2p.SafetyNumber(peer[:], &peerKey, connector.ID[:], &connector.EncKey); number != want {
+		t.Fatalf("Expected safety number %q, got %q", want, number)
+	}
+	if err := c.SetContactVerified(peer, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reconnecting with the same key keeps verification, a new key clears it
+	c.checkContactKey(peer)
+	if contact, err := c.storage.GetContact(peer); err != nil || !contact.Verified {
+		t.Fatalf("Expected contact to stay verified, got %+v, %v", contact, err)
+	}
+	connector.SetPeerKey(peer, p2p.Curve25519PublicKey{3})
+	c.checkContactKey(peer)
+	select {
+	case event := <-c.events:
+		if event.Type != ChatEventContactKeyChanged || event.PeerID != peer {
+			t.Fatalf("Unexpected event: %+v", event)
+		}
+	default:
+		t.Fatal("Expected ChatEventContactKeyChanged")
+	}
+	if contact, err := c.storage.GetContact(peer); err != nil || contact.Verified || *contact.EncKey != (p2p.Curve25519PublicKey{3}) {
+		t.Fatalf("Expected new key and no verification, got %+v, %v", contact, err)
+	}
+	if newNumber, err := c.GetSafetyNumber(peer); err != nil || newNumber == number {
+		t.Fatalf("Expected a new safety number, got %q, %v", newNumber, err)
+	}
+}
+
+func TestConnectionMode(t *testing.T) {
+	storage := newTestStorage(t)
+	connector := p2ptest.NewMockConnector()
+	c := &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: storage}
+
+	// Nothing saved: the connector keeps its open default
+	c.loadConnectionMode()
+	if calls := connector.CallsTo("SetConnectionPolicy"); len(calls) != 0 {
+		t.Fatalf("Unexpected policy change without a saved mode: %v", calls)
+	}
+
+	if err := c.SetConnectionMode(p2p.ConnectionManual); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := storage.GetSetting(connectionModeSetting); err != nil || value != "manual" {
+		t.Fatalf("Expected saved mode %q, got %q, %v", "manual", value, err)
+	}
+
+	// A restarted chat restores the mode
+	connector = p2ptest.NewMockConnector()
+	c = &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: storage}
+	c.loadConnectionMode()
+	policy := connector.Policy()
+	if policy.Mode != p2p.ConnectionManual || c.ConnectionMode() != p2p.ConnectionManual {
+		t.Fatalf("Expected manual mode after restart, got %v", policy.Mode)
+	}
+
+	// Blocked contacts and strangers are not trusted
+	contact, blocked, stranger := router.PeerID{1}, router.PeerID{2}, router.PeerID{3}
+	for _, peer := range []router.PeerID{contact, blocked} {
+		if err := storage.AddContact(peer, "peer"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.SetBlocked(blocked, true); err != nil {
+		t.Fatal(err)
+	}
+	if !policy.IsContact(contact) || policy.IsContact(blocked) || policy.IsContact(stranger) {
+		t.Fatal("IsContact must accept only unblocked contacts")
+	}
+
+	c.ApproveConnection(stranger)
+	c.RejectConnection(blocked)
+	if calls := connector.CallsTo("Approve"); len(calls) != 1 || calls[0].Args[0] != stranger {
+		t.Fatalf("Expected Approve(%x), got %v", stranger[:1], calls)
+	}
+	if calls := connector.CallsTo("Reject"); len(calls) != 1 || calls[0].Args[0] != blocked {
+		t.Fatalf("Expected Reject(%x), got %v", blocked[:1], calls)
+	}
+}
+
+// TestBlacklistPersists checks that p2p blocks are restored after a restart
+func TestBlacklistPersists(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	pubKey, privKey, _ := ed25519.GenerateKey(nil)
+	contact, stranger := router.PeerID{1}, router.PeerID{2}
+
+	// start opens storage and creates a connector the way the chat command does
+	start := func() (*Storage, *p2p.Connector) {
+		storage, err := NewStorage(dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blacklist, err := storage.GetBlockedPeers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		connector, err := p2p.NewConnector(router.NewClient(pubKey, privKey), p2p.ConnectorConfig{
+			Blacklist: blacklist,
+			BlacklistChanged: func(peerID router.PeerID, blocked bool) {
+				if err := storage.SetPeerBlocked(peerID, blocked); err != nil {
+					t.Error(err)
+				}
+			},
+		}, nil, privKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage, connector
+	}
+
+	storage, connector := start()
+	if err := storage.AddContact(contact, "contact"); err != nil {
+		t.Fatal(err)
+	}
+	c := &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: storage}
+	if err := c.BlockContact(contact); err != nil {
+		t.Fatal(err)
+	}
+	connector.AddToBlacklist(stranger)
+	connector.Close()
+	storage.Close()
+
+	storage, connector = start()
+	if !connector.IsBlacklisted(contact) || !connector.IsBlacklisted(stranger) {
+		t.Fatalf("Expected both peers blocked after restart, got %v", connector.GetBlacklist())
+	}
+	if _, err := storage.GetContact(stranger); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("Blocked stranger must not become a contact, got %v", err)
+	}
+
+	// Unblocking is saved too
+	c = &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: storage}
+	if err := c.UnblockContact(contact); err != nil {
+		t.Fatal(err)
+	}
+	connector.RemoveFromBlacklist(stranger)
+	connector.Close()
+	storage.Close()
+
+	storage, connector = start()
+	defer storage.Close()
+	defer connector.Close()
+	if blocked := connector.GetBlacklist(); len(blocked) != 0 {
+		t.Fatalf("Expected empty blacklist after unblocking, got %v", blocked)
+	}
+}
@@ -0,0 +1,32 @@
+package chat
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/atotto/clipboard"
+)
+
+// writeClipboard puts text on the OS clipboard. On Linux it runs xclip,
+// xsel or wl-copy, so it works without CGO but fails on headless machines
+var writeClipboard = clipboard.WriteAll
+
+// clipboardFallback receives text that could not be copied
+var clipboardFallback io.Writer = os.Stderr
+
+// copyText copies text to the clipboard. If there is no clipboard, e.g.
+// over SSH, the text is printed to clipboardFallback instead and copied is
+// false, so the user can still get it with 2>file
+func copyText(text string) (copied bool, err error) {
+	err = writeClipboard(text)
+	if err == nil {
+		return true, nil
+	}
+	slog.Warn("Clipboard unavailable, printing to stderr", "error", err)
+	if _, err := fmt.Fprintln(clipboardFallback, text); err != nil {
+		return false, fmt.Errorf("print copied text: %w", err)
+	}
+	return false, nil
+}
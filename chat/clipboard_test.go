@@ -0,0 +1,35 @@
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCopyTextFallback(t *testing.T) {
+	var fallback bytes.Buffer
+	var clipboard string
+	oldWrite, oldFallback := writeClipboard, clipboardFallback
+	t.Cleanup(func() { writeClipboard, clipboardFallback = oldWrite, oldFallback })
+	clipboardFallback = &fallback
+
+	writeClipboard = func(text string) error {
+		clipboard = text
+		return nil
+	}
+	if copied, err := copyText("hello"); err != nil || !copied || clipboard != "hello" {
+		t.Fatalf("Expected text on the clipboard, got %q, %v, %v", clipboard, copied, err)
+	}
+	if fallback.Len() != 0 {
+		t.Fatalf("Unexpected fallback output: %q", fallback.String())
+	}
+
+	// Headless terminal: no xclip, xsel or wl-copy
+	writeClipboard = func(string) error { return errors.New("no clipboard utilities") }
+	if copied, err := copyText("over ssh"); err != nil || copied {
+		t.Fatalf("Expected fallback, got %v, %v", copied, err)
+	}
+	if fallback.String() != "over ssh\n" {
+		t.Fatalf("Expected text printed to the fallback, got %q", fallback.String())
+	}
+}
@@ -0,0 +1,105 @@
+package chat
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/udisondev/sendy/router"
+)
+
+const DeleteMessageType = "delete"
+
+// DeleteEnvelope deletes a previously sent message over the data channel.
+// OrigID is the ContentHash of the original message
+type DeleteEnvelope struct {
+	Type   string `json:"type"`
+	OrigID string `json:"orig_id"`
+}
+
+// parseDeleteEnvelope reports whether data is a message deletion
+func parseDeleteEnvelope(data []byte) (*DeleteEnvelope, bool) {
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return nil, false
+	}
+	var env DeleteEnvelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Type != DeleteMessageType {
+		return nil, false
+	}
+	return &env, true
+}
+
+// DeleteMessage soft-deletes a message. Deleting a sent message also deletes
+// it on the contact's side if the contact is online
+func (c *Chat) DeleteMessage(messageID int64) error {
+	msg, err := c.storage.GetMessage(messageID)
+	if err != nil {
+		return fmt.Errorf("get message: %w", err)
+	}
+
+	hexID := hex.EncodeToString(msg.PeerID[:8])
+	slog.Debug("Deleting message", "peerID", hexID+"...", "messageID", messageID)
+
+	if msg.IsOutgoing {
+		if peer, ok := c.connector.GetPeer(msg.PeerID); ok {
+			origID := msg.ContentHash
+			if origID == "" {
+				origID = MessageContentHash(msg.Content)
+			}
+			data, err := json.Marshal(DeleteEnvelope{Type: DeleteMessageType, OrigID: origID})
+			if err != nil {
+				return fmt.Errorf("marshal delete message: %w", err)
+			}
+			if err := peer.Send(data); err != nil {
+				slog.Error("Failed to send delete", "peerID", hexID+"...", "error", err)
+				return fmt.Errorf("send: %w", err)
+			}
+		} else {
+			slog.Warn("Peer not connected, message deleted only locally", "peerID", hexID+"...")
+		}
+	}
+
+	return c.applyDelete(msg)
+}
+
+// handleDeleteEnvelope deletes the message the peer sent earlier
+func (c *Chat) handleDeleteEnvelope(peerID router.PeerID, env *DeleteEnvelope) {
+	hexID := hex.EncodeToString(peerID[:8])
+
+	msg, err := c.storage.GetMessageByHash(peerID, env.OrigID, false)
+	if errors.Is(err, sql.ErrNoRows) {
+		slog.Warn("Deleted message not found", "peerID", hexID+"...", "origID", env.OrigID)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to find deleted message", "peerID", hexID+"...", "error", err)
+		return
+	}
+
+	if err := c.applyDelete(msg); err != nil {
+		slog.Error("Failed to apply delete", "peerID", hexID+"...", "messageID", msg.ID, "error", err)
+		c.events <- ChatEvent{
+			Type:   ChatEventError,
+			PeerID: peerID,
+			Error:  fmt.Errorf("delete message: %w", err),
+		}
+	}
+}
+
+// applyDelete soft-deletes the message and emits ChatEventMessageDeleted
+func (c *Chat) applyDelete(msg *Message) error {
+	if err := c.storage.DeleteMessage(msg.ID); err != nil {
+		return fmt.Errorf("save delete: %w", err)
+	}
+
+	c.events <- ChatEvent{
+		Type:    ChatEventMessageDeleted,
+		PeerID:  msg.PeerID,
+		Message: msg,
+	}
+	return nil
+}
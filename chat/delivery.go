@@ -0,0 +1,291 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/udisondev/sendy/p2p"
+	"github.com/udisondev/sendy/router"
+)
+
+const (
+	TextMessageType = "msg"
+	DeliveryAckType = "ack"
+
+	// DeliveryTimeout is how long a sent message waits for the contact's
+	// ack before it is marked failed
+	DeliveryTimeout = 30 * time.Second
+
+	// maxRetryMessages limits unacked messages resent on one reconnect
+	maxRetryMessages = 100
+)
+
+// MessageStatus is the delivery state of an outgoing message. It is empty
+// for received messages and for outgoing ones sent without delivery
+// tracking: broadcasts, group and file messages and messages saved before
+// tracking existed
+type MessageStatus string
+
+const (
+	MessageStatusSending   MessageStatus = "sending"   // Saved, not yet taken by the data channel
+	MessageStatusSent      MessageStatus = "sent"      // Taken by the data channel, not acked yet
+	MessageStatusDelivered MessageStatus = "delivered" // Acked by the contact
+	MessageStatusFailed    MessageStatus = "failed"    // Not acked in time, resent on reconnect
+)
+
+// deliveryWatch is the timeout of a sent message waiting for its ack
+type deliveryWatch struct {
+	timer *time.Timer
+}
+
+// TextEnvelope carries an outgoing text message. ID is a random UUID the
+// receiver echoes in a DeliveryAck and uses to drop resent copies
+type TextEnvelope struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Content string `json:"content"`
+}
+
+// DeliveryAck tells the sender that the message with ID was saved.
+// Acks are not saved to storage
+type DeliveryAck struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// parseTextEnvelope reports whether data is a text envelope
+func parseTextEnvelope(data []byte) (*TextEnvelope, bool) {
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return nil, false
+	}
+	var env TextEnvelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Type != TextMessageType {
+		return nil, false
+	}
+	if !isMessageUUID(env.ID) || env.Content == "" {
+		return nil, false
+	}
+	return &env, true
+}
+
+// parseDeliveryAck reports whether data is a delivery ack
+func parseDeliveryAck(data []byte) (*DeliveryAck, bool) {
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return nil, false
+	}
+	var ack DeliveryAck
+	if err := json.Unmarshal(data, &ack); err != nil || ack.Type != DeliveryAckType {
+		return nil, false
+	}
+	if !isMessageUUID(ack.ID) {
+		return nil, false
+	}
+	return &ack, true
+}
+
+// newMessageUUID returns a random version 4 UUID
+func newMessageUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// isMessageUUID reports whether s has the form of a UUID. Anything else
+// from the network is rejected before it reaches storage
+func isMessageUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, r := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if r != '-' {
+				return false
+			}
+		default:
+			if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SetDeliveryTimeout sets how long a sent message waits for the ack before
+// it is marked failed
+func (c *Chat) SetDeliveryTimeout(d time.Duration) {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+	c.deliveryTimeout = d
+}
+
+// sendText sends msg to the peer in a TextEnvelope
+func (c *Chat) sendText(ctx context.Context, peer *p2p.Peer, msg *Message) error {
+	data, err := json.Marshal(TextEnvelope{Type: TextMessageType, ID: msg.UUID, Content: msg.Content})
+	if err != nil {
+		return fmt.Errorf("marshal message: %w", err)
+	}
+	return peer.SendWithContext(ctx, data)
+}
+
+// sendDeliveryAck acks a received message. A lost ack makes the sender
+// resend the message on reconnect, the copy is dropped and acked again
+func (c *Chat) sendDeliveryAck(peerID router.PeerID, id string) {
+	hexID := hex.EncodeToString(peerID[:8])
+	peer, ok := c.connector.GetPeer(peerID)
+	if !ok {
+		slog.Debug("Delivery ack not sent: peer not connected", "peerID", hexID+"...")
+		return
+	}
+	data, err := json.Marshal(DeliveryAck{Type: DeliveryAckType, ID: id})
+	if err != nil {
+		slog.Error("Failed to marshal delivery ack", "error", err)
+		return
+	}
+	if err := peer.Send(data); err != nil {
+		slog.Debug("Delivery ack not sent", "peerID", hexID+"...", "error", err)
+	}
+}
+
+// handleDeliveryAck marks our message delivered and emits
+// ChatEventMessageStatusChanged. Repeated acks change nothing
+func (c *Chat) handleDeliveryAck(peerID router.PeerID, ack *DeliveryAck) {
+	hexID := hex.EncodeToString(peerID[:8])
+	c.stopDeliveryTimer(ack.ID)
+
+	msg, err := c.storage.MarkMessageDelivered(peerID, ack.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		slog.Debug("Ignoring ack of unknown or delivered message", "peerID", hexID+"...", "id", ack.ID)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to apply delivery ack", "peerID", hexID+"...", "error", err)
+		c.events <- ChatEvent{
+			Type:   ChatEventError,
+			PeerID: peerID,
+			Error:  fmt.Errorf("delivery ack: %w", err),
+		}
+		return
+	}
+	slog.Debug("Message delivered", "peerID", hexID+"...", "id", ack.ID)
+
+	c.events <- ChatEvent{
+		Type:    ChatEventMessageStatusChanged,
+		PeerID:  peerID,
+		Message: msg,
+	}
+}
+
+// watchDelivery marks msg failed unless it is acked within the delivery
+// timeout. Watching a message again restarts its timeout
+func (c *Chat) watchDelivery(msg *Message) {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+	if c.deliveryTimers == nil {
+		c.deliveryTimers = make(map[string]*deliveryWatch)
+	}
+	if watch, ok := c.deliveryTimers[msg.UUID]; ok {
+		watch.timer.Stop()
+	}
+	timeout := c.deliveryTimeout
+	if timeout == 0 {
+		timeout = DeliveryTimeout
+	}
+	watch := &deliveryWatch{}
+	watch.timer = time.AfterFunc(timeout, func() { c.deliveryTimedOut(msg, watch) })
+	c.deliveryTimers[msg.UUID] = watch
+}
+
+// stopDeliveryTimer stops waiting for the ack of the message with id
+func (c *Chat) stopDeliveryTimer(id string) {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+	if watch, ok := c.deliveryTimers[id]; ok {
+		watch.timer.Stop()
+		delete(c.deliveryTimers, id)
+	}
+}
+
+// deliveryTimedOut marks a sent message failed when its timer fires
+func (c *Chat) deliveryTimedOut(msg *Message, watch *deliveryWatch) {
+	c.deliveryMu.Lock()
+	if c.deliveryTimers[msg.UUID] != watch {
+		// Replaced by a resend or stopped by the ack
+		c.deliveryMu.Unlock()
+		return
+	}
+	delete(c.deliveryTimers, msg.UUID)
+	c.deliveryMu.Unlock()
+
+	hexID := hex.EncodeToString(msg.PeerID[:8])
+	failed, err := c.storage.UpdateMessageStatus(msg.ID, MessageStatusSent, MessageStatusFailed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to mark message failed", "peerID", hexID+"...", "error", err)
+		return
+	}
+	slog.Warn("Message not acked in time", "peerID", hexID+"...", "id", msg.UUID)
+
+	c.events <- ChatEvent{
+		Type:    ChatEventMessageStatusChanged,
+		PeerID:  msg.PeerID,
+		Message: failed,
+	}
+}
+
+// retryUndelivered resends messages the peer has not acked, oldest first.
+// The receiver drops copies it already has by their UUID
+func (c *Chat) retryUndelivered(peerID router.PeerID) {
+	hexID := hex.EncodeToString(peerID[:8])
+	msgs, err := c.storage.GetUndeliveredMessages(peerID, maxRetryMessages)
+	if err != nil {
+		slog.Error("Failed to get undelivered messages", "peerID", hexID+"...", "error", err)
+		return
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	peer, ok := c.connector.GetPeer(peerID)
+	if !ok {
+		return
+	}
+	slog.Info("Resending unacked messages", "peerID", hexID+"...", "count", len(msgs))
+
+	for _, msg := range msgs {
+		ctx, cancel := context.WithTimeout(context.Background(), messageSendTimeout)
+		err := c.sendText(ctx, peer, msg)
+		cancel()
+		if err != nil {
+			// The rest waits for the next reconnect
+			slog.Warn("Failed to resend message", "peerID", hexID+"...", "error", err)
+			return
+		}
+
+		if msg.Status != MessageStatusSent {
+			sent, err := c.storage.UpdateMessageStatus(msg.ID, msg.Status, MessageStatusSent)
+			if err == nil {
+				c.events <- ChatEvent{
+					Type:    ChatEventMessageStatusChanged,
+					PeerID:  peerID,
+					Message: sent,
+				}
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				slog.Error("Failed to mark message sent", "peerID", hexID+"...", "error", err)
+			}
+		}
+		c.watchDelivery(msg)
+	}
+}
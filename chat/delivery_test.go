@@ -0,0 +1,196 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/p2p"
+	p2ptest "github.com/udisondev/sendy/p2p/testing"
+	"github.com/udisondev/sendy/router"
+)
+
+func TestParseDeliveryEnvelopes(t *testing.T) {
+	id := newMessageUUID()
+	if !isMessageUUID(id) || id[14] != '4' {
+		t.Fatalf("Unexpected UUID %q", id)
+	}
+	if newMessageUUID() == id {
+		t.Fatal("UUIDs must be random")
+	}
+
+	data, _ := json.Marshal(TextEnvelope{Type: TextMessageType, ID: id, Content: "hi"})
+	env, ok := parseTextEnvelope(data)
+	if !ok || env.ID != id || env.Content != "hi" {
+		t.Fatalf("Unexpected envelope %+v, %v", env, ok)
+	}
+	if _, ok := parseDeliveryAck(data); ok {
+		t.Fatal("Text envelope parsed as ack")
+	}
+	if _, ok := parseReadReceipt(data); ok {
+		t.Fatal("Text envelope parsed as read receipt")
+	}
+
+	ack, _ := json.Marshal(DeliveryAck{Type: DeliveryAckType, ID: id})
+	if got, ok := parseDeliveryAck(ack); !ok || got.ID != id {
+		t.Fatalf("Unexpected ack %+v, %v", got, ok)
+	}
+
+	// Plain text and malformed IDs are regular messages
+	for _, data := range []string{
+		"hi",
+		`{"type":"msg","id":"../../etc","content":"hi"}`,
+		`{"type":"msg","id":"` + id + `","content":""}`,
+	} {
+		if _, ok := parseTextEnvelope([]byte(data)); ok {
+			t.Errorf("%s parsed as text envelope", data)
+		}
+	}
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	c := &Chat{connector: p2ptest.NewMockConnector(), events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+	c.SetDeliveryTimeout(20 * time.Millisecond)
+	peer := router.PeerID{1}
+	if err := c.storage.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	save := func(content string, status MessageStatus) *Message {
+		t.Helper()
+		msg := &Message{PeerID: peer, Content: content, Timestamp: time.Now(), IsOutgoing: true, UUID: newMessageUUID(), Status: status}
+		if err := c.storage.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	nextStatus := func() MessageStatus {
+		t.Helper()
+		select {
+		case event := <-c.events:
+			if event.Type != ChatEventMessageStatusChanged {
+				t.Fatalf("Unexpected event %v", event.Type)
+			}
+			return event.Message.Status
+		case <-time.After(time.Second):
+			t.Fatal("Expected ChatEventMessageStatusChanged")
+			return ""
+		}
+	}
+
+	// An acked message is delivered, a repeated ack changes nothing
+	acked := save("acked", MessageStatusSent)
+	c.watchDelivery(acked)
+	c.handleDeliveryAck(peer, &DeliveryAck{Type: DeliveryAckType, ID: acked.UUID})
+	if status := nextStatus(); status != MessageStatusDelivered {
+		t.Fatalf("Expected delivered, got %q", status)
+	}
+	c.handleDeliveryAck(peer, &DeliveryAck{Type: DeliveryAckType, ID: acked.UUID})
+	time.Sleep(50 * time.Millisecond)
+	if len(c.events) != 0 {
+		t.Fatalf("Unexpected event %v", (<-c.events).Type)
+	}
+
+	// A message without an ack fails after the timeout
+	lost := save("lost", MessageStatusSent)
+	c.watchDelivery(lost)
+	if status := nextStatus(); status != MessageStatusFailed {
+		t.Fatalf("Expected failed, got %q", status)
+	}
+
+	// Acks from another peer don't touch our messages
+	c.handleDeliveryAck(router.PeerID{2}, &DeliveryAck{Type: DeliveryAckType, ID: lost.UUID})
+	if len(c.events) != 0 {
+		t.Fatalf("Unexpected event %v", (<-c.events).Type)
+	}
+
+	// Failed and unsent messages wait for a resend, oldest first
+	sending := save("sending", MessageStatusSending)
+	msgs, err := c.storage.GetUndeliveredMessages(peer, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].ID != lost.ID || msgs[1].ID != sending.ID {
+		t.Fatalf("Unexpected undelivered messages %+v", msgs)
+	}
+
+	// A late ack still delivers a failed message
+	c.handleDeliveryAck(peer, &DeliveryAck{Type: DeliveryAckType, ID: lost.UUID})
+	if status := nextStatus(); status != MessageStatusDelivered {
+		t.Fatalf("Expected delivered, got %q", status)
+	}
+	if _, err := c.storage.UpdateMessageStatus(sending.ID, MessageStatusSent, MessageStatusFailed); err == nil {
+		t.Fatal("Status changed from a status the message is not in")
+	}
+}
+
+func TestReceiveTextEnvelope(t *testing.T) {
+	connector := p2ptest.NewMockConnector()
+	c := &Chat{connector: connector, events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+	peer := router.PeerID{1}
+	if err := c.storage.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	id := newMessageUUID()
+	data, _ := json.Marshal(TextEnvelope{Type: TextMessageType, ID: id, Content: "hi"})
+	done := make(chan struct{})
+	go func() {
+		c.handleConnectorEvents()
+		close(done)
+	}()
+	// The resent copy is dropped
+	for range 2 {
+		connector.Inject() <- p2p.Event{Type: p2p.EventDataReceived, PeerID: peer, Data: data}
+	}
+	connector.Inject() <- p2p.Event{Type: p2p.EventDataReceived, PeerID: peer, Data: []byte("plain")}
+	connector.Close()
+	<-done
+
+	var received []*Message
+	for len(c.events) > 0 {
+		if event := <-c.events; event.Type == ChatEventMessageReceived {
+			received = append(received, event.Message)
+		}
+	}
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(received))
+	}
+	if received[0].Content != "hi" || received[0].UUID != id || received[1].Content != "plain" || received[1].UUID != "" {
+		t.Fatalf("Unexpected messages %+v, %+v", received[0], received[1])
+	}
+
+	// A copy in a later second is still the same message
+	err := c.storage.SaveMessage(&Message{PeerID: peer, Content: "hi", Timestamp: time.Now().Add(time.Minute), UUID: id})
+	if !errors.Is(err, ErrDuplicateMessage) {
+		t.Fatalf("Expected ErrDuplicateMessage, got %v", err)
+	}
+}
+
+func TestCloseStopsDeliveryTimers(t *testing.T) {
+	storage := newTestStorage(t)
+	c := &Chat{connector: p2ptest.NewMockConnector(), events: make(chan ChatEvent, 10), storage: storage, fileTransferMgr: NewFileTransferManager(storage, t.TempDir())}
+	c.SetDeliveryTimeout(20 * time.Millisecond)
+	peer := router.PeerID{1}
+	if err := storage.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{PeerID: peer, Content: "hi", Timestamp: time.Now(), IsOutgoing: true, UUID: newMessageUUID(), Status: MessageStatusSent}
+	if err := storage.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The timer must not fire against the closed storage
+	c.watchDelivery(msg)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.deliveryTimers) != 0 {
+		t.Fatalf("Expected no delivery timers, got %d", len(c.deliveryTimers))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(c.events) != 0 {
+		t.Fatalf("Unexpected event %v", (<-c.events).Type)
+	}
+}
@@ -0,0 +1,167 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// downloadDirSetting is the storage key of the folder received files are
+// saved to
+const downloadDirSetting = "download_dir"
+
+// maxNameCollisions is how many " (n)" names are tried before giving up
+const maxNameCollisions = 1000
+
+// loadDownloadDir applies the folder saved in storage. Without a saved
+// folder files go to downloads in the data directory
+func (c *Chat) loadDownloadDir() {
+	dir, err := c.storage.GetSetting(downloadDirSetting)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to load download dir setting", "error", err)
+		return
+	}
+	c.fileTransferMgr.SetDownloadDir(dir)
+}
+
+// SetDownloadDir sets the folder received files are saved to, creating it
+// if needed. The folder is saved and restored on the next start. Transfers
+// in progress finish in the new folder
+func (c *Chat) SetDownloadDir(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("resolve download dir: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create download dir: %w", err)
+	}
+	if err := c.storage.SetSetting(downloadDirSetting, dir); err != nil {
+		return fmt.Errorf("save download dir setting: %w", err)
+	}
+	c.fileTransferMgr.SetDownloadDir(dir)
+	return nil
+}
+
+// DownloadDir returns the folder received files are saved to
+func (c *Chat) DownloadDir() string {
+	return c.fileTransferMgr.DownloadDir()
+}
+
+// SetDownloadDir sets the folder completed incoming files are moved to.
+// Partial files stay in the data directory until the hash is checked
+func (ftm *FileTransferManager) SetDownloadDir(dir string) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+	ftm.downloadDir = dir
+}
+
+// DownloadDir returns the folder completed incoming files are moved to
+func (ftm *FileTransferManager) DownloadDir() string {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+	return ftm.downloadDir
+}
+
+// moveToDownloads moves a verified incoming file from its partial location
+// to the download folder and returns the final path. An existing file is
+// never replaced, the name gets " (1)", " (2)" and so on instead
+func (ftm *FileTransferManager) moveToDownloads(ft *FileTransfer) (string, error) {
+	dir := ftm.DownloadDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("create download dir: %w", err)
+	}
+
+	dst, err := linkUnique(ft.FilePath, dir, ft.FileName)
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		// Another filesystem or no hard links: copy next to the target first,
+		// so the file shows up under its name only when complete
+		var tmp string
+		if tmp, err = copyToTemp(ft.FilePath, dir); err != nil {
+			return "", err
+		}
+		defer os.Remove(tmp)
+		dst, err = linkUnique(tmp, dir, ft.FileName)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Remove(ft.FilePath); err != nil {
+		slog.Warn("Failed to delete partial file", "path", ft.FilePath, "error", err)
+	}
+	return dst, nil
+}
+
+// linkUnique hard links src into dir under name or the first free
+// "name (n)". A link fails if the target exists, so a file saved at the
+// same moment is not overwritten. A non-collision failure is returned as
+// *os.LinkError
+func linkUnique(src, dir, name string) (string, error) {
+	for n := range maxNameCollisions {
+		dst := filepath.Join(dir, collisionName(name, n))
+		err := os.Link(src, dst)
+		if err == nil {
+			return dst, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free name for %s in %s", name, dir)
+}
+
+// collisionName returns name for n == 0, otherwise name with " (n)" before
+// the extension: report.pdf, report (1).pdf, report (2).pdf
+func collisionName(name string, n int) string {
+	if n == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = "" // .bashrc has no extension
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// copyToTemp copies src into a hidden temporary file in dir
+func copyToTemp(src, dir string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", fmt.Errorf("open received file: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(dir, ".sendy-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", fmt.Errorf("copy received file: %w", err)
+	}
+	if err := out.Chmod(0644); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", fmt.Errorf("chmod received file: %w", err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", fmt.Errorf("sync received file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", fmt.Errorf("close received file: %w", err)
+	}
+	return out.Name(), nil
+}
@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/udisondev/sendy/router"
+)
+
+func TestCollisionName(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"report.pdf", 0, "report.pdf"},
+		{"report.pdf", 1, "report (1).pdf"},
+		{"archive.tar.gz", 2, "archive.tar (2).gz"},
+		{"README", 3, "README (3)"},
+		{".bashrc", 1, ".bashrc (1)"},
+	}
+	for _, tt := range tests {
+		if got := collisionName(tt.name, tt.n); got != tt.want {
+			t.Errorf("collisionName(%q, %d) = %q, want %q", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestMoveToDownloads(t *testing.T) {
+	storage := newTestStorage(t)
+	ftm := NewFileTransferManager(storage, t.TempDir())
+	downloads := t.TempDir()
+	ftm.SetDownloadDir(downloads)
+
+	// Two files of the same name and one already on disk
+	if err := os.WriteFile(filepath.Join(downloads, "report.pdf"), []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for i, content := range []string{"first", "second"} {
+		ft, err := ftm.StartReceiving(router.PeerID{1}, &FileTransferMessage{
+			TransferID:  string(rune('a' + i)),
+			FileName:    "report.pdf",
+			FileSize:    int64(len(content)),
+			TotalChunks: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(ft.FilePath) == downloads {
+			t.Fatalf("Partial file %s is in the download dir", ft.FilePath)
+		}
+		if _, err := ft.File.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		ft.File.Close()
+
+		path, err := ftm.moveToDownloads(ft)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(ft.FilePath); !os.IsNotExist(err) {
+			t.Errorf("Partial file %s left behind: %v", ft.FilePath, err)
+		}
+		paths = append(paths, path)
+	}
+
+	want := map[string]string{
+		"report.pdf":     "mine",
+		"report (1).pdf": "first",
+		"report (2).pdf": "second",
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(downloads, name))
+		if err != nil || string(data) != content {
+			t.Errorf("%s: got %q, %v, want %q", name, data, err, content)
+		}
+	}
+	if paths[0] != filepath.Join(downloads, "report (1).pdf") || paths[1] != filepath.Join(downloads, "report (2).pdf") {
+		t.Errorf("Unexpected final paths %v", paths)
+	}
+}
+
+func TestDownloadDirSaved(t *testing.T) {
+	storage := newTestStorage(t)
+	c := &Chat{storage: storage, fileTransferMgr: NewFileTransferManager(storage, t.TempDir())}
+
+	dir := filepath.Join(t.TempDir(), "incoming")
+	if err := c.SetDownloadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("Download dir not created: %v", err)
+	}
+
+	restarted := &Chat{storage: storage, fileTransferMgr: NewFileTransferManager(storage, t.TempDir())}
+	restarted.loadDownloadDir()
+	if got := restarted.DownloadDir(); got != dir {
+		t.Fatalf("Expected saved download dir %s, got %s", dir, got)
+	}
+}
@@ -0,0 +1,118 @@
+package chat
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/udisondev/sendy/router"
+)
+
+const EditMessageType = "edit"
+
+// EditEnvelope edits a previously sent message over the data channel.
+// OrigID is the ContentHash of the original message
+type EditEnvelope struct {
+	Type    string `json:"type"`
+	OrigID  string `json:"orig_id"`
+	Content string `json:"content"`
+}
+
+// parseEditEnvelope reports whether data is a message edit
+func parseEditEnvelope(data []byte) (*EditEnvelope, bool) {
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return nil, false
+	}
+	var env EditEnvelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Type != EditMessageType {
+		return nil, false
+	}
+	return &env, true
+}
+
+// EditMessage changes the content of a sent message locally and on the
+// contact's side. The contact must be online
+func (c *Chat) EditMessage(messageID int64, newContent string) error {
+	msg, err := c.storage.GetMessage(messageID)
+	if err != nil {
+		return fmt.Errorf("get message: %w", err)
+	}
+	if !msg.IsOutgoing {
+		return fmt.Errorf("only sent messages can be edited")
+	}
+
+	hexID := hex.EncodeToString(msg.PeerID[:8])
+	slog.Debug("Editing message", "peerID", hexID+"...", "messageID", messageID)
+
+	peer, ok := c.connector.GetPeer(msg.PeerID)
+	if !ok {
+		slog.Warn("Cannot edit message: peer not connected", "peerID", hexID+"...")
+		return fmt.Errorf("peer not connected")
+	}
+
+	// Messages saved before content hashes were introduced have never been
+	// edited, so the current content is the original
+	origID := msg.ContentHash
+	if origID == "" {
+		origID = MessageContentHash(msg.Content)
+	}
+
+	data, err := json.Marshal(EditEnvelope{Type: EditMessageType, OrigID: origID, Content: newContent})
+	if err != nil {
+		return fmt.Errorf("marshal edit message: %w", err)
+	}
+	if err := peer.Send(data); err != nil {
+		slog.Error("Failed to send edit", "peerID", hexID+"...", "error", err)
+		return fmt.Errorf("send: %w", err)
+	}
+
+	return c.applyEdit(msg, newContent)
+}
+
+// handleEditEnvelope applies an edit received from the peer to the message
+// the peer sent earlier
+func (c *Chat) handleEditEnvelope(peerID router.PeerID, env *EditEnvelope) {
+	hexID := hex.EncodeToString(peerID[:8])
+
+	msg, err := c.storage.GetMessageByHash(peerID, env.OrigID, false)
+	if errors.Is(err, sql.ErrNoRows) {
+		slog.Warn("Edited message not found", "peerID", hexID+"...", "origID", env.OrigID)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to find edited message", "peerID", hexID+"...", "error", err)
+		return
+	}
+
+	if err := c.applyEdit(msg, env.Content); err != nil {
+		slog.Error("Failed to apply edit", "peerID", hexID+"...", "messageID", msg.ID, "error", err)
+		c.events <- ChatEvent{
+			Type:   ChatEventError,
+			PeerID: peerID,
+			Error:  fmt.Errorf("edit message: %w", err),
+		}
+	}
+}
+
+// applyEdit stores the new content and emits ChatEventMessageEdited
+func (c *Chat) applyEdit(msg *Message, newContent string) error {
+	if err := c.storage.EditMessage(msg.ID, newContent); err != nil {
+		return fmt.Errorf("save edit: %w", err)
+	}
+
+	edited, err := c.storage.GetMessage(msg.ID)
+	if err != nil {
+		return fmt.Errorf("get edited message: %w", err)
+	}
+
+	c.events <- ChatEvent{
+		Type:    ChatEventMessageEdited,
+		PeerID:  msg.PeerID,
+		Message: edited,
+	}
+	return nil
+}
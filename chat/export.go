@@ -0,0 +1,172 @@
+package chat
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// ExportFormat is the conversation export file format
+type ExportFormat int
+
+const (
+	ExportJSON ExportFormat = iota
+	ExportCSV
+)
+
+func (f ExportFormat) String() string {
+	switch f {
+	case ExportJSON:
+		return "json"
+	case ExportCSV:
+		return "csv"
+	default:
+		return fmt.Sprintf("ExportFormat(%d)", int(f))
+	}
+}
+
+// ParseExportFormat parses "json" or "csv"
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch strings.ToLower(s) {
+	case "json":
+		return ExportJSON, nil
+	case "csv":
+		return ExportCSV, nil
+	default:
+		return 0, fmt.Errorf("unknown export format %q: use json or csv", s)
+	}
+}
+
+// Message directions in exports
+const (
+	directionIncoming = "incoming"
+	directionOutgoing = "outgoing"
+)
+
+// exportedMessage is a Message as written by the JSON export
+type exportedMessage struct {
+	ID        int64      `json:"id"`
+	PeerID    string     `json:"peer_id"`
+	Timestamp time.Time  `json:"timestamp"`
+	Direction string     `json:"direction"`
+	Content   string     `json:"content"`
+	IsRead    bool       `json:"is_read"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+func newExportedMessage(msg *Message) exportedMessage {
+	exported := exportedMessage{
+		ID:        msg.ID,
+		PeerID:    hex.EncodeToString(msg.PeerID[:]),
+		Timestamp: msg.Timestamp.UTC(),
+		Direction: messageDirection(msg),
+		Content:   msg.Content,
+		IsRead:    msg.IsRead,
+	}
+	if msg.IsEdited() {
+		editedAt := msg.EditedAt.UTC()
+		exported.EditedAt = &editedAt
+	}
+	if msg.ReadAt != nil {
+		readAt := msg.ReadAt.UTC()
+		exported.ReadAt = &readAt
+	}
+	return exported
+}
+
+func messageDirection(msg *Message) string {
+	if msg.IsOutgoing {
+		return directionOutgoing
+	}
+	return directionIncoming
+}
+
+// ExportConversation writes all messages with the peer to w, oldest first.
+// Rows are streamed from the database, the history is never loaded at once
+func (s *Storage) ExportConversation(peerID router.PeerID, format ExportFormat, w io.Writer) error {
+	var write func(*Message) error
+	var finish func() error
+
+	switch format {
+	case ExportJSON:
+		first := true
+		if _, err := io.WriteString(w, "["); err != nil {
+			return err
+		}
+		write = func(msg *Message) error {
+			data, err := json.Marshal(newExportedMessage(msg))
+			if err != nil {
+				return err
+			}
+			sep := ",\n"
+			if first {
+				sep, first = "\n", false
+			}
+			if _, err := io.WriteString(w, sep); err != nil {
+				return err
+			}
+			_, err = w.Write(data)
+			return err
+		}
+		finish = func() error {
+			_, err := io.WriteString(w, "\n]\n")
+			return err
+		}
+
+	case ExportCSV:
+		cw := csv.NewWriter(w)
+		cw.UseCRLF = true // RFC 4180
+		if err := cw.Write([]string{"id", "timestamp", "direction", "content"}); err != nil {
+			return err
+		}
+		write = func(msg *Message) error {
+			return cw.Write([]string{
+				strconv.FormatInt(msg.ID, 10),
+				msg.Timestamp.UTC().Format(time.RFC3339),
+				messageDirection(msg),
+				msg.Content,
+			})
+		}
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+
+	default:
+		return fmt.Errorf("unknown export format: %v", format)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE peer_id = ? AND deleted_at IS NULL
+		ORDER BY timestamp ASC, id ASC
+	`, hex.EncodeToString(peerID[:]))
+	if err != nil {
+		return fmt.Errorf("query messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return fmt.Errorf("scan message: %w", err)
+		}
+		if err := write(msg); err != nil {
+			return fmt.Errorf("write message: %w", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read messages: %w", err)
+	}
+
+	return finish()
+}
@@ -0,0 +1,90 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+func TestExportConversation(t *testing.T) {
+	s := newTestStorage(t)
+
+	alice, bob := router.PeerID{1}, router.PeerID{2}
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	msgs := []*Message{
+		{PeerID: alice, Content: "hi", Timestamp: now},
+		{PeerID: alice, Content: "hello, \"alice\"\nsecond line", Timestamp: now.Add(time.Second), IsOutgoing: true},
+		{PeerID: bob, Content: "not exported", Timestamp: now},
+	}
+	for _, msg := range msgs {
+		if err := s.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportConversation(alice, ExportJSON, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var exported []exportedMessage
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatalf("Invalid JSON export: %v\n%s", err, buf.String())
+	}
+	if len(exported) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(exported))
+	}
+	if exported[0].Content != "hi" || exported[0].Direction != "incoming" ||
+		exported[1].Content != msgs[1].Content || exported[1].Direction != "outgoing" {
+		t.Errorf("Unexpected JSON export: %+v", exported)
+	}
+	if !exported[0].Timestamp.Equal(now) {
+		t.Errorf("Expected timestamp %v, got %v", now, exported[0].Timestamp)
+	}
+
+	buf.Reset()
+	if err := s.ExportConversation(alice, ExportCSV, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "id,timestamp,direction,content\r\n") {
+		t.Errorf("Expected CRLF header, got %q", buf.String())
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV export: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected header and 2 rows, got %d records", len(records))
+	}
+	if records[1][1] != "2025-01-02T03:04:05Z" || records[1][2] != "incoming" {
+		t.Errorf("Unexpected first row: %q", records[1])
+	}
+	if records[2][2] != "outgoing" || records[2][3] != msgs[1].Content {
+		t.Errorf("Unexpected second row: %q", records[2])
+	}
+
+	// Empty conversation is still a valid JSON array
+	buf.Reset()
+	if err := s.ExportConversation(router.PeerID{3}, ExportJSON, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil || len(exported) != 0 {
+		t.Errorf("Expected empty array, got %q (%v)", buf.String(), err)
+	}
+}
+
+func TestParseExportFormat(t *testing.T) {
+	for s, want := range map[string]ExportFormat{"json": ExportJSON, "CSV": ExportCSV} {
+		got, err := ParseExportFormat(s)
+		if err != nil || got != want {
+			t.Errorf("ParseExportFormat(%q) = %v, %v", s, got, err)
+		}
+	}
+	if _, err := ParseExportFormat("xml"); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// autoAcceptFilesSetting is the storage key of the option to receive files
+// from verified contacts without asking
+const autoAcceptFilesSetting = "auto_accept_verified_files"
+
+// loadAutoAcceptFiles applies the option saved in storage. Without a saved
+// option every file waits for the user
+func (c *Chat) loadAutoAcceptFiles() {
+	value, err := c.storage.GetSetting(autoAcceptFilesSetting)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to load auto-accept setting", "error", err)
+		return
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Error("Invalid saved auto-accept setting", "value", value, "error", err)
+		return
+	}
+	c.mu.Lock()
+	c.autoAcceptFiles = enabled
+	c.mu.Unlock()
+}
+
+// SetAutoAcceptFiles sets whether files from verified contacts are received
+// without asking. The option is saved and restored on the next start
+func (c *Chat) SetAutoAcceptFiles(enabled bool) error {
+	if err := c.storage.SetSetting(autoAcceptFilesSetting, strconv.FormatBool(enabled)); err != nil {
+		return fmt.Errorf("save auto-accept setting: %w", err)
+	}
+	c.mu.Lock()
+	c.autoAcceptFiles = enabled
+	c.mu.Unlock()
+	return nil
+}
+
+// AutoAcceptFiles reports whether files from verified contacts are received
+// without asking
+func (c *Chat) AutoAcceptFiles() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.autoAcceptFiles
+}
+
+// handleFileOffer holds an incoming file until the user accepts or rejects
+// it with ChatEventFileOfferReceived. Files from verified contacts are
+// accepted right away if AutoAcceptFiles is on
+func (c *Chat) handleFileOffer(peerID router.PeerID, msg *FileTransferMessage) {
+	offer, err := c.fileTransferMgr.AddOffer(peerID, msg)
+	if err != nil {
+		slog.Error("Rejecting invalid file offer", transferLogGroup(peerID, msg.TransferID), "error", err)
+		c.sendFileTransferCancel(peerID, msg.TransferID)
+		return
+	}
+	log := offer.logger()
+
+	if c.AutoAcceptFiles() {
+		if contact, err := c.storage.GetContact(peerID); err == nil && contact.Verified {
+			log.Info("Auto-accepting file from verified contact")
+			if err := c.AcceptFileTransfer(offer.ID); err != nil {
+				log.Error("Failed to accept file", "error", err)
+			}
+			return
+		}
+	}
+
+	log.Info("File offer waits for the user")
+	c.events <- ChatEvent{
+		Type:         ChatEventFileOfferReceived,
+		PeerID:       peerID,
+		FileTransfer: offer,
+	}
+}
+
+// AcceptFileTransfer starts receiving an offered file and tells the sender
+// to stream it
+func (c *Chat) AcceptFileTransfer(transferID string) error {
+	offer, ok := c.fileTransferMgr.TakeOffer(transferID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTransferNotFound, transferID)
+	}
+	// The offer stays for a retry once the sender is back
+	if _, ok := c.connector.GetPeer(offer.PeerID); !ok {
+		c.fileTransferMgr.offers.Store(offer.ID, offer)
+		return fmt.Errorf("peer not connected")
+	}
+
+	ft, err := c.fileTransferMgr.StartReceiving(offer.PeerID, &FileTransferMessage{
+		TransferID:  offer.ID,
+		FileName:    offer.FileName,
+		FileSize:    offer.FileSize,
+		TotalChunks: offer.TotalChunks,
+		Archive:     offer.Archive,
+	})
+	if err != nil {
+		c.sendFileTransferCancel(offer.PeerID, transferID)
+		return fmt.Errorf("start receiving: %w", err)
+	}
+	c.storage.SaveFileTransfer(ft.ID, ft.PeerID, ft.FileName, ft.FileSize, ft.FilePath, false, string(FileTransferTransferring))
+
+	if err := c.sendFileMessage(ft.PeerID, &FileTransferMessage{Type: FileTransferAccept, TransferID: ft.ID, BinaryChunks: true}); err != nil {
+		c.handleFileTransferError(ft, err)
+		return fmt.Errorf("send accept: %w", err)
+	}
+
+	ft.logger().Info("Accepted file transfer", ft.progressArgs()...)
+
+	c.events <- ChatEvent{
+		Type:         ChatEventFileTransferStarted,
+		PeerID:       ft.PeerID,
+		FileTransfer: ft,
+	}
+	return nil
+}
+
+// RejectFileTransfer declines an offered file, the sender sees the transfer
+// cancelled
+func (c *Chat) RejectFileTransfer(transferID string) error {
+	offer, ok := c.fileTransferMgr.TakeOffer(transferID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTransferNotFound, transferID)
+	}
+	c.sendFileTransferCancel(offer.PeerID, transferID)
+
+	offer.logger().Info("Rejected file transfer")
+	return nil
+}
+
+// FileOffers returns incoming files waiting for AcceptFileTransfer or
+// RejectFileTransfer, oldest first
+func (c *Chat) FileOffers() []*FileTransfer {
+	return c.fileTransferMgr.Offers()
+}
@@ -1,13 +1,20 @@
 package chat
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
@@ -18,6 +25,28 @@ const (
 	MaxFileSize    = 200 * 1024 * 1024 // 200 MB
 	ChunkSize      = 64 * 1024          // 64 KB chunks
 	FileTransferV1 = "FILE_TRANSFER_V1"
+
+	// ChunkSendTimeout fails the transfer when the peer stops reading
+	// and the channel buffer does not drain
+	ChunkSendTimeout = 30 * time.Second
+
+	// MaxChunkConcurrency caps how many chunks of a file are read and sent
+	// at once
+	MaxChunkConcurrency = 8
+
+	// ChunkFrameMagic starts a binary chunk frame. 0xFF never occurs in
+	// UTF-8, so frames cannot be mistaken for text or JSON messages
+	ChunkFrameMagic = 0xFF
+	// TransferIDSize is the length of IDs made by GenerateTransferID
+	TransferIDSize = 16
+	// ChunkFrameHeaderSize is magic, transfer ID and uint32 chunk index
+	ChunkFrameHeaderSize = 1 + TransferIDSize + 4
+
+	// ProgressSaveChunks and ProgressSaveInterval bound how much progress
+	// of an incoming transfer is not saved yet. Unsaved chunks are asked
+	// for again on resume
+	ProgressSaveChunks   = 64
+	ProgressSaveInterval = 2 * time.Second
 )
 
 // FileTransferType defines file transfer message type
@@ -29,6 +58,10 @@ const (
 	FileTransferEnd                           // End of transfer (with hash)
 	FileTransferAck                           // Acknowledgment of chunk receipt
 	FileTransferCancel                        // Transfer cancellation
+	FileTransferResumeRequest                 // Sender asks which chunks the receiver already has
+	FileTransferResume                        // Receiver replies with bitset of received chunks
+	FileTransferAccept                        // Receiver accepted the offer, sender may stream chunks
+	FileTransferNack                          // Receiver lists chunks missing after END, sender re-sends them
 )
 
 // FileTransferMessage represents a file transfer message
@@ -42,6 +75,17 @@ type FileTransferMessage struct {
 	TotalChunks int              `json:"total_chunks"` // Total chunks
 	Data        []byte           `json:"data"`         // Chunk data
 	SHA256Hash  string           `json:"sha256_hash"`  // SHA256 file hash
+	// Bitset of already received chunks (FileTransferResume only)
+	ReceivedChunks []byte `json:"received_chunks,omitempty"`
+	// Bitset of chunks the receiver is missing (FileTransferNack only)
+	MissingChunks []byte `json:"missing_chunks,omitempty"`
+	// Binary chunk frames are supported. The sender sets it in Start and
+	// ResumeRequest, the receiver in Accept and Resume; chunks go as
+	// frames only if the receiver set it, older peers get JSON
+	BinaryChunks bool `json:"binary_chunks,omitempty"`
+	// The file is a tar of a directory, the receiver extracts it. Set in
+	// Start and ResumeRequest, older peers save the tar as is
+	Archive bool `json:"archive,omitempty"`
 }
 
 // FileTransfer represents an active file transfer
@@ -52,6 +96,7 @@ type FileTransfer struct {
 	FileSize    int64
 	FilePath    string // File path (for sending or saving)
 	IsOutgoing  bool
+	Archive     bool // A directory sent as a tar, extracted on arrival
 	Status      FileTransferStatus
 	Progress    int // Completion percentage
 	ChunksRecv  map[int]bool
@@ -60,12 +105,51 @@ type FileTransfer struct {
 	Hash        string
 	StartedAt   time.Time
 	mu          sync.Mutex
+
+	// Transfer rate, updated after each chunk. BytesTransferred includes
+	// bytes of a resumed transfer that were already there. BytesPerSecond
+	// counts only bytes moved within the last SpeedWindow, TimeLeft is the
+	// rest of the file at that rate, 0 if unknown
+	BytesTransferred int64
+	BytesPerSecond   float64
+	TimeLeft         time.Duration
+	movedBytes       int64
+	rateSamples      []rateSample // Oldest first, the first one is the base of the window
+
+	// Hash from an END that overtook chunks on the bulk channel
+	endHash string
+
+	// Chunks received since the progress was last saved, and when
+	unsavedChunks   int
+	progressSavedAt time.Time
+
+	// Set by CancelTransfer, the sending loop stops before the next chunk
+	cancelled bool
+	// Done once cancelled, stops chunks being sent or waiting for the rate
+	// limit. Created by context
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The receiver accepts binary chunk frames instead of JSON
+	binaryChunks bool
+
+	// Missing chunk requests: the receiver's timer and the rounds asked for,
+	// the sender's rounds answered
+	nackTimer        *time.Timer
+	nackRounds       int
+	retransmitRounds int
+
+	// Outgoing transfer scheduling: transfers ahead in the queue while
+	// queued, and the function that offers the file once it gets a slot
+	queuePosition int
+	start         func() error
 }
 
 // FileTransferStatus defines transfer status
 type FileTransferStatus string
 
 const (
+	FileTransferQueued       FileTransferStatus = "queued" // Outgoing, waiting for a free slot
 	FileTransferPending      FileTransferStatus = "pending"
 	FileTransferTransferring FileTransferStatus = "transferring"
 	FileTransferCompleted    FileTransferStatus = "completed"
@@ -73,12 +157,29 @@ const (
 	FileTransferCancelled    FileTransferStatus = "cancelled"
 )
 
+// ErrTransferNotFound is returned for an unknown or already finished transfer
+var ErrTransferNotFound = errors.New("file transfer not found")
+
+// ErrCancelledByUser is the error of ChatEventFileTransferFailed for a
+// transfer cancelled with CancelFileTransfer
+var ErrCancelledByUser = errors.New("transfer cancelled by user")
+
 // FileTransferManager manages file transfers
 type FileTransferManager struct {
-	storage   *Storage
-	dataDir   string
-	transfers sync.Map // map[transferID]*FileTransfer
-	mu        sync.Mutex
+	storage     *Storage
+	dataDir     string   // Partial incoming files and their progress
+	downloadDir string   // Completed incoming files, protected by mu
+	transfers   sync.Map // map[transferID]*FileTransfer
+	offers      sync.Map // map[transferID]*FileTransfer - incoming files waiting for the user
+	mu          sync.Mutex
+	concurrency int         // Chunks sent at once, protected by mu
+	limiter     rateLimiter // Shared by all outgoing transfers
+
+	// Outgoing transfer scheduling, protected by mu
+	maxPerPeer int                      // Transfers running at once to one peer
+	maxTotal   int                      // Transfers running at once in total
+	queue      []*FileTransfer          // Waiting for a slot, oldest first
+	slots      map[string]router.PeerID // Transfer ID to peer of transfers holding a slot
 }
 
 // NewFileTransferManager creates a new transfer manager
@@ -86,10 +187,44 @@ func NewFileTransferManager(storage *Storage, dataDir string) *FileTransferManag
 	filesDir := filepath.Join(dataDir, "files")
 	os.MkdirAll(filesDir, 0755)
 
-	return &FileTransferManager{
-		storage: storage,
-		dataDir: filesDir,
+	ftm := &FileTransferManager{
+		storage:     storage,
+		dataDir:     filesDir,
+		downloadDir: filepath.Join(dataDir, "downloads"),
+		concurrency: 1,
+		maxPerPeer:  DefaultMaxTransfersPerPeer,
+		maxTotal:    DefaultMaxTransfers,
+		slots:       make(map[string]router.PeerID),
 	}
+	ftm.removeFinishedArchives()
+	return ftm
+}
+
+// SetConcurrency sets how many chunks of an outgoing file are read and sent
+// at once, clamped to 1..MaxChunkConcurrency. The receiver places chunks by
+// ChunkIndex, so they may arrive in any order. Default is 1
+func (ftm *FileTransferManager) SetConcurrency(n int) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+	ftm.concurrency = min(max(n, 1), MaxChunkConcurrency)
+}
+
+// Concurrency returns how many chunks are sent at once
+func (ftm *FileTransferManager) Concurrency() int {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+	return max(ftm.concurrency, 1)
+}
+
+// SetRateLimit caps the file data all outgoing transfers send per second
+// together. 0 or less removes the cap, which is the default
+func (ftm *FileTransferManager) SetRateLimit(bytesPerSec int64) {
+	ftm.limiter.setRate(bytesPerSec)
+}
+
+// RateLimit returns the cap on file data sent per second, 0 if unlimited
+func (ftm *FileTransferManager) RateLimit() int64 {
+	return ftm.limiter.limit()
 }
 
 // GenerateTransferID generates unique transfer ID
@@ -133,20 +268,26 @@ func (ftm *FileTransferManager) StartSending(peerID router.PeerID, filePath stri
 		return nil, err
 	}
 
+	return ftm.newOutgoing(peerID, GenerateTransferID(peerID, fileName), filePath, fileInfo.Size())
+}
+
+// newOutgoing opens a file checked by the caller and registers its
+// outgoing transfer
+func (ftm *FileTransferManager) newOutgoing(peerID router.PeerID, transferID string, filePath string, size int64) (*FileTransfer, error) {
 	// Open file for reading
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("open file: %w", err)
 	}
 
-	transferID := GenerateTransferID(peerID, fileName)
-	totalChunks := int((fileInfo.Size() + ChunkSize - 1) / ChunkSize)
+	fileName := filepath.Base(filePath)
+	totalChunks := int((size + ChunkSize - 1) / ChunkSize)
 
 	ft := &FileTransfer{
 		ID:          transferID,
 		PeerID:      peerID,
 		FileName:    fileName,
-		FileSize:    fileInfo.Size(),
+		FileSize:    size,
 		FilePath:    filePath,
 		IsOutgoing:  true,
 		Status:      FileTransferPending,
@@ -160,19 +301,95 @@ func (ftm *FileTransferManager) StartSending(peerID router.PeerID, filePath stri
 	return ft, nil
 }
 
+// validateOffer checks the metadata of an incoming file
+func validateOffer(msg *FileTransferMessage) error {
+	if err := ValidateFileName(msg.FileName); err != nil {
+		return err
+	}
+	// The archive is extracted into a folder named after it
+	if msg.Archive {
+		if err := ValidateFileName(archiveFolderName(msg.FileName)); err != nil {
+			return fmt.Errorf("invalid folder name: %w", err)
+		}
+	}
+
+	if msg.FileSize > MaxFileSize {
+		return fmt.Errorf("file too large: %d bytes (max %d)", msg.FileSize, MaxFileSize)
+	}
+
+	if err := ValidateFileName(msg.TransferID); err != nil {
+		return fmt.Errorf("invalid transfer id: %w", err)
+	}
+	return nil
+}
+
+// AddOffer keeps an incoming file offer until the user accepts or rejects
+// it. Nothing is written to disk and chunks of the offer are dropped
+func (ftm *FileTransferManager) AddOffer(peerID router.PeerID, msg *FileTransferMessage) (*FileTransfer, error) {
+	if err := validateOffer(msg); err != nil {
+		return nil, err
+	}
+	if _, ok := ftm.transfers.Load(msg.TransferID); ok {
+		return nil, fmt.Errorf("transfer %s already in progress", msg.TransferID)
+	}
+
+	ft := &FileTransfer{
+		ID:          msg.TransferID,
+		PeerID:      peerID,
+		FileName:    msg.FileName,
+		FileSize:    msg.FileSize,
+		IsOutgoing:  false,
+		Archive:     msg.Archive,
+		Status:      FileTransferPending,
+		TotalChunks: msg.TotalChunks,
+		StartedAt:   time.Now(),
+	}
+	ftm.offers.Store(msg.TransferID, ft)
+	return ft, nil
+}
+
+// TakeOffer removes and returns a pending incoming offer
+func (ftm *FileTransferManager) TakeOffer(transferID string) (*FileTransfer, bool) {
+	val, ok := ftm.offers.LoadAndDelete(transferID)
+	if !ok {
+		return nil, false
+	}
+	return val.(*FileTransfer), true
+}
+
+// Offers returns incoming offers waiting for the user, oldest first
+func (ftm *FileTransferManager) Offers() []*FileTransfer {
+	var offers []*FileTransfer
+	ftm.offers.Range(func(_, val any) bool {
+		offers = append(offers, val.(*FileTransfer))
+		return true
+	})
+	sort.Slice(offers, func(i, j int) bool {
+		return offers[i].StartedAt.Before(offers[j].StartedAt)
+	})
+	return offers
+}
+
 // StartReceiving starts file receiving
 func (ftm *FileTransferManager) StartReceiving(peerID router.PeerID, msg *FileTransferMessage) (*FileTransfer, error) {
-	if err := ValidateFileName(msg.FileName); err != nil {
+	if err := validateOffer(msg); err != nil {
 		return nil, err
 	}
 
-	if msg.FileSize > MaxFileSize {
-		return nil, fmt.Errorf("file too large: %d bytes (max %d)", msg.FileSize, MaxFileSize)
+	// Load progress of an interrupted transfer, if any
+	chunksRecv, bytesReceived, err := ftm.loadProgress(msg.TransferID)
+	if err != nil {
+		return nil, fmt.Errorf("load progress: %w", err)
 	}
 
-	// Create file for writing
+	// Open file for writing. Partial file is kept when resuming and moves to
+	// the download folder once the hash matches
 	filePath := filepath.Join(ftm.dataDir, msg.TransferID+"_"+msg.FileName)
-	file, err := os.Create(filePath)
+	flags := os.O_RDWR | os.O_CREATE
+	if len(chunksRecv) == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(filePath, flags, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("create file: %w", err)
 	}
@@ -184,18 +401,148 @@ func (ftm *FileTransferManager) StartReceiving(peerID router.PeerID, msg *FileTr
 		FileSize:    msg.FileSize,
 		FilePath:    filePath,
 		IsOutgoing:  false,
+		Archive:     msg.Archive,
 		Status:      FileTransferTransferring,
 		Progress:    0,
-		ChunksRecv:  make(map[int]bool),
+		ChunksRecv:  chunksRecv,
 		TotalChunks: msg.TotalChunks,
 		File:        file,
 		StartedAt:   time.Now(),
 	}
+	ft.UpdateProgress(len(chunksRecv))
+	ft.AddResumed(bytesReceived)
 
 	ftm.transfers.Store(msg.TransferID, ft)
 	return ft, nil
 }
 
+// ResumeSending reopens an interrupted outgoing transfer keeping its ID
+func (ftm *FileTransferManager) ResumeSending(peerID router.PeerID, transferID string, filePath string) (*FileTransfer, error) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("stat file: %w", err)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+
+	ft := &FileTransfer{
+		ID:          transferID,
+		PeerID:      peerID,
+		FileName:    filepath.Base(filePath),
+		FileSize:    fileInfo.Size(),
+		FilePath:    filePath,
+		IsOutgoing:  true,
+		Archive:     ftm.isArchive(filePath),
+		Status:      FileTransferPending,
+		Progress:    0,
+		TotalChunks: int((fileInfo.Size() + ChunkSize - 1) / ChunkSize),
+		File:        file,
+		StartedAt:   time.Now(),
+	}
+
+	ftm.transfers.Store(transferID, ft)
+	return ft, nil
+}
+
+// SaveProgress persists the received chunks, bytes written and completion
+// percentage of an incoming transfer in the file_transfers table, so that
+// the transfer resumes after a disconnect or a restart. Without storage
+// progress is kept in memory only
+func (ftm *FileTransferManager) SaveProgress(ft *FileTransfer) error {
+	if ftm.storage == nil {
+		return nil
+	}
+	ft.mu.Lock()
+	bitset := EncodeChunkBitset(ft.ChunksRecv, ft.TotalChunks)
+	bytesReceived := ft.BytesTransferred
+	progress := ft.Progress
+	ft.unsavedChunks = 0
+	ft.progressSavedAt = time.Now()
+	ft.mu.Unlock()
+
+	return ftm.storage.SaveFileTransferChunks(ft.ID, progress, bitset, bytesReceived)
+}
+
+// chunkReceived saves the progress once ProgressSaveChunks chunks arrived
+// or ProgressSaveInterval passed since it was last saved
+func (ftm *FileTransferManager) chunkReceived(ft *FileTransfer) error {
+	ft.mu.Lock()
+	ft.unsavedChunks++
+	save := ft.unsavedChunks >= ProgressSaveChunks || time.Since(ft.progressSavedAt) >= ProgressSaveInterval
+	ft.mu.Unlock()
+	if !save {
+		return nil
+	}
+	return ftm.SaveProgress(ft)
+}
+
+// FlushProgress saves the progress of incoming transfers of peerID, of all
+// peers if peerID is nil, that has chunks not saved yet
+func (ftm *FileTransferManager) FlushProgress(peerID *router.PeerID) error {
+	var errs []error
+	for _, ft := range ftm.ActiveTransfers() {
+		if ft.IsOutgoing || peerID != nil && ft.PeerID != *peerID {
+			continue
+		}
+		ft.mu.Lock()
+		unsaved := ft.unsavedChunks > 0
+		ft.mu.Unlock()
+		if unsaved {
+			errs = append(errs, ftm.SaveProgress(ft))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RemoveProgress drops the saved progress of a finished transfer
+func (ftm *FileTransferManager) RemoveProgress(transferID string) error {
+	if ftm.storage != nil {
+		return ftm.storage.ClearFileTransferChunks(transferID)
+	}
+	return nil
+}
+
+// loadProgress returns the chunks and bytes already received of an
+// interrupted transfer, an empty map if there are none
+func (ftm *FileTransferManager) loadProgress(transferID string) (map[int]bool, int64, error) {
+	if ftm.storage == nil {
+		return make(map[int]bool), 0, nil
+	}
+	bitset, bytesReceived, err := ftm.storage.GetFileTransferChunks(transferID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return DecodeChunkBitset(bitset), bytesReceived, nil
+}
+
+// EncodeChunkBitset packs chunk indexes into a bitset (bit i = chunk i)
+func EncodeChunkBitset(chunks map[int]bool, totalChunks int) []byte {
+	bitset := make([]byte, (totalChunks+7)/8)
+	for idx, ok := range chunks {
+		if !ok || idx < 0 || idx >= totalChunks {
+			continue
+		}
+		bitset[idx/8] |= 1 << (idx % 8)
+	}
+	return bitset
+}
+
+// DecodeChunkBitset unpacks bitset produced by EncodeChunkBitset
+func DecodeChunkBitset(bitset []byte) map[int]bool {
+	chunks := make(map[int]bool)
+	for i, b := range bitset {
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<bit) != 0 {
+				chunks[i*8+bit] = true
+			}
+		}
+	}
+	return chunks
+}
+
 // GetTransfer returns transfer by ID
 func (ftm *FileTransferManager) GetTransfer(transferID string) (*FileTransfer, bool) {
 	val, ok := ftm.transfers.Load(transferID)
@@ -205,6 +552,90 @@ func (ftm *FileTransferManager) GetTransfer(transferID string) (*FileTransfer, b
 	return val.(*FileTransfer), true
 }
 
+// ActiveTransfers returns transfers that are pending or in progress,
+// oldest first
+func (ftm *FileTransferManager) ActiveTransfers() []*FileTransfer {
+	var active []*FileTransfer
+	ftm.transfers.Range(func(_, val any) bool {
+		ft := val.(*FileTransfer)
+		ft.mu.Lock()
+		status := ft.Status
+		ft.mu.Unlock()
+		if status == FileTransferPending || status == FileTransferTransferring {
+			active = append(active, ft)
+		}
+		return true
+	})
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].StartedAt.Before(active[j].StartedAt)
+	})
+	return active
+}
+
+// ListTransfers returns pending and running transfers oldest first, then
+// queued ones in the order they will start
+func (ftm *FileTransferManager) ListTransfers() []*FileTransfer {
+	// Under the scheduler lock no transfer leaves the queue meanwhile
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+	return append(ftm.ActiveTransfers(), ftm.queue...)
+}
+
+// CancelTransfer aborts a queued, pending or running transfer: marks it
+// cancelled, closes the file and forgets it. Notifying the peer is up to
+// the caller
+func (ftm *FileTransferManager) CancelTransfer(transferID string) error {
+	_, err := ftm.cancelTransfer(transferID)
+	return err
+}
+
+// cancelTransfer is CancelTransfer reporting whether the transfer was still
+// queued, so the peer never heard of it
+func (ftm *FileTransferManager) cancelTransfer(transferID string) (queued bool, err error) {
+	val, ok := ftm.transfers.Load(transferID)
+	if !ok {
+		return false, fmt.Errorf("%w: %s", ErrTransferNotFound, transferID)
+	}
+	ft := val.(*FileTransfer)
+
+	// Under the scheduler lock a queued transfer cannot start meanwhile
+	ftm.mu.Lock()
+	ft.mu.Lock()
+	queued = ft.Status == FileTransferQueued
+	if !queued && ft.Status != FileTransferPending && ft.Status != FileTransferTransferring {
+		ft.mu.Unlock()
+		ftm.mu.Unlock()
+		return false, fmt.Errorf("%w: %s is %s", ErrTransferNotFound, transferID, ft.Status)
+	}
+	if queued {
+		ftm.queue = slices.DeleteFunc(ftm.queue, func(q *FileTransfer) bool { return q == ft })
+	}
+	ftm.mu.Unlock()
+
+	ft.cancelled = true
+	ft.Status = FileTransferCancelled
+	if ft.cancel != nil {
+		ft.cancel()
+	}
+	var closeErr error
+	if ft.File != nil {
+		closeErr = ft.File.Close()
+	}
+	ft.mu.Unlock()
+
+	ftm.transfers.Delete(transferID)
+	if ftm.storage != nil && !queued {
+		ftm.storage.UpdateFileTransferStatus(transferID, string(FileTransferCancelled), "")
+	}
+	if ft.IsOutgoing && ft.Archive {
+		ftm.removeArchive(ft)
+	}
+	if closeErr != nil {
+		return queued, fmt.Errorf("close file: %w", closeErr)
+	}
+	return queued, nil
+}
+
 // EncodeFileMessage encodes file transfer message
 func EncodeFileMessage(msg *FileTransferMessage) ([]byte, error) {
 	return json.Marshal(msg)
@@ -219,6 +650,94 @@ func DecodeFileMessage(data []byte) (*FileTransferMessage, error) {
 	return &msg, nil
 }
 
+// EncodeChunkFrame encodes a chunk as a binary frame: ChunkFrameMagic, the
+// transfer ID, the big-endian chunk index and the raw data. Unlike JSON the
+// data is not base64-encoded
+func EncodeChunkFrame(transferID string, chunkIndex int, data []byte) ([]byte, error) {
+	if len(transferID) != TransferIDSize {
+		return nil, fmt.Errorf("invalid transfer id length: %d (expected %d)", len(transferID), TransferIDSize)
+	}
+	if chunkIndex < 0 || int64(chunkIndex) > math.MaxUint32 {
+		return nil, fmt.Errorf("chunk index out of range: %d", chunkIndex)
+	}
+	frame := make([]byte, ChunkFrameHeaderSize+len(data))
+	frame[0] = ChunkFrameMagic
+	copy(frame[1:], transferID)
+	binary.BigEndian.PutUint32(frame[1+TransferIDSize:], uint32(chunkIndex))
+	copy(frame[ChunkFrameHeaderSize:], data)
+	return frame, nil
+}
+
+// IsChunkFrame reports whether data is a binary chunk frame
+func IsChunkFrame(data []byte) bool {
+	return len(data) > 0 && data[0] == ChunkFrameMagic
+}
+
+// DecodeChunkFrame decodes a frame made by EncodeChunkFrame into a
+// FileTransferChunk message. Data refers to the frame, it is not copied
+func DecodeChunkFrame(frame []byte) (*FileTransferMessage, error) {
+	if !IsChunkFrame(frame) {
+		return nil, fmt.Errorf("not a chunk frame")
+	}
+	if len(frame) < ChunkFrameHeaderSize {
+		return nil, fmt.Errorf("chunk frame too short: %d bytes", len(frame))
+	}
+	return &FileTransferMessage{
+		Type:       FileTransferChunk,
+		TransferID: string(frame[1 : 1+TransferIDSize]),
+		ChunkIndex: int(binary.BigEndian.Uint32(frame[1+TransferIDSize:])),
+		Data:       frame[ChunkFrameHeaderSize:],
+	}, nil
+}
+
+// transferLogGroup returns the "file_transfer" log group of a transfer.
+// Keys are snake_case so log tools can filter transfers across sessions
+func transferLogGroup(peerID router.PeerID, transferID string, attrs ...any) slog.Attr {
+	return slog.Group("file_transfer", append([]any{
+		"transfer_id", transferID,
+		"peer_id", hex.EncodeToString(peerID[:8]) + "...",
+	}, attrs...)...)
+}
+
+// logger returns the default logger with the transfer's log group attached
+func (ft *FileTransfer) logger() *slog.Logger {
+	return slog.With(transferLogGroup(ft.PeerID, ft.ID,
+		"file_name", ft.FileName,
+		"file_size", ft.FileSize,
+		"total_chunks", ft.TotalChunks,
+	))
+}
+
+// progressArgs returns the progress and speed of the transfer for a log
+// record, they change while the transfer runs
+func (ft *FileTransfer) progressArgs(args ...any) []any {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return append(args, "progress", ft.Progress, "speed_bytes_per_sec", int64(ft.BytesPerSecond))
+}
+
+// useBinaryChunks reports whether chunks go as binary frames. Frames need a
+// 16-byte transfer ID, anything else falls back to JSON
+func (ft *FileTransfer) useBinaryChunks() bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.binaryChunks && len(ft.ID) == TransferIDSize
+}
+
+// encodeChunk encodes a chunk as a binary frame or as JSON
+func (ft *FileTransfer) encodeChunk(binaryChunks bool, chunkIndex int, data []byte) ([]byte, error) {
+	if binaryChunks {
+		return EncodeChunkFrame(ft.ID, chunkIndex, data)
+	}
+	return json.Marshal(&FileTransferMessage{
+		Type:        FileTransferChunk,
+		TransferID:  ft.ID,
+		ChunkIndex:  chunkIndex,
+		TotalChunks: ft.TotalChunks,
+		Data:        data,
+	})
+}
+
 // UpdateProgress updates transfer progress
 func (ft *FileTransfer) UpdateProgress(chunksCompleted int) {
 	ft.mu.Lock()
@@ -229,11 +748,92 @@ func (ft *FileTransfer) UpdateProgress(chunksCompleted int) {
 	}
 }
 
+// AddResumed counts bytes that were already transferred before a resume.
+// They shorten the ETA but do not add to the speed
+func (ft *FileTransfer) AddResumed(n int64) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	ft.BytesTransferred = min(ft.BytesTransferred+n, ft.FileSize)
+	ft.updateTimeLeft()
+}
+
+// AddTransferred counts bytes of a sent or received chunk and updates the speed
+func (ft *FileTransfer) AddTransferred(n int64) {
+	ft.addTransferredAt(n, time.Now())
+}
+
+// addTransferredAt is AddTransferred for a chunk done at now
+func (ft *FileTransfer) addTransferredAt(n int64, now time.Time) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	ft.BytesTransferred = min(ft.BytesTransferred+n, ft.FileSize)
+	ft.movedBytes += n
+	ft.BytesPerSecond = ft.addRateSample(now)
+	ft.updateTimeLeft()
+}
+
+// Speed returns the current transfer rate in bytes per second
+func (ft *FileTransfer) Speed() float64 {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.BytesPerSecond
+}
+
+// ETA returns the estimated time left at the current speed, 0 if unknown
+func (ft *FileTransfer) ETA() time.Duration {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.TimeLeft
+}
+
+// updateTimeLeft recomputes TimeLeft, ft.mu must be held
+func (ft *FileTransfer) updateTimeLeft() {
+	if ft.BytesPerSecond <= 0 {
+		ft.TimeLeft = 0
+		return
+	}
+	remaining := float64(ft.FileSize - ft.BytesTransferred)
+	ft.TimeLeft = time.Duration(remaining / ft.BytesPerSecond * float64(time.Second))
+}
+
+// context returns a context that is done once the transfer is cancelled
+func (ft *FileTransfer) context() context.Context {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	if ft.ctx == nil {
+		ft.ctx, ft.cancel = context.WithCancel(context.Background())
+		if ft.cancelled {
+			ft.cancel()
+		}
+	}
+	return ft.ctx
+}
+
+// isCancelled reports whether CancelTransfer was called
+func (ft *FileTransfer) isCancelled() bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.cancelled
+}
+
+// isTransferring reports whether chunks are being sent or received
+func (ft *FileTransfer) isTransferring() bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.Status == FileTransferTransferring
+}
+
 // Close closes transfer file
 func (ft *FileTransfer) Close() error {
 	ft.mu.Lock()
 	defer ft.mu.Unlock()
 
+	if ft.nackTimer != nil {
+		ft.nackTimer.Stop()
+	}
 	if ft.File != nil {
 		return ft.File.Close()
 	}
@@ -0,0 +1,1059 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/p2p"
+	p2ptest "github.com/udisondev/sendy/p2p/testing"
+	"github.com/udisondev/sendy/router"
+)
+
+func TestChunkBitset(t *testing.T) {
+	chunks := map[int]bool{0: true, 3: true, 8: true, 12: true}
+	bitset := EncodeChunkBitset(chunks, 13)
+	if len(bitset) != 2 {
+		t.Fatalf("expected 2 bytes, got %d", len(bitset))
+	}
+
+	decoded := DecodeChunkBitset(bitset)
+	if len(decoded) != len(chunks) {
+		t.Fatalf("expected %d chunks, got %d", len(chunks), len(decoded))
+	}
+	for idx := range chunks {
+		if !decoded[idx] {
+			t.Errorf("chunk %d missing after decode", idx)
+		}
+	}
+}
+
+func TestChunkFrame(t *testing.T) {
+	data := []byte("chunk data")
+	frame, err := EncodeChunkFrame("0123456789abcdef", 70000, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) != ChunkFrameHeaderSize+len(data) || !IsChunkFrame(frame) {
+		t.Fatalf("Unexpected frame: %x", frame)
+	}
+
+	msg, err := DecodeChunkFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != FileTransferChunk || msg.TransferID != "0123456789abcdef" || msg.ChunkIndex != 70000 || string(msg.Data) != "chunk data" {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+
+	// Empty chunk of an empty file
+	if frame, err := EncodeChunkFrame("0123456789abcdef", 0, nil); err != nil {
+		t.Fatal(err)
+	} else if msg, err := DecodeChunkFrame(frame); err != nil || len(msg.Data) != 0 {
+		t.Fatalf("Expected empty chunk, got %+v, %v", msg, err)
+	}
+
+	if _, err := EncodeChunkFrame("short", 0, data); err == nil {
+		t.Fatal("Expected error for a transfer ID that does not fit the frame")
+	}
+	if _, err := EncodeChunkFrame("0123456789abcdef", -1, data); err == nil {
+		t.Fatal("Expected error for a negative chunk index")
+	}
+	if _, err := DecodeChunkFrame(frame[:ChunkFrameHeaderSize-1]); err == nil {
+		t.Fatal("Expected error for a truncated frame")
+	}
+	// Text and JSON messages are not frames
+	for _, text := range []string{"", "hello", `{"type":1}`, "привет"} {
+		if IsChunkFrame([]byte(text)) {
+			t.Fatalf("%q must not be a chunk frame", text)
+		}
+	}
+}
+
+func TestTransferLogGroup(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	ft := &FileTransfer{ID: "0123456789abcdef", PeerID: router.PeerID{0xab}, FileName: "a.txt", FileSize: 10, TotalChunks: 1, Progress: 50}
+	ft.logger().Info("Sent chunk", ft.progressArgs("chunk", 0)...)
+
+	var record struct {
+		FileTransfer map[string]any `json:"file_transfer"`
+		Chunk        *int           `json:"chunk"`
+		Progress     int            `json:"progress"`
+		Speed        *int64         `json:"speed_bytes_per_sec"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Invalid log record %q: %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"transfer_id":  "0123456789abcdef",
+		"peer_id":      "ab00000000000000...",
+		"file_name":    "a.txt",
+		"file_size":    float64(10),
+		"total_chunks": float64(1),
+	}
+	if !maps.Equal(record.FileTransfer, want) {
+		t.Fatalf("Expected group %v, got %v", want, record.FileTransfer)
+	}
+	if record.Chunk == nil || record.Progress != 50 || record.Speed == nil {
+		t.Fatalf("Expected chunk, progress and speed, got %s", buf.String())
+	}
+}
+
+func TestResumeReceivingFromProgress(t *testing.T) {
+	dataDir := t.TempDir()
+	storage := newTestStorage(t)
+	ftm := NewFileTransferManager(storage, dataDir)
+	peerID := router.PeerID{1}
+
+	startMsg := &FileTransferMessage{
+		Type:        FileTransferStart,
+		TransferID:  "0123456789abcdef",
+		FileName:    "test.bin",
+		FileSize:    3 * ChunkSize,
+		TotalChunks: 3,
+	}
+
+	ft, err := ftm.StartReceiving(peerID, startMsg)
+	if err != nil {
+		t.Fatalf("StartReceiving: %v", err)
+	}
+	if err := storage.SaveFileTransfer(ft.ID, peerID, ft.FileName, ft.FileSize, ft.FilePath, false, string(FileTransferTransferring)); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, ChunkSize)
+	for i := range data {
+		data[i] = 0xAB
+	}
+	if _, err := ft.File.WriteAt(data, ChunkSize); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	ft.ChunksRecv[1] = true
+	ft.UpdateProgress(1)
+	ft.AddTransferred(ChunkSize)
+	if err := ftm.SaveProgress(ft); err != nil {
+		t.Fatalf("SaveProgress: %v", err)
+	}
+	ft.Close()
+
+	// Simulate receiver restart
+	ftm = NewFileTransferManager(storage, dataDir)
+	resumed, err := ftm.StartReceiving(peerID, startMsg)
+	if err != nil {
+		t.Fatalf("StartReceiving after restart: %v", err)
+	}
+	defer resumed.Close()
+
+	if len(resumed.ChunksRecv) != 1 || !resumed.ChunksRecv[1] {
+		t.Fatalf("expected chunk 1 to be restored, got %v", resumed.ChunksRecv)
+	}
+	if resumed.BytesTransferred != ChunkSize || resumed.Progress != 33 {
+		t.Fatalf("expected %d bytes and 33%%, got %d bytes and %d%%", ChunkSize, resumed.BytesTransferred, resumed.Progress)
+	}
+	if _, _, _, _, _, _, progress, err := storage.GetFileTransfer(ft.ID); err != nil || progress != 33 {
+		t.Fatalf("expected 33%% progress in the database, got %d (%v)", progress, err)
+	}
+
+	// Partial file must not be truncated
+	content, err := os.ReadFile(resumed.FilePath)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if len(content) != 2*ChunkSize || content[ChunkSize] != 0xAB {
+		t.Fatalf("partial file was truncated: len=%d", len(content))
+	}
+
+	if err := ftm.RemoveProgress(resumed.ID); err != nil {
+		t.Fatalf("RemoveProgress: %v", err)
+	}
+	if bitset, _, err := storage.GetFileTransferChunks(resumed.ID); err != nil || bitset != nil {
+		t.Fatalf("progress was not removed: %v, %v", bitset, err)
+	}
+}
+
+// TestProgressSavedEveryFewChunks checks that chunk progress reaches the
+// database only every ProgressSaveChunks chunks or on a flush
+func TestProgressSavedEveryFewChunks(t *testing.T) {
+	storage := newTestStorage(t)
+	ftm := NewFileTransferManager(storage, t.TempDir())
+	peerID := router.PeerID{1}
+	ft, err := ftm.StartReceiving(peerID, &FileTransferMessage{
+		TransferID:  "0123456789abcdef",
+		FileName:    "test.bin",
+		FileSize:    100 * ChunkSize,
+		TotalChunks: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ft.Close()
+	if err := storage.SaveFileTransfer(ft.ID, peerID, ft.FileName, ft.FileSize, ft.FilePath, false, string(FileTransferTransferring)); err != nil {
+		t.Fatal(err)
+	}
+	saved := func() int {
+		t.Helper()
+		bitset, _, err := storage.GetFileTransferChunks(ft.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(DecodeChunkBitset(bitset))
+	}
+	receive := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			ft.mu.Lock()
+			ft.ChunksRecv[i] = true
+			ft.mu.Unlock()
+			if err := ftm.chunkReceived(ft); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The first chunk is saved, the following ones only in batches
+	receive(0, 1)
+	if n := saved(); n != 1 {
+		t.Fatalf("Expected the first chunk saved, got %d", n)
+	}
+	receive(1, ProgressSaveChunks)
+	if n := saved(); n != 1 {
+		t.Fatalf("Expected progress not saved yet, got %d chunks", n)
+	}
+	receive(ProgressSaveChunks, ProgressSaveChunks+1)
+	if n := saved(); n != ProgressSaveChunks+1 {
+		t.Fatalf("Expected %d chunks saved, got %d", ProgressSaveChunks+1, n)
+	}
+
+	// A disconnect saves the rest
+	receive(ProgressSaveChunks+1, ProgressSaveChunks+3)
+	if err := ftm.FlushProgress(&router.PeerID{2}); err != nil || saved() != ProgressSaveChunks+1 {
+		t.Fatalf("Flush of another peer saved progress: %v", err)
+	}
+	if err := ftm.FlushProgress(&peerID); err != nil {
+		t.Fatal(err)
+	}
+	if n := saved(); n != ProgressSaveChunks+3 {
+		t.Fatalf("Expected %d chunks saved after flush, got %d", ProgressSaveChunks+3, n)
+	}
+}
+
+func TestTransferSpeedAndETA(t *testing.T) {
+	ft := &FileTransfer{FileSize: 10 * ChunkSize}
+	if ft.ETA() != 0 {
+		t.Fatal("ETA must be unknown before the first chunk")
+	}
+
+	// Two chunks were there before the resume and do not count to the speed
+	ft.AddResumed(2 * ChunkSize)
+	ft.StartedAt = time.Now().Add(-2 * time.Second)
+	ft.AddTransferred(4 * ChunkSize)
+
+	if ft.BytesTransferred != 6*ChunkSize {
+		t.Fatalf("Expected %d bytes, got %d", 6*ChunkSize, ft.BytesTransferred)
+	}
+	// 4 chunks in 2 seconds: the remaining 4 chunks take about 2 seconds
+	if speed := ft.Speed(); speed < 1.9*ChunkSize || speed > 2*ChunkSize {
+		t.Fatalf("Unexpected speed %.0f", speed)
+	}
+	if eta := ft.ETA(); eta < 1900*time.Millisecond || eta > 2100*time.Millisecond {
+		t.Fatalf("Unexpected ETA %v", eta)
+	}
+
+	// Bytes never exceed the file size
+	ft.AddTransferred(100 * ChunkSize)
+	if ft.BytesTransferred != ft.FileSize || ft.ETA() != 0 {
+		t.Fatalf("Expected complete transfer, got %d bytes, ETA %v", ft.BytesTransferred, ft.ETA())
+	}
+}
+
+func TestTransferSpeedWindow(t *testing.T) {
+	start := time.Unix(1000, 0)
+	ft := &FileTransfer{FileSize: 100 * ChunkSize, StartedAt: start}
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	// 10 chunks per second for 10 seconds, a sample every 100ms
+	for i := 1; i <= 100; i++ {
+		ft.addTransferredAt(ChunkSize, at(time.Duration(i)*100*time.Millisecond))
+	}
+	if speed := ft.Speed(); speed != 10*ChunkSize {
+		t.Fatalf("Expected %d B/s, got %.0f", 10*ChunkSize, speed)
+	}
+	if len(ft.rateSamples) > int(SpeedWindow/speedSampleInterval)+2 {
+		t.Fatalf("Expected samples within the window, got %d", len(ft.rateSamples))
+	}
+
+	// The link slows down to 1 chunk per second: once the window moves past
+	// the fast part, only the new rate counts
+	for i := 1; i <= 6; i++ {
+		ft.addTransferredAt(ChunkSize, at(10*time.Second+time.Duration(i)*time.Second))
+	}
+	if speed := ft.Speed(); speed != ChunkSize {
+		t.Fatalf("Expected %d B/s after slowing down, got %.0f", ChunkSize, speed)
+	}
+	// 106 chunks of 100 are done, nothing is left
+	if eta := ft.ETA(); eta != 0 {
+		t.Fatalf("Expected no time left, got %v", eta)
+	}
+
+	// Chunks a few milliseconds apart merge into about one sample per 100ms
+	ft = &FileTransfer{FileSize: 100 * ChunkSize, StartedAt: start}
+	for i := 1; i <= 20; i++ {
+		ft.addTransferredAt(ChunkSize, at(time.Duration(i)*10*time.Millisecond))
+	}
+	if len(ft.rateSamples) > 4 {
+		t.Fatalf("Expected merged samples, got %d", len(ft.rateSamples))
+	}
+	if speed := ft.Speed(); speed != 100*ChunkSize {
+		t.Fatalf("Expected %d B/s, got %.0f", 100*ChunkSize, speed)
+	}
+	// 80 chunks left at 100 per second
+	if eta := ft.ETA(); eta != 800*time.Millisecond {
+		t.Fatalf("Expected 800ms left, got %v", eta)
+	}
+
+	// The average covers the whole transfer, not just the window
+	ft = &FileTransfer{FileSize: 10 * ChunkSize, StartedAt: start}
+	ft.AddResumed(2 * ChunkSize)
+	ft.addTransferredAt(4*ChunkSize, at(time.Second))
+	ft.addTransferredAt(4*ChunkSize, at(20*time.Second))
+	if avg := ft.averageSpeed(); avg != 8*ChunkSize/20.0 {
+		t.Fatalf("Expected average %.0f B/s, got %.0f", 8*ChunkSize/20.0, avg)
+	}
+}
+
+func TestCancelTransfer(t *testing.T) {
+	storage := newTestStorage(t)
+	ftm := NewFileTransferManager(storage, t.TempDir())
+	peerID := router.PeerID{1}
+
+	filePath := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(filePath, make([]byte, 3*ChunkSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ft, err := ftm.StartSending(peerID, filePath)
+	if err != nil {
+		t.Fatalf("StartSending: %v", err)
+	}
+	storage.SaveFileTransfer(ft.ID, peerID, ft.FileName, ft.FileSize, ft.FilePath, true, string(FileTransferTransferring))
+
+	if active := ftm.ActiveTransfers(); len(active) != 1 || active[0] != ft {
+		t.Fatalf("Expected one active transfer, got %d", len(active))
+	}
+
+	if err := ftm.CancelTransfer(ft.ID); err != nil {
+		t.Fatalf("CancelTransfer: %v", err)
+	}
+	if !ft.isCancelled() || ft.Status != FileTransferCancelled {
+		t.Fatalf("Expected cancelled transfer, got %s", ft.Status)
+	}
+	// The sending loop reads from a closed file and stops
+	if _, err := ft.File.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Fatal("Expected file to be closed")
+	}
+	if _, ok := ftm.GetTransfer(ft.ID); ok {
+		t.Fatal("Cancelled transfer must be forgotten")
+	}
+	if len(ftm.ActiveTransfers()) != 0 {
+		t.Fatal("Cancelled transfer must not be active")
+	}
+	if _, _, _, _, _, status, _, err := storage.GetFileTransfer(ft.ID); err != nil || status != string(FileTransferCancelled) {
+		t.Fatalf("Expected cancelled status in storage, got %q, %v", status, err)
+	}
+
+	if err := ftm.CancelTransfer(ft.ID); !errors.Is(err, ErrTransferNotFound) {
+		t.Fatalf("Expected ErrTransferNotFound, got %v", err)
+	}
+}
+
+// TestCancelFileTransferFromPeer checks that a cancel from the receiver
+// stops our sending loop instead of failing it
+func TestCancelFileTransferFromPeer(t *testing.T) {
+	c := &Chat{
+		connector:       p2ptest.NewMockConnector(),
+		events:          make(chan ChatEvent, 10),
+		storage:         newTestStorage(t),
+		fileTransferMgr: NewFileTransferManager(nil, t.TempDir()),
+	}
+	peerID := router.PeerID{2}
+
+	filePath := filepath.Join(t.TempDir(), "doc.txt")
+	if err := os.WriteFile(filePath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ft, err := c.fileTransferMgr.StartSending(peerID, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.handleFileTransferMessage(peerID, &FileTransferMessage{Type: FileTransferCancel, TransferID: ft.ID})
+	if event := <-c.events; event.Type != ChatEventFileTransferFailed || event.FileTransfer != ft {
+		t.Fatalf("Unexpected event: %+v", event)
+	}
+	if !ft.isCancelled() {
+		t.Fatal("Expected transfer to be cancelled")
+	}
+
+	// The sending loop stops without reporting an error or cancelling back
+	c.sendFileChunks(peerID, ft)
+	select {
+	case event := <-c.events:
+		t.Fatalf("Unexpected event after cancel: %+v", event)
+	default:
+	}
+	if ft.Status != FileTransferCancelled {
+		t.Fatalf("Expected cancelled status, got %s", ft.Status)
+	}
+
+	if err := c.CancelFileTransfer(ft.ID); !errors.Is(err, ErrTransferNotFound) {
+		t.Fatalf("Expected ErrTransferNotFound, got %v", err)
+	}
+}
+
+func TestCancelFileTransferByUser(t *testing.T) {
+	storage := newTestStorage(t)
+	c := &Chat{
+		connector:       p2ptest.NewMockConnector(),
+		events:          make(chan ChatEvent, 10),
+		storage:         storage,
+		fileTransferMgr: NewFileTransferManager(storage, t.TempDir()),
+	}
+	peerID := router.PeerID{2}
+
+	ft, err := c.fileTransferMgr.StartReceiving(peerID, &FileTransferMessage{
+		TransferID:  "0123456789abcdef",
+		FileName:    "a.bin",
+		FileSize:    2 * ChunkSize,
+		TotalChunks: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.SaveFileTransfer(ft.ID, peerID, ft.FileName, ft.FileSize, ft.FilePath, false, string(FileTransferTransferring))
+	c.handleFileTransferMessage(peerID, &FileTransferMessage{Type: FileTransferChunk, TransferID: ft.ID, ChunkIndex: 0, Data: make([]byte, ChunkSize)})
+	if event := <-c.events; event.Type != ChatEventFileTransferProgress {
+		t.Fatalf("Expected progress, got %+v", event)
+	}
+
+	if err := c.CancelFileTransfer(ft.ID); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-c.events; event.Type != ChatEventFileTransferFailed || !errors.Is(event.Error, ErrCancelledByUser) {
+		t.Fatalf("Expected cancel by user, got %+v", event)
+	}
+	if _, err := os.Stat(ft.FilePath); !os.IsNotExist(err) {
+		t.Fatalf("Expected partial file to be deleted, got %v", err)
+	}
+	if bitset, _, err := storage.GetFileTransferChunks(ft.ID); err != nil || bitset != nil {
+		t.Fatalf("Expected progress to be removed, got %v, %v", bitset, err)
+	}
+	if _, _, _, _, _, status, _, err := storage.GetFileTransfer(ft.ID); err != nil || status != string(FileTransferCancelled) {
+		t.Fatalf("Expected cancelled status in storage, got %q, %v", status, err)
+	}
+
+	// A send blocked on a full channel stops right away
+	sender, outgoing := newSendingTransfer(t, 3*ChunkSize)
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- sender.sendChunks(outgoing.logger(), outgoing, 1, func(ctx context.Context, data []byte) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := sender.CancelFileTransfer(outgoing.ID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sendErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sending did not stop after cancel")
+	}
+	if _, err := os.Stat(outgoing.FilePath); err != nil {
+		t.Fatalf("Sent file must be kept: %v", err)
+	}
+}
+
+// newSendingTransfer starts sending a file of size bytes from a chat that
+// drains its events
+func newSendingTransfer(tb testing.TB, size int) (*Chat, *FileTransfer) {
+	tb.Helper()
+
+	c := &Chat{
+		connector:       p2ptest.NewMockConnector(),
+		events:          make(chan ChatEvent, 10),
+		storage:         newTestStorage(tb),
+		fileTransferMgr: NewFileTransferManager(nil, tb.TempDir()),
+	}
+	go func() {
+		for range c.events {
+		}
+	}()
+	tb.Cleanup(func() { close(c.events) })
+
+	filePath := filepath.Join(tb.TempDir(), "data.bin")
+	if err := os.WriteFile(filePath, make([]byte, size), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	ft, err := c.fileTransferMgr.StartSending(router.PeerID{2}, filePath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ft.File.Close() })
+	return c, ft
+}
+
+func TestSendChunksConcurrently(t *testing.T) {
+	c, ft := newSendingTransfer(t, 10*ChunkSize+100)
+
+	var mu sync.Mutex
+	sent := make(map[int]int)
+	err := c.sendChunks(ft.logger(), ft, 4, func(ctx context.Context, data []byte) error {
+		var msg FileTransferMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		mu.Lock()
+		sent[msg.ChunkIndex] = len(msg.Data)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != ft.TotalChunks || sent[ft.TotalChunks-1] != 100 {
+		t.Fatalf("Expected %d chunks with a 100 byte tail, got %v", ft.TotalChunks, sent)
+	}
+	if ft.Progress != 100 {
+		t.Fatalf("Expected 100%% progress, got %d", ft.Progress)
+	}
+
+	// The first error stops the remaining chunks
+	errSend := errors.New("send failed")
+	var calls int
+	err = c.sendChunks(ft.logger(), ft, 4, func(ctx context.Context, data []byte) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return errSend
+	})
+	if !errors.Is(err, errSend) {
+		t.Fatalf("Expected send error, got %v", err)
+	}
+	if calls > 4 {
+		t.Fatalf("Expected at most 4 sends after the error, got %d", calls)
+	}
+}
+
+// TestSendChunksBinary checks that chunks go as binary frames once the
+// receiver said it supports them
+func TestSendChunksBinary(t *testing.T) {
+	c, ft := newSendingTransfer(t, 3*ChunkSize+100)
+	ft.binaryChunks = true
+
+	var mu sync.Mutex
+	sent := make(map[int]int)
+	err := c.sendChunks(ft.logger(), ft, 2, func(ctx context.Context, data []byte) error {
+		msg, err := DecodeChunkFrame(data)
+		if err != nil {
+			return err
+		}
+		if msg.TransferID != ft.ID {
+			return errors.New("wrong transfer id")
+		}
+		mu.Lock()
+		sent[msg.ChunkIndex] = len(msg.Data)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != ft.TotalChunks || sent[0] != ChunkSize || sent[ft.TotalChunks-1] != 100 {
+		t.Fatalf("Expected %d chunks with a 100 byte tail, got %v", ft.TotalChunks, sent)
+	}
+}
+
+func TestSendChunksRateLimit(t *testing.T) {
+	const limit = 2 << 20
+	c, ft := newSendingTransfer(t, 40*ChunkSize)
+	c.fileTransferMgr.SetRateLimit(limit)
+
+	start := time.Now()
+	err := c.sendChunks(ft.logger(), ft, 4, func(ctx context.Context, data []byte) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Throughput of the whole file, the bucket lets only the first chunk
+	// through without waiting
+	rate := float64(ft.FileSize) / time.Since(start).Seconds()
+	if rate < 0.9*limit || rate > 1.1*limit {
+		t.Fatalf("Expected throughput within 10%% of %d B/s, got %.0f B/s", limit, rate)
+	}
+	if speed := ft.Speed(); speed < 0.9*limit || speed > 1.1*limit {
+		t.Fatalf("Expected reported speed within 10%% of %d B/s, got %.0f B/s", limit, speed)
+	}
+}
+
+// BenchmarkSendChunks sends a 10 MB file over a link with a fixed latency
+// per chunk, one chunk at a time and four at once
+func BenchmarkSendChunks(b *testing.B) {
+	const (
+		fileSize = 10 << 20
+		latency  = 100 * time.Microsecond
+	)
+	send := func(ctx context.Context, data []byte) error {
+		time.Sleep(latency)
+		return nil
+	}
+
+	for _, bench := range []struct {
+		name        string
+		concurrency int
+	}{
+		{"sequential", 1},
+		{"concurrent-4", 4},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			c, ft := newSendingTransfer(b, fileSize)
+			b.SetBytes(fileSize)
+			b.ResetTimer()
+			for b.Loop() {
+				if err := c.sendChunks(ft.logger(), ft, bench.concurrency, send); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestFileOffer checks that an incoming file waits for the user: nothing is
+// written before AcceptFileTransfer and chunks of an offer are dropped
+func TestFileOffer(t *testing.T) {
+	connector := p2ptest.NewMockConnector()
+	storage := newTestStorage(t)
+	dataDir := t.TempDir()
+	c := &Chat{
+		connector:       connector,
+		events:          make(chan ChatEvent, 10),
+		storage:         storage,
+		fileTransferMgr: NewFileTransferManager(storage, dataDir),
+	}
+	peerID := router.PeerID{2}
+	filesDir := filepath.Join(dataDir, "files")
+	offerMsg := func(id string) *FileTransferMessage {
+		return &FileTransferMessage{Type: FileTransferStart, TransferID: id, FileName: "photo.jpg", FileSize: 10, TotalChunks: 1}
+	}
+
+	c.handleFileTransferMessage(peerID, offerMsg("0123456789abcdef"))
+	event := <-c.events
+	if event.Type != ChatEventFileOfferReceived || event.FileTransfer.ID != "0123456789abcdef" || event.FileTransfer.FileName != "photo.jpg" {
+		t.Fatalf("Unexpected event: %+v", event)
+	}
+	c.handleFileTransferMessage(peerID, &FileTransferMessage{Type: FileTransferChunk, TransferID: "0123456789abcdef", Data: []byte("0123456789")})
+	if entries, _ := os.ReadDir(filesDir); len(entries) != 0 {
+		t.Fatalf("Expected nothing on disk before accept, got %d files", len(entries))
+	}
+
+	// Accepting needs the sender online, the offer waits for a retry
+	if err := c.AcceptFileTransfer("0123456789abcdef"); err == nil {
+		t.Fatal("Expected error accepting from an offline peer")
+	}
+	if offers := c.FileOffers(); len(offers) != 1 {
+		t.Fatalf("Expected the offer to stay, got %d", len(offers))
+	}
+
+	if err := c.RejectFileTransfer("0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RejectFileTransfer("0123456789abcdef"); !errors.Is(err, ErrTransferNotFound) {
+		t.Fatalf("Expected ErrTransferNotFound, got %v", err)
+	}
+	if err := c.AcceptFileTransfer("0123456789abcdef"); !errors.Is(err, ErrTransferNotFound) {
+		t.Fatalf("Expected ErrTransferNotFound, got %v", err)
+	}
+
+	// A withdrawn offer is reported like a cancelled transfer
+	c.handleFileTransferMessage(peerID, offerMsg("fedcba9876543210"))
+	<-c.events
+	c.handleFileTransferMessage(peerID, &FileTransferMessage{Type: FileTransferCancel, TransferID: "fedcba9876543210"})
+	if event := <-c.events; event.Type != ChatEventFileTransferFailed || event.FileTransfer.ID != "fedcba9876543210" {
+		t.Fatalf("Unexpected event: %+v", event)
+	}
+	if offers := c.FileOffers(); len(offers) != 0 {
+		t.Fatalf("Expected no offers, got %d", len(offers))
+	}
+
+	// Resuming a transfer that was never accepted asks the user too
+	resume := offerMsg("00112233aabbccdd")
+	resume.Type = FileTransferResumeRequest
+	c.handleFileTransferMessage(peerID, resume)
+	if event := <-c.events; event.Type != ChatEventFileOfferReceived || event.FileTransfer.ID != resume.TransferID {
+		t.Fatalf("Unexpected event: %+v", event)
+	}
+	if entries, _ := os.ReadDir(filesDir); len(entries) != 0 {
+		t.Fatalf("Expected nothing on disk before accept, got %d files", len(entries))
+	}
+}
+
+// TestSendFileWaitsForAccept checks that chunks go only after the receiver
+// accepts or resumes, and only once
+func TestSendFileWaitsForAccept(t *testing.T) {
+	for name, typ := range map[string]FileTransferType{"accept": FileTransferAccept, "resume": FileTransferResume} {
+		t.Run(name, func(t *testing.T) {
+			c := &Chat{
+				connector:       p2ptest.NewMockConnector(),
+				events:          make(chan ChatEvent, 10),
+				storage:         newTestStorage(t),
+				fileTransferMgr: NewFileTransferManager(nil, t.TempDir()),
+			}
+			peerID := router.PeerID{2}
+
+			filePath := filepath.Join(t.TempDir(), "doc.txt")
+			if err := os.WriteFile(filePath, []byte("hello"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ft, err := c.fileTransferMgr.StartSending(peerID, filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Only the receiver can accept
+			c.handleFileTransferMessage(router.PeerID{3}, &FileTransferMessage{Type: typ, TransferID: ft.ID})
+			if ft.Status != FileTransferPending {
+				t.Fatalf("Expected pending transfer, got %s", ft.Status)
+			}
+
+			// The sending loop starts and fails: the mock peer is offline
+			c.handleFileTransferMessage(peerID, &FileTransferMessage{Type: typ, TransferID: ft.ID})
+			select {
+			case event := <-c.events:
+				if event.Type != ChatEventFileTransferFailed || event.FileTransfer != ft {
+					t.Fatalf("Unexpected event: %+v", event)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timeout waiting for the sending loop")
+			}
+
+			c.handleFileTransferMessage(peerID, &FileTransferMessage{Type: typ, TransferID: ft.ID})
+			select {
+			case event := <-c.events:
+				t.Fatalf("Unexpected event after a repeated %s: %+v", name, event)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestTransferQueue(t *testing.T) {
+	connector := p2ptest.NewMockConnector()
+	c := &Chat{
+		connector:       connector,
+		events:          make(chan ChatEvent, 20),
+		storage:         newTestStorage(t),
+		fileTransferMgr: NewFileTransferManager(nil, t.TempDir()),
+	}
+	c.SetTransferLimits(1, 2)
+
+	var started []string
+	schedule := func(peerID router.PeerID, name string) *FileTransfer {
+		t.Helper()
+		filePath := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(filePath, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ft, err := c.fileTransferMgr.StartSending(peerID, filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.scheduleTransfer(ft, func() error {
+			started = append(started, name)
+			return nil
+		})
+		return ft
+	}
+	a1 := schedule(router.PeerID{1}, "a1")
+	a2 := schedule(router.PeerID{1}, "a2")
+	b1 := schedule(router.PeerID{2}, "b1")
+	c1 := schedule(router.PeerID{3}, "c1")
+
+	// One transfer per peer, two in total
+	if !slices.Equal(started, []string{"a1", "b1"}) {
+		t.Fatalf("Expected a1 and b1 to start, got %v", started)
+	}
+	for ft, want := range map[*FileTransfer]int{a2: 0, c1: 1} {
+		if ahead, queued := ft.QueuePosition(); !queued || ahead != want {
+			t.Errorf("%s: expected queued with %d ahead, got %d, %v", ft.FileName, want, ahead, queued)
+		}
+	}
+	if _, queued := a1.QueuePosition(); queued || a1.Status != FileTransferPending {
+		t.Errorf("Expected a1 pending, got %s", a1.Status)
+	}
+	if got := c.ListTransfers(); !slices.Equal(got, []*FileTransfer{a1, b1, a2, c1}) {
+		t.Fatalf("Unexpected transfer list: %v", got)
+	}
+
+	// a2 and c1 were reported queued
+	for range 2 {
+		if event := <-c.events; event.Type != ChatEventFileTransferProgress {
+			t.Fatalf("Expected queue position event, got %+v", event)
+		}
+	}
+
+	// A queued transfer goes without a word to the peer
+	calls := len(connector.CallsTo("GetPeer"))
+	if err := c.CancelFileTransfer(a2.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(connector.CallsTo("GetPeer")); n != calls {
+		t.Errorf("Expected no network access for a queued transfer, got %d calls", n-calls)
+	}
+	if event := <-c.events; event.FileTransfer != a2 || !errors.Is(event.Error, ErrCancelledByUser) {
+		t.Fatalf("Expected a2 cancelled, got %+v", event)
+	}
+	if event := <-c.events; event.FileTransfer != c1 || event.Type != ChatEventFileTransferProgress {
+		t.Fatalf("Expected c1 to move up, got %+v", event)
+	}
+	if ahead, _ := c1.QueuePosition(); ahead != 0 {
+		t.Errorf("Expected c1 first in the queue, got %d ahead", ahead)
+	}
+
+	// A finished transfer frees its slot for the next one
+	c.releaseTransfer(b1)
+	if !slices.Equal(started, []string{"a1", "b1", "c1"}) {
+		t.Fatalf("Expected c1 to start, got %v", started)
+	}
+	if got := c.ListTransfers(); len(got) != 3 || slices.Contains(got, a2) {
+		t.Fatalf("Unexpected transfer list: %v", got)
+	}
+}
+
+func TestAutoAcceptFilesFromVerifiedContacts(t *testing.T) {
+	connector := p2ptest.NewMockConnector()
+	storage := newTestStorage(t)
+	dataDir := t.TempDir()
+	c := &Chat{
+		connector:       connector,
+		events:          make(chan ChatEvent, 10),
+		storage:         storage,
+		fileTransferMgr: NewFileTransferManager(storage, dataDir),
+	}
+	verified, unverified := router.PeerID{2}, router.PeerID{3}
+	for _, peerID := range []router.PeerID{verified, unverified} {
+		if err := storage.AddContact(peerID, "peer"); err != nil {
+			t.Fatal(err)
+		}
+		connector.SetPeer(&p2p.Peer{ID: peerID})
+	}
+	if err := storage.SetVerified(verified, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetAutoAcceptFiles(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The option survives a restart
+	restarted := &Chat{storage: storage}
+	restarted.loadAutoAcceptFiles()
+	if !restarted.AutoAcceptFiles() {
+		t.Fatal("Expected auto-accept to be restored")
+	}
+
+	c.handleFileTransferMessage(unverified, &FileTransferMessage{Type: FileTransferStart, TransferID: "0123456789abcdef", FileName: "a.txt", FileSize: 1, TotalChunks: 1})
+	if event := <-c.events; event.Type != ChatEventFileOfferReceived {
+		t.Fatalf("Expected an offer from an unverified contact, got %+v", event)
+	}
+
+	// The mock peer has no data channel, so the accept is created on disk
+	// but cannot be sent
+	c.handleFileTransferMessage(verified, &FileTransferMessage{Type: FileTransferStart, TransferID: "fedcba9876543210", FileName: "b.txt", FileSize: 1, TotalChunks: 1})
+	if event := <-c.events; event.Type != ChatEventFileTransferFailed || event.FileTransfer.ID != "fedcba9876543210" {
+		t.Fatalf("Expected the file to be accepted without asking, got %+v", event)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "files", "fedcba9876543210_b.txt")); err != nil {
+		t.Fatalf("Expected accepted file on disk: %v", err)
+	}
+	if offers := c.FileOffers(); len(offers) != 1 || offers[0].ID != "0123456789abcdef" {
+		t.Fatalf("Expected only the unverified offer to wait, got %d", len(offers))
+	}
+}
+
+// TestRetransmitMissingChunks drops chunks on the way and checks that the
+// receiver gets them after asking for them
+func TestRetransmitMissingChunks(t *testing.T) {
+	sender, ft := newSendingTransfer(t, 5*ChunkSize+10)
+	content := make([]byte, 5*ChunkSize+10)
+	for i := range content {
+		content[i] = byte(i / ChunkSize)
+	}
+	if err := os.WriteFile(ft.FilePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := CalculateFileHash(ft.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft.Hash = hash
+
+	storage := newTestStorage(t)
+	receiver := &Chat{
+		connector:            p2ptest.NewMockConnector(),
+		events:               make(chan ChatEvent, 100),
+		storage:              storage,
+		fileTransferMgr:      NewFileTransferManager(storage, t.TempDir()),
+		missingChunksTimeout: time.Hour,
+	}
+	senderID := router.PeerID{1}
+	incoming, err := receiver.fileTransferMgr.StartReceiving(senderID, &FileTransferMessage{
+		TransferID:  ft.ID,
+		FileName:    ft.FileName,
+		FileSize:    ft.FileSize,
+		TotalChunks: ft.TotalChunks,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver := func(drop ...int) func(ctx context.Context, data []byte) error {
+		return func(ctx context.Context, data []byte) error {
+			msg, err := DecodeFileMessage(data)
+			if err != nil {
+				return err
+			}
+			if !slices.Contains(drop, msg.ChunkIndex) {
+				receiver.handleFileTransferMessage(senderID, msg)
+			}
+			return nil
+		}
+	}
+	end := &FileTransferMessage{Type: FileTransferEnd, TransferID: ft.ID, SHA256Hash: hash}
+
+	if err := sender.sendChunks(ft.logger(), ft, 1, deliver(1, 3)); err != nil {
+		t.Fatal(err)
+	}
+	receiver.handleFileTransferMessage(senderID, end)
+
+	missing, err := incoming.nextNackRound()
+	if err != nil || !slices.Equal(missing, []int{1, 3}) {
+		t.Fatalf("Expected chunks 1 and 3 missing, got %v, %v", missing, err)
+	}
+	if err := sender.resendChunks(ft, missing, deliver()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The re-sent END comes after the file is complete
+	receiver.handleFileTransferMessage(senderID, end)
+
+	var completed int
+	for len(receiver.events) > 0 {
+		event := <-receiver.events
+		switch event.Type {
+		case ChatEventFileTransferCompleted:
+			completed++
+		case ChatEventFileTransferFailed:
+			t.Fatalf("Transfer failed: %v", event.Error)
+		}
+	}
+	if completed != 1 {
+		t.Fatalf("Expected one completion, got %d", completed)
+	}
+	received, err := os.ReadFile(incoming.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatal("Received file differs from the sent one")
+	}
+}
+
+// TestMissingChunksFail checks that the receiver gives up after
+// MaxNackRounds requests the sender does not answer
+func TestMissingChunksFail(t *testing.T) {
+	storage := newTestStorage(t)
+	receiver := &Chat{
+		connector:            p2ptest.NewMockConnector(),
+		events:               make(chan ChatEvent, 10),
+		storage:              storage,
+		fileTransferMgr:      NewFileTransferManager(storage, t.TempDir()),
+		missingChunksTimeout: 10 * time.Millisecond,
+	}
+	senderID := router.PeerID{1}
+	ft, err := receiver.fileTransferMgr.StartReceiving(senderID, &FileTransferMessage{
+		TransferID:  "0123456789abcdef",
+		FileName:    "a.bin",
+		FileSize:    3 * ChunkSize,
+		TotalChunks: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.handleFileTransferMessage(senderID, &FileTransferMessage{Type: FileTransferChunk, TransferID: ft.ID, ChunkIndex: 0, Data: make([]byte, ChunkSize)})
+	receiver.handleFileTransferMessage(senderID, &FileTransferMessage{Type: FileTransferEnd, TransferID: ft.ID, SHA256Hash: "hash"})
+
+	select {
+	case event := <-receiver.events:
+		if event.Type != ChatEventFileTransferFailed || !errors.Is(event.Error, ErrMissingChunks) {
+			t.Fatalf("Expected failure for missing chunks, got %+v", event)
+		}
+		if !strings.HasSuffix(event.Error.Error(), "after 3 requests: 1, 2") {
+			t.Fatalf("Expected missing chunks in the error, got %v", event.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Transfer with missing chunks did not fail")
+	}
+
+	if got := formatChunks([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}); got != "0, 1, 2, 3, 4, 5, 6, 7, 8, 9 and 2 more" {
+		t.Fatalf("Unexpected chunk list: %q", got)
+	}
+}
+
+// BenchmarkChunkEncoding encodes and decodes a full chunk as JSON and as a
+// binary frame
+func BenchmarkChunkEncoding(b *testing.B) {
+	data := make([]byte, ChunkSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	const transferID = "0123456789abcdef"
+
+	b.Run("json", func(b *testing.B) {
+		b.SetBytes(ChunkSize)
+		b.ReportAllocs()
+		for b.Loop() {
+			encoded, err := json.Marshal(&FileTransferMessage{Type: FileTransferChunk, TransferID: transferID, ChunkIndex: 7, TotalChunks: 100, Data: data})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := DecodeFileMessage(encoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		b.SetBytes(ChunkSize)
+		b.ReportAllocs()
+		for b.Loop() {
+			encoded, err := EncodeChunkFrame(transferID, 7, data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := DecodeChunkFrame(encoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
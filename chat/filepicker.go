@@ -5,6 +5,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 
@@ -20,12 +21,15 @@ type FilePickerModel struct {
 	selected    int
 	width       int
 	height      int
-	onSelect    func(string) // Callback when a file is selected
-	onCancel    func()       // Callback when cancelled
+	marked      []string       // Paths marked with space, in the order marked
+	onSelect    func([]string) // Callback with the marked paths or the file under the cursor
+	onCancel    func()         // Callback when cancelled
 }
 
-// NewFilePicker creates a new file browser
-func NewFilePicker(startDir string, onSelect func(string), onCancel func()) *FilePickerModel {
+// NewFilePicker creates a new file browser. Space marks files and folders,
+// possibly in several directories, and enter passes them to onSelect.
+// Without marks enter opens a folder or picks the file under the cursor
+func NewFilePicker(startDir string, onSelect func([]string), onCancel func()) *FilePickerModel {
 	if startDir == "" {
 		startDir, _ = os.UserHomeDir()
 	}
@@ -100,8 +104,20 @@ func (fp *FilePickerModel) Update(msg tea.Msg) (*FilePickerModel, tea.Cmd) {
 				fp.selected++
 			}
 
-		case key.Matches(msg, key.NewBinding(key.WithKeys("enter"))):
+		case key.Matches(msg, key.NewBinding(key.WithKeys(" "))):
 			if len(fp.entries) > 0 {
+				fp.toggleMark(filepath.Join(fp.currentDir, fp.entries[fp.selected].Name()))
+				if fp.selected < len(fp.entries)-1 {
+					fp.selected++
+				}
+			}
+
+		case key.Matches(msg, key.NewBinding(key.WithKeys("enter"))):
+			if len(fp.marked) > 0 {
+				if fp.onSelect != nil {
+					fp.onSelect(fp.marked)
+				}
+			} else if len(fp.entries) > 0 {
 				entry := fp.entries[fp.selected]
 				path := filepath.Join(fp.currentDir, entry.Name())
 
@@ -113,7 +129,7 @@ func (fp *FilePickerModel) Update(msg tea.Msg) (*FilePickerModel, tea.Cmd) {
 				} else {
 					// Select file
 					if fp.onSelect != nil {
-						fp.onSelect(path)
+						fp.onSelect([]string{path})
 					}
 				}
 			}
@@ -138,6 +154,15 @@ func (fp *FilePickerModel) Update(msg tea.Msg) (*FilePickerModel, tea.Cmd) {
 	return fp, nil
 }
 
+// toggleMark marks path or removes its mark
+func (fp *FilePickerModel) toggleMark(path string) {
+	if i := slices.Index(fp.marked, path); i >= 0 {
+		fp.marked = slices.Delete(fp.marked, i, i+1)
+		return
+	}
+	fp.marked = append(fp.marked, path)
+}
+
 // View renders the file browser
 func (fp *FilePickerModel) View() string {
 	var b strings.Builder
@@ -161,7 +186,11 @@ func (fp *FilePickerModel) View() string {
 		Padding(0, 1)
 
 	// Header
-	b.WriteString(headerStyle.Render("📁 Select File to Send"))
+	title := "📁 Select File to Send"
+	if len(fp.marked) > 0 {
+		title = fmt.Sprintf("📁 Send %d Marked", len(fp.marked))
+	}
+	b.WriteString(headerStyle.Render(title))
 	b.WriteString("\n")
 	b.WriteString(lipgloss.NewStyle().Faint(true).Render(fp.currentDir))
 	b.WriteString("\n\n")
@@ -230,11 +259,16 @@ func (fp *FilePickerModel) View() string {
 			}
 		}
 
+		mark := "  "
+		if slices.Contains(fp.marked, filepath.Join(fp.currentDir, name)) {
+			mark = "✓ "
+		}
+
 		var line string
 		if entry.IsDir() {
-			line = dirStyle.Render("📁 " + name + "/")
+			line = dirStyle.Render(mark + "📁 " + name + "/")
 		} else {
-			line = fileStyle.Render("📄 " + name + sizeStr)
+			line = fileStyle.Render(mark + "📄 " + name + sizeStr)
 		}
 
 		if i == fp.selected {
@@ -254,7 +288,7 @@ func (fp *FilePickerModel) View() string {
 	// Hints
 	b.WriteString("\n")
 	helpStyle := lipgloss.NewStyle().Faint(true)
-	b.WriteString(helpStyle.Render("↑/↓: navigate • Enter: select/open • Backspace: parent dir • g: home • Esc: cancel"))
+	b.WriteString(helpStyle.Render("↑/↓: navigate • Space: mark • Enter: send marked/select/open • Backspace: parent dir • g: home • Esc: cancel"))
 
 	return b.String()
 }
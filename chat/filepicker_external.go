@@ -10,7 +10,8 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 )
 
-// fileSelectedMsg contains path to selected file
+// fileSelectedMsg reports that fzf exited, the picked paths are read
+// with ReadFzfResult
 type fileSelectedMsg struct {
 	filePath string
 	startDir string
@@ -45,14 +46,14 @@ func createFzfCmd(startDir string) *exec.Cmd {
 	// Shell command that launches fd | fzf and saves result to temporary file
 	shellCmd := fmt.Sprintf(`
 cd %s && \
-fd --type f --hidden --exclude .git --exclude node_modules --exclude .DS_Store --color always . | \
-fzf --height 80%% --reverse --border \
-  --prompt '📁 Select file to send: ' \
-  --header 'Tab: toggle preview | Enter: select | Esc: cancel' \
-  --preview 'head -n 100 {}' \
+fd --type f --type d --hidden --exclude .git --exclude node_modules --exclude .DS_Store --color always . | \
+fzf --height 80%% --reverse --border --multi \
+  --prompt '📁 Select files or folders to send: ' \
+  --header 'Tab: mark | Enter: send | Ctrl-T: toggle preview | Esc: cancel' \
+  --preview '[ -d {} ] && ls {} || head -n 100 {}' \
   --preview-window 'right:50%%:wrap' \
   --ansi --info inline \
-  --bind 'tab:toggle-preview' \
+  --bind 'ctrl-t:toggle-preview' \
   --bind 'ctrl-/:change-preview-window(down|hidden|)' \
   > %s
 `,
@@ -63,30 +64,37 @@ fzf --height 80%% --reverse --border \
 	return cmd
 }
 
-// ReadFzfResult reads the result from a temporary file
-func ReadFzfResult(startDir string) (string, error) {
+// ReadFzfResult reads the picked paths from a temporary file, one per line.
+// Without marks fzf returns the path under the cursor
+func ReadFzfResult(startDir string) ([]string, error) {
 	tmpFile := filepath.Join(os.TempDir(), fmt.Sprintf("sendychat-file-selection-%d", os.Getpid()))
 	defer os.Remove(tmpFile) // Remove temporary file
 
 	data, err := os.ReadFile(tmpFile)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return "", fmt.Errorf("cancelled")
+			return nil, fmt.Errorf("cancelled")
 		}
-		return "", fmt.Errorf("read result: %w", err)
+		return nil, fmt.Errorf("read result: %w", err)
 	}
 
-	selectedFile := strings.TrimSpace(string(data))
-	if selectedFile == "" {
-		return "", fmt.Errorf("no file selected")
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		path := strings.TrimSpace(line)
+		if path == "" {
+			continue
+		}
+		// If path is relative, make it absolute
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(startDir, path)
+		}
+		paths = append(paths, path)
 	}
-
-	// If path is relative, make it absolute
-	if !filepath.IsAbs(selectedFile) {
-		selectedFile = filepath.Join(startDir, selectedFile)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no file selected")
 	}
 
-	return selectedFile, nil
+	return paths, nil
 }
 
 // escapeShellArg escapes an argument for safe use in shell
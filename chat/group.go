@@ -0,0 +1,358 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// Group is a group conversation. Its messages are stored under the group ID
+// the way one-to-one messages are stored under the contact's peer ID
+type Group struct {
+	ID      router.PeerID // Random group ID
+	Name    string
+	Members []router.PeerID // Other participants, never includes us
+}
+
+// GroupEnvelope carries a group message. There is no group server: the
+// sender sends a copy to every member over the data channel. Name and
+// Members list all participants, including the sender, so that members
+// learn about the group from its first message
+type GroupEnvelope struct {
+	GroupID string   `json:"group_id"`
+	Name    string   `json:"name,omitempty"`
+	Members []string `json:"members,omitempty"`
+	Content string   `json:"content"`
+}
+
+// parseGroupEnvelope reports whether data is a group message
+func parseGroupEnvelope(data []byte) (*GroupEnvelope, bool) {
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return nil, false
+	}
+	var env GroupEnvelope
+	if err := json.Unmarshal(data, &env); err != nil || env.GroupID == "" {
+		return nil, false
+	}
+	return &env, true
+}
+
+// SaveGroup creates or replaces a group
+func (s *Storage) SaveGroup(group *Group) error {
+	// SECURITY: Validate group name and size
+	if len(group.Name) == 0 {
+		return fmt.Errorf("group name cannot be empty")
+	}
+	if len(group.Name) > MaxContactName {
+		return fmt.Errorf("group name too long: %d bytes (max %d)", len(group.Name), MaxContactName)
+	}
+	if len(group.Members) > MaxGroupMembers {
+		return fmt.Errorf("too many group members: %d (max %d)", len(group.Members), MaxGroupMembers)
+	}
+
+	members := make([]string, len(group.Members))
+	for i, member := range group.Members {
+		members[i] = hex.EncodeToString(member[:])
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO groups (id, name, members)
+		VALUES (?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET name = excluded.name, members = excluded.members
+	`, hex.EncodeToString(group.ID[:]), group.Name, strings.Join(members, ","))
+	return err
+}
+
+// GetGroup returns a group by ID
+func (s *Storage) GetGroup(id router.PeerID) (*Group, error) {
+	row := s.db.QueryRow(`SELECT id, name, members FROM groups WHERE id = ?`, hex.EncodeToString(id[:]))
+	return scanGroup(row)
+}
+
+// GetGroups returns all groups sorted by name
+func (s *Storage) GetGroups() ([]*Group, error) {
+	rows, err := s.db.Query(`SELECT id, name, members FROM groups ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*Group
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+// scanGroup scans a groups row selected as id, name, members
+func scanGroup(row interface{ Scan(dest ...any) error }) (*Group, error) {
+	var group Group
+	var hexID, members string
+	var name sql.NullString
+
+	if err := row.Scan(&hexID, &name, &members); err != nil {
+		return nil, err
+	}
+
+	// SECURITY: Check hex decoding error
+	id, err := parsePeerID(hexID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid group id in database: %w", err)
+	}
+	group.ID = id
+	group.Name = name.String
+
+	if members != "" {
+		for _, hexMember := range strings.Split(members, ",") {
+			member, err := parsePeerID(hexMember)
+			if err != nil {
+				return nil, fmt.Errorf("invalid group member in database: %w", err)
+			}
+			group.Members = append(group.Members, member)
+		}
+	}
+
+	return &group, nil
+}
+
+// CreateGroup creates a group with a random ID. Members learn about the
+// group from its first message
+func (c *Chat) CreateGroup(name string, members []router.PeerID) (*Group, error) {
+	localID := c.connector.LocalID()
+
+	var unique []router.PeerID
+	for _, member := range members {
+		if member != localID && !slices.Contains(unique, member) {
+			unique = append(unique, member)
+		}
+	}
+	if len(unique) == 0 {
+		return nil, fmt.Errorf("group needs at least one member")
+	}
+
+	group := &Group{Name: name, Members: unique}
+	if _, err := rand.Read(group.ID[:]); err != nil {
+		return nil, fmt.Errorf("generate group id: %w", err)
+	}
+	if err := c.storage.SaveGroup(group); err != nil {
+		return nil, fmt.Errorf("save group: %w", err)
+	}
+
+	slog.Info("Created group", "groupID", hex.EncodeToString(group.ID[:8])+"...", "members", len(unique))
+	return group, nil
+}
+
+// GetGroups returns all groups
+func (c *Chat) GetGroups() ([]*Group, error) {
+	return c.storage.GetGroups()
+}
+
+// groupContacts returns groups as contacts with IsGroup set, so that the
+// contact list shows them next to one-to-one conversations
+func (c *Chat) groupContacts() ([]*Contact, error) {
+	groups, err := c.storage.GetGroups()
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]router.PeerID, len(groups))
+	for i, group := range groups {
+		ids[i] = group.ID
+	}
+	lastMessages, err := c.storage.GetLastMessages(ids)
+	if err != nil {
+		return nil, fmt.Errorf("get last messages: %w", err)
+	}
+
+	contacts := make([]*Contact, len(groups))
+	for i, group := range groups {
+		contacts[i] = &Contact{
+			PeerID:      group.ID,
+			Name:        group.Name,
+			LastMessage: lastMessages[group.ID],
+			IsGroup:     true,
+		}
+	}
+	return contacts, nil
+}
+
+// sendGroupMessage sends a copy of the message to every online member and
+// saves it once under the group ID. Offline members miss the message
+func (c *Chat) sendGroupMessage(ctx context.Context, group *Group, content string) error {
+	groupHex := hex.EncodeToString(group.ID[:8])
+
+	localID := c.connector.LocalID()
+	participants := []string{hex.EncodeToString(localID[:])}
+	for _, member := range group.Members {
+		participants = append(participants, hex.EncodeToString(member[:]))
+	}
+	data, err := json.Marshal(GroupEnvelope{
+		GroupID: hex.EncodeToString(group.ID[:]),
+		Name:    group.Name,
+		Members: participants,
+		Content: content,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal group message: %w", err)
+	}
+
+	var sent int
+	var errs []error
+	for _, member := range group.Members {
+		peer, ok := c.connector.GetPeer(member)
+		if !ok {
+			continue
+		}
+		if err := peer.SendWithContext(ctx, data); err != nil {
+			slog.Warn("Failed to send group message to member",
+				"groupID", groupHex+"...",
+				"peerID", hex.EncodeToString(member[:8])+"...",
+				"error", err)
+			errs = append(errs, err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		if len(errs) > 0 {
+			return fmt.Errorf("send: %w", errors.Join(errs...))
+		}
+		return fmt.Errorf("no group members online")
+	}
+	slog.Debug("Group message sent", "groupID", groupHex+"...", "sent", sent, "members", len(group.Members))
+
+	msg := &Message{
+		PeerID:     group.ID,
+		Content:    content,
+		Timestamp:  time.Now(),
+		IsOutgoing: true,
+		IsRead:     true,
+	}
+	if err := c.storage.SaveMessage(msg); err != nil {
+		return fmt.Errorf("save message: %w", err)
+	}
+
+	c.events <- ChatEvent{
+		Type:    ChatEventMessageSent,
+		PeerID:  group.ID,
+		Message: msg,
+	}
+	return nil
+}
+
+// handleGroupEnvelope stores a group message from a member. A message of an
+// unknown group creates it if both we and the sender are listed as members
+func (c *Chat) handleGroupEnvelope(peerID router.PeerID, env *GroupEnvelope) {
+	hexID := hex.EncodeToString(peerID[:8])
+
+	groupID, err := parsePeerID(env.GroupID)
+	if err != nil {
+		slog.Warn("Invalid group ID", "peerID", hexID+"...", "error", err)
+		return
+	}
+	groupHex := hex.EncodeToString(groupID[:8])
+
+	group, err := c.storage.GetGroup(groupID)
+	if errors.Is(err, sql.ErrNoRows) {
+		group, err = c.joinGroup(peerID, groupID, env)
+	}
+	if err != nil {
+		slog.Warn("Dropping group message", "peerID", hexID+"...", "groupID", groupHex+"...", "error", err)
+		return
+	}
+
+	// SECURITY: Only members may post to the group
+	if !slices.Contains(group.Members, peerID) {
+		slog.Warn("Dropping group message from non-member", "peerID", hexID+"...", "groupID", groupHex+"...")
+		return
+	}
+
+	msg := &Message{
+		PeerID:    group.ID,
+		Content:   env.Content,
+		Timestamp: time.Now(),
+		SenderID:  peerID,
+	}
+	err = c.storage.SaveMessage(msg)
+	if errors.Is(err, ErrDuplicateMessage) {
+		slog.Debug("Dropping duplicate group message", "peerID", hexID+"...", "groupID", groupHex+"...")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to save group message", "peerID", hexID+"...", "groupID", groupHex+"...", "error", err)
+		c.events <- ChatEvent{
+			Type:  ChatEventError,
+			Error: fmt.Errorf("save group message: %w", err),
+		}
+		return
+	}
+
+	c.events <- ChatEvent{
+		Type:    ChatEventGroupMessageReceived,
+		PeerID:  group.ID,
+		Message: msg,
+	}
+}
+
+// joinGroup saves a group first seen in a message from peerID
+func (c *Chat) joinGroup(peerID, groupID router.PeerID, env *GroupEnvelope) (*Group, error) {
+	localID := c.connector.LocalID()
+
+	// SECURITY: Groups share the message history keyspace with contacts. A
+	// group with the ID of a peer would mix its messages into that chat
+	if groupID == localID || groupID == peerID {
+		return nil, fmt.Errorf("group ID is a peer ID")
+	}
+	if _, err := c.storage.GetContact(groupID); err == nil {
+		return nil, fmt.Errorf("group ID is a contact ID")
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("get contact: %w", err)
+	}
+
+	var members []router.PeerID
+	var listed, senderListed bool
+	for _, hexMember := range env.Members {
+		member, err := parsePeerID(hexMember)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group member: %w", err)
+		}
+		switch {
+		case member == groupID:
+			return nil, fmt.Errorf("group ID is a member ID")
+		case member == localID:
+			listed = true
+		case slices.Contains(members, member):
+		default:
+			senderListed = senderListed || member == peerID
+			members = append(members, member)
+		}
+	}
+	if !listed || !senderListed {
+		return nil, fmt.Errorf("unknown group")
+	}
+
+	group := &Group{ID: groupID, Name: env.Name, Members: members}
+	if err := c.storage.SaveGroup(group); err != nil {
+		return nil, fmt.Errorf("save group: %w", err)
+	}
+	slog.Info("Joined group", "peerID", hex.EncodeToString(peerID[:8])+"...", "groupID", hex.EncodeToString(groupID[:8])+"...", "members", len(members))
+	return group, nil
+}
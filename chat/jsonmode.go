@@ -0,0 +1,501 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// JSON mode command operations
+const (
+	JSONOpSend       = "send"
+	JSONOpConnect    = "connect"
+	JSONOpDisconnect = "disconnect"
+	JSONOpAddContact = "add_contact"
+	JSONOpContacts   = "contacts"
+	JSONOpSendFile   = "send_file"
+	JSONOpEdit       = "edit"
+	JSONOpDelete     = "delete"
+	JSONOpGroup      = "create_group"
+	JSONOpApprove    = "approve"
+	JSONOpReject     = "reject"
+	JSONOpAcceptFile = "accept_file"
+	JSONOpRejectFile = "reject_file"
+	JSONOpQuit       = "quit"
+)
+
+// JSON mode event names
+const (
+	JSONEventReady                = "ready"
+	JSONEventMessageReceived      = "message_received"
+	JSONEventMessageSent          = "message_sent"
+	JSONEventMessageEdited        = "message_edited"
+	JSONEventMessageDeleted       = "message_deleted"
+	JSONEventMessageRead          = "message_read"
+	JSONEventMessageStatus        = "message_status"
+	JSONEventGroupMessageReceived = "group_message_received"
+	JSONEventGroupCreated         = "group_created"
+	JSONEventContactAdded         = "contact_added"
+	JSONEventContactOnline        = "contact_online"
+	JSONEventContactOffline       = "contact_offline"
+	JSONEventContactReconnecting  = "contact_reconnecting"
+	JSONEventContactConnecting    = "contact_connecting"
+	JSONEventContactKeyChanged    = "contact_key_changed"
+	JSONEventPeerDiscovered       = "peer_discovered"
+	JSONEventContacts             = "contacts"
+	JSONEventConnectionFailed     = "connection_failed"
+	JSONEventConnectionRequest    = "connection_request"
+	JSONEventFileOffer            = "file_offer"
+	JSONEventFileTransferStarted  = "file_transfer_started"
+	JSONEventFileTransferProgress = "file_transfer_progress"
+	JSONEventFileTransferComplete = "file_transfer_completed"
+	JSONEventFileTransferFailed   = "file_transfer_failed"
+	JSONEventTypingStarted        = "typing_started"
+	JSONEventTypingStopped        = "typing_stopped"
+	JSONEventError                = "error"
+)
+
+// oneShotDrainDelay gives the data channel time to flush the message before
+// the connection is closed. There are no delivery acknowledgements yet, so a
+// successful send over the reliable data channel counts as delivery
+const oneShotDrainDelay = time.Second
+
+// JSONCommand is a single newline-delimited command read in JSON mode
+type JSONCommand struct {
+	Op   string `json:"op"`
+	Peer string `json:"peer,omitempty"`
+	Msg  string `json:"msg,omitempty"`
+	Name string `json:"name,omitempty"`
+	File string `json:"file,omitempty"`
+
+	Transfer  string   `json:"transfer,omitempty"` // transfer ID for accept_file and reject_file
+	MessageID int64    `json:"message_id,omitempty"`
+	Members   []string `json:"members,omitempty"` // hex IDs for create_group
+}
+
+// JSONEvent is a single newline-delimited event written in JSON mode
+type JSONEvent struct {
+	Event     string        `json:"event"`
+	Op        string        `json:"op,omitempty"`
+	ID        string        `json:"id,omitempty"`
+	Peer      string        `json:"peer,omitempty"`
+	From      string        `json:"from,omitempty"` // author of a group message
+	MessageID int64         `json:"message_id,omitempty"`
+	Content   string        `json:"content,omitempty"`
+	Status    string        `json:"status,omitempty"` // delivery of an outgoing message
+	Timestamp int64         `json:"timestamp,omitempty"`
+	File      string        `json:"file,omitempty"`
+	Path      string        `json:"path,omitempty"`     // where a received file was saved
+	Archive   bool          `json:"archive,omitempty"`  // the file is a folder, extracted on arrival
+	Transfer  string        `json:"transfer,omitempty"` // file transfer ID
+	Progress  int           `json:"progress,omitempty"` // percent
+	Size      int64         `json:"size,omitempty"`
+	Speed     float64       `json:"speed,omitempty"`  // bytes per second
+	ETA       int64         `json:"eta,omitempty"`    // seconds left
+	Queued    bool          `json:"queued,omitempty"` // waits for a free transfer slot
+	Ahead     int           `json:"ahead,omitempty"`  // queued transfers ahead of it
+	Relayed   bool          `json:"relayed,omitempty"`
+	Contacts  []JSONContact `json:"contacts,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// JSONContact describes a contact in the "contacts" event
+type JSONContact struct {
+	Peer      string `json:"peer"`
+	Name      string `json:"name"`
+	Online    bool   `json:"online"`
+	IsBlocked bool   `json:"is_blocked,omitempty"`
+	IsGroup   bool   `json:"is_group,omitempty"`
+	Muted     bool   `json:"muted,omitempty"`
+	Verified  bool   `json:"verified,omitempty"`
+}
+
+// jsonWriter serializes events from the command loop and the events loop
+type jsonWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newJSONWriter(out io.Writer) *jsonWriter {
+	return &jsonWriter{enc: json.NewEncoder(out)}
+}
+
+func (w *jsonWriter) write(ev JSONEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.enc.Encode(ev); err != nil {
+		slog.Error("Failed to write JSON event", "event", ev.Event, "error", err)
+	}
+}
+
+// RunJSON runs the non-interactive mode: it reads newline-delimited JSON
+// commands from in and writes chat events as newline-delimited JSON to out.
+// It returns when in is exhausted or a "quit" command is received
+func RunJSON(chat *Chat, myID router.PeerID, in io.Reader, out io.Writer) error {
+	w := newJSONWriter(out)
+	w.write(JSONEvent{Event: JSONEventReady, ID: hex.EncodeToString(myID[:])})
+
+	done := make(chan struct{})
+	eventsDone := make(chan struct{})
+	go func() {
+		defer close(eventsDone)
+		for {
+			select {
+			case event := <-chat.Events():
+				if ev, ok := jsonEventFromChat(event); ok {
+					w.write(ev)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		<-eventsDone
+	}()
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), MaxMessageSize*2)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var cmd JSONCommand
+		if err := json.Unmarshal(line, &cmd); err != nil {
+			w.write(JSONEvent{Event: JSONEventError, Error: fmt.Sprintf("invalid command: %v", err)})
+			continue
+		}
+		if cmd.Op == JSONOpQuit {
+			return nil
+		}
+
+		ev, err := chat.handleJSONCommand(cmd)
+		if err != nil {
+			w.write(JSONEvent{Event: JSONEventError, Op: cmd.Op, Peer: cmd.Peer, Error: err.Error()})
+			continue
+		}
+		if ev != nil {
+			w.write(*ev)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read commands: %w", err)
+	}
+	return nil
+}
+
+// handleJSONCommand executes a command. Results of most commands arrive later
+// as chat events; only "contacts" answers with an event directly
+func (c *Chat) handleJSONCommand(cmd JSONCommand) (*JSONEvent, error) {
+	switch cmd.Op {
+	case JSONOpSend:
+		peerID, err := parsePeerID(cmd.Peer)
+		if err != nil {
+			return nil, err
+		}
+		if cmd.Msg == "" {
+			return nil, fmt.Errorf("empty message")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), messageSendTimeout)
+		defer cancel()
+		return nil, c.SendMessage(ctx, peerID, cmd.Msg)
+
+	case JSONOpConnect:
+		if _, err := parsePeerID(cmd.Peer); err != nil {
+			return nil, err
+		}
+		return nil, c.startConnect(context.Background(), cmd.Peer)
+
+	case JSONOpDisconnect:
+		peerID, err := parsePeerID(cmd.Peer)
+		if err != nil {
+			return nil, err
+		}
+		return nil, c.Disconnect(peerID)
+
+	case JSONOpAddContact:
+		if _, err := parsePeerID(cmd.Peer); err != nil {
+			return nil, err
+		}
+		name := cmd.Name
+		if name == "" {
+			name = cmd.Peer[:16] + "..."
+		}
+		return nil, c.AddContact(cmd.Peer, name)
+
+	case JSONOpContacts:
+		contacts, err := c.GetContacts()
+		if err != nil {
+			return nil, fmt.Errorf("get contacts: %w", err)
+		}
+		ev := &JSONEvent{Event: JSONEventContacts, Contacts: []JSONContact{}}
+		for _, contact := range contacts {
+			ev.Contacts = append(ev.Contacts, JSONContact{
+				Peer:      hex.EncodeToString(contact.PeerID[:]),
+				Name:      contact.Name,
+				Online:    c.IsOnline(contact.PeerID),
+				IsBlocked: contact.IsBlocked,
+				IsGroup:   contact.IsGroup,
+				Muted:     contact.IsMuted(time.Now()),
+				Verified:  contact.Verified,
+			})
+		}
+		return ev, nil
+
+	case JSONOpGroup:
+		var members []router.PeerID
+		for _, hexMember := range cmd.Members {
+			member, err := parsePeerID(hexMember)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, member)
+		}
+		group, err := c.CreateGroup(cmd.Name, members)
+		if err != nil {
+			return nil, err
+		}
+		return &JSONEvent{Event: JSONEventGroupCreated, Peer: hex.EncodeToString(group.ID[:])}, nil
+
+	case JSONOpSendFile:
+		peerID, err := parsePeerID(cmd.Peer)
+		if err != nil {
+			return nil, err
+		}
+		if cmd.File == "" {
+			return nil, fmt.Errorf("empty file path")
+		}
+		// A folder goes as an archive
+		if info, err := os.Stat(cmd.File); err == nil && info.IsDir() {
+			return nil, c.SendDirectory(peerID, cmd.File)
+		}
+		return nil, c.SendFile(peerID, cmd.File)
+
+	case JSONOpEdit:
+		if cmd.MessageID == 0 {
+			return nil, fmt.Errorf("message_id is required")
+		}
+		if cmd.Msg == "" {
+			return nil, fmt.Errorf("empty message")
+		}
+		return nil, c.EditMessage(cmd.MessageID, cmd.Msg)
+
+	case JSONOpDelete:
+		if cmd.MessageID == 0 {
+			return nil, fmt.Errorf("message_id is required")
+		}
+		return nil, c.DeleteMessage(cmd.MessageID)
+
+	case JSONOpApprove:
+		peerID, err := parsePeerID(cmd.Peer)
+		if err != nil {
+			return nil, err
+		}
+		c.ApproveConnection(peerID)
+		return nil, nil
+
+	case JSONOpReject:
+		peerID, err := parsePeerID(cmd.Peer)
+		if err != nil {
+			return nil, err
+		}
+		c.RejectConnection(peerID)
+		return nil, nil
+
+	case JSONOpAcceptFile:
+		if cmd.Transfer == "" {
+			return nil, fmt.Errorf("transfer is required")
+		}
+		return nil, c.AcceptFileTransfer(cmd.Transfer)
+
+	case JSONOpRejectFile:
+		if cmd.Transfer == "" {
+			return nil, fmt.Errorf("transfer is required")
+		}
+		return nil, c.RejectFileTransfer(cmd.Transfer)
+
+	default:
+		return nil, fmt.Errorf("unknown op %q", cmd.Op)
+	}
+}
+
+// jsonEventFromChat converts a chat event, reporting false for events that
+// have no JSON representation
+func jsonEventFromChat(event ChatEvent) (JSONEvent, bool) {
+	ev := JSONEvent{Peer: hex.EncodeToString(event.PeerID[:])}
+	if event.PeerID == (router.PeerID{}) {
+		ev.Peer = ""
+	}
+	if event.Error != nil {
+		ev.Error = event.Error.Error()
+	}
+	if event.Message != nil {
+		ev.MessageID = event.Message.ID
+		ev.Content = event.Message.Content
+		ev.Timestamp = event.Message.Timestamp.Unix()
+		ev.Status = string(event.Message.Status)
+		if event.Message.SenderID != (router.PeerID{}) {
+			ev.From = hex.EncodeToString(event.Message.SenderID[:])
+		}
+	}
+	if ft := event.FileTransfer; ft != nil {
+		ev.File = ft.FileName
+		ev.Archive = ft.Archive
+		ev.Transfer = ft.ID
+		ev.Size = ft.FileSize
+		ev.Progress = ft.Progress
+		if event.Type == ChatEventFileTransferProgress {
+			ev.Speed = ft.Speed()
+			ev.ETA = int64(ft.ETA().Round(time.Second) / time.Second)
+			ev.Ahead, ev.Queued = ft.QueuePosition()
+		}
+	}
+
+	switch event.Type {
+	case ChatEventMessageReceived:
+		ev.Event = JSONEventMessageReceived
+	case ChatEventMessageSent:
+		ev.Event = JSONEventMessageSent
+	case ChatEventMessageEdited:
+		ev.Event = JSONEventMessageEdited
+	case ChatEventMessageDeleted:
+		ev.Event = JSONEventMessageDeleted
+	case ChatEventMessageRead:
+		ev.Event = JSONEventMessageRead
+	case ChatEventMessageStatusChanged:
+		ev.Event = JSONEventMessageStatus
+	case ChatEventGroupMessageReceived:
+		ev.Event = JSONEventGroupMessageReceived
+	case ChatEventContactAdded:
+		ev.Event = JSONEventContactAdded
+	case ChatEventContactOnline:
+		ev.Event = JSONEventContactOnline
+		ev.Relayed = event.Relayed
+	case ChatEventContactOffline:
+		ev.Event = JSONEventContactOffline
+	case ChatEventContactReconnecting:
+		ev.Event = JSONEventContactReconnecting
+	case ChatEventContactConnecting:
+		ev.Event = JSONEventContactConnecting
+	case ChatEventContactKeyChanged:
+		ev.Event = JSONEventContactKeyChanged
+	case ChatEventPeerDiscovered:
+		ev.Event = JSONEventPeerDiscovered
+	case ChatEventConnectionFailed:
+		ev.Event = JSONEventConnectionFailed
+	case ChatEventConnectionRequest:
+		ev.Event = JSONEventConnectionRequest
+	case ChatEventFileOfferReceived:
+		ev.Event = JSONEventFileOffer
+	case ChatEventError:
+		ev.Event = JSONEventError
+	case ChatEventFileTransferStarted:
+		ev.Event = JSONEventFileTransferStarted
+	case ChatEventFileTransferProgress:
+		ev.Event = JSONEventFileTransferProgress
+	case ChatEventFileTransferCompleted:
+		ev.Event = JSONEventFileTransferComplete
+		if !event.FileTransfer.IsOutgoing {
+			ev.Path = event.FileTransfer.FilePath
+		}
+	case ChatEventFileTransferFailed:
+		ev.Event = JSONEventFileTransferFailed
+	case ChatEventTypingStarted:
+		ev.Event = JSONEventTypingStarted
+	case ChatEventTypingStopped:
+		ev.Event = JSONEventTypingStopped
+	default:
+		return JSONEvent{}, false
+	}
+	return ev, true
+}
+
+// SendOnce connects to the peer, sends a single message and writes the
+// resulting events as JSON to out. It fails if the peer is not reachable
+// within timeout
+func SendOnce(chat *Chat, hexID string, content string, timeout time.Duration, out io.Writer) error {
+	peerID, err := parsePeerID(hexID)
+	if err != nil {
+		return err
+	}
+	if content == "" {
+		return fmt.Errorf("empty message")
+	}
+
+	w := newJSONWriter(out)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if !chat.IsOnline(peerID) {
+		if err := chat.startConnect(ctx, hexID); err != nil {
+			return fmt.Errorf("connect: %w", err)
+		}
+	}
+
+	for !chat.IsOnline(peerID) {
+		select {
+		case event := <-chat.Events():
+			if event.PeerID != peerID {
+				continue
+			}
+			if ev, ok := jsonEventFromChat(event); ok {
+				w.write(ev)
+			}
+			if event.Type == ChatEventConnectionFailed {
+				return fmt.Errorf("connection failed: %w", event.Error)
+			}
+		case <-ctx.Done():
+			return errors.New("timeout waiting for peer connection")
+		}
+	}
+
+	if err := chat.SendMessage(ctx, peerID, content); err != nil {
+		return err
+	}
+
+	// SendMessage emits ChatEventMessageSent before returning
+	for {
+		select {
+		case event := <-chat.Events():
+			if ev, ok := jsonEventFromChat(event); ok && event.PeerID == peerID {
+				w.write(ev)
+			}
+			if event.Type == ChatEventMessageSent && event.PeerID == peerID {
+				time.Sleep(oneShotDrainDelay)
+				return nil
+			}
+		case <-ctx.Done():
+			return errors.New("timeout waiting for message delivery")
+		}
+	}
+}
+
+// parsePeerID decodes a hex encoded peer ID
+func parsePeerID(hexID string) (router.PeerID, error) {
+	var peerID router.PeerID
+	if hexID == "" {
+		return peerID, fmt.Errorf("peer id is required")
+	}
+	b, err := hex.DecodeString(hexID)
+	if err != nil {
+		return peerID, fmt.Errorf("invalid hex id: %w", err)
+	}
+	if len(b) != router.PeerIDSize {
+		return peerID, fmt.Errorf("invalid peer id size: got %d, expected %d", len(b), router.PeerIDSize)
+	}
+	copy(peerID[:], b)
+	return peerID, nil
+}
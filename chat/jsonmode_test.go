@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+func TestJSONEventFromChat(t *testing.T) {
+	var peerID router.PeerID
+	peerID[0] = 0xab
+
+	ev, ok := jsonEventFromChat(ChatEvent{
+		Type:    ChatEventMessageReceived,
+		PeerID:  peerID,
+		Message: &Message{Content: "hello", Timestamp: time.Unix(100, 0)},
+	})
+	if !ok {
+		t.Fatal("Expected message event to be converted")
+	}
+	if ev.Event != JSONEventMessageReceived || ev.Content != "hello" || ev.Timestamp != 100 {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	if ev.Peer != hex.EncodeToString(peerID[:]) {
+		t.Fatalf("Unexpected peer %q", ev.Peer)
+	}
+
+	ev, ok = jsonEventFromChat(ChatEvent{Type: ChatEventError, Error: errors.New("boom")})
+	if !ok || ev.Event != JSONEventError || ev.Error != "boom" || ev.Peer != "" {
+		t.Fatalf("Unexpected error event: %+v", ev)
+	}
+
+	ft := &FileTransfer{FileName: "foo.zip", FileSize: 4 * ChunkSize, Progress: 50, StartedAt: time.Now().Add(-time.Second)}
+	ft.AddTransferred(2 * ChunkSize)
+	ev, ok = jsonEventFromChat(ChatEvent{Type: ChatEventFileTransferProgress, FileTransfer: ft})
+	if !ok || ev.Event != JSONEventFileTransferProgress || ev.Progress != 50 || ev.Speed <= 0 || ev.ETA != 1 {
+		t.Fatalf("Unexpected progress event: %+v", ev)
+	}
+
+	if _, ok := jsonEventFromChat(ChatEvent{Type: ChatEventType(255)}); ok {
+		t.Fatal("Unknown event type must be skipped")
+	}
+}
+
+func TestRunJSONCommands(t *testing.T) {
+	c := &Chat{events: make(chan ChatEvent, 10), storage: newTestStorage(t)}
+
+	var myID, peerID router.PeerID
+	myID[0] = 1
+	peerID[0] = 2
+	peerHex := hex.EncodeToString(peerID[:])
+
+	in := strings.Join([]string{
+		`not json`,
+		`{"op":"dance"}`,
+		`{"op":"send","peer":"xyz","msg":"hi"}`,
+		`{"op":"add_contact","peer":"` + peerHex + `","name":"Bob"}`,
+		`{"op":"quit"}`,
+		`{"op":"dance"}`,
+	}, "\n")
+
+	var out bytes.Buffer
+	if err := RunJSON(c, myID, strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []JSONEvent
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var ev JSONEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("Output line is not JSON: %q", scanner.Text())
+		}
+		events = append(events, ev)
+	}
+
+	want := []string{JSONEventReady, JSONEventError, JSONEventError, JSONEventError}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %+v", len(want), events)
+	}
+	for i, ev := range events {
+		if ev.Event != want[i] {
+			t.Fatalf("Event %d: expected %s, got %+v", i, want[i], ev)
+		}
+	}
+	if events[0].ID != hex.EncodeToString(myID[:]) {
+		t.Fatalf("Unexpected ready id %q", events[0].ID)
+	}
+	if events[2].Op != "dance" {
+		t.Fatalf("Expected error for op dance, got %+v", events[2])
+	}
+
+	contact, err := c.storage.GetContact(peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact.Name != "Bob" {
+		t.Fatalf("Expected contact Bob, got %q", contact.Name)
+	}
+}
@@ -0,0 +1,149 @@
+package chat
+
+import (
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// Markdown styles of the message viewport. Only the subset people type in
+// chat is rendered: fenced code blocks, headings, bullet lists, inline
+// code, bold and italic
+var (
+	markdownCodeBlockStyle = lipgloss.NewStyle().
+				Foreground(lipgloss.Color("252")).
+				Background(lipgloss.Color("236"))
+
+	markdownCodeStyle = lipgloss.NewStyle().
+				Foreground(lipgloss.Color("203")).
+				Background(lipgloss.Color("236"))
+
+	markdownHeadingStyle = lipgloss.NewStyle().
+				Bold(true).
+				Foreground(lipgloss.Color("205"))
+
+	markdownBoldStyle   = lipgloss.NewStyle().Bold(true)
+	markdownItalicStyle = lipgloss.NewStyle().Italic(true)
+)
+
+// looksLikeMarkdown reports whether content has Markdown markers worth
+// rendering: backticks, bold, a heading or a bullet list item
+func looksLikeMarkdown(content string) bool {
+	if strings.Contains(content, "`") || strings.Contains(content, "**") {
+		return true
+	}
+	for line := range strings.SplitSeq(content, "\n") {
+		line = strings.TrimLeft(line, " ")
+		if markdownHeading(line) != "" || markdownListItem(line) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// renderMarkdown renders content for the terminal, wrapping text lines to
+// width. Code block lines are not wrapped
+func renderMarkdown(content string, width int) string {
+	var lines []string
+	inCode := false
+	for line := range strings.SplitSeq(content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			// The fence line (with an optional language) is not shown
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			lines = append(lines, markdownCodeBlockStyle.Render(" "+line+" "))
+			continue
+		}
+
+		trimmed := strings.TrimLeft(line, " ")
+		indent := line[:len(line)-len(trimmed)]
+		switch {
+		case markdownHeading(trimmed) != "":
+			line = markdownHeadingStyle.Render(markdownHeading(trimmed))
+		case markdownListItem(trimmed) != "":
+			line = indent + "• " + renderInlineMarkdown(markdownListItem(trimmed))
+		default:
+			line = renderInlineMarkdown(line)
+		}
+		if width > 0 {
+			line = ansi.Wrap(line, width, "")
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// markdownHeading returns the text of a "# heading" line or "" for other
+// lines
+func markdownHeading(line string) string {
+	level := len(line) - len(strings.TrimLeft(line, "#"))
+	if level == 0 || level > 6 || !strings.HasPrefix(line[level:], " ") {
+		return ""
+	}
+	return strings.TrimSpace(line[level:])
+}
+
+// markdownListItem returns the text of a "- item" or "* item" line or ""
+// for other lines
+func markdownListItem(line string) string {
+	for _, bullet := range []string{"- ", "* "} {
+		if item, ok := strings.CutPrefix(line, bullet); ok && strings.TrimSpace(item) != "" {
+			return item
+		}
+	}
+	return ""
+}
+
+// renderInlineMarkdown styles `code`, **bold** and *italic* spans. Markers
+// without a closing pair are left as typed
+func renderInlineMarkdown(s string) string {
+	var b strings.Builder
+	for s != "" {
+		i := strings.IndexAny(s, "`*")
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+
+		marker, style := s[:1], markdownItalicStyle
+		switch {
+		case marker == "`":
+			style = markdownCodeStyle
+		case strings.HasPrefix(s, "**"):
+			marker, style = "**", markdownBoldStyle
+		}
+		end := strings.Index(s[len(marker):], marker)
+		if end <= 0 {
+			b.WriteString(marker)
+			s = s[len(marker):]
+			continue
+		}
+		span := s[len(marker) : len(marker)+end]
+		if marker != "`" {
+			span = renderInlineMarkdown(span)
+		}
+		b.WriteString(style.Render(span))
+		s = s[2*len(marker)+end:]
+	}
+	return b.String()
+}
+
+// SetMarkdownEnabled turns Markdown rendering of messages in the TUI on or
+// off. It is on by default
+func (c *Chat) SetMarkdownEnabled(enabled bool) {
+	c.mu.Lock()
+	c.markdown = enabled
+	c.mu.Unlock()
+}
+
+// MarkdownEnabled reports whether the TUI renders Markdown in messages
+func (c *Chat) MarkdownEnabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.markdown
+}
@@ -0,0 +1,44 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/muesli/termenv"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	// Without a terminal lipgloss renders no colors
+	profile := lipgloss.ColorProfile()
+	lipgloss.SetColorProfile(termenv.ANSI256)
+	t.Cleanup(func() { lipgloss.SetColorProfile(profile) })
+
+	content := "Try this:\n```go\nfmt.Println(\"hi\")\n```\n- **bold** and `code`"
+	if !looksLikeMarkdown(content) {
+		t.Fatal("Expected Markdown to be detected")
+	}
+	rendered := renderMarkdown(content, 40)
+	if !strings.Contains(rendered, "\x1b[") {
+		t.Fatalf("Expected ANSI escape codes, got %q", rendered)
+	}
+	want := "Try this:\n fmt.Println(\"hi\") \n• bold and code"
+	if plain := ansi.Strip(rendered); plain != want {
+		t.Fatalf("Expected %q, got %q", want, plain)
+	}
+
+	for _, plain := range []string{"hello", "2 * 3 = 6", "well - maybe", "#hashtag"} {
+		if looksLikeMarkdown(plain) {
+			t.Errorf("%q is not Markdown", plain)
+		}
+	}
+
+	// Text lines wrap to the viewport width
+	wrapped := renderMarkdown("# Title\n"+strings.Repeat("word ", 20), 20)
+	for line := range strings.SplitSeq(ansi.Strip(wrapped), "\n") {
+		if ansi.StringWidth(line) > 20 {
+			t.Fatalf("Line %q is wider than 20", line)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package chat
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migrations upgrade the database schema. Migration i brings the schema to
+// version i+1 and runs once, in a transaction that also records the version
+// in schema_versions. Databases created before versioning have no recorded
+// version, so every migration must be idempotent: a table, column or index
+// may already exist. New migrations are appended, never edited
+var migrations = []func(*sql.Tx) error{
+	migrateInitialSchema,
+	migrateNotificationsBlocked,
+	migrateFileTransferChunks,
+	migrateFileTransferRate,
+	migrateMessageStatus,
+}
+
+// init brings the database schema up to date
+func (s *Storage) init() error {
+	_, err := s.db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_versions (
+		version INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	);`)
+	if err != nil {
+		return fmt.Errorf("create schema_versions: %w", err)
+	}
+
+	version, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		if err := s.migrate(i+1, migrations[i]); err != nil {
+			return fmt.Errorf("migrate to version %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the latest applied migration, 0 if none
+func (s *Storage) schemaVersion() (int, error) {
+	var version int
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_versions`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("get schema version: %w", err)
+	}
+	return version, nil
+}
+
+// migrate applies migration and records version in one transaction
+func (s *Storage) migrate(version int, migration func(*sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := migration(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_versions (version, applied_at) VALUES (?, ?)`, version, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumn adds a column unless the table already has it
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	var exists bool
+	err := tx.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("check column %s.%s: %w", table, column, err)
+	}
+	if exists {
+		return nil
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition)); err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// migrateInitialSchema creates the schema as it was before versioning.
+// Columns added over time are created separately: older databases already
+// have the tables without them
+func migrateInitialSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS contacts (
+		peer_id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		added_at INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		is_blocked INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		peer_id TEXT NOT NULL,
+		content TEXT NOT NULL,
+		timestamp INTEGER NOT NULL,
+		is_outgoing INTEGER NOT NULL,
+		is_read INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(peer_id) REFERENCES contacts(peer_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_messages_peer_timestamp
+	ON messages(peer_id, timestamp DESC);
+
+	CREATE INDEX IF NOT EXISTS idx_messages_unread
+	ON messages(peer_id, is_read) WHERE is_read = 0;
+
+	CREATE TABLE IF NOT EXISTS file_transfers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		transfer_id TEXT UNIQUE NOT NULL,
+		peer_id TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		file_size INTEGER NOT NULL,
+		file_path TEXT,
+		is_outgoing INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		progress INTEGER DEFAULT 0,
+		sha256_hash TEXT,
+		started_at INTEGER NOT NULL,
+		completed_at INTEGER,
+		FOREIGN KEY(peer_id) REFERENCES contacts(peer_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_file_transfers_peer
+	ON file_transfers(peer_id, started_at DESC);
+
+	CREATE INDEX IF NOT EXISTS idx_file_transfers_status
+	ON file_transfers(status, started_at DESC);
+
+	CREATE TABLE IF NOT EXISTS message_edits (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id INTEGER NOT NULL,
+		old_content TEXT NOT NULL,
+		edited_at INTEGER NOT NULL,
+		FOREIGN KEY(message_id) REFERENCES messages(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS groups (
+		id TEXT PRIMARY KEY,
+		name TEXT,
+		members TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_message_edits_message
+	ON message_edits(message_id, edited_at);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS blocked_peers (
+		peer_id TEXT PRIMARY KEY,
+		blocked_at INTEGER NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+
+	columns := []struct{ table, column, definition string }{
+		{"messages", "content_hash", "TEXT"},
+		{"messages", "edited_at", "INTEGER"},
+		{"messages", "deleted_at", "INTEGER"},
+		{"messages", "read_at", "INTEGER"},
+		{"messages", "sender_id", "TEXT"},
+		{"messages", "dedup_hash", "TEXT"},
+		{"contacts", "muted_until", "INTEGER"},
+		{"contacts", "enc_key", "TEXT"},
+		{"contacts", "verified", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		if err := addColumn(tx, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	// dedup_hash is NULL for outgoing and older messages, NULLs never
+	// conflict in a unique index
+	_, err = tx.Exec(`
+	CREATE INDEX IF NOT EXISTS idx_messages_content_hash
+	ON messages(peer_id, content_hash);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_dedup_hash
+	ON messages(peer_id, dedup_hash);`)
+	return err
+}
+
+// migrateNotificationsBlocked adds per-contact notification blocking
+func migrateNotificationsBlocked(tx *sql.Tx) error {
+	return addColumn(tx, "contacts", "notifications_blocked", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// migrateFileTransferChunks stores which chunks of an incoming file arrived
+// and how many bytes were written, so the transfer resumes from there
+func migrateFileTransferChunks(tx *sql.Tx) error {
+	if err := addColumn(tx, "file_transfers", "received_chunks", "BLOB"); err != nil {
+		return err
+	}
+	return addColumn(tx, "file_transfers", "bytes_received", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// migrateFileTransferRate stores the average rate of completed transfers
+func migrateFileTransferRate(tx *sql.Tx) error {
+	return addColumn(tx, "file_transfers", "avg_bytes_per_sec", "REAL NOT NULL DEFAULT 0")
+}
+
+// migrateMessageStatus stores the UUID of a message, used by delivery acks,
+// and the delivery status of outgoing messages. Older messages keep an
+// empty status: they were sent without acks
+func migrateMessageStatus(tx *sql.Tx) error {
+	if err := addColumn(tx, "messages", "uuid", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "messages", "status", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+	CREATE INDEX IF NOT EXISTS idx_messages_uuid
+	ON messages(peer_id, uuid);`)
+	return err
+}
@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// TestMigrateLegacyDatabase opens a database created before schema
+// versioning, with some of the later columns already added
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+	CREATE TABLE contacts (
+		peer_id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		added_at INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		is_blocked INTEGER NOT NULL DEFAULT 0,
+		notifications_blocked INTEGER NOT NULL DEFAULT 0
+	);
+	INSERT INTO contacts (peer_id, name, added_at, last_seen) VALUES ('0100000000000000000000000000000000000000000000000000000000000000', 'Alice', 1, 1);`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := s.schemaVersion()
+	if err != nil || version != len(migrations) {
+		t.Fatalf("Expected version %d, got %d (%v)", len(migrations), version, err)
+	}
+	contact, err := s.GetContact(router.PeerID{1})
+	if err != nil || contact.Name != "Alice" || contact.Verified {
+		t.Fatalf("Unexpected contact after migration: %+v (%v)", contact, err)
+	}
+	if err := s.SetNotificationsBlocked(router.PeerID{1}, true); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Reopening applies nothing
+	s, err = NewStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var applied int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM schema_versions`).Scan(&applied); err != nil || applied != len(migrations) {
+		t.Fatalf("Expected %d applied migrations, got %d (%v)", len(migrations), applied, err)
+	}
+
+	// A database from a newer client is not opened
+	if _, err := s.db.Exec(`INSERT INTO schema_versions (version, applied_at) VALUES (?, 0)`, len(migrations)+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.init(); err == nil {
+		t.Fatal("Expected error for a newer schema version")
+	}
+}
@@ -0,0 +1,83 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/udisondev/sendy/p2p"
+	"github.com/udisondev/sendy/router"
+)
+
+// connectionModeSetting is the storage key of the incoming connection policy
+const connectionModeSetting = "connection_mode"
+
+// loadConnectionMode applies the policy saved in storage. Without a saved
+// policy the connector stays open to everyone
+func (c *Chat) loadConnectionMode() {
+	value, err := c.storage.GetSetting(connectionModeSetting)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to load connection policy", "error", err)
+		return
+	}
+	mode, err := p2p.ParseConnectionMode(value)
+	if err != nil {
+		slog.Error("Invalid saved connection policy", "value", value, "error", err)
+		return
+	}
+	c.applyConnectionMode(mode)
+}
+
+// SetConnectionMode changes who may connect: everyone, contacts only, or
+// contacts plus strangers approved with ApproveConnection. The mode is
+// saved and restored on the next start
+func (c *Chat) SetConnectionMode(mode p2p.ConnectionMode) error {
+	if err := c.storage.SetSetting(connectionModeSetting, mode.String()); err != nil {
+		return fmt.Errorf("save connection policy: %w", err)
+	}
+	c.applyConnectionMode(mode)
+	return nil
+}
+
+// ConnectionMode returns the current incoming connection policy
+func (c *Chat) ConnectionMode() p2p.ConnectionMode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connectionMode
+}
+
+func (c *Chat) applyConnectionMode(mode p2p.ConnectionMode) {
+	c.mu.Lock()
+	c.connectionMode = mode
+	c.mu.Unlock()
+
+	c.connector.SetConnectionPolicy(p2p.ConnectionPolicy{
+		Mode:      mode,
+		IsContact: c.isKnownContact,
+	})
+	slog.Info("Connection policy applied", "mode", mode.String())
+}
+
+// isKnownContact reports whether the peer is a contact that is not blocked
+func (c *Chat) isKnownContact(peerID router.PeerID) bool {
+	contact, err := c.storage.GetContact(peerID)
+	return err == nil && !contact.IsBlocked
+}
+
+// ApproveConnection accepts a pending connection request. The peer is
+// added as a contact once connected, like with the open policy
+func (c *Chat) ApproveConnection(peerID router.PeerID) {
+	slog.Info("Approving connection request", "peerID", hex.EncodeToString(peerID[:8])+"...")
+	c.connector.Approve(peerID)
+}
+
+// RejectConnection drops a pending connection request
+func (c *Chat) RejectConnection(peerID router.PeerID) {
+	slog.Info("Rejecting connection request", "peerID", hex.EncodeToString(peerID[:8])+"...")
+	c.connector.Reject(peerID)
+}
@@ -0,0 +1,169 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+const (
+	ReadReceiptType = "read"
+
+	// readReceiptInterval limits outgoing read receipts per peer. Messages
+	// read in between are batched into the next receipt
+	readReceiptInterval = time.Second
+	// maxReadReceiptIDs limits message IDs in one receipt, the rest go out
+	// with the next one
+	maxReadReceiptIDs = 100
+)
+
+// ReadReceipt tells the sender that its messages were read. IDs are the
+// ContentHash of the read messages. Receipts are not saved to storage
+type ReadReceipt struct {
+	Type string   `json:"type"`
+	IDs  []string `json:"ids"`
+}
+
+// readReceiptState batches read receipts to a peer
+type readReceiptState struct {
+	pending  []string
+	lastSent time.Time
+	timer    *time.Timer // scheduled flush, nil if none
+}
+
+// parseReadReceipt reports whether data is a read receipt
+func parseReadReceipt(data []byte) (*ReadReceipt, bool) {
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return nil, false
+	}
+	var receipt ReadReceipt
+	if err := json.Unmarshal(data, &receipt); err != nil || receipt.Type != ReadReceiptType {
+		return nil, false
+	}
+	return &receipt, true
+}
+
+// MarkAsRead marks messages from the contact as read and tells the contact
+// which of its messages were read
+func (c *Chat) MarkAsRead(peerID router.PeerID) error {
+	ids, err := c.storage.MarkAsRead(peerID)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		c.queueReadReceipt(peerID, ids, time.Now())
+	}
+	return nil
+}
+
+// queueReadReceipt adds ids to the next receipt to the peer. The receipt is
+// sent at once unless one was sent less than readReceiptInterval ago
+func (c *Chat) queueReadReceipt(peerID router.PeerID, ids []string, now time.Time) {
+	c.readMu.Lock()
+	if c.readSent == nil {
+		c.readSent = make(map[router.PeerID]*readReceiptState)
+	}
+	state, ok := c.readSent[peerID]
+	if !ok {
+		state = &readReceiptState{}
+		c.readSent[peerID] = state
+	}
+	state.pending = append(state.pending, ids...)
+
+	if state.timer != nil {
+		c.readMu.Unlock()
+		return
+	}
+	wait := readReceiptInterval - now.Sub(state.lastSent)
+	if wait > 0 {
+		state.timer = time.AfterFunc(wait, func() { c.flushReadReceipt(peerID) })
+		c.readMu.Unlock()
+		return
+	}
+	c.readMu.Unlock()
+
+	c.flushReadReceipt(peerID)
+}
+
+// flushReadReceipt sends pending message IDs to the peer. Receipts to an
+// offline peer are dropped: the messages stay unread on the sender's side
+func (c *Chat) flushReadReceipt(peerID router.PeerID) {
+	c.readMu.Lock()
+	state, ok := c.readSent[peerID]
+	if !ok || len(state.pending) == 0 {
+		c.readMu.Unlock()
+		return
+	}
+	ids := state.pending
+	if len(ids) > maxReadReceiptIDs {
+		ids = ids[:maxReadReceiptIDs]
+	}
+	state.pending = state.pending[len(ids):]
+	state.lastSent = time.Now()
+	state.timer = nil
+	if len(state.pending) > 0 {
+		state.timer = time.AfterFunc(readReceiptInterval, func() { c.flushReadReceipt(peerID) })
+	}
+	c.readMu.Unlock()
+
+	hexID := hex.EncodeToString(peerID[:8])
+	if err := c.sendReadReceipt(peerID, ids); err != nil {
+		slog.Debug("Read receipt not sent", "peerID", hexID+"...", "count", len(ids), "error", err)
+		return
+	}
+	slog.Debug("Sent read receipt", "peerID", hexID+"...", "count", len(ids))
+}
+
+// sendReadReceipt sends a read receipt with ids to the peer
+func (c *Chat) sendReadReceipt(peerID router.PeerID, ids []string) error {
+	peer, ok := c.connector.GetPeer(peerID)
+	if !ok {
+		return fmt.Errorf("peer not connected")
+	}
+	data, err := json.Marshal(ReadReceipt{Type: ReadReceiptType, IDs: ids})
+	if err != nil {
+		return fmt.Errorf("marshal read receipt: %w", err)
+	}
+	if err := peer.Send(data); err != nil {
+		return fmt.Errorf("send read receipt: %w", err)
+	}
+	return nil
+}
+
+// handleReadReceipt marks our messages the peer has read and emits
+// ChatEventMessageRead for each of them
+func (c *Chat) handleReadReceipt(peerID router.PeerID, receipt *ReadReceipt) {
+	hexID := hex.EncodeToString(peerID[:8])
+
+	// SECURITY: Limit the work a single receipt can cause
+	ids := receipt.IDs
+	if len(ids) > maxReadReceiptIDs {
+		slog.Warn("Read receipt has too many IDs, truncating", "peerID", hexID+"...", "count", len(ids))
+		ids = ids[:maxReadReceiptIDs]
+	}
+
+	msgs, err := c.storage.MarkOutgoingRead(peerID, ids, time.Now())
+	if err != nil {
+		slog.Error("Failed to apply read receipt", "peerID", hexID+"...", "error", err)
+		c.events <- ChatEvent{
+			Type:   ChatEventError,
+			PeerID: peerID,
+			Error:  fmt.Errorf("read receipt: %w", err),
+		}
+		return
+	}
+	slog.Debug("Received read receipt", "peerID", hexID+"...", "ids", len(ids), "read", len(msgs))
+
+	for _, msg := range msgs {
+		c.events <- ChatEvent{
+			Type:    ChatEventMessageRead,
+			PeerID:  peerID,
+			Message: msg,
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// Chunks can get lost on the way, e.g. one that fails to decrypt is dropped.
+// The receiver notices the gaps after END and lists them in a
+// FileTransferNack, the sender re-sends only those chunks and END again.
+
+const (
+	// MissingChunksTimeout is how long the receiver waits after END, or
+	// after the last chunk that came after it, before asking for the rest
+	MissingChunksTimeout = 3 * time.Second
+	// MaxNackRounds bounds how many times missing chunks are asked for
+	// before the transfer fails
+	MaxNackRounds = 3
+	// maxListedChunks limits the missing chunks named in an error
+	maxListedChunks = 10
+)
+
+// ErrMissingChunks fails a transfer whose chunks did not arrive after
+// MaxNackRounds requests
+var ErrMissingChunks = errors.New("chunks missing")
+
+// watchMissingChunks starts or restarts the timer after which the receiver
+// asks for the chunks that did not arrive
+func (c *Chat) watchMissingChunks(ft *FileTransfer) {
+	timeout := c.missingChunksTimeout
+	if timeout <= 0 {
+		timeout = MissingChunksTimeout
+	}
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if ft.nackTimer != nil {
+		ft.nackTimer.Reset(timeout)
+		return
+	}
+	ft.nackTimer = time.AfterFunc(timeout, func() { c.requestMissingChunks(ft) })
+}
+
+// requestMissingChunks sends the sender a FileTransferNack with the chunks
+// still missing and waits for them again. After MaxNackRounds the transfer
+// fails with the list of missing chunks
+func (c *Chat) requestMissingChunks(ft *FileTransfer) {
+	log := ft.logger()
+
+	missing, err := ft.nextNackRound()
+	if err != nil {
+		log.Error("Giving up on missing chunks", "error", err)
+		c.handleFileTransferError(ft, err)
+		return
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	log.Info("Asking for missing chunks", ft.progressArgs("missing", len(missing))...)
+	c.watchMissingChunks(ft)
+
+	chunks := make(map[int]bool, len(missing))
+	for _, index := range missing {
+		chunks[index] = true
+	}
+	nack := &FileTransferMessage{
+		Type:          FileTransferNack,
+		TransferID:    ft.ID,
+		TotalChunks:   ft.TotalChunks,
+		MissingChunks: EncodeChunkBitset(chunks, ft.TotalChunks),
+	}
+	if err := c.sendFileMessage(ft.PeerID, nack); err != nil {
+		log.Warn("Failed to ask for missing chunks", "error", err)
+	}
+}
+
+// nextNackRound returns the chunks missing after END and counts a request
+// for them. Nothing is returned once the transfer is over
+func (ft *FileTransfer) nextNackRound() ([]int, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	if ft.Status != FileTransferTransferring || ft.endHash == "" {
+		return nil, nil
+	}
+	var missing []int
+	for index := range ft.TotalChunks {
+		if !ft.ChunksRecv[index] {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	if ft.nackRounds >= MaxNackRounds {
+		return nil, fmt.Errorf("%w after %d requests: %s", ErrMissingChunks, ft.nackRounds, formatChunks(missing))
+	}
+	ft.nackRounds++
+	return missing, nil
+}
+
+// formatChunks lists chunk indices for an error message
+func formatChunks(indices []int) string {
+	listed := make([]string, 0, maxListedChunks)
+	for _, index := range indices[:min(len(indices), maxListedChunks)] {
+		listed = append(listed, strconv.Itoa(index))
+	}
+	s := strings.Join(listed, ", ")
+	if rest := len(indices) - len(listed); rest > 0 {
+		s += fmt.Sprintf(" and %d more", rest)
+	}
+	return s
+}
+
+// retransmitChunks re-sends the chunks the receiver reported missing and
+// then END again. At most MaxNackRounds requests are answered
+func (c *Chat) retransmitChunks(peerID router.PeerID, ft *FileTransfer, missing map[int]bool) {
+	log := ft.logger()
+
+	ft.mu.Lock()
+	answer := ft.Status == FileTransferCompleted && ft.retransmitRounds < MaxNackRounds
+	if answer {
+		ft.retransmitRounds++
+	}
+	hash := ft.Hash
+	ft.mu.Unlock()
+	if !answer {
+		log.Warn("Ignoring missing chunks request")
+		return
+	}
+
+	peer, ok := c.connector.GetPeer(peerID)
+	if !ok {
+		return
+	}
+
+	var indices []int
+	for _, index := range slices.Sorted(maps.Keys(missing)) {
+		if index < ft.TotalChunks {
+			indices = append(indices, index)
+		}
+	}
+	log.Info("Re-sending missing chunks", "missing", len(indices))
+
+	err := c.resendChunks(ft, indices, func(ctx context.Context, data []byte) error {
+		return sendBulk(ctx, peer, data)
+	})
+	if err != nil {
+		log.Error("Failed to re-send missing chunks", "error", err)
+		return
+	}
+
+	endMsg := &FileTransferMessage{
+		Type:       FileTransferEnd,
+		TransferID: ft.ID,
+		SHA256Hash: hash,
+	}
+	if err := c.sendFileMessage(peerID, endMsg); err != nil {
+		log.Error("Failed to send end message", "error", err)
+	}
+}
+
+// resendChunks reads the given chunks from the sent file again and passes
+// them to send one by one, within the rate limit
+func (c *Chat) resendChunks(ft *FileTransfer, indices []int, send func(ctx context.Context, data []byte) error) error {
+	file, err := os.Open(ft.FilePath)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer file.Close()
+
+	binaryChunks := ft.useBinaryChunks()
+	buffer := make([]byte, ChunkSize)
+	for _, index := range indices {
+		n, err := file.ReadAt(buffer, int64(index)*ChunkSize)
+		if err != nil && n == 0 {
+			return fmt.Errorf("read chunk %d: %w", index, err)
+		}
+		data, err := ft.encodeChunk(binaryChunks, index, buffer[:n])
+		if err != nil {
+			return fmt.Errorf("marshal chunk %d: %w", index, err)
+		}
+
+		if err := c.fileTransferMgr.limiter.wait(ft.context(), n); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ft.context(), ChunkSendTimeout)
+		err = send(ctx, data)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("send chunk %d: %w", index, err)
+		}
+	}
+	return nil
+}
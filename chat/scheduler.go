@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"github.com/udisondev/sendy/router"
+)
+
+// Defaults for how many outgoing transfers run at once. Chunks of running
+// transfers share the data channel and the disk, the rest wait in a queue
+const (
+	DefaultMaxTransfersPerPeer = 1
+	DefaultMaxTransfers        = 3
+)
+
+// QueuePosition reports whether the transfer waits for a free slot and how
+// many queued transfers are ahead of it
+func (ft *FileTransfer) QueuePosition() (ahead int, queued bool) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if ft.Status != FileTransferQueued {
+		return 0, false
+	}
+	return max(ft.queuePosition, 0), true
+}
+
+// SetTransferLimits sets how many outgoing transfers run at once to one
+// peer and in total, both at least 1
+func (ftm *FileTransferManager) SetTransferLimits(perPeer, total int) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+	ftm.maxPerPeer = max(perPeer, 1)
+	ftm.maxTotal = max(total, 1)
+}
+
+// TransferLimits returns how many outgoing transfers run at once to one
+// peer and in total
+func (ftm *FileTransferManager) TransferLimits() (perPeer, total int) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+	return ftm.maxPerPeer, ftm.maxTotal
+}
+
+// enqueue puts an outgoing transfer at the end of the queue, start offers
+// the file to the peer once dispatch gives it a slot
+func (ftm *FileTransferManager) enqueue(ft *FileTransfer, start func() error) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+
+	ft.mu.Lock()
+	ft.Status = FileTransferQueued
+	ft.queuePosition = -1 // Reported by the first dispatch
+	ft.start = start
+	ft.mu.Unlock()
+
+	ftm.queue = append(ftm.queue, ft)
+}
+
+// release frees the slot of a finished, failed or cancelled transfer
+func (ftm *FileTransferManager) release(transferID string) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+	delete(ftm.slots, transferID)
+}
+
+// dispatch gives free slots to queued transfers in order, skipping those
+// whose peer has no slot left. It returns the transfers to start and the
+// ones still queued whose position changed
+func (ftm *FileTransferManager) dispatch() (started, moved []*FileTransfer) {
+	ftm.mu.Lock()
+	defer ftm.mu.Unlock()
+
+	perPeer := make(map[router.PeerID]int, len(ftm.slots))
+	for _, peerID := range ftm.slots {
+		perPeer[peerID]++
+	}
+
+	queue := ftm.queue[:0]
+	for _, ft := range ftm.queue {
+		ft.mu.Lock()
+		if len(ftm.slots) < ftm.maxTotal && perPeer[ft.PeerID] < ftm.maxPerPeer {
+			ftm.slots[ft.ID] = ft.PeerID
+			perPeer[ft.PeerID]++
+			ft.Status = FileTransferPending
+			ft.queuePosition = 0
+			started = append(started, ft)
+		} else {
+			if ft.queuePosition != len(queue) {
+				ft.queuePosition = len(queue)
+				moved = append(moved, ft)
+			}
+			queue = append(queue, ft)
+		}
+		ft.mu.Unlock()
+	}
+	clear(ftm.queue[len(queue):])
+	ftm.queue = queue
+	return started, moved
+}
+
+// scheduleTransfer queues an outgoing transfer and starts it right away if
+// there is a free slot
+func (c *Chat) scheduleTransfer(ft *FileTransfer, start func() error) {
+	c.fileTransferMgr.enqueue(ft, start)
+	c.runTransferQueue()
+}
+
+// releaseTransfer frees the slot of an outgoing transfer that ended and
+// starts the next queued one
+func (c *Chat) releaseTransfer(ft *FileTransfer) {
+	if !ft.IsOutgoing {
+		return
+	}
+	c.fileTransferMgr.release(ft.ID)
+	c.runTransferQueue()
+}
+
+// runTransferQueue starts queued transfers that got a slot and reports the
+// new positions of the rest with ChatEventFileTransferProgress
+func (c *Chat) runTransferQueue() {
+	started, moved := c.fileTransferMgr.dispatch()
+	for _, ft := range moved {
+		c.events <- ChatEvent{
+			Type:         ChatEventFileTransferProgress,
+			PeerID:       ft.PeerID,
+			FileTransfer: ft,
+		}
+	}
+	for _, ft := range started {
+		if err := ft.start(); err != nil {
+			c.handleFileTransferError(ft, err)
+		}
+	}
+}
+
+// SetTransferLimits sets how many outgoing transfers run at once to one
+// peer and in total. Further SendFile calls wait in a queue, shown by
+// ListTransfers. Raising the limits starts waiting transfers right away
+func (c *Chat) SetTransferLimits(perPeer, total int) {
+	c.fileTransferMgr.SetTransferLimits(perPeer, total)
+	c.runTransferQueue()
+}
+
+// TransferLimits returns how many outgoing transfers run at once to one
+// peer and in total
+func (c *Chat) TransferLimits() (perPeer, total int) {
+	return c.fileTransferMgr.TransferLimits()
+}
+
+// ListTransfers returns pending and running file transfers oldest first,
+// then queued ones in the order they will start
+func (c *Chat) ListTransfers() []*FileTransfer {
+	return c.fileTransferMgr.ListTransfers()
+}
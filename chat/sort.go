@@ -0,0 +1,103 @@
+package chat
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SortOrder is the order of the contact list
+type SortOrder int
+
+const (
+	SortRecent   SortOrder = iota // Latest message first
+	SortNameAsc                   // Name A-Z
+	SortNameDesc                  // Name Z-A
+	SortLastSeen                  // Most recently connected first
+)
+
+// sortOrderNames are the config file values of the sort orders
+var sortOrderNames = []string{
+	SortRecent:   "recent",
+	SortNameAsc:  "name",
+	SortNameDesc: "name_desc",
+	SortLastSeen: "last_seen",
+}
+
+// String returns the config file value of the order
+func (o SortOrder) String() string {
+	if o < 0 || int(o) >= len(sortOrderNames) {
+		return fmt.Sprintf("SortOrder(%d)", int(o))
+	}
+	return sortOrderNames[o]
+}
+
+// Next returns the order that follows o when cycling through orders
+func (o SortOrder) Next() SortOrder {
+	return (o + 1) % SortOrder(len(sortOrderNames))
+}
+
+// ParseSortOrder parses a config file value of the order
+func ParseSortOrder(s string) (SortOrder, error) {
+	i := slices.Index(sortOrderNames, s)
+	if i < 0 {
+		return 0, fmt.Errorf("invalid contact sort %q: use %s", s, strings.Join(sortOrderNames, ", "))
+	}
+	return SortOrder(i), nil
+}
+
+// GetContactsSorted returns contacts and groups in the given order
+func (c *Chat) GetContactsSorted(order SortOrder) ([]*Contact, error) {
+	var contacts []*Contact
+	var err error
+	switch order {
+	case SortRecent:
+		contacts, err = c.storage.GetRecentContacts(0)
+	case SortNameAsc:
+		contacts, err = c.storage.GetContactsSortedByName(true)
+	case SortNameDesc:
+		contacts, err = c.storage.GetContactsSortedByName(false)
+	default:
+		contacts, err = c.storage.GetAllContacts()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := c.groupContacts()
+	if err != nil {
+		return nil, fmt.Errorf("get groups: %w", err)
+	}
+	if len(groups) == 0 {
+		return contacts, nil
+	}
+
+	// Groups are placed among contacts by the same key. The sort is stable
+	// so contacts keep the order of the query. Groups have no last seen time
+	// and go last in SortLastSeen
+	all := append(contacts, groups...)
+	switch order {
+	case SortRecent:
+		slices.SortStableFunc(all, func(a, b *Contact) int {
+			return lastMessageTime(b).Compare(lastMessageTime(a))
+		})
+	case SortNameAsc:
+		slices.SortStableFunc(all, func(a, b *Contact) int {
+			return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		})
+	case SortNameDesc:
+		slices.SortStableFunc(all, func(a, b *Contact) int {
+			return strings.Compare(strings.ToLower(b.Name), strings.ToLower(a.Name))
+		})
+	}
+	return all, nil
+}
+
+// lastMessageTime returns the time of the latest message, zero if none
+func lastMessageTime(contact *Contact) time.Time {
+	if contact.LastMessage == nil {
+		return time.Time{}
+	}
+	return contact.LastMessage.Timestamp
+}
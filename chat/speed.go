@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"log/slog"
+	"time"
+)
+
+// SpeedWindow is how far back the transfer rate looks, so the ETA follows
+// a link that gets faster or slower instead of the average since the start
+const SpeedWindow = 5 * time.Second
+
+// speedSampleInterval merges samples closer than this, a fast transfer
+// keeps about SpeedWindow/speedSampleInterval of them
+const speedSampleInterval = 100 * time.Millisecond
+
+// rateSample is the number of bytes moved by a point in time
+type rateSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// addRateSample records movedBytes at now and returns the rate over the
+// last SpeedWindow. The window starts at StartedAt until it fills up, and
+// keeps the last sample before its start, so a stall lowers the rate.
+// ft.mu must be held
+func (ft *FileTransfer) addRateSample(now time.Time) float64 {
+	if len(ft.rateSamples) == 0 {
+		ft.rateSamples = append(ft.rateSamples, rateSample{at: ft.StartedAt})
+	}
+	if n := len(ft.rateSamples); n > 1 && now.Sub(ft.rateSamples[n-2].at) < speedSampleInterval {
+		ft.rateSamples[n-1] = rateSample{at: now, bytes: ft.movedBytes}
+	} else {
+		ft.rateSamples = append(ft.rateSamples, rateSample{at: now, bytes: ft.movedBytes})
+	}
+
+	// Drop samples older than the base of the window
+	base := 0
+	for i, s := range ft.rateSamples {
+		if now.Sub(s.at) < SpeedWindow {
+			break
+		}
+		base = i
+	}
+	ft.rateSamples = append(ft.rateSamples[:0], ft.rateSamples[base:]...)
+
+	first, last := ft.rateSamples[0], ft.rateSamples[len(ft.rateSamples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return ft.BytesPerSecond
+	}
+	return float64(last.bytes-first.bytes) / elapsed
+}
+
+// averageSpeed returns bytes moved per second from StartedAt to the last
+// chunk, 0 before the first chunk
+func (ft *FileTransfer) averageSpeed() float64 {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	if len(ft.rateSamples) == 0 {
+		return 0
+	}
+	elapsed := ft.rateSamples[len(ft.rateSamples)-1].at.Sub(ft.StartedAt).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(ft.movedBytes) / elapsed
+}
+
+// saveTransferRate stores the average rate of a completed transfer
+func (c *Chat) saveTransferRate(log *slog.Logger, ft *FileTransfer) {
+	if err := c.storage.SaveFileTransferRate(ft.ID, ft.averageSpeed()); err != nil {
+		log.Warn("Failed to save transfer rate", "error", err)
+	}
+}
@@ -1,13 +1,17 @@
 package chat
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+	"github.com/udisondev/sendy/p2p"
 	"github.com/udisondev/sendy/router"
 )
 
@@ -16,11 +20,13 @@ const (
 	MaxMessageSize  = 10 * 1024 * 1024 // 10 MB - maximum message size
 	MaxContactName  = 256              // Maximum contact name length
 	MaxContactCount = 10000            // Maximum number of contacts
+	MaxGroupMembers = 100              // Maximum members of a group, excluding us
 )
 
 // Storage manages message and contact storage
 type Storage struct {
-	db *sql.DB
+	db   *sql.DB
+	path string
 }
 
 // Contact represents a contact in address book
@@ -31,6 +37,11 @@ type Contact struct {
 	LastSeen            time.Time
 	IsBlocked           bool
 	NotificationsBlocked bool // Block notifications from this contact
+	MutedUntil          time.Time // End of the mute, zero if muted until unmuted
+	EncKey              *p2p.Curve25519PublicKey // Key of the last connection, nil if never connected
+	Verified            bool     // Safety number confirmed by the user for EncKey
+	LastMessage         *Message // Latest message for previews, nil if none
+	IsGroup             bool     // Group conversation, PeerID is the group ID
 }
 
 // Message represents a message in chat
@@ -41,6 +52,57 @@ type Message struct {
 	Timestamp time.Time
 	IsOutgoing bool // true if we sent, false if received
 	IsRead    bool
+	ContentHash string    // Hash of the original content, identifies the message in edits
+	EditedAt    time.Time // Zero if the message was never edited
+	ReadAt      *time.Time // When the message was read, by us or by the contact for outgoing ones
+	SenderID    router.PeerID // Author of an incoming group message, zero otherwise
+	UUID        string        // Sent with the message to be acked, empty for untracked messages
+	Status      MessageStatus // Delivery of an outgoing message
+}
+
+// IsMuted reports whether notifications from the contact are blocked at now
+func (c *Contact) IsMuted(now time.Time) bool {
+	return c.NotificationsBlocked && (c.MutedUntil.IsZero() || now.Before(c.MutedUntil))
+}
+
+// IsEdited reports whether the message content was edited
+func (m *Message) IsEdited() bool {
+	return !m.EditedAt.IsZero()
+}
+
+// MessageEdit is a previous version of an edited message
+type MessageEdit struct {
+	ID         int64
+	MessageID  int64
+	OldContent string
+	EditedAt   time.Time
+}
+
+// MessageContentHash returns the stable hash both sides compute for a sent
+// message. Edits refer to the original message by this hash
+func MessageContentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// ErrDuplicateMessage is returned by SaveMessage for a received message
+// that is already stored, e.g. retransmitted after a connection flicker
+var ErrDuplicateMessage = errors.New("duplicate message")
+
+// messageDedupHash identifies a received message: the same content from the
+// same sender within the same second is saved once. A message with a UUID
+// is identified by it, so a copy resent after a reconnect is saved once
+func messageDedupHash(msg *Message) string {
+	h := sha256.New()
+	h.Write(msg.PeerID[:])
+	if msg.UUID != "" {
+		h.Write([]byte("uuid:" + msg.UUID))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	h.Write(msg.SenderID[:])
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(msg.Timestamp.Unix())))
+	h.Write([]byte(msg.Content))
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 // SearchResult represents a search result with contact info
@@ -56,7 +118,7 @@ func NewStorage(dbPath string) (*Storage, error) {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
 
-	s := &Storage{db: db}
+	s := &Storage{db: db, path: dbPath}
 	if err := s.init(); err != nil {
 		db.Close()
 		return nil, err
@@ -65,73 +127,6 @@ func NewStorage(dbPath string) (*Storage, error) {
 	return s, nil
 }
 
-// init initializes database schema
-func (s *Storage) init() error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS contacts (
-		peer_id TEXT PRIMARY KEY,
-		name TEXT NOT NULL,
-		added_at INTEGER NOT NULL,
-		last_seen INTEGER NOT NULL,
-		is_blocked INTEGER NOT NULL DEFAULT 0,
-		notifications_blocked INTEGER NOT NULL DEFAULT 0
-	);
-
-	CREATE TABLE IF NOT EXISTS messages (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		peer_id TEXT NOT NULL,
-		content TEXT NOT NULL,
-		timestamp INTEGER NOT NULL,
-		is_outgoing INTEGER NOT NULL,
-		is_read INTEGER NOT NULL DEFAULT 0,
-		FOREIGN KEY(peer_id) REFERENCES contacts(peer_id)
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_messages_peer_timestamp
-	ON messages(peer_id, timestamp DESC);
-
-	CREATE INDEX IF NOT EXISTS idx_messages_unread
-	ON messages(peer_id, is_read) WHERE is_read = 0;
-
-	CREATE TABLE IF NOT EXISTS file_transfers (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		transfer_id TEXT UNIQUE NOT NULL,
-		peer_id TEXT NOT NULL,
-		file_name TEXT NOT NULL,
-		file_size INTEGER NOT NULL,
-		file_path TEXT,
-		is_outgoing INTEGER NOT NULL,
-		status TEXT NOT NULL,
-		progress INTEGER DEFAULT 0,
-		sha256_hash TEXT,
-		started_at INTEGER NOT NULL,
-		completed_at INTEGER,
-		FOREIGN KEY(peer_id) REFERENCES contacts(peer_id)
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_file_transfers_peer
-	ON file_transfers(peer_id, started_at DESC);
-
-	CREATE INDEX IF NOT EXISTS idx_file_transfers_status
-	ON file_transfers(status, started_at DESC);
-	`
-
-	_, err := s.db.Exec(schema)
-	if err != nil {
-		return err
-	}
-
-	// Migration: add notifications_blocked for existing databases
-	_, err = s.db.Exec(`
-		ALTER TABLE contacts ADD COLUMN notifications_blocked INTEGER NOT NULL DEFAULT 0;
-	`)
-	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
-		return err
-	}
-
-	return nil
-}
-
 // Close closes database connection
 func (s *Storage) Close() error {
 	return s.db.Close()
@@ -198,10 +193,74 @@ func (s *Storage) SetBlocked(peerID router.PeerID, blocked bool) error {
 	return err
 }
 
-// SetNotificationsBlocked sets notification blocking for contact
+// SetPeerBlocked saves a change of the p2p blacklist. Contacts keep the flag
+// in the contacts table, other peers are saved to blocked_peers
+func (s *Storage) SetPeerBlocked(peerID router.PeerID, blocked bool) error {
+	hexID := hex.EncodeToString(peerID[:])
+	if !blocked {
+		if _, err := s.db.Exec(`DELETE FROM blocked_peers WHERE peer_id = ?`, hexID); err != nil {
+			return err
+		}
+		return s.SetBlocked(peerID, false)
+	}
+
+	_, err := s.GetContact(peerID)
+	if err == nil {
+		return s.SetBlocked(peerID, true)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR IGNORE INTO blocked_peers (peer_id, blocked_at) VALUES (?, ?)`, hexID, time.Now().Unix())
+	return err
+}
+
+// GetBlockedPeers returns blocked contacts and peers blocked without being
+// contacts, the initial p2p blacklist
+func (s *Storage) GetBlockedPeers() ([]router.PeerID, error) {
+	rows, err := s.db.Query(`
+		SELECT peer_id FROM contacts WHERE is_blocked = 1
+		UNION
+		SELECT peer_id FROM blocked_peers
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peers []router.PeerID
+	for rows.Next() {
+		var hexID string
+		if err := rows.Scan(&hexID); err != nil {
+			return nil, err
+		}
+		peerID, err := parsePeerID(hexID)
+		if err != nil {
+			return nil, fmt.Errorf("blocked peer: %w", err)
+		}
+		peers = append(peers, peerID)
+	}
+	return peers, rows.Err()
+}
+
+// SetNotificationsBlocked sets notification blocking for contact. A mute
+// set with SetMutedUntil is replaced by an indefinite one or lifted
 func (s *Storage) SetNotificationsBlocked(peerID router.PeerID, blocked bool) error {
 	hexID := hex.EncodeToString(peerID[:])
-	_, err := s.db.Exec(`UPDATE contacts SET notifications_blocked = ? WHERE peer_id = ?`, blocked, hexID)
+	_, err := s.db.Exec(`UPDATE contacts SET notifications_blocked = ?, muted_until = NULL WHERE peer_id = ?`, blocked, hexID)
+	return err
+}
+
+// SetMutedUntil blocks notifications from contact until the given time.
+// Zero time mutes the contact until SetNotificationsBlocked lifts the mute
+func (s *Storage) SetMutedUntil(peerID router.PeerID, until time.Time) error {
+	hexID := hex.EncodeToString(peerID[:])
+
+	var mutedUntil sql.NullInt64
+	if !until.IsZero() {
+		mutedUntil = sql.NullInt64{Int64: until.Unix(), Valid: true}
+	}
+	_, err := s.db.Exec(`UPDATE contacts SET notifications_blocked = 1, muted_until = ? WHERE peer_id = ?`, mutedUntil, hexID)
 	return err
 }
 
@@ -215,6 +274,14 @@ func (s *Storage) DeleteContact(peerID router.PeerID) error {
 	}
 	defer tx.Rollback()
 
+	// Delete edit history of the messages
+	if _, err := tx.Exec(`
+		DELETE FROM message_edits
+		WHERE message_id IN (SELECT id FROM messages WHERE peer_id = ?)
+	`, hexID); err != nil {
+		return err
+	}
+
 	// Delete messages
 	if _, err := tx.Exec(`DELETE FROM messages WHERE peer_id = ?`, hexID); err != nil {
 		return err
@@ -228,21 +295,21 @@ func (s *Storage) DeleteContact(peerID router.PeerID) error {
 	return tx.Commit()
 }
 
-// GetContact returns contact by ID
-func (s *Storage) GetContact(peerID router.PeerID) (*Contact, error) {
-	hexID := hex.EncodeToString(peerID[:])
+// contactColumns lists contact columns in the order scanContact expects,
+// qualified with the c alias for queries that join messages
+const contactColumns = `c.peer_id, c.name, c.added_at, c.last_seen, c.is_blocked,
+	c.notifications_blocked, c.muted_until, c.enc_key, c.verified`
 
+// scanContact scans a contact selected with contactColumns
+func scanContact(row interface{ Scan(dest ...any) error }) (*Contact, error) {
 	var contact Contact
 	var hexStr string
 	var addedAt, lastSeen int64
-	var isBlocked, notificationsBlocked int
-
-	err := s.db.QueryRow(`
-		SELECT peer_id, name, added_at, last_seen, is_blocked, notifications_blocked
-		FROM contacts WHERE peer_id = ?
-	`, hexID).Scan(&hexStr, &contact.Name, &addedAt, &lastSeen, &isBlocked, &notificationsBlocked)
+	var isBlocked, notificationsBlocked, verified int
+	var mutedUntil sql.NullInt64
+	var encKey sql.NullString
 
-	if err != nil {
+	if err := row.Scan(&hexStr, &contact.Name, &addedAt, &lastSeen, &isBlocked, &notificationsBlocked, &mutedUntil, &encKey, &verified); err != nil {
 		return nil, err
 	}
 
@@ -260,17 +327,82 @@ func (s *Storage) GetContact(peerID router.PeerID) (*Contact, error) {
 	contact.LastSeen = time.Unix(lastSeen, 0)
 	contact.IsBlocked = isBlocked != 0
 	contact.NotificationsBlocked = notificationsBlocked != 0
+	if mutedUntil.Valid {
+		contact.MutedUntil = time.Unix(mutedUntil.Int64, 0)
+	}
+	if contact.EncKey, err = parseEncKey(encKey); err != nil {
+		return nil, err
+	}
+	contact.Verified = verified != 0
 
 	return &contact, nil
 }
 
-// GetAllContacts returns all contacts
+// GetSetting returns the value of a setting, sql.ErrNoRows if it is not set
+func (s *Storage) GetSetting(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	return value, err
+}
+
+// SetSetting stores the value of a setting
+func (s *Storage) SetSetting(key, value string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, key, value)
+	return err
+}
+
+// GetContact returns contact by ID
+func (s *Storage) GetContact(peerID router.PeerID) (*Contact, error) {
+	hexID := hex.EncodeToString(peerID[:])
+	row := s.db.QueryRow(`SELECT `+contactColumns+` FROM contacts c WHERE c.peer_id = ?`, hexID)
+	return scanContact(row)
+}
+
+// GetAllContacts returns all contacts, the most recently connected first
 func (s *Storage) GetAllContacts() ([]*Contact, error) {
-	rows, err := s.db.Query(`
-		SELECT peer_id, name, added_at, last_seen, is_blocked, notifications_blocked
-		FROM contacts
-		ORDER BY last_seen DESC
+	return s.queryContacts(`
+		SELECT ` + contactColumns + `
+		FROM contacts c
+		ORDER BY c.last_seen DESC
+	`)
+}
+
+// GetRecentContacts returns contacts ordered by their latest message,
+// contacts without messages last. limit <= 0 returns all contacts
+func (s *Storage) GetRecentContacts(limit int) ([]*Contact, error) {
+	if limit <= 0 {
+		limit = -1 // No limit in SQLite
+	}
+	return s.queryContacts(`
+		SELECT `+contactColumns+`
+		FROM contacts c
+		LEFT JOIN messages m ON m.peer_id = c.peer_id AND m.deleted_at IS NULL
+		GROUP BY c.peer_id
+		ORDER BY MAX(m.timestamp) DESC, c.last_seen DESC
+		LIMIT ?
+	`, limit)
+}
+
+// GetContactsSortedByName returns contacts ordered by name, case-insensitive
+func (s *Storage) GetContactsSortedByName(asc bool) ([]*Contact, error) {
+	direction := "DESC"
+	if asc {
+		direction = "ASC"
+	}
+	return s.queryContacts(`
+		SELECT ` + contactColumns + `
+		FROM contacts c
+		ORDER BY c.name COLLATE NOCASE ` + direction + `, c.peer_id
 	`)
+}
+
+// queryContacts runs a query selecting contactColumns and fills in the
+// latest message of each contact
+func (s *Storage) queryContacts(query string, args ...any) ([]*Contact, error) {
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -278,37 +410,35 @@ func (s *Storage) GetAllContacts() ([]*Contact, error) {
 
 	var contacts []*Contact
 	for rows.Next() {
-		var contact Contact
-		var hexStr string
-		var addedAt, lastSeen int64
-		var isBlocked, notificationsBlocked int
-
-		if err := rows.Scan(&hexStr, &contact.Name, &addedAt, &lastSeen, &isBlocked, &notificationsBlocked); err != nil {
-			return nil, err
-		}
-
-		// SECURITY: Check hex decoding error
-		peerIDBytes, err := hex.DecodeString(hexStr)
+		contact, err := scanContact(rows)
 		if err != nil {
-			return nil, fmt.Errorf("invalid peer_id in database: %w", err)
-		}
-		if len(peerIDBytes) != router.PeerIDSize {
-			return nil, fmt.Errorf("invalid peer_id size in database: got %d, expected %d", len(peerIDBytes), router.PeerIDSize)
+			return nil, err
 		}
+		contacts = append(contacts, contact)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		copy(contact.PeerID[:], peerIDBytes)
-		contact.AddedAt = time.Unix(addedAt, 0)
-		contact.LastSeen = time.Unix(lastSeen, 0)
-		contact.IsBlocked = isBlocked != 0
-		contact.NotificationsBlocked = notificationsBlocked != 0
-
-		contacts = append(contacts, &contact)
+	peerIDs := make([]router.PeerID, len(contacts))
+	for i, contact := range contacts {
+		peerIDs[i] = contact.PeerID
+	}
+	lastMessages, err := s.GetLastMessages(peerIDs)
+	if err != nil {
+		return nil, fmt.Errorf("get last messages: %w", err)
+	}
+	for _, contact := range contacts {
+		contact.LastMessage = lastMessages[contact.PeerID]
 	}
 
-	return contacts, rows.Err()
+	return contacts, nil
 }
 
-// SaveMessage saves a message
+// SaveMessage saves a message. A received message already saved returns
+// ErrDuplicateMessage: one with a UUID is matched by it, one without by the
+// same content within the same second. Outgoing messages are never
+// deduplicated: the user may send the same text twice
 func (s *Storage) SaveMessage(msg *Message) error {
 	// SECURITY: Validate message size
 	if len(msg.Content) == 0 {
@@ -320,12 +450,28 @@ func (s *Storage) SaveMessage(msg *Message) error {
 
 	hexID := hex.EncodeToString(msg.PeerID[:])
 	timestamp := msg.Timestamp.Unix()
+	var senderID sql.NullString
+	if msg.SenderID != (router.PeerID{}) {
+		senderID = sql.NullString{String: hex.EncodeToString(msg.SenderID[:]), Valid: true}
+	}
+	if msg.ContentHash == "" {
+		msg.ContentHash = MessageContentHash(msg.Content)
+	}
+	var dedupHash sql.NullString
+	if !msg.IsOutgoing {
+		dedupHash = sql.NullString{String: messageDedupHash(msg), Valid: true}
+	}
+	uuid := sql.NullString{String: msg.UUID, Valid: msg.UUID != ""}
 
 	result, err := s.db.Exec(`
-		INSERT INTO messages (peer_id, content, timestamp, is_outgoing, is_read)
-		VALUES (?, ?, ?, ?, ?)
-	`, hexID, msg.Content, timestamp, msg.IsOutgoing, msg.IsRead)
+		INSERT INTO messages (peer_id, content, timestamp, is_outgoing, is_read, content_hash, sender_id, dedup_hash, uuid, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, hexID, msg.Content, timestamp, msg.IsOutgoing, msg.IsRead, msg.ContentHash, senderID, dedupHash, uuid, msg.Status)
 
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return fmt.Errorf("%w: %w", ErrDuplicateMessage, err)
+	}
 	if err != nil {
 		return err
 	}
@@ -339,9 +485,9 @@ func (s *Storage) GetMessages(peerID router.PeerID, limit int) ([]*Message, erro
 	hexID := hex.EncodeToString(peerID[:])
 
 	rows, err := s.db.Query(`
-		SELECT id, peer_id, content, timestamp, is_outgoing, is_read
+		SELECT `+messageColumns+`
 		FROM messages
-		WHERE peer_id = ?
+		WHERE peer_id = ? AND deleted_at IS NULL
 		ORDER BY timestamp DESC
 		LIMIT ?
 	`, hexID, limit)
@@ -352,49 +498,442 @@ func (s *Storage) GetMessages(peerID router.PeerID, limit int) ([]*Message, erro
 
 	var messages []*Message
 	for rows.Next() {
-		var msg Message
-		var hexStr string
-		var timestamp int64
-		var isOutgoing, isRead int
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	// Reverse so old messages are first
+	for i := 0; i < len(messages)/2; i++ {
+		j := len(messages) - 1 - i
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages, rows.Err()
+}
+
+// GetLastMessage returns the latest message with a contact, or nil if there
+// are no messages
+func (s *Storage) GetLastMessage(peerID router.PeerID) (*Message, error) {
+	hexID := hex.EncodeToString(peerID[:])
+
+	row := s.db.QueryRow(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE peer_id = ? AND deleted_at IS NULL
+		ORDER BY timestamp DESC, id DESC
+		LIMIT 1
+	`, hexID)
+
+	msg, err := scanMessage(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return msg, err
+}
+
+// lastMessagesBatch keeps the number of SQL variables per query well below
+// SQLite limits
+const lastMessagesBatch = 500
 
-		if err := rows.Scan(&msg.ID, &hexStr, &msg.Content, &timestamp, &isOutgoing, &isRead); err != nil {
+// GetLastMessages returns the latest message for each of the given contacts.
+// Contacts without messages are absent from the result
+func (s *Storage) GetLastMessages(peerIDs []router.PeerID) (map[router.PeerID]*Message, error) {
+	result := make(map[router.PeerID]*Message, len(peerIDs))
+
+	for start := 0; start < len(peerIDs); start += lastMessagesBatch {
+		batch := peerIDs[start:min(start+lastMessagesBatch, len(peerIDs))]
+
+		args := make([]any, len(batch))
+		for i, peerID := range batch {
+			args[i] = hex.EncodeToString(peerID[:])
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("(?),", len(batch)), ",")
+
+		// One indexed lookup of the latest message per requested peer
+		rows, err := s.db.Query(`
+			SELECT `+messageColumns+`
+			FROM messages
+			WHERE id IN (
+				SELECT (
+					SELECT id FROM messages
+					WHERE peer_id = p.column1 AND deleted_at IS NULL
+					ORDER BY timestamp DESC, id DESC
+					LIMIT 1
+				)
+				FROM (VALUES `+placeholders+`) p
+			)
+		`, args...)
+		if err != nil {
 			return nil, err
 		}
 
-		// SECURITY: Check hex decoding error
-		peerIDBytes, err := hex.DecodeString(hexStr)
+		for rows.Next() {
+			msg, err := scanMessage(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			result[msg.PeerID] = msg
+		}
+		err = rows.Err()
+		rows.Close()
 		if err != nil {
-			return nil, fmt.Errorf("invalid peer_id in database: %w", err)
+			return nil, err
 		}
-		if len(peerIDBytes) != router.PeerIDSize {
-			return nil, fmt.Errorf("invalid peer_id size in database: got %d, expected %d", len(peerIDBytes), router.PeerIDSize)
+	}
+
+	return result, nil
+}
+
+// messageColumns are the messages columns read by scanMessage
+const messageColumns = `id, peer_id, content, timestamp, is_outgoing, is_read, content_hash, edited_at, read_at, sender_id, uuid, status`
+
+// scanMessage scans a messages row selected as messageColumns
+func scanMessage(row interface{ Scan(dest ...any) error }) (*Message, error) {
+	var msg Message
+	var hexStr string
+	var timestamp int64
+	var isOutgoing, isRead int
+	var contentHash, senderID, uuid sql.NullString
+	var editedAt, readAt sql.NullInt64
+
+	if err := row.Scan(&msg.ID, &hexStr, &msg.Content, &timestamp, &isOutgoing, &isRead, &contentHash, &editedAt, &readAt, &senderID, &uuid, &msg.Status); err != nil {
+		return nil, err
+	}
+
+	// SECURITY: Check hex decoding error
+	peerIDBytes, err := hex.DecodeString(hexStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer_id in database: %w", err)
+	}
+	if len(peerIDBytes) != router.PeerIDSize {
+		return nil, fmt.Errorf("invalid peer_id size in database: got %d, expected %d", len(peerIDBytes), router.PeerIDSize)
+	}
+
+	copy(msg.PeerID[:], peerIDBytes)
+	msg.Timestamp = time.Unix(timestamp, 0)
+	msg.IsOutgoing = isOutgoing != 0
+	msg.IsRead = isRead != 0
+	msg.ContentHash = contentHash.String
+	msg.UUID = uuid.String
+	if editedAt.Valid {
+		msg.EditedAt = time.Unix(editedAt.Int64, 0)
+	}
+	if readAt.Valid {
+		t := time.Unix(readAt.Int64, 0)
+		msg.ReadAt = &t
+	}
+	if senderID.Valid {
+		if msg.SenderID, err = parsePeerID(senderID.String); err != nil {
+			return nil, fmt.Errorf("invalid sender_id in database: %w", err)
 		}
+	}
+
+	return &msg, nil
+}
 
-		copy(msg.PeerID[:], peerIDBytes)
-		msg.Timestamp = time.Unix(timestamp, 0)
-		msg.IsOutgoing = isOutgoing != 0
-		msg.IsRead = isRead != 0
+// GetMessage returns a message by ID. Deleted messages are not found
+func (s *Storage) GetMessage(id int64) (*Message, error) {
+	row := s.db.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE id = ? AND deleted_at IS NULL`, id)
+	return scanMessage(row)
+}
+
+// GetMessageByHash returns the latest message with the given content hash
+// exchanged with a contact in the given direction
+func (s *Storage) GetMessageByHash(peerID router.PeerID, contentHash string, isOutgoing bool) (*Message, error) {
+	hexID := hex.EncodeToString(peerID[:])
+
+	row := s.db.QueryRow(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE peer_id = ? AND content_hash = ? AND is_outgoing = ? AND deleted_at IS NULL
+		ORDER BY timestamp DESC, id DESC
+		LIMIT 1
+	`, hexID, contentHash, isOutgoing)
+	return scanMessage(row)
+}
 
-		messages = append(messages, &msg)
+// EditMessage replaces message content and records the previous content in
+// the edit history. The content hash keeps identifying the original message
+func (s *Storage) EditMessage(id int64, newContent string) error {
+	// SECURITY: Validate message size
+	if len(newContent) == 0 {
+		return fmt.Errorf("message content cannot be empty")
+	}
+	if len(newContent) > MaxMessageSize {
+		return fmt.Errorf("message too large: %d bytes (max %d)", len(newContent), MaxMessageSize)
 	}
 
-	// Reverse so old messages are first
-	for i := 0; i < len(messages)/2; i++ {
-		j := len(messages) - 1 - i
-		messages[i], messages[j] = messages[j], messages[i]
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldContent string
+	if err := tx.QueryRow(`SELECT content FROM messages WHERE id = ?`, id).Scan(&oldContent); err != nil {
+		return fmt.Errorf("get message: %w", err)
+	}
+	if oldContent == newContent {
+		return nil
 	}
 
-	return messages, rows.Err()
+	now := time.Now().Unix()
+	if _, err := tx.Exec(`
+		INSERT INTO message_edits (message_id, old_content, edited_at)
+		VALUES (?, ?, ?)
+	`, id, oldContent, now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE messages SET content = ?, edited_at = ? WHERE id = ?`, newContent, now, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteMessage soft-deletes a message: it disappears from history, search
+// and exports but stays in the database until PurgeDeletedMessages
+func (s *Storage) DeleteMessage(id int64) error {
+	result, err := s.db.Exec(`
+		UPDATE messages SET deleted_at = ?
+		WHERE id = ? AND deleted_at IS NULL
+	`, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("delete message %d: %w", id, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// PurgeDeletedMessages permanently removes messages deleted more than
+// olderThan ago, together with their edit history
+func (s *Storage) PurgeDeletedMessages(olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan).Unix()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM message_edits
+		WHERE message_id IN (SELECT id FROM messages WHERE deleted_at <= ?)
+	`, cutoff); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM messages WHERE deleted_at <= ?`, cutoff); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeOldMessages permanently removes messages sent or received more than
+// olderThan ago, together with their edit history, and finished file
+// transfers started before the same cutoff. Pending and active transfers
+// are kept so they can still resume. Returns the number of purged messages
+func (s *Storage) PurgeOldMessages(olderThan time.Duration) (int64, error) {
+	if olderThan <= 0 {
+		return 0, fmt.Errorf("invalid purge age: %v", olderThan)
+	}
+	cutoff := time.Now().Add(-olderThan).Unix()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM message_edits
+		WHERE message_id IN (SELECT id FROM messages WHERE timestamp < ?)
+	`, cutoff); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`DELETE FROM messages WHERE timestamp < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		DELETE FROM file_transfers
+		WHERE status IN (?, ?, ?) AND started_at < ?
+	`, FileTransferCompleted, FileTransferFailed, FileTransferCancelled, cutoff); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
 }
 
-// MarkAsRead marks all messages from contact as read
-func (s *Storage) MarkAsRead(peerID router.PeerID) error {
+// GetMessageEdits returns previous versions of a message, oldest first
+func (s *Storage) GetMessageEdits(messageID int64) ([]*MessageEdit, error) {
+	rows, err := s.db.Query(`
+		SELECT id, message_id, old_content, edited_at
+		FROM message_edits
+		WHERE message_id = ?
+		ORDER BY edited_at, id
+	`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var edits []*MessageEdit
+	for rows.Next() {
+		var edit MessageEdit
+		var editedAt int64
+		if err := rows.Scan(&edit.ID, &edit.MessageID, &edit.OldContent, &editedAt); err != nil {
+			return nil, err
+		}
+		edit.EditedAt = time.Unix(editedAt, 0)
+		edits = append(edits, &edit)
+	}
+	return edits, rows.Err()
+}
+
+// MarkAsRead marks all messages from contact as read and returns the content
+// hashes of the messages that were unread
+func (s *Storage) MarkAsRead(peerID router.PeerID) ([]string, error) {
 	hexID := hex.EncodeToString(peerID[:])
-	_, err := s.db.Exec(`
-		UPDATE messages SET is_read = 1
+
+	rows, err := s.db.Query(`
+		UPDATE messages SET is_read = 1, read_at = ?
 		WHERE peer_id = ? AND is_outgoing = 0 AND is_read = 0
-	`, hexID)
-	return err
+		RETURNING content_hash, deleted_at
+	`, time.Now().Unix(), hexID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var contentHash sql.NullString
+		var deletedAt sql.NullInt64
+		if err := rows.Scan(&contentHash, &deletedAt); err != nil {
+			return nil, err
+		}
+		if contentHash.String != "" && !deletedAt.Valid {
+			hashes = append(hashes, contentHash.String)
+		}
+	}
+	return hashes, rows.Err()
+}
+
+// MarkOutgoingRead marks messages sent to contact with the given content
+// hashes as read at readAt and returns the messages that were unread
+func (s *Storage) MarkOutgoingRead(peerID router.PeerID, contentHashes []string, readAt time.Time) ([]*Message, error) {
+	hexID := hex.EncodeToString(peerID[:])
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var msgs []*Message
+	for _, contentHash := range contentHashes {
+		rows, err := tx.Query(`
+			UPDATE messages SET is_read = 1, read_at = ?
+			WHERE peer_id = ? AND content_hash = ? AND is_outgoing = 1
+				AND read_at IS NULL AND deleted_at IS NULL
+			RETURNING `+messageColumns,
+			readAt.Unix(), hexID, contentHash)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			msg, err := scanMessage(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			msgs = append(msgs, msg)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// UpdateMessageStatus changes the status of an outgoing message from one
+// value to another and returns the updated message. A message not in the
+// from status is left as is and sql.ErrNoRows is returned
+func (s *Storage) UpdateMessageStatus(id int64, from, to MessageStatus) (*Message, error) {
+	row := s.db.QueryRow(`
+		UPDATE messages SET status = ?
+		WHERE id = ? AND status = ? AND is_outgoing = 1 AND deleted_at IS NULL
+		RETURNING `+messageColumns,
+		to, id, from)
+	return scanMessage(row)
+}
+
+// MarkMessageDelivered marks the message sent to contact with the given UUID
+// as delivered and returns it. A message already delivered or not found
+// returns sql.ErrNoRows
+func (s *Storage) MarkMessageDelivered(peerID router.PeerID, uuid string) (*Message, error) {
+	hexID := hex.EncodeToString(peerID[:])
+
+	row := s.db.QueryRow(`
+		UPDATE messages SET status = ?
+		WHERE peer_id = ? AND uuid = ? AND is_outgoing = 1
+			AND status != ? AND deleted_at IS NULL
+		RETURNING `+messageColumns,
+		MessageStatusDelivered, hexID, uuid, MessageStatusDelivered)
+	return scanMessage(row)
+}
+
+// GetUndeliveredMessages returns up to limit messages sent to contact that
+// were not acked yet, oldest first
+func (s *Storage) GetUndeliveredMessages(peerID router.PeerID, limit int) ([]*Message, error) {
+	hexID := hex.EncodeToString(peerID[:])
+
+	rows, err := s.db.Query(`
+		SELECT `+messageColumns+`
+		FROM messages
+		WHERE peer_id = ? AND is_outgoing = 1 AND uuid IS NOT NULL
+			AND status IN (?, ?, ?) AND deleted_at IS NULL
+		ORDER BY timestamp ASC, id ASC
+		LIMIT ?
+	`, hexID, MessageStatusSending, MessageStatusSent, MessageStatusFailed, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []*Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
 }
 
 // GetUnreadCount returns the number of unread messages from contact
@@ -404,12 +943,65 @@ func (s *Storage) GetUnreadCount(peerID router.PeerID) (int, error) {
 	var count int
 	err := s.db.QueryRow(`
 		SELECT COUNT(*) FROM messages
-		WHERE peer_id = ? AND is_outgoing = 0 AND is_read = 0
+		WHERE peer_id = ? AND is_outgoing = 0 AND is_read = 0 AND deleted_at IS NULL
+	`, hexID).Scan(&count)
+
+	return count, err
+}
+
+// CountMessages returns the number of messages with a contact
+func (s *Storage) CountMessages(peerID router.PeerID) (int, error) {
+	hexID := hex.EncodeToString(peerID[:])
+
+	var count int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*) FROM messages
+		WHERE peer_id = ? AND deleted_at IS NULL
 	`, hexID).Scan(&count)
 
 	return count, err
 }
 
+// CountAllMessages returns the number of messages in all conversations
+func (s *Storage) CountAllMessages() (int, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE deleted_at IS NULL`).Scan(&count)
+	return count, err
+}
+
+// StorageStats describes the contents and size of the database
+type StorageStats struct {
+	TotalMessages      int
+	TotalContacts      int
+	TotalFileTransfers int
+	DBSizeBytes        int64
+}
+
+// GetStorageStats returns row counts and the database size
+func (s *Storage) GetStorageStats() (StorageStats, error) {
+	var stats StorageStats
+	err := s.db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM messages WHERE deleted_at IS NULL),
+			(SELECT COUNT(*) FROM contacts),
+			(SELECT COUNT(*) FROM file_transfers)
+	`).Scan(&stats.TotalMessages, &stats.TotalContacts, &stats.TotalFileTransfers)
+	if err != nil {
+		return StorageStats{}, fmt.Errorf("count rows: %w", err)
+	}
+
+	var pageCount, pageSize int64
+	if err := s.db.QueryRow(`PRAGMA page_count`).Scan(&pageCount); err != nil {
+		return StorageStats{}, fmt.Errorf("get page count: %w", err)
+	}
+	if err := s.db.QueryRow(`PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return StorageStats{}, fmt.Errorf("get page size: %w", err)
+	}
+	stats.DBSizeBytes = pageCount * pageSize
+
+	return stats, nil
+}
+
 // SaveFileTransfer saves file transfer information
 func (s *Storage) SaveFileTransfer(transferID string, peerID router.PeerID, fileName string, fileSize int64, filePath string, isOutgoing bool, status string) error {
 	hexID := hex.EncodeToString(peerID[:])
@@ -446,6 +1038,54 @@ func (s *Storage) UpdateFileTransferStatus(transferID string, status string, has
 	return err
 }
 
+// SaveFileTransferRate saves the average rate of a completed transfer in
+// bytes per second
+func (s *Storage) SaveFileTransferRate(transferID string, bytesPerSec float64) error {
+	_, err := s.db.Exec(`
+		UPDATE file_transfers SET avg_bytes_per_sec = ?
+		WHERE transfer_id = ?
+	`, bytesPerSec, transferID)
+	return err
+}
+
+// SaveFileTransferChunks saves progress of an incoming transfer: the
+// completion percentage, a bitset of received chunks (see
+// EncodeChunkBitset) and the bytes written
+func (s *Storage) SaveFileTransferChunks(transferID string, progress int, receivedChunks []byte, bytesReceived int64) error {
+	_, err := s.db.Exec(`
+		UPDATE file_transfers SET progress = ?, received_chunks = ?, bytes_received = ?
+		WHERE transfer_id = ?
+	`, progress, receivedChunks, bytesReceived, transferID)
+	return err
+}
+
+// GetFileTransferChunks returns the received chunks bitset and bytes written
+// of an incoming transfer. The bitset is nil if none was saved
+func (s *Storage) GetFileTransferChunks(transferID string) ([]byte, int64, error) {
+	var receivedChunks []byte
+	var bytesReceived int64
+	err := s.db.QueryRow(`
+		SELECT received_chunks, bytes_received FROM file_transfers
+		WHERE transfer_id = ?
+	`, transferID).Scan(&receivedChunks, &bytesReceived)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return receivedChunks, bytesReceived, nil
+}
+
+// ClearFileTransferChunks drops the saved chunks of a finished transfer
+func (s *Storage) ClearFileTransferChunks(transferID string) error {
+	_, err := s.db.Exec(`
+		UPDATE file_transfers SET received_chunks = NULL
+		WHERE transfer_id = ?
+	`, transferID)
+	return err
+}
+
 // GetFileTransfer returns transfer information by ID
 func (s *Storage) GetFileTransfer(transferID string) (peerID router.PeerID, fileName string, fileSize int64, filePath string, isOutgoing bool, status string, progress int, err error) {
 	var hexID string
@@ -473,19 +1113,20 @@ func (s *Storage) GetFileTransfer(transferID string) (peerID router.PeerID, file
 
 // GetFileTransfers returns list of transfers for contact
 func (s *Storage) GetFileTransfers(peerID router.PeerID, limit int) ([]struct {
-	TransferID  string
-	FileName    string
-	FileSize    int64
-	IsOutgoing  bool
-	Status      string
-	Progress    int
-	StartedAt   time.Time
-	CompletedAt *time.Time
+	TransferID     string
+	FileName       string
+	FileSize       int64
+	IsOutgoing     bool
+	Status         string
+	Progress       int
+	StartedAt      time.Time
+	CompletedAt    *time.Time
+	AvgBytesPerSec float64 // Average rate of a completed transfer, 0 if unknown
 }, error) {
 	hexID := hex.EncodeToString(peerID[:])
 
 	rows, err := s.db.Query(`
-		SELECT transfer_id, file_name, file_size, is_outgoing, status, progress, started_at, completed_at
+		SELECT transfer_id, file_name, file_size, is_outgoing, status, progress, started_at, completed_at, avg_bytes_per_sec
 		FROM file_transfers
 		WHERE peer_id = ?
 		ORDER BY started_at DESC
@@ -497,32 +1138,34 @@ func (s *Storage) GetFileTransfers(peerID router.PeerID, limit int) ([]struct {
 	defer rows.Close()
 
 	var transfers []struct {
-		TransferID  string
-		FileName    string
-		FileSize    int64
-		IsOutgoing  bool
-		Status      string
-		Progress    int
-		StartedAt   time.Time
-		CompletedAt *time.Time
+		TransferID     string
+		FileName       string
+		FileSize       int64
+		IsOutgoing     bool
+		Status         string
+		Progress       int
+		StartedAt      time.Time
+		CompletedAt    *time.Time
+		AvgBytesPerSec float64
 	}
 
 	for rows.Next() {
 		var t struct {
-			TransferID  string
-			FileName    string
-			FileSize    int64
-			IsOutgoing  bool
-			Status      string
-			Progress    int
-			StartedAt   time.Time
-			CompletedAt *time.Time
+			TransferID     string
+			FileName       string
+			FileSize       int64
+			IsOutgoing     bool
+			Status         string
+			Progress       int
+			StartedAt      time.Time
+			CompletedAt    *time.Time
+			AvgBytesPerSec float64
 		}
 		var isOut int
 		var startedAt int64
 		var completedAt sql.NullInt64
 
-		if err := rows.Scan(&t.TransferID, &t.FileName, &t.FileSize, &isOut, &t.Status, &t.Progress, &startedAt, &completedAt); err != nil {
+		if err := rows.Scan(&t.TransferID, &t.FileName, &t.FileSize, &isOut, &t.Status, &t.Progress, &startedAt, &completedAt, &t.AvgBytesPerSec); err != nil {
 			return nil, err
 		}
 
@@ -556,7 +1199,7 @@ func (s *Storage) SearchMessages(query string, limit int) ([]*SearchResult, erro
 			c.name
 		FROM messages m
 		JOIN contacts c ON m.peer_id = c.peer_id
-		WHERE m.content LIKE ? COLLATE NOCASE
+		WHERE m.content LIKE ? COLLATE NOCASE AND m.deleted_at IS NULL
 		ORDER BY m.timestamp DESC
 		LIMIT ?
 	`, searchPattern, limit)
@@ -0,0 +1,602 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+func newTestStorage(t testing.TB) *Storage {
+	t.Helper()
+
+	s, err := NewStorage(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestGetLastMessages(t *testing.T) {
+	s := newTestStorage(t)
+
+	alice, bob, carol := router.PeerID{1}, router.PeerID{2}, router.PeerID{3}
+	for _, id := range []router.PeerID{alice, bob, carol} {
+		if err := s.AddContact(id, fmt.Sprintf("peer-%d", id[0])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	for i, content := range []string{"first", "second", "third"} {
+		if err := s.SaveMessage(&Message{PeerID: alice, Content: content, Timestamp: now.Add(time.Duration(i) * time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Same timestamp: the later insert wins
+	for _, content := range []string{"older", "newer"} {
+		if err := s.SaveMessage(&Message{PeerID: bob, Content: content, Timestamp: now, IsOutgoing: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, err := s.GetLastMessage(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg == nil || msg.Content != "third" || msg.PeerID != alice {
+		t.Fatalf("Unexpected last message for alice: %+v", msg)
+	}
+
+	msg, err = s.GetLastMessage(carol)
+	if err != nil || msg != nil {
+		t.Fatalf("Expected no message for carol, got %+v, %v", msg, err)
+	}
+
+	last, err := s.GetLastMessages([]router.PeerID{alice, bob, carol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(last) != 2 || last[alice].Content != "third" || last[bob].Content != "newer" || !last[bob].IsOutgoing {
+		t.Fatalf("Unexpected last messages: %+v", last)
+	}
+
+	contacts, err := s.GetAllContacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range contacts {
+		switch c.PeerID {
+		case alice, bob:
+			if c.LastMessage == nil || c.LastMessage.ID != last[c.PeerID].ID {
+				t.Errorf("Contact %s: unexpected LastMessage %+v", c.Name, c.LastMessage)
+			}
+		case carol:
+			if c.LastMessage != nil {
+				t.Errorf("Contact %s: expected no LastMessage, got %+v", c.Name, c.LastMessage)
+			}
+		}
+	}
+}
+
+func TestGetLastMessagesBatches(t *testing.T) {
+	s := newTestStorage(t)
+
+	peerIDs := make([]router.PeerID, lastMessagesBatch+10)
+	for i := range peerIDs {
+		peerIDs[i] = router.PeerID{byte(i >> 8), byte(i)}
+		if err := s.SaveMessage(&Message{PeerID: peerIDs[i], Content: fmt.Sprint(i), Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	last, err := s.GetLastMessages(peerIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(last) != len(peerIDs) {
+		t.Fatalf("Expected %d messages, got %d", len(peerIDs), len(last))
+	}
+	if msg := last[peerIDs[len(peerIDs)-1]]; msg == nil || msg.Content != fmt.Sprint(len(peerIDs)-1) {
+		t.Fatalf("Unexpected message for last peer: %+v", msg)
+	}
+}
+
+func TestSaveMessageDedup(t *testing.T) {
+	s := newTestStorage(t)
+
+	peer := router.PeerID{1}
+	if err := s.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1000, 0)
+	if err := s.SaveMessage(&Message{PeerID: peer, Content: "hi", Timestamp: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A retransmit within the same second is skipped
+	err := s.SaveMessage(&Message{PeerID: peer, Content: "hi", Timestamp: now.Add(500 * time.Millisecond)})
+	if !errors.Is(err, ErrDuplicateMessage) {
+		t.Fatalf("Expected ErrDuplicateMessage, got %v", err)
+	}
+
+	// A later second, another group member and outgoing messages are new
+	for _, msg := range []*Message{
+		{PeerID: peer, Content: "hi", Timestamp: now.Add(time.Second)},
+		{PeerID: peer, Content: "hi", Timestamp: now, SenderID: router.PeerID{2}},
+		{PeerID: peer, Content: "hi", Timestamp: now, IsOutgoing: true},
+		{PeerID: peer, Content: "hi", Timestamp: now, IsOutgoing: true},
+	} {
+		if err := s.SaveMessage(msg); err != nil {
+			t.Fatalf("Unexpected error for %+v: %v", msg, err)
+		}
+	}
+
+	messages, err := s.GetMessages(peer, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 5 {
+		t.Fatalf("Expected 5 messages, got %d", len(messages))
+	}
+}
+
+func TestEditMessage(t *testing.T) {
+	s := newTestStorage(t)
+
+	peer := router.PeerID{1}
+	if err := s.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &Message{PeerID: peer, Content: "helo", Timestamp: time.Now()}
+	if err := s.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ContentHash != MessageContentHash("helo") {
+		t.Fatalf("Unexpected content hash %q", msg.ContentHash)
+	}
+
+	for _, content := range []string{"hello", "hello!"} {
+		if err := s.EditMessage(msg.ID, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The original hash still finds the edited message
+	edited, err := s.GetMessageByHash(peer, MessageContentHash("helo"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.ID != msg.ID || edited.Content != "hello!" || !edited.IsEdited() {
+		t.Fatalf("Unexpected edited message: %+v", edited)
+	}
+	if _, err := s.GetMessageByHash(peer, MessageContentHash("helo"), true); err != sql.ErrNoRows {
+		t.Fatalf("Expected no outgoing message with the hash, got %v", err)
+	}
+
+	edits, err := s.GetMessageEdits(msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 2 || edits[0].OldContent != "helo" || edits[1].OldContent != "hello" {
+		t.Fatalf("Unexpected edit history: %+v", edits)
+	}
+
+	if err := s.EditMessage(msg.ID, ""); err == nil {
+		t.Fatal("Expected error for empty content")
+	}
+	if err := s.EditMessage(msg.ID+100, "missing"); err == nil {
+		t.Fatal("Expected error for unknown message")
+	}
+
+	if err := s.DeleteContact(peer); err != nil {
+		t.Fatal(err)
+	}
+	if edits, err := s.GetMessageEdits(msg.ID); err != nil || len(edits) != 0 {
+		t.Fatalf("Expected edit history to be deleted, got %d edits, %v", len(edits), err)
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	s := newTestStorage(t)
+
+	peer := router.PeerID{1}
+	if err := s.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	kept := &Message{PeerID: peer, Content: "keep me", Timestamp: now}
+	deleted := &Message{PeerID: peer, Content: "delete me", Timestamp: now.Add(time.Second)}
+	for _, msg := range []*Message{kept, deleted} {
+		if err := s.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.EditMessage(deleted.ID, "delete me!"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeleteMessage(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteMessage(deleted.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("Expected sql.ErrNoRows deleting twice, got %v", err)
+	}
+
+	messages, err := s.GetMessages(peer, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID != kept.ID {
+		t.Fatalf("Expected only the kept message, got %+v", messages)
+	}
+	if last, err := s.GetLastMessage(peer); err != nil || last.ID != kept.ID {
+		t.Fatalf("Expected kept message as last, got %+v, %v", last, err)
+	}
+	if _, err := s.GetMessage(deleted.ID); err != sql.ErrNoRows {
+		t.Fatalf("Expected deleted message to be hidden, got %v", err)
+	}
+	if _, err := s.GetMessageByHash(peer, deleted.ContentHash, false); err != sql.ErrNoRows {
+		t.Fatalf("Expected deleted message to be hidden by hash, got %v", err)
+	}
+	if results, err := s.SearchMessages("delete", 10); err != nil || len(results) != 0 {
+		t.Fatalf("Expected deleted message to be excluded from search, got %d results, %v", len(results), err)
+	}
+
+	// Recently deleted messages survive the purge
+	if err := s.PurgeDeletedMessages(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&count); err != nil || count != 2 {
+		t.Fatalf("Expected 2 stored messages, got %d, %v", count, err)
+	}
+
+	if err := s.PurgeDeletedMessages(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&count); err != nil || count != 1 {
+		t.Fatalf("Expected 1 stored message after purge, got %d, %v", count, err)
+	}
+	if edits, err := s.GetMessageEdits(deleted.ID); err != nil || len(edits) != 0 {
+		t.Fatalf("Expected edit history to be purged, got %d edits, %v", len(edits), err)
+	}
+}
+
+func TestPurgeOldMessages(t *testing.T) {
+	s := newTestStorage(t)
+
+	peer := router.PeerID{1}
+	if err := s.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	old := &Message{PeerID: peer, Content: "old", Timestamp: now.Add(-100 * 24 * time.Hour)}
+	recent := &Message{PeerID: peer, Content: "recent", Timestamp: now.Add(-time.Hour)}
+	for _, msg := range []*Message{old, recent} {
+		if err := s.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.EditMessage(old.ID, "old!"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Finished transfers go with old messages, unfinished ones can resume
+	for id, status := range map[string]FileTransferStatus{
+		"completed": FileTransferCompleted,
+		"failed":    FileTransferFailed,
+		"pending":   FileTransferPending,
+	} {
+		if err := s.SaveFileTransfer(id, peer, id+".txt", 1, "", false, string(status)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.db.Exec(`UPDATE file_transfers SET started_at = ?`, old.Timestamp.Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveFileTransfer("new", peer, "new.txt", 1, "", false, string(FileTransferCompleted)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.PurgeOldMessages(0); err == nil {
+		t.Fatal("Expected error for zero age")
+	}
+	deleted, err := s.PurgeOldMessages(90 * 24 * time.Hour)
+	if err != nil || deleted != 1 {
+		t.Fatalf("Expected 1 purged message, got %d, %v", deleted, err)
+	}
+
+	messages, err := s.GetMessages(peer, 10)
+	if err != nil || len(messages) != 1 || messages[0].ID != recent.ID {
+		t.Fatalf("Expected only the recent message, got %+v, %v", messages, err)
+	}
+	if edits, err := s.GetMessageEdits(old.ID); err != nil || len(edits) != 0 {
+		t.Fatalf("Expected edit history to be purged, got %d edits, %v", len(edits), err)
+	}
+	rows, err := s.db.Query(`SELECT transfer_id FROM file_transfers ORDER BY transfer_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var transfers []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		transfers = append(transfers, id)
+	}
+	if !slices.Equal(transfers, []string{"new", "pending"}) {
+		t.Fatalf("Expected new and pending transfers to be kept, got %v", transfers)
+	}
+
+	if deleted, err := s.PurgeOldMessages(90 * 24 * time.Hour); err != nil || deleted != 0 {
+		t.Fatalf("Expected nothing to purge twice, got %d, %v", deleted, err)
+	}
+}
+
+func TestMarkAsRead(t *testing.T) {
+	s := newTestStorage(t)
+
+	peer := router.PeerID{1}
+	if err := s.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	incoming := &Message{PeerID: peer, Content: "ping", Timestamp: now}
+	deleted := &Message{PeerID: peer, Content: "gone", Timestamp: now}
+	outgoing := &Message{PeerID: peer, Content: "pong", Timestamp: now, IsOutgoing: true}
+	for _, msg := range []*Message{incoming, deleted, outgoing} {
+		if err := s.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteMessage(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only visible incoming messages are reported for read receipts
+	hashes, err := s.MarkAsRead(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 || hashes[0] != incoming.ContentHash {
+		t.Fatalf("Expected hash of the incoming message, got %v", hashes)
+	}
+	if hashes, err := s.MarkAsRead(peer); err != nil || len(hashes) != 0 {
+		t.Fatalf("Expected nothing to mark the second time, got %v, %v", hashes, err)
+	}
+	if msg, err := s.GetMessage(incoming.ID); err != nil || !msg.IsRead || msg.ReadAt == nil {
+		t.Fatalf("Expected incoming message to be read, got %+v, %v", msg, err)
+	}
+	if msg, err := s.GetMessage(outgoing.ID); err != nil || msg.IsRead || msg.ReadAt != nil {
+		t.Fatalf("Expected outgoing message to stay unread, got %+v, %v", msg, err)
+	}
+
+	readAt := now.Add(time.Minute).Truncate(time.Second)
+	msgs, err := s.MarkOutgoingRead(peer, []string{outgoing.ContentHash, incoming.ContentHash}, readAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].ID != outgoing.ID || !msgs[0].ReadAt.Equal(readAt) {
+		t.Fatalf("Expected outgoing message read at %v, got %+v", readAt, msgs)
+	}
+	if msgs, err := s.MarkOutgoingRead(peer, []string{outgoing.ContentHash}, readAt); err != nil || len(msgs) != 0 {
+		t.Fatalf("Expected repeated receipt to change nothing, got %+v, %v", msgs, err)
+	}
+}
+
+func TestSaveGroup(t *testing.T) {
+	s := newTestStorage(t)
+
+	group := &Group{ID: router.PeerID{9}, Name: "team", Members: []router.PeerID{{1}, {2}}}
+	if err := s.SaveGroup(group); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetGroup(group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "team" || !slices.Equal(got.Members, group.Members) {
+		t.Fatalf("Unexpected group: %+v", got)
+	}
+	if _, err := s.GetGroup(router.PeerID{8}); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("Expected sql.ErrNoRows for unknown group, got %v", err)
+	}
+
+	// Group messages keep their author
+	msg := &Message{PeerID: group.ID, Content: "hi", Timestamp: time.Now(), SenderID: router.PeerID{2}}
+	if err := s.SaveMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := s.GetMessage(msg.ID); err != nil || saved.SenderID != msg.SenderID {
+		t.Fatalf("Expected sender %x, got %+v, %v", msg.SenderID[:1], saved, err)
+	}
+
+	group.Members = make([]router.PeerID, MaxGroupMembers+1)
+	if err := s.SaveGroup(group); err == nil {
+		t.Fatal("Expected error for too many members")
+	}
+	if groups, err := s.GetGroups(); err != nil || len(groups) != 1 || len(groups[0].Members) != 2 {
+		t.Fatalf("Expected the saved group unchanged, got %+v, %v", groups, err)
+	}
+}
+
+func TestMuteContact(t *testing.T) {
+	s := newTestStorage(t)
+
+	peer := router.PeerID{1}
+	if err := s.AddContact(peer, "peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	until := now.Add(time.Hour).Truncate(time.Second)
+	if err := s.SetMutedUntil(peer, until); err != nil {
+		t.Fatal(err)
+	}
+	contact, err := s.GetContact(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contact.NotificationsBlocked || !contact.MutedUntil.Equal(until) {
+		t.Fatalf("Expected contact muted until %v, got %+v", until, contact)
+	}
+	if !contact.IsMuted(now) || contact.IsMuted(until) {
+		t.Fatal("Expected mute to end at MutedUntil")
+	}
+
+	// Unmuting clears the end time as well
+	if err := s.SetNotificationsBlocked(peer, false); err != nil {
+		t.Fatal(err)
+	}
+	contacts, err := s.GetAllContacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0].IsMuted(now) || !contacts[0].MutedUntil.IsZero() {
+		t.Fatalf("Expected contact unmuted, got %+v", contacts)
+	}
+
+	if err := s.SetMutedUntil(peer, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if contact, err := s.GetContact(peer); err != nil || !contact.IsMuted(now.Add(24*time.Hour)) {
+		t.Fatalf("Expected indefinite mute, got %+v, %v", contact, err)
+	}
+}
+
+func TestContactSortOrders(t *testing.T) {
+	s := newTestStorage(t)
+
+	alice, bob, carol := router.PeerID{1}, router.PeerID{2}, router.PeerID{3}
+	for peer, name := range map[router.PeerID]string{alice: "alice", bob: "Bob", carol: "carol"} {
+		if err := s.AddContact(peer, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Bob wrote last, alice before him, carol never; a deleted message doesn't count
+	now := time.Now()
+	deleted := &Message{PeerID: alice, Content: "oops", Timestamp: now}
+	for _, msg := range []*Message{
+		{PeerID: alice, Content: "hi", Timestamp: now.Add(-time.Hour)},
+		{PeerID: bob, Content: "hey", Timestamp: now.Add(-time.Minute)},
+		deleted,
+	} {
+		if err := s.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteMessage(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(contacts []*Contact, err error) []string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, contact := range contacts {
+			out = append(out, contact.Name)
+		}
+		return out
+	}
+	if got := names(s.GetRecentContacts(0)); !slices.Equal(got, []string{"Bob", "alice", "carol"}) {
+		t.Errorf("Unexpected recent order: %v", got)
+	}
+	if got := names(s.GetRecentContacts(1)); !slices.Equal(got, []string{"Bob"}) {
+		t.Errorf("Unexpected limited recent order: %v", got)
+	}
+	if got := names(s.GetContactsSortedByName(true)); !slices.Equal(got, []string{"alice", "Bob", "carol"}) {
+		t.Errorf("Unexpected name order: %v", got)
+	}
+	if got := names(s.GetContactsSortedByName(false)); !slices.Equal(got, []string{"carol", "Bob", "alice"}) {
+		t.Errorf("Unexpected reverse name order: %v", got)
+	}
+}
+
+func TestCountMessages(t *testing.T) {
+	s := newTestStorage(t)
+
+	alice, bob := router.PeerID{1}, router.PeerID{2}
+	for _, id := range []router.PeerID{alice, bob} {
+		if err := s.AddContact(id, fmt.Sprintf("peer-%d", id[0])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	for i := range 3 {
+		if err := s.SaveMessage(&Message{PeerID: alice, Content: fmt.Sprint(i), Timestamp: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := &Message{PeerID: bob, Content: "deleted", Timestamp: now}
+	for _, msg := range []*Message{{PeerID: bob, Content: "kept", Timestamp: now}, deleted} {
+		if err := s.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteMessage(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveFileTransfer("transfer", alice, "file.txt", 10, "/tmp/file.txt", true, "pending"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		peer router.PeerID
+		want int
+	}{{alice, 3}, {bob, 1}, {router.PeerID{3}, 0}} {
+		if count, err := s.CountMessages(tt.peer); err != nil || count != tt.want {
+			t.Errorf("Peer %d: expected %d messages, got %d, %v", tt.peer[0], tt.want, count, err)
+		}
+	}
+	if count, err := s.CountAllMessages(); err != nil || count != 4 {
+		t.Errorf("Expected 4 messages in total, got %d, %v", count, err)
+	}
+
+	stats, err := s.GetStorageStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalMessages != 4 || stats.TotalContacts != 2 || stats.TotalFileTransfers != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if stats.DBSizeBytes <= 0 {
+		t.Fatalf("Expected positive database size, got %d", stats.DBSizeBytes)
+	}
+}
+
+func TestSaveFileTransferRate(t *testing.T) {
+	s := newTestStorage(t)
+	peer := router.PeerID{1}
+
+	if err := s.SaveFileTransfer("transfer", peer, "file.txt", 10, "/tmp/file.txt", true, string(FileTransferCompleted)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveFileTransferRate("transfer", 2.5*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+
+	transfers, err := s.GetFileTransfers(peer, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transfers) != 1 || transfers[0].AvgBytesPerSec != 2.5*1024*1024 {
+		t.Fatalf("Expected the saved rate, got %+v", transfers)
+	}
+}
@@ -1,15 +1,23 @@
 package chat
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/textarea"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/udisondev/sendy/p2p"
 	"github.com/udisondev/sendy/router"
 )
 
@@ -34,6 +42,13 @@ const (
 	viewFilePicker
 	viewSearch
 	viewSearchContacts
+	viewStats
+	viewCreateGroup
+	viewSafetyNumber
+	viewTransfers
+	viewConnectionRequest
+	viewContactMenu
+	viewFileOffer
 )
 
 // model represents TUI state
@@ -50,6 +65,7 @@ type model struct {
 	addContactInput     textarea.Model
 	renameInput         textarea.Model
 	filePicker          *FilePickerModel
+	pendingSend         tea.Cmd // Sends the files picked in the file picker
 	searchInput         textarea.Model
 	searchResults       []*SearchResult
 	selectedSearchResult int
@@ -57,6 +73,7 @@ type model struct {
 	filteredContacts    []*Contact
 	selectedFilteredContact int
 	jumpToMessageID     int64  // Message ID to scroll to after loading
+	unreadMarkID        int64  // Message marked with ">" after jumping to it with "u"
 	width               int
 	height              int
 	ready               bool
@@ -65,6 +82,56 @@ type model struct {
 	contactsWidth       int
 	contactToDelete     router.PeerID
 	contactToDeleteName string
+	typingPeers         map[router.PeerID]bool
+	connectResult       <-chan error       // Pending connection attempt started with "c"
+	connectCancel       context.CancelFunc // Aborts the pending attempt
+	groupMembers        map[router.PeerID]bool // Contacts marked with space for a new group
+	groupNameInput      textarea.Model
+	safetyContact       *Contact // Contact shown in viewSafetyNumber
+	safetyNumber        string
+	selectedTransfer    int // Row in viewTransfers
+	sortOrder           SortOrder               // Contact list order, cycled with "s"
+	saveSortOrder       func(SortOrder) error // Persists sortOrder, may be nil
+	saveContactsWidth   func(int) error       // Persists contactsWidth, may be nil
+	connectionRequests  []router.PeerID       // Strangers waiting for approval, oldest first
+	discoveredPeer      router.PeerID         // Stranger found on the local network, prefilled by "a"
+	selectedMenuItem    int                   // Row in viewContactMenu
+	fileOffers          []*FileTransfer       // Incoming files waiting for y/n, oldest first
+	selectingMessage    bool                  // Message selection in the messages panel, entered with "v"
+	selectedMessage     int                   // Index in messages while selectingMessage
+}
+
+// Contacts panel width in columns, changed with "<" and ">"
+const (
+	DefaultContactsWidth = 30
+	MinContactsWidth     = 15 // Fits the status dot and a 10 character name
+	MaxContactsWidth     = 60
+
+	contactsWidthStep = 2
+	minContactNameLen = 10
+)
+
+// clampContactsWidth limits a contacts panel width to MinContactsWidth and
+// MaxContactsWidth
+func clampContactsWidth(width int) int {
+	return min(max(width, MinContactsWidth), MaxContactsWidth)
+}
+
+// TUIOptions configures the TUI
+type TUIOptions struct {
+	SortOrder SortOrder // Initial contact list order
+	// SaveSortOrder is called when the user changes the order, nil keeps
+	// the change for the session only
+	SaveSortOrder func(SortOrder) error
+	// ContactsWidth is the initial contacts panel width, DefaultContactsWidth
+	// if zero
+	ContactsWidth int
+	// SaveContactsWidth is called when the user resizes the contacts panel,
+	// nil keeps the change for the session only
+	SaveContactsWidth func(int) error
+	// NoMouse leaves the mouse to the terminal, for terminals that
+	// intercept mouse events or to keep native text selection
+	NoMouse bool
 }
 
 // Styles
@@ -98,6 +165,12 @@ var (
 	offlineStyle = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("8"))
 
+	reconnectingStyle = lipgloss.NewStyle().
+				Foreground(lipgloss.Color("11"))
+
+	groupStyle = lipgloss.NewStyle().
+			Foreground(lipgloss.Color("13"))
+
 	// Messages
 	messageOutgoingStyle = lipgloss.NewStyle().
 				Foreground(lipgloss.Color("12"))
@@ -105,9 +178,23 @@ var (
 	messageIncomingStyle = lipgloss.NewStyle().
 				Foreground(lipgloss.Color("10"))
 
+	selectedMessageStyle = lipgloss.NewStyle().
+				Background(lipgloss.Color("62")).
+				Foreground(lipgloss.Color("230"))
+
 	messageTimeStyle = lipgloss.NewStyle().
 				Foreground(lipgloss.Color("8"))
 
+	readReceiptStyle = lipgloss.NewStyle().
+				Foreground(lipgloss.Color("14"))
+
+	deliveryStyle = lipgloss.NewStyle().
+			Foreground(lipgloss.Color("8"))
+
+	deliveryFailedStyle = lipgloss.NewStyle().
+				Bold(true).
+				Foreground(lipgloss.Color("9"))
+
 	// Header
 	headerStyle = lipgloss.NewStyle().
 			Bold(true).
@@ -126,7 +213,7 @@ var (
 )
 
 // NewTUI creates a new TUI model
-func NewTUI(chat *Chat, myID router.PeerID) *model {
+func NewTUI(chat *Chat, myID router.PeerID, opts TUIOptions) *model {
 	ta := textarea.New()
 	ta.Placeholder = "Type a message... (Ctrl+S to send)"
 	ta.Prompt = "│ "
@@ -154,6 +241,14 @@ func NewTUI(chat *Chat, myID router.PeerID) *model {
 	renameInput.SetHeight(1)
 	renameInput.ShowLineNumbers = false
 
+	groupNameInput := textarea.New()
+	groupNameInput.Placeholder = "Enter group name..."
+	groupNameInput.Prompt = "> "
+	groupNameInput.CharLimit = 50
+	groupNameInput.SetWidth(50)
+	groupNameInput.SetHeight(1)
+	groupNameInput.ShowLineNumbers = false
+
 	searchInput := textarea.New()
 	searchInput.Placeholder = "Search messages..."
 	searchInput.Prompt = "> "
@@ -181,15 +276,65 @@ func NewTUI(chat *Chat, myID router.PeerID) *model {
 		textarea:           ta,
 		addContactInput:    addInput,
 		renameInput:        renameInput,
+		groupNameInput:     groupNameInput,
 		searchInput:        searchInput,
 		searchContactInput: searchContactInput,
 		viewport:           vp,
-		contactsWidth:      30, // Default width for contacts panel
+		contactsWidth:      DefaultContactsWidth,
+		sortOrder:          opts.SortOrder,
+		saveSortOrder:      opts.SaveSortOrder,
+		saveContactsWidth:  opts.SaveContactsWidth,
+	}
+	if opts.ContactsWidth != 0 {
+		m.contactsWidth = clampContactsWidth(opts.ContactsWidth)
 	}
 
 	return m
 }
 
+// layout sizes the message viewport and the input to the space the
+// contacts panel leaves
+func (m *model) layout() {
+	// Chat area width (minus contacts panel and borders)
+	chatWidth := m.width - m.contactsWidth - 4
+
+	if !m.ready {
+		m.viewport = viewport.New(chatWidth-4, m.height-11) // Adjusted for new layout
+		m.viewport.YPosition = 0
+		m.textarea.SetWidth(chatWidth - 4)
+		m.ready = true
+	} else {
+		m.viewport.Width = chatWidth - 4
+		m.viewport.Height = m.height - 11
+		m.textarea.SetWidth(chatWidth - 4)
+	}
+}
+
+// resizeContacts widens or narrows the contacts panel by delta columns and
+// saves the new width. The panel never takes more than half of the screen
+func (m *model) resizeContacts(delta int) {
+	width := clampContactsWidth(m.contactsWidth + delta)
+	if delta > 0 && width > m.width/2 {
+		width = m.contactsWidth
+	}
+	if width == m.contactsWidth {
+		return
+	}
+
+	m.contactsWidth = width
+	if m.ready {
+		m.layout()
+		m.updateViewport()
+	}
+	m.statusMsg = fmt.Sprintf("Contacts panel width: %d", width)
+	m.error = ""
+	if m.saveContactsWidth != nil {
+		if err := m.saveContactsWidth(width); err != nil {
+			m.error = fmt.Sprintf("Failed to save contacts width: %v", err)
+		}
+	}
+}
+
 // Init initializes TUI
 func (m *model) Init() tea.Cmd {
 	return tea.Batch(
@@ -207,20 +352,7 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.WindowSizeMsg:
 		m.width = msg.Width
 		m.height = msg.Height
-
-		// Chat area width (minus contacts panel and borders)
-		chatWidth := msg.Width - m.contactsWidth - 4
-
-		if !m.ready {
-			m.viewport = viewport.New(chatWidth-4, msg.Height-11) // Adjusted for new layout
-			m.viewport.YPosition = 0
-			m.textarea.SetWidth(chatWidth - 4)
-			m.ready = true
-		} else {
-			m.viewport.Width = chatWidth - 4
-			m.viewport.Height = msg.Height - 11
-			m.textarea.SetWidth(chatWidth - 4)
-		}
+		m.layout()
 
 	case tea.KeyMsg:
 		switch m.mode {
@@ -240,29 +372,111 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m.updateSearchView(msg)
 		case viewSearchContacts:
 			return m.updateSearchContactsView(msg)
+		case viewStats:
+			return m.updateStatsView(msg)
+		case viewCreateGroup:
+			return m.updateCreateGroupView(msg)
+		case viewSafetyNumber:
+			return m.updateSafetyNumberView(msg)
+		case viewTransfers:
+			return m.updateTransfersView(msg)
+		case viewConnectionRequest:
+			return m.updateConnectionRequestView(msg)
+		case viewContactMenu:
+			return m.updateContactMenuView(msg)
+		case viewFileOffer:
+			return m.updateFileOfferView(msg)
 		}
 
+	case tea.MouseMsg:
+		return m.handleMouse(msg)
+
 	case contactsLoadedMsg:
+		// Keep the selection on the same contact when the order changes
+		var selected router.PeerID
+		hadSelection := len(m.contacts) > 0 && m.selectedContact < len(m.contacts)
+		if hadSelection {
+			selected = m.contacts[m.selectedContact].PeerID
+		}
 		m.contacts = msg.contacts
+		if hadSelection {
+			for i, contact := range m.contacts {
+				if contact.PeerID == selected {
+					m.selectedContact = i
+					break
+				}
+			}
+		}
 		if len(m.contacts) > 0 && m.selectedContact >= len(m.contacts) {
 			m.selectedContact = len(m.contacts) - 1
 		}
 
 	case messagesLoadedMsg:
 		m.messages = msg.messages
+		if m.selectingMessage {
+			m.selectedMessage = min(m.selectedMessage, len(m.messages)-1)
+			m.selectingMessage = m.selectedMessage >= 0
+		}
 		m.updateViewport()
 
 	case chatEventMsg:
 		return m.handleChatEvent(msg.event)
 
+	case statsTickMsg:
+		// Re-render with fresh counters while the overlay is open
+		if m.mode == viewStats || m.mode == viewTransfers {
+			return m, statsTick()
+		}
+
 	case statusMsg:
 		m.statusMsg = string(msg)
 		m.error = ""
 
+	case statusExpiredMsg:
+		// A newer status stays
+		if m.statusMsg == string(msg) {
+			m.statusMsg = ""
+		}
+
+	case unreadMarkExpiredMsg:
+		if m.unreadMarkID == msg.id {
+			m.unreadMarkID = 0
+			offset := m.viewport.YOffset
+			m.updateViewport()
+			m.viewport.SetYOffset(offset)
+		}
+
 	case errorMsg:
 		m.error = string(msg)
 		m.statusMsg = ""
 
+	case messageSentMsg:
+		if msg.err != nil {
+			m.error = msg.err.Error()
+			m.statusMsg = ""
+			return m, nil
+		}
+		m.statusMsg = ""
+		// Keep what was typed while the message waited for the connection
+		if strings.TrimSpace(m.textarea.Value()) == msg.content {
+			m.textarea.Reset()
+		}
+		return m, m.loadMessages
+
+	case connectResultMsg:
+		if msg.result != m.connectResult {
+			return m, nil
+		}
+		m.connectCancel()
+		m.connectResult, m.connectCancel = nil, nil
+		switch {
+		case errors.Is(msg.err, context.Canceled):
+			m.statusMsg = "Connection cancelled"
+		case msg.err != nil:
+			m.error = fmt.Sprintf("Connection failed: %v", msg.err)
+			m.statusMsg = ""
+		}
+
 	case fileSelectedMsg:
 		// Result from fzf file picker
 		if msg.err != nil {
@@ -275,8 +489,8 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 
-		// Read selected file
-		filePath, err := ReadFzfResult(msg.startDir)
+		// Read selected files
+		paths, err := ReadFzfResult(msg.startDir)
 		if err != nil {
 			if err.Error() != "cancelled" {
 				m.error = fmt.Sprintf("Failed to read selection: %v", err)
@@ -284,14 +498,11 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 
-		// Send file to selected contact
+		// Send files to selected contact
 		if len(m.contacts) > 0 {
 			contact := m.contacts[m.selectedContact]
-			if err := m.chat.SendFile(contact.PeerID, filePath); err != nil {
-				m.error = fmt.Sprintf("Failed to send file: %v", err)
-			} else {
-				m.statusMsg = "Sending file..."
-			}
+			m.statusMsg = sendingStatus(paths)
+			return m, m.sendPaths(contact.PeerID, paths)
 		}
 		return m, nil
 	}
@@ -322,6 +533,20 @@ func (m *model) View() string {
 		return m.viewSearch()
 	case viewSearchContacts:
 		return m.viewSearchContacts()
+	case viewStats:
+		return m.viewStats()
+	case viewCreateGroup:
+		return m.viewCreateGroup()
+	case viewSafetyNumber:
+		return m.viewSafetyNumber()
+	case viewTransfers:
+		return m.viewTransfers()
+	case viewConnectionRequest:
+		return m.viewConnectionRequest()
+	case viewContactMenu:
+		return m.viewContactMenu()
+	case viewFileOffer:
+		return m.viewFileOffer()
 	}
 
 	return ""
@@ -369,10 +594,7 @@ func (m *model) renderContactsPanel() string {
 				style = selectedContactStyle
 			}
 
-			status := offlineStyle.Render("●")
-			if m.chat.IsOnline(contact.PeerID) {
-				status = onlineStyle.Render("●")
-			}
+			status := contactStatusDot(m.chat, contact)
 
 			unread, _ := m.chat.GetUnreadCount(contact.PeerID)
 			unreadStr := ""
@@ -384,10 +606,19 @@ func (m *model) renderContactsPanel() string {
 			if contact.IsBlocked {
 				blocked = " [X]"
 			}
+			if contact.IsMuted(time.Now()) {
+				blocked += " 🔇"
+			}
+			if contact.Verified {
+				blocked += " ✓"
+			}
+			if m.groupMembers[contact.PeerID] {
+				blocked += " +"
+			}
 
 			// Truncate name if too long
 			name := contact.Name
-			maxNameLen := m.contactsWidth - 7 // Status + padding
+			maxNameLen := max(m.contactsWidth-7, minContactNameLen) // Status + padding
 			if len(name) > maxNameLen {
 				name = name[:maxNameLen-3] + "..."
 			}
@@ -425,8 +656,23 @@ func (m *model) renderChatPanel() string {
 
 	// Header with contact name and status
 	status := offlineStyle.Render("[Offline]")
-	if m.chat.IsOnline(contact.PeerID) {
+	state := m.chat.PeerState(contact.PeerID)
+	switch {
+	case contact.IsGroup:
+		status = groupStyle.Render("[Group]")
+	case m.chat.IsReconnecting(contact.PeerID):
+		status = reconnectingStyle.Render("[Reconnecting…]")
+	case state == p2p.PeerStateConnecting:
+		status = reconnectingStyle.Render("[Connecting…]")
+	case state == p2p.PeerStateConnected:
 		status = onlineStyle.Render("[Online]")
+		if m.chat.IsRelayed(contact.PeerID) {
+			status += " " + statusBarStyle.Render("[Relayed]")
+		}
+	}
+
+	if contact.Verified {
+		status += " " + onlineStyle.Render("[Verified]")
 	}
 
 	header := fmt.Sprintf("%s %s", contact.Name, status)
@@ -471,9 +717,12 @@ func (m *model) renderStatusBar() string {
 
 	switch m.focus {
 	case focusContacts:
-		helpText = "enter: open chat • ↑/↓: select • /: search contacts • f: send file • a: add • r: rename • d: delete • c: connect • x: disconnect • i: my ID • q: quit"
+		helpText = "enter: open chat • ↑/↓: select • /: search contacts • s: sort • f: send file • space: mark • g: group • a: add • r: rename • d: delete • m: mute • v: verify • c: connect • X: cancel connect • x: disconnect • i: my ID • S: stats • t: transfers • o: incoming files • A: auto-accept • p: requests • P: policy • </>: resize • q: quit"
 	case focusMessages:
-		helpText = "↑/↓: scroll • /: search messages • tab: next panel"
+		helpText = "↑/↓: scroll • u: first unread • v: select message • /: search messages • </>: resize contacts • tab: next panel"
+		if m.selectingMessage {
+			helpText = "↑/↓: select • y: copy • esc: done"
+		}
 	case focusInput:
 		helpText = "enter: send • tab: next panel"
 	}
@@ -482,6 +731,8 @@ func (m *model) renderStatusBar() string {
 
 	if m.error != "" {
 		status = errorStyle.Render("Error: " + m.error)
+	} else if m.activeContactTyping() {
+		status = statusBarStyle.Render("Contact is typing…")
 	} else if m.statusMsg != "" {
 		status = statusBarStyle.Render(m.statusMsg)
 	}
@@ -504,6 +755,10 @@ func (m *model) updateMainView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	case "tab":
 		// Cycle through panels
 		m.focus = (m.focus + 1) % 3
+		if m.selectingMessage {
+			m.selectingMessage = false
+			m.updateViewport()
+		}
 
 		// Update focus states
 		if m.focus == focusInput {
@@ -513,10 +768,24 @@ func (m *model) updateMainView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		}
 		return m, nil
 
+	case "<", ">":
+		if m.focus != focusInput {
+			delta := contactsWidthStep
+			if msg.String() == "<" {
+				delta = -delta
+			}
+			m.resizeContacts(delta)
+			return m, nil
+		}
+
 	case "a":
 		if m.focus == focusContacts {
 			m.mode = viewAddContact
 			m.addContactInput.Reset()
+			if m.discoveredPeer != (router.PeerID{}) {
+				m.addContactInput.SetValue(hex.EncodeToString(m.discoveredPeer[:]))
+				m.discoveredPeer = router.PeerID{}
+			}
 			m.addContactInput.Focus()
 			m.error = ""
 			return m, nil
@@ -529,6 +798,69 @@ func (m *model) updateMainView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 
+	case "S":
+		if m.focus == focusContacts {
+			m.mode = viewStats
+			m.error = ""
+			return m, statsTick()
+		}
+
+	case "t":
+		if m.focus == focusContacts {
+			m.mode = viewTransfers
+			m.selectedTransfer = 0
+			m.error = ""
+			m.statusMsg = ""
+			return m, statsTick()
+		}
+
+	case "p":
+		if m.focus == focusContacts {
+			if len(m.connectionRequests) == 0 {
+				m.statusMsg = "No connection requests"
+				return m, nil
+			}
+			m.mode = viewConnectionRequest
+			m.error = ""
+			return m, nil
+		}
+
+	case "o":
+		if m.focus == focusContacts {
+			if len(m.fileOffers) == 0 {
+				m.statusMsg = "No incoming files"
+				return m, nil
+			}
+			m.mode = viewFileOffer
+			m.error = ""
+			return m, nil
+		}
+
+	case "A":
+		if m.focus == focusContacts {
+			enabled := !m.chat.AutoAcceptFiles()
+			if err := m.chat.SetAutoAcceptFiles(enabled); err != nil {
+				m.error = err.Error()
+				return m, nil
+			}
+			m.statusMsg = "Auto-accept files from verified contacts: off"
+			if enabled {
+				m.statusMsg = "Auto-accept files from verified contacts: on"
+			}
+			return m, nil
+		}
+
+	case "P":
+		if m.focus == focusContacts {
+			mode := (m.chat.ConnectionMode() + 1) % (p2p.ConnectionManual + 1)
+			if err := m.chat.SetConnectionMode(mode); err != nil {
+				m.error = err.Error()
+				return m, nil
+			}
+			m.statusMsg = "Incoming connections: " + connectionModeLabel(mode)
+			return m, nil
+		}
+
 	case "/":
 		if m.focus == focusContacts {
 			// Search contacts
@@ -623,8 +955,43 @@ func (m *model) updateContactsFocus(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 			return m, m.loadMessages
 		}
 
+	case " ":
+		// Mark contact as a member of a new group
+		if len(m.contacts) > 0 {
+			contact := m.contacts[m.selectedContact]
+			if contact.IsGroup {
+				m.error = "Groups cannot be group members"
+				return m, nil
+			}
+			if m.groupMembers == nil {
+				m.groupMembers = make(map[router.PeerID]bool)
+			}
+			if m.groupMembers[contact.PeerID] {
+				delete(m.groupMembers, contact.PeerID)
+			} else {
+				m.groupMembers[contact.PeerID] = true
+			}
+			m.statusMsg = fmt.Sprintf("%d marked for a group (g to create)", len(m.groupMembers))
+			m.error = ""
+		}
+
+	case "g":
+		// Create a group from marked contacts
+		if len(m.groupMembers) == 0 {
+			m.error = "Mark group members with space first"
+			return m, nil
+		}
+		m.mode = viewCreateGroup
+		m.groupNameInput.Reset()
+		m.groupNameInput.Focus()
+		m.error = ""
+		return m, nil
+
 	case "r":
 		// Rename contact
+		if m.selectedIsGroup() {
+			return m, nil
+		}
 		if len(m.contacts) > 0 {
 			m.mode = viewRenameContact
 			contact := m.contacts[m.selectedContact]
@@ -636,6 +1003,9 @@ func (m *model) updateContactsFocus(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 
 	case "d":
 		// Request deletion confirmation
+		if m.selectedIsGroup() {
+			return m, nil
+		}
 		if len(m.contacts) > 0 {
 			contact := m.contacts[m.selectedContact]
 			m.contactToDelete = contact.PeerID
@@ -646,6 +1016,9 @@ func (m *model) updateContactsFocus(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		}
 
 	case "b":
+		if m.selectedIsGroup() {
+			return m, nil
+		}
 		if len(m.contacts) > 0 {
 			contact := m.contacts[m.selectedContact]
 			if contact.IsBlocked {
@@ -665,20 +1038,91 @@ func (m *model) updateContactsFocus(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 			}
 		}
 
+	case "m":
+		// Toggle notifications from selected contact
+		if m.selectedIsGroup() {
+			return m, nil
+		}
+		if len(m.contacts) > 0 {
+			contact := m.contacts[m.selectedContact]
+			if contact.IsMuted(time.Now()) {
+				if err := m.chat.UnmuteContact(contact.PeerID); err != nil {
+					m.error = err.Error()
+				} else {
+					m.statusMsg = "Contact unmuted"
+					return m, m.loadContacts
+				}
+			} else {
+				if err := m.chat.MuteContact(contact.PeerID, time.Time{}); err != nil {
+					m.error = err.Error()
+				} else {
+					m.statusMsg = "Contact muted"
+					return m, m.loadContacts
+				}
+			}
+		}
+
+	case "s":
+		// Cycle contact list order
+		m.sortOrder = m.sortOrder.Next()
+		m.statusMsg = "Contacts sorted by " + sortOrderLabel(m.sortOrder)
+		m.error = ""
+		if m.saveSortOrder != nil {
+			if err := m.saveSortOrder(m.sortOrder); err != nil {
+				m.error = fmt.Sprintf("Failed to save sort order: %v", err)
+			}
+		}
+		return m, m.loadContacts
+
+	case "v":
+		// Show safety number of selected contact
+		if m.selectedIsGroup() {
+			return m, nil
+		}
+		if len(m.contacts) > 0 {
+			contact := m.contacts[m.selectedContact]
+			number, err := m.chat.GetSafetyNumber(contact.PeerID)
+			if err != nil {
+				m.error = err.Error()
+				return m, nil
+			}
+			m.safetyContact = contact
+			m.safetyNumber = number
+			m.mode = viewSafetyNumber
+			m.error = ""
+			return m, nil
+		}
+
 	case "c":
 		// Connect to selected contact
+		if m.selectedIsGroup() {
+			return m, nil
+		}
 		if len(m.contacts) > 0 {
+			if m.connectResult != nil {
+				m.error = "Already connecting, press X to cancel"
+				return m, nil
+			}
 			contact := m.contacts[m.selectedContact]
 			hexID := hex.EncodeToString(contact.PeerID[:])
-			if err := m.chat.Connect(hexID); err != nil {
-				m.error = err.Error()
-			} else {
-				m.statusMsg = "Connecting..."
-			}
+			ctx, cancel := context.WithCancel(context.Background())
+			m.connectResult = m.chat.Connect(ctx, hexID)
+			m.connectCancel = cancel
+			m.statusMsg = "Connecting... (X to cancel)"
+			return m, waitForConnect(m.connectResult)
+		}
+
+	case "X":
+		// Cancel the pending connection attempt
+		if m.connectCancel != nil {
+			m.connectCancel()
 		}
 
 	case "x":
 		// Disconnect from selected contact
+		if m.selectedIsGroup() {
+			return m, nil
+		}
 		if len(m.contacts) > 0 {
 			contact := m.contacts[m.selectedContact]
 			if err := m.chat.Disconnect(contact.PeerID); err != nil {
@@ -690,6 +1134,9 @@ func (m *model) updateContactsFocus(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 
 	case "f":
 		// Open file picker to send file
+		if m.selectedIsGroup() {
+			return m, nil
+		}
 		if len(m.contacts) > 0 {
 			contact := m.contacts[m.selectedContact]
 			if !m.chat.IsOnline(contact.PeerID) {
@@ -705,13 +1152,10 @@ func (m *model) updateContactsFocus(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 			} else {
 				// Fallback to built-in file picker
 				m.filePicker = NewFilePicker("",
-					func(filePath string) {
-						// File selected - send it
-						if err := m.chat.SendFile(contact.PeerID, filePath); err != nil {
-							m.error = fmt.Sprintf("Failed to send file: %v", err)
-						} else {
-							m.statusMsg = "Sending file..."
-						}
+					func(paths []string) {
+						// Files selected - send them
+						m.statusMsg = sendingStatus(paths)
+						m.pendingSend = m.sendPaths(contact.PeerID, paths)
 						m.mode = viewMain
 						m.filePicker = nil
 					},
@@ -730,10 +1174,37 @@ func (m *model) updateContactsFocus(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// selectedIsGroup reports whether the selected conversation is a group and
+// shows an error if so. Contact actions don't apply to groups
+func (m *model) selectedIsGroup() bool {
+	if len(m.contacts) == 0 || !m.contacts[m.selectedContact].IsGroup {
+		return false
+	}
+	m.error = "Not available for groups"
+	m.statusMsg = ""
+	return true
+}
+
 func (m *model) updateMessagesFocus(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
 
+	if m.selectingMessage {
+		return m.updateMessageSelection(msg)
+	}
+
 	switch msg.String() {
+	case "v":
+		if len(m.messages) == 0 {
+			return m, nil
+		}
+		m.selectingMessage = true
+		m.selectedMessage = len(m.messages) - 1
+		m.updateViewport()
+		return m, nil
+
+	case "u":
+		return m, m.jumpToUnread()
+
 	case "up", "k":
 		m.viewport.LineUp(1)
 
@@ -751,6 +1222,63 @@ func (m *model) updateMessagesFocus(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
+// jumpToUnread scrolls to the oldest unread incoming message and marks it
+// with ">" for unreadMarkDuration. Messages keep the read state they had
+// when the conversation was opened
+func (m *model) jumpToUnread() tea.Cmd {
+	for _, msg := range m.messages {
+		if msg.IsOutgoing || msg.IsRead {
+			continue
+		}
+		m.jumpToMessageID = msg.ID
+		m.unreadMarkID = msg.ID
+		m.updateViewport()
+		return tea.Tick(unreadMarkDuration, func(time.Time) tea.Msg {
+			return unreadMarkExpiredMsg{id: msg.ID}
+		})
+	}
+	m.statusMsg = noUnreadStatus
+	m.error = ""
+	return tea.Tick(noUnreadStatusDuration, func(time.Time) tea.Msg {
+		return statusExpiredMsg(noUnreadStatus)
+	})
+}
+
+// updateMessageSelection moves the message selection and copies the
+// selected message with "y"
+func (m *model) updateMessageSelection(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "up", "k":
+		m.selectedMessage = max(m.selectedMessage-1, 0)
+
+	case "down", "j":
+		m.selectedMessage = min(m.selectedMessage+1, len(m.messages)-1)
+
+	case "y":
+		copied, err := copyText(m.messages[m.selectedMessage].Content)
+		switch {
+		case err != nil:
+			m.error = err.Error()
+		case copied:
+			m.statusMsg = "Message copied to clipboard"
+			m.error = ""
+		default:
+			m.statusMsg = "No clipboard (headless terminal?), message printed to stderr"
+			m.error = ""
+		}
+		m.selectingMessage = false
+
+	case "esc":
+		m.selectingMessage = false
+
+	default:
+		return m, nil
+	}
+
+	m.updateViewport()
+	return m, nil
+}
+
 func (m *model) updateInputFocus(msg tea.KeyMsg, cmd tea.Cmd) (tea.Model, tea.Cmd) {
 	switch msg.String() {
 	case "ctrl+s":
@@ -758,10 +1286,21 @@ func (m *model) updateInputFocus(msg tea.KeyMsg, cmd tea.Cmd) (tea.Model, tea.Cm
 			content := strings.TrimSpace(m.textarea.Value())
 			if content != "" {
 				contact := m.contacts[m.selectedContact]
-				if err := m.chat.SendMessage(contact.PeerID, content); err != nil {
+				// Sending to an offline contact waits for the connection,
+				// so it runs outside the update loop
+				if !contact.IsGroup && !m.chat.IsOnline(contact.PeerID) {
+					m.statusMsg = fmt.Sprintf("Connecting to %s...", contact.Name)
+					m.error = ""
+					return m, m.sendMessage(contact.PeerID, content)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), messageSendTimeout)
+				err := m.chat.SendMessage(ctx, contact.PeerID, content)
+				cancel()
+				if err != nil {
 					m.error = err.Error()
 				} else {
 					m.textarea.Reset()
+					m.chat.SendTypingIndicator(contact.PeerID, false)
 					return m, m.loadMessages
 				}
 			}
@@ -769,9 +1308,23 @@ func (m *model) updateInputFocus(msg tea.KeyMsg, cmd tea.Cmd) (tea.Model, tea.Cm
 		return m, nil
 	}
 
+	// Typing indicator follows the input content; Chat rate-limits it
+	if len(m.contacts) > 0 && m.chat.IsOnline(m.contacts[m.selectedContact].PeerID) {
+		typing := strings.TrimSpace(m.textarea.Value()) != ""
+		m.chat.SendTypingIndicator(m.contacts[m.selectedContact].PeerID, typing)
+	}
+
 	return m, cmd
 }
 
+// activeContactTyping reports whether the selected contact is typing
+func (m *model) activeContactTyping() bool {
+	if len(m.contacts) == 0 || m.selectedContact >= len(m.contacts) {
+		return false
+	}
+	return m.typingPeers[m.contacts[m.selectedContact].PeerID]
+}
+
 func (m *model) updateAddContactView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
 
@@ -860,35 +1413,397 @@ func (m *model) updateRenameContactView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
-func (m *model) viewConfirmDelete() string {
+func (m *model) viewCreateGroup() string {
 	var b strings.Builder
 
-	b.WriteString(headerStyle.Render("Delete Contact") + "\n\n")
-	b.WriteString(fmt.Sprintf("  Are you sure you want to delete '%s'?\n\n", m.contactToDeleteName))
-	b.WriteString(errorStyle.Render("  This will delete all messages with this contact!") + "\n\n")
-	b.WriteString(statusBarStyle.Render("  y: yes, delete • n: no, cancel") + "\n")
+	b.WriteString(headerStyle.Render("Create Group") + "\n\n")
+	b.WriteString(fmt.Sprintf("  Members: %d contacts\n\n", len(m.groupMembers)))
+	b.WriteString("  Enter group name:\n\n")
+	b.WriteString("  " + m.groupNameInput.View() + "\n\n")
+	b.WriteString(statusBarStyle.Render("  enter: create • esc: cancel") + "\n")
+
+	if m.error != "" {
+		b.WriteString("\n" + errorStyle.Render(m.error))
+	}
 
 	return b.String()
 }
 
-func (m *model) updateConfirmDeleteView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+func (m *model) updateCreateGroupView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd
+
 	switch msg.String() {
-	case "y", "Y":
-		// Confirmed - delete
-		if err := m.chat.DeleteContact(m.contactToDelete); err != nil {
+	case "esc":
+		m.mode = viewMain
+		m.groupNameInput.Blur()
+		return m, nil
+
+	case "enter":
+		name := strings.TrimSpace(m.groupNameInput.Value())
+		if name == "" {
+			m.error = "Name cannot be empty"
+			return m, nil
+		}
+
+		members := make([]router.PeerID, 0, len(m.groupMembers))
+		for peerID := range m.groupMembers {
+			members = append(members, peerID)
+		}
+		if _, err := m.chat.CreateGroup(name, members); err != nil {
 			m.error = err.Error()
-			m.mode = viewMain
 			return m, nil
 		}
 
 		m.mode = viewMain
-		m.statusMsg = "Contact deleted"
+		m.statusMsg = "Group created"
+		m.groupMembers = nil
+		m.groupNameInput.Blur()
 		return m, m.loadContacts
-
-	case "n", "N", "esc":
-		// Cancelled
-		m.mode = viewMain
-		return m, nil
+	}
+
+	m.groupNameInput, cmd = m.groupNameInput.Update(msg)
+	return m, cmd
+}
+
+func (m *model) viewSafetyNumber() string {
+	var b strings.Builder
+	contact := m.safetyContact
+
+	b.WriteString(headerStyle.Render("Verify "+contact.Name) + "\n\n")
+	b.WriteString("  Compare this number with the one your contact sees,\n")
+	b.WriteString("  in person or over a call:\n\n")
+
+	// 12 groups of 5 digits, 4 groups per line
+	groups := strings.Fields(m.safetyNumber)
+	for i := 0; i < len(groups); i += 4 {
+		b.WriteString("    " + strings.Join(groups[i:min(i+4, len(groups))], " ") + "\n")
+	}
+	b.WriteString("\n")
+
+	if contact.Verified {
+		b.WriteString("  " + onlineStyle.Render("Verified") + "\n\n")
+	} else {
+		b.WriteString("  " + offlineStyle.Render("Not verified") + "\n\n")
+	}
+	b.WriteString(statusBarStyle.Render("  y: numbers match, mark verified • u: clear verification • esc: back") + "\n")
+
+	if m.error != "" {
+		b.WriteString("\n" + errorStyle.Render(m.error))
+	}
+
+	return b.String()
+}
+
+func (m *model) updateSafetyNumberView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	contact := m.safetyContact
+
+	switch msg.String() {
+	case "y", "Y":
+		if err := m.chat.SetContactVerified(contact.PeerID, true); err != nil {
+			m.error = err.Error()
+			return m, nil
+		}
+		m.mode = viewMain
+		m.statusMsg = "Contact verified"
+		return m, m.loadContacts
+
+	case "u":
+		if err := m.chat.SetContactVerified(contact.PeerID, false); err != nil {
+			m.error = err.Error()
+			return m, nil
+		}
+		m.mode = viewMain
+		m.statusMsg = "Verification cleared"
+		return m, m.loadContacts
+
+	case "esc", "q":
+		m.mode = viewMain
+		m.error = ""
+	}
+
+	return m, nil
+}
+
+func (m *model) viewConnectionRequest() string {
+	var b strings.Builder
+	peerID := m.connectionRequests[0]
+
+	b.WriteString(headerStyle.Render("Connection Request") + "\n\n")
+	b.WriteString("  A peer that is not in your contacts wants to connect:\n\n")
+	b.WriteString("    " + hex.EncodeToString(peerID[:]) + "\n\n")
+	if more := len(m.connectionRequests) - 1; more > 0 {
+		b.WriteString(fmt.Sprintf("  %d more waiting\n\n", more))
+	}
+	b.WriteString(statusBarStyle.Render("  y: accept • n: reject • esc: decide later") + "\n")
+
+	return b.String()
+}
+
+func (m *model) updateConnectionRequestView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	peerID := m.connectionRequests[0]
+
+	switch msg.String() {
+	case "y", "Y":
+		m.chat.ApproveConnection(peerID)
+		m.statusMsg = "Connection request accepted"
+	case "n", "N":
+		m.chat.RejectConnection(peerID)
+		m.statusMsg = "Connection request rejected"
+	case "esc", "q":
+		m.mode = viewMain
+		return m, nil
+	default:
+		return m, nil
+	}
+
+	m.connectionRequests = m.connectionRequests[1:]
+	if len(m.connectionRequests) == 0 {
+		m.mode = viewMain
+	}
+	return m, nil
+}
+
+func (m *model) viewFileOffer() string {
+	var b strings.Builder
+	offer := m.fileOffers[0]
+
+	sender := hex.EncodeToString(offer.PeerID[:8]) + "…"
+	for _, contact := range m.contacts {
+		if contact.PeerID == offer.PeerID {
+			sender = contact.Name
+			break
+		}
+	}
+
+	if offer.Archive {
+		b.WriteString(headerStyle.Render("Incoming Folder") + "\n\n")
+		b.WriteString(fmt.Sprintf("  %s wants to send you a folder:\n\n", sender))
+		b.WriteString(fmt.Sprintf("    📁 %s (%s)\n\n", archiveFolderName(offer.FileName), formatBytes(uint64(offer.FileSize))))
+	} else {
+		b.WriteString(headerStyle.Render("Incoming File") + "\n\n")
+		b.WriteString(fmt.Sprintf("  %s wants to send you a file:\n\n", sender))
+		b.WriteString(fmt.Sprintf("    %s (%s)\n\n", offer.FileName, formatBytes(uint64(offer.FileSize))))
+	}
+	if more := len(m.fileOffers) - 1; more > 0 {
+		b.WriteString(fmt.Sprintf("  %d more waiting\n\n", more))
+	}
+	if m.error != "" {
+		b.WriteString(errorStyle.Render("  Error: "+m.error) + "\n\n")
+	}
+	b.WriteString(statusBarStyle.Render("  y: accept • n: reject • esc: decide later") + "\n")
+
+	return b.String()
+}
+
+func (m *model) updateFileOfferView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	offer := m.fileOffers[0]
+
+	switch msg.String() {
+	case "y", "Y":
+		m.error = ""
+		if err := m.chat.AcceptFileTransfer(offer.ID); err != nil {
+			m.error = err.Error()
+			// The offer stays while the sender is offline
+			if slices.Contains(m.chat.FileOffers(), offer) {
+				return m, nil
+			}
+		}
+	case "n", "N":
+		if err := m.chat.RejectFileTransfer(offer.ID); err != nil {
+			m.error = err.Error()
+		} else {
+			m.statusMsg = "File rejected: " + offer.FileName
+		}
+	case "esc", "q":
+		m.mode = viewMain
+		return m, nil
+	default:
+		return m, nil
+	}
+
+	m.fileOffers = m.fileOffers[1:]
+	if len(m.fileOffers) == 0 {
+		m.mode = viewMain
+	}
+	return m, nil
+}
+
+// removeFileOffer drops an offer the sender withdrew
+func (m *model) removeFileOffer(transferID string) {
+	m.fileOffers = slices.DeleteFunc(m.fileOffers, func(ft *FileTransfer) bool {
+		return ft.ID == transferID
+	})
+	if m.mode == viewFileOffer && len(m.fileOffers) == 0 {
+		m.mode = viewMain
+	}
+}
+
+// Screen rows of the first contact in the main view (below the panel border
+// and header) and of the first item in viewContactMenu
+const (
+	contactsListTop = 2
+	contactMenuTop  = 2
+)
+
+// contactMenuItems are the actions of the right-click menu. Each one runs
+// the contact list key of the same action
+var contactMenuItems = []struct{ label, key string }{
+	{"Rename", "r"},
+	{"Delete", "d"},
+	{"Connect", "c"},
+}
+
+// handleMouse selects contacts with a click, opens the contact menu with a
+// right click and scrolls messages with the wheel. Dialogs are keyboard
+// only, apart from the contact menu
+func (m *model) handleMouse(msg tea.MouseMsg) (tea.Model, tea.Cmd) {
+	if msg.Action != tea.MouseActionPress {
+		return m, nil
+	}
+
+	switch m.mode {
+	case viewContactMenu:
+		if i := msg.Y - contactMenuTop; msg.Button == tea.MouseButtonLeft && i >= 0 && i < len(contactMenuItems) {
+			m.selectedMenuItem = i
+			return m.runContactMenuItem()
+		}
+		return m, nil
+	case viewMain:
+	default:
+		return m, nil
+	}
+
+	// The contacts panel is contactsWidth wide plus its border
+	inContacts := msg.X < m.contactsWidth+2
+
+	switch msg.Button {
+	case tea.MouseButtonWheelUp, tea.MouseButtonWheelDown:
+		if !inContacts {
+			var cmd tea.Cmd
+			m.viewport, cmd = m.viewport.Update(msg)
+			return m, cmd
+		}
+
+	case tea.MouseButtonLeft, tea.MouseButtonRight:
+		i, ok := m.contactAt(msg.Y)
+		if !inContacts || !ok {
+			return m, nil
+		}
+		m.focus = focusContacts
+		m.textarea.Blur()
+		var cmd tea.Cmd
+		if i != m.selectedContact {
+			m.selectedContact = i
+			cmd = m.loadMessages
+		}
+		if msg.Button == tea.MouseButtonRight && !m.selectedIsGroup() {
+			m.mode = viewContactMenu
+			m.selectedMenuItem = 0
+			m.error = ""
+		}
+		return m, cmd
+	}
+
+	return m, nil
+}
+
+// contactAt returns the contact shown on screen row y of the contacts panel
+func (m *model) contactAt(y int) (int, bool) {
+	i := y - contactsListTop
+	// renderContactsPanel shows at most height-5 contacts
+	if i < 0 || i >= len(m.contacts) || i >= m.height-5 {
+		return 0, false
+	}
+	return i, true
+}
+
+func (m *model) viewContactMenu() string {
+	var b strings.Builder
+
+	name := ""
+	if m.selectedContact < len(m.contacts) {
+		name = m.contacts[m.selectedContact].Name
+	}
+	b.WriteString(headerStyle.Render(name) + "\n\n")
+	for i, item := range contactMenuItems {
+		style := contactStyle
+		if i == m.selectedMenuItem {
+			style = selectedContactStyle
+		}
+		b.WriteString(style.Render(item.label) + "\n")
+	}
+	b.WriteString("\n" + statusBarStyle.Render("  ↑/↓: select • enter or click: run • esc: close") + "\n")
+
+	return b.String()
+}
+
+func (m *model) updateContactMenuView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "up", "k":
+		if m.selectedMenuItem > 0 {
+			m.selectedMenuItem--
+		}
+	case "down", "j":
+		if m.selectedMenuItem < len(contactMenuItems)-1 {
+			m.selectedMenuItem++
+		}
+	case "enter":
+		return m.runContactMenuItem()
+	case "esc", "q":
+		m.mode = viewMain
+	}
+
+	return m, nil
+}
+
+// runContactMenuItem closes the menu and runs the selected action
+func (m *model) runContactMenuItem() (tea.Model, tea.Cmd) {
+	m.mode = viewMain
+	key := contactMenuItems[m.selectedMenuItem].key
+	return m.updateContactsFocus(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(key)})
+}
+
+// connectionModeLabel describes a connection policy in the status bar
+func connectionModeLabel(mode p2p.ConnectionMode) string {
+	switch mode {
+	case p2p.ConnectionContactsOnly:
+		return "contacts only"
+	case p2p.ConnectionManual:
+		return "contacts, ask for others"
+	default:
+		return "open to everyone"
+	}
+}
+
+func (m *model) viewConfirmDelete() string {
+	var b strings.Builder
+
+	b.WriteString(headerStyle.Render("Delete Contact") + "\n\n")
+	b.WriteString(fmt.Sprintf("  Are you sure you want to delete '%s'?\n\n", m.contactToDeleteName))
+	b.WriteString(errorStyle.Render("  This will delete all messages with this contact!") + "\n\n")
+	b.WriteString(statusBarStyle.Render("  y: yes, delete • n: no, cancel") + "\n")
+
+	return b.String()
+}
+
+func (m *model) updateConfirmDeleteView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "y", "Y":
+		// Confirmed - delete
+		if err := m.chat.DeleteContact(m.contactToDelete); err != nil {
+			m.error = err.Error()
+			m.mode = viewMain
+			return m, nil
+		}
+
+		m.mode = viewMain
+		m.statusMsg = "Contact deleted"
+		return m, m.loadContacts
+
+	case "n", "N", "esc":
+		// Cancelled
+		m.mode = viewMain
+		return m, nil
 	}
 
 	return m, nil
@@ -910,35 +1825,121 @@ func (m *model) updateFilePickerView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	// Update file picker with the key message
 	updatedPicker, cmd := m.filePicker.Update(msg)
 	m.filePicker = updatedPicker
+	if m.pendingSend != nil {
+		cmd = tea.Batch(cmd, m.pendingSend)
+		m.pendingSend = nil
+	}
 
 	return m, cmd
 }
 
+// sendPaths sends picked files and folders to peer in the background,
+// since packing a folder takes a while. Folders go as archives
+func (m *model) sendPaths(peerID router.PeerID, paths []string) tea.Cmd {
+	return func() tea.Msg {
+		var files []string
+		var errs []error
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil && info.IsDir() {
+				if err := m.chat.SendDirectory(peerID, path); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", filepath.Base(path), err))
+				}
+				continue
+			}
+			files = append(files, path)
+		}
+		if len(files) > 0 {
+			if err := m.chat.SendFiles(peerID, files); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
+			return errorMsg("Failed to send: " + strings.ReplaceAll(err.Error(), "\n", "; "))
+		}
+		return nil
+	}
+}
+
+// sendingStatus is the status line while picked paths are being sent
+func sendingStatus(paths []string) string {
+	if len(paths) == 1 {
+		return "Sending file..."
+	}
+	return fmt.Sprintf("Sending %d files...", len(paths))
+}
+
+// deliveryMarker shows how far an outgoing message got: ✓ sent, grey ✓✓
+// delivered, colored ✓✓ read and ! not acked in time
+func deliveryMarker(msg *Message) string {
+	switch {
+	case msg.ReadAt != nil:
+		return readReceiptStyle.Render("✓✓")
+	case msg.Status == MessageStatusDelivered:
+		return deliveryStyle.Render("✓✓")
+	case msg.Status == MessageStatusSent:
+		return deliveryStyle.Render("✓")
+	case msg.Status == MessageStatusFailed:
+		return deliveryFailedStyle.Render("!")
+	}
+	return ""
+}
+
 func (m *model) updateViewport() {
 	var b strings.Builder
 	jumpToLine := -1  // Line to scroll to
 	currentLine := 0  // Current line in viewport
+	markdown := m.chat.MarkdownEnabled()
+	selectedLine := -1 // Line of the selected message
 
-	for _, msg := range m.messages {
+	for i, msg := range m.messages {
 		// If this is the message to scroll to - remember the line
 		if m.jumpToMessageID > 0 && msg.ID == m.jumpToMessageID {
 			jumpToLine = currentLine
 		}
+		outgoingStyle, incomingStyle := messageOutgoingStyle, messageIncomingStyle
+		if m.selectingMessage && i == m.selectedMessage {
+			selectedLine = currentLine
+			outgoingStyle, incomingStyle = selectedMessageStyle, selectedMessageStyle
+		}
 
 		timestamp := msg.Timestamp.Format("15:04:05")
+		marker := ""
+		if msg.ID == m.unreadMarkID {
+			marker = "> "
+		}
+		content := msg.Content
+		if msg.IsEdited() {
+			content += " (edited)"
+		}
+		// Markdown starts on its own line so that code blocks and lists
+		// keep their layout. The text already has its own styles
+		var rendered string
+		if markdown && looksLikeMarkdown(msg.Content) {
+			rendered = "\n" + renderMarkdown(content, m.viewport.Width)
+			content = ""
+		}
 
 		if msg.IsOutgoing {
-			line := fmt.Sprintf("[%s] You: %s", timestamp, msg.Content)
-			rendered := messageOutgoingStyle.Render(line)
+			line := marker + fmt.Sprintf("[%s] You: %s", timestamp, content)
+			rendered = outgoingStyle.Render(line) + rendered
+			if status := deliveryMarker(msg); status != "" {
+				rendered += " " + status
+			}
+			b.WriteString(rendered + "\n")
+			// Count lines (including newlines in Content)
+			currentLine += strings.Count(rendered, "\n") + 1
+		} else if msg.SenderID != (router.PeerID{}) {
+			line := marker + fmt.Sprintf("[%s] %s: %s", timestamp, m.senderName(msg.SenderID), content)
+			rendered = incomingStyle.Render(line) + rendered
 			b.WriteString(rendered + "\n")
 			// Count lines (including newlines in Content)
-			currentLine += strings.Count(msg.Content, "\n") + 1
+			currentLine += strings.Count(rendered, "\n") + 1
 		} else {
-			line := fmt.Sprintf("[%s] %s", timestamp, msg.Content)
-			rendered := messageIncomingStyle.Render(line)
+			line := marker + fmt.Sprintf("[%s] %s", timestamp, content)
+			rendered = incomingStyle.Render(line) + rendered
 			b.WriteString(rendered + "\n")
 			// Count lines (including newlines in Content)
-			currentLine += strings.Count(msg.Content, "\n") + 1
+			currentLine += strings.Count(rendered, "\n") + 1
 		}
 	}
 
@@ -954,16 +1955,34 @@ func (m *model) updateViewport() {
 		}
 		m.viewport.SetYOffset(targetOffset)
 		m.jumpToMessageID = 0  // Reset flag
+	} else if selectedLine >= 0 {
+		// Keep the selected message in view
+		if selectedLine < m.viewport.YOffset {
+			m.viewport.SetYOffset(selectedLine)
+		} else if selectedLine >= m.viewport.YOffset+m.viewport.Height {
+			m.viewport.SetYOffset(selectedLine - m.viewport.Height + 1)
+		}
 	} else {
 		m.viewport.GotoBottom()
 	}
 }
 
+// senderName returns the contact name of a group message author or a short
+// hex ID for members who are not our contacts
+func (m *model) senderName(peerID router.PeerID) string {
+	for _, contact := range m.contacts {
+		if contact.PeerID == peerID {
+			return contact.Name
+		}
+	}
+	return hex.EncodeToString(peerID[:4])
+}
+
 func (m *model) handleChatEvent(event ChatEvent) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
 
 	switch event.Type {
-	case ChatEventMessageReceived:
+	case ChatEventMessageReceived, ChatEventGroupMessageReceived:
 		if m.mode == viewMain && len(m.contacts) > 0 {
 			contact := m.contacts[m.selectedContact]
 			if contact.PeerID == event.PeerID {
@@ -990,6 +2009,11 @@ func (m *model) handleChatEvent(event ChatEvent) (tea.Model, tea.Cmd) {
 			cmd = m.loadMessages
 		}
 
+	case ChatEventMessageEdited, ChatEventMessageDeleted, ChatEventMessageRead, ChatEventMessageStatusChanged:
+		if m.mode == viewMain && len(m.contacts) > 0 && m.contacts[m.selectedContact].PeerID == event.PeerID {
+			cmd = m.loadMessages
+		}
+
 	case ChatEventContactAdded:
 		// New contact added automatically
 		m.statusMsg = "New contact added"
@@ -997,30 +2021,77 @@ func (m *model) handleChatEvent(event ChatEvent) (tea.Model, tea.Cmd) {
 
 	case ChatEventContactOnline:
 		m.statusMsg = "Contact connected"
+		if event.Relayed {
+			m.statusMsg = "Contact connected via relay (direct connection failed)"
+		}
 		cmd = m.loadContacts
 
 	case ChatEventContactOffline:
 		m.statusMsg = "Contact disconnected"
 		cmd = m.loadContacts
 
+	case ChatEventContactReconnecting:
+		m.statusMsg = "Connection lost, reconnecting…"
+		cmd = m.loadContacts
+
+	case ChatEventContactConnecting:
+		cmd = m.loadContacts
+
+	case ChatEventPeerDiscovered:
+		if event.Contact != nil {
+			m.statusMsg = event.Contact.Name + " is on the local network"
+			break
+		}
+		m.discoveredPeer = event.PeerID
+		m.statusMsg = fmt.Sprintf("Found %s… on the local network (a: add)", hex.EncodeToString(event.PeerID[:8]))
+
+	case ChatEventContactKeyChanged:
+		m.error = "A contact's encryption key changed, verify the safety number again (v)"
+		m.statusMsg = ""
+		cmd = m.loadContacts
+
+	case ChatEventConnectionRequest:
+		if !slices.Contains(m.connectionRequests, event.PeerID) {
+			m.connectionRequests = append(m.connectionRequests, event.PeerID)
+		}
+		m.statusMsg = fmt.Sprintf("Connection request from %s… (p: review)", hex.EncodeToString(event.PeerID[:8]))
+
+	case ChatEventFileOfferReceived:
+		m.fileOffers = append(m.fileOffers, event.FileTransfer)
+		// Pop up unless the user is typing, "y" or "n" would answer it
+		if m.mode == viewMain && m.focus != focusInput {
+			m.mode = viewFileOffer
+			m.error = ""
+		} else {
+			m.statusMsg = fmt.Sprintf("Incoming file %s (o: review)", event.FileTransfer.FileName)
+		}
+
 	case ChatEventConnectionFailed:
-		// Errors are logged, no need to show in TUI
+		// Errors are logged, only router rejections are worth showing
+		if text, ok := routerErrorText(event.Error); ok {
+			m.statusMsg = "Connection failed: " + text
+		}
 
 	case ChatEventError:
-		// Errors are logged, no need to show in TUI
+		// Errors are logged, only losing the router is worth showing:
+		// no messages arrive until restart
+		if errors.Is(event.Error, p2p.ErrRouterDisconnected) {
+			m.error = event.Error.Error()
+			m.statusMsg = ""
+		}
 
 	case ChatEventFileTransferStarted:
 		if event.FileTransfer.IsOutgoing {
-			m.statusMsg = fmt.Sprintf("Sending file: %s", event.FileTransfer.FileName)
+			m.statusMsg = fmt.Sprintf("Offered file: %s, waiting for the contact", event.FileTransfer.FileName)
 		} else {
 			m.statusMsg = fmt.Sprintf("Receiving file: %s", event.FileTransfer.FileName)
 		}
 
 	case ChatEventFileTransferProgress:
 		if event.FileTransfer.IsOutgoing {
-			m.statusMsg = fmt.Sprintf("Sending %s: %d%%", event.FileTransfer.FileName, event.FileTransfer.Progress)
+			m.statusMsg = fmt.Sprintf("Sending %s: %s", event.FileTransfer.FileName, formatTransferProgress(event.FileTransfer))
 		} else {
-			m.statusMsg = fmt.Sprintf("Receiving %s: %d%%", event.FileTransfer.FileName, event.FileTransfer.Progress)
+			m.statusMsg = fmt.Sprintf("Receiving %s: %s", event.FileTransfer.FileName, formatTransferProgress(event.FileTransfer))
 		}
 
 	case ChatEventFileTransferCompleted:
@@ -1032,7 +2103,21 @@ func (m *model) handleChatEvent(event ChatEvent) (tea.Model, tea.Cmd) {
 		cmd = m.loadMessages // Update messages
 
 	case ChatEventFileTransferFailed:
-		m.error = fmt.Sprintf("File transfer failed: %v", event.Error)
+		m.removeFileOffer(event.FileTransfer.ID)
+		if errors.Is(event.Error, ErrCancelledByUser) {
+			m.statusMsg = fmt.Sprintf("Cancelled transfer of %s", event.FileTransfer.FileName)
+		} else {
+			m.error = fmt.Sprintf("File transfer failed: %v", event.Error)
+		}
+
+	case ChatEventTypingStarted:
+		if m.typingPeers == nil {
+			m.typingPeers = make(map[router.PeerID]bool)
+		}
+		m.typingPeers[event.PeerID] = true
+
+	case ChatEventTypingStopped:
+		delete(m.typingPeers, event.PeerID)
 	}
 
 	// IMPORTANT: always return command to wait for next event
@@ -1046,7 +2131,7 @@ type contactsLoadedMsg struct {
 }
 
 func (m *model) loadContacts() tea.Msg {
-	contacts, err := m.chat.GetContacts()
+	contacts, err := m.chat.GetContactsSorted(m.sortOrder)
 	if err != nil {
 		return errorMsg(err.Error())
 	}
@@ -1086,6 +2171,250 @@ func (m *model) waitForChatEvents() tea.Msg {
 type statusMsg string
 type errorMsg string
 
+// messageSentMsg is the outcome of a message sent to an offline contact
+type messageSentMsg struct {
+	content string
+	err     error
+}
+
+func (m *model) sendMessage(peerID router.PeerID, content string) tea.Cmd {
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), messageSendTimeout)
+		defer cancel()
+		return messageSentMsg{content: content, err: m.chat.SendMessage(ctx, peerID, content)}
+	}
+}
+
+// connectResultMsg is the outcome of a connection attempt started with "c"
+type connectResultMsg struct {
+	result <-chan error
+	err    error
+}
+
+func waitForConnect(result <-chan error) tea.Cmd {
+	return func() tea.Msg {
+		return connectResultMsg{result: result, err: <-result}
+	}
+}
+
+// statsTickMsg refreshes the stats overlay
+type statsTickMsg struct{}
+
+const (
+	// unreadMarkDuration is how long the ">" marker stays on the message
+	// "u" jumped to
+	unreadMarkDuration = 2 * time.Second
+	// noUnreadStatusDuration is how long "u" reports there is nothing unread
+	noUnreadStatusDuration = time.Second
+	noUnreadStatus         = "No unread messages"
+)
+
+// unreadMarkExpiredMsg removes the ">" marker from message id
+type unreadMarkExpiredMsg struct {
+	id int64
+}
+
+// statusExpiredMsg clears the status bar if it still shows this text
+type statusExpiredMsg string
+
+const statsRefreshInterval = time.Second
+
+func statsTick() tea.Cmd {
+	return tea.Tick(statsRefreshInterval, func(time.Time) tea.Msg {
+		return statsTickMsg{}
+	})
+}
+
+func (m *model) viewStats() string {
+	var b strings.Builder
+
+	b.WriteString(headerStyle.Render("Connection Stats") + "\n\n")
+
+	stats := m.chat.GetStats()
+	if len(stats) == 0 {
+		b.WriteString(statusBarStyle.Render("No connected peers") + "\n")
+	} else {
+		names := make(map[router.PeerID]string, len(m.contacts))
+		for _, contact := range m.contacts {
+			names[contact.PeerID] = contact.Name
+		}
+
+		peerIDs := make([]router.PeerID, 0, len(stats))
+		for peerID := range stats {
+			peerIDs = append(peerIDs, peerID)
+		}
+		sort.Slice(peerIDs, func(i, j int) bool {
+			return bytes.Compare(peerIDs[i][:], peerIDs[j][:]) < 0
+		})
+
+		b.WriteString(fmt.Sprintf("%-20s %-12s %10s %10s %9s %9s %8s\n",
+			"Peer", "State", "Sent", "Received", "Pkts out", "Pkts in", "RTT"))
+		for _, peerID := range peerIDs {
+			s := stats[peerID]
+
+			name, ok := names[peerID]
+			if !ok {
+				name = hex.EncodeToString(peerID[:8]) + "..."
+			}
+			if len(name) > 20 {
+				name = name[:17] + "..."
+			}
+
+			state := s.State.String()
+			if s.Relayed {
+				state = "relayed"
+			}
+
+			rtt := "-"
+			if s.RTT > 0 {
+				rtt = s.RTT.Round(time.Millisecond).String()
+			}
+
+			b.WriteString(fmt.Sprintf("%-20s %-12s %10s %10s %9d %9d %8s\n",
+				name, state, formatBytes(s.BytesSent), formatBytes(s.BytesReceived),
+				s.PacketsSent, s.PacketsReceived, rtt))
+		}
+	}
+
+	b.WriteString("\n" + statusBarStyle.Render("press any key to go back"))
+
+	return activeBorderStyle.Padding(0, 1).Render(b.String())
+}
+
+func (m *model) updateStatsView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.mode = viewMain
+	return m, nil
+}
+
+func (m *model) viewTransfers() string {
+	var b strings.Builder
+
+	b.WriteString(headerStyle.Render("File Transfers") + "\n\n")
+
+	transfers := m.chat.ListTransfers()
+	if len(transfers) == 0 {
+		b.WriteString(statusBarStyle.Render("No active transfers") + "\n")
+	} else {
+		names := make(map[router.PeerID]string, len(m.contacts))
+		for _, contact := range m.contacts {
+			names[contact.PeerID] = contact.Name
+		}
+		selected := min(m.selectedTransfer, len(transfers)-1)
+
+		for i, ft := range transfers {
+			name, ok := names[ft.PeerID]
+			if !ok {
+				name = hex.EncodeToString(ft.PeerID[:8]) + "..."
+			}
+			direction := "↓ from"
+			if ft.IsOutgoing {
+				direction = "↑ to"
+			}
+
+			line := fmt.Sprintf("%s %s %s: %s", direction, name, ft.FileName, formatTransferProgress(ft))
+			if i == selected {
+				b.WriteString(selectedContactStyle.Render(line) + "\n")
+			} else {
+				b.WriteString(contactStyle.Render(line) + "\n")
+			}
+		}
+	}
+
+	b.WriteString("\n")
+	if m.error != "" {
+		b.WriteString(errorStyle.Render("Error: "+m.error) + "\n")
+	} else if m.statusMsg != "" {
+		b.WriteString(statusBarStyle.Render(m.statusMsg) + "\n")
+	}
+	b.WriteString(statusBarStyle.Render("↑/↓: select • c: cancel transfer • esc: back"))
+
+	return activeBorderStyle.Padding(0, 1).Render(b.String())
+}
+
+func (m *model) updateTransfersView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	transfers := m.chat.ListTransfers()
+
+	switch msg.String() {
+	case "up", "k":
+		if m.selectedTransfer > 0 {
+			m.selectedTransfer--
+		}
+
+	case "down", "j":
+		if m.selectedTransfer < len(transfers)-1 {
+			m.selectedTransfer++
+		}
+
+	case "c":
+		if len(transfers) == 0 {
+			return m, nil
+		}
+		ft := transfers[min(m.selectedTransfer, len(transfers)-1)]
+		// Notifying the peer may wait for the data channel
+		return m, func() tea.Msg {
+			if err := m.chat.CancelFileTransfer(ft.ID); err != nil {
+				return errorMsg(err.Error())
+			}
+			return statusMsg(fmt.Sprintf("Cancelled transfer of %s", ft.FileName))
+		}
+
+	case "esc", "q":
+		m.mode = viewMain
+		m.error = ""
+	}
+
+	return m, nil
+}
+
+// contactStatusDot renders the contact list indicator: green when
+// connected, yellow while connecting or reconnecting, gray when offline
+func contactStatusDot(c *Chat, contact *Contact) string {
+	if contact.IsGroup {
+		return groupStyle.Render("#")
+	}
+	switch c.PeerState(contact.PeerID) {
+	case p2p.PeerStateConnecting:
+		return reconnectingStyle.Render("●")
+	case p2p.PeerStateConnected:
+		return onlineStyle.Render("●")
+	default:
+		return offlineStyle.Render("●")
+	}
+}
+
+// formatTransferProgress formats percent, speed and time left of a
+// transfer, e.g. "43% • 2.1 MB/s • 1m12s left", or its place in the queue,
+// e.g. "queued (2 ahead)"
+func formatTransferProgress(ft *FileTransfer) string {
+	if ahead, queued := ft.QueuePosition(); queued {
+		return fmt.Sprintf("queued (%d ahead)", ahead)
+	}
+	progress := fmt.Sprintf("%d%%", ft.Progress)
+	speed := ft.Speed()
+	if speed <= 0 {
+		return progress
+	}
+	progress += fmt.Sprintf(" • %s/s", formatBytes(uint64(speed)))
+	if eta := ft.ETA().Round(time.Second); eta > 0 {
+		progress += fmt.Sprintf(" • %s left", eta)
+	}
+	return progress
+}
+
+// formatBytes formats a byte count as B, KB, MB or GB
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit && exp < 2; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMG"[exp])
+}
+
 func (m *model) viewSearchContacts() string {
 	var b strings.Builder
 
@@ -1108,10 +2437,7 @@ func (m *model) viewSearchContacts() string {
 				style = selectedContactStyle
 			}
 
-			status := offlineStyle.Render("●")
-			if m.chat.IsOnline(contact.PeerID) {
-				status = onlineStyle.Render("●")
-			}
+			status := contactStatusDot(m.chat, contact)
 
 			blocked := ""
 			if contact.IsBlocked {
@@ -1361,12 +2687,55 @@ func (m *model) updateSearchView(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
+// sortOrderLabel describes the contact list order in the status bar
+func sortOrderLabel(order SortOrder) string {
+	switch order {
+	case SortRecent:
+		return "latest message"
+	case SortNameAsc:
+		return "name (A-Z)"
+	case SortNameDesc:
+		return "name (Z-A)"
+	case SortLastSeen:
+		return "last seen"
+	}
+	return order.String()
+}
+
+// routerErrorText returns a user-facing description of a router rejection
+func routerErrorText(err error) (string, bool) {
+	if errors.Is(err, p2p.ErrPeerNotFound) {
+		return "contact is offline", true
+	}
+	var rerr *router.RouterError
+	if !errors.As(err, &rerr) {
+		return "", false
+	}
+	switch rerr.Code() {
+	case router.ErrCodeRecipientWriteFailed:
+		return "contact is unreachable", true
+	case router.ErrCodeTooLarge:
+		return "message is too large", true
+	case router.ErrCodeRateLimited:
+		return "sending too fast, try again later", true
+	case router.ErrCodeForbidden:
+		return "blocked by router", true
+	case router.ErrCodeRecipientBusy:
+		return "contact is busy, try again later", true
+	case router.ErrCodeOfflineQueueFull:
+		return "contact is offline, too many messages waiting", true
+	default:
+		return "router error", true
+	}
+}
+
 // RunTUI starts the TUI application
-func RunTUI(chat *Chat, myID router.PeerID) error {
-	p := tea.NewProgram(
-		NewTUI(chat, myID),
-		tea.WithAltScreen(),
-	)
+func RunTUI(chat *Chat, myID router.PeerID, opts TUIOptions) error {
+	programOpts := []tea.ProgramOption{tea.WithAltScreen()}
+	if !opts.NoMouse {
+		programOpts = append(programOpts, tea.WithMouseCellMotion())
+	}
+	p := tea.NewProgram(NewTUI(chat, myID, opts), programOpts...)
 
 	_, err := p.Run()
 	return err
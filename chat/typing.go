@@ -0,0 +1,162 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+const (
+	TypingMessageType = "typing"
+	TypingStateStart  = "start"
+	TypingStateStop   = "stop"
+
+	// TypingTimeout stops the indicator if the "stop" message was lost
+	TypingTimeout = 5 * time.Second
+	// typingSendInterval limits outgoing typing indicators per peer
+	typingSendInterval = time.Second
+)
+
+// TypingMessage is the typing indicator envelope sent over the data channel.
+// It is never saved to storage
+type TypingMessage struct {
+	Type  string `json:"type"`
+	State string `json:"state"`
+}
+
+// typingSendState tracks the last typing indicator sent to a peer
+type typingSendState struct {
+	typing   bool
+	lastSent time.Time
+}
+
+// parseTypingMessage reports whether data is a typing indicator
+func parseTypingMessage(data []byte) (*TypingMessage, bool) {
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return nil, false
+	}
+	var msg TypingMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != TypingMessageType {
+		return nil, false
+	}
+	return &msg, true
+}
+
+// SendTypingIndicator tells the peer that the user started or stopped typing.
+// Indicators are sent at most once per second, except that a "stop" after a
+// "start" is always sent so the receiver does not wait for TypingTimeout
+func (c *Chat) SendTypingIndicator(peerID router.PeerID, typing bool) error {
+	if !c.shouldSendTyping(peerID, typing, time.Now()) {
+		return nil
+	}
+
+	peer, ok := c.connector.GetPeer(peerID)
+	if !ok {
+		return fmt.Errorf("peer not connected")
+	}
+
+	msg := TypingMessage{Type: TypingMessageType, State: TypingStateStop}
+	if typing {
+		msg.State = TypingStateStart
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal typing message: %w", err)
+	}
+
+	if err := peer.Send(data); err != nil {
+		return fmt.Errorf("send typing message: %w", err)
+	}
+	return nil
+}
+
+// shouldSendTyping applies the outgoing rate limit and records the sent state
+func (c *Chat) shouldSendTyping(peerID router.PeerID, typing bool, now time.Time) bool {
+	c.typingMu.Lock()
+	defer c.typingMu.Unlock()
+
+	if c.typingSent == nil {
+		c.typingSent = make(map[router.PeerID]*typingSendState)
+	}
+	state, ok := c.typingSent[peerID]
+	if !ok {
+		state = &typingSendState{}
+		c.typingSent[peerID] = state
+	}
+
+	if !typing && !state.typing {
+		return false
+	}
+	if typing && now.Sub(state.lastSent) < typingSendInterval {
+		return false
+	}
+	state.typing = typing
+	state.lastSent = now
+	return true
+}
+
+// handleTypingMessage updates the peer typing state and emits events on change
+func (c *Chat) handleTypingMessage(peerID router.PeerID, msg *TypingMessage) {
+	switch msg.State {
+	case TypingStateStart:
+		c.setPeerTyping(peerID, true)
+	case TypingStateStop:
+		c.setPeerTyping(peerID, false)
+	default:
+		slog.Debug("Unknown typing state", "peerID", hex.EncodeToString(peerID[:8])+"...", "state", msg.State)
+	}
+}
+
+// setPeerTyping starts or stops the receive-side typing indicator. A started
+// indicator stops by itself after TypingTimeout unless refreshed
+func (c *Chat) setPeerTyping(peerID router.PeerID, typing bool) {
+	c.typingMu.Lock()
+	if c.typingRecv == nil {
+		c.typingRecv = make(map[router.PeerID]*time.Timer)
+	}
+	timer, wasTyping := c.typingRecv[peerID]
+	if wasTyping {
+		timer.Stop()
+		delete(c.typingRecv, peerID)
+	}
+	if typing {
+		var t *time.Timer
+		timeout := c.typingTimeout
+		if timeout <= 0 {
+			timeout = TypingTimeout
+		}
+		t = time.AfterFunc(timeout, func() {
+			c.typingMu.Lock()
+			current, ok := c.typingRecv[peerID]
+			if ok && current == t {
+				delete(c.typingRecv, peerID)
+			}
+			c.typingMu.Unlock()
+			if ok && current == t {
+				c.events <- ChatEvent{Type: ChatEventTypingStopped, PeerID: peerID}
+			}
+		})
+		c.typingRecv[peerID] = t
+	}
+	c.typingMu.Unlock()
+
+	switch {
+	case typing && !wasTyping:
+		c.events <- ChatEvent{Type: ChatEventTypingStarted, PeerID: peerID}
+	case !typing && wasTyping:
+		c.events <- ChatEvent{Type: ChatEventTypingStopped, PeerID: peerID}
+	}
+}
+
+// IsTyping reports whether the peer is currently typing
+func (c *Chat) IsTyping(peerID router.PeerID) bool {
+	c.typingMu.Lock()
+	defer c.typingMu.Unlock()
+	_, ok := c.typingRecv[peerID]
+	return ok
+}
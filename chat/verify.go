@@ -0,0 +1,139 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/udisondev/sendy/p2p"
+	"github.com/udisondev/sendy/router"
+)
+
+// Contacts are verified by comparing safety numbers out of band. The router
+// relays the first key exchange, so a malicious router could substitute its
+// own keys; matching safety numbers on both sides rule that out. The key a
+// contact connected with is saved, and a different key on a later
+// connection clears the verified flag
+
+var ErrNoContactKey = errors.New("no encryption key from contact yet, connect first")
+
+// parseEncKey parses an encryption key column, NULL gives nil
+func parseEncKey(value sql.NullString) (*p2p.Curve25519PublicKey, error) {
+	if !value.Valid {
+		return nil, nil
+	}
+	// SECURITY: Check hex decoding error
+	keyBytes, err := hex.DecodeString(value.String)
+	if err != nil {
+		return nil, fmt.Errorf("invalid enc_key in database: %w", err)
+	}
+	var key p2p.Curve25519PublicKey
+	if len(keyBytes) != len(key) {
+		return nil, fmt.Errorf("invalid enc_key size in database: got %d, expected %d", len(keyBytes), len(key))
+	}
+	copy(key[:], keyBytes)
+	return &key, nil
+}
+
+// SetContactKey saves the encryption key the contact connected with. A key
+// different from the saved one clears the verified flag. Reports whether a
+// previously saved key was replaced
+func (s *Storage) SetContactKey(peerID router.PeerID, key *p2p.Curve25519PublicKey) (bool, error) {
+	hexID := hex.EncodeToString(peerID[:])
+	hexKey := hex.EncodeToString(key[:])
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var oldKey sql.NullString
+	if err := tx.QueryRow(`SELECT enc_key FROM contacts WHERE peer_id = ?`, hexID).Scan(&oldKey); err != nil {
+		return false, err
+	}
+	if oldKey.Valid && oldKey.String == hexKey {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(`UPDATE contacts SET enc_key = ?, verified = 0 WHERE peer_id = ?`, hexKey, hexID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return oldKey.Valid, nil
+}
+
+// SetVerified sets the verified flag of contact
+func (s *Storage) SetVerified(peerID router.PeerID, verified bool) error {
+	hexID := hex.EncodeToString(peerID[:])
+	_, err := s.db.Exec(`UPDATE contacts SET verified = ? WHERE peer_id = ?`, verified, hexID)
+	return err
+}
+
+// GetSafetyNumber returns the safety number of the conversation with the
+// contact. Both sides see the same number unless the keys were substituted
+func (c *Chat) GetSafetyNumber(peerID router.PeerID) (string, error) {
+	key, err := c.contactKey(peerID)
+	if err != nil {
+		return "", err
+	}
+	localID := c.connector.LocalID()
+	return p2p.SafetyNumber(localID[:], c.connector.EncryptionKey(), peerID[:], key), nil
+}
+
+// SetContactVerified marks the contact as verified after the user compared
+// safety numbers, or clears the mark
+func (c *Chat) SetContactVerified(peerID router.PeerID, verified bool) error {
+	if verified {
+		// The number the user compared must come from the saved key
+		if _, err := c.contactKey(peerID); err != nil {
+			return err
+		}
+	}
+	if err := c.storage.SetVerified(peerID, verified); err != nil {
+		return fmt.Errorf("set verified: %w", err)
+	}
+	slog.Info("Contact verification changed", "peerID", hex.EncodeToString(peerID[:8])+"...", "verified", verified)
+	return nil
+}
+
+// contactKey returns the saved encryption key of the contact
+func (c *Chat) contactKey(peerID router.PeerID) (*p2p.Curve25519PublicKey, error) {
+	contact, err := c.storage.GetContact(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("get contact: %w", err)
+	}
+	if contact.EncKey == nil {
+		return nil, ErrNoContactKey
+	}
+	return contact.EncKey, nil
+}
+
+// checkContactKey saves the key of a connected contact. A changed key
+// clears the verified flag and emits ChatEventContactKeyChanged
+func (c *Chat) checkContactKey(peerID router.PeerID) {
+	hexID := hex.EncodeToString(peerID[:8])
+
+	key, ok := c.connector.PeerEncryptionKey(peerID)
+	if !ok {
+		return
+	}
+	changed, err := c.storage.SetContactKey(peerID, key)
+	if err != nil {
+		slog.Error("Failed to save contact key", "peerID", hexID+"...", "error", err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	slog.Warn("SECURITY: Contact encryption key changed, verification cleared", "peerID", hexID+"...")
+	c.events <- ChatEvent{
+		Type:   ChatEventContactKeyChanged,
+		PeerID: peerID,
+	}
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/udisondev/sendy/chat"
+)
+
+var (
+	backupOutput string
+	restoreInput string
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Back up the chat database",
+	Long: `Copy the chat database (contacts and message history) to a file.
+The backup can be taken while the chat client is running.
+
+Example:
+  sendy backup --output ~/sendy-backup.db`,
+	RunE: runBackup,
+
+	SilenceUsage: true,
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore the chat database from a backup",
+	Long: `Replace the chat database with a backup made by "sendy backup".
+Stop the chat client before restoring: the current history is overwritten.
+
+Example:
+  sendy restore --input ~/sendy-backup.db`,
+	RunE: runRestore,
+
+	SilenceUsage: true,
+}
+
+func init() {
+	backupCmd.Flags().StringVarP(&backupOutput, "output", "o", "", "Backup file to create")
+	backupCmd.Flags().StringVarP(&chatDataDir, "data", "d", "", "Base directory (default: ~/.sendy)")
+	backupCmd.MarkFlagRequired("output")
+
+	restoreCmd.Flags().StringVarP(&restoreInput, "input", "i", "", "Backup file to restore from")
+	restoreCmd.Flags().StringVarP(&chatDataDir, "data", "d", "", "Base directory (default: ~/.sendy)")
+	restoreCmd.MarkFlagRequired("input")
+
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+}
+
+func runBackup(cmd *cobra.Command, args []string) error {
+	// Backup replaces the destination, an existing file is most likely a mistake
+	if _, err := os.Stat(backupOutput); err == nil {
+		return fmt.Errorf("%s already exists", backupOutput)
+	}
+
+	storage, err := openExistingStorage()
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	if err := storage.Backup(backupOutput); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Backup written to %s\n", backupOutput)
+	return nil
+}
+
+func runRestore(cmd *cobra.Command, args []string) error {
+	dbFile, err := chatDBFile()
+	if err != nil {
+		return err
+	}
+	// Restoring into a fresh installation creates the database
+	if err := os.MkdirAll(filepath.Dir(dbFile), 0700); err != nil {
+		return fmt.Errorf("create data directory: %w", err)
+	}
+
+	storage, err := chat.NewStorage(dbFile)
+	if err != nil {
+		return fmt.Errorf("open chat database: %w", err)
+	}
+	defer storage.Close()
+
+	if err := storage.Restore(restoreInput); err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Chat database restored from %s\n", restoreInput)
+	return nil
+}
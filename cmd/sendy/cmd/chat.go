@@ -1,15 +1,18 @@
 package cmd
 
 import (
+	"cmp"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,7 +23,66 @@ import (
 	"github.com/udisondev/sendy/router"
 )
 
+// oneShotTimeout limits peer connection and delivery in --send mode
+const oneShotTimeout = 30 * time.Second
+
+// infoOut receives progress output. In --no-tui mode stdout carries JSON
+// events only, so progress goes to stderr
+var infoOut io.Writer = os.Stdout
+
+// chatBaseDir returns --data or ~/.sendy
+func chatBaseDir() (string, error) {
+	if chatDataDir != "" {
+		return chatDataDir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".sendy"), nil
+}
+
 func runChat(cmd *cobra.Command, args []string) {
+	if chatSendPeer != "" || chatSendMsg != "" {
+		if !chatNoTUI {
+			exitWithError("Invalid flags", fmt.Errorf("--peer and --send require --no-tui"))
+		}
+		if chatSendPeer == "" || chatSendMsg == "" {
+			exitWithError("Invalid flags", fmt.Errorf("--peer and --send must be used together"))
+		}
+	}
+	if chatNoTUI {
+		infoOut = os.Stderr
+	}
+	turnServers, err := getTURNServers(chatTURNServer, chatTURNUser, chatTURNPass)
+	if err != nil {
+		exitWithError("Invalid TURN configuration", err)
+	}
+	keyExchangeTimeout, err := getTimeout(chatKeyExchangeTimeout, "SENDY_KEY_EXCHANGE_TIMEOUT")
+	if err != nil {
+		exitWithError("Invalid key exchange timeout", err)
+	}
+	answerTimeout, err := getTimeout(chatAnswerTimeout, "SENDY_ANSWER_TIMEOUT")
+	if err != nil {
+		exitWithError("Invalid answer timeout", err)
+	}
+	iceGatherTimeout, err := getTimeout(chatICEGatherTimeout, "SENDY_ICE_GATHER_TIMEOUT")
+	if err != nil {
+		exitWithError("Invalid ICE gather timeout", err)
+	}
+	reconnectCooldown, err := getTimeout(chatReconnectCooldown, "SENDY_RECONNECT_COOLDOWN")
+	if err != nil {
+		exitWithError("Invalid reconnect cooldown", err)
+	}
+	maxUploadRate, err := parseByteRate(chatMaxUploadRate)
+	if err != nil {
+		exitWithError("Invalid --max-upload-rate", err)
+	}
+	autoPurgeAfter, err := parseAge(chatAutoPurgeAfter)
+	if err != nil {
+		exitWithError("Invalid --auto-purge-after", err)
+	}
+
 	if chatGenKey {
 		pubkey, privkey, _ := ed25519.GenerateKey(rand.Reader)
 		fmt.Println("Public key (your ID):", hex.EncodeToString(pubkey))
@@ -29,14 +91,9 @@ func runChat(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	// Determine base directory
-	baseDir := chatDataDir
-	if baseDir == "" {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			exitWithError("Cannot determine home directory", err)
-		}
-		baseDir = filepath.Join(home, ".sendy")
+	baseDir, err := chatBaseDir()
+	if err != nil {
+		exitWithError("Cannot determine home directory", err)
 	}
 
 	// Create directory structure
@@ -60,7 +117,10 @@ func runChat(cmd *cobra.Command, args []string) {
 	defer logFile.Close()
 
 	// Configure slog to write to file (stdout is used by TUI)
-	logLevel := slog.LevelInfo
+	logLevel, err := parseLogLevel(chatLogLevel)
+	if err != nil {
+		exitWithError("Invalid --log-level", err)
+	}
 	if os.Getenv("DEBUG") != "" {
 		logLevel = slog.LevelDebug
 	}
@@ -76,7 +136,7 @@ func runChat(cmd *cobra.Command, args []string) {
 	dbFile := filepath.Join(dataDir, "chat.db")
 
 	// Load or generate keys
-	pubkey, privkey, err := loadOrGenerateKeys(keyFile)
+	pubkey, privkey, err := loadOrGenerateKeys(keyFile, getKeyPassphrase())
 	if err != nil {
 		slog.Error("Key management error", "error", err)
 		exitWithError("Key management error", err)
@@ -86,12 +146,17 @@ func runChat(cmd *cobra.Command, args []string) {
 	copy(myID[:], pubkey)
 
 	hexID := hex.EncodeToString(myID[:])
-	fmt.Printf("Your ID: %s\n", hexID)
-	fmt.Printf("Connecting to router at %s...\n", chatRouterAddr)
+	fmt.Fprintf(infoOut, "Your ID: %s\n", hexID)
+	fmt.Fprintf(infoOut, "Connecting to router at %s...\n", chatRouterAddr)
 	slog.Info("Loaded keys", "myID", hexID)
 
 	// Create router client
 	client := router.NewClient(pubkey, privkey)
+	// Key exchanges and offers to several contacts go out as one batch.
+	// Older routers don't know batches, so it is opt-in
+	if chatBatchSignaling {
+		client.SetBatchWindow(router.DefaultBatchWindow)
+	}
 	slog.Debug("Created router client")
 
 	// Create context for application lifecycle
@@ -133,75 +198,151 @@ func runChat(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	fmt.Println("✓ Connected to router")
+	defer client.Close()
+
+	fmt.Fprintln(infoOut, "✓ Connected to router")
 	slog.Info("Successfully connected to router")
 
+	// Create storage
+	slog.Debug("Opening database", "path", dbFile)
+	storage, err := chat.NewStorage(dbFile)
+	if err != nil {
+		slog.Error("Failed to open database", "path", dbFile, "error", err)
+		exitWithError("Failed to open database", err)
+	}
+	defer storage.Close()
+	fmt.Fprintln(infoOut, "Database opened")
+	slog.Info("Database opened", "path", dbFile)
+
+	blacklist, err := storage.GetBlockedPeers()
+	if err != nil {
+		exitWithError("Failed to load blocked peers", err)
+	}
+
 	// Create P2P connector
 	stunServers := getSTUNServers(chatSTUNServers)
 	connectorCfg := p2p.ConnectorConfig{
-		STUNServers: stunServers,
+		STUNServers:   stunServers,
+		TURNServers:   turnServers,
+		RelayFallback: true,
+		// 0 keeps the connector defaults
+		KeyExchangeTimeout:   keyExchangeTimeout,
+		ICEConnectionTimeout: answerTimeout,
+		ICEGatheringTimeout:  iceGatherTimeout,
+		EnableLocalDiscovery: chatLocalDiscovery,
+		// Contacts connect as soon as the router reports them online
+		AutoConnect: func(peerID router.PeerID) bool {
+			contact, err := storage.GetContact(peerID)
+			return err == nil && !contact.IsBlocked
+		},
+		// Blocks survive restarts, including peers that are not contacts
+		Blacklist: blacklist,
+		BlacklistChanged: func(peerID router.PeerID, blocked bool) {
+			if err := storage.SetPeerBlocked(peerID, blocked); err != nil {
+				slog.Error("Failed to save blacklist change", "peerID", hex.EncodeToString(peerID[:8])+"...", "error", err)
+			}
+		},
 	}
-	slog.Debug("Creating P2P connector with encryption", "stunServers", connectorCfg.STUNServers)
+	slog.Debug("Creating P2P connector with encryption", "stunServers", connectorCfg.STUNServers, "turnServers", len(turnServers))
 	connector, err := p2p.NewConnector(client, connectorCfg, income, privkey)
 	if err != nil {
 		slog.Error("Failed to create P2P connector", "error", err)
 		log.Fatal("Failed to create P2P connector:", err)
 	}
-	fmt.Println("P2P connector initialized with end-to-end encryption")
+	fmt.Fprintln(infoOut, "P2P connector initialized with end-to-end encryption")
 	slog.Info("P2P connector initialized with encryption")
 
-	// Create storage
-	slog.Debug("Opening database", "path", dbFile)
-	storage, err := chat.NewStorage(dbFile)
-	if err != nil {
-		slog.Error("Failed to open database", "path", dbFile, "error", err)
-		exitWithError("Failed to open database", err)
-	}
-	defer storage.Close()
-	fmt.Println("Database opened")
-	slog.Info("Database opened", "path", dbFile)
-
 	// Create chat
 	slog.Debug("Creating chat instance")
 	chatInstance := chat.NewChat(connector, storage, dataDir)
 	defer chatInstance.Close()
-	fmt.Println("Chat initialized")
+	chatInstance.SetReconnectCooldown(reconnectCooldown)
+	chatInstance.SetFileConcurrency(chatFileConcurrency)
+	chatInstance.SetTransferLimits(chatMaxTransfersPerPeer, chatMaxTransfers)
+	chatInstance.SetTransferRateLimit(maxUploadRate)
+	// Without a flag or environment variable the saved folder is kept
+	if dir := cmp.Or(chatDownloadDir, os.Getenv("SENDY_DOWNLOAD_DIR")); dir != "" {
+		dir, err := expandHome(dir)
+		if err != nil {
+			exitWithError("Invalid download dir", err)
+		}
+		if err := chatInstance.SetDownloadDir(dir); err != nil {
+			exitWithError("Invalid download dir", err)
+		}
+	}
+	slog.Info("Saving received files", "dir", chatInstance.DownloadDir())
+	if autoPurgeAfter > 0 {
+		deleted, err := chatInstance.PurgeOldMessages(autoPurgeAfter)
+		if err != nil {
+			slog.Error("Failed to purge old messages", "error", err)
+		} else if deleted > 0 {
+			fmt.Fprintf(infoOut, "Purged %d messages older than %s\n", deleted, chatAutoPurgeAfter)
+			slog.Info("Purged old messages", "count", deleted, "olderThan", autoPurgeAfter)
+		}
+	}
+	fmt.Fprintln(infoOut, "Chat initialized")
 	slog.Info("Chat initialized")
 
-	fmt.Println("\nStarting TUI...")
-	fmt.Println()
-	slog.Info("Starting TUI")
+	switch {
+	case chatNoTUI && chatSendPeer != "":
+		slog.Info("Sending one-shot message", "peerID", chatSendPeer)
+		if err := chat.SendOnce(chatInstance, chatSendPeer, chatSendMsg, oneShotTimeout, os.Stdout); err != nil {
+			slog.Error("One-shot send failed", "error", err)
+			exitWithError("Send failed", err)
+		}
+
+	case chatNoTUI:
+		slog.Info("Starting JSON mode")
+		if err := chat.RunJSON(chatInstance, myID, os.Stdin, os.Stdout); err != nil {
+			slog.Error("JSON mode error", "error", err)
+			exitWithError("JSON mode error", err)
+		}
 
-	// Start TUI
-	if err := chat.RunTUI(chatInstance, myID); err != nil {
-		slog.Error("TUI error", "error", err)
-		exitWithError("TUI error", err)
+	default:
+		fmt.Println("\nStarting TUI...")
+		fmt.Println()
+		slog.Info("Starting TUI")
+
+		// Start TUI
+		chatInstance.SetMarkdownEnabled(!chatNoMarkdown)
+		opts := chat.TUIOptions{
+			SortOrder:         configContactSort,
+			SaveSortOrder:     saveContactSort,
+			ContactsWidth:     configContactsWidth,
+			SaveContactsWidth: saveContactsWidth,
+			NoMouse:           chatNoMouse,
+		}
+		if err := chat.RunTUI(chatInstance, myID, opts); err != nil {
+			slog.Error("TUI error", "error", err)
+			exitWithError("TUI error", err)
+		}
 	}
 
 	slog.Info("Chat exiting gracefully")
 }
 
-func loadOrGenerateKeys(keyFile string) (ed25519.PublicKey, ed25519.PrivateKey, error) {
+// loadOrGenerateKeys loads the private key, decrypting it with passphrase
+// if the file is locked. A new key is encrypted if passphrase is not empty
+func loadOrGenerateKeys(keyFile, passphrase string) (ed25519.PublicKey, ed25519.PrivateKey, error) {
 	// Try to load existing keys
 	slog.Debug("Attempting to load keys", "path", keyFile)
 	data, err := os.ReadFile(keyFile)
 	if err == nil {
 		// File exists
-		if len(data) != ed25519.PrivateKeySize {
-			slog.Error("Invalid key file size", "path", keyFile, "size", len(data), "expected", ed25519.PrivateKeySize)
-			return nil, nil, fmt.Errorf("invalid key file size")
+		privkey, err := parseKeyFile(data, passphrase)
+		if err != nil {
+			slog.Error("Failed to load key file", "path", keyFile, "error", err)
+			return nil, nil, err
 		}
-
-		privkey := ed25519.PrivateKey(data)
 		pubkey := privkey.Public().(ed25519.PublicKey)
 
-		fmt.Println("Loaded existing keys")
-		slog.Info("Loaded existing keys from file", "path", keyFile)
+		fmt.Fprintln(infoOut, "Loaded existing keys")
+		slog.Info("Loaded existing keys from file", "path", keyFile, "encrypted", isEncryptedKey(data))
 		return pubkey, privkey, nil
 	}
 
 	// Generate new keys
-	fmt.Println("Generating new keypair...")
+	fmt.Fprintln(infoOut, "Generating new keypair...")
 	slog.Info("Generating new keypair", "reason", "key file not found")
 	pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
@@ -210,21 +351,36 @@ func loadOrGenerateKeys(keyFile string) (ed25519.PublicKey, ed25519.PrivateKey,
 	}
 
 	// Save private key
-	slog.Debug("Saving private key", "path", keyFile)
-	if err := os.WriteFile(keyFile, privkey, 0600); err != nil {
+	slog.Debug("Saving private key", "path", keyFile, "encrypted", passphrase != "")
+	if err := writeKeyFile(keyFile, privkey, passphrase, defaultArgonParams()); err != nil {
 		slog.Error("Failed to save key", "path", keyFile, "error", err)
 		return nil, nil, fmt.Errorf("save key: %w", err)
 	}
 
-	fmt.Println("New keys generated and saved")
+	fmt.Fprintln(infoOut, "New keys generated and saved")
 	slog.Info("New keys generated and saved", "path", keyFile)
 	return pubkey, privkey, nil
 }
 
+// defaultSTUNServers are the verified servers used when nothing is configured.
+// Only tested working servers
+var defaultSTUNServers = []string{
+	// Google (popular, reliable, ~0.15s)
+	"stun:stun.l.google.com:19302",
+	"stun:stun1.l.google.com:19302",
+
+	// Cloudflare (fastest, ~0.05s)
+	"stun:stun.cloudflare.com:3478",
+
+	// Twilio (production-ready, ~0.17s)
+	"stun:global.stun.twilio.com:3478",
+}
+
 // getSTUNServers returns STUN server list with priority:
 // 1. From --stun-servers flag
 // 2. From SENDY_STUN_SERVERS environment variable
-// 3. Default verified servers (Google + Cloudflare + Twilio)
+// 3. From stun_servers in the config file
+// 4. Default verified servers (Google + Cloudflare + Twilio)
 func getSTUNServers(flagValue string) []string {
 	// Priority 1: command line flag
 	if flagValue != "" {
@@ -248,19 +404,117 @@ func getSTUNServers(flagValue string) []string {
 		return servers
 	}
 
-	// Priority 3: default verified servers
-	// Only tested working servers
-	defaultServers := []string{
-		// Google (popular, reliable, ~0.15s)
-		"stun:stun.l.google.com:19302",
-		"stun:stun1.l.google.com:19302",
+	// Priority 3: config file
+	if len(configSTUNServers) > 0 {
+		slog.Info("Using STUN servers from config", "servers", configSTUNServers)
+		return configSTUNServers
+	}
+
+	// Priority 4: default verified servers
+	slog.Debug("Using default STUN servers", "servers", defaultSTUNServers)
+	return defaultSTUNServers
+}
+
+// getTimeout returns the flag value, or the environment variable when the
+// flag is not set. 0 means the connector default
+func getTimeout(flagValue time.Duration, env string) (time.Duration, error) {
+	timeout := flagValue
+	if timeout == 0 {
+		if value := os.Getenv(env); value != "" {
+			var err error
+			if timeout, err = time.ParseDuration(value); err != nil {
+				return 0, fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("negative timeout %v", timeout)
+	}
+	return timeout, nil
+}
+
+// parseByteRate parses a rate in bytes per second such as 500K, 2MB or
+// 1048576. Suffixes are powers of 1024, "" and "0" mean unlimited
+func parseByteRate(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S")
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := 1.0
+	for _, unit := range []struct {
+		suffix string
+		size   float64
+	}{
+		{"GB", 1 << 30}, {"G", 1 << 30},
+		{"MB", 1 << 20}, {"M", 1 << 20},
+		{"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	} {
+		if number, ok := strings.CutSuffix(value, unit.suffix); ok {
+			value, multiplier = number, unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q: use bytes per second like 500K or 2MB", s)
+	}
+	return int64(n * multiplier), nil
+}
+
+// parseAge parses a message age such as 90d, 2w or 36h. Days and weeks are
+// added to the Go duration syntax, "" and "0" mean no limit
+func parseAge(s string) (time.Duration, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	for _, unit := range []struct {
+		suffix string
+		size   time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+	} {
+		if number, ok := strings.CutSuffix(value, unit.suffix); ok {
+			n, err := strconv.ParseFloat(number, 64)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid age %q: use a duration like 90d, 2w or 36h", s)
+			}
+			return time.Duration(n * float64(unit.size)), nil
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q: use a duration like 90d, 2w or 36h", s)
+	}
+	return d, nil
+}
 
-		// Cloudflare (fastest, ~0.05s)
-		"stun:stun.cloudflare.com:3478",
+// getTURNServers returns TURN servers from the --turn-server flag or the
+// SENDY_TURN_SERVER environment variable. All URLs share one set of
+// credentials: --turn-user/--turn-pass or SENDY_TURN_USER/SENDY_TURN_PASS
+func getTURNServers(flagURLs, flagUser, flagPass string) ([]p2p.TURNServer, error) {
+	urls := cmp.Or(flagURLs, os.Getenv("SENDY_TURN_SERVER"))
+	user := cmp.Or(flagUser, os.Getenv("SENDY_TURN_USER"))
+	pass := cmp.Or(flagPass, os.Getenv("SENDY_TURN_PASS"))
+
+	if urls == "" {
+		if user != "" || pass != "" {
+			return nil, fmt.Errorf("TURN credentials are set but no TURN server is given")
+		}
+		return nil, nil
+	}
+	if user == "" || pass == "" {
+		return nil, fmt.Errorf("TURN server requires a username and password")
+	}
 
-		// Twilio (production-ready, ~0.17s)
-		"stun:global.stun.twilio.com:3478",
+	var servers []p2p.TURNServer
+	for _, url := range strings.Split(urls, ",") {
+		if url = strings.TrimSpace(url); url == "" {
+			continue
+		}
+		servers = append(servers, p2p.TURNServer{URL: url, Username: user, Credential: pass})
 	}
-	slog.Debug("Using default STUN servers", "servers", defaultServers)
-	return defaultServers
+	return servers, nil
 }
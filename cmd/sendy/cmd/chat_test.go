@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/p2p"
+)
+
+func TestGetTURNServers(t *testing.T) {
+	t.Setenv("SENDY_TURN_SERVER", "")
+	t.Setenv("SENDY_TURN_USER", "")
+	t.Setenv("SENDY_TURN_PASS", "")
+	t.Cleanup(func() { chatTURNServer, chatTURNUser, chatTURNPass = "", "", "" })
+
+	flags := rootCmd.Flags()
+	if err := flags.Parse([]string{
+		"--turn-server", "turn:a.example.com:3478, turns:b.example.com",
+		"--turn-user", "alice",
+		"--turn-pass", "secret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := getTURNServers(chatTURNServer, chatTURNUser, chatTURNPass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []p2p.TURNServer{
+		{URL: "turn:a.example.com:3478", Username: "alice", Credential: "secret"},
+		{URL: "turns:b.example.com", Username: "alice", Credential: "secret"},
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Fatalf("Unexpected TURN servers from flags: %+v", servers)
+	}
+
+	// Flags override the environment, missing flags fall back to it
+	t.Setenv("SENDY_TURN_SERVER", "turn:env.example.com")
+	t.Setenv("SENDY_TURN_USER", "bob")
+	t.Setenv("SENDY_TURN_PASS", "env-secret")
+	servers, err = getTURNServers("", "carol", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []p2p.TURNServer{{URL: "turn:env.example.com", Username: "carol", Credential: "env-secret"}}
+	if !reflect.DeepEqual(servers, want) {
+		t.Fatalf("Unexpected TURN servers from environment: %+v", servers)
+	}
+
+	t.Setenv("SENDY_TURN_SERVER", "")
+	if _, err := getTURNServers("", "", ""); err == nil {
+		t.Error("Expected error for credentials without a server")
+	}
+	t.Setenv("SENDY_TURN_USER", "")
+	t.Setenv("SENDY_TURN_PASS", "")
+	if servers, err := getTURNServers("", "", ""); err != nil || servers != nil {
+		t.Errorf("Expected no TURN servers, got %+v, %v", servers, err)
+	}
+	if _, err := getTURNServers("turn:a.example.com", "alice", ""); err == nil {
+		t.Error("Expected error for a server without a password")
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	const env = "SENDY_KEY_EXCHANGE_TIMEOUT"
+
+	t.Setenv(env, "")
+	if timeout, err := getTimeout(0, env); err != nil || timeout != 0 {
+		t.Fatalf("Expected 0 for the connector default, got %v, %v", timeout, err)
+	}
+
+	// The flag overrides the environment
+	t.Setenv(env, "20s")
+	if timeout, err := getTimeout(0, env); err != nil || timeout != 20*time.Second {
+		t.Fatalf("Expected 20s from the environment, got %v, %v", timeout, err)
+	}
+	if timeout, err := getTimeout(time.Minute, env); err != nil || timeout != time.Minute {
+		t.Fatalf("Expected 1m from the flag, got %v, %v", timeout, err)
+	}
+
+	t.Setenv(env, "soon")
+	if _, err := getTimeout(0, env); err == nil {
+		t.Error("Expected error for an invalid duration")
+	}
+	if _, err := getTimeout(-time.Second, env); err == nil {
+		t.Error("Expected error for a negative timeout")
+	}
+}
+
+func TestParseByteRate(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"1048576", 1 << 20},
+		{"500K", 500 << 10},
+		{"2MB", 2 << 20},
+		{"1.5mb/s", 3 << 19},
+		{"1G", 1 << 30},
+		{"100B", 100},
+	} {
+		if got, err := parseByteRate(tc.in); err != nil || got != tc.want {
+			t.Errorf("parseByteRate(%q) = %d, %v, want %d", tc.in, got, err, tc.want)
+		}
+	}
+	for _, in := range []string{"fast", "-1M", "MB"} {
+		if _, err := parseByteRate(in); err == nil {
+			t.Errorf("Expected error for %q", in)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"90d", 90 * 24 * time.Hour},
+		{"2W", 14 * 24 * time.Hour},
+		{"1.5d", 36 * time.Hour},
+		{"36h", 36 * time.Hour},
+	} {
+		if got, err := parseAge(tc.in); err != nil || got != tc.want {
+			t.Errorf("parseAge(%q) = %v, %v, want %v", tc.in, got, err, tc.want)
+		}
+	}
+	for _, in := range []string{"old", "d", "-1d", "-5h", "90"} {
+		if _, err := parseAge(in); err == nil {
+			t.Errorf("Expected error for %q", in)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+
+	"github.com/udisondev/sendy/chat"
+)
+
+const configFileName = "config.toml"
+
+// Config mirrors the chat client flags. Flags override config values,
+// config values override built-in defaults
+type Config struct {
+	RouterAddr  string   `toml:"router_addr"`
+	STUNServers []string `toml:"stun_servers"`
+	DataDir     string   `toml:"data_dir"`
+	LogLevel    string   `toml:"log_level"`
+	ContactSort string   `toml:"contact_sort"`
+	// ContactsWidth is the TUI contacts panel width, saved when resized
+	ContactsWidth int `toml:"contacts_width,omitempty"`
+	// MaxUploadRate caps outgoing file data per second, like 2MB. Unlimited
+	// if empty
+	MaxUploadRate string `toml:"max_upload_rate,omitempty"`
+	// AutoPurgeAfter deletes older messages on startup, like 90d. History
+	// is kept forever if empty
+	AutoPurgeAfter string `toml:"auto_purge_after,omitempty"`
+}
+
+var (
+	configPath  string
+	configForce bool
+
+	// STUN servers from the config file, used after flag and environment
+	configSTUNServers []string
+	// Contact list order from the config file, the TUI saves changes to it
+	configContactSort chat.SortOrder
+	// Contacts panel width from the config file, the TUI saves changes to it
+	configContactsWidth int
+	// Config file in use, it may not exist yet
+	configFile string
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the config file",
+}
+
+var configInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Write the default config file",
+	Long:  `Write the default config to ~/.sendy/config.toml (or the --config path).`,
+	RunE:  runConfigInit,
+
+	SilenceUsage: true,
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "Config file (default: ~/.sendy/config.toml)")
+	configInitCmd.Flags().BoolVarP(&configForce, "force", "f", false, "Overwrite an existing config file")
+
+	configCmd.AddCommand(configInitCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+// defaultConfig returns the config matching the built-in flag defaults
+func defaultConfig() Config {
+	return Config{
+		RouterAddr:    "localhost:9090",
+		STUNServers:   defaultSTUNServers,
+		DataDir:       "~/.sendy",
+		LogLevel:      "info",
+		ContactSort:   chat.SortRecent.String(),
+		ContactsWidth: chat.DefaultContactsWidth,
+	}
+}
+
+// defaultConfigPath returns ~/.sendy/config.toml
+func defaultConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("determine home directory: %w", err)
+	}
+	return filepath.Join(home, ".sendy", configFileName), nil
+}
+
+// configPathFromArgs finds --config before cobra parses flags
+func configPathFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if v, ok := strings.CutPrefix(arg, "--config="); ok {
+			return v
+		}
+		if arg == "--config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// loadConfig reads the config file and applies its values as flag defaults.
+// A missing default config file is not an error, a missing --config file is
+func loadConfig(args []string) error {
+	path := configPathFromArgs(args)
+	explicit := path != ""
+	if !explicit {
+		var err error
+		if path, err = defaultConfigPath(); err != nil {
+			return err
+		}
+	}
+	configFile = path
+
+	var cfg Config
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("load config %s: %w", path, err)
+	}
+
+	if err := applyConfig(cfg); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyConfig sets chat flag defaults from the config. Flags given on the
+// command line are parsed later and override these values
+func applyConfig(cfg Config) error {
+	flags := rootCmd.Flags()
+
+	if cfg.RouterAddr != "" {
+		chatRouterAddr = cfg.RouterAddr
+		flags.Lookup("router").DefValue = cfg.RouterAddr
+	}
+	if cfg.DataDir != "" {
+		dir, err := expandHome(cfg.DataDir)
+		if err != nil {
+			return err
+		}
+		chatDataDir = dir
+		flags.Lookup("data").DefValue = dir
+	}
+	if cfg.LogLevel != "" {
+		if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+		chatLogLevel = cfg.LogLevel
+		flags.Lookup("log-level").DefValue = cfg.LogLevel
+	}
+	if cfg.ContactSort != "" {
+		order, err := chat.ParseSortOrder(cfg.ContactSort)
+		if err != nil {
+			return err
+		}
+		configContactSort = order
+	}
+	if cfg.ContactsWidth != 0 {
+		if cfg.ContactsWidth < chat.MinContactsWidth || cfg.ContactsWidth > chat.MaxContactsWidth {
+			return fmt.Errorf("invalid contacts_width %d: must be between %d and %d", cfg.ContactsWidth, chat.MinContactsWidth, chat.MaxContactsWidth)
+		}
+		configContactsWidth = cfg.ContactsWidth
+	}
+	if cfg.MaxUploadRate != "" {
+		if _, err := parseByteRate(cfg.MaxUploadRate); err != nil {
+			return err
+		}
+		chatMaxUploadRate = cfg.MaxUploadRate
+		flags.Lookup("max-upload-rate").DefValue = cfg.MaxUploadRate
+	}
+	if cfg.AutoPurgeAfter != "" {
+		if _, err := parseAge(cfg.AutoPurgeAfter); err != nil {
+			return err
+		}
+		chatAutoPurgeAfter = cfg.AutoPurgeAfter
+		flags.Lookup("auto-purge-after").DefValue = cfg.AutoPurgeAfter
+	}
+	configSTUNServers = cfg.STUNServers
+	return nil
+}
+
+// saveContactSort writes the contact list order to the config file
+func saveContactSort(order chat.SortOrder) error {
+	if configFile == "" {
+		return fmt.Errorf("no config file")
+	}
+	return setConfigValue(configFile, "contact_sort", order.String())
+}
+
+// saveContactsWidth writes the contacts panel width to the config file
+func saveContactsWidth(width int) error {
+	if configFile == "" {
+		return fmt.Errorf("no config file")
+	}
+	return setConfigLine(configFile, "contacts_width", strconv.Itoa(width))
+}
+
+// setConfigValue sets a top-level string key in the config file, creating
+// the file if needed. Other lines, comments included, are kept as is
+func setConfigValue(path, key, value string) error {
+	return setConfigLine(path, key, strconv.Quote(value))
+}
+
+// setConfigLine sets a top-level key to a value already written as TOML,
+// like a quoted string or a number
+func setConfigLine(path, key, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read config: %w", err)
+	}
+
+	line := key + " = " + value
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	// Top-level keys come before the first table
+	end := len(lines)
+	replaced := false
+	for i, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, "[") {
+			end = i
+			break
+		}
+		if name, _, ok := strings.Cut(trimmed, "="); ok && strings.TrimSpace(name) == key {
+			lines[i] = line
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		lines = slices.Insert(lines, end, line)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create config directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	return nil
+}
+
+// parseLogLevel parses debug, info, warn or error
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q: use debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// expandHome replaces a leading ~ with the home directory
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("determine home directory: %w", err)
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+func runConfigInit(cmd *cobra.Command, args []string) error {
+	path := configPath
+	if path == "" {
+		var err error
+		if path, err = defaultConfigPath(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(path); err == nil && !configForce {
+		return fmt.Errorf("config file %s already exists (use --force to overwrite)", path)
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(defaultConfig()); err != nil {
+		return fmt.Errorf("encode config: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create config directory: %w", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+
+	fmt.Println("Config written to", path)
+	return nil
+}
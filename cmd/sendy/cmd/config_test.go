@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/udisondev/sendy/chat"
+)
+
+func TestSetConfigValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+
+	// A missing file is created
+	if err := setConfigValue(path, "contact_sort", "name"); err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	if _, err := toml.DecodeFile(path, &cfg); err != nil || cfg.ContactSort != "name" {
+		t.Fatalf("Expected contact_sort in new file, got %+v, %v", cfg, err)
+	}
+
+	// Existing keys and comments are kept, the value is replaced in place
+	orig := "# my router\nrouter_addr = \"example.com:9090\"\ncontact_sort = \"name\"\n\n[extra]\ncontact_sort = \"other\"\n"
+	if err := os.WriteFile(path, []byte(orig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setConfigValue(path, "contact_sort", chat.SortLastSeen.String()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# my router\nrouter_addr = \"example.com:9090\"\ncontact_sort = \"last_seen\"\n\n[extra]\ncontact_sort = \"other\"\n"
+	if string(data) != want {
+		t.Fatalf("Unexpected config:\n%s", data)
+	}
+
+	// A new key goes before the first table
+	if err := setConfigValue(path, "log_level", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Config
+		Extra map[string]any `toml:"extra"`
+	}
+	if _, err := toml.DecodeFile(path, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.LogLevel != "debug" || decoded.ContactSort != "last_seen" || decoded.Extra["log_level"] != nil {
+		t.Fatalf("Unexpected config: %+v", decoded)
+	}
+
+	// Numbers are written unquoted
+	if err := setConfigLine(path, "contacts_width", "40"); err != nil {
+		t.Fatal(err)
+	}
+	cfg = Config{}
+	if _, err := toml.DecodeFile(path, &cfg); err != nil || cfg.ContactsWidth != 40 || cfg.ContactSort != "last_seen" {
+		t.Fatalf("Expected contacts_width 40, got %+v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/udisondev/sendy/chat"
+)
+
+var (
+	contactsOutput string
+	contactsInput  string
+)
+
+var contactsCmd = &cobra.Command{
+	Use:   "contacts",
+	Short: "Export or import the address book",
+	Long: `Move the address book between devices as a JSON file:
+an array of {"peer_id": "<hex>", "name": "<string>"} objects.`,
+}
+
+var contactsExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export contacts to a JSON file",
+	Long: `Write all contacts (without groups and message history) to a JSON file.
+
+Example:
+  sendy contacts export --output contacts.json`,
+	RunE: runContactsExport,
+
+	SilenceUsage: true,
+}
+
+var contactsImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import contacts from a JSON file",
+	Long: `Add contacts from a file written by "sendy contacts export".
+Existing contacts take the name from the file. Invalid entries are skipped.
+
+Example:
+  sendy contacts import --input contacts.json`,
+	RunE: runContactsImport,
+
+	SilenceUsage: true,
+}
+
+func init() {
+	contactsExportCmd.Flags().StringVarP(&contactsOutput, "output", "o", "", "JSON file to create")
+	contactsExportCmd.Flags().StringVarP(&chatDataDir, "data", "d", "", "Base directory (default: ~/.sendy)")
+	contactsExportCmd.MarkFlagRequired("output")
+
+	contactsImportCmd.Flags().StringVarP(&contactsInput, "input", "i", "", "JSON file to import")
+	contactsImportCmd.Flags().StringVarP(&chatDataDir, "data", "d", "", "Base directory (default: ~/.sendy)")
+	contactsImportCmd.MarkFlagRequired("input")
+
+	contactsCmd.AddCommand(contactsExportCmd)
+	contactsCmd.AddCommand(contactsImportCmd)
+	rootCmd.AddCommand(contactsCmd)
+}
+
+func runContactsExport(cmd *cobra.Command, args []string) error {
+	// An existing file is most likely a mistake, like with backup
+	if _, err := os.Stat(contactsOutput); err == nil {
+		return fmt.Errorf("%s already exists", contactsOutput)
+	}
+
+	storage, err := openExistingStorage()
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	f, err := os.OpenFile(contactsOutput, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := storage.ExportContacts(f); err != nil {
+		f.Close()
+		os.Remove(contactsOutput)
+		return fmt.Errorf("export contacts: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", contactsOutput, err)
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Contacts exported to %s\n", contactsOutput)
+	return nil
+}
+
+func runContactsImport(cmd *cobra.Command, args []string) error {
+	f, err := os.Open(contactsInput)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dbFile, err := chatDBFile()
+	if err != nil {
+		return err
+	}
+	// Importing into a fresh installation creates the database
+	if err := os.MkdirAll(filepath.Dir(dbFile), 0700); err != nil {
+		return fmt.Errorf("create data directory: %w", err)
+	}
+
+	storage, err := chat.NewStorage(dbFile)
+	if err != nil {
+		return fmt.Errorf("open chat database: %w", err)
+	}
+	defer storage.Close()
+
+	imported, err := storage.ImportContacts(f)
+	fmt.Fprintf(cmd.ErrOrStderr(), "Imported %d contacts from %s\n", imported, contactsInput)
+	if err != nil {
+		return fmt.Errorf("import contacts: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/udisondev/sendy/chat"
+	"github.com/udisondev/sendy/router"
+)
+
+var (
+	exportPeer   string
+	exportFormat string
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export a conversation to stdout",
+	Long: `Export the message history with a peer to stdout as JSON or CSV.
+
+Example:
+  sendy export --peer <hex_id> --format csv > chat.csv`,
+	RunE: runExport,
+
+	SilenceUsage: true,
+}
+
+func init() {
+	exportCmd.Flags().StringVar(&exportPeer, "peer", "", "Peer ID (hex) of the conversation to export")
+	exportCmd.Flags().StringVar(&exportFormat, "format", "json", "Output format: json or csv")
+	exportCmd.Flags().StringVarP(&chatDataDir, "data", "d", "", "Base directory (default: ~/.sendy)")
+	exportCmd.MarkFlagRequired("peer")
+
+	rootCmd.AddCommand(exportCmd)
+}
+
+func runExport(cmd *cobra.Command, args []string) error {
+	format, err := chat.ParseExportFormat(exportFormat)
+	if err != nil {
+		return err
+	}
+
+	peerIDBytes, err := hex.DecodeString(exportPeer)
+	if err != nil {
+		return fmt.Errorf("invalid peer id: %w", err)
+	}
+	if len(peerIDBytes) != router.PeerIDSize {
+		return fmt.Errorf("invalid peer id size: got %d, expected %d", len(peerIDBytes), router.PeerIDSize)
+	}
+	var peerID router.PeerID
+	copy(peerID[:], peerIDBytes)
+
+	storage, err := openExistingStorage()
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	return storage.ExportConversation(peerID, format, os.Stdout)
+}
+
+// chatDBFile returns the chat database path under the base directory
+func chatDBFile() (string, error) {
+	baseDir, err := chatBaseDir()
+	if err != nil {
+		return "", fmt.Errorf("determine home directory: %w", err)
+	}
+	return filepath.Join(baseDir, "data", "chat.db"), nil
+}
+
+// openExistingStorage opens the chat database. NewStorage creates a missing
+// database, commands that only read it must not
+func openExistingStorage() (*chat.Storage, error) {
+	dbFile, err := chatDBFile()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dbFile); err != nil {
+		return nil, fmt.Errorf("open chat database: %w", err)
+	}
+
+	storage, err := chat.NewStorage(dbFile)
+	if err != nil {
+		return nil, fmt.Errorf("open chat database: %w", err)
+	}
+	return storage, nil
+}
@@ -0,0 +1,314 @@
+package cmd
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The key file holds either the raw 64-byte Ed25519 private key or, when it
+// is locked with a passphrase, a JSON envelope with the encrypted key and
+// the parameters needed to decrypt it. The version field lets later
+// releases change the algorithms without breaking existing files.
+
+const (
+	keyFileVersion = 1
+	keyFileKDF     = "argon2id"
+	keyFileCipher  = "chacha20poly1305"
+
+	keySaltSize = 16
+)
+
+// Default Argon2id parameters, following the RFC 9106 recommendation for
+// memory-constrained environments
+const (
+	defaultArgonTime    = 3
+	defaultArgonMemory  = 64 // MiB
+	defaultArgonThreads = 4
+)
+
+var errKeyLocked = errors.New("key file is encrypted, set --key-passphrase or SENDY_KEY_PASSPHRASE")
+var errWrongPassphrase = errors.New("wrong passphrase or corrupted key file")
+
+// argonParams are the tunable Argon2id parameters
+type argonParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+}
+
+// defaultArgonParams returns the parameters used when none are given
+func defaultArgonParams() argonParams {
+	return argonParams{
+		Time:    defaultArgonTime,
+		Memory:  defaultArgonMemory * 1024,
+		Threads: defaultArgonThreads,
+	}
+}
+
+// encryptedKeyFile is the JSON envelope of a locked key file
+type encryptedKeyFile struct {
+	Version    int         `json:"version"`
+	KDF        string      `json:"kdf"`
+	Argon      argonParams `json:"argon2"`
+	Salt       []byte      `json:"salt"`
+	Cipher     string      `json:"cipher"`
+	Nonce      []byte      `json:"nonce"`
+	Ciphertext []byte      `json:"ciphertext"`
+}
+
+var (
+	keyPassphrase   string
+	lockArgonTime   uint32
+	lockArgonMemory uint32
+	lockArgonThread uint8
+)
+
+var lockKeyCmd = &cobra.Command{
+	Use:   "lock-key",
+	Short: "Encrypt the private key file with a passphrase",
+	Long: `Encrypt the private key file with a passphrase. The encryption key is
+derived with Argon2id, the private key is encrypted with ChaCha20-Poly1305.
+The chat client then needs the passphrase on every start.
+
+The passphrase is taken from --key-passphrase or SENDY_KEY_PASSPHRASE.
+
+Example:
+  SENDY_KEY_PASSPHRASE='correct horse battery staple' sendy lock-key`,
+	RunE: runLockKey,
+
+	SilenceUsage: true,
+}
+
+var unlockKeyCmd = &cobra.Command{
+	Use:   "unlock-key",
+	Short: "Store the private key file without a passphrase",
+	Long: `Decrypt the private key file and store it unencrypted with permissions
+0600, as before "sendy lock-key".
+
+Example:
+  SENDY_KEY_PASSPHRASE='correct horse battery staple' sendy unlock-key`,
+	RunE: runUnlockKey,
+
+	SilenceUsage: true,
+}
+
+func init() {
+	rootCmd.Flags().StringVar(&keyPassphrase, "key-passphrase", "", "Passphrase of the encrypted key file (visible in the process list, prefer SENDY_KEY_PASSPHRASE)")
+
+	def := defaultArgonParams()
+	lockKeyCmd.Flags().StringVarP(&chatDataDir, "data", "d", "", "Base directory (default: ~/.sendy)")
+	lockKeyCmd.Flags().StringVar(&keyPassphrase, "key-passphrase", "", "New passphrase (visible in the process list, prefer SENDY_KEY_PASSPHRASE)")
+	lockKeyCmd.Flags().Uint32Var(&lockArgonTime, "argon-time", def.Time, "Argon2id passes over memory")
+	lockKeyCmd.Flags().Uint32Var(&lockArgonMemory, "argon-memory", defaultArgonMemory, "Argon2id memory in MiB")
+	lockKeyCmd.Flags().Uint8Var(&lockArgonThread, "argon-threads", def.Threads, "Argon2id parallelism")
+
+	unlockKeyCmd.Flags().StringVarP(&chatDataDir, "data", "d", "", "Base directory (default: ~/.sendy)")
+	unlockKeyCmd.Flags().StringVar(&keyPassphrase, "key-passphrase", "", "Current passphrase (visible in the process list, prefer SENDY_KEY_PASSPHRASE)")
+
+	rootCmd.AddCommand(lockKeyCmd)
+	rootCmd.AddCommand(unlockKeyCmd)
+}
+
+// getKeyPassphrase returns --key-passphrase or SENDY_KEY_PASSPHRASE
+func getKeyPassphrase() string {
+	return cmp.Or(keyPassphrase, os.Getenv("SENDY_KEY_PASSPHRASE"))
+}
+
+// keyFilePath returns the private key file in the data directory
+func keyFilePath() (string, error) {
+	baseDir, err := chatBaseDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine home directory: %w", err)
+	}
+	return filepath.Join(baseDir, "data", "key"), nil
+}
+
+func runLockKey(cmd *cobra.Command, args []string) error {
+	passphrase := getKeyPassphrase()
+	if passphrase == "" {
+		return fmt.Errorf("set the passphrase with --key-passphrase or SENDY_KEY_PASSPHRASE")
+	}
+	params := argonParams{Time: lockArgonTime, Memory: lockArgonMemory * 1024, Threads: lockArgonThread}
+	if params.Time == 0 || params.Memory == 0 || params.Threads == 0 {
+		return fmt.Errorf("argon2 parameters must be positive")
+	}
+
+	keyFile, err := keyFilePath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("read key file: %w", err)
+	}
+	if isEncryptedKey(data) {
+		return fmt.Errorf("%s is already encrypted, run \"sendy unlock-key\" first", keyFile)
+	}
+	privkey, err := parseKeyFile(data, "")
+	if err != nil {
+		return err
+	}
+
+	if err := writeKeyFile(keyFile, privkey, passphrase, params); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Key file %s encrypted\n", keyFile)
+	return nil
+}
+
+func runUnlockKey(cmd *cobra.Command, args []string) error {
+	keyFile, err := keyFilePath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("read key file: %w", err)
+	}
+	if !isEncryptedKey(data) {
+		return fmt.Errorf("%s is not encrypted", keyFile)
+	}
+	privkey, err := parseKeyFile(data, getKeyPassphrase())
+	if err != nil {
+		return err
+	}
+
+	if err := writeKeyFile(keyFile, privkey, "", argonParams{}); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Key file %s stored without passphrase\n", keyFile)
+	return nil
+}
+
+// isEncryptedKey reports whether the key file content is a JSON envelope.
+// A file of raw key size is a raw key even if its first byte is '{'
+func isEncryptedKey(data []byte) bool {
+	if len(data) == ed25519.PrivateKeySize {
+		return false
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// parseKeyFile returns the private key from a raw or encrypted key file
+func parseKeyFile(data []byte, passphrase string) (ed25519.PrivateKey, error) {
+	if !isEncryptedKey(data) {
+		if len(data) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("invalid key file size: %d bytes (expected %d)", len(data), ed25519.PrivateKeySize)
+		}
+		return ed25519.PrivateKey(data), nil
+	}
+
+	var env encryptedKeyFile
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("parse encrypted key file: %w", err)
+	}
+	if env.Version != keyFileVersion || env.KDF != keyFileKDF || env.Cipher != keyFileCipher {
+		return nil, fmt.Errorf("unsupported key file: version %d, %s, %s", env.Version, env.KDF, env.Cipher)
+	}
+	if passphrase == "" {
+		return nil, errKeyLocked
+	}
+
+	aead, err := keyFileAEAD(passphrase, env.Salt, env.Argon)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid key file nonce size: %d", len(env.Nonce))
+	}
+	privkey, err := aead.Open(nil, env.Nonce, env.Ciphertext, keyFileAD(env.Version))
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	if len(privkey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid decrypted key size: %d bytes", len(privkey))
+	}
+	return ed25519.PrivateKey(privkey), nil
+}
+
+// encryptKey builds the JSON envelope of a private key locked with passphrase
+func encryptKey(privkey ed25519.PrivateKey, passphrase string, params argonParams) ([]byte, error) {
+	env := encryptedKeyFile{
+		Version: keyFileVersion,
+		KDF:     keyFileKDF,
+		Argon:   params,
+		Salt:    make([]byte, keySaltSize),
+		Cipher:  keyFileCipher,
+		Nonce:   make([]byte, chacha20poly1305.NonceSize),
+	}
+	if _, err := rand.Read(env.Salt); err != nil {
+		return nil, fmt.Errorf("generate salt: %w", err)
+	}
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	aead, err := keyFileAEAD(passphrase, env.Salt, params)
+	if err != nil {
+		return nil, err
+	}
+	env.Ciphertext = aead.Seal(nil, env.Nonce, privkey, keyFileAD(env.Version))
+	return json.MarshalIndent(env, "", "  ")
+}
+
+// keyFileAEAD derives the file encryption key from the passphrase
+func keyFileAEAD(passphrase string, salt []byte, params argonParams) (cipher.AEAD, error) {
+	// SECURITY: Reject parameters that would make the derivation trivial
+	// or exhaust memory when reading a tampered file
+	if len(salt) < keySaltSize {
+		return nil, fmt.Errorf("key file salt too short: %d bytes", len(salt))
+	}
+	if params.Time == 0 || params.Threads == 0 || params.Memory < 8*uint32(params.Threads) || params.Memory > 4*1024*1024 {
+		return nil, fmt.Errorf("invalid argon2 parameters: time=%d memory=%dKiB threads=%d", params.Time, params.Memory, params.Threads)
+	}
+
+	key := argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, chacha20poly1305.KeySize)
+	aead, err := chacha20poly1305.New(key)
+	clear(key)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// keyFileAD binds the ciphertext to the file format version
+func keyFileAD(version int) []byte {
+	return fmt.Appendf(nil, "sendy-key-v%d", version)
+}
+
+// writeKeyFile replaces the key file, encrypted if passphrase is not empty.
+// The new content is written to a temporary file first, so a failure never
+// leaves a truncated key behind
+func writeKeyFile(keyFile string, privkey ed25519.PrivateKey, passphrase string, params argonParams) error {
+	data := []byte(privkey)
+	if passphrase != "" {
+		var err error
+		data, err = encryptKey(privkey, passphrase, params)
+		if err != nil {
+			return fmt.Errorf("encrypt key: %w", err)
+		}
+	}
+
+	tmp := keyFile + ".tmp"
+	os.Remove(tmp)
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write key file: %w", err)
+	}
+	if err := os.Rename(tmp, keyFile); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("replace key file: %w", err)
+	}
+	return nil
+}
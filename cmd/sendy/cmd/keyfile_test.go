@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testArgonParams keep the derivation fast in tests
+var testArgonParams = argonParams{Time: 1, Memory: 64, Threads: 1}
+
+func TestKeyFileEncryption(t *testing.T) {
+	_, privkey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key")
+
+	// Without a passphrase the raw key is stored as before
+	if err := writeKeyFile(keyFile, privkey, "", testArgonParams); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isEncryptedKey(data) || !bytes.Equal(data, privkey) {
+		t.Fatal("Expected raw key file")
+	}
+	if got, err := parseKeyFile(data, "ignored"); err != nil || !got.Equal(privkey) {
+		t.Fatalf("Expected raw key, got %v", err)
+	}
+
+	// A raw key may start with '{' like a JSON envelope
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = '{'
+	braceKey := ed25519.NewKeyFromSeed(seed)
+	if isEncryptedKey(braceKey) {
+		t.Fatal("Raw key starting with '{' detected as encrypted")
+	}
+	if got, err := parseKeyFile(braceKey, ""); err != nil || !got.Equal(braceKey) {
+		t.Fatalf("Expected raw key, got %v", err)
+	}
+
+	if err := writeKeyFile(keyFile, privkey, "secret", testArgonParams); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedKey(data) || bytes.Contains(data, privkey) {
+		t.Fatal("Expected encrypted key file")
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected permissions 0600, got %v", info.Mode().Perm())
+	}
+
+	got, err := parseKeyFile(data, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(privkey) {
+		t.Fatal("Decrypted key differs")
+	}
+	if _, err := parseKeyFile(data, ""); !errors.Is(err, errKeyLocked) {
+		t.Fatalf("Expected errKeyLocked, got %v", err)
+	}
+	if _, err := parseKeyFile(data, "wrong"); !errors.Is(err, errWrongPassphrase) {
+		t.Fatalf("Expected errWrongPassphrase, got %v", err)
+	}
+}
+
+func TestKeyFileEnvelope(t *testing.T) {
+	_, privkey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := encryptKey(privkey, "secret", testArgonParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(env *encryptedKeyFile)
+	}{
+		{"unknown version", func(env *encryptedKeyFile) { env.Version = 2 }},
+		{"unknown kdf", func(env *encryptedKeyFile) { env.KDF = "scrypt" }},
+		{"short salt", func(env *encryptedKeyFile) { env.Salt = env.Salt[:4] }},
+		{"huge memory", func(env *encryptedKeyFile) { env.Argon.Memory = 1 << 31 }},
+		{"zero time", func(env *encryptedKeyFile) { env.Argon.Time = 0 }},
+		{"changed params", func(env *encryptedKeyFile) { env.Argon.Time = 2 }},
+		{"tampered ciphertext", func(env *encryptedKeyFile) { env.Ciphertext[0] ^= 0xff }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var env encryptedKeyFile
+			if err := json.Unmarshal(data, &env); err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(&env)
+			modified, err := json.Marshal(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := parseKeyFile(modified, "secret"); err == nil {
+				t.Fatal("Expected error")
+			}
+		})
+	}
+}
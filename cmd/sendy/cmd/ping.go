@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/udisondev/sendy/p2p"
+	"github.com/udisondev/sendy/router"
+)
+
+// pingReplyTimeout limits the wait for a single ping reply
+const pingReplyTimeout = 5 * time.Second
+
+var (
+	pingPeer     string
+	pingCount    int
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+	pingLogLevel string
+)
+
+var pingCmd = &cobra.Command{
+	Use:   "ping",
+	Short: "Check that a peer is reachable over P2P",
+	Long: `Connect to a peer through the router, send ping requests over the
+encrypted data channel and print the round-trip time of each, like ICMP ping.
+Exits with code 1 if the peer cannot be reached or does not reply.
+
+Ping uses a throwaway identity, so a running chat with your key stays
+connected. Peers that accept connections only from contacts reject it.
+
+Example:
+  sendy ping --peer <hex_id> --router localhost:9090 --count 3`,
+	RunE: runPing,
+
+	SilenceUsage: true,
+}
+
+func init() {
+	pingCmd.Flags().StringVar(&pingPeer, "peer", "", "Peer ID (hex) to ping")
+	pingCmd.Flags().StringVarP(&chatRouterAddr, "router", "r", "localhost:9090", "Router server address (host:port, unix:///path or ws(s)://host/ws)")
+	pingCmd.Flags().IntVarP(&pingCount, "count", "c", 3, "Number of pings to send")
+	pingCmd.Flags().DurationVarP(&pingInterval, "interval", "i", time.Second, "Wait between pings")
+	pingCmd.Flags().DurationVar(&pingTimeout, "timeout", oneShotTimeout, "Give up if the router or the peer is not reachable within this time")
+	pingCmd.Flags().StringVarP(&chatSTUNServers, "stun-servers", "s", "", "Comma-separated STUN servers (default: Google+Cloudflare+Twilio)")
+	pingCmd.Flags().StringVar(&pingLogLevel, "log-level", "error", "Log level: debug, info, warn or error")
+	pingCmd.MarkFlagRequired("peer")
+
+	rootCmd.AddCommand(pingCmd)
+}
+
+func runPing(cmd *cobra.Command, args []string) error {
+	peerIDBytes, err := hex.DecodeString(pingPeer)
+	if err != nil {
+		return fmt.Errorf("invalid peer id: %w", err)
+	}
+	if len(peerIDBytes) != router.PeerIDSize {
+		return fmt.Errorf("invalid peer id size: got %d, expected %d", len(peerIDBytes), router.PeerIDSize)
+	}
+	var peerID router.PeerID
+	copy(peerID[:], peerIDBytes)
+	if pingCount < 1 {
+		return fmt.Errorf("invalid --count: %d", pingCount)
+	}
+
+	logLevel, err := parseLogLevel(pingLogLevel)
+	if err != nil {
+		return fmt.Errorf("invalid --log-level: %w", err)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+
+	turnServers, err := getTURNServers("", "", "")
+	if err != nil {
+		return fmt.Errorf("invalid TURN configuration: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate key: %w", err)
+	}
+	client := router.NewClient(pubkey, privkey)
+	income, err := client.Dial(ctx, chatRouterAddr)
+	if err != nil {
+		return fmt.Errorf("connect to router at %s: %w", chatRouterAddr, err)
+	}
+	defer client.Close()
+
+	connector, err := p2p.NewConnector(client, p2p.ConnectorConfig{
+		STUNServers:   getSTUNServers(chatSTUNServers),
+		TURNServers:   turnServers,
+		RelayFallback: true,
+	}, income, privkey)
+	if err != nil {
+		return fmt.Errorf("create P2P connector: %w", err)
+	}
+	defer connector.Close()
+	// Results come from ConnectContext and Ping, events are not needed
+	go func() {
+		for range connector.Events() {
+		}
+	}()
+
+	out := cmd.OutOrStdout()
+	shortID := pingPeer[:16] + "..."
+	fmt.Fprintf(out, "PING %s via %s\n", shortID, chatRouterAddr)
+
+	start := time.Now()
+	if err := <-connector.ConnectContext(ctx, pingPeer); err != nil {
+		return fmt.Errorf("peer %s is unreachable: %w", shortID, err)
+	}
+	how := "directly"
+	if peer, ok := connector.GetPeer(peerID); ok && peer.Relayed() {
+		how = "via relay"
+	}
+	fmt.Fprintf(out, "Connected %s in %v\n", how, time.Since(start).Round(time.Millisecond))
+
+	var rtts []time.Duration
+	for seq := 1; seq <= pingCount; seq++ {
+		if seq > 1 {
+			time.Sleep(pingInterval)
+		}
+		pingCtx, cancelPing := context.WithTimeout(context.Background(), pingReplyTimeout)
+		rtt, err := connector.Ping(pingCtx, peerID)
+		cancelPing()
+		if err != nil {
+			fmt.Fprintf(out, "seq=%d: %v\n", seq, err)
+			continue
+		}
+		rtts = append(rtts, rtt)
+		fmt.Fprintf(out, "reply from %s: seq=%d time=%s\n", shortID, seq, formatRTT(rtt))
+	}
+
+	loss := 100 * (pingCount - len(rtts)) / pingCount
+	fmt.Fprintf(out, "--- %d sent, %d received, %d%% loss\n", pingCount, len(rtts), loss)
+	if len(rtts) == 0 {
+		return fmt.Errorf("no replies from %s", shortID)
+	}
+	minRTT, maxRTT, total := rtts[0], rtts[0], time.Duration(0)
+	for _, rtt := range rtts {
+		minRTT, maxRTT, total = min(minRTT, rtt), max(maxRTT, rtt), total+rtt
+	}
+	fmt.Fprintf(out, "rtt min/avg/max = %s/%s/%s\n", formatRTT(minRTT), formatRTT(total/time.Duration(len(rtts))), formatRTT(maxRTT))
+	return nil
+}
+
+// formatRTT prints a round-trip time in milliseconds
+func formatRTT(rtt time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(rtt)/float64(time.Millisecond))
+}
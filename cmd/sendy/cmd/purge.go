@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var purgeOlderThan string
+
+var purgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Delete old messages from the chat database",
+	Long: `Permanently delete messages older than the given age, together with
+their edit history, and finished file transfer records. Received files on
+disk are kept.
+
+Example:
+  sendy purge --older-than 90d`,
+	RunE: runPurge,
+
+	SilenceUsage: true,
+}
+
+func init() {
+	purgeCmd.Flags().StringVarP(&chatDataDir, "data", "d", "", "Base directory (default: ~/.sendy)")
+	purgeCmd.Flags().StringVar(&purgeOlderThan, "older-than", "", "Delete messages older than this, e.g. 90d, 2w or 36h")
+	purgeCmd.MarkFlagRequired("older-than")
+
+	rootCmd.AddCommand(purgeCmd)
+}
+
+func runPurge(cmd *cobra.Command, args []string) error {
+	olderThan, err := parseAge(purgeOlderThan)
+	if err != nil {
+		return err
+	}
+	if olderThan == 0 {
+		return fmt.Errorf("invalid --older-than %q: must be greater than zero", purgeOlderThan)
+	}
+
+	storage, err := openExistingStorage()
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	deleted, err := storage.PurgeOldMessages(olderThan)
+	if err != nil {
+		return fmt.Errorf("purge messages: %w", err)
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Deleted %d messages older than %s\n", deleted, purgeOlderThan)
+	return nil
+}
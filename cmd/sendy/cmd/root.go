@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -13,6 +14,29 @@ var (
 	chatDataDir    string
 	chatGenKey     bool
 	chatSTUNServers string
+	chatTURNServer string
+	chatTURNUser   string
+	chatTURNPass   string
+	chatNoTUI      bool
+	chatNoMouse    bool
+	chatNoMarkdown bool
+	chatLocalDiscovery bool
+	chatBatchSignaling bool
+	chatSendPeer   string
+	chatSendMsg    string
+	chatLogLevel   string
+
+	chatFileConcurrency     int
+	chatMaxTransfersPerPeer int
+	chatMaxTransfers        int
+	chatMaxUploadRate       string
+	chatAutoPurgeAfter      string
+	chatDownloadDir         string
+
+	chatKeyExchangeTimeout time.Duration
+	chatAnswerTimeout      time.Duration
+	chatICEGatherTimeout   time.Duration
+	chatReconnectCooldown  time.Duration
 )
 
 var rootCmd = &cobra.Command{
@@ -26,15 +50,44 @@ Use 'sendy router' to start the router server.`,
 }
 
 func Execute() error {
+	// Config values become flag defaults, so load it before cobra parses
+	// flags. "config init" creates the file and must work without it
+	if sub, _, err := rootCmd.Find(os.Args[1:]); err != nil || sub.Parent() != configCmd {
+		if err := loadConfig(os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return err
+		}
+	}
 	return rootCmd.Execute()
 }
 
 func init() {
 	// Add chat flags to root command
-	rootCmd.Flags().StringVarP(&chatRouterAddr, "router", "r", "localhost:9090", "Router server address")
+	rootCmd.Flags().StringVarP(&chatRouterAddr, "router", "r", "localhost:9090", "Router server address (host:port, unix:///path or ws(s)://host/ws)")
 	rootCmd.Flags().StringVarP(&chatDataDir, "data", "d", "", "Base directory (default: ~/.sendy)")
 	rootCmd.Flags().BoolVarP(&chatGenKey, "genkey", "g", false, "Generate new keypair and exit")
 	rootCmd.Flags().StringVarP(&chatSTUNServers, "stun-servers", "s", "", "Comma-separated STUN servers (default: Google+Cloudflare+Twilio)")
+	rootCmd.Flags().StringVar(&chatTURNServer, "turn-server", "", "Comma-separated TURN servers (turn:host:port or turns:host:port)")
+	rootCmd.Flags().StringVar(&chatTURNUser, "turn-user", "", "TURN username")
+	rootCmd.Flags().StringVar(&chatTURNPass, "turn-pass", "", "TURN password (visible in the process list, prefer SENDY_TURN_PASS)")
+	rootCmd.Flags().StringVar(&chatLogLevel, "log-level", "info", "Log level: debug, info, warn or error (DEBUG=1 forces debug)")
+	rootCmd.Flags().BoolVar(&chatNoTUI, "no-tui", false, "Read JSON commands from stdin and write JSON events to stdout instead of the TUI")
+	rootCmd.Flags().BoolVar(&chatNoMouse, "no-mouse", false, "Don't capture the mouse in the TUI (keeps terminal text selection)")
+	rootCmd.Flags().BoolVar(&chatLocalDiscovery, "local-discovery", false, "Find sendy peers on the local network over mDNS and connect to them without the router")
+	rootCmd.Flags().BoolVar(&chatBatchSignaling, "batch-signaling", false, "Send signaling to several contacts in one router packet (the router must support batches)")
+	rootCmd.Flags().BoolVar(&chatNoMarkdown, "no-markdown", false, "Show messages in the TUI as plain text instead of rendering Markdown")
+	rootCmd.Flags().StringVar(&chatSendPeer, "peer", "", "Peer ID for a one-shot --send (requires --no-tui)")
+	rootCmd.Flags().StringVar(&chatSendMsg, "send", "", "Send one message to --peer and exit (requires --no-tui)")
+	rootCmd.Flags().DurationVar(&chatKeyExchangeTimeout, "key-exchange-timeout", 0, "Wait for the peer's encryption key, raise on slow links (default 5s)")
+	rootCmd.Flags().DurationVar(&chatAnswerTimeout, "answer-timeout", 0, "Wait for the peer's answer to a connection offer (default 30s)")
+	rootCmd.Flags().DurationVar(&chatICEGatherTimeout, "ice-gather-timeout", 0, "Wait for STUN servers while gathering candidates (default 5s)")
+	rootCmd.Flags().IntVar(&chatFileConcurrency, "file-concurrency", 1, "Send up to this many chunks of a file at once, 1-8 (helps on high-latency links)")
+	rootCmd.Flags().IntVar(&chatMaxTransfersPerPeer, "max-transfers-per-peer", 1, "Send this many files to one contact at once, the rest wait in a queue")
+	rootCmd.Flags().IntVar(&chatMaxTransfers, "max-transfers", 3, "Send this many files at once in total, the rest wait in a queue")
+	rootCmd.Flags().StringVar(&chatMaxUploadRate, "max-upload-rate", "", "Cap outgoing file data per second, e.g. 500K or 2MB (default unlimited)")
+	rootCmd.Flags().StringVar(&chatAutoPurgeAfter, "auto-purge-after", "", "On startup delete messages older than this, e.g. 90d or 2w (default keep everything)")
+	rootCmd.Flags().StringVar(&chatDownloadDir, "download-dir", "", "Save received files here and remember it, also SENDY_DOWNLOAD_DIR (default: data/downloads in the base directory)")
+	rootCmd.Flags().DurationVar(&chatReconnectCooldown, "reconnect-cooldown", 0, "Don't auto-reconnect to a contact who closed the connection on purpose for this long (default 5m)")
 
 	rootCmd.CompletionOptions.DisableDefaultCmd = true
 }
@@ -11,11 +11,29 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/udisondev/sendy/router"
+	"github.com/udisondev/sendy/router/admin"
 )
 
 var (
-	routerAddr   string
-	routerLogDir string
+	routerAddr         string
+	routerLogDir       string
+	routerMetricsAddr  string
+	routerAdminSocket  string
+	routerBanList      string
+	routerIdleTimeout  time.Duration
+	routerMaxPacket    uint32
+	routerAuthTimeout  time.Duration
+	routerWriteTimeout time.Duration
+	routerWSAddr       string
+	routerWSCert       string
+	routerWSKey        string
+	routerQuota        uint64
+	routerQuotaWindow  time.Duration
+	routerConnsPerIP   int
+	routerPeerList     bool
+	routerQueueSize    int
+	routerQueueTTL     time.Duration
+	routerQueueBytes   int
 )
 
 var routerCmd = &cobra.Command{
@@ -26,8 +44,29 @@ var routerCmd = &cobra.Command{
 }
 
 func init() {
-	routerCmd.Flags().StringVarP(&routerAddr, "addr", "a", ":9090", "Server listen address")
+	routerCmd.Flags().StringVarP(&routerAddr, "addr", "a", ":9090", "Server listen address (host:port or unix:///path/to/router.sock)")
 	routerCmd.Flags().StringVarP(&routerLogDir, "logdir", "l", "logs", "Directory for log files")
+	routerCmd.Flags().StringVar(&routerMetricsAddr, "metrics-addr", "", "HTTP address for Prometheus metrics (disabled if empty)")
+	routerCmd.Flags().StringVar(&routerAdminSocket, "admin-socket", "", "Unix socket path or loopback host:port for the admin API (disabled if empty)")
+
+	routerCmd.Flags().StringVar(&routerBanList, "banlist", "", "File with banned peer IDs (hex, one per line), updated on ban/unban")
+
+	routerCmd.Flags().DurationVar(&routerIdleTimeout, "idle-timeout", router.IdleTimeout, "Disconnect peers that send nothing (including keepalives) for this long")
+	routerCmd.Flags().Uint32Var(&routerMaxPacket, "max-packet-size", router.MaxPacketSize, "Maximum packet size in bytes (larger payloads are fragmented by clients)")
+	routerCmd.Flags().DurationVar(&routerAuthTimeout, "auth-timeout", router.AuthTimeout, "Timeout for the peer authentication handshake")
+	routerCmd.Flags().DurationVar(&routerWriteTimeout, "write-timeout", router.WriteTimeout, "Timeout for a single write to a peer")
+
+	routerCmd.Flags().Uint64Var(&routerQuota, "quota-bytes", 0, "Maximum payload bytes a peer can route per quota window (unlimited if 0)")
+	routerCmd.Flags().DurationVar(&routerQuotaWindow, "quota-window", router.QuotaWindow, "Sliding window for --quota-bytes")
+	routerCmd.Flags().IntVar(&routerConnsPerIP, "max-conns-per-ip", 0, "Maximum new connections per minute from a single IP (unlimited if 0)")
+	routerCmd.Flags().BoolVar(&routerPeerList, "peer-list", false, "Send the list of connected peers to all peers when a peer connects or disconnects")
+	routerCmd.Flags().IntVar(&routerQueueSize, "queue-size", 0, "Keep up to this many messages per offline peer and deliver them when it reconnects (disabled if 0)")
+	routerCmd.Flags().DurationVar(&routerQueueTTL, "queue-ttl", router.OfflineQueueTTL, "Drop messages queued for an offline peer after this long")
+	routerCmd.Flags().IntVar(&routerQueueBytes, "queue-max-bytes", router.OfflineQueueMaxBytes, "Total bytes kept for all offline peers together")
+
+	routerCmd.Flags().StringVar(&routerWSAddr, "ws-addr", "", "HTTP address for the WebSocket transport on "+router.WebSocketPath+" (disabled if empty)")
+	routerCmd.Flags().StringVar(&routerWSCert, "ws-cert", "", "TLS certificate file for the WebSocket transport (wss://)")
+	routerCmd.Flags().StringVar(&routerWSKey, "ws-key", "", "TLS key file for the WebSocket transport (wss://)")
 
 	rootCmd.AddCommand(routerCmd)
 }
@@ -72,9 +111,60 @@ func runRouter(cmd *cobra.Command, args []string) {
 	}))
 	slog.SetDefault(logger)
 
-	slog.Info("Starting Sendy Router", "addr", routerAddr, "logfile", logPath)
+	slog.Info("Starting Sendy Router", "addr", routerAddr, "logfile", logPath, "metricsAddr", routerMetricsAddr, "adminSocket", routerAdminSocket, "banlist", routerBanList)
+
+	cfg := router.RouterConfig{
+		MetricsAddr:   routerMetricsAddr,
+		BanListPath:   routerBanList,
+		IdleTimeout:   routerIdleTimeout,
+		MaxPacketSize: routerMaxPacket,
+		AuthTimeout:   routerAuthTimeout,
+		WriteTimeout:  routerWriteTimeout,
+		WSAddr:        routerWSAddr,
+		WSCertFile:    routerWSCert,
+		WSKeyFile:     routerWSKey,
+		QuotaBytes:    routerQuota,
+		QuotaWindow:   routerQuotaWindow,
+
+		MaxConnsPerIPPerMinute: routerConnsPerIP,
+		EnablePeerList:         routerPeerList,
+		OfflineQueueSize:       routerQueueSize,
+		OfflineQueueTTL:        routerQueueTTL,
+		OfflineQueueMaxBytes:   routerQueueBytes,
+	}
+	r := router.NewRouter(cfg)
+
+	if cfg.BanListPath != "" {
+		if err := r.LoadBanList(cfg.BanListPath); err != nil {
+			exitWithError("Failed to load ban list", err)
+		}
+	}
+
+	if cfg.MetricsAddr != "" {
+		go func() {
+			if err := router.ServeMetrics(cfg.MetricsAddr, r.Metrics()); err != nil {
+				slog.Error("Metrics server error", "error", err)
+			}
+		}()
+	}
+
+	if cfg.WSAddr != "" {
+		go func() {
+			if err := r.ServeWebSocket(cfg.WSAddr, cfg.WSCertFile, cfg.WSKeyFile); err != nil {
+				slog.Error("WebSocket server error", "error", err)
+			}
+		}()
+	}
+
+	if routerAdminSocket != "" {
+		go func() {
+			if err := admin.Serve(routerAdminSocket, r); err != nil {
+				slog.Error("Admin API error", "error", err)
+			}
+		}()
+	}
 
-	if err := router.Run(routerAddr); err != nil {
+	if err := r.ListenAndServe(routerAddr); err != nil {
 		slog.Error("Router error", "error", err)
 		exitWithError("Router error", err)
 	}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show chat database statistics",
+	Long: `Show the number of messages, contacts and file transfers stored in the
+chat database and the size of the database file.
+
+Example:
+  sendy stats`,
+	RunE: runStats,
+
+	SilenceUsage: true,
+}
+
+func init() {
+	statsCmd.Flags().StringVarP(&chatDataDir, "data", "d", "", "Base directory (default: ~/.sendy)")
+
+	rootCmd.AddCommand(statsCmd)
+}
+
+func runStats(cmd *cobra.Command, args []string) error {
+	storage, err := openExistingStorage()
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	stats, err := storage.GetStorageStats()
+	if err != nil {
+		return fmt.Errorf("get storage stats: %w", err)
+	}
+
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "Messages:       %d\n", stats.TotalMessages)
+	fmt.Fprintf(out, "Contacts:       %d\n", stats.TotalContacts)
+	fmt.Fprintf(out, "File transfers: %d\n", stats.TotalFileTransfers)
+	fmt.Fprintf(out, "Database size:  %.1f MB (%d bytes)\n", float64(stats.DBSizeBytes)/(1<<20), stats.DBSizeBytes)
+	return nil
+}
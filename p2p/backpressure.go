@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Отправка с учетом заполненности буфера: DataChannel.Send не блокируется
+// и складывает данные в очередь SCTP без ограничений. Передача файла в
+// цикле копила бы в памяти весь файл, а сообщения чата стояли бы в очереди
+// за ним. Поэтому отправка ждет, пока в очереди канала не станет меньше
+// maxBufferedAmount байт. Канал сообщает об освобождении буфера через
+// OnBufferedAmountLow, когда в нем остается меньше половины предела
+
+// DefaultMaxBufferedAmount - предел очереди отправки DataChannel по умолчанию
+const DefaultMaxBufferedAmount = 1 << 20
+
+// setupBackpressure настраивает уведомление об освобождении буфера канала
+func (c *Connector) setupBackpressure(peer *Peer, dc *webrtc.DataChannel) {
+	dc.SetBufferedAmountLowThreshold(c.maxBufferedAmount / 2)
+	dc.OnBufferedAmountLow(peer.signalBufferLow)
+}
+
+// waitBufferLow ждет, пока в очереди отправки канала меньше
+// maxBufferedAmount байт. Закрытие канала тоже будит ожидание
+func (p *Peer) waitBufferLow(ctx context.Context, dc *webrtc.DataChannel) error {
+	for {
+		// Сигнал берем до проверки, чтобы не пропустить освобождение между ними
+		low := p.bufferLowSignal()
+		if dc.BufferedAmount() < p.connector.maxBufferedAmount {
+			return nil
+		}
+		if state := dc.ReadyState(); state != webrtc.DataChannelStateOpen {
+			return fmt.Errorf("data channel %q is not open: state=%v", dc.Label(), state)
+		}
+
+		select {
+		case <-low:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.connector.done:
+			return ErrConnectorClosed
+		}
+	}
+}
+
+// bufferLowSignal возвращает канал, который закроется при освобождении буфера
+func (p *Peer) bufferLowSignal() <-chan struct{} {
+	p.bufferMu.Lock()
+	defer p.bufferMu.Unlock()
+	if p.bufferLow == nil {
+		p.bufferLow = make(chan struct{})
+	}
+	return p.bufferLow
+}
+
+// signalBufferLow будит отправки, ждущие освобождения буфера. Вызывается
+// из колбэков pion, поэтому берет только bufferMu, а не mu: под mu идет
+// DataChannel.Send
+func (p *Peer) signalBufferLow() {
+	p.bufferMu.Lock()
+	defer p.bufferMu.Unlock()
+	if p.bufferLow != nil {
+		close(p.bufferLow)
+		p.bufferLow = nil
+	}
+}
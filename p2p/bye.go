@@ -0,0 +1,167 @@
+package p2p
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Прощание перед закрытием соединения. Peer.Close и DisconnectAll
+// отправляют пиру сообщение msgBye с причиной DisconnectUser, Close
+// коннектора - с DisconnectShutdown. Получив его, пир закрывает соединение
+// сам, не пытаясь восстановить его ICE restart'ом, и отправляет
+// EventDisconnected с Reason: приложение может на время отказаться от
+// переподключения. Прощание идет по каналу DataChannelLabel внутри
+// сообщения, зашифрованного сеансовым ключом, поэтому подделать или
+// повторить его нельзя. Relay-пир передает причину в подписанном кадре
+// "close" (см. relay.go).
+//
+// Прощание отправляется, только если пир поставил sessionFlagBye в
+// handshake: пир прежней версии отклонил бы неизвестный тип сообщения. Как
+// и при обрыве соединения, Reason у него пустая
+
+// DisconnectReason - причина закрытия соединения, которую сообщил пир
+type DisconnectReason string
+
+const (
+	DisconnectUser     DisconnectReason = "user"     // пользователь отключился от пира
+	DisconnectShutdown DisconnectReason = "shutdown" // приложение пира завершает работу
+)
+
+const (
+	// byeTimeout - сколько закрытие ждет, пока прощание дойдет до пира
+	byeTimeout = time.Second
+
+	// maxDisconnectReasonLen - длиннее причина не принимается
+	maxDisconnectReasonLen = 64
+)
+
+// UserInitiated сообщает, что соединение закрыто по воле пользователя, а
+// не оборвалось
+func (r DisconnectReason) UserInitiated() bool {
+	return r == DisconnectUser || r == DisconnectShutdown
+}
+
+// parseDisconnectReason разбирает причину из прощания пира. Некорректная
+// причина считается пустой
+func parseDisconnectReason(data []byte) DisconnectReason {
+	if len(data) > maxDisconnectReasonLen || !utf8.Valid(data) {
+		return ""
+	}
+	return DisconnectReason(data)
+}
+
+// Close прощается с пиром и закрывает соединение
+func (p *Peer) Close() error {
+	return p.closeWithReason(DisconnectUser)
+}
+
+// closeWithReason прощается с пиром и закрывает соединение
+func (p *Peer) closeWithReason(reason DisconnectReason) error {
+	hexID := hex.EncodeToString(p.ID[:8])
+	slog.Info("Closing peer connection", "peerID", hexID+"...", "relay", p.relay, "reason", reason)
+
+	if p.relay {
+		return p.closeRelay(reason)
+	}
+	p.sendBye(reason)
+	return p.close()
+}
+
+// close закрывает WebRTC соединение без прощания
+func (p *Peer) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil {
+		return p.conn.Close()
+	}
+	return nil
+}
+
+// sendBye отправляет пиру прощание и ждет, пока пир подтвердит его
+// получение, не дольше byeTimeout. Ошибки не мешают закрытию
+func (p *Peer) sendBye(reason DisconnectReason) {
+	if p.session == nil {
+		return
+	}
+	hexID := hex.EncodeToString(p.ID[:8])
+
+	ctx, cancel := context.WithTimeout(context.Background(), byeTimeout)
+	defer cancel()
+	// Сразу после соединения обмен сеансовыми ключами может еще идти,
+	// поддержку прощания пир сообщает в handshake
+	select {
+	case <-p.session.ready:
+	case <-ctx.Done():
+		return
+	}
+	if !p.session.bye() {
+		return
+	}
+	if err := p.sendOnContext(ctx, DataChannelLabel, msgBye, []byte(reason)); err != nil {
+		slog.Debug("Failed to say bye", "peerID", hexID+"...", "error", err)
+		return
+	}
+
+	// pion не дожидается отправки буфера при закрытии соединения. Буфер
+	// DataChannel освобождается, когда SCTP пира подтвердил получение
+	p.mu.Lock()
+	dc := p.dataChannels[DataChannelLabel]
+	p.mu.Unlock()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for dc.BufferedAmount() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			slog.Debug("Bye not acknowledged", "peerID", hexID+"...")
+			return
+		}
+	}
+}
+
+// handleBye закрывает соединение, с которым попрощался пир
+func (c *Connector) handleBye(peer *Peer, data []byte) {
+	reason := parseDisconnectReason(data)
+	slog.Info("Peer closed the connection", "peerID", hex.EncodeToString(peer.ID[:8])+"...", "reason", reason)
+
+	// Закрытие больше не запускает ICE restart и не порождает второе
+	// EventDisconnected
+	peer.supersede()
+	if c.peers.CompareAndDelete(peer.ID, peer) {
+		c.emit(Event{
+			Type:   EventDisconnected,
+			PeerID: peer.ID,
+			Reason: reason,
+		})
+	}
+	// Вызывается из обработчика pion, закрытие ждет его завершения
+	go peer.close()
+}
+
+// disconnectAll прощается со всеми пирами, не больше maxSendAllWorkers
+// одновременно, и закрывает соединения
+func (c *Connector) disconnectAll(reason DisconnectReason) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxSendAllWorkers)
+	c.peers.Range(func(key, value any) bool {
+		// Удаляем по одному: обработчики pion могут обращаться к peers конкурентно
+		c.peers.Delete(key)
+		peer := value.(*Peer)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			peer.closeWithReason(reason)
+		}()
+		return true
+	})
+	wg.Wait()
+}
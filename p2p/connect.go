@@ -0,0 +1,154 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// Ожидание результата подключения: ConnectContext возвращает канал, в
+// который приходит единственный результат попытки.
+//
+//   - nil - EventConnected или EventConnectedRelay
+//   - ошибка EventConnectionFailed или ErrConnectionClosed, если соединение
+//     закрылось после обмена SDP, так и не установившись
+//   - ctx.Err() - подключение отменено, PeerConnection закрыт без
+//     EventConnectionFailed
+//   - ErrConnectorClosed - коннектор закрылся
+//
+// Результат определяют события пира, а не сама попытка, поэтому попытка,
+// проигравшая встречному offer'у, завершается соединением, установленным
+// через него
+//
+// WaitForPeer ждет соединения с пиром независимо от того, кто его начал:
+// ConnectContext, встречный offer пира или автоподключение. Все ожидающие
+// одного пира делят один peerWaiter, который завершает первое событие
+// EventConnected, EventConnectedRelay или EventConnectionFailed
+
+var ErrConnectInProgress = errors.New("connection attempt already in progress")
+var ErrConnectionClosed = errors.New("connection closed before it was established")
+var ErrConnectionFailed = errors.New("connection failed")
+
+// connectWaiter - ожидание результата одной попытки подключения
+type connectWaiter struct {
+	once   sync.Once
+	result chan error    // буфер 1, результат читает вызывающий ConnectContext
+	done   chan struct{} // закрывается вместе с отправкой результата
+}
+
+func newConnectWaiter() *connectWaiter {
+	return &connectWaiter{
+		result: make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// resolve отправляет результат попытки, повторные вызовы игнорируются
+func (w *connectWaiter) resolve(err error) {
+	w.once.Do(func() {
+		w.result <- err
+		close(w.result)
+		close(w.done)
+	})
+}
+
+// ConnectContext инициирует WebRTC соединение с пиром по hex ID и
+// возвращает канал с результатом попытки. Ошибки проверки (неверный ID,
+// черный список, существующее соединение) приходят в канал до возврата из
+// ConnectContext. Отмена ctx прерывает ожидание ключа, answer и установки
+// соединения, незавершенный PeerConnection закрывается
+func (c *Connector) ConnectContext(ctx context.Context, hexID string) <-chan error {
+	w := newConnectWaiter()
+	peerID, err := c.prepareConnect(hexID)
+	if err != nil {
+		w.resolve(err)
+		return w.result
+	}
+	if _, loaded := c.connecting.LoadOrStore(peerID, w); loaded {
+		w.resolve(ErrConnectInProgress)
+		return w.result
+	}
+
+	c.spawn(func() { c.connectAsync(ctx, peerID, w) })
+	return w.result
+}
+
+// finishConnect завершает ожидающую попытку подключения к пиру
+func (c *Connector) finishConnect(peerID router.PeerID, err error) {
+	if val, ok := c.connecting.LoadAndDelete(peerID); ok {
+		val.(*connectWaiter).resolve(err)
+	}
+}
+
+// peerWaiter - общее ожидание соединения с пиром для WaitForPeer
+type peerWaiter struct {
+	once sync.Once
+	done chan struct{} // закрывается после записи peer и err
+	peer *Peer
+	err  error
+}
+
+// WaitForPeer ждет установленного соединения с пиром и возвращает его.
+// Если соединение уже есть, возвращает сразу. Сам подключение не начинает.
+// Возвращает ctx.Err() по отмене ctx и ошибку, обернутую в
+// ErrConnectionFailed, если раньше пришло EventConnectionFailed
+func (c *Connector) WaitForPeer(ctx context.Context, peerID router.PeerID) (*Peer, error) {
+	// Ожидание регистрируется до проверки, чтобы не пропустить событие
+	// между ними
+	w := c.peerWaiter(peerID)
+	if val, ok := c.peers.Load(peerID); ok {
+		peer := val.(*Peer)
+		peer.mu.Lock()
+		established := peer.relay || peer.connected
+		peer.mu.Unlock()
+		if established {
+			c.resolvePeerWaiter(peerID, peer, nil)
+		}
+	}
+
+	select {
+	case <-w.done:
+		return w.peer, w.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrConnectorClosed
+	}
+}
+
+// peerWaiter возвращает общий для всех ожидающих peerWaiter пира
+func (c *Connector) peerWaiter(peerID router.PeerID) *peerWaiter {
+	w, _ := c.peerWaiters.LoadOrStore(peerID, &peerWaiter{done: make(chan struct{})})
+	return w.(*peerWaiter)
+}
+
+// resolvePeerWaiter завершает ожидания соединения с пиром. Следующий
+// WaitForPeer ждет уже нового события
+func (c *Connector) resolvePeerWaiter(peerID router.PeerID, peer *Peer, err error) {
+	val, ok := c.peerWaiters.LoadAndDelete(peerID)
+	if !ok {
+		return
+	}
+	w := val.(*peerWaiter)
+	w.once.Do(func() {
+		w.peer, w.err = peer, err
+		close(w.done)
+	})
+}
+
+// connectionFailedError оборачивает причину EventConnectionFailed в ErrConnectionFailed
+func connectionFailedError(cause error) error {
+	if cause == nil {
+		return ErrConnectionFailed
+	}
+	return fmt.Errorf("%w: %w", ErrConnectionFailed, cause)
+}
+
+// abortConnect завершает попытку w, если ее еще не сменила другая
+func (c *Connector) abortConnect(peerID router.PeerID, w *connectWaiter, err error) {
+	c.connecting.CompareAndDelete(peerID, w)
+	w.resolve(err)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/sha512"
 	"fmt"
+	"strings"
 
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/nacl/box"
@@ -122,8 +123,49 @@ func EncryptPeerMessage(message []byte, recipientEdPub ed25519.PublicKey, sender
 	return nil, fmt.Errorf("use EncryptMessage with pre-exchanged Curve25519 keys")
 }
 
+// safetyNumberIterations slows down searching for keys that produce a
+// given safety number
+const safetyNumberIterations = 5200
+
+// SafetyNumber returns a 60-digit number in groups of 5 that two peers
+// compare out of band (in person, over a call) to detect a MITM during the
+// first key exchange. It combines both Ed25519 IDs and Curve25519 keys and
+// is the same on both sides regardless of argument order
+func SafetyNumber(idA ed25519.PublicKey, keyA *Curve25519PublicKey, idB ed25519.PublicKey, keyB *Curve25519PublicKey) string {
+	a := fingerprintDigits(idA, keyA)
+	b := fingerprintDigits(idB, keyB)
+	if a > b {
+		a, b = b, a
+	}
+	digits := a + b
+
+	groups := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+	return strings.Join(groups, " ")
+}
+
+// fingerprintDigits returns 30 digits derived from one peer's keys
+func fingerprintDigits(id ed25519.PublicKey, key *Curve25519PublicKey) string {
+	input := append([]byte("sendy-safety-number:"), id...)
+	h := sha512.Sum512(append(input, key[:]...))
+	for i := 0; i < safetyNumberIterations; i++ {
+		h = sha512.Sum512(append(h[:], key[:]...))
+	}
+
+	// Each 5 bytes of the hash give 5 digits
+	var b strings.Builder
+	for i := 0; i < 30; i += 5 {
+		chunk := uint64(h[i])<<32 | uint64(h[i+1])<<24 | uint64(h[i+2])<<16 | uint64(h[i+3])<<8 | uint64(h[i+4])
+		fmt.Fprintf(&b, "%05d", chunk%100000)
+	}
+	return b.String()
+}
+
 // SignedMessage represents a message with Ed25519 signature
-// This protects against MITM attacks on WebRTC signaling
+// This protects against MITM attacks on WebRTC signaling. It is the legacy
+// JSON signaling envelope, see envelope.go for the binary one
 type SignedMessage struct {
 	Payload   []byte // Encrypted message payload
 	Signature []byte // Ed25519 signature of the payload
@@ -0,0 +1,37 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"regexp"
+	"testing"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubB, privB, _ := ed25519.GenerateKey(nil)
+	keyA, err := DerivePublicEncryptionKey(privA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB, err := DerivePublicEncryptionKey(privB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Обе стороны видят одно и то же число
+	number := SafetyNumber(pubA, keyA, pubB, keyB)
+	if got := SafetyNumber(pubB, keyB, pubA, keyA); got != number {
+		t.Fatalf("Safety number depends on order: %q != %q", number, got)
+	}
+	if !regexp.MustCompile(`^\d{5}( \d{5}){11}$`).MatchString(number) {
+		t.Fatalf("Unexpected safety number format: %q", number)
+	}
+
+	// Подмененный ключ дает другое число
+	var substituted Curve25519PublicKey
+	copy(substituted[:], keyB[:])
+	substituted[0] ^= 1
+	if SafetyNumber(pubA, keyA, pubB, &substituted) == number {
+		t.Fatal("Safety number didn't change with the key")
+	}
+}
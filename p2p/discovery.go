@@ -0,0 +1,740 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// Поиск пиров в локальной сети (ConnectorConfig.EnableLocalDiscovery).
+// Коннектор объявляет себя по mDNS как сервис _sendy._tcp: имя экземпляра -
+// хеш PeerID, SRV - порт TCP сокета локальной сигнализации. Сам PeerID в
+// multicast не попадает.
+//
+// Найдя объявление, коннектор подключается к сокету пира и обменивается с
+// ним PeerID (hello). Пир отвечает, только если сам видел объявление
+// спрашивающего с того же адреса, поэтому PeerID узнают лишь пиры sendy с
+// включенным поиском. Каждая сторона подписывает случайный nonce другой
+// стороны своим Ed25519 ключом, так что чужой PeerID в hello не подставить.
+// После обмена пир появляется в DiscoverLocal и приходит
+// EventPeerDiscovered.
+//
+// Сигнальные сообщения найденным пирам (KEY_EXCHANGE, SDP, кандидаты)
+// отправляются напрямую через их сокет, router для соединения не нужен.
+// Сообщения те же, что идут через router: зашифрованы и подписаны, поэтому
+// сокет не доверяет отправителю - подпись проверяет handleIncoming. Если
+// сокет недоступен, сообщение уходит через router
+
+const (
+	// localServiceName - тип сервиса sendy в mDNS
+	localServiceName = "_sendy._tcp.local."
+
+	// localAnnounceInterval - как часто повторяется объявление
+	localAnnounceInterval = 30 * time.Second
+
+	// localPeerTTL - через сколько без объявлений пир считается ушедшим
+	localPeerTTL = 3 * localAnnounceInterval
+
+	// localIOTimeout ограничивает подключение к сокету пира и обмен кадром
+	localIOTimeout = 3 * time.Second
+
+	// localSignalBuffer - сколько сигнальных сообщений из сокета ждут handleIncoming
+	localSignalBuffer = 64
+
+	// maxLocalAnnouncements - сколько объявлений пиров запоминается
+	maxLocalAnnouncements = 256
+
+	// maxLocalConns - сколько подключений к сокету обслуживается одновременно
+	maxLocalConns = 16
+
+	// maxLocalSignalSize - предел сигнального сообщения в сокете. SDP и
+	// кандидаты занимают единицы килобайт
+	maxLocalSignalSize = 256 * 1024
+)
+
+// mdnsGroup - multicast адрес mDNS
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Типы кадров локальной сигнализации
+const (
+	localFrameHello  byte = 1 // обмен PeerID, в ответ - hello
+	localFrameSignal byte = 2 // сигнальное сообщение, в ответ - ack
+	localFrameAck    byte = 3 // сообщение принято
+	localFrameProof  byte = 4 // подпись nonce из ответа на hello, в ответ - ack
+)
+
+// localFrameHeaderSize - тип, PeerID отправителя и длина payload
+const localFrameHeaderSize = 1 + router.PeerIDSize + 4
+
+const (
+	// localNonceSize - nonce, который подписывает другая сторона hello
+	localNonceSize = 32
+
+	// localHelloReplySize - ответ на hello: наш nonce и подпись nonce
+	// спрашивающего
+	localHelloReplySize = localNonceSize + ed25519.SignatureSize
+)
+
+// localHelloContext отделяет подпись hello от других подписей ключа
+var localHelloContext = []byte("sendy-local-hello:")
+
+// localFrameLimit возвращает предел payload кадра
+func localFrameLimit(kind byte) uint32 {
+	switch kind {
+	case localFrameHello:
+		return localHelloReplySize
+	case localFrameSignal:
+		return maxLocalSignalSize
+	case localFrameProof:
+		return ed25519.SignatureSize
+	}
+	return 0
+}
+
+// DiscoveredPeer - пир sendy, найденный в локальной сети
+type DiscoveredPeer struct {
+	PeerID   router.PeerID
+	Addr     netip.AddrPort // сокет локальной сигнализации
+	LastSeen time.Time      // последнее объявление
+}
+
+// localAnnouncement - объявление, PeerID которого еще не известен
+type localAnnouncement struct {
+	addr      netip.AddrPort
+	lastSeen  time.Time
+	resolving bool // идет hello
+}
+
+// localDiscovery объявляет коннектор в локальной сети и принимает сигнальные
+// сообщения найденных пиров
+type localDiscovery struct {
+	c        *Connector
+	hash     string // имя нашего экземпляра
+	mconn    *net.UDPConn
+	listener *net.TCPListener
+	signals  chan router.ServerMessage
+	conns    chan struct{} // слоты обслуживаемых подключений
+
+	mu            sync.Mutex
+	announcements map[string]*localAnnouncement // по хешу PeerID
+	peers         map[router.PeerID]*DiscoveredPeer
+}
+
+// localPeerHash - хеш PeerID, под которым пир объявляет себя в mDNS
+func localPeerHash(peerID router.PeerID) string {
+	sum := sha256.Sum256(append([]byte("sendy-local-discovery:"), peerID[:]...))
+	return hex.EncodeToString(sum[:16])
+}
+
+// startLocalDiscovery открывает сокеты и запускает объявление и прием
+func (c *Connector) startLocalDiscovery() error {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{})
+	if err != nil {
+		return fmt.Errorf("listen local signaling: %w", err)
+	}
+	mconn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("listen mDNS: %w", err)
+	}
+
+	d := &localDiscovery{
+		c:             c,
+		hash:          localPeerHash(c.LocalID()),
+		mconn:         mconn,
+		listener:      listener,
+		signals:       make(chan router.ServerMessage, localSignalBuffer),
+		conns:         make(chan struct{}, maxLocalConns),
+		announcements: make(map[string]*localAnnouncement),
+		peers:         make(map[router.PeerID]*DiscoveredPeer),
+	}
+	c.local = d
+	c.spawn(d.readMDNS)
+	c.spawn(d.acceptSignals)
+	c.spawn(d.announceLoop)
+	slog.Info("Local discovery started", "hash", d.hash[:16]+"...", "port", listener.Addr().(*net.TCPAddr).Port)
+	return nil
+}
+
+// close закрывает сокеты, прощаясь объявлением с нулевым TTL
+func (d *localDiscovery) close() {
+	if packet, err := d.announcement(0); err == nil {
+		d.mconn.WriteToUDP(packet, mdnsGroup)
+	}
+	d.mconn.Close()
+	d.listener.Close()
+}
+
+// DiscoverLocal возвращает пиров, найденных в локальной сети. Пусто, если
+// поиск выключен
+func (c *Connector) DiscoverLocal() []DiscoveredPeer {
+	if c.local == nil {
+		return nil
+	}
+	d := c.local
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	peers := make([]DiscoveredPeer, 0, len(d.peers))
+	for _, peer := range d.peers {
+		if now.Sub(peer.LastSeen) < localPeerTTL {
+			peers = append(peers, *peer)
+		}
+	}
+	slices.SortFunc(peers, func(a, b DiscoveredPeer) int { return compareIDs(a.PeerID, b.PeerID) })
+	return peers
+}
+
+// localSignals возвращает канал сигнальных сообщений из локального сокета,
+// nil если поиск выключен
+func (c *Connector) localSignals() <-chan router.ServerMessage {
+	if c.local == nil {
+		return nil
+	}
+	return c.local.signals
+}
+
+// sendSignaling отправляет подписанное сигнальное сообщение: найденному в
+// локальной сети пиру - напрямую, остальным - через router. Канал ответа
+// такой же, как у router.Client.Send
+func (c *Connector) sendSignaling(ctx context.Context, peerID router.PeerID, signedMsg []byte) (<-chan router.ServerMessage, error) {
+	if c.local != nil {
+		if addr, ok := c.local.peerAddr(peerID); ok {
+			err := c.local.sendSignal(ctx, addr, signedMsg)
+			if err == nil {
+				resp := make(chan router.ServerMessage, 1)
+				resp <- router.ServerMessage{Type: router.Success, SenderID: peerID}
+				close(resp)
+				return resp, nil
+			}
+			slog.Debug("Local signaling failed, sending through router",
+				"peerID", hex.EncodeToString(peerID[:8])+"...", "error", err)
+		}
+	}
+	return c.cli.Send(ctx, peerID, signedMsg)
+}
+
+// peerAddr возвращает адрес сокета пира, если он найден и не ушел
+func (d *localDiscovery) peerAddr(peerID router.PeerID) (netip.AddrPort, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	peer, ok := d.peers[peerID]
+	if !ok || time.Since(peer.LastSeen) >= localPeerTTL {
+		return netip.AddrPort{}, false
+	}
+	return peer.Addr, true
+}
+
+// announceLoop спрашивает, кто есть в сети, и периодически объявляет себя
+func (d *localDiscovery) announceLoop() {
+	d.send(d.query)
+	d.send(func() ([]byte, error) { return d.announcement(localPeerTTL) })
+
+	ticker := time.NewTicker(localAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.send(func() ([]byte, error) { return d.announcement(localPeerTTL) })
+		case <-d.c.done:
+			return
+		}
+	}
+}
+
+// send отправляет mDNS пакет в multicast группу
+func (d *localDiscovery) send(build func() ([]byte, error)) {
+	packet, err := build()
+	if err == nil {
+		_, err = d.mconn.WriteToUDP(packet, mdnsGroup)
+	}
+	if err != nil {
+		slog.Debug("Failed to send mDNS packet", "error", err)
+	}
+}
+
+// query строит mDNS запрос сервисов sendy
+func (d *localDiscovery) query() ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(localServiceName),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// announcement строит mDNS ответ с нашим экземпляром. TTL 0 - прощание
+func (d *localDiscovery) announcement(ttl time.Duration) ([]byte, error) {
+	instance, err := dnsmessage.NewName(d.hash + "." + localServiceName)
+	if err != nil {
+		return nil, err
+	}
+	target, err := dnsmessage.NewName(d.hash + ".local.")
+	if err != nil {
+		return nil, err
+	}
+	header := func(name dnsmessage.Name, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: dnsmessage.ClassINET, TTL: uint32(ttl.Seconds())}
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	err = b.PTRResource(header(dnsmessage.MustNewName(localServiceName), dnsmessage.TypePTR), dnsmessage.PTRResource{PTR: instance})
+	if err != nil {
+		return nil, err
+	}
+	port := uint16(d.listener.Addr().(*net.TCPAddr).Port)
+	if err := b.SRVResource(header(instance, dnsmessage.TypeSRV), dnsmessage.SRVResource{Target: target, Port: port}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// readMDNS принимает mDNS пакеты до закрытия сокета
+func (d *localDiscovery) readMDNS() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := d.mconn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Debug("mDNS read failed", "error", err)
+			}
+			return
+		}
+		d.handlePacket(buf[:n], netip.AddrPortFrom(from.Addr().Unmap(), from.Port()))
+	}
+}
+
+// handlePacket отвечает на запросы сервисов sendy и запоминает объявления
+// других пиров. Остальные пакеты mDNS пропускаются
+func (d *localDiscovery) handlePacket(packet []byte, from netip.AddrPort) {
+	var p dnsmessage.Parser
+	header, err := p.Start(packet)
+	if err != nil {
+		return
+	}
+
+	if !header.Response {
+		for {
+			q, err := p.Question()
+			if err != nil {
+				return
+			}
+			if q.Type == dnsmessage.TypePTR && strings.EqualFold(q.Name.String(), localServiceName) {
+				d.send(func() ([]byte, error) { return d.announcement(localPeerTTL) })
+				return
+			}
+		}
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	var (
+		instance string
+		ttl      uint32
+		ports    = make(map[string]uint16)
+	)
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		switch {
+		case h.Type == dnsmessage.TypePTR && strings.EqualFold(h.Name.String(), localServiceName):
+			r, err := p.PTRResource()
+			if err != nil {
+				return
+			}
+			instance, ttl = strings.ToLower(r.PTR.String()), h.TTL
+		case h.Type == dnsmessage.TypeSRV:
+			r, err := p.SRVResource()
+			if err != nil {
+				return
+			}
+			ports[strings.ToLower(h.Name.String())] = r.Port
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return
+			}
+		}
+	}
+
+	hash, ok := strings.CutSuffix(instance, "."+localServiceName)
+	if !ok || hash == d.hash || ports[instance] == 0 {
+		return
+	}
+	d.handleAnnouncement(hash, netip.AddrPortFrom(from.Addr(), ports[instance]), ttl == 0)
+}
+
+// handleAnnouncement запоминает объявление пира и узнает его PeerID, если
+// он еще не известен или сменил адрес
+func (d *localDiscovery) handleAnnouncement(hash string, addr netip.AddrPort, goodbye bool) {
+	now := time.Now()
+
+	d.mu.Lock()
+	if goodbye {
+		delete(d.announcements, hash)
+		for id := range d.peers {
+			if localPeerHash(id) == hash {
+				delete(d.peers, id)
+			}
+		}
+		d.mu.Unlock()
+		return
+	}
+
+	a, ok := d.announcements[hash]
+	if !ok {
+		d.pruneLocked(now)
+		if len(d.announcements) >= maxLocalAnnouncements {
+			d.mu.Unlock()
+			return
+		}
+		a = &localAnnouncement{}
+		d.announcements[hash] = a
+	}
+	changed := a.addr != addr
+	a.addr, a.lastSeen = addr, now
+
+	known := false
+	for _, peer := range d.peers {
+		if peer.Addr == addr && now.Sub(peer.LastSeen) < localPeerTTL && localPeerHash(peer.PeerID) == hash {
+			peer.LastSeen = now
+			known = true
+		}
+	}
+	resolve := !known && !a.resolving
+	if resolve {
+		a.resolving = true
+	}
+	d.mu.Unlock()
+
+	if changed {
+		slog.Debug("Local peer announced", "hash", hash[:16]+"...", "addr", addr)
+	}
+	if resolve {
+		d.c.spawn(func() { d.resolve(hash, addr) })
+	}
+}
+
+// pruneLocked забывает ушедших пиров. Вызывается под d.mu
+func (d *localDiscovery) pruneLocked(now time.Time) {
+	for hash, a := range d.announcements {
+		if now.Sub(a.lastSeen) >= localPeerTTL && !a.resolving {
+			delete(d.announcements, hash)
+		}
+	}
+	for id, peer := range d.peers {
+		if now.Sub(peer.LastSeen) >= localPeerTTL {
+			delete(d.peers, id)
+		}
+	}
+}
+
+// resolve узнает PeerID пира по hello
+func (d *localDiscovery) resolve(hash string, addr netip.AddrPort) {
+	defer func() {
+		d.mu.Lock()
+		if a, ok := d.announcements[hash]; ok {
+			a.resolving = false
+		}
+		d.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), localIOTimeout)
+	defer cancel()
+	peerID, err := d.hello(ctx, addr, hash)
+	if err != nil {
+		// Пир мог еще не видеть нашего объявления, повторим на следующем
+		slog.Debug("Local hello failed", "hash", hash[:16]+"...", "addr", addr, "error", err)
+		return
+	}
+	d.addPeer(peerID, addr)
+}
+
+// addPeer запоминает найденного пира и сообщает о новом
+func (d *localDiscovery) addPeer(peerID router.PeerID, addr netip.AddrPort) {
+	now := time.Now()
+	d.mu.Lock()
+	peer, ok := d.peers[peerID]
+	found := !ok || now.Sub(peer.LastSeen) >= localPeerTTL
+	d.peers[peerID] = &DiscoveredPeer{PeerID: peerID, Addr: addr, LastSeen: now}
+	d.mu.Unlock()
+
+	if found {
+		slog.Info("Peer discovered on local network", "peerID", hex.EncodeToString(peerID[:8])+"...", "addr", addr)
+		d.c.emit(Event{Type: EventPeerDiscovered, PeerID: peerID})
+	}
+}
+
+// dial подключается к сокету пира со сроком ctx
+func (d *localDiscovery) dial(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// hello узнает PeerID пира с хешем hash. Пир подписывает наш nonce, мы -
+// его, и он подтверждает подпись ack
+func (d *localDiscovery) hello(ctx context.Context, addr netip.AddrPort, hash string) (router.PeerID, error) {
+	conn, err := d.dial(ctx, addr)
+	if err != nil {
+		return router.PeerID{}, err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	localID := d.c.LocalID()
+
+	var nonce [localNonceSize]byte
+	rand.Read(nonce[:])
+	if err := writeLocalFrame(conn, localFrameHello, localID, nonce[:]); err != nil {
+		return router.PeerID{}, err
+	}
+	_, peerID, reply, err := readLocalFrame(r, localFrameHello)
+	if err != nil {
+		return router.PeerID{}, err
+	}
+	if localPeerHash(peerID) != hash || len(reply) != localHelloReplySize {
+		return router.PeerID{}, fmt.Errorf("unexpected hello from %s", addr)
+	}
+	// SECURITY: PeerID принимаем, только если пир владеет его ключом
+	peerNonce, sig := reply[:localNonceSize], reply[localNonceSize:]
+	if !ed25519.Verify(ed25519.PublicKey(peerID[:]), localHelloSigned(nonce[:], peerID, localID), sig) {
+		return router.PeerID{}, fmt.Errorf("invalid hello signature from %s", addr)
+	}
+
+	proof := ed25519.Sign(d.c.edPrivKey, localHelloSigned(peerNonce, localID, peerID))
+	if err := writeLocalFrame(conn, localFrameProof, localID, proof); err != nil {
+		return router.PeerID{}, err
+	}
+	if _, _, _, err := readLocalFrame(r, localFrameAck); err != nil {
+		return router.PeerID{}, fmt.Errorf("hello proof rejected: %w", err)
+	}
+	return peerID, nil
+}
+
+// localHelloSigned - подписываемые данные hello: nonce другой стороны, ID
+// подписавшего и ID проверяющего
+func localHelloSigned(nonce []byte, from, to router.PeerID) []byte {
+	msg := append([]byte{}, localHelloContext...)
+	msg = append(msg, nonce...)
+	msg = append(msg, from[:]...)
+	return append(msg, to[:]...)
+}
+
+// sendSignal отправляет сигнальное сообщение в сокет пира и ждет подтверждения
+func (d *localDiscovery) sendSignal(ctx context.Context, addr netip.AddrPort, signedMsg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, localIOTimeout)
+	defer cancel()
+	conn, err := d.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := writeLocalFrame(conn, localFrameSignal, d.c.LocalID(), signedMsg); err != nil {
+		return err
+	}
+	_, _, _, err = readLocalFrame(bufio.NewReader(conn), localFrameAck)
+	return err
+}
+
+// acceptSignals принимает подключения к сокету до его закрытия
+func (d *localDiscovery) acceptSignals() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Debug("Local signaling accept failed", "error", err)
+			}
+			return
+		}
+		// SECURITY: подключиться может любой в сети, число одновременно
+		// обслуживаемых подключений ограничено
+		select {
+		case d.conns <- struct{}{}:
+		default:
+			slog.Debug("Too many local signaling connections", "addr", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		d.c.spawn(func() {
+			defer func() { <-d.conns }()
+			defer conn.Close()
+			d.serve(conn)
+		})
+	}
+}
+
+// serve отвечает на hello или сигнальное сообщение. Отправитель проверяется
+// до чтения payload
+func (d *localDiscovery) serve(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(localIOTimeout))
+	r := bufio.NewReader(conn)
+	kind, sender, size, err := readLocalHeader(r, localFrameHello, localFrameSignal)
+	if err != nil {
+		return
+	}
+	remote, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	hexID := hex.EncodeToString(sender[:8])
+
+	switch kind {
+	case localFrameHello:
+		// PeerID сообщаем только пиру, объявление которого видели с этого адреса
+		d.mu.Lock()
+		a, ok := d.announcements[localPeerHash(sender)]
+		seen := ok && a.addr.Addr() == remote.Addr().Unmap() && time.Since(a.lastSeen) < localPeerTTL
+		var addr netip.AddrPort
+		if seen {
+			addr = a.addr
+		}
+		d.mu.Unlock()
+		if !seen {
+			slog.Debug("Rejected local hello from unannounced peer", "peerID", hexID+"...", "addr", remote)
+			return
+		}
+		if size != localNonceSize {
+			return
+		}
+		d.serveHello(conn, r, sender, addr)
+
+	case localFrameSignal:
+		addr, ok := d.peerAddr(sender)
+		if !ok || addr.Addr() != remote.Addr().Unmap() {
+			slog.Debug("Rejected local signal from unknown peer", "peerID", hexID+"...", "addr", remote)
+			return
+		}
+		payload, err := readLocalPayload(r, size)
+		if err != nil {
+			return
+		}
+		select {
+		case d.signals <- router.ServerMessage{Type: router.Income, SenderID: sender, Payload: payload}:
+		case <-d.c.done:
+			return
+		}
+		writeLocalFrame(conn, localFrameAck, d.c.LocalID(), nil)
+	}
+}
+
+// serveHello отвечает на hello подписью nonce спрашивающего и запоминает
+// его, если он подписал наш nonce
+func (d *localDiscovery) serveHello(conn net.Conn, r io.Reader, sender router.PeerID, addr netip.AddrPort) {
+	peerNonce, err := readLocalPayload(r, localNonceSize)
+	if err != nil {
+		return
+	}
+	localID := d.c.LocalID()
+
+	reply := make([]byte, localNonceSize, localHelloReplySize)
+	rand.Read(reply)
+	nonce := reply[:localNonceSize]
+	reply = append(reply, ed25519.Sign(d.c.edPrivKey, localHelloSigned(peerNonce, localID, sender))...)
+	if err := writeLocalFrame(conn, localFrameHello, localID, reply); err != nil {
+		return
+	}
+
+	_, from, sig, err := readLocalFrame(r, localFrameProof)
+	if err != nil || from != sender || len(sig) != ed25519.SignatureSize {
+		return
+	}
+	// SECURITY: без подписи любой в сети мог бы выдать себя за sender
+	if !ed25519.Verify(ed25519.PublicKey(sender[:]), localHelloSigned(nonce, sender, localID), sig) {
+		slog.Debug("Rejected local hello with invalid signature", "peerID", hex.EncodeToString(sender[:8])+"...", "addr", addr)
+		return
+	}
+	if err := writeLocalFrame(conn, localFrameAck, localID, nil); err != nil {
+		return
+	}
+	d.addPeer(sender, addr)
+}
+
+// writeLocalFrame пишет кадр: тип, PeerID отправителя, длина и payload
+func writeLocalFrame(w io.Writer, kind byte, sender router.PeerID, payload []byte) error {
+	frame := make([]byte, localFrameHeaderSize, localFrameHeaderSize+len(payload))
+	frame[0] = kind
+	copy(frame[1:], sender[:])
+	binary.BigEndian.PutUint32(frame[1+router.PeerIDSize:], uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// readLocalHeader читает заголовок кадра одного из типов kinds и проверяет
+// длину payload до его чтения
+func readLocalHeader(r io.Reader, kinds ...byte) (byte, router.PeerID, uint32, error) {
+	var header [localFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, router.PeerID{}, 0, err
+	}
+	kind := header[0]
+	if !slices.Contains(kinds, kind) {
+		return 0, router.PeerID{}, 0, fmt.Errorf("unexpected local frame %d", kind)
+	}
+	size := binary.BigEndian.Uint32(header[1+router.PeerIDSize:])
+	if size > localFrameLimit(kind) {
+		return 0, router.PeerID{}, 0, fmt.Errorf("local frame %d too large: %d bytes", kind, size)
+	}
+	var sender router.PeerID
+	copy(sender[:], header[1:])
+	return kind, sender, size, nil
+}
+
+// readLocalPayload читает payload кадра, длина уже проверена
+func readLocalPayload(r io.Reader, size uint32) ([]byte, error) {
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// readLocalFrame читает кадр одного из типов kinds, записанный writeLocalFrame
+func readLocalFrame(r io.Reader, kinds ...byte) (byte, router.PeerID, []byte, error) {
+	kind, sender, size, err := readLocalHeader(r, kinds...)
+	if err != nil {
+		return 0, router.PeerID{}, nil, err
+	}
+	payload, err := readLocalPayload(r, size)
+	if err != nil {
+		return 0, router.PeerID{}, nil, err
+	}
+	return kind, sender, payload, nil
+}
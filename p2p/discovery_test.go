@@ -0,0 +1,135 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// TestLocalDiscovery проверяет обмен PeerID после объявлений и соединение
+// через локальную сигнализацию. Клиенты router'а не подключены, поэтому
+// сигнальные сообщения могут идти только напрямую
+func TestLocalDiscovery(t *testing.T) {
+	newConnector := func() (*Connector, router.PeerID, chan Event) {
+		connector, peerID := newTestConnector(t, "", ConnectorConfig{EnableLocalDiscovery: true})
+		discovered := make(chan Event, 10)
+		go func() {
+			for event := range connector.Events() {
+				if event.Type == EventPeerDiscovered {
+					discovered <- event
+				}
+			}
+		}()
+		return connector, peerID, discovered
+	}
+
+	connector1, peerID1, discovered1 := newConnector()
+	connector2, peerID2, discovered2 := newConnector()
+
+	// Multicast в тестовом окружении может не работать, объявления
+	// передаются напрямую
+	from := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), 5353)
+	announce := func(sender, to *Connector) {
+		t.Helper()
+		packet, err := sender.local.announcement(localPeerTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		to.local.handlePacket(packet, from)
+	}
+	announce(connector1, connector2)
+	announce(connector2, connector1)
+
+	for _, c := range []struct {
+		events <-chan Event
+		want   router.PeerID
+	}{
+		{discovered1, peerID2},
+		{discovered2, peerID1},
+	} {
+		select {
+		case event := <-c.events:
+			if event.PeerID != c.want {
+				t.Fatalf("Discovered unexpected peer %x", event.PeerID[:8])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for local discovery")
+		}
+	}
+	if peers := connector1.DiscoverLocal(); len(peers) != 1 || peers[0].PeerID != peerID2 {
+		t.Fatalf("Unexpected local peers: %+v", peers)
+	}
+
+	// Повторное объявление не порождает событие
+	announce(connector2, connector1)
+	select {
+	case event := <-discovered1:
+		t.Fatalf("Unexpected event: %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := <-connector1.ConnectContext(ctx, hex.EncodeToString(peerID2[:])); err != nil {
+		t.Fatalf("Connect over local signaling failed: %v", err)
+	}
+	if _, err := connector2.WaitForPeer(ctx, peerID1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Прощание убирает пира из найденных
+	packet, err := connector2.local.announcement(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector1.local.handlePacket(packet, from)
+	if peers := connector1.DiscoverLocal(); len(peers) != 0 {
+		t.Fatalf("Expected no local peers after goodbye, got %+v", peers)
+	}
+}
+
+func TestLocalHelloFromUnannouncedPeer(t *testing.T) {
+	connector, peerID := newTestConnector(t, "", ConnectorConfig{EnableLocalDiscovery: true})
+
+	// Пир, объявления которого не было, PeerID не узнает
+	otherPub, otherPriv, _ := ed25519.GenerateKey(nil)
+	other := &localDiscovery{c: &Connector{cli: router.NewClient(otherPub, otherPriv), edPrivKey: otherPriv}}
+	addr := netip.MustParseAddrPort(connector.local.listener.Addr().String())
+	addr = netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), addr.Port())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := other.hello(ctx, addr, localPeerHash(peerID)); err == nil {
+		t.Fatal("Expected hello to be rejected")
+	}
+	if err := other.sendSignal(ctx, addr, []byte("signal")); err == nil {
+		t.Fatal("Expected signal from unknown peer to be rejected")
+	}
+
+	// Чужой PeerID в hello без его ключа не принимается, даже если
+	// объявление с этим хешем было
+	var victim router.PeerID
+	copy(victim[:], otherPub)
+	connector.local.handleAnnouncement(localPeerHash(victim), netip.AddrPortFrom(addr.Addr(), 1), false)
+	_, impostorPriv, _ := ed25519.GenerateKey(nil)
+	impostor := &localDiscovery{c: &Connector{cli: router.NewClient(otherPub, impostorPriv), edPrivKey: impostorPriv}}
+	if _, err := impostor.hello(ctx, addr, localPeerHash(peerID)); err == nil {
+		t.Fatal("Expected hello without the key to be rejected")
+	}
+	if peers := connector.DiscoverLocal(); len(peers) != 0 {
+		t.Fatalf("Impostor discovered: %+v", peers)
+	}
+
+	// Кадр сверх предела отклоняется до чтения payload
+	var frame bytes.Buffer
+	writeLocalFrame(&frame, localFrameHello, victim, make([]byte, localHelloReplySize+1))
+	if _, _, _, err := readLocalFrame(&frame, localFrameHello); err == nil {
+		t.Fatal("Expected oversized hello to be rejected")
+	}
+}
@@ -0,0 +1,123 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// Бинарный конверт сигнализации вместо JSON(SignedMessage{JSON(EncryptedMessage)}),
+// где зашифрованные данные дважды кодируются в base64:
+//
+//   - Version(1) + Signature(64) + SenderEncPubKey(32) + uvarint(len) + EncryptedData
+//
+// Подпись Ed25519 покрывает все, кроме самой подписи. Прежний JSON конверт
+// начинается с '{', поэтому форматы различаются по первому байту.
+//
+// Пир прежней версии бинарный конверт не разберет, поэтому он отправляется
+// только пирам, которые показали, что его понимают: прислали бинарный
+// конверт или JSON конверт с signal_version. Остальным, в том числе до
+// первого сообщения от пира (KEY_EXCHANGE), уходит JSON с signal_version,
+// который прежние версии игнорируют. JSON формат можно будет убрать через
+// релиз
+
+// signalVersion - версия бинарного конверта
+const signalVersion byte = 1
+
+const signalHeaderSize = 1 + ed25519.SignatureSize + 32
+
+var errInvalidSignature = errors.New("invalid Ed25519 signature - potential MITM attack")
+
+// encodeSignal кодирует и подписывает бинарный конверт
+func encodeSignal(env *EncryptedMessage, priv ed25519.PrivateKey) []byte {
+	body := make([]byte, 0, 32+binary.MaxVarintLen64+len(env.EncryptedData))
+	body = append(body, env.SenderEncPubKey[:]...)
+	body = binary.AppendUvarint(body, uint64(len(env.EncryptedData)))
+	body = append(body, env.EncryptedData...)
+
+	sig := ed25519.Sign(priv, signalSigned(signalVersion, body))
+	buf := make([]byte, 0, 1+len(sig)+len(body))
+	buf = append(buf, signalVersion)
+	buf = append(buf, sig...)
+	return append(buf, body...)
+}
+
+// signalSigned - подписываемые данные бинарного конверта: все, кроме подписи
+func signalSigned(version byte, body []byte) []byte {
+	return append([]byte{version}, body...)
+}
+
+// encodeLegacySignal кодирует и подписывает JSON конверт прежней версии
+func encodeLegacySignal(env *EncryptedMessage, priv ed25519.PrivateKey) ([]byte, error) {
+	legacy := *env
+	legacy.SignalVersion = signalVersion
+	payload, err := json.Marshal(legacy)
+	if err != nil {
+		return nil, fmt.Errorf("marshal envelope: %w", err)
+	}
+	return json.Marshal(SignedMessage{
+		Payload:   payload,
+		Signature: SignMessage(payload, priv),
+	})
+}
+
+// decodeSignal проверяет подпись отправителя и декодирует конверт любого
+// формата. Второе значение сообщает, что отправитель понимает бинарный
+// конверт
+func decodeSignal(data []byte, sender ed25519.PublicKey) (*EncryptedMessage, bool, error) {
+	if len(data) == 0 {
+		return nil, false, fmt.Errorf("empty message")
+	}
+	if data[0] == '{' {
+		return decodeLegacySignal(data, sender)
+	}
+	if data[0] != signalVersion {
+		return nil, false, fmt.Errorf("unsupported signal version %d", data[0])
+	}
+
+	if len(data) < signalHeaderSize+1 {
+		return nil, false, fmt.Errorf("signal too short: %d bytes", len(data))
+	}
+	sig := data[1 : 1+ed25519.SignatureSize]
+	body := data[1+ed25519.SignatureSize:]
+	size, n := binary.Uvarint(body[32:])
+	if n <= 0 || size != uint64(len(body)-32-n) {
+		return nil, false, fmt.Errorf("invalid signal payload length")
+	}
+
+	if !VerifySignature(signalSigned(data[0], body), sig, sender) {
+		return nil, false, errInvalidSignature
+	}
+
+	env := &EncryptedMessage{EncryptedData: body[32+n:]}
+	copy(env.SenderEncPubKey[:], body[:32])
+	return env, true, nil
+}
+
+// decodeLegacySignal разбирает JSON конверт прежней версии
+func decodeLegacySignal(data []byte, sender ed25519.PublicKey) (*EncryptedMessage, bool, error) {
+	var signed SignedMessage
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, false, fmt.Errorf("unmarshal signed message: %w", err)
+	}
+	if !VerifySignature(signed.Payload, signed.Signature, sender) {
+		return nil, false, errInvalidSignature
+	}
+	var env EncryptedMessage
+	if err := json.Unmarshal(signed.Payload, &env); err != nil {
+		return nil, false, fmt.Errorf("unmarshal envelope: %w", err)
+	}
+	return &env, env.SignalVersion >= signalVersion, nil
+}
+
+// signEnvelope кодирует и подписывает конверт в формате, который понимает пир
+func (c *Connector) signEnvelope(peerID router.PeerID, env *EncryptedMessage) ([]byte, error) {
+	if _, ok := c.binarySignal.Load(peerID); ok {
+		return encodeSignal(env, c.edPrivKey), nil
+	}
+	return encodeLegacySignal(env, c.edPrivKey)
+}
@@ -0,0 +1,111 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestSignalEnvelope(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	env := &EncryptedMessage{
+		SenderEncPubKey: [32]byte{1, 2, 3},
+		EncryptedData:   bytes.Repeat([]byte{0xab}, 300),
+	}
+
+	binary := encodeSignal(env, priv)
+	legacy, err := encodeLegacySignal(env, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"binary": binary, "legacy": legacy} {
+		got, supportsBinary, err := decodeSignal(data, pub)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !supportsBinary {
+			t.Fatalf("%s: expected sender to support binary envelope", name)
+		}
+		if got.SenderEncPubKey != env.SenderEncPubKey || !bytes.Equal(got.EncryptedData, env.EncryptedData) {
+			t.Fatalf("%s: envelope changed", name)
+		}
+		if _, _, err := decodeSignal(data, otherPub); !errors.Is(err, errInvalidSignature) {
+			t.Fatalf("%s: expected errInvalidSignature for another sender, got %v", name, err)
+		}
+	}
+
+	// Подмена ключа шифрования или данных ломает подпись
+	for _, i := range []int{1 + ed25519.SignatureSize, len(binary) - 1} {
+		tampered := bytes.Clone(binary)
+		tampered[i] ^= 0xff
+		if _, _, err := decodeSignal(tampered, pub); !errors.Is(err, errInvalidSignature) {
+			t.Fatalf("Expected errInvalidSignature for byte %d, got %v", i, err)
+		}
+	}
+
+	// Обрезанный конверт и неизвестная версия
+	if _, _, err := decodeSignal(binary[:len(binary)-1], pub); err == nil {
+		t.Fatal("Expected error for truncated envelope")
+	}
+	unknown := bytes.Clone(binary)
+	unknown[0] = signalVersion + 1
+	if _, _, err := decodeSignal(unknown, pub); err == nil {
+		t.Fatal("Expected error for unknown version")
+	}
+}
+
+// TestLegacySignalEnvelope проверяет конверт пира прежней версии: без
+// signal_version ему нельзя отправлять бинарный конверт
+func TestLegacySignalEnvelope(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	payload, err := json.Marshal(map[string]any{
+		"sender_enc_pubkey": [32]byte{7},
+		"encrypted_data":    []byte("KEY_EXCHANGE_V1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(SignedMessage{Payload: payload, Signature: SignMessage(payload, priv)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, supportsBinary, err := decodeSignal(data, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if supportsBinary {
+		t.Fatal("Old peer must not get binary envelopes")
+	}
+	if env.SenderEncPubKey != [32]byte{7} || string(env.EncryptedData) != "KEY_EXCHANGE_V1" {
+		t.Fatalf("Unexpected envelope: %+v", env)
+	}
+}
+
+// TestSignalEnvelopeSize сравнивает размер конвертов для offer типичного
+// размера: JSON с base64 внутри base64 почти вдвое больше
+func TestSignalEnvelopeSize(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+
+	for _, size := range []int{40, 1500, 6000} {
+		env := &EncryptedMessage{EncryptedData: make([]byte, size)}
+		binary := encodeSignal(env, priv)
+		legacy, err := encodeLegacySignal(env, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		overhead := len(binary) - size
+		if overhead > signalHeaderSize+2 {
+			t.Fatalf("Size %d: binary overhead %d bytes", size, overhead)
+		}
+		if size >= 1500 && float64(len(legacy)) < 1.7*float64(len(binary)) {
+			t.Fatalf("Size %d: expected legacy envelope to be much larger, got %d vs %d", size, len(legacy), len(binary))
+		}
+		t.Logf("Payload %d bytes: binary %d, legacy JSON %d", size, len(binary), len(legacy))
+	}
+}
@@ -0,0 +1,200 @@
+package p2p
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// Доставка событий. emit не отправляет в канал Events сам, а кладет событие
+// во внутреннюю очередь, из которой его забирает pumpEvents. Так медленный
+// читатель Events не блокирует обработчики pion и router'а.
+//
+// Гарантии:
+//   - порядок событий сохраняется, в том числе между данными и событиями
+//     соединения одного пира
+//   - EventDataReceived никогда не отбрасываются. Если в очереди больше
+//     EventBufferSize сообщений (см. SetEventBufferSize), emit ждет
+//     читателя (backpressure): медленный читатель замедляет прием данных,
+//     а не теряет их
+//   - остальные события не блокируют emit. Если в очереди их больше
+//     maxQueuedEvents, новые отбрасываются и учитываются в DroppedEvents,
+//     о начале потерь пишется предупреждение в лог. Результат
+//     ConnectContext и WaitForPeer от этого не зависит - они узнают его
+//     в emit до постановки в очередь
+//   - после Close события, не прочитанные из очереди, отбрасываются
+
+// maxQueuedEvents - сколько событий, кроме EventDataReceived, может ждать
+// отправки в Events
+const maxQueuedEvents = 10000
+
+// eventQueue - очередь событий между emit и каналом Events
+type eventQueue struct {
+	mu        sync.Mutex
+	events    []Event
+	data      int           // EventDataReceived в очереди
+	dataLimit int           // сколько EventDataReceived может ждать в очереди
+	space     chan struct{} // закрывается, когда освобождается место для данных
+	ready     chan struct{} // буфер 1, в очереди появились события
+	// Очередь отбрасывает события, пока pop не освободит место
+	overflow bool
+
+	dropped atomic.Uint64
+}
+
+// push ставит событие в очередь. EventDataReceived ждет, пока в очереди
+// станет меньше dataLimit данных или закроется done. Возвращает false, если
+// событие отброшено, firstDrop - если с него начались потери
+func (q *eventQueue) push(event Event, done <-chan struct{}) (ok, firstDrop bool) {
+	for {
+		q.mu.Lock()
+		if event.Type != EventDataReceived {
+			if len(q.events)-q.data >= maxQueuedEvents {
+				firstDrop = !q.overflow
+				q.overflow = true
+				q.mu.Unlock()
+				q.dropped.Add(1)
+				return false, firstDrop
+			}
+			break
+		}
+		if q.data < q.dataLimit {
+			q.data++
+			break
+		}
+		if q.space == nil {
+			q.space = make(chan struct{})
+		}
+		space := q.space
+		q.mu.Unlock()
+
+		select {
+		case <-space:
+		case <-done:
+			return false, false
+		}
+	}
+	q.events = append(q.events, event)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true, false
+}
+
+// pop забирает первое событие из очереди и будит emit, ждущие места для
+// данных
+func (q *eventQueue) pop() (Event, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.events) == 0 {
+		return Event{}, false
+	}
+	event := q.events[0]
+	q.events[0] = Event{}
+	q.events = q.events[1:]
+	if len(q.events) == 0 {
+		// Не держим разросшийся после всплеска массив
+		q.events = nil
+	}
+	if q.overflow && len(q.events)-q.data < maxQueuedEvents {
+		q.overflow = false
+	}
+	if event.Type == EventDataReceived {
+		q.data--
+		q.wakeLocked()
+	}
+	return event, true
+}
+
+// setDataLimit меняет dataLimit и будит emit, ждущие места для данных
+func (q *eventQueue) setDataLimit(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dataLimit = limit
+	q.wakeLocked()
+}
+
+// wakeLocked будит emit, ждущие места для данных. Вызывается под mu
+func (q *eventQueue) wakeLocked() {
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+}
+
+// pumpEvents переносит события из очереди в канал Events до Close
+func (c *Connector) pumpEvents() {
+	for {
+		event, ok := c.queue.pop()
+		if !ok {
+			select {
+			case <-c.queue.ready:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+		select {
+		case c.events <- event:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Events возвращает канал событий. Канал закрывается в Close. Гарантии
+// доставки описаны в начале events.go
+func (c *Connector) Events() <-chan Event {
+	return c.events
+}
+
+// emit отправляет событие. После Close события отбрасываются
+func (c *Connector) emit(event Event) {
+	switch event.Type {
+	case EventConnected, EventConnectedRelay:
+		c.finishConnect(event.PeerID, nil)
+		c.resolvePeerWaiter(event.PeerID, event.Peer, nil)
+		c.keyPeers.remove(event.PeerID)
+	case EventConnectionFailed:
+		c.finishConnect(event.PeerID, event.Error)
+		c.resolvePeerWaiter(event.PeerID, nil, connectionFailedError(event.Error))
+	}
+
+	c.eventsMu.RLock()
+	closed := c.closed
+	c.eventsMu.RUnlock()
+	if closed {
+		return
+	}
+
+	ok, firstDrop := c.queue.push(event, c.done)
+	switch {
+	case ok || event.Type == EventDataReceived:
+	case firstDrop:
+		slog.Warn("Event queue is full, dropping events until Events is read", "type", event.Type, "dropped", c.queue.dropped.Load())
+	default:
+		slog.Debug("Event queue is full, dropping event", "type", event.Type, "dropped", c.queue.dropped.Load())
+	}
+}
+
+// SetEventBufferSize меняет, сколько полученных сообщений может ждать
+// чтения Events, прежде чем прием данных начнет ждать читателя. Емкость
+// самого канала Events задается EventBufferSize при создании и не меняется.
+// size <= 0 = DefaultEventBufferSize
+func (c *Connector) SetEventBufferSize(size int) {
+	if size <= 0 {
+		size = DefaultEventBufferSize
+	}
+	c.queue.setDataLimit(size)
+	slog.Debug("Event buffer size changed", "size", size)
+}
+
+// DroppedEvents возвращает, сколько событий отброшено из-за того, что
+// Events не читали (см. начало events.go). Полученные данные не теряются
+func (c *Connector) DroppedEvents() uint64 {
+	return c.queue.dropped.Load()
+}
@@ -0,0 +1,209 @@
+package p2p
+
+import (
+	"container/list"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// Состояние пиров, с которыми соединение не установлено: счетчики rate
+// limiting offer'ов и ключи шифрования из KEY_EXCHANGE. Любой пир сети
+// может прислать их с новых ID, поэтому число таких записей ограничено
+// maxUnconnectedPeers (вытесняются давно не использованные), а устаревшие
+// удаляет фоновая горутина раз в janitorInterval. Ключи пиров, с которыми
+// соединение установлено, хранятся до перезапуска как раньше
+
+const (
+	// maxUnconnectedPeers - сколько пиров без соединения хранится в каждой таблице
+	maxUnconnectedPeers = 1024
+
+	// offerCounterTTL - время жизни счетчика offer'ов. Больше окна rate
+	// limiting, чтобы пир не сбрасывал лимит паузой
+	offerCounterTTL = 2 * time.Minute
+
+	// peerKeyTTL - время жизни ключа пира, соединение с которым не
+	// установлено. Пир повторит KEY_EXCHANGE при следующей попытке
+	peerKeyTTL = 10 * time.Minute
+
+	janitorInterval = time.Minute
+)
+
+// Stats - размеры внутренних таблиц коннектора и счетчики шифрования
+type Stats struct {
+	Peers           int // установленные соединения
+	PendingOffers   int // наши offer'ы, ждущие answer
+	OfferCounters   int // счетчики rate limiting входящих offer'ов
+	PeerKeys        int // ключи шифрования пиров
+	UnconfirmedKeys int // ключи пиров, соединение с которыми не установлено
+
+	MessagesEncrypted uint64 // сообщения, зашифрованные для пиров
+	MessagesDecrypted uint64 // сообщения пиров, успешно расшифрованные
+
+	DroppedEvents uint64 // события, отброшенные из-за переполнения очереди, см. Connector.DroppedEvents
+}
+
+// Stats возвращает размеры внутренних таблиц коннектора и счетчики шифрования
+func (c *Connector) Stats() Stats {
+	return Stats{
+		Peers:           syncMapLen(&c.peers),
+		PendingOffers:   syncMapLen(&c.pendingOffers),
+		OfferCounters:   syncMapLen(&c.offerCount),
+		PeerKeys:        syncMapLen(&c.peerEncKeys),
+		UnconfirmedKeys: c.keyPeers.len(),
+
+		MessagesEncrypted: c.messagesEncrypted.Load(),
+		MessagesDecrypted: c.messagesDecrypted.Load(),
+
+		DroppedEvents: c.queue.dropped.Load(),
+	}
+}
+
+func syncMapLen(m *sync.Map) int {
+	n := 0
+	m.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// runJanitor периодически удаляет устаревшее состояние пиров до Close
+func (c *Connector) runJanitor() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			c.expireState(now)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// expireState удаляет счетчики offer'ов и ключи пиров, не использованные дольше TTL
+func (c *Connector) expireState(now time.Time) {
+	for _, peerID := range c.offerPeers.expire(now, offerCounterTTL) {
+		c.offerCount.Delete(peerID)
+	}
+	for _, peerID := range c.keyPeers.expire(now, peerKeyTTL) {
+		if c.peerActive(peerID) {
+			// Соединение устанавливается - ждем его результата
+			c.keyPeers.touch(peerID, now)
+			continue
+		}
+		c.forgetPeerKey(peerID)
+	}
+}
+
+// trackOfferCounter отмечает offer от пира, вытесняя самый старый счетчик
+func (c *Connector) trackOfferCounter(peerID router.PeerID, now time.Time) {
+	if evicted, ok := c.offerPeers.touch(peerID, now); ok {
+		c.offerCount.Delete(evicted)
+	}
+}
+
+// trackPeerKey отмечает ключ пира, соединение с которым еще не установлено
+func (c *Connector) trackPeerKey(peerID router.PeerID, now time.Time) {
+	if evicted, ok := c.keyPeers.touch(peerID, now); ok && !c.peerActive(evicted) {
+		c.forgetPeerKey(evicted)
+	}
+}
+
+// forgetPeerKey удаляет ключ пира и связанное с ним состояние сигнализации
+func (c *Connector) forgetPeerKey(peerID router.PeerID) {
+	slog.Debug("Forgetting encryption key of unconnected peer", "peerID", hex.EncodeToString(peerID[:8])+"...")
+	c.peerEncKeys.Delete(peerID)
+	c.peerKeyReady.Delete(peerID)
+	c.binarySignal.Delete(peerID)
+}
+
+// peerActive сообщает, есть ли с пиром соединение или попытка соединения
+func (c *Connector) peerActive(peerID router.PeerID) bool {
+	if _, ok := c.peers.Load(peerID); ok {
+		return true
+	}
+	if _, ok := c.pendingOffers.Load(peerID); ok {
+		return true
+	}
+	c.peerSlotsMu.Lock()
+	defer c.peerSlotsMu.Unlock()
+	return c.peerSlots[peerID] > 0
+}
+
+// peerLRU - пиры в порядке последнего обращения, не больше
+// maxUnconnectedPeers. Нулевое значение готово к работе
+type peerLRU struct {
+	mu    sync.Mutex
+	order list.List // *lruEntry, в начале - недавно использованные
+	items map[router.PeerID]*list.Element
+}
+
+type lruEntry struct {
+	peerID router.PeerID
+	used   time.Time
+}
+
+// touch отмечает обращение к пиру. Если пиров стало больше
+// maxUnconnectedPeers, вытесняет и возвращает давно не использованного
+func (l *peerLRU) touch(peerID router.PeerID, now time.Time) (router.PeerID, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.items[peerID]; ok {
+		el.Value.(*lruEntry).used = now
+		l.order.MoveToFront(el)
+		return router.PeerID{}, false
+	}
+	if l.items == nil {
+		l.items = make(map[router.PeerID]*list.Element)
+	}
+	l.items[peerID] = l.order.PushFront(&lruEntry{peerID: peerID, used: now})
+
+	if l.order.Len() <= maxUnconnectedPeers {
+		return router.PeerID{}, false
+	}
+	oldest := l.order.Remove(l.order.Back()).(*lruEntry)
+	delete(l.items, oldest.peerID)
+	return oldest.peerID, true
+}
+
+// remove перестает отслеживать пира
+func (l *peerLRU) remove(peerID router.PeerID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.items[peerID]; ok {
+		l.order.Remove(el)
+		delete(l.items, peerID)
+	}
+}
+
+// expire удаляет и возвращает пиров, к которым не обращались дольше ttl
+func (l *peerLRU) expire(now time.Time, ttl time.Duration) []router.PeerID {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var expired []router.PeerID
+	for el := l.order.Back(); el != nil; el = l.order.Back() {
+		entry := el.Value.(*lruEntry)
+		if now.Sub(entry.used) <= ttl {
+			break
+		}
+		l.order.Remove(el)
+		delete(l.items, entry.peerID)
+		expired = append(expired, entry.peerID)
+	}
+	return expired
+}
+
+func (l *peerLRU) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
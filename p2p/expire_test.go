@@ -0,0 +1,76 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// TestExpireState проверяет, что состояние пиров без соединения истекает,
+// а ключ пира, с которым идет соединение, сохраняется
+func TestExpireState(t *testing.T) {
+	c := &Connector{done: make(chan struct{}), maxOffersPerMinute: DefaultMaxOffersPerMinute}
+	idle, connecting := router.PeerID{1}, router.PeerID{2}
+
+	for _, peerID := range []router.PeerID{idle, connecting} {
+		if !c.checkOfferRateLimit(peerID) {
+			t.Fatal("Unexpected rate limit")
+		}
+		keyExchange := &EncryptedMessage{
+			SenderEncPubKey: [32]byte{peerID[0]},
+			EncryptedData:   []byte("KEY_EXCHANGE_V1"),
+		}
+		if _, err := c.decryptMessageFromPeer(peerID, keyExchange); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.pendingOffers.Store(connecting, make(chan []byte))
+
+	stats := c.Stats()
+	if stats.OfferCounters != 2 || stats.PeerKeys != 2 || stats.UnconfirmedKeys != 2 || stats.PendingOffers != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	// Счетчики offer'ов истекают раньше ключей
+	now := time.Now()
+	c.expireState(now.Add(offerCounterTTL + time.Second))
+	stats = c.Stats()
+	if stats.OfferCounters != 0 || stats.PeerKeys != 2 {
+		t.Fatalf("Expected offer counters to expire: %+v", stats)
+	}
+
+	c.expireState(now.Add(peerKeyTTL + time.Second))
+	if _, ok := c.PeerEncryptionKey(idle); ok {
+		t.Fatal("Expected key of idle peer to expire")
+	}
+	if _, ok := c.PeerEncryptionKey(connecting); !ok {
+		t.Fatal("Key of connecting peer must be kept")
+	}
+	if _, ok := c.peerKeyReady.Load(idle); ok {
+		t.Fatal("Expected key waiter of idle peer to be removed")
+	}
+	if stats = c.Stats(); stats.PeerKeys != 1 || stats.UnconfirmedKeys != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+// TestOfferCountersBounded проверяет, что пир с множеством ID не может
+// завести больше maxUnconnectedPeers счетчиков
+func TestOfferCountersBounded(t *testing.T) {
+	c := &Connector{done: make(chan struct{})}
+
+	for i := range maxUnconnectedPeers + 10 {
+		var peerID router.PeerID
+		peerID[0], peerID[1] = byte(i), byte(i>>8)
+		c.checkOfferRateLimit(peerID)
+	}
+
+	if n := c.Stats().OfferCounters; n != maxUnconnectedPeers {
+		t.Fatalf("Expected %d offer counters, got %d", maxUnconnectedPeers, n)
+	}
+	// Вытеснены самые старые
+	if _, ok := c.offerCount.Load(router.PeerID{0}); ok {
+		t.Fatal("Expected oldest counter to be evicted")
+	}
+}
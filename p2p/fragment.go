@@ -0,0 +1,190 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Фрагментация сообщений DataChannel: SCTP ограничивает размер одного
+// сообщения (у браузеров - от 16 KB), а Send принимает данные любого
+// размера. Сообщение больше maxFragmentSize делится на фрагменты, каждый
+// шифруется и отправляется отдельным сообщением канала. Получатель собирает
+// фрагменты и отдает приложению целое сообщение. Заголовок идет в открытом
+// тексте после номера сообщения (см. replay.go):
+//
+//   - целое сообщение: Kind(1)=0 + данные
+//   - фрагмент: Kind(1)=1 + MessageID(4) + Index(2) + Total(2) + данные
+//
+// MessageID уникален в пределах пира, поэтому фрагменты разных сообщений,
+// в том числе разных каналов, могут чередоваться. Заголовок добавляется,
+// только если оба пира поставили sessionFlagFragments в handshake, пиру
+// прежней версии сообщение уходит целиком, как раньше. Relay не
+// фрагментируется: router делит сообщения сам
+
+const (
+	fragWhole byte = iota
+	fragPart
+)
+
+const (
+	fragWholeHeaderSize = 1
+	fragPartHeaderSize  = 1 + 4 + 2 + 2
+
+	// maxFragmentSize - данных в одном фрагменте. Вместе с заголовками и
+	// шифрованием сообщение канала остается меньше 16 KB
+	maxFragmentSize = 16*1024 - 128
+
+	// MaxMessageSize - предел размера сообщения, которое отправляется и
+	// собирается из фрагментов
+	MaxMessageSize = 16 * 1024 * 1024
+
+	// maxReassemblySize - MaxMessageSize вместе с типом сообщения (см. rpc.go)
+	maxReassemblySize = MaxMessageSize + msgTypeSize
+
+	maxFragments = (maxReassemblySize + maxFragmentSize - 1) / maxFragmentSize
+
+	// maxPartialMessages - сколько сообщений пира собирается одновременно.
+	// Фрагменты ненадежного канала теряются, недособранные сообщения
+	// вытесняются новыми
+	maxPartialMessages = 16
+)
+
+var ErrMessageTooLarge = errors.New("message too large")
+
+var errReassemblyLimit = errors.New("reassembly buffer limit exceeded")
+
+// fragment делит данные на сообщения канала с заголовком фрагментации
+func (p *Peer) fragment(data []byte) [][]byte {
+	if len(data) <= maxFragmentSize {
+		frame := make([]byte, 0, fragWholeHeaderSize+len(data))
+		frame = append(frame, fragWhole)
+		return [][]byte{append(frame, data...)}
+	}
+
+	id := p.nextMessageID.Add(1)
+	total := (len(data) + maxFragmentSize - 1) / maxFragmentSize
+	frames := make([][]byte, 0, total)
+	for i := range total {
+		part := data[i*maxFragmentSize : min((i+1)*maxFragmentSize, len(data))]
+		frame := make([]byte, 0, fragPartHeaderSize+len(part))
+		frame = append(frame, fragPart)
+		frame = binary.BigEndian.AppendUint32(frame, id)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(i))
+		frame = binary.BigEndian.AppendUint16(frame, uint16(total))
+		frames = append(frames, append(frame, part...))
+	}
+	return frames
+}
+
+// reassembler - собираемые сообщения одного пира
+type reassembler struct {
+	mu      sync.Mutex
+	partial map[uint32]*partialMessage
+	size    int // байт во всех собираемых сообщениях
+}
+
+type partialMessage struct {
+	parts    [][]byte
+	received int
+	size     int
+}
+
+// add принимает сообщение канала. Возвращает собранное сообщение и true,
+// если оно целое или пришел его последний фрагмент
+func (r *reassembler) add(frame []byte) ([]byte, bool, error) {
+	if len(frame) == 0 {
+		return nil, false, fmt.Errorf("empty fragment")
+	}
+	switch frame[0] {
+	case fragWhole:
+		return frame[fragWholeHeaderSize:], true, nil
+	case fragPart:
+	default:
+		return nil, false, fmt.Errorf("unknown fragment kind %d", frame[0])
+	}
+
+	if len(frame) < fragPartHeaderSize {
+		return nil, false, fmt.Errorf("fragment too short: %d bytes", len(frame))
+	}
+	id := binary.BigEndian.Uint32(frame[1:5])
+	index := int(binary.BigEndian.Uint16(frame[5:7]))
+	total := int(binary.BigEndian.Uint16(frame[7:9]))
+	data := frame[fragPartHeaderSize:]
+	if total < 2 || total > maxFragments || index >= total {
+		return nil, false, fmt.Errorf("invalid fragment %d of %d", index, total)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg, ok := r.partial[id]
+	if !ok {
+		if r.partial == nil {
+			r.partial = make(map[uint32]*partialMessage)
+		}
+		if len(r.partial) >= maxPartialMessages {
+			r.evictOldestLocked()
+		}
+		msg = &partialMessage{parts: make([][]byte, total)}
+		r.partial[id] = msg
+	}
+	if len(msg.parts) != total {
+		r.dropLocked(id)
+		return nil, false, fmt.Errorf("fragment count changed from %d to %d", len(msg.parts), total)
+	}
+	if msg.parts[index] != nil {
+		return nil, false, fmt.Errorf("duplicate fragment %d of message %d", index, id)
+	}
+	// SECURITY: ограничиваем память, которую пир может занять недособранными
+	// сообщениями
+	if msg.size+len(data) > maxReassemblySize || r.size+len(data) > maxReassemblySize {
+		r.dropLocked(id)
+		return nil, false, errReassemblyLimit
+	}
+
+	msg.parts[index] = data
+	msg.received++
+	msg.size += len(data)
+	r.size += len(data)
+	if msg.received < total {
+		return nil, false, nil
+	}
+
+	r.dropLocked(id)
+	buf := make([]byte, 0, msg.size)
+	for _, part := range msg.parts {
+		buf = append(buf, part...)
+	}
+	return buf, true, nil
+}
+
+// dropLocked удаляет собираемое сообщение
+func (r *reassembler) dropLocked(id uint32) {
+	if msg, ok := r.partial[id]; ok {
+		r.size -= msg.size
+		delete(r.partial, id)
+	}
+}
+
+// evictOldestLocked удаляет сообщение с наименьшим ID - отправитель
+// нумерует сообщения по порядку
+func (r *reassembler) evictOldestLocked() {
+	var oldest uint32
+	first := true
+	for id := range r.partial {
+		// Сравнение с учетом переполнения счетчика
+		if first || int32(id-oldest) < 0 {
+			oldest, first = id, false
+		}
+	}
+	r.dropLocked(oldest)
+}
+
+// pending - число собираемых сообщений
+func (r *reassembler) pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.partial)
+}
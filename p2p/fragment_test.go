@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	mrand "math/rand/v2"
+	"testing"
+)
+
+func TestFragmentReassemble(t *testing.T) {
+	var p Peer
+	var r reassembler
+
+	// Маленькое сообщение уходит целиком
+	frames := p.fragment([]byte("hello"))
+	if len(frames) != 1 {
+		t.Fatalf("Expected one frame, got %d", len(frames))
+	}
+	if data, ok, err := r.add(frames[0]); err != nil || !ok || string(data) != "hello" {
+		t.Fatalf("Unexpected whole message: %q, %v, %v", data, ok, err)
+	}
+
+	// Два сообщения по 1 MB, фрагменты перемешаны между собой и внутри
+	// сообщения, как в неупорядоченных каналах
+	first := make([]byte, 1<<20)
+	second := make([]byte, 1<<20+1)
+	rand.Read(first)
+	rand.Read(second)
+	firstFrames, secondFrames := p.fragment(first), p.fragment(second)
+	for _, frame := range append(firstFrames, secondFrames...) {
+		if len(frame) > maxFragmentSize+fragPartHeaderSize {
+			t.Fatalf("Fragment too large: %d bytes", len(frame))
+		}
+	}
+	all := append(append([][]byte{}, firstFrames...), secondFrames...)
+	mrand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+
+	var got [][]byte
+	for _, frame := range all {
+		data, ok, err := r.add(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			got = append(got, data)
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(got))
+	}
+	if !bytes.Equal(got[0], first) && !bytes.Equal(got[0], second) ||
+		!bytes.Equal(got[1], first) && !bytes.Equal(got[1], second) ||
+		bytes.Equal(got[0], got[1]) {
+		t.Fatal("Reassembled messages differ from sent")
+	}
+	if r.pending() != 0 || r.size != 0 {
+		t.Fatalf("Expected empty reassembler, got %d messages, %d bytes", r.pending(), r.size)
+	}
+}
+
+func TestFragmentInvalid(t *testing.T) {
+	var p Peer
+	var r reassembler
+	frames := p.fragment(make([]byte, 3*maxFragmentSize))
+
+	if _, _, err := r.add(frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.add(frames[0]); err == nil {
+		t.Fatal("Expected error for duplicate fragment")
+	}
+
+	for name, frame := range map[string][]byte{
+		"Empty":   {},
+		"Kind":    {7, 1, 2, 3},
+		"Short":   frames[1][:fragPartHeaderSize-1],
+		"Index":   partHeader(1, 5, 5),
+		"Single":  partHeader(1, 0, 1),
+		"TooMany": partHeader(1, 0, maxFragments+1),
+		"Total":   partHeader(frameID(frames[1]), 1, 4),
+	} {
+		if _, _, err := r.add(frame); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+	// Фрагмент с другим числом частей сбрасывает сообщение
+	if r.pending() != 0 {
+		t.Fatalf("Expected message to be dropped, %d pending", r.pending())
+	}
+}
+
+// TestFragmentLimits проверяет, что недособранные сообщения не занимают
+// память без ограничений
+func TestFragmentLimits(t *testing.T) {
+	var r reassembler
+
+	// Новые сообщения вытесняют самые старые
+	for id := range uint32(maxPartialMessages + 4) {
+		if _, _, err := r.add(partHeader(id, 0, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.pending() != maxPartialMessages {
+		t.Fatalf("Expected %d pending messages, got %d", maxPartialMessages, r.pending())
+	}
+	if _, ok := r.partial[0]; ok {
+		t.Fatal("Expected oldest message to be evicted")
+	}
+
+	// Объем всех собираемых сообщений ограничен maxReassemblySize
+	r = reassembler{}
+	chunk := make([]byte, maxFragmentSize)
+	var err error
+	for i := 0; err == nil && i < maxFragments*2; i++ {
+		id := uint32(i / (maxFragments - 1))
+		_, _, err = r.add(append(partHeader(id, uint16(i%(maxFragments-1)), maxFragments), chunk...))
+	}
+	if !errors.Is(err, errReassemblyLimit) {
+		t.Fatalf("Expected errReassemblyLimit, got %v", err)
+	}
+	if r.size > maxReassemblySize {
+		t.Fatalf("Reassembly buffer exceeded limit: %d bytes", r.size)
+	}
+}
+
+func partHeader(id uint32, index, total uint16) []byte {
+	frame := []byte{fragPart}
+	frame = binary.BigEndian.AppendUint32(frame, id)
+	frame = binary.BigEndian.AppendUint16(frame, index)
+	return binary.BigEndian.AppendUint16(frame, total)
+}
+
+func frameID(frame []byte) uint32 {
+	return binary.BigEndian.Uint32(frame[1:5])
+}
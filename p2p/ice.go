@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// TURNServer - TURN сервер с учетными данными. Через него идет трафик,
+// когда прямое соединение невозможно (симметричный NAT с обеих сторон)
+type TURNServer struct {
+	URL        string // turn:host:port[?transport=udp|tcp] или turns:host:port
+	Username   string
+	Credential string
+}
+
+// buildICEServers проверяет адреса STUN и TURN серверов и собирает из них
+// конфигурацию ICE
+func buildICEServers(stunServers []string, turnServers []TURNServer) ([]webrtc.ICEServer, error) {
+	servers := []webrtc.ICEServer{}
+
+	for _, url := range stunServers {
+		uri, err := stun.ParseURI(url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid STUN server %q: %w", url, err)
+		}
+		if uri.Scheme != stun.SchemeTypeSTUN && uri.Scheme != stun.SchemeTypeSTUNS {
+			return nil, fmt.Errorf("invalid STUN server %q: expected stun: or stuns: scheme", url)
+		}
+	}
+	if len(stunServers) > 0 {
+		servers = append(servers, webrtc.ICEServer{URLs: stunServers})
+	}
+
+	for _, ts := range turnServers {
+		uri, err := stun.ParseURI(ts.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TURN server %q: %w", ts.URL, err)
+		}
+		if uri.Scheme != stun.SchemeTypeTURN && uri.Scheme != stun.SchemeTypeTURNS {
+			return nil, fmt.Errorf("invalid TURN server %q: expected turn: or turns: scheme", ts.URL)
+		}
+		if ts.Username == "" || ts.Credential == "" {
+			return nil, fmt.Errorf("TURN server %q: username and credential are required", ts.URL)
+		}
+		servers = append(servers, webrtc.ICEServer{
+			URLs:           []string{ts.URL},
+			Username:       ts.Username,
+			Credential:     ts.Credential,
+			CredentialType: webrtc.ICECredentialTypePassword,
+		})
+	}
+
+	return servers, nil
+}
+
+// logICEServers пишет в лог настроенные серверы без учетных данных
+func logICEServers(servers []webrtc.ICEServer) {
+	var stunURLs, turnURLs []string
+	for _, s := range servers {
+		if s.Username == "" {
+			stunURLs = append(stunURLs, s.URLs...)
+		} else {
+			turnURLs = append(turnURLs, s.URLs...)
+		}
+	}
+	slog.Info("Configured ICE servers", "stun", stunURLs, "turn", turnURLs)
+}
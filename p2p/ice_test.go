@@ -0,0 +1,60 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestBuildICEServers(t *testing.T) {
+	servers, err := buildICEServers(
+		[]string{"stun:stun.example.com:3478", "stun:stun2.example.com"},
+		[]TURNServer{
+			{URL: "turn:turn.example.com:3478?transport=tcp", Username: "alice", Credential: "secret"},
+			{URL: "turns:turn.example.com", Username: "bob", Credential: "hunter2"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 3 {
+		t.Fatalf("Expected 3 ICE servers, got %d", len(servers))
+	}
+	if len(servers[0].URLs) != 2 || servers[0].Username != "" {
+		t.Errorf("Unexpected STUN entry: %+v", servers[0])
+	}
+	turn := servers[1]
+	if len(turn.URLs) != 1 || turn.URLs[0] != "turn:turn.example.com:3478?transport=tcp" ||
+		turn.Username != "alice" || turn.Credential != "secret" ||
+		turn.CredentialType != webrtc.ICECredentialTypePassword {
+		t.Errorf("Unexpected TURN entry: %+v", turn)
+	}
+
+	// pion принимает собранную конфигурацию
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{ICEServers: servers})
+	if err != nil {
+		t.Fatalf("pion rejected ICE servers: %v", err)
+	}
+	pc.Close()
+
+	if servers, err := buildICEServers(nil, nil); err != nil || len(servers) != 0 {
+		t.Errorf("Expected no ICE servers, got %+v, %v", servers, err)
+	}
+
+	invalid := []struct {
+		name string
+		stun []string
+		turn []TURNServer
+	}{
+		{"bad stun scheme", []string{"http://stun.example.com"}, nil},
+		{"turn as stun", []string{"turn:turn.example.com"}, nil},
+		{"stun as turn", nil, []TURNServer{{URL: "stun:stun.example.com", Username: "u", Credential: "p"}}},
+		{"bad turn port", nil, []TURNServer{{URL: "turn:turn.example.com:port", Username: "u", Credential: "p"}}},
+		{"no credentials", nil, []TURNServer{{URL: "turn:turn.example.com"}}},
+	}
+	for _, tc := range invalid {
+		if _, err := buildICEServers(tc.stun, tc.turn); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
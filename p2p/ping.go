@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// pingMethod - встроенный RPC метод Ping, обработчик возвращает запрос
+const pingMethod = "p2p.ping"
+
+// pingPayloadSize - размер случайных данных запроса Ping
+const pingPayloadSize = 8
+
+// Ping отправляет пиру запрос и возвращает время до ответа (RTT). Запрос
+// идет тем же путем, что и данные: через DataChannel или relay, с
+// шифрованием. Пир без обработчика ping (ErrUnknownMethod) тоже отвечает,
+// и ответ учитывается. Без дедлайна у ctx ждет DefaultRPCTimeout
+func (c *Connector) Ping(ctx context.Context, peerID router.PeerID) (time.Duration, error) {
+	peer, ok := c.GetPeer(peerID)
+	if !ok {
+		return 0, fmt.Errorf("peer not found")
+	}
+
+	payload := make([]byte, pingPayloadSize)
+	rand.Read(payload)
+
+	start := time.Now()
+	reply, err := peer.Request(ctx, pingMethod, payload)
+	rtt := time.Since(start)
+	if errors.Is(err, ErrUnknownMethod) {
+		return rtt, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ping: %w", err)
+	}
+	if !bytes.Equal(reply, payload) {
+		return 0, fmt.Errorf("ping: unexpected reply")
+	}
+	return rtt, nil
+}
+
+// handlePing отвечает на Ping пира
+func handlePing(ctx context.Context, peer *Peer, payload []byte) ([]byte, error) {
+	return payload, nil
+}
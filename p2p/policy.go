@@ -0,0 +1,192 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// Политика входящих соединений: кто может подключиться к нам по offer или
+// relay. Соединения, которые начали мы сами (ConnectContext, встречный
+// offer при одновременном подключении, автоподключение), принимаются в
+// любом режиме, черный список действует во всех режимах.
+//
+//   - ConnectionOpen - принимаются все (по умолчанию)
+//   - ConnectionContactsOnly - только пиры, для которых IsContact вернул
+//     true, остальные offer'ы молча отбрасываются
+//   - ConnectionManual - контакты принимаются сразу, для остальных
+//     отправляется EventConnectionRequest и offer ждет Approve или Reject
+//     не дольше connectionRequestTimeout
+//
+// Approve запоминает пира до Reject или перезапуска: повторные попытки
+// одобренного пира, в том числе relay, принимаются без подтверждения
+
+// ConnectionMode - режим политики входящих соединений
+type ConnectionMode uint8
+
+const (
+	ConnectionOpen ConnectionMode = iota
+	ConnectionContactsOnly
+	ConnectionManual
+)
+
+const (
+	// connectionRequestTimeout - сколько offer ждет решения. Меньше
+	// DefaultICEConnectionTimeout, чтобы инициатор еще ждал answer
+	connectionRequestTimeout = 25 * time.Second
+
+	// maxConnectionRequests - сколько запросов ждут решения одновременно
+	maxConnectionRequests = 16
+)
+
+var connectionModeNames = map[ConnectionMode]string{
+	ConnectionOpen:         "open",
+	ConnectionContactsOnly: "contacts",
+	ConnectionManual:       "manual",
+}
+
+func (m ConnectionMode) String() string {
+	if name, ok := connectionModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("ConnectionMode(%d)", m)
+}
+
+// ParseConnectionMode разбирает имя режима: open, contacts или manual
+func ParseConnectionMode(s string) (ConnectionMode, error) {
+	for mode, name := range connectionModeNames {
+		if name == s {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown connection mode %q (expected open, contacts or manual)", s)
+}
+
+// ConnectionPolicy - политика входящих соединений
+type ConnectionPolicy struct {
+	Mode ConnectionMode
+	// IsContact сообщает, что пир известен и его соединения принимаются
+	// без подтверждения. nil = известных пиров нет
+	IsContact func(router.PeerID) bool
+}
+
+// connectionRequest - входящий offer, ждущий решения приложения
+type connectionRequest struct {
+	decision chan bool // буфер 1, true - Approve
+}
+
+// SetConnectionPolicy задает политику входящих соединений. Действует на
+// новые offer'ы, установленные соединения не закрываются
+func (c *Connector) SetConnectionPolicy(policy ConnectionPolicy) {
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	c.policy = policy
+	slog.Info("Connection policy changed", "mode", policy.Mode.String())
+}
+
+// ConnectionPolicy возвращает текущую политику входящих соединений
+func (c *Connector) ConnectionPolicy() ConnectionPolicy {
+	c.policyMu.RLock()
+	defer c.policyMu.RUnlock()
+	return c.policy
+}
+
+// Approve разрешает соединения пира в режиме ConnectionManual и принимает
+// его offer, ждущий решения
+func (c *Connector) Approve(peerID router.PeerID) {
+	c.approved.Store(peerID, struct{}{})
+	c.decideRequest(peerID, true)
+}
+
+// Reject отклоняет offer пира, ждущий решения, и отменяет прежнее Approve
+func (c *Connector) Reject(peerID router.PeerID) {
+	c.approved.Delete(peerID)
+	c.decideRequest(peerID, false)
+}
+
+// decideRequest передает решение offer'у пира, если он ждет
+func (c *Connector) decideRequest(peerID router.PeerID, approve bool) {
+	c.requestsMu.Lock()
+	req, ok := c.requests[peerID]
+	delete(c.requests, peerID)
+	c.requestsMu.Unlock()
+	if ok {
+		req.decision <- approve
+	}
+}
+
+// allowIncoming сообщает, можно ли принять соединение пира без
+// подтверждения
+func (c *Connector) allowIncoming(peerID router.PeerID) bool {
+	policy := c.ConnectionPolicy()
+	if policy.Mode == ConnectionOpen {
+		return true
+	}
+	if policy.IsContact != nil && policy.IsContact(peerID) {
+		return true
+	}
+	// Мы сами подключаемся к пиру
+	if _, ok := c.connecting.Load(peerID); ok {
+		return true
+	}
+	if policy.Mode == ConnectionManual {
+		_, ok := c.approved.Load(peerID)
+		return ok
+	}
+	return false
+}
+
+// admitOffer применяет политику к входящему offer. В режиме
+// ConnectionManual ждет решения приложения
+func (c *Connector) admitOffer(peerID router.PeerID) bool {
+	hexID := hex.EncodeToString(peerID[:8])
+
+	if c.allowIncoming(peerID) {
+		return true
+	}
+	if c.ConnectionPolicy().Mode != ConnectionManual {
+		slog.Debug("Dropping offer from unknown peer", "peerID", hexID+"...")
+		return false
+	}
+
+	req := &connectionRequest{decision: make(chan bool, 1)}
+	c.requestsMu.Lock()
+	// SECURITY: незнакомые пиры не могут накопить неограниченно запросов
+	if _, ok := c.requests[peerID]; ok || len(c.requests) >= maxConnectionRequests {
+		c.requestsMu.Unlock()
+		slog.Debug("Dropping offer: connection request already pending or too many requests", "peerID", hexID+"...")
+		return false
+	}
+	if c.requests == nil {
+		c.requests = make(map[router.PeerID]*connectionRequest)
+	}
+	c.requests[peerID] = req
+	c.requestsMu.Unlock()
+
+	slog.Info("Waiting for connection approval", "peerID", hexID+"...")
+	c.emit(Event{
+		Type:   EventConnectionRequest,
+		PeerID: peerID,
+	})
+
+	timer := time.NewTimer(connectionRequestTimeout)
+	defer timer.Stop()
+	select {
+	case approved := <-req.decision:
+		slog.Info("Connection request decided", "peerID", hexID+"...", "approved", approved)
+		return approved
+	case <-timer.C:
+		slog.Info("Connection request expired", "peerID", hexID+"...")
+	case <-c.done:
+	}
+
+	c.requestsMu.Lock()
+	if c.requests[peerID] == req {
+		delete(c.requests, peerID)
+	}
+	c.requestsMu.Unlock()
+	return false
+}
@@ -0,0 +1,157 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+func TestConnectionPolicy(t *testing.T) {
+	c := &Connector{
+		done:   make(chan struct{}),
+		events: make(chan Event, maxConnectionRequests+1),
+		queue:  eventQueue{ready: make(chan struct{}, 1)},
+	}
+	go c.pumpEvents()
+	contact, stranger := router.PeerID{1}, router.PeerID{2}
+	isContact := func(peerID router.PeerID) bool { return peerID == contact }
+
+	// По умолчанию принимаются все
+	if !c.admitOffer(stranger) {
+		t.Fatal("Open policy must accept strangers")
+	}
+
+	c.SetConnectionPolicy(ConnectionPolicy{Mode: ConnectionContactsOnly, IsContact: isContact})
+	if !c.admitOffer(contact) {
+		t.Fatal("Contact must be accepted")
+	}
+	if c.admitOffer(stranger) {
+		t.Fatal("Stranger must be dropped")
+	}
+	// Встречный offer пира, к которому подключаемся мы
+	c.connecting.Store(stranger, newConnectWaiter())
+	if !c.admitOffer(stranger) {
+		t.Fatal("Offer of a peer we connect to must be accepted")
+	}
+	c.connecting.Delete(stranger)
+	if len(c.events) != 0 {
+		t.Fatalf("Expected no events, got %d", len(c.events))
+	}
+
+	// Ручной режим ждет решения
+	c.SetConnectionPolicy(ConnectionPolicy{Mode: ConnectionManual, IsContact: isContact})
+	if !c.admitOffer(contact) {
+		t.Fatal("Contact must be accepted without approval")
+	}
+	decide := func(approve bool) bool {
+		t.Helper()
+		result := make(chan bool, 1)
+		go func() { result <- c.admitOffer(stranger) }()
+		select {
+		case event := <-c.events:
+			if event.Type != EventConnectionRequest || event.PeerID != stranger {
+				t.Fatalf("Unexpected event: %+v", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for EventConnectionRequest")
+		}
+		if approve {
+			c.Approve(stranger)
+		} else {
+			c.Reject(stranger)
+		}
+		select {
+		case ok := <-result:
+			return ok
+		case <-time.After(time.Second):
+			t.Fatal("Offer still waits after decision")
+			return false
+		}
+	}
+	if decide(false) {
+		t.Fatal("Rejected offer must be dropped")
+	}
+	if !decide(true) {
+		t.Fatal("Approved offer must be accepted")
+	}
+	// Одобренный пир больше не спрашивается, relay тоже принимается
+	if !c.admitOffer(stranger) || !c.allowIncoming(stranger) {
+		t.Fatal("Approved peer must be accepted without a new request")
+	}
+	c.Reject(stranger)
+	if c.allowIncoming(stranger) {
+		t.Fatal("Reject must revoke approval")
+	}
+
+	// Число ожидающих запросов ограничено
+	for i := range maxConnectionRequests {
+		go c.admitOffer(router.PeerID{100, byte(i)})
+	}
+	for range maxConnectionRequests {
+		<-c.events
+	}
+	if c.admitOffer(router.PeerID{99}) {
+		t.Fatal("Offer above the request limit must be dropped")
+	}
+	if len(c.events) != 0 {
+		t.Fatal("Expected no request above the limit")
+	}
+	close(c.done)
+}
+
+func TestParseConnectionMode(t *testing.T) {
+	for _, mode := range []ConnectionMode{ConnectionOpen, ConnectionContactsOnly, ConnectionManual} {
+		parsed, err := ParseConnectionMode(mode.String())
+		if err != nil || parsed != mode {
+			t.Fatalf("Round trip of %v: %v, %v", mode, parsed, err)
+		}
+	}
+	if _, err := ParseConnectionMode("friends"); err == nil {
+		t.Fatal("Expected error for unknown mode")
+	}
+}
+
+func TestBlacklist(t *testing.T) {
+	pubKey, privKey, _ := ed25519.GenerateKey(nil)
+	blocked, stranger := router.PeerID{1}, router.PeerID{2}
+
+	type change struct {
+		peerID  router.PeerID
+		blocked bool
+	}
+	var changes []change
+	c, err := NewConnector(router.NewClient(pubKey, privKey), ConnectorConfig{
+		Blacklist: []router.PeerID{blocked},
+		BlacklistChanged: func(peerID router.PeerID, blocked bool) {
+			changes = append(changes, change{peerID, blocked})
+		},
+	}, nil, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Начальный черный список не считается изменением
+	if !c.IsBlacklisted(blocked) || c.IsBlacklisted(stranger) {
+		t.Fatalf("Unexpected initial blacklist: %v", c.GetBlacklist())
+	}
+	if len(changes) != 0 {
+		t.Fatalf("Unexpected changes: %v", changes)
+	}
+
+	// Повторные вызовы ничего не меняют и не сообщаются
+	c.AddToBlacklist(stranger)
+	c.AddToBlacklist(stranger)
+	c.RemoveFromBlacklist(blocked)
+	c.RemoveFromBlacklist(blocked)
+	want := []change{{stranger, true}, {blocked, false}}
+	if !slices.Equal(changes, want) {
+		t.Fatalf("Expected changes %v, got %v", want, changes)
+	}
+	if !c.IsBlacklisted(stranger) || c.IsBlacklisted(blocked) {
+		t.Fatalf("Unexpected blacklist: %v", c.GetBlacklist())
+	}
+}
@@ -0,0 +1,399 @@
+package p2p
+
+import (
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// Relay - запасной транспорт, когда WebRTC не смог установить прямое
+// соединение (например, симметричный NAT с обеих сторон). Кадры идут через
+// router в том же конверте, что и сигнализация: подписанный EncryptedMessage
+// (см. envelope.go), поэтому router видит только шифротекст.
+//
+// Протокол:
+//   - инициатор, у которого ICE перешел в failed, отправляет "open"
+//   - принимающая сторона заменяет неудавшееся WebRTC соединение relay-пиром
+//     и отправляет EventConnectedRelay
+//   - данные идут кадрами "data", "close" закрывает relay с любой стороны,
+//     в Data - причина закрытия (см. bye.go)
+//
+// Сеансовые ключи (см. session.go) дают relay ту же forward secrecy, что и
+// DataChannel. Инициатор отмечает в "open" флаг session и, зарегистрировав
+// relay-пира, отправляет handshake кадром "session". Этим же кадром идут
+// ответ на handshake, смена ключей и данные, зашифрованные сеансовым
+// ключом, с номером сообщения против повторов (см. replay.go). Пир прежней
+// версии флаг игнорирует и на handshake не отвечает: через relaySessionWait
+// отправка переходит на кадры "data". После обмена ключами кадры "data"
+// отклоняются, чтобы router не мог повторить перехваченные ранее
+
+var ErrICEFailed = errors.New("ICE connection failed")
+
+// relayFrameType отличает relay-кадры от SDP в handleIncoming
+const relayFrameType = "relay"
+
+type relayOp string
+
+const (
+	relayOpOpen    relayOp = "open"
+	relayOpData    relayOp = "data"
+	relayOpSession relayOp = "session"
+	relayOpClose   relayOp = "close"
+)
+
+// relaySessionWait - сколько отправка ждет сеансовых ключей, прежде чем
+// считать пира прежней версией
+const relaySessionWait = 3 * time.Second
+
+// relayFrame - кадр relay-соединения, заменяет сообщение DataChannel
+type relayFrame struct {
+	Type string  `json:"type"` // всегда relayFrameType
+	Op   relayOp `json:"op"`
+	Data []byte  `json:"data,omitempty"`
+
+	// Channel - метка канала данных. Пир прежней версии ее не отправляет,
+	// такие данные считаются пришедшими по DataChannelLabel
+	Channel string `json:"channel,omitempty"`
+
+	// Session в "open" сообщает, что инициатор поддерживает сеансовые ключи
+	Session bool `json:"session,omitempty"`
+}
+
+// parseRelayFrame возвращает кадр, если расшифрованный payload - relay-кадр, а не SDP
+func parseRelayFrame(payload []byte) (relayFrame, bool) {
+	var frame relayFrame
+	if err := json.Unmarshal(payload, &frame); err != nil || frame.Type != relayFrameType {
+		return relayFrame{}, false
+	}
+	return frame, true
+}
+
+// newRelayPeer создает relay-пира. С withSession данные шифруются
+// сеансовыми ключами, как в DataChannel
+func newRelayPeer(id router.PeerID, c *Connector, withSession bool) *Peer {
+	peer := &Peer{
+		ID:        id,
+		relay:     true,
+		connector: c,
+	}
+	if withSession {
+		peer.session = newSession(c.LocalID(), id, c.edPrivKey, c.rekeyMessages, c.rekeyInterval)
+	}
+	return peer
+}
+
+// sendRelayFrame отправляет кадр через router.
+// Возвращает ошибку, если router не подтвердил доставку
+func (c *Connector) sendRelayFrame(peerID router.PeerID, frame relayFrame) error {
+	frame.Type = relayFrameType
+	frameJSON, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("marshal relay frame: %w", err)
+	}
+	if err := c.sendSignal(peerID, frameJSON); err != nil {
+		return fmt.Errorf("relay frame: %w", err)
+	}
+	return nil
+}
+
+// fallbackToRelay открывает relay после неудачного WebRTC соединения.
+// Если relay тоже не удался, отправляет EventConnectionFailed с исходной причиной
+func (c *Connector) fallbackToRelay(peerID router.PeerID, cause error) {
+	hexID := hex.EncodeToString(peerID[:8])
+	slog.Info("WebRTC connection failed, falling back to relay", "peerID", hexID+"...", "cause", cause)
+
+	if !c.reservePeerSlot(peerID) {
+		c.emit(Event{
+			Type:   EventConnectionFailed,
+			PeerID: peerID,
+			Error:  ErrMaxPeersReached,
+		})
+		return
+	}
+	defer c.releasePeerSlot(peerID)
+
+	if err := c.sendRelayFrame(peerID, relayFrame{Op: relayOpOpen, Session: true}); err != nil {
+		slog.Warn("Relay fallback failed", "peerID", hexID+"...", "error", err)
+		c.emit(Event{
+			Type:   EventConnectionFailed,
+			PeerID: peerID,
+			Error:  fmt.Errorf("%w (relay fallback: %v)", cause, err),
+		})
+		return
+	}
+
+	peer := newRelayPeer(peerID, c, true)
+	if _, loaded := c.peers.LoadOrStore(peerID, peer); loaded {
+		// Пока открывали relay, пир успел подключиться сам
+		slog.Debug("Peer connected while opening relay", "peerID", hexID+"...")
+		return
+	}
+
+	// Handshake отправляется после регистрации пира, чтобы ответ на него
+	// не пришел раньше
+	if handshake, err := peer.session.start(); err != nil {
+		slog.Warn("Failed to start relay session", "peerID", hexID+"...", "error", err)
+	} else if err := c.sendRelayFrame(peerID, relayFrame{Op: relayOpSession, Data: handshake}); err != nil {
+		slog.Warn("Failed to send relay session handshake", "peerID", hexID+"...", "error", err)
+	}
+
+	slog.Info("Relay connection established", "peerID", hexID+"...")
+	c.emit(Event{
+		Type:   EventConnectedRelay,
+		PeerID: peerID,
+		Peer:   peer,
+	})
+}
+
+// handleRelayFrame обрабатывает relay-кадр, полученный через router
+func (c *Connector) handleRelayFrame(peerID router.PeerID, frame relayFrame) {
+	hexID := hex.EncodeToString(peerID[:8])
+
+	switch frame.Op {
+	case relayOpOpen:
+		c.acceptRelay(peerID, frame.Session)
+
+	case relayOpData:
+		val, ok := c.peers.Load(peerID)
+		if !ok || !val.(*Peer).relay {
+			slog.Debug("Dropping relay frame without relay connection", "peerID", hexID+"...")
+			return
+		}
+		peer := val.(*Peer)
+		if peer.session != nil && peer.session.isReady() {
+			// SECURITY: после обмена ключами данные без них - повтор или подмена
+			slog.Warn("Dropping relay data without session key", "peerID", hexID+"...")
+			return
+		}
+		c.receiveRelayData(peer, frame.Channel, frame.Data)
+
+	case relayOpSession:
+		val, ok := c.peers.Load(peerID)
+		if !ok || !val.(*Peer).relay || val.(*Peer).session == nil {
+			slog.Debug("Dropping relay session frame without relay session", "peerID", hexID+"...")
+			return
+		}
+		c.handleRelaySession(val.(*Peer), frame.Channel, frame.Data)
+
+	case relayOpClose:
+		val, ok := c.peers.Load(peerID)
+		if ok && val.(*Peer).relay && c.peers.CompareAndDelete(peerID, val) {
+			reason := parseDisconnectReason(frame.Data)
+			slog.Info("Relay connection closed by peer", "peerID", hexID+"...", "reason", reason)
+			val.(*Peer).rpc.close()
+			c.emit(Event{
+				Type:   EventDisconnected,
+				PeerID: peerID,
+				Reason: reason,
+			})
+		}
+
+	default:
+		c.emit(Event{
+			Type:   EventError,
+			PeerID: peerID,
+			Error:  fmt.Errorf("unexpected relay op: %q", frame.Op),
+		})
+	}
+}
+
+// handleRelaySession обрабатывает кадр сеанса relay-пира: handshake или данные
+func (c *Connector) handleRelaySession(peer *Peer, channel string, frame []byte) {
+	hexID := hex.EncodeToString(peer.ID[:8])
+
+	data, reply, err := c.decryptDataChannelMessage(peer, frame)
+	if reply != nil {
+		c.spawn(func() {
+			if err := c.sendRelayFrame(peer.ID, relayFrame{Op: relayOpSession, Data: reply}); err != nil {
+				slog.Warn("Failed to send relay session reply", "peerID", hexID+"...", "error", err)
+			}
+		})
+	}
+	if errors.Is(err, errReplayedMessage) || errors.Is(err, errMessageTooOld) {
+		slog.Warn("Dropping replayed relay message", "peerID", hexID+"...", "error", err)
+		return
+	}
+	if err != nil {
+		slog.Warn("Failed to decrypt relay message", "peerID", hexID+"...", "error", err)
+		c.emit(Event{
+			Type:   EventError,
+			PeerID: peer.ID,
+			Error:  fmt.Errorf("relay session: %w", err),
+		})
+		return
+	}
+	if data == nil {
+		return
+	}
+	msgType, data, err := peer.splitType(data)
+	if err != nil {
+		slog.Warn("Dropping relay message of unknown type", "peerID", hexID+"...", "error", err)
+		c.emit(Event{
+			Type:   EventError,
+			PeerID: peer.ID,
+			Error:  fmt.Errorf("relay message type: %w", err),
+		})
+		return
+	}
+	if msgType == msgRPC {
+		c.handleRPC(peer, data)
+		return
+	}
+	// Relay-пир прощается кадром "close"
+	if msgType == msgBye {
+		return
+	}
+	c.receiveRelayData(peer, channel, data)
+}
+
+// receiveRelayData передает приложению данные relay-пира
+func (c *Connector) receiveRelayData(peer *Peer, channel string, data []byte) {
+	peer.relayStats.bytesReceived.Add(uint64(len(data)))
+	peer.relayStats.packetsReceived.Add(1)
+	c.emit(Event{
+		Type:    EventDataReceived,
+		PeerID:  peer.ID,
+		Peer:    peer,
+		Data:    data,
+		Channel: cmp.Or(channel, DataChannelLabel),
+	})
+}
+
+// acceptRelay регистрирует relay-пира по запросу удаленной стороны.
+// withSession - инициатор поддерживает сеансовые ключи и начнет handshake.
+// Неудавшееся WebRTC соединение с этим пиром закрывается без EventDisconnected
+func (c *Connector) acceptRelay(peerID router.PeerID, withSession bool) {
+	hexID := hex.EncodeToString(peerID[:8])
+
+	if c.IsBlacklisted(peerID) {
+		return
+	}
+	// Relay открывается после неудачного offer'а, который уже прошел
+	// политику, поэтому подтверждения здесь не ждем
+	if !c.allowIncoming(peerID) {
+		slog.Debug("Dropping relay from peer not allowed by connection policy", "peerID", hexID+"...")
+		return
+	}
+	// SECURITY: open ведет себя как offer и ограничивается тем же лимитом
+	if !c.checkOfferRateLimit(peerID) {
+		slog.Warn("Rejecting relay due to rate limit", "peerID", hexID+"...")
+		return
+	}
+	if !c.reservePeerSlot(peerID) {
+		slog.Warn("Max peers reached, rejecting relay", "peerID", hexID+"...", "maxPeers", c.maxPeers)
+		c.emit(Event{
+			Type:   EventConnectionFailed,
+			PeerID: peerID,
+			Error:  ErrMaxPeersReached,
+		})
+		return
+	}
+	defer c.releasePeerSlot(peerID)
+
+	peer := newRelayPeer(peerID, c, withSession)
+	if old, loaded := c.peers.Swap(peerID, peer); loaded {
+		oldPeer := old.(*Peer)
+		if !oldPeer.relay {
+			oldPeer.supersede()
+			oldPeer.close()
+		}
+	}
+
+	slog.Info("Accepted relay connection", "peerID", hexID+"...")
+	c.emit(Event{
+		Type:   EventConnectedRelay,
+		PeerID: peerID,
+		Peer:   peer,
+	})
+}
+
+// sendRelay отправляет данные relay-пиру. Метка канала передается
+// получателю, но через router все каналы идут одним упорядоченным потоком
+func (p *Peer) sendRelay(channel string, msgType byte, data []byte) error {
+	if !p.connector.hasDataChannel(channel) {
+		return fmt.Errorf("%w: %q", ErrChannelNotFound, channel)
+	}
+
+	hexID := hex.EncodeToString(p.ID[:8])
+	slog.Debug("Sending data via relay",
+		"peerID", hexID+"...",
+		"label", channel,
+		"bytes", len(data))
+
+	frame := relayFrame{Op: relayOpData, Data: data, Channel: channel}
+	if p.relaySessionReady() {
+		p.mu.Lock()
+		encrypted, rekey, err := p.connector.encryptDataChannelMessage(p, p.withType(msgType, data))
+		p.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("encrypt relay data: %w", err)
+		}
+		if rekey != nil {
+			slog.Debug("Rekeying relay session", "peerID", hexID+"...")
+			if err := p.connector.sendRelayFrame(p.ID, relayFrame{Op: relayOpSession, Data: rekey}); err != nil {
+				slog.Warn("Failed to send relay session rekey", "peerID", hexID+"...", "error", err)
+			}
+		}
+		frame = relayFrame{Op: relayOpSession, Data: encrypted, Channel: channel}
+	}
+
+	if err := p.connector.sendRelayFrame(p.ID, frame); err != nil {
+		return err
+	}
+	p.relayStats.bytesSent.Add(uint64(len(data)))
+	p.relayStats.packetsSent.Add(1)
+	return nil
+}
+
+// relaySessionReady сообщает, шифровать ли данные relay-пира сеансовым
+// ключом. Ключей пира прежней версии ждет только первая отправка
+func (p *Peer) relaySessionReady() bool {
+	if p.session == nil {
+		return false
+	}
+	if p.session.isReady() {
+		return true
+	}
+	if p.relayLegacy.Load() {
+		return false
+	}
+
+	select {
+	case <-p.session.ready:
+		return true
+	case <-time.After(relaySessionWait):
+	case <-p.connector.done:
+		return false
+	}
+	slog.Warn("Peer did not answer relay session handshake, sending without session keys",
+		"peerID", hex.EncodeToString(p.ID[:8])+"...")
+	p.relayLegacy.Store(true)
+	return false
+}
+
+// closeRelay закрывает relay и уведомляет об этом пира
+func (p *Peer) closeRelay(reason DisconnectReason) error {
+	p.connector.peers.CompareAndDelete(p.ID, p)
+	p.rpc.close()
+	p.connector.emit(Event{
+		Type:   EventDisconnected,
+		PeerID: p.ID,
+	})
+	return p.connector.sendRelayFrame(p.ID, relayFrame{Op: relayOpClose, Data: []byte(reason)})
+}
+
+// hasDataChannel проверяет, что канал с меткой label есть в конфигурации
+func (c *Connector) hasDataChannel(label string) bool {
+	for _, ch := range c.dataChannels {
+		if ch.Label == label {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Защита DataChannel от повторов: перед шифрованием к данным добавляется
+// номер сообщения пира (8 байт, big endian), начиная с 1. Номер внутри
+// открытого текста, поэтому подделать его без сеансового ключа нельзя.
+// Получатель принимает каждый номер один раз. Номера общие для всех
+// каналов пира, а сообщения разных (или неупорядоченных) каналов могут
+// обгонять друг друга, поэтому принимаются и номера меньше последнего,
+// если они попадают в окно replayWindowSize (как в IPsec, RFC 4303)
+//
+//   - сообщение: Seq(8) + данные
+//
+// Handshake и подтверждения смены ключей номеров не несут: повтор первого
+// отклоняется как устаревшая эпоха, второе не содержит данных
+
+const (
+	seqSize = 8
+
+	// replayWindowSize - сколько номеров до последнего принятого
+	// отслеживается. Более старые сообщения отбрасываются
+	replayWindowSize = 4096
+)
+
+var errReplayedMessage = errors.New("replayed message")
+var errMessageTooOld = errors.New("message outside replay window")
+
+// replayWindow - принятые номера сообщений пира
+type replayWindow struct {
+	mu     sync.Mutex
+	last   uint64                        // наибольший принятый номер
+	bitmap [replayWindowSize / 64]uint64 // бит номера last-i - принят ли он
+}
+
+// check принимает номер seq, если он еще не встречался и не старше окна
+func (w *replayWindow) check(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if seq == 0 {
+		return fmt.Errorf("invalid sequence number 0")
+	}
+	if seq > w.last {
+		w.shiftLocked(seq - w.last)
+		w.last = seq
+		w.bitmap[0] |= 1
+		return nil
+	}
+
+	diff := w.last - seq
+	if diff >= replayWindowSize {
+		return errMessageTooOld
+	}
+	word, bit := diff/64, diff%64
+	if w.bitmap[word]&(1<<bit) != 0 {
+		return errReplayedMessage
+	}
+	w.bitmap[word] |= 1 << bit
+	return nil
+}
+
+// shiftLocked сдвигает окно на n номеров вперед
+func (w *replayWindow) shiftLocked(n uint64) {
+	if n >= replayWindowSize {
+		clear(w.bitmap[:])
+		return
+	}
+	words, bits := int(n/64), n%64
+	for i := len(w.bitmap) - 1; i >= 0; i-- {
+		var v uint64
+		if j := i - words; j >= 0 {
+			v = w.bitmap[j] << bits
+			if bits > 0 && j > 0 {
+				v |= w.bitmap[j-1] >> (64 - bits)
+			}
+		}
+		w.bitmap[i] = v
+	}
+}
+
+// appendSeq добавляет номер сообщения перед данными
+func appendSeq(seq uint64, data []byte) []byte {
+	buf := make([]byte, 0, seqSize+len(data))
+	buf = binary.BigEndian.AppendUint64(buf, seq)
+	return append(buf, data...)
+}
+
+// splitSeq отделяет номер сообщения от данных
+func splitSeq(data []byte) (uint64, []byte, error) {
+	if len(data) < seqSize {
+		return 0, nil, fmt.Errorf("message too short for sequence number: %d bytes", len(data))
+	}
+	return binary.BigEndian.Uint64(data[:seqSize]), data[seqSize:], nil
+}
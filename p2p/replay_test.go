@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+
+	if err := w.check(0); err == nil {
+		t.Fatal("Expected error for sequence 0")
+	}
+
+	// Переупорядоченные номера принимаются по одному разу
+	for _, seq := range []uint64{1, 3, 2, 70, 5, 4, 200} {
+		if err := w.check(seq); err != nil {
+			t.Fatalf("Sequence %d: %v", seq, err)
+		}
+	}
+	for _, seq := range []uint64{1, 2, 3, 4, 5, 70, 200} {
+		if err := w.check(seq); !errors.Is(err, errReplayedMessage) {
+			t.Fatalf("Expected duplicate %d to be rejected, got %v", seq, err)
+		}
+	}
+	// Пропущенный номер внутри окна еще можно принять
+	if err := w.check(69); err != nil {
+		t.Fatalf("Expected sequence 69 in window, got %v", err)
+	}
+
+	// Сдвиг окна дальше его размера забывает все номера
+	last := uint64(200 + replayWindowSize)
+	if err := w.check(last); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.check(200); !errors.Is(err, errMessageTooOld) {
+		t.Fatalf("Expected sequence 200 outside window, got %v", err)
+	}
+	if err := w.check(last - replayWindowSize + 1); err != nil {
+		t.Fatalf("Expected oldest sequence in window, got %v", err)
+	}
+	if err := w.check(last - 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.check(last - 100); !errors.Is(err, errReplayedMessage) {
+		t.Fatalf("Expected duplicate, got %v", err)
+	}
+}
+
+// TestDataChannelReplay проверяет, что повтор зашифрованного кадра
+// отбрасывается, а переупорядоченные кадры доходят
+func TestDataChannelReplay(t *testing.T) {
+	a, b := newSessionPair(t, 0)
+	handshake(t, a, b)
+	var c Connector
+	peerA := &Peer{session: a}
+	peerB := &Peer{session: b}
+
+	var frames [][]byte
+	for _, msg := range []string{"first", "second", ""} {
+		frame, _, err := c.encryptDataChannelMessage(peerA, []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+
+	receive := func(frame []byte) ([]byte, error) {
+		t.Helper()
+		data, reply, err := c.decryptDataChannelMessage(peerB, frame)
+		if reply != nil {
+			t.Fatal("Unexpected handshake reply")
+		}
+		return data, err
+	}
+
+	// Кадры в обратном порядке, как в неупорядоченном канале
+	if data, err := receive(frames[1]); err != nil || string(data) != "second" {
+		t.Fatalf("Expected second message, got %q, %v", data, err)
+	}
+	if data, err := receive(frames[0]); err != nil || string(data) != "first" {
+		t.Fatalf("Expected first message, got %q, %v", data, err)
+	}
+	// Пустое сообщение приложения не путается с подтверждением эпохи
+	if data, err := receive(frames[2]); err != nil || data == nil || len(data) != 0 {
+		t.Fatalf("Expected empty message, got %q, %v", data, err)
+	}
+
+	for i, frame := range frames {
+		if _, err := receive(frame); !errors.Is(err, errReplayedMessage) {
+			t.Fatalf("Expected replay of frame %d to be rejected, got %v", i, err)
+		}
+	}
+}
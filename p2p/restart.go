@@ -0,0 +1,329 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ICE restart: при смене сети (Wi-Fi -> LTE, новый адрес) установленное
+// соединение переходит в disconnected, хотя оба пира на месте. Вместо
+// EventDisconnected коннектор отправляет EventReconnecting и повторяет
+// offer с новыми ICE учетными данными по той же сигнализации, что и при
+// подключении. DTLS и SCTP переживают restart, DataChannel'ы не
+// пересоздаются.
+//
+//   - попыток не больше maxICERestarts, каждая ждет восстановления
+//     iceRestartTimeout
+//   - восстановленное соединение снова отправляет EventConnected, после
+//     последней неудачной попытки соединение закрывается с EventDisconnected
+//   - offer отправляет пир с меньшим ID - тот, чей offer побеждает при
+//     одновременном подключении. Пир с большим ID только просит о restart
+//     кадром "ice_restart", поэтому встречных restart offer'ов не бывает
+
+const (
+	maxICERestarts    = 3
+	iceRestartTimeout = 10 * time.Second
+)
+
+var errNegotiationInProgress = errors.New("negotiation already in progress")
+
+// restartFrameType отличает просьбу о restart от SDP в handleIncoming
+const restartFrameType = "ice_restart"
+
+// restartFrame - просьба пира с большим ID начать ICE restart
+type restartFrame struct {
+	Type string `json:"type"` // всегда restartFrameType
+}
+
+// isRestartFrame сообщает, что расшифрованный payload - просьба о restart
+func isRestartFrame(payload []byte) bool {
+	var frame restartFrame
+	return json.Unmarshal(payload, &frame) == nil && frame.Type == restartFrameType
+}
+
+// restartOffer - offer ICE restart. Флаг отличает его от offer нового
+// соединения: перезапущенный пир присылает обычный offer, и его нельзя
+// применять к старому PeerConnection
+type restartOffer struct {
+	webrtc.SessionDescription
+	ICERestart bool `json:"ice_restart"`
+}
+
+// parseRestartOffer возвращает offer, если payload - offer ICE restart
+func parseRestartOffer(payload []byte) (webrtc.SessionDescription, bool) {
+	var offer restartOffer
+	if err := json.Unmarshal(payload, &offer); err != nil || !offer.ICERestart {
+		return webrtc.SessionDescription{}, false
+	}
+	return offer.SessionDescription, true
+}
+
+// Reconnecting сообщает, что соединение прервалось и идет ICE restart
+func (p *Peer) Reconnecting() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.restarting
+}
+
+// beginICERestart запускает ICE restart прервавшегося соединения.
+// Возвращает false, если соединение нужно закрывать: оно ни разу не
+// устанавливалось, заменено relay-пиром или коннектор закрывается
+func (c *Connector) beginICERestart(peer *Peer) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	peer.mu.Lock()
+	if peer.restarting {
+		// Failed во время restart'а: попытками управляет restartICE
+		peer.mu.Unlock()
+		return true
+	}
+	if !peer.connected || peer.superseded {
+		peer.mu.Unlock()
+		return false
+	}
+	peer.restarting = true
+	reconnected := make(chan struct{})
+	peer.reconnected = reconnected
+	peer.mu.Unlock()
+
+	slog.Info("Connection interrupted, restarting ICE", "peerID", hex.EncodeToString(peer.ID[:8])+"...")
+	c.emit(Event{
+		Type:   EventReconnecting,
+		PeerID: peer.ID,
+		Peer:   peer,
+	})
+	c.spawn(func() { c.restartICE(peer, reconnected) })
+	return true
+}
+
+// restartICE делает до maxICERestarts попыток ICE restart. Если соединение
+// так и не восстановилось, закрывает его, EventDisconnected отправит
+// обработчик состояния
+func (c *Connector) restartICE(peer *Peer, reconnected <-chan struct{}) {
+	hexID := hex.EncodeToString(peer.ID[:8])
+
+	for attempt := 1; attempt <= maxICERestarts; attempt++ {
+		select {
+		case <-reconnected:
+			return
+		case <-c.done:
+			return
+		default:
+		}
+		if peer.conn.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+
+		slog.Info("Restarting ICE", "peerID", hexID+"...", "attempt", attempt)
+		var err error
+		if c.offersRestart(peer.ID) {
+			err = c.sendRestartOffer(peer)
+		} else {
+			err = c.requestRestart(peer.ID)
+		}
+		if err != nil {
+			slog.Warn("ICE restart attempt failed", "peerID", hexID+"...", "attempt", attempt, "error", err)
+		}
+
+		select {
+		case <-reconnected:
+			slog.Info("Connection restored by ICE restart", "peerID", hexID+"...", "attempt", attempt)
+			return
+		case <-time.After(iceRestartTimeout):
+		case <-c.done:
+			return
+		}
+	}
+
+	slog.Warn("ICE restart failed, closing connection", "peerID", hexID+"...", "attempts", maxICERestarts)
+	peer.conn.Close()
+}
+
+// offersRestart сообщает, что restart offer'ы к пиру отправляем мы, а не он
+func (c *Connector) offersRestart(peerID router.PeerID) bool {
+	return compareIDs(c.LocalID(), peerID) < 0
+}
+
+// requestRestart просит пира с меньшим ID отправить restart offer
+func (c *Connector) requestRestart(peerID router.PeerID) error {
+	frameJSON, err := json.Marshal(restartFrame{Type: restartFrameType})
+	if err != nil {
+		return fmt.Errorf("marshal restart request: %w", err)
+	}
+	if err := c.sendSignal(peerID, frameJSON); err != nil {
+		return fmt.Errorf("send restart request: %w", err)
+	}
+	return nil
+}
+
+// handleRestartRequest начинает restart по просьбе пира. Наша сторона
+// может еще не заметить обрыв, restart ей все равно нужен
+func (c *Connector) handleRestartRequest(peerID router.PeerID) {
+	hexID := hex.EncodeToString(peerID[:8])
+
+	val, ok := c.peers.Load(peerID)
+	if !ok || val.(*Peer).relay {
+		slog.Debug("Ignoring ICE restart request without connection", "peerID", hexID+"...")
+		return
+	}
+	// SECURITY: каждая просьба порождает offer, лимит тот же
+	if !c.checkOfferRateLimit(peerID) {
+		slog.Warn("Rejecting ICE restart request due to rate limit", "peerID", hexID+"...")
+		return
+	}
+	c.beginICERestart(val.(*Peer))
+}
+
+// sendRestartOffer отправляет offer ICE restart и устанавливает answer пира
+func (c *Connector) sendRestartOffer(peer *Peer) error {
+	answerChan := make(chan []byte, 1)
+	if _, loaded := c.pendingOffers.LoadOrStore(peer.ID, answerChan); loaded {
+		return errNegotiationInProgress
+	}
+	defer c.pendingOffers.CompareAndDelete(peer.ID, answerChan)
+
+	if err := c.createRestartOffer(peer); err != nil {
+		return err
+	}
+
+	offerJSON, err := json.Marshal(restartOffer{
+		SessionDescription: *peer.conn.LocalDescription(),
+		ICERestart:         true,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal restart offer: %w", err)
+	}
+	if err := c.sendSignal(peer.ID, offerJSON); err != nil {
+		return fmt.Errorf("send restart offer: %w", err)
+	}
+	c.flushLocalCandidates(peer)
+
+	select {
+	case answerJSON, ok := <-answerChan:
+		if !ok {
+			return fmt.Errorf("restart offer cancelled")
+		}
+		var answer webrtc.SessionDescription
+		if err := json.Unmarshal(answerJSON, &answer); err != nil {
+			return fmt.Errorf("unmarshal answer: %w", err)
+		}
+
+		peer.negotiation.Lock()
+		defer peer.negotiation.Unlock()
+		if peer.conn.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+			return fmt.Errorf("unexpected answer in signaling state %v", peer.conn.SignalingState())
+		}
+		if err := peer.trickle.setRemoteDescription(peer.conn, answer); err != nil {
+			return fmt.Errorf("set remote description: %w", err)
+		}
+		return nil
+
+	case <-time.After(iceRestartTimeout):
+		return ErrConnectionTimeout
+	case <-c.done:
+		return ErrConnectorClosed
+	}
+}
+
+// createRestartOffer создает offer с новыми ICE учетными данными. Offer
+// предыдущей попытки, оставшийся без answer, заменяется новым
+func (c *Connector) createRestartOffer(peer *Peer) error {
+	peer.negotiation.Lock()
+	defer peer.negotiation.Unlock()
+
+	state := peer.conn.SignalingState()
+	if state != webrtc.SignalingStateStable && state != webrtc.SignalingStateHaveLocalOffer {
+		return errNegotiationInProgress
+	}
+
+	// Кандидаты старого поколения пиру не нужны, новые копим до доставки offer
+	peer.trickle.reset()
+
+	offer, err := peer.conn.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return fmt.Errorf("create restart offer: %w", err)
+	}
+	if err := peer.conn.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("set local description: %w", err)
+	}
+	return nil
+}
+
+// acceptRestartOffer принимает offer ICE restart от пира, с которым уже есть
+// WebRTC соединение
+func (c *Connector) acceptRestartOffer(peerID router.PeerID, offer webrtc.SessionDescription) {
+	hexID := hex.EncodeToString(peerID[:8])
+
+	val, ok := c.peers.Load(peerID)
+	if !ok || val.(*Peer).relay {
+		slog.Debug("Ignoring ICE restart offer without connection", "peerID", hexID+"...")
+		return
+	}
+	peer := val.(*Peer)
+
+	// SECURITY: restart offer ограничивается тем же лимитом, что и обычный
+	if !c.checkOfferRateLimit(peerID) {
+		slog.Warn("Rejecting ICE restart offer due to rate limit", "peerID", hexID+"...")
+		return
+	}
+
+	// Кандидаты пира, пришедшие вслед за offer, копятся до его установки
+	peer.trickle.reset()
+	c.spawn(func() { c.handleRestartOffer(peer, offer) })
+}
+
+// handleRestartOffer отвечает на offer ICE restart
+func (c *Connector) handleRestartOffer(peer *Peer, offer webrtc.SessionDescription) {
+	hexID := hex.EncodeToString(peer.ID[:8])
+
+	answerJSON, err := c.answerRestartOffer(peer, offer)
+	if err != nil {
+		slog.Warn("Failed to answer ICE restart offer", "peerID", hexID+"...", "error", err)
+		return
+	}
+	if err := c.sendSignal(peer.ID, answerJSON); err != nil {
+		slog.Warn("Failed to send ICE restart answer", "peerID", hexID+"...", "error", err)
+		return
+	}
+	c.flushLocalCandidates(peer)
+	slog.Info("Answered ICE restart offer", "peerID", hexID+"...")
+}
+
+// answerRestartOffer устанавливает offer пира и создает answer
+func (c *Connector) answerRestartOffer(peer *Peer, offer webrtc.SessionDescription) ([]byte, error) {
+	peer.negotiation.Lock()
+	defer peer.negotiation.Unlock()
+
+	if peer.conn.SignalingState() != webrtc.SignalingStateStable {
+		return nil, errNegotiationInProgress
+	}
+
+	if err := peer.trickle.setRemoteDescription(peer.conn, offer); err != nil {
+		return nil, fmt.Errorf("set remote description: %w", err)
+	}
+	answer, err := peer.conn.CreateAnswer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("create answer: %w", err)
+	}
+	if err := peer.conn.SetLocalDescription(answer); err != nil {
+		return nil, fmt.Errorf("set local description: %w", err)
+	}
+
+	answerJSON, err := json.Marshal(peer.conn.LocalDescription())
+	if err != nil {
+		return nil, fmt.Errorf("marshal answer: %w", err)
+	}
+	return answerJSON, nil
+}
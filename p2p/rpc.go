@@ -0,0 +1,441 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// RPC поверх DataChannel: Peer.Request отправляет запрос с уникальным в
+// пределах пира ID и ждет ответа с тем же ID, пир выполняет обработчик,
+// зарегистрированный Connector.Handle. Запросы и ответы идут по каналу
+// DataChannelLabel (или relay) внутри зашифрованного сообщения, поэтому
+// фрагментируются и защищены от повторов как обычные данные. Чтобы
+// отличить их от данных Send, перед сообщением добавляется тип:
+//
+//   - сообщение: Type(1) + данные, Type = msgData, msgRPC или msgBye
+//   - RPC: Kind(1) + RequestID(4) + MethodLen(1) + Method + данные
+//
+// Тип добавляется, только если пир поставил sessionFlagRPC в handshake,
+// пиру прежней версии Send отправляет данные как раньше, а Request
+// возвращает ErrRPCNotSupported. Relay-пир без сеансовых ключей RPC не
+// поддерживает. Отмена ctx запроса отправляет пиру rpcCancel, он отменяет
+// контекст обработчика, ответ на отмененный запрос не отправляется
+
+const (
+	msgData byte = iota
+	msgRPC
+	msgBye // прощание перед закрытием соединения, данные - причина (см. bye.go)
+)
+
+const (
+	rpcRequest  byte = iota
+	rpcResponse      // данные - ответ обработчика
+	rpcError         // данные - текст ошибки обработчика
+	rpcNotFound      // обработчик метода не зарегистрирован
+	rpcCancel        // запрос отменен отправителем
+)
+
+const (
+	msgTypeSize     = 1
+	rpcHeaderSize   = 1 + 4 + 1
+	maxRPCMethodLen = 255
+
+	// DefaultRPCTimeout - ожидание ответа, если у ctx запроса нет дедлайна
+	DefaultRPCTimeout = 30 * time.Second
+
+	// maxServedRequests - сколько запросов пира обрабатывается одновременно
+	maxServedRequests = 64
+
+	// rpcReplyTimeout - ожидание места в буфере канала для ответа и отмены
+	rpcReplyTimeout = 10 * time.Second
+)
+
+var ErrRPCNotSupported = errors.New("peer does not support RPC")
+var ErrUnknownMethod = errors.New("unknown RPC method")
+var ErrPeerClosed = errors.New("peer connection closed")
+
+// RPCError - ошибка, которую вернул обработчик запроса на стороне пира
+type RPCError struct {
+	Method  string
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc %s: %s", e.Method, e.Message)
+}
+
+// RPCHandler обрабатывает запрос пира. ctx отменяется, если пир отменил
+// запрос, соединение закрылось или коннектор остановлен. Ошибка уходит
+// пиру текстом в *RPCError
+type RPCHandler func(ctx context.Context, peer *Peer, payload []byte) ([]byte, error)
+
+// Handle регистрирует обработчик запросов метода method, заменяя прежний.
+// nil удаляет обработчик
+func (c *Connector) Handle(method string, handler RPCHandler) {
+	if len(method) == 0 || len(method) > maxRPCMethodLen {
+		panic(fmt.Sprintf("p2p: invalid RPC method %q", method))
+	}
+	c.rpcMu.Lock()
+	defer c.rpcMu.Unlock()
+	if handler == nil {
+		delete(c.rpcHandlers, method)
+		return
+	}
+	if c.rpcHandlers == nil {
+		c.rpcHandlers = make(map[string]RPCHandler)
+	}
+	c.rpcHandlers[method] = handler
+}
+
+// Request отправляет пиру запрос метода method и ждет ответа. Без дедлайна
+// у ctx ждет DefaultRPCTimeout. Ошибку обработчика пира возвращает как
+// *RPCError, незарегистрированный у пира метод - как ErrUnknownMethod
+func (p *Peer) Request(ctx context.Context, method string, payload []byte) ([]byte, error) {
+	if len(method) == 0 || len(method) > maxRPCMethodLen {
+		return nil, fmt.Errorf("invalid RPC method %q", method)
+	}
+	if size := rpcHeaderSize + len(method) + len(payload); size > MaxMessageSize {
+		return nil, fmt.Errorf("request %q: %w: %d bytes (max %d)", method, ErrMessageTooLarge, size, MaxMessageSize)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRPCTimeout)
+		defer cancel()
+	}
+	if err := p.rpcReady(); err != nil {
+		return nil, fmt.Errorf("request %q: %w", method, err)
+	}
+
+	id, result, err := p.rpc.register(method)
+	if err != nil {
+		return nil, fmt.Errorf("request %q: %w", method, err)
+	}
+	defer p.rpc.forget(id)
+
+	frame := encodeRPC(rpcRequest, id, method, payload)
+	if err := p.sendOnContext(ctx, DataChannelLabel, msgRPC, frame); err != nil {
+		if ctx.Err() != nil {
+			p.cancelRequest(id)
+		}
+		return nil, fmt.Errorf("request %q: %w", method, err)
+	}
+
+	select {
+	case res := <-result:
+		return res.data, res.err
+	case <-ctx.Done():
+		p.cancelRequest(id)
+		return nil, ctx.Err()
+	case <-p.connector.done:
+		return nil, ErrConnectorClosed
+	}
+}
+
+// rpcReady проверяет, что пир понимает RPC. Ждет сеансовых ключей: флаги
+// пира известны из его handshake
+func (p *Peer) rpcReady() error {
+	if p.session == nil {
+		return ErrRPCNotSupported
+	}
+	if p.relay {
+		if !p.relaySessionReady() {
+			return ErrRPCNotSupported
+		}
+	} else if err := p.session.waitReady(p.connector.done); err != nil {
+		return err
+	}
+	if !p.session.rpc() {
+		return ErrRPCNotSupported
+	}
+	return nil
+}
+
+// cancelRequest сообщает пиру, что ответ на запрос больше не нужен
+func (p *Peer) cancelRequest(id uint32) {
+	p.connector.spawn(func() {
+		p.sendRPC(encodeRPC(rpcCancel, id, "", nil))
+	})
+}
+
+// sendRPC отправляет кадр RPC по каналу DataChannelLabel
+func (p *Peer) sendRPC(frame []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcReplyTimeout)
+	defer cancel()
+	if err := p.sendOnContext(ctx, DataChannelLabel, msgRPC, frame); err != nil {
+		slog.Debug("Failed to send RPC frame", "peerID", hex.EncodeToString(p.ID[:8])+"...", "kind", frame[0], "error", err)
+	}
+}
+
+// withType добавляет тип перед данными, если пир его ожидает
+func (p *Peer) withType(msgType byte, data []byte) []byte {
+	if !p.session.rpc() {
+		return data
+	}
+	buf := make([]byte, 0, msgTypeSize+len(data))
+	buf = append(buf, msgType)
+	return append(buf, data...)
+}
+
+// splitType отделяет тип сообщения от данных. Пир без sessionFlagRPC
+// присылает только данные
+func (p *Peer) splitType(data []byte) (byte, []byte, error) {
+	if !p.session.rpc() {
+		return msgData, data, nil
+	}
+	if len(data) < msgTypeSize {
+		return 0, nil, fmt.Errorf("message too short for type")
+	}
+	switch data[0] {
+	case msgData, msgRPC, msgBye:
+		return data[0], data[msgTypeSize:], nil
+	default:
+		return 0, nil, fmt.Errorf("unknown message type %d", data[0])
+	}
+}
+
+// handleRPC обрабатывает кадр RPC пира
+func (c *Connector) handleRPC(peer *Peer, data []byte) {
+	hexID := hex.EncodeToString(peer.ID[:8])
+
+	kind, id, method, payload, err := decodeRPC(data)
+	if err != nil {
+		slog.Warn("Dropping invalid RPC frame", "peerID", hexID+"...", "error", err)
+		c.emit(Event{
+			Type:   EventError,
+			PeerID: peer.ID,
+			Error:  fmt.Errorf("rpc: %w", err),
+		})
+		return
+	}
+
+	switch kind {
+	case rpcRequest:
+		c.serveRPC(peer, id, method, payload)
+	case rpcCancel:
+		peer.rpc.cancelServing(id)
+	default:
+		if !peer.rpc.resolve(id, kind, payload) {
+			slog.Debug("Dropping RPC reply to unknown request", "peerID", hexID+"...", "requestID", id)
+		}
+	}
+}
+
+// serveRPC выполняет обработчик запроса пира в отдельной горутине и
+// отправляет ответ
+func (c *Connector) serveRPC(peer *Peer, id uint32, method string, payload []byte) {
+	hexID := hex.EncodeToString(peer.ID[:8])
+
+	c.rpcMu.RLock()
+	handler := c.rpcHandlers[method]
+	c.rpcMu.RUnlock()
+
+	ctx, err := peer.rpc.serve(id)
+	if err != nil {
+		slog.Warn("Rejecting RPC request", "peerID", hexID+"...", "method", method, "error", err)
+		c.spawn(func() {
+			peer.sendRPC(encodeRPC(rpcError, id, "", []byte(err.Error())))
+		})
+		return
+	}
+
+	c.spawn(func() {
+		defer peer.rpc.finish(id)
+
+		if handler == nil {
+			slog.Debug("No handler for RPC method", "peerID", hexID+"...", "method", method)
+			peer.sendRPC(encodeRPC(rpcNotFound, id, "", nil))
+			return
+		}
+
+		// Остановка коннектора отменяет обработчики
+		go func() {
+			select {
+			case <-c.done:
+				peer.rpc.cancelServing(id)
+			case <-ctx.Done():
+			}
+		}()
+
+		resp, err := handler(ctx, peer, payload)
+		if ctx.Err() != nil {
+			slog.Debug("RPC request cancelled", "peerID", hexID+"...", "method", method)
+			return
+		}
+		if err != nil {
+			peer.sendRPC(encodeRPC(rpcError, id, "", []byte(err.Error())))
+			return
+		}
+		if size := rpcHeaderSize + len(resp); size > MaxMessageSize {
+			slog.Warn("RPC response too large", "peerID", hexID+"...", "method", method, "bytes", len(resp))
+			peer.sendRPC(encodeRPC(rpcError, id, "", []byte(ErrMessageTooLarge.Error())))
+			return
+		}
+		peer.sendRPC(encodeRPC(rpcResponse, id, "", resp))
+	})
+}
+
+// rpcResult - ответ пира на запрос
+type rpcResult struct {
+	data []byte
+	err  error
+}
+
+// rpcCall - запрос, ждущий ответа
+type rpcCall struct {
+	method string
+	result chan rpcResult
+}
+
+// rpcCalls - запросы одного пира: наши, ждущие ответа, и его, которые
+// обрабатываются. Нулевое значение готово к работе
+type rpcCalls struct {
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]*rpcCall
+	serving map[uint32]context.CancelFunc
+	closed  bool
+}
+
+// register выделяет ID запроса и канал для ответа на него
+func (r *rpcCalls) register(method string) (uint32, <-chan rpcResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, nil, ErrPeerClosed
+	}
+	if r.pending == nil {
+		r.pending = make(map[uint32]*rpcCall)
+	}
+	r.nextID++
+	call := &rpcCall{method: method, result: make(chan rpcResult, 1)}
+	r.pending[r.nextID] = call
+	return r.nextID, call.result, nil
+}
+
+// forget перестает ждать ответа на запрос
+func (r *rpcCalls) forget(id uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, id)
+}
+
+// resolve передает ответ пира ожидающему запросу. false, если запрос
+// уже завершен
+func (r *rpcCalls) resolve(id uint32, kind byte, payload []byte) bool {
+	r.mu.Lock()
+	call, ok := r.pending[id]
+	delete(r.pending, id)
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	var res rpcResult
+	switch kind {
+	case rpcResponse:
+		res.data = payload
+	case rpcError:
+		res.err = &RPCError{Method: call.method, Message: string(payload)}
+	default:
+		res.err = fmt.Errorf("%w: %q", ErrUnknownMethod, call.method)
+	}
+	call.result <- res
+	return true
+}
+
+// serve отмечает запрос пира обрабатываемым и возвращает контекст
+// обработчика
+func (r *rpcCalls) serve(id uint32) (context.Context, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, ErrPeerClosed
+	}
+	if _, ok := r.serving[id]; ok {
+		return nil, fmt.Errorf("duplicate request %d", id)
+	}
+	// SECURITY: пир не может занять неограниченное число горутин
+	if len(r.serving) >= maxServedRequests {
+		return nil, fmt.Errorf("too many concurrent requests")
+	}
+	if r.serving == nil {
+		r.serving = make(map[uint32]context.CancelFunc)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.serving[id] = cancel
+	return ctx, nil
+}
+
+// cancelServing отменяет контекст обработчика запроса пира
+func (r *rpcCalls) cancelServing(id uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel, ok := r.serving[id]; ok {
+		cancel()
+	}
+}
+
+// finish завершает обработку запроса пира
+func (r *rpcCalls) finish(id uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel, ok := r.serving[id]; ok {
+		cancel()
+		delete(r.serving, id)
+	}
+}
+
+// close завершает ожидающие запросы с ErrPeerClosed и отменяет
+// обработчики запросов пира
+func (r *rpcCalls) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	for id, call := range r.pending {
+		call.result <- rpcResult{err: ErrPeerClosed}
+		delete(r.pending, id)
+	}
+	for _, cancel := range r.serving {
+		cancel()
+	}
+}
+
+// encodeRPC собирает кадр RPC
+func encodeRPC(kind byte, id uint32, method string, payload []byte) []byte {
+	frame := make([]byte, 0, rpcHeaderSize+len(method)+len(payload))
+	frame = append(frame, kind)
+	frame = binary.BigEndian.AppendUint32(frame, id)
+	frame = append(frame, byte(len(method)))
+	frame = append(frame, method...)
+	return append(frame, payload...)
+}
+
+// decodeRPC разбирает кадр RPC
+func decodeRPC(frame []byte) (kind byte, id uint32, method string, payload []byte, err error) {
+	if len(frame) < rpcHeaderSize {
+		return 0, 0, "", nil, fmt.Errorf("frame too short: %d bytes", len(frame))
+	}
+	kind = frame[0]
+	if kind > rpcCancel {
+		return 0, 0, "", nil, fmt.Errorf("unknown frame kind %d", kind)
+	}
+	id = binary.BigEndian.Uint32(frame[1:5])
+	methodLen := int(frame[5])
+	if len(frame) < rpcHeaderSize+methodLen {
+		return 0, 0, "", nil, fmt.Errorf("frame too short for method: %d bytes", len(frame))
+	}
+	if kind == rpcRequest && methodLen == 0 {
+		return 0, 0, "", nil, fmt.Errorf("request without method")
+	}
+	method = string(frame[rpcHeaderSize : rpcHeaderSize+methodLen])
+	return kind, id, method, frame[rpcHeaderSize+methodLen:], nil
+}
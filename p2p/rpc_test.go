@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRPCFrame(t *testing.T) {
+	frame := encodeRPC(rpcRequest, 42, "file.accept", []byte("payload"))
+	kind, id, method, payload, err := decodeRPC(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != rpcRequest || id != 42 || method != "file.accept" || !bytes.Equal(payload, []byte("payload")) {
+		t.Fatalf("Unexpected frame: %d %d %q %q", kind, id, method, payload)
+	}
+
+	for name, frame := range map[string][]byte{
+		"Empty":    {},
+		"Short":    frame[:rpcHeaderSize-1],
+		"Kind":     encodeRPC(rpcCancel+1, 1, "", nil),
+		"Method":   frame[:rpcHeaderSize+3],
+		"NoMethod": encodeRPC(rpcRequest, 1, "", []byte("payload")),
+	} {
+		if _, _, _, _, err := decodeRPC(frame); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+// TestRPCCalls проверяет корреляцию ответов и завершение запросов при
+// закрытии соединения
+func TestRPCCalls(t *testing.T) {
+	var r rpcCalls
+
+	first, result1, err := r.register("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, result2, err := r.register("fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("Expected unique request IDs")
+	}
+
+	// Ответы приходят в любом порядке
+	if !r.resolve(second, rpcError, []byte("boom")) {
+		t.Fatal("Expected pending request")
+	}
+	if !r.resolve(first, rpcResponse, []byte("pong")) {
+		t.Fatal("Expected pending request")
+	}
+	if res := <-result1; res.err != nil || string(res.data) != "pong" {
+		t.Fatalf("Unexpected result: %q, %v", res.data, res.err)
+	}
+	var rpcErr *RPCError
+	if res := <-result2; !errors.As(res.err, &rpcErr) || rpcErr.Method != "fail" || rpcErr.Message != "boom" {
+		t.Fatalf("Expected RPCError, got %v", res.err)
+	}
+	if r.resolve(first, rpcResponse, nil) {
+		t.Fatal("Duplicate response must be dropped")
+	}
+
+	id, result, _ := r.register("missing")
+	r.resolve(id, rpcNotFound, nil)
+	if res := <-result; !errors.Is(res.err, ErrUnknownMethod) {
+		t.Fatalf("Expected ErrUnknownMethod, got %v", res.err)
+	}
+
+	// Обработка запросов пира ограничена и отменяется при закрытии
+	ctx, err := r.serve(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.serve(1); err == nil {
+		t.Fatal("Expected error for duplicate request ID")
+	}
+	for id := uint32(2); id <= maxServedRequests; id++ {
+		if _, err := r.serve(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.serve(maxServedRequests + 1); err == nil {
+		t.Fatal("Expected error above maxServedRequests")
+	}
+
+	_, pending, _ := r.register("slow")
+	r.close()
+	if res := <-pending; !errors.Is(res.err, ErrPeerClosed) {
+		t.Fatalf("Expected ErrPeerClosed, got %v", res.err)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("Expected handler context to be cancelled")
+	}
+	if _, _, err := r.register("late"); !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("Expected ErrPeerClosed after close, got %v", err)
+	}
+}
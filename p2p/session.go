@@ -0,0 +1,487 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Сеансовые ключи DataChannel: долговременные ключи из Ed25519 шифруют
+// только сигнализацию через router. После открытия канала DataChannelLabel
+// пиры обмениваются эфемерными X25519 ключами, подписанными Ed25519
+// идентичностью, и выводят из них (HKDF) по ключу на каждое направление.
+// Утечка долговременного ключа не раскрывает перехваченный трафик
+// DataChannel (forward secrecy).
+//
+//   - handshake: Type(1) + Flags(1) + Epoch(4) + EphPub(32) + Signature(64)
+//   - данные: Type(1) + Epoch(4) + Nonce(24) + secretbox
+//
+// Смена ключей (rekey) - новый handshake со следующей эпохой после
+// RekeyMessages отправленных сообщений или RekeyInterval. Инициатор шлет
+// handshake, пир выводит ключи эпохи и отвечает handshake с флагом reply.
+// Получив ответ, инициатор переходит на новую эпоху и шлет пустое
+// подтверждение, а пир переходит на нее, получив первое сообщение новой
+// эпохи. Так ни одна сторона не шифрует ключом, которого у другой еще нет:
+// сообщение другого канала может обогнать handshake. Ключи предыдущей эпохи
+// живут до следующего rekey, чтобы расшифровать сообщения в пути.
+//
+// Оба пира начинают первую эпоху одновременно при открытии канала. Встречный
+// handshake той же эпохи, что и собственный неотвеченный, принимается как
+// ответ на него: обе стороны выводят ключи из одной пары эфемерных ключей и
+// отвечают reply
+//
+// Relay через router использует те же сеансы, кадры идут через router
+// (см. relay.go)
+
+const (
+	sessionFrameHandshake byte = iota + 1
+	sessionFrameData
+)
+
+const (
+	sessionFlagReply byte = 1
+	// sessionFlagFragments - отправитель собирает фрагменты сообщений (см.
+	// fragment.go). Прежние версии флаг не ставят и игнорируют
+	sessionFlagFragments byte = 2
+	// sessionFlagRPC - отправитель различает данные и RPC по типу
+	// сообщения (см. rpc.go)
+	sessionFlagRPC byte = 4
+	// sessionFlagBye - отправитель понимает прощание msgBye (см. bye.go)
+	sessionFlagBye byte = 8
+
+	sessionHandshakeSize = 1 + 1 + 4 + 32 + ed25519.SignatureSize
+	sessionDataHeader    = 1 + 4 + 24
+
+	// DefaultRekeyMessages - отправленных сообщений на одну эпоху
+	DefaultRekeyMessages = 1000
+	// DefaultRekeyInterval - время жизни ключей эпохи
+	DefaultRekeyInterval = 10 * time.Minute
+
+	// sessionHandshakeTimeout - ожидание ключей перед первой отправкой
+	sessionHandshakeTimeout = 10 * time.Second
+)
+
+// sessionContext отделяет подписи и ключи сеанса от других применений
+var sessionContext = []byte("sendy-session-v1")
+
+var ErrSessionNotReady = errors.New("session key exchange did not complete")
+
+// sessionKeys - ключи одной эпохи
+type sessionKeys struct {
+	epoch uint32
+	send  [32]byte
+	recv  [32]byte
+}
+
+// pendingHandshake - отправленный handshake, ждущий ответа
+type pendingHandshake struct {
+	epoch uint32
+	pub   [32]byte
+	priv  [32]byte
+}
+
+// session - сеансовые ключи DataChannel одного пира
+type session struct {
+	localID router.PeerID
+	peerID  router.PeerID
+	edPriv  ed25519.PrivateKey
+
+	rekeyMessages int
+	rekeyInterval time.Duration
+
+	mu        sync.Mutex
+	cur       *sessionKeys // последняя выведенная эпоха
+	prev      *sessionKeys // предыдущая эпоха, для сообщений в пути
+	sendEpoch uint32       // эпоха, которой шифруется отправка
+	sent      int          // отправлено в sendEpoch
+	keyedAt   time.Time    // переход на sendEpoch
+	pending   *pendingHandshake
+	ready     chan struct{} // закрывается при первом переходе на эпоху
+
+	peerFragments bool // handshake пира с sessionFlagFragments
+	peerRPC       bool // handshake пира с sessionFlagRPC
+	peerBye       bool // handshake пира с sessionFlagBye
+}
+
+func newSession(localID, peerID router.PeerID, edPriv ed25519.PrivateKey, rekeyMessages int, rekeyInterval time.Duration) *session {
+	if rekeyMessages <= 0 {
+		rekeyMessages = DefaultRekeyMessages
+	}
+	if rekeyInterval <= 0 {
+		rekeyInterval = DefaultRekeyInterval
+	}
+	return &session{
+		localID:       localID,
+		peerID:        peerID,
+		edPriv:        edPriv,
+		rekeyMessages: rekeyMessages,
+		rekeyInterval: rekeyInterval,
+		ready:         make(chan struct{}),
+	}
+}
+
+// start возвращает handshake первой эпохи. nil, если обмен уже начат
+// встречным handshake пира
+func (s *session) start() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur != nil || s.pending != nil {
+		return nil, nil
+	}
+	return s.beginHandshakeLocked(1)
+}
+
+// isReady сообщает, есть ли ключи для отправки
+func (s *session) isReady() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// fragments сообщает, что пир собирает фрагменты сообщений. Известно к
+// моменту готовности ключей: их выводит handshake пира
+func (s *session) fragments() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerFragments
+}
+
+// rpc сообщает, что пир различает данные и RPC по типу сообщения
+func (s *session) rpc() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerRPC
+}
+
+// bye сообщает, что пир понимает прощание перед закрытием соединения
+func (s *session) bye() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerBye
+}
+
+// waitReady ждет ключей для отправки
+func (s *session) waitReady(done <-chan struct{}) error {
+	select {
+	case <-s.ready:
+		return nil
+	default:
+	}
+	select {
+	case <-s.ready:
+		return nil
+	case <-time.After(sessionHandshakeTimeout):
+		return ErrSessionNotReady
+	case <-done:
+		return ErrConnectorClosed
+	}
+}
+
+// seal шифрует данные ключом текущей эпохи. Если пора сменить ключи,
+// вторым значением возвращается handshake rekey для канала DataChannelLabel
+func (s *session) seal(data []byte) ([]byte, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := s.sendKeysLocked()
+	if keys == nil {
+		return nil, nil, ErrSessionNotReady
+	}
+	frame, err := sealSessionFrame(keys, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.sent++
+
+	var rekey []byte
+	if s.rekeyDueLocked() {
+		rekey, err = s.beginHandshakeLocked(s.cur.epoch + 1)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return frame, rekey, nil
+}
+
+// open обрабатывает кадр пира. Возвращает расшифрованные данные (пустые
+// для handshake и подтверждения эпохи) и кадр, который нужно отправить в
+// ответ по каналу DataChannelLabel
+func (s *session) open(frame []byte) ([]byte, []byte, error) {
+	if len(frame) == 0 {
+		return nil, nil, fmt.Errorf("empty frame")
+	}
+	switch frame[0] {
+	case sessionFrameHandshake:
+		reply, err := s.handleHandshake(frame)
+		return nil, reply, err
+	case sessionFrameData:
+		data, err := s.openData(frame)
+		return data, nil, err
+	default:
+		return nil, nil, fmt.Errorf("unknown frame type %d", frame[0])
+	}
+}
+
+// sendKeysLocked возвращает ключи эпохи отправки
+func (s *session) sendKeysLocked() *sessionKeys {
+	switch {
+	case s.sendEpoch == 0:
+		return nil
+	case s.cur != nil && s.cur.epoch == s.sendEpoch:
+		return s.cur
+	case s.prev != nil && s.prev.epoch == s.sendEpoch:
+		return s.prev
+	}
+	return nil
+}
+
+// rekeyDueLocked сообщает, что пора начать следующую эпоху. Пока
+// предыдущий rekey не завершен, новый не начинается
+func (s *session) rekeyDueLocked() bool {
+	if s.cur == nil || s.sendEpoch != s.cur.epoch || s.pending != nil {
+		return false
+	}
+	return s.sent >= s.rekeyMessages || time.Since(s.keyedAt) >= s.rekeyInterval
+}
+
+// beginHandshakeLocked создает эфемерный ключ эпохи и handshake с ним
+func (s *session) beginHandshakeLocked(epoch uint32) ([]byte, error) {
+	var p pendingHandshake
+	if _, err := rand.Read(p.priv[:]); err != nil {
+		return nil, fmt.Errorf("generate ephemeral key: %w", err)
+	}
+	pub, err := curve25519.X25519(p.priv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("derive ephemeral key: %w", err)
+	}
+	copy(p.pub[:], pub)
+	p.epoch = epoch
+	s.pending = &p
+	return s.handshakeFrame(0, epoch, &p.pub), nil
+}
+
+// handshakeFrame подписывает эфемерный ключ нашей Ed25519 идентичностью
+func (s *session) handshakeFrame(flags byte, epoch uint32, pub *[32]byte) []byte {
+	flags |= sessionFlagFragments | sessionFlagRPC | sessionFlagBye
+	frame := make([]byte, 0, sessionHandshakeSize)
+	frame = append(frame, sessionFrameHandshake, flags)
+	frame = binary.BigEndian.AppendUint32(frame, epoch)
+	frame = append(frame, pub[:]...)
+	sig := ed25519.Sign(s.edPriv, handshakeSigned(flags, epoch, pub, s.localID, s.peerID))
+	return append(frame, sig...)
+}
+
+// handshakeSigned - подписываемые данные handshake. ID отправителя и
+// получателя не дают переслать handshake другому пиру
+func handshakeSigned(flags byte, epoch uint32, pub *[32]byte, from, to router.PeerID) []byte {
+	msg := append([]byte{}, sessionContext...)
+	msg = append(msg, flags)
+	msg = binary.BigEndian.AppendUint32(msg, epoch)
+	msg = append(msg, pub[:]...)
+	msg = append(msg, from[:]...)
+	return append(msg, to[:]...)
+}
+
+// handleHandshake проверяет handshake пира и выводит ключи эпохи
+func (s *session) handleHandshake(frame []byte) ([]byte, error) {
+	if len(frame) != sessionHandshakeSize {
+		return nil, fmt.Errorf("invalid handshake size: %d", len(frame))
+	}
+	flags := frame[1]
+	epoch := binary.BigEndian.Uint32(frame[2:6])
+	var peerPub [32]byte
+	copy(peerPub[:], frame[6:38])
+	sig := frame[38:]
+
+	// SECURITY: эфемерный ключ должен быть подписан идентичностью пира
+	signed := handshakeSigned(flags, epoch, &peerPub, s.peerID, s.localID)
+	if !ed25519.Verify(ed25519.PublicKey(s.peerID[:]), signed, sig) {
+		return nil, fmt.Errorf("invalid handshake signature")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peerFragments = flags&sessionFlagFragments != 0
+	s.peerRPC = flags&sessionFlagRPC != 0
+	s.peerBye = flags&sessionFlagBye != 0
+	reply := flags&sessionFlagReply != 0
+	if reply {
+		return s.handleReplyLocked(epoch, &peerPub)
+	}
+
+	if s.cur != nil && epoch <= s.cur.epoch {
+		return nil, fmt.Errorf("stale handshake epoch %d", epoch)
+	}
+	var ours *pendingHandshake
+	if s.pending != nil && s.pending.epoch == epoch {
+		// Встречный handshake: ответ на наш
+		ours = s.pending
+	} else {
+		// Наш handshake другой эпохи больше не нужен, ключ берем новый
+		if _, err := s.beginHandshakeLocked(epoch); err != nil {
+			return nil, err
+		}
+		ours = s.pending
+	}
+	if err := s.deriveLocked(ours, &peerPub); err != nil {
+		return nil, err
+	}
+	return s.handshakeFrame(sessionFlagReply, epoch, &ours.pub), nil
+}
+
+// handleReplyLocked переходит на эпоху, которую подтвердил ответ пира, и
+// возвращает пустое подтверждение для перехода пира
+func (s *session) handleReplyLocked(epoch uint32, peerPub *[32]byte) ([]byte, error) {
+	switch {
+	case s.pending != nil && s.pending.epoch == epoch:
+		if err := s.deriveLocked(s.pending, peerPub); err != nil {
+			return nil, err
+		}
+	case s.cur != nil && s.cur.epoch == epoch:
+		// Ключи уже выведены из встречного handshake
+	default:
+		return nil, fmt.Errorf("unexpected handshake reply for epoch %d", epoch)
+	}
+
+	if s.sendEpoch == epoch {
+		return nil, nil
+	}
+	s.switchSendLocked(epoch)
+	return sealSessionFrame(s.cur, nil)
+}
+
+// deriveLocked выводит ключи эпохи ours.epoch. Ключи эпохи до предыдущей
+// удаляются
+func (s *session) deriveLocked(ours *pendingHandshake, peerPub *[32]byte) error {
+	shared, err := curve25519.X25519(ours.priv[:], peerPub[:])
+	if err != nil {
+		return fmt.Errorf("key agreement: %w", err)
+	}
+
+	// Порядок ключей в salt и направлений в выводе определяют ID, чтобы
+	// обе стороны получили одно и то же
+	localFirst := compareIDs(s.localID, s.peerID) < 0
+	var salt []byte
+	if localFirst {
+		salt = append(append(salt, ours.pub[:]...), peerPub[:]...)
+	} else {
+		salt = append(append(salt, peerPub[:]...), ours.pub[:]...)
+	}
+	info := binary.BigEndian.AppendUint32(append([]byte{}, sessionContext...), ours.epoch)
+	okm, err := hkdf.Key(sha256.New, shared, salt, string(info), 64)
+	if err != nil {
+		return fmt.Errorf("derive session keys: %w", err)
+	}
+
+	keys := &sessionKeys{epoch: ours.epoch}
+	if localFirst {
+		copy(keys.send[:], okm[:32])
+		copy(keys.recv[:], okm[32:])
+	} else {
+		copy(keys.send[:], okm[32:])
+		copy(keys.recv[:], okm[:32])
+	}
+	clear(okm)
+	clear(shared)
+
+	if s.prev != nil && s.prev.epoch != s.sendEpoch {
+		clear(s.prev.send[:])
+		clear(s.prev.recv[:])
+	}
+	if s.cur == nil || s.cur.epoch == s.sendEpoch {
+		s.prev = s.cur
+	} else {
+		// Неподтвержденная эпоха заменяется, отправка остается на prev
+		clear(s.cur.send[:])
+		clear(s.cur.recv[:])
+	}
+	s.cur = keys
+
+	clear(ours.priv[:])
+	if s.pending == ours {
+		s.pending = nil
+	}
+	return nil
+}
+
+// switchSendLocked переходит на эпоху cur для отправки
+func (s *session) switchSendLocked(epoch uint32) {
+	s.sendEpoch = epoch
+	s.sent = 0
+	s.keyedAt = time.Now()
+	select {
+	case <-s.ready:
+	default:
+		close(s.ready)
+	}
+}
+
+// openData расшифровывает кадр данных ключом его эпохи. Первое сообщение
+// новой эпохи переводит на нее и нашу отправку
+func (s *session) openData(frame []byte) ([]byte, error) {
+	if len(frame) < sessionDataHeader+secretbox.Overhead {
+		return nil, fmt.Errorf("data frame too short: %d bytes", len(frame))
+	}
+	epoch := binary.BigEndian.Uint32(frame[1:5])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys *sessionKeys
+	switch {
+	case s.cur != nil && s.cur.epoch == epoch:
+		keys = s.cur
+	case s.prev != nil && s.prev.epoch == epoch:
+		keys = s.prev
+	default:
+		return nil, fmt.Errorf("no session key for epoch %d", epoch)
+	}
+
+	data, err := openSessionFrame(keys, frame)
+	if err != nil {
+		return nil, err
+	}
+	if keys == s.cur && s.sendEpoch != epoch {
+		s.switchSendLocked(epoch)
+	}
+	return data, nil
+}
+
+// sealSessionFrame шифрует data ключом отправки эпохи
+func sealSessionFrame(keys *sessionKeys, data []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	frame := make([]byte, 0, sessionDataHeader+len(data)+secretbox.Overhead)
+	frame = append(frame, sessionFrameData)
+	frame = binary.BigEndian.AppendUint32(frame, keys.epoch)
+	frame = append(frame, nonce[:]...)
+	return secretbox.Seal(frame, data, &nonce, &keys.send), nil
+}
+
+// openSessionFrame расшифровывает кадр данных ключом получения эпохи
+func openSessionFrame(keys *sessionKeys, frame []byte) ([]byte, error) {
+	var nonce [24]byte
+	copy(nonce[:], frame[5:sessionDataHeader])
+	data, ok := secretbox.Open(nil, frame[sessionDataHeader:], &nonce, &keys.recv)
+	if !ok {
+		return nil, fmt.Errorf("decryption failed: authentication failed or corrupted message")
+	}
+	return data, nil
+}
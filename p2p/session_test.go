@@ -0,0 +1,247 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// newSessionPair создает сеансы двух пиров друг с другом
+func newSessionPair(t *testing.T, rekeyMessages int) (*session, *session) {
+	t.Helper()
+
+	pubA, privA, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubB, privB, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idA, idB router.PeerID
+	copy(idA[:], pubA)
+	copy(idB[:], pubB)
+
+	a := newSession(idA, idB, privA, rekeyMessages, 0)
+	b := newSession(idB, idA, privB, rekeyMessages, 0)
+	return a, b
+}
+
+// deliver передает кадр from -> to и ответы обратно, пока они есть.
+// Возвращает данные первого кадра
+func deliver(t *testing.T, from, to *session, frame []byte) []byte {
+	t.Helper()
+
+	data, reply, err := to.open(frame)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for reply != nil {
+		from, to = to, from
+		_, reply, err = to.open(reply)
+		if err != nil {
+			t.Fatalf("open reply: %v", err)
+		}
+	}
+	return data
+}
+
+// handshake проводит первый обмен ключами, как при открытии канала
+func handshake(t *testing.T, a, b *session) {
+	t.Helper()
+
+	helloA, err := a.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	helloB, err := b.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Встречные handshake, как при одновременном открытии канала: каждый
+	// приходит раньше ответа на него
+	_, replyB, err := b.open(helloA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, replyA, err := a.open(helloB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, b, a, replyB)
+	deliver(t, a, b, replyA)
+
+	for _, s := range []*session{a, b} {
+		select {
+		case <-s.ready:
+		default:
+			t.Fatal("Session not ready after handshake")
+		}
+	}
+}
+
+// send шифрует сообщение и доставляет его вместе с handshake rekey
+func send(t *testing.T, from, to *session, msg []byte) {
+	t.Helper()
+
+	frame, rekey, err := from.seal(msg)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if got := deliver(t, from, to, frame); !bytes.Equal(got, msg) {
+		t.Fatalf("Expected %q, got %q", msg, got)
+	}
+	if rekey != nil {
+		deliver(t, from, to, rekey)
+	}
+}
+
+func TestSessionHandshake(t *testing.T) {
+	a, b := newSessionPair(t, 0)
+
+	// До обмена ключами отправлять нечем
+	if _, _, err := a.seal([]byte("early")); err == nil {
+		t.Fatal("Expected error before handshake")
+	}
+
+	handshake(t, a, b)
+	if a.sendEpoch != 1 || b.sendEpoch != 1 {
+		t.Fatalf("Expected epoch 1, got %d and %d", a.sendEpoch, b.sendEpoch)
+	}
+	if a.cur.send != b.cur.recv || a.cur.recv != b.cur.send {
+		t.Fatal("Peers derived different keys")
+	}
+	if a.cur.send == a.cur.recv {
+		t.Fatal("Expected separate keys per direction")
+	}
+
+	send(t, a, b, []byte("hello"))
+	send(t, b, a, []byte("hi"))
+
+	// Измененный кадр не расшифровывается
+	frame, _, err := a.seal([]byte("tampered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame[len(frame)-1] ^= 0xff
+	if _, _, err := b.open(frame); err == nil {
+		t.Fatal("Expected error for tampered frame")
+	}
+}
+
+// TestSessionHandshakeOneSided проверяет обмен, который начал один пир:
+// второй открыл канал позже и получил handshake раньше своего OnOpen
+func TestSessionHandshakeOneSided(t *testing.T) {
+	a, b := newSessionPair(t, 0)
+
+	hello, err := a.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, a, b, hello)
+
+	if again, err := b.start(); err != nil || again != nil {
+		t.Fatalf("Expected no second handshake, got %v, %v", again, err)
+	}
+	if a.sendEpoch != 1 || b.sendEpoch != 1 {
+		t.Fatalf("Expected epoch 1, got %d and %d", a.sendEpoch, b.sendEpoch)
+	}
+	send(t, b, a, []byte("hello"))
+}
+
+func TestSessionHandshakeSignature(t *testing.T) {
+	a, b := newSessionPair(t, 0)
+	hello, err := a.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Подмененный эфемерный ключ не совпадает с подписью
+	forged := bytes.Clone(hello)
+	forged[10] ^= 0xff
+	if _, _, err := b.open(forged); err == nil {
+		t.Fatal("Expected error for forged handshake")
+	}
+
+	// Handshake, подписанный не тем пиром
+	c, _ := newSessionPair(t, 0)
+	c.peerID = b.localID
+	other, err := c.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.open(other); err == nil {
+		t.Fatal("Expected error for handshake from another identity")
+	}
+}
+
+// TestSessionRekey проверяет, что после смены ключей старые ключи не
+// расшифровывают новый трафик и удаляются
+func TestSessionRekey(t *testing.T) {
+	const rekeyMessages = 3
+	a, b := newSessionPair(t, rekeyMessages)
+	handshake(t, a, b)
+
+	oldA := *a.cur
+	oldB := *b.cur
+	oldFrame, _, err := a.seal([]byte("epoch 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, a, b, oldFrame)
+	// Неупорядоченный канал доставит его уже после rekey
+	inFlight, _, err := a.seal([]byte("in flight"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range rekeyMessages {
+		send(t, a, b, []byte("message"))
+	}
+	if a.sendEpoch != 2 || b.sendEpoch != 2 {
+		t.Fatalf("Expected epoch 2, got %d and %d", a.sendEpoch, b.sendEpoch)
+	}
+	if got := deliver(t, a, b, inFlight); string(got) != "in flight" {
+		t.Fatalf("Expected in-flight message of previous epoch, got %q", got)
+	}
+
+	// Новый трафик в обе стороны не открывается ключами первой эпохи
+	frameA, rekeyA, err := a.seal([]byte("secret from a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameB, _, err := b.seal([]byte("secret from b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openSessionFrame(&oldB, frameA); err == nil {
+		t.Fatal("Old key decrypted traffic of the new epoch")
+	}
+	if _, err := openSessionFrame(&oldA, frameB); err == nil {
+		t.Fatal("Old key decrypted traffic of the new epoch")
+	}
+	if a.cur.send == oldA.send || a.cur.recv == oldA.recv {
+		t.Fatal("Expected new keys after rekey")
+	}
+	deliver(t, a, b, frameA)
+	deliver(t, b, a, frameB)
+	if rekeyA != nil {
+		deliver(t, a, b, rekeyA)
+	}
+
+	// Ключи предыдущей эпохи живут до следующего rekey для сообщений в пути
+	for i := 0; i < rekeyMessages && a.sendEpoch < 3; i++ {
+		send(t, a, b, []byte("message"))
+	}
+	if a.sendEpoch != 3 || b.sendEpoch != 3 {
+		t.Fatalf("Expected epoch 3, got %d and %d", a.sendEpoch, b.sendEpoch)
+	}
+	if _, _, err := b.open(oldFrame); err == nil {
+		t.Fatal("Expected epoch 1 keys to be discarded")
+	}
+	if oldA.send == b.prev.recv || oldA.send == b.cur.recv {
+		t.Fatal("Epoch 1 key still present")
+	}
+}
@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// PeerState - состояние соединения с пиром с точки зрения приложения
+type PeerState uint8
+
+const (
+	PeerStateDisconnected PeerState = iota // соединения нет и попытка не идет
+	PeerStateConnecting                    // идет подключение или ICE restart
+	PeerStateConnected                     // соединение установлено, можно отправлять
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerStateDisconnected:
+		return "disconnected"
+	case PeerStateConnecting:
+		return "connecting"
+	case PeerStateConnected:
+		return "connected"
+	default:
+		return fmt.Sprintf("unknown (%d)", uint8(s))
+	}
+}
+
+// GetPeerState возвращает состояние соединения с пиром. Пир, с которым
+// завершен обмен SDP, но ICE еще не установил соединение, считается
+// подключающимся, как и пир, ждущий answer на наш offer или ключ
+// шифрования в ConnectContext
+func (c *Connector) GetPeerState(peerID router.PeerID) PeerState {
+	if peer, ok := c.GetPeer(peerID); ok {
+		peer.mu.Lock()
+		defer peer.mu.Unlock()
+		if peer.restarting || !(peer.relay || peer.connected) {
+			return PeerStateConnecting
+		}
+		return PeerStateConnected
+	}
+	if _, ok := c.pendingOffers.Load(peerID); ok {
+		return PeerStateConnecting
+	}
+	if _, ok := c.connecting.Load(peerID); ok {
+		return PeerStateConnecting
+	}
+	return PeerStateDisconnected
+}
+
+// GetPeerStateByHex возвращает состояние соединения с пиром по hex ID
+func (c *Connector) GetPeerStateByHex(hexID string) (PeerState, error) {
+	peerID, err := parsePeerID(hexID)
+	if err != nil {
+		return PeerStateDisconnected, err
+	}
+	return c.GetPeerState(peerID), nil
+}
+
+// parsePeerID разбирает hex ID пира
+func parsePeerID(hexID string) (router.PeerID, error) {
+	peerIDBytes, err := hex.DecodeString(hexID)
+	if err != nil {
+		return router.PeerID{}, fmt.Errorf("%w: %v", ErrInvalidIDFormat, err)
+	}
+	if len(peerIDBytes) != router.PeerIDSize {
+		return router.PeerID{}, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidIDFormat, router.PeerIDSize, len(peerIDBytes))
+	}
+	return router.PeerID(peerIDBytes), nil
+}
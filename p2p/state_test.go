@@ -0,0 +1,55 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// TestGetPeerState проверяет состояние пира на каждом этапе подключения
+func TestGetPeerState(t *testing.T) {
+	c := &Connector{done: make(chan struct{}), closed: true}
+	peerID := router.PeerID{1}
+	hexID := hex.EncodeToString(peerID[:])
+
+	if state := c.GetPeerState(peerID); state != PeerStateDisconnected {
+		t.Fatalf("Expected disconnected, got %v", state)
+	}
+
+	// ConnectContext ждет ключ, затем answer на offer
+	c.connecting.Store(peerID, newConnectWaiter())
+	if state := c.GetPeerState(peerID); state != PeerStateConnecting {
+		t.Fatalf("Expected connecting while waiting for the key, got %v", state)
+	}
+	if _, err := c.GetPeerByHex(hexID); !errors.Is(err, ErrConnectInProgress) {
+		t.Fatalf("Expected ErrConnectInProgress, got %v", err)
+	}
+	c.connecting.Delete(peerID)
+	c.pendingOffers.Store(peerID, make(chan []byte, 1))
+	if state := c.GetPeerState(peerID); state != PeerStateConnecting {
+		t.Fatalf("Expected connecting while waiting for the answer, got %v", state)
+	}
+	c.pendingOffers.Delete(peerID)
+
+	// Обмен SDP завершен, ICE еще проверяет кандидатов
+	peer := &Peer{ID: peerID}
+	c.peers.Store(peerID, peer)
+	if state := c.GetPeerState(peerID); state != PeerStateConnecting {
+		t.Fatalf("Expected connecting before ICE connects, got %v", state)
+	}
+
+	peer.connected = true
+	if state, err := c.GetPeerStateByHex(hexID); err != nil || state != PeerStateConnected {
+		t.Fatalf("Expected connected, got %v, %v", state, err)
+	}
+	peer.restarting = true
+	if state := c.GetPeerState(peerID); state != PeerStateConnecting {
+		t.Fatalf("Expected connecting during ICE restart, got %v", state)
+	}
+
+	if _, err := c.GetPeerStateByHex("abc"); !errors.Is(err, ErrInvalidIDFormat) {
+		t.Fatalf("Expected ErrInvalidIDFormat, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// PeerStats - статистика соединения с пиром
+type PeerStats struct {
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+	RTT             time.Duration // 0, если еще не измерен или соединение через relay
+	State           webrtc.PeerConnectionState
+	Relayed         bool
+
+	// Типы выбранной пары ICE кандидатов (host, srflx, prflx, relay).
+	// ICECandidateTypeUnknown, если пара не выбрана или соединение через relay
+	LocalCandidateType  webrtc.ICECandidateType
+	RemoteCandidateType webrtc.ICECandidateType
+
+	// BufferedAmount - данные в очередях отправки всех DataChannel'ов
+	BufferedAmount uint64
+}
+
+// relayCounters считает трафик relay-пира: у него нет PeerConnection со статистикой
+type relayCounters struct {
+	bytesSent       atomic.Uint64
+	bytesReceived   atomic.Uint64
+	packetsSent     atomic.Uint64
+	packetsReceived atomic.Uint64
+}
+
+// GetStats возвращает статистику всех активных пиров. Для WebRTC счетчики
+// и RTT берутся из номинированной пары ICE кандидатов
+func (c *Connector) GetStats() map[router.PeerID]PeerStats {
+	stats := make(map[router.PeerID]PeerStats)
+	c.peers.Range(func(key, value any) bool {
+		stats[key.(router.PeerID)] = value.(*Peer).Stats()
+		return true
+	})
+	return stats
+}
+
+// Stats возвращает статистику соединения с пиром
+func (p *Peer) Stats() PeerStats {
+	if p.relay {
+		return PeerStats{
+			BytesSent:       p.relayStats.bytesSent.Load(),
+			BytesReceived:   p.relayStats.bytesReceived.Load(),
+			PacketsSent:     p.relayStats.packetsSent.Load(),
+			PacketsReceived: p.relayStats.packetsReceived.Load(),
+			State:           webrtc.PeerConnectionStateConnected,
+			Relayed:         true,
+		}
+	}
+
+	stats := PeerStats{State: p.conn.ConnectionState()}
+	var sctp webrtc.SCTPTransportStats
+	var messagesSent, messagesReceived uint64
+	for _, s := range p.conn.GetStats() {
+		switch s := s.(type) {
+		case webrtc.ICECandidatePairStats:
+			if !s.Nominated {
+				continue
+			}
+			stats.BytesSent = s.BytesSent
+			stats.BytesReceived = s.BytesReceived
+			stats.PacketsSent = uint64(s.PacketsSent)
+			stats.PacketsReceived = uint64(s.PacketsReceived)
+			stats.RTT = time.Duration(s.CurrentRoundTripTime * float64(time.Second))
+		case webrtc.SCTPTransportStats:
+			sctp = s
+		case webrtc.DataChannelStats:
+			messagesSent += uint64(s.MessagesSent)
+			messagesReceived += uint64(s.MessagesReceived)
+		}
+	}
+
+	// pion/ice пока не считает трафик пары кандидатов, берем его у SCTP
+	// транспорта и DataChannel'ов (пакеты = сообщения DataChannel)
+	if stats.BytesSent == 0 && stats.BytesReceived == 0 {
+		stats.BytesSent = sctp.BytesSent
+		stats.BytesReceived = sctp.BytesReceived
+	}
+	if stats.PacketsSent == 0 && stats.PacketsReceived == 0 {
+		stats.PacketsSent = messagesSent
+		stats.PacketsReceived = messagesReceived
+	}
+
+	if pair := p.selectedCandidatePair(); pair != nil {
+		stats.LocalCandidateType = pair.Local.Typ
+		stats.RemoteCandidateType = pair.Remote.Typ
+	}
+
+	p.mu.Lock()
+	for _, dc := range p.dataChannels {
+		stats.BufferedAmount += dc.BufferedAmount()
+	}
+	p.mu.Unlock()
+	return stats
+}
+
+// selectedCandidatePair возвращает выбранную пару ICE кандидатов или nil
+func (p *Peer) selectedCandidatePair() *webrtc.ICECandidatePair {
+	sctp := p.conn.SCTP()
+	if sctp == nil || sctp.Transport() == nil {
+		return nil
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil {
+		return nil
+	}
+	return pair
+}
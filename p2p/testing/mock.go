@@ -0,0 +1,297 @@
+// Package p2ptest provides a fake p2p.Connector for testing code built on
+// top of it without a WebRTC stack or a router
+package p2ptest
+
+import (
+	"context"
+	"maps"
+	"sync"
+
+	"github.com/udisondev/sendy/p2p"
+	"github.com/udisondev/sendy/router"
+)
+
+// Call is a recorded method call of MockConnector
+type Call struct {
+	Method string
+	Args   []any
+}
+
+// MockConnector records calls and delivers events injected by the test.
+// Peers returned by GetPeer are registered with SetPeer
+type MockConnector struct {
+	// ID is returned by LocalID
+	ID router.PeerID
+	// EncKey is returned by EncryptionKey
+	EncKey p2p.Curve25519PublicKey
+
+	// Errors returned by ConnectContext, WaitForPeer and Disconnect
+	ConnectErr    error
+	WaitErr       error
+	DisconnectErr error
+	// SendErrs are returned by SendAll for the listed peers
+	SendErrs map[router.PeerID]error
+
+	mu        sync.Mutex
+	calls     []Call
+	peers     map[router.PeerID]*p2p.Peer
+	stats     map[router.PeerID]p2p.PeerStats
+	peerKeys  map[router.PeerID]p2p.Curve25519PublicKey
+	blacklist map[router.PeerID]struct{}
+	policy    p2p.ConnectionPolicy
+	peerSet   chan struct{} // closed and replaced by SetPeer, wakes WaitForPeer
+
+	events    chan p2p.Event
+	closeOnce sync.Once
+}
+
+// NewMockConnector creates a mock with a buffered events channel
+func NewMockConnector() *MockConnector {
+	return &MockConnector{
+		peers:     make(map[router.PeerID]*p2p.Peer),
+		stats:     make(map[router.PeerID]p2p.PeerStats),
+		peerKeys:  make(map[router.PeerID]p2p.Curve25519PublicKey),
+		blacklist: make(map[router.PeerID]struct{}),
+		peerSet:   make(chan struct{}),
+		events:    make(chan p2p.Event, 100),
+	}
+}
+
+// Inject returns the channel behind Events. Sending to it delivers a fake
+// event to the code under test
+func (m *MockConnector) Inject() chan<- p2p.Event {
+	return m.events
+}
+
+// SetPeer makes GetPeer and GetActivePeers report the peer as connected
+func (m *MockConnector) SetPeer(peer *p2p.Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peers[peer.ID] = peer
+	close(m.peerSet)
+	m.peerSet = make(chan struct{})
+}
+
+// SetStats sets the statistics returned by GetStats for the peer
+func (m *MockConnector) SetStats(peerID router.PeerID, stats p2p.PeerStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats[peerID] = stats
+}
+
+// SetPeerKey sets the encryption key returned by PeerEncryptionKey
+func (m *MockConnector) SetPeerKey(peerID router.PeerID, key p2p.Curve25519PublicKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peerKeys[peerID] = key
+}
+
+// Calls returns all recorded calls in order
+func (m *MockConnector) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// CallsTo returns recorded calls of the method
+func (m *MockConnector) CallsTo(method string) []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var calls []Call
+	for _, call := range m.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func (m *MockConnector) record(method string, args ...any) {
+	m.calls = append(m.calls, Call{Method: method, Args: args})
+}
+
+func (m *MockConnector) LocalID() router.PeerID {
+	return m.ID
+}
+
+func (m *MockConnector) EncryptionKey() *p2p.Curve25519PublicKey {
+	return &m.EncKey
+}
+
+func (m *MockConnector) PeerEncryptionKey(peerID router.PeerID) (*p2p.Curve25519PublicKey, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.peerKeys[peerID]
+	return &key, ok
+}
+
+// ConnectContext delivers ConnectErr if it is set. Otherwise the result
+// channel stays empty, the outcome is reported by injected events
+func (m *MockConnector) ConnectContext(ctx context.Context, hexID string) <-chan error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("ConnectContext", hexID)
+	result := make(chan error, 1)
+	if m.ConnectErr != nil {
+		result <- m.ConnectErr
+	}
+	return result
+}
+
+// WaitForPeer returns WaitErr if it is set. Otherwise it returns the peer
+// set with SetPeer, waiting for SetPeer until ctx is done
+func (m *MockConnector) WaitForPeer(ctx context.Context, peerID router.PeerID) (*p2p.Peer, error) {
+	m.mu.Lock()
+	m.record("WaitForPeer", peerID)
+	m.mu.Unlock()
+	for {
+		m.mu.Lock()
+		peer, ok := m.peers[peerID]
+		waitErr, peerSet := m.WaitErr, m.peerSet
+		m.mu.Unlock()
+		if waitErr != nil {
+			return nil, waitErr
+		}
+		if ok {
+			return peer, nil
+		}
+		select {
+		case <-peerSet:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Disconnect removes the peer set with SetPeer
+func (m *MockConnector) Disconnect(peerID router.PeerID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Disconnect", peerID)
+	if m.DisconnectErr != nil {
+		return m.DisconnectErr
+	}
+	delete(m.peers, peerID)
+	return nil
+}
+
+func (m *MockConnector) DisconnectAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("DisconnectAll")
+	clear(m.peers)
+}
+
+func (m *MockConnector) GetPeer(peerID router.PeerID) (*p2p.Peer, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("GetPeer", peerID)
+	peer, ok := m.peers[peerID]
+	return peer, ok
+}
+
+// GetPeerState reports peers registered with SetPeer as connected
+func (m *MockConnector) GetPeerState(peerID router.PeerID) p2p.PeerState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("GetPeerState", peerID)
+	if _, ok := m.peers[peerID]; ok {
+		return p2p.PeerStateConnected
+	}
+	return p2p.PeerStateDisconnected
+}
+
+func (m *MockConnector) GetActivePeers() []router.PeerID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("GetActivePeers")
+	peers := make([]router.PeerID, 0, len(m.peers))
+	for id := range m.peers {
+		peers = append(peers, id)
+	}
+	return peers
+}
+
+// SendAll reports every peer registered with SetPeer as sent, except those
+// listed in SendErrs
+func (m *MockConnector) SendAll(data []byte) map[router.PeerID]error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("SendAll", data)
+	failures := make(map[router.PeerID]error)
+	for id := range m.peers {
+		if err, ok := m.SendErrs[id]; ok {
+			failures[id] = err
+		}
+	}
+	return failures
+}
+
+func (m *MockConnector) GetStats() map[router.PeerID]p2p.PeerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("GetStats")
+	return maps.Clone(m.stats)
+}
+
+func (m *MockConnector) AddToBlacklist(peerID router.PeerID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("AddToBlacklist", peerID)
+	m.blacklist[peerID] = struct{}{}
+}
+
+func (m *MockConnector) RemoveFromBlacklist(peerID router.PeerID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("RemoveFromBlacklist", peerID)
+	delete(m.blacklist, peerID)
+}
+
+func (m *MockConnector) IsBlacklisted(peerID router.PeerID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("IsBlacklisted", peerID)
+	_, ok := m.blacklist[peerID]
+	return ok
+}
+
+func (m *MockConnector) SetConnectionPolicy(policy p2p.ConnectionPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("SetConnectionPolicy", policy.Mode)
+	m.policy = policy
+}
+
+// Policy returns the policy set with SetConnectionPolicy
+func (m *MockConnector) Policy() p2p.ConnectionPolicy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.policy
+}
+
+func (m *MockConnector) Approve(peerID router.PeerID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Approve", peerID)
+}
+
+func (m *MockConnector) Reject(peerID router.PeerID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Reject", peerID)
+}
+
+func (m *MockConnector) Events() <-chan p2p.Event {
+	return m.events
+}
+
+// Close closes the events channel like p2p.Connector.Close. Events must not
+// be injected after Close
+func (m *MockConnector) Close() error {
+	m.mu.Lock()
+	m.record("Close")
+	m.mu.Unlock()
+	m.closeOnce.Do(func() { close(m.events) })
+	return nil
+}
@@ -0,0 +1,192 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/udisondev/sendy/router"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Trickle ICE: offer и answer отправляются сразу после SetLocalDescription,
+// без ожидания сбора кандидатов. Каждый кандидат уходит отдельным сигнальным
+// сообщением в том же конверте, что и SDP: подписанный EncryptedMessage
+// (см. envelope.go).
+//
+// Кандидаты копятся с обеих сторон:
+//   - локальные - пока router не подтвердил доставку offer/answer, иначе
+//     они обгонят SDP
+//   - удаленные - пока не установлен remote description, до него
+//     AddICECandidate возвращает ошибку
+
+// candidateFrameType отличает кадры кандидатов от SDP в handleIncoming
+const candidateFrameType = "candidate"
+
+// maxPendingCandidates ограничивает очередь удаленных кандидатов до
+// установки remote description, лишние отбрасываются
+const maxPendingCandidates = 64
+
+// candidateFrame - ICE кандидат, отправленный через router
+type candidateFrame struct {
+	Type      string                  `json:"type"` // всегда candidateFrameType
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
+}
+
+// parseCandidateFrame возвращает кандидата, если расшифрованный payload - кадр кандидата, а не SDP
+func parseCandidateFrame(payload []byte) (webrtc.ICECandidateInit, bool) {
+	var frame candidateFrame
+	if err := json.Unmarshal(payload, &frame); err != nil || frame.Type != candidateFrameType {
+		return webrtc.ICECandidateInit{}, false
+	}
+	return frame.Candidate, true
+}
+
+// iceTrickle - очереди кандидатов одного PeerConnection
+type iceTrickle struct {
+	mu sync.Mutex
+
+	sdpSent bool // offer/answer доставлен, локальные кандидаты отправляются сразу
+	local   []webrtc.ICECandidateInit
+
+	conn   *webrtc.PeerConnection // nil до установки remote description
+	remote []webrtc.ICECandidateInit
+}
+
+// newTrickle регистрирует очередь удаленных кандидатов пира. Предыдущая
+// очередь пира заменяется: кандидаты относятся к последнему offer
+func (c *Connector) newTrickle(peerID router.PeerID) *iceTrickle {
+	t := &iceTrickle{}
+	c.trickles.Store(peerID, t)
+	return t
+}
+
+// stopTrickle удаляет очередь пира, если ее еще не заменило новое соединение
+func (c *Connector) stopTrickle(peerID router.PeerID, t *iceTrickle) {
+	c.trickles.CompareAndDelete(peerID, t)
+}
+
+// trickleLocal отправляет локальные кандидаты пиру по мере их сбора.
+// Вызывается до SetLocalDescription, с которого начинается сбор
+func (c *Connector) trickleLocal(peer *Peer, peerConn *webrtc.PeerConnection) {
+	t := peer.trickle
+	peerConn.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return // сбор завершен
+		}
+		init := candidate.ToJSON()
+
+		t.mu.Lock()
+		if !t.sdpSent {
+			t.local = append(t.local, init)
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-c.done:
+		default:
+			c.spawn(func() { c.sendCandidate(peer.ID, init) })
+		}
+	})
+}
+
+// flushLocalCandidates отправляет накопленные кандидаты после доставки
+// offer/answer, следующие кандидаты уходят сразу
+func (c *Connector) flushLocalCandidates(peer *Peer) {
+	t := peer.trickle
+	t.mu.Lock()
+	t.sdpSent = true
+	pending := t.local
+	t.local = nil
+	t.mu.Unlock()
+
+	for _, init := range pending {
+		c.spawn(func() { c.sendCandidate(peer.ID, init) })
+	}
+}
+
+// sendCandidate отправляет кандидата через router. Потерянный кандидат не
+// ошибка соединения: ICE может сойтись по остальным
+func (c *Connector) sendCandidate(peerID router.PeerID, init webrtc.ICECandidateInit) {
+	frameJSON, err := json.Marshal(candidateFrame{Type: candidateFrameType, Candidate: init})
+	if err != nil {
+		slog.Error("Failed to marshal ICE candidate", "error", err)
+		return
+	}
+	if err := c.sendSignal(peerID, frameJSON); err != nil {
+		slog.Warn("Failed to send ICE candidate",
+			"peerID", hex.EncodeToString(peerID[:8])+"...",
+			"error", err)
+		return
+	}
+	slog.Debug("Sent ICE candidate",
+		"peerID", hex.EncodeToString(peerID[:8])+"...",
+		"candidate", init.Candidate)
+}
+
+// reset начинает новое поколение кандидатов после ICE restart: локальные
+// снова копятся до доставки SDP, удаленные - до нового remote description
+func (t *iceTrickle) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sdpSent = false
+	t.local = nil
+	t.conn = nil
+	t.remote = nil
+}
+
+// setRemoteDescription устанавливает remote description и добавляет
+// накопленные удаленные кандидаты. Под mu, чтобы addRemote не проскочил между ними
+func (t *iceTrickle) setRemoteDescription(conn *webrtc.PeerConnection, desc webrtc.SessionDescription) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := conn.SetRemoteDescription(desc); err != nil {
+		return err
+	}
+	t.conn = conn
+	for _, init := range t.remote {
+		if err := conn.AddICECandidate(init); err != nil {
+			slog.Warn("Failed to add ICE candidate", "candidate", init.Candidate, "error", err)
+		}
+	}
+	t.remote = nil
+	return nil
+}
+
+// addRemote добавляет удаленного кандидата или откладывает его до remote description
+func (t *iceTrickle) addRemote(init webrtc.ICECandidateInit) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil {
+		return t.conn.AddICECandidate(init)
+	}
+	if len(t.remote) >= maxPendingCandidates {
+		return fmt.Errorf("too many pending ICE candidates")
+	}
+	t.remote = append(t.remote, init)
+	return nil
+}
+
+// handleRemoteCandidate обрабатывает кандидата, полученного через router
+func (c *Connector) handleRemoteCandidate(peerID router.PeerID, init webrtc.ICECandidateInit) {
+	hexID := hex.EncodeToString(peerID[:8])
+
+	val, ok := c.trickles.Load(peerID)
+	if !ok {
+		slog.Debug("Dropping ICE candidate without connection attempt", "peerID", hexID+"...")
+		return
+	}
+	if err := val.(*iceTrickle).addRemote(init); err != nil {
+		slog.Warn("Failed to add ICE candidate", "peerID", hexID+"...", "error", err)
+		return
+	}
+	slog.Debug("Received ICE candidate", "peerID", hexID+"...", "candidate", init.Candidate)
+}
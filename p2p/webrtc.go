@@ -5,7 +5,8 @@
 //  1. Connector управляет всеми WebRTC соединениями и использует router.Client для сигнализации
 //     (обмен SDP offer/answer между пирами)
 //
-// 2. Connector.Connect(hexID) инициирует подключение к удаленному пиру (асинхронно):
+// 2. Connector.Connect(hexID) инициирует подключение к удаленному пиру (асинхронно),
+// ConnectContext(ctx, hexID) дополнительно возвращает канал с результатом (см. connect.go):
 //   - Создает WebRTC PeerConnection
 //   - Генерирует SDP offer
 //   - Отправляет offer через router
@@ -16,24 +17,33 @@
 //   - SDP offers от других пиров (входящие подключения)
 //   - SDP answers на наши offers (ответы на исходящие подключения)
 //   - Разрешает коллизии при одновременном подключении (perfect negotiation)
+//   - Списки пиров router'а: подключается к появившимся пирам, которых
+//     выбрал ConnectorConfig.AutoConnect
 //
 // 4. События отправляются через канал Events():
 //
 //   - EventConnected - соединение установлено
 //
+//   - EventConnectedRelay - WebRTC не удалось, данные идут через router (см. relay.go)
+//
+//   - EventReconnecting - соединение прервалось, идет ICE restart (см. restart.go).
+//     При успехе снова приходит EventConnected, иначе EventDisconnected
+//
 //   - EventDisconnected - соединение разорвано
 //
 //   - EventConnectionFailed - не удалось установить соединение
 //
 //   - EventDataReceived - получены данные от пира
 //
-//   - EventError - ошибка на существующем соединении
+//   - EventError - ошибка на существующем соединении, с пустым PeerID -
+//     потеря соединения с router (ErrRouterDisconnected)
 //
 //     5. После установки соединения данные передаются напрямую через WebRTC DataChannel,
 //     без участия router сервера (P2P)
 package p2p
 
 import (
+	"cmp"
 	"context"
 	"crypto/ed25519"
 	"encoding/hex"
@@ -42,21 +52,29 @@ import (
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/udisondev/sendy/router"
 
+	"github.com/pion/transport/v3"
 	"github.com/pion/webrtc/v4"
 )
 
 var ErrInvalidIDFormat = errors.New("invalid id format")
 var ErrConnectionTimeout = errors.New("connection timeout")
 var ErrDecryptionFailed = errors.New("decryption failed")
+var ErrMaxPeersReached = errors.New("max peers reached")
+var ErrConnectorClosed = errors.New("connector closed")
+var ErrChannelNotFound = errors.New("data channel not found")
+var ErrPeerNotFound = errors.New("peer is not connected to router")
+var ErrRouterDisconnected = errors.New("lost connection to router")
 
 // EncryptedMessage представляет зашифрованное сообщение с ключом отправителя
 type EncryptedMessage struct {
-	SenderEncPubKey [32]byte `json:"sender_enc_pubkey"` // Curve25519 публичный ключ отправителя
-	EncryptedData   []byte   `json:"encrypted_data"`    // Зашифрованный payload
+	SenderEncPubKey [32]byte `json:"sender_enc_pubkey"`        // Curve25519 публичный ключ отправителя
+	EncryptedData   []byte   `json:"encrypted_data"`           // Зашифрованный payload
+	SignalVersion   byte     `json:"signal_version,omitempty"` // Версия бинарного конверта, которую понимает отправитель (см. envelope.go)
 }
 
 // EventType определяет тип события
@@ -68,26 +86,58 @@ const (
 	EventConnectionFailed
 	EventError
 	EventDataReceived
+	EventConnectedRelay
+	EventReconnecting
+	EventConnectionRequest // входящее соединение ждет Approve или Reject (см. policy.go)
+
+	// Информационные события о ходе соединения, для индикации в UI и
+	// отладки NAT. Их можно не обрабатывать: результат соединения по-прежнему
+	// сообщают EventConnected, EventDisconnected и EventConnectionFailed.
+	// При переполнении очереди событий они отбрасываются (см. events.go)
+	EventConnectionStateChanged // новое состояние PeerConnection в ConnectionState
+	EventICEStateChanged        // новое состояние ICE в ICEState
+
+	EventPeerDiscovered // в локальной сети найден пир sendy (см. discovery.go)
 )
 
 // Event представляет событие от Connector
 type Event struct {
-	Type   EventType
-	PeerID router.PeerID
-	Peer   *Peer
-	Data   []byte
-	Error  error
+	Type    EventType
+	PeerID  router.PeerID
+	Peer    *Peer
+	Data    []byte
+	Channel string // метка DataChannel, по которому пришли данные EventDataReceived
+	Error   error
+
+	ConnectionState webrtc.PeerConnectionState // EventConnectionStateChanged
+	ICEState        webrtc.ICEConnectionState  // EventICEStateChanged
+
+	// Reason - причина EventDisconnected, которую сообщил пир. Пустая, если
+	// соединение оборвалось или его закрыли мы (см. bye.go)
+	Reason DisconnectReason
 }
 
 // Connector управляет WebRTC соединениями
 type Connector struct {
 	cli           *router.Client
+	api           *webrtc.API
 	config        webrtc.Configuration
 	events        chan Event
 	peers         sync.Map // map[router.PeerID]*Peer
-	pendingOffers sync.Map // map[router.PeerID]chan router.ServerMessage
+	pendingOffers sync.Map // map[router.PeerID]chan []byte - расшифрованный answer на наш offer
 	blacklist     sync.Map // map[router.PeerID]struct{}
 	peerEncKeys   sync.Map // map[router.PeerID]*Curve25519PublicKey - encryption keys received from peers
+	peerKeyReady  sync.Map // map[router.PeerID]*keyWaiter - сигнал о получении ключа пира
+	binarySignal  sync.Map // map[router.PeerID]struct{} - пиры, понимающие бинарный конверт (см. envelope.go)
+	trickles      sync.Map // map[router.PeerID]*iceTrickle - очереди ICE кандидатов текущей попытки соединения
+	connecting    sync.Map // map[router.PeerID]*connectWaiter - попытки ConnectContext, ждущие результата
+	peerWaiters   sync.Map // map[router.PeerID]*peerWaiter - ожидания WaitForPeer
+
+	// События, ждущие отправки в events (см. events.go)
+	queue eventQueue
+
+	// Поиск пиров в локальной сети, nil если выключен (см. discovery.go)
+	local *localDiscovery
 
 	// Ключи шифрования (выведены из Ed25519)
 	encPubKey  *Curve25519PublicKey
@@ -96,6 +146,47 @@ type Connector struct {
 
 	// SECURITY: Rate limiting для защиты от DoS
 	offerCount sync.Map // map[router.PeerID]*offerCounter
+	offerPeers peerLRU  // пиры со счетчиками offer'ов (см. expire.go)
+	keyPeers   peerLRU  // пиры с ключами, соединение с которыми не установлено
+
+	// Зашифрованные и расшифрованные сообщения: сигнализация, relay и DataChannel
+	messagesEncrypted atomic.Uint64
+	messagesDecrypted atomic.Uint64
+
+	dataChannels     []DataChannelConfig
+	relayFallback    bool
+	autoConnect      func(router.PeerID) bool
+	blacklistChanged func(router.PeerID, bool)
+	rekeyMessages    int
+	rekeyInterval    time.Duration
+
+	maxBufferedAmount    uint64
+	iceConnectionTimeout time.Duration
+	keyExchangeTimeout   time.Duration
+	maxOffersPerMinute   int
+
+	// Обработчики RPC запросов пиров по методу (см. rpc.go)
+	rpcMu       sync.RWMutex
+	rpcHandlers map[string]RPCHandler
+
+	// Политика входящих соединений (см. policy.go)
+	policyMu   sync.RWMutex
+	policy     ConnectionPolicy
+	approved   sync.Map // map[router.PeerID]struct{} - пиры, одобренные Approve
+	requestsMu sync.Mutex
+	requests   map[router.PeerID]*connectionRequest // offer'ы, ждущие решения
+
+	// SECURITY: Ограничение числа одновременных соединений
+	maxPeers    int
+	peerSlotsMu sync.Mutex
+	peerSlots   map[router.PeerID]int // попытки подключения в процессе
+
+	// Завершение работы
+	done      chan struct{}
+	wg        sync.WaitGroup // фоновые горутины коннектора
+	closeOnce sync.Once
+	eventsMu  sync.RWMutex // защищает closed
+	closed    bool
 }
 
 // offerCounter отслеживает количество offer'ов от пира для rate limiting
@@ -105,27 +196,169 @@ type offerCounter struct {
 	mu         sync.Mutex
 }
 
-const (
-	maxOffersPerMinute = 10 // Максимум 10 offer'ов в минуту от одного пира
-)
+// maxSendAllWorkers - сколько отправок SendAll выполняется одновременно
+const maxSendAllWorkers = 16
 
 // Peer представляет WebRTC соединение с удаленным пиром
 type Peer struct {
-	ID          router.PeerID
-	conn        *webrtc.PeerConnection
-	dataChannel *webrtc.DataChannel
-	connector   *Connector
-	mu          sync.Mutex
+	ID           router.PeerID
+	conn         *webrtc.PeerConnection
+	dataChannels map[string]*webrtc.DataChannel // по Label
+	connector    *Connector
+	mu           sync.Mutex
+
+	relay      bool // данные идут через router, conn == nil
+	initiator  bool // мы отправили offer
+	connected  bool // WebRTC соединение хотя бы раз установилось
+	negotiated bool // обмен SDP завершен, пир добавлен в peers
+	superseded bool // заменен relay-пиром или пир попрощался, закрытие не порождает EventDisconnected
+
+	trickle *iceTrickle // nil у relay-пира
+	session *session    // сеансовые ключи, nil у relay-пира прежней версии
+	sendSeq uint64      // номер последнего отправленного сообщения, под mu (см. replay.go)
+	recvSeq replayWindow
+
+	nextMessageID atomic.Uint32 // ID последнего фрагментированного сообщения (см. fragment.go)
+	reassembly    reassembler
+
+	rpc rpcCalls // запросы RPC в обе стороны (см. rpc.go)
+
+	restarting  bool          // идет ICE restart, см. restart.go
+	reconnected chan struct{} // закрывается, когда restart восстановил соединение
+	negotiation sync.Mutex    // сериализует смену local/remote description при restart
+
+	relayStats  relayCounters
+	relayLegacy atomic.Bool // relay-пир не ответил на handshake сеанса
+
+	bufferMu  sync.Mutex
+	bufferLow chan struct{} // закрывается, когда буфер DataChannel освободился
 }
 
+// Метки стандартных DataChannel
+const (
+	DataChannelLabel = "data" // Упорядоченный канал для сообщений чата и управления
+	BulkChannelLabel = "bulk" // Канал для крупных данных (чанки файлов)
+)
+
+// DataChannelPriority - приоритет DataChannel относительно других каналов пира
+type DataChannelPriority uint8
+
+const (
+	PriorityVeryLow DataChannelPriority = iota
+	PriorityLow
+	PriorityMedium
+	PriorityHigh
+)
+
+// DataChannelConfig описывает DataChannel, который создается для каждого пира
+// Для данных, которым задержка важнее доставки (presence, голос), подходит
+// канал с Ordered: false и MaxRetransmits: 0 - сообщения могут теряться и
+// приходить не по порядку, зато не ждут повторной отправки предыдущих
+type DataChannelConfig struct {
+	Label          string
+	Ordered        bool
+	MaxRetransmits *uint16 // nil = надежная доставка
+	// Priority пока не передается в SCTP: pion/webrtc v4 не позволяет
+	// задать приоритет канала, все каналы получают обычный приоритет
+	Priority DataChannelPriority
+}
+
+// DefaultDataChannels возвращает каналы по умолчанию: "data" для сообщений
+// чата и управления и "bulk" для файлов. Оба упорядоченные: SCTP в pion
+// отправляет неупорядоченные данные раньше любых упорядоченных, и
+// неупорядоченный "bulk" во время передачи файла задерживал бы сообщения
+// чата до ее конца. В одной очереди сообщение ждет не больше
+// maxBufferedAmount данных файла (см. backpressure.go)
+func DefaultDataChannels() []DataChannelConfig {
+	return []DataChannelConfig{
+		{Label: DataChannelLabel, Ordered: true, Priority: PriorityHigh},
+		{Label: BulkChannelLabel, Ordered: true, Priority: PriorityLow},
+	}
+}
+
+const (
+	// DefaultICEGatheringTimeout - ожидание ответа STUN сервера при сборе кандидатов
+	DefaultICEGatheringTimeout = 5 * time.Second
+	// DefaultICEConnectionTimeout - ожидание answer на offer
+	DefaultICEConnectionTimeout = 30 * time.Second
+	// DefaultKeyExchangeTimeout - ожидание ключа пира после KEY_EXCHANGE
+	DefaultKeyExchangeTimeout = 5 * time.Second
+	// DefaultMaxOffersPerMinute - сколько offer'ов в минуту принимается от
+	// одного пира
+	DefaultMaxOffersPerMinute = 10
+	// DefaultEventBufferSize - сколько событий ждут чтения из Events
+	DefaultEventBufferSize = 100
+)
+
 // ConnectorConfig конфигурация для Connector
 type ConnectorConfig struct {
 	STUNServers []string
+	TURNServers []TURNServer
+	MaxPeers    int // Максимум одновременных соединений (0 = без ограничений)
+	// DataChannels создаются инициатором соединения. Пусто = DefaultDataChannels,
+	// канал DataChannelLabel обязателен
+	DataChannels []DataChannelConfig
+	// RelayFallback - если ICE не смог соединить пиров, инициатор переходит
+	// на relay через router. Входящие relay-соединения принимаются всегда
+	RelayFallback bool
+	// AutoConnect выбирает пиров из списка router'а (router.Client.PeerListUpdates),
+	// к которым коннектор подключается сам, как только они появились в сети.
+	// nil = не подключаться
+	AutoConnect func(router.PeerID) bool
+	// RekeyMessages и RekeyInterval - после скольких отправленных сообщений
+	// или какого времени сменяются сеансовые ключи DataChannel и relay (см.
+	// session.go). 0 = DefaultRekeyMessages и DefaultRekeyInterval.
+	// Отдельного интервала ротации для relay нет: сессия relay та же, что у
+	// DataChannel, и 10 минут по умолчанию строже часа
+	RekeyMessages int
+	RekeyInterval time.Duration
+	// MaxBufferedAmount - сколько байт может ждать отправки в одном
+	// DataChannel, дальше Send блокируется (см. backpressure.go).
+	// 0 = DefaultMaxBufferedAmount
+	MaxBufferedAmount uint64
+	// ICEGatheringTimeout - сколько ждать ответа STUN серверов при сборе
+	// кандидатов. Кандидаты отправляются пиру по мере сбора (trickle ICE),
+	// таймаут ограничивает только опрос STUN. С внешними STUN серверами
+	// меньше 2s не рекомендуется: ответ может не успеть прийти, и пир за
+	// NAT останется без server reflexive кандидата. 0 = DefaultICEGatheringTimeout
+	ICEGatheringTimeout time.Duration
+	// ICEConnectionTimeout - сколько инициатор ждет answer на свой offer.
+	// 0 = DefaultICEConnectionTimeout
+	ICEConnectionTimeout time.Duration
+	// KeyExchangeTimeout - сколько ждать ключ шифрования пира после
+	// отправки KEY_EXCHANGE. На медленных каналах стоит увеличить.
+	// 0 = DefaultKeyExchangeTimeout
+	KeyExchangeTimeout time.Duration
+	// MaxOffersPerMinute - сколько offer'ов (в том числе ICE restart и
+	// relay) в минуту принимается от одного пира, остальные отбрасываются.
+	// 0 = DefaultMaxOffersPerMinute
+	MaxOffersPerMinute int
+	// EventBufferSize - емкость канала Events и сколько еще полученных
+	// сообщений может ждать его во внутренней очереди. Дальше прием данных
+	// ждет читателя, остальные события копятся в очереди (см. events.go).
+	// 0 = DefaultEventBufferSize, а не отбрасывание при переполнении:
+	// полученные сообщения не теряются, а остальные события emit и так не
+	// ждет. Очередь данных меняется на ходу через SetEventBufferSize
+	EventBufferSize int
+	// Blacklist - пиры, заблокированные с прошлого запуска
+	Blacklist []router.PeerID
+	// EnableLocalDiscovery - искать пиров sendy в локальной сети по mDNS и
+	// обмениваться с найденными сигнальными сообщениями напрямую, без
+	// router'а (см. discovery.go)
+	EnableLocalDiscovery bool
+	// BlacklistChanged вызывается, когда AddToBlacklist или
+	// RemoveFromBlacklist меняют черный список (blocked = true - пир
+	// добавлен), чтобы приложение сохранило его. Вызывается синхронно,
+	// не должен блокироваться. nil = не сообщать
+	BlacklistChanged func(peerID router.PeerID, blocked bool)
+
+	// net заменяет сеть ICE, в тестах - виртуальной сетью с потерями (vnet)
+	net transport.Net
 }
 
 // NewConnector creates a new Connector instance
 func NewConnector(cli *router.Client, cfg ConnectorConfig, income <-chan router.ServerMessage, edPrivKey ed25519.PrivateKey) (*Connector, error) {
-	slog.Info("Creating P2P Connector", "stunServers", len(cfg.STUNServers))
+	slog.Info("Creating P2P Connector", "stunServers", len(cfg.STUNServers), "turnServers", len(cfg.TURNServers), "maxPeers", cfg.MaxPeers)
 
 	// Derive encryption keys from Ed25519 keys
 	encPubKey, encPrivKey, err := DeriveEncryptionKeys(edPrivKey)
@@ -135,42 +368,167 @@ func NewConnector(cli *router.Client, cfg ConnectorConfig, income <-chan router.
 	}
 	slog.Info("Derived encryption keys for P2P", "pubKey", hex.EncodeToString(encPubKey[:8])+"...")
 
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	dataChannels := cfg.DataChannels
+	if len(dataChannels) == 0 {
+		dataChannels = DefaultDataChannels()
+	}
+	if err := validateDataChannels(dataChannels); err != nil {
+		return nil, err
+	}
+
+	iceServers, err := buildICEServers(cfg.STUNServers, cfg.TURNServers)
+	if err != nil {
+		return nil, err
+	}
+	logICEServers(iceServers)
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{},
+		ICEServers: iceServers,
 	}
 
-	if len(cfg.STUNServers) > 0 {
-		config.ICEServers = append(config.ICEServers, webrtc.ICEServer{
-			URLs: cfg.STUNServers,
-		})
-		slog.Debug("Configured STUN servers", "urls", cfg.STUNServers)
+	// С trickle ICE проверки связности часто приходят раньше кандидата и
+	// пара получается peer-reflexive. По умолчанию pion ждет секунду перед
+	// номинацией такой пары, для DataChannel это лишняя задержка
+	var settings webrtc.SettingEngine
+	settings.SetPrflxAcceptanceMinWait(0)
+	settings.SetSTUNGatherTimeout(cmp.Or(cfg.ICEGatheringTimeout, DefaultICEGatheringTimeout))
+	if cfg.net != nil {
+		settings.SetNet(cfg.net)
 	}
 
+	eventBufferSize := cmp.Or(cfg.EventBufferSize, DefaultEventBufferSize)
 	c := &Connector{
 		cli:        cli,
+		api:        webrtc.NewAPI(webrtc.WithSettingEngine(settings)),
 		config:     config,
-		events:     make(chan Event, 100),
+		events:     make(chan Event, eventBufferSize),
+		queue:      eventQueue{ready: make(chan struct{}, 1), dataLimit: eventBufferSize},
 		encPubKey:  encPubKey,
 		encPrivKey: encPrivKey,
 		edPrivKey:  edPrivKey,
+		maxPeers:     cfg.MaxPeers,
+		dataChannels: dataChannels,
+		relayFallback: cfg.RelayFallback,
+		autoConnect:   cfg.AutoConnect,
+		blacklistChanged: cfg.BlacklistChanged,
+		rekeyMessages: cfg.RekeyMessages,
+		rekeyInterval: cfg.RekeyInterval,
+		maxBufferedAmount: cmp.Or(cfg.MaxBufferedAmount, DefaultMaxBufferedAmount),
+		iceConnectionTimeout: cmp.Or(cfg.ICEConnectionTimeout, DefaultICEConnectionTimeout),
+		keyExchangeTimeout:   cmp.Or(cfg.KeyExchangeTimeout, DefaultKeyExchangeTimeout),
+		maxOffersPerMinute:   cmp.Or(cfg.MaxOffersPerMinute, DefaultMaxOffersPerMinute),
+		peerSlots:    make(map[router.PeerID]int),
+		done:       make(chan struct{}),
+	}
+	for _, peerID := range cfg.Blacklist {
+		c.blacklist.Store(peerID, struct{}{})
+	}
+	c.Handle(pingMethod, handlePing)
+
+	if cfg.EnableLocalDiscovery {
+		if err := c.startLocalDiscovery(); err != nil {
+			return nil, err
+		}
 	}
 
 	// Start incoming message handler
-	go c.handleIncoming(income)
+	c.spawn(func() { c.handleIncoming(income) })
+	c.spawn(c.handleRouterErrors)
+	c.spawn(c.runJanitor)
+	c.spawn(c.pumpEvents)
 	slog.Debug("Started incoming message handler")
 
 	return c, nil
 }
 
-// Events возвращает канал событий
-func (c *Connector) Events() <-chan Event {
-	return c.events
+// validate проверяет лимиты и таймауты: 0 означает значение по умолчанию,
+// отрицательные значения - ошибка
+func (cfg *ConnectorConfig) validate() error {
+	for name, value := range map[string]time.Duration{
+		"RekeyInterval":        cfg.RekeyInterval,
+		"ICEGatheringTimeout":  cfg.ICEGatheringTimeout,
+		"ICEConnectionTimeout": cfg.ICEConnectionTimeout,
+		"KeyExchangeTimeout":   cfg.KeyExchangeTimeout,
+	} {
+		if value < 0 {
+			return fmt.Errorf("invalid %s: %v", name, value)
+		}
+	}
+	for name, value := range map[string]int{
+		"MaxPeers":           cfg.MaxPeers,
+		"RekeyMessages":      cfg.RekeyMessages,
+		"MaxOffersPerMinute": cfg.MaxOffersPerMinute,
+		"EventBufferSize":    cfg.EventBufferSize,
+	} {
+		if value < 0 {
+			return fmt.Errorf("invalid %s: %d", name, value)
+		}
+	}
+	return nil
+}
+
+// validateDataChannels проверяет, что метки уникальны и есть канал DataChannelLabel
+func validateDataChannels(channels []DataChannelConfig) error {
+	seen := make(map[string]bool, len(channels))
+	for _, ch := range channels {
+		if ch.Label == "" {
+			return fmt.Errorf("data channel label is empty")
+		}
+		if seen[ch.Label] {
+			return fmt.Errorf("duplicate data channel label %q", ch.Label)
+		}
+		seen[ch.Label] = true
+	}
+	if !seen[DataChannelLabel] {
+		return fmt.Errorf("data channel %q is required", DataChannelLabel)
+	}
+	return nil
+}
+
+// spawn запускает фоновую горутину, которую дожидается Close
+func (c *Connector) spawn(f func()) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		f()
+	}()
+}
+
+// Close останавливает обработку входящих сообщений, закрывает все
+// соединения, дожидается фоновых горутин и закрывает канал событий
+func (c *Connector) Close() error {
+	c.closeOnce.Do(func() {
+		slog.Info("Closing P2P Connector")
+		close(c.done)
+		c.disconnectAll(DisconnectShutdown)
+		if c.local != nil {
+			c.local.close()
+		}
+		c.wg.Wait()
+
+		// Попытки, ждущие встречного соединения, больше не завершатся
+		c.connecting.Range(func(key, _ any) bool {
+			c.finishConnect(key.(router.PeerID), ErrConnectorClosed)
+			return true
+		})
+
+		// pumpEvents завершился вместе с остальными горутинами, в events
+		// больше никто не пишет
+		c.eventsMu.Lock()
+		c.closed = true
+		close(c.events)
+		c.eventsMu.Unlock()
+	})
+	return nil
 }
 
 // encryptMessageForPeer шифрует сообщение для конкретного пира
-// Возвращает JSON с envelope (EncryptedMessage)
+// Возвращает envelope (EncryptedMessage), его подписывает signEnvelope
 // SECURITY: ВСЕ сообщения должны быть зашифрованы. Если у нас нет ключа пира - ошибка.
-func (c *Connector) encryptMessageForPeer(peerID router.PeerID, payload []byte) ([]byte, error) {
+func (c *Connector) encryptMessageForPeer(peerID router.PeerID, payload []byte) (*EncryptedMessage, error) {
 	// SECURITY: Проверяем есть ли у нас ключ шифрования этого пира
 	peerEncKeyVal, hasPeerKey := c.peerEncKeys.Load(peerID)
 	if !hasPeerKey {
@@ -188,13 +546,13 @@ func (c *Connector) encryptMessageForPeer(peerID router.PeerID, payload []byte)
 		return nil, fmt.Errorf("encrypt: %w", err)
 	}
 	envelope.EncryptedData = encrypted
+	c.messagesEncrypted.Add(1)
 	slog.Debug("Encrypted message for peer",
 		"peerID", hex.EncodeToString(peerID[:8])+"...",
 		"originalSize", len(payload),
 		"encryptedSize", len(encrypted))
 
-	// Кодируем envelope в JSON
-	return json.Marshal(envelope)
+	return &envelope, nil
 }
 
 // sendKeyExchange отправляет сообщение обмена ключами
@@ -205,21 +563,11 @@ func (c *Connector) sendKeyExchange(peerID router.PeerID) error {
 	// Payload - просто маркер обмена ключами
 	envelope.EncryptedData = []byte("KEY_EXCHANGE_V1")
 
-	envelopeJSON, err := json.Marshal(envelope)
-	if err != nil {
-		return fmt.Errorf("marshal envelope: %w", err)
-	}
-
 	// SECURITY: Подписываем KEY_EXCHANGE нашим Ed25519 приватным ключом
 	// Получатель проверит подпись используя наш PeerID (Ed25519 публичный ключ)
-	signature := SignMessage(envelopeJSON, c.edPrivKey)
-	signedMsg := SignedMessage{
-		Payload:   envelopeJSON,
-		Signature: signature,
-	}
-	signedMsgJSON, err := json.Marshal(signedMsg)
+	signedMsg, err := c.signEnvelope(peerID, &envelope)
 	if err != nil {
-		return fmt.Errorf("marshal signed key exchange: %w", err)
+		return fmt.Errorf("sign key exchange: %w", err)
 	}
 
 	slog.Info("Sending signed key exchange",
@@ -229,26 +577,91 @@ func (c *Connector) sendKeyExchange(peerID router.PeerID) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err = c.cli.Send(ctx, peerID, signedMsgJSON)
+	_, err = c.sendSignaling(ctx, peerID, signedMsg)
 	return err
 }
 
+// signalTimeout - сколько ждать подтверждения доставки сигнального сообщения от router
+const signalTimeout = 10 * time.Second
+
+// sendSignal шифрует, подписывает и отправляет сигнальное сообщение через router.
+// Возвращает ошибку, если router не подтвердил доставку
+func (c *Connector) sendSignal(peerID router.PeerID, payload []byte) error {
+	encrypted, err := c.encryptMessageForPeer(peerID, payload)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+
+	signedMsg, err := c.signEnvelope(peerID, encrypted)
+	if err != nil {
+		return fmt.Errorf("sign message: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), signalTimeout)
+	defer cancel()
+
+	respCh, err := c.sendSignaling(ctx, peerID, signedMsg)
+	if err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+
+	select {
+	case resp, ok := <-respCh:
+		if !ok {
+			return ErrConnectionTimeout
+		}
+		if resp.Type != router.Success {
+			return routerResponseError(resp)
+		}
+		return nil
+	case <-c.done:
+		return ErrConnectorClosed
+	}
+}
+
+// keyWaiter сообщает о получении ключа шифрования пира
+type keyWaiter struct {
+	once  sync.Once
+	ready chan struct{} // закрывается, когда ключ сохранен
+}
+
+func (w *keyWaiter) fire() {
+	w.once.Do(func() { close(w.ready) })
+}
+
+// keyWaiter возвращает общий для всех ожидающих keyWaiter пира. Ключ
+// сохраняется до fire, поэтому ожидание, начатое после сохранения ключа,
+// завершается сразу
+func (c *Connector) keyWaiter(peerID router.PeerID) *keyWaiter {
+	if w, ok := c.peerKeyReady.Load(peerID); ok {
+		return w.(*keyWaiter)
+	}
+	w, _ := c.peerKeyReady.LoadOrStore(peerID, &keyWaiter{ready: make(chan struct{})})
+	return w.(*keyWaiter)
+}
+
+// waitPeerKey ждет ключ шифрования пира из KEY_EXCHANGE
+func (c *Connector) waitPeerKey(ctx context.Context, peerID router.PeerID) error {
+	select {
+	case <-c.keyWaiter(peerID).ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrConnectorClosed
+	}
+}
+
 // decryptMessageFromPeer расшифровывает сообщение от пира
 // Извлекает ключ шифрования пира из envelope и сохраняет его
 // Возвращает расшифрованный payload
-func (c *Connector) decryptMessageFromPeer(peerID router.PeerID, envelopeJSON []byte) ([]byte, error) {
-	// Декодируем envelope
-	var envelope EncryptedMessage
-	if err := json.Unmarshal(envelopeJSON, &envelope); err != nil {
-		return nil, fmt.Errorf("unmarshal envelope: %w", err)
-	}
-
+func (c *Connector) decryptMessageFromPeer(peerID router.PeerID, envelope *EncryptedMessage) ([]byte, error) {
 	// SECURITY: Проверяем ключ шифрования пира (TOFU - Trust On First Use)
 	newPeerEncKey := &Curve25519PublicKey{}
 	copy((*newPeerEncKey)[:], envelope.SenderEncPubKey[:])
 
 	// Проверяем, есть ли уже сохраненный ключ для этого пира
-	if existingKeyVal, exists := c.peerEncKeys.Load(peerID); exists {
+	if existingKeyVal, exists := c.peerEncKeys.LoadOrStore(peerID, newPeerEncKey); exists {
 		existingKey := existingKeyVal.(*Curve25519PublicKey)
 		// SECURITY: Ключ не должен меняться! Если изменился - это атака!
 		if *existingKey != *newPeerEncKey {
@@ -259,11 +672,14 @@ func (c *Connector) decryptMessageFromPeer(peerID router.PeerID, envelopeJSON []
 			return nil, fmt.Errorf("peer encryption key changed - possible MITM attack")
 		}
 	} else {
-		// Первый раз видим этот ключ - сохраняем (Trust On First Use)
-		c.peerEncKeys.Store(peerID, newPeerEncKey)
+		// Первый раз видим этот ключ - сохранили (Trust On First Use)
 		slog.Info("Stored peer encryption key (TOFU)",
 			"peerID", hex.EncodeToString(peerID[:8])+"...",
 			"encKey", hex.EncodeToString(newPeerEncKey[:8])+"...")
+		if _, connected := c.peers.Load(peerID); !connected {
+			c.trackPeerKey(peerID, time.Now())
+		}
+		c.keyWaiter(peerID).fire()
 	}
 
 	peerEncKey := newPeerEncKey
@@ -300,6 +716,7 @@ func (c *Connector) decryptMessageFromPeer(peerID router.PeerID, envelopeJSON []
 			"error", err)
 		return nil, fmt.Errorf("decrypt: %w", err)
 	}
+	c.messagesDecrypted.Add(1)
 
 	slog.Debug("Decrypted message from peer",
 		"peerID", hex.EncodeToString(peerID[:8])+"...",
@@ -310,42 +727,63 @@ func (c *Connector) decryptMessageFromPeer(peerID router.PeerID, envelopeJSON []
 }
 
 // encryptDataChannelMessage шифрует сообщение для отправки через data channel
-// Используется более простой формат без JSON envelope (только сырые байты)
-func (c *Connector) encryptDataChannelMessage(peerID router.PeerID, data []byte) ([]byte, error) {
-	// Получаем ключ шифрования пира
-	peerEncKeyVal, ok := c.peerEncKeys.Load(peerID)
-	if !ok {
-		return nil, fmt.Errorf("peer encryption key not found")
+// сеансовым ключом (см. session.go) вместе со следующим номером сообщения
+// пира (см. replay.go). Если пора сменить ключи, вторым значением
+// возвращается handshake для канала DataChannelLabel. Вызывается под peer.mu
+func (c *Connector) encryptDataChannelMessage(peer *Peer, data []byte) ([]byte, []byte, error) {
+	peer.sendSeq++
+	encrypted, rekey, err := peer.session.seal(appendSeq(peer.sendSeq, data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("encrypt: %w", err)
 	}
+	c.messagesEncrypted.Add(1)
+	return encrypted, rekey, nil
+}
 
-	peerEncKey := peerEncKeyVal.(*Curve25519PublicKey)
-
-	// Шифруем данные
-	encrypted, err := EncryptMessage(data, peerEncKey, c.encPrivKey)
+// decryptDataChannelMessage расшифровывает сообщение полученное через data channel.
+// Handshake сеансовых ключей возвращает nil и, если нужно, ответ для канала
+// DataChannelLabel. Повторы возвращают errReplayedMessage или errMessageTooOld
+func (c *Connector) decryptDataChannelMessage(peer *Peer, encrypted []byte) ([]byte, []byte, error) {
+	decrypted, reply, err := peer.session.open(encrypted)
 	if err != nil {
-		return nil, fmt.Errorf("encrypt: %w", err)
+		return nil, nil, fmt.Errorf("decrypt: %w", err)
+	}
+	// Handshake или подтверждение смены ключей
+	if len(decrypted) == 0 {
+		return nil, reply, nil
 	}
 
-	return encrypted, nil
+	seq, data, err := splitSeq(decrypted)
+	if err != nil {
+		return nil, reply, err
+	}
+	if err := peer.recvSeq.check(seq); err != nil {
+		return nil, reply, fmt.Errorf("sequence %d: %w", seq, err)
+	}
+	c.messagesDecrypted.Add(1)
+	return data, reply, nil
 }
 
-// decryptDataChannelMessage расшифровывает сообщение полученное через data channel
-func (c *Connector) decryptDataChannelMessage(peerID router.PeerID, encrypted []byte) ([]byte, error) {
-	// Получаем ключ шифрования пира
-	peerEncKeyVal, ok := c.peerEncKeys.Load(peerID)
-	if !ok {
-		return nil, fmt.Errorf("peer encryption key not found")
-	}
+// LocalID возвращает наш ID - публичный Ed25519 ключ
+func (c *Connector) LocalID() router.PeerID {
+	var id router.PeerID
+	copy(id[:], c.cli.GetPublicKey())
+	return id
+}
 
-	peerEncKey := peerEncKeyVal.(*Curve25519PublicKey)
+// EncryptionKey возвращает наш Curve25519 ключ шифрования
+func (c *Connector) EncryptionKey() *Curve25519PublicKey {
+	return c.encPubKey
+}
 
-	// Расшифровываем данные
-	decrypted, err := DecryptMessage(encrypted, peerEncKey, c.encPrivKey)
-	if err != nil {
-		return nil, fmt.Errorf("decrypt: %w", err)
+// PeerEncryptionKey возвращает ключ шифрования, полученный от пира при
+// обмене ключами. Ключи хранятся только в памяти, до перезапуска
+func (c *Connector) PeerEncryptionKey(peerID router.PeerID) (*Curve25519PublicKey, bool) {
+	val, ok := c.peerEncKeys.Load(peerID)
+	if !ok {
+		return nil, false
 	}
-
-	return decrypted, nil
+	return val.(*Curve25519PublicKey), true
 }
 
 // GetPeer возвращает установленное соединение с пиром
@@ -357,22 +795,19 @@ func (c *Connector) GetPeer(peerID router.PeerID) (*Peer, bool) {
 	return val.(*Peer), true
 }
 
-// GetPeerByHex возвращает установленное соединение с пиром по hex ID
+// GetPeerByHex возвращает установленное соединение с пиром по hex ID. Если
+// подключение к пиру еще идет, ошибка оборачивает ErrConnectInProgress
 func (c *Connector) GetPeerByHex(hexID string) (*Peer, error) {
-	peerIDBytes, err := hex.DecodeString(hexID)
+	peerID, err := parsePeerID(hexID)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrInvalidIDFormat, err)
+		return nil, err
 	}
 
-	if len(peerIDBytes) != router.PeerIDSize {
-		return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidIDFormat, router.PeerIDSize, len(peerIDBytes))
-	}
-
-	var peerID router.PeerID
-	copy(peerID[:], peerIDBytes)
-
 	peer, ok := c.GetPeer(peerID)
 	if !ok {
+		if c.GetPeerState(peerID) == PeerStateConnecting {
+			return nil, fmt.Errorf("peer not connected yet: %w", ErrConnectInProgress)
+		}
 		return nil, fmt.Errorf("peer not found")
 	}
 	return peer, nil
@@ -388,14 +823,9 @@ func (c *Connector) Disconnect(peerID router.PeerID) error {
 	return peer.Close()
 }
 
-// DisconnectAll закрывает все активные соединения
+// DisconnectAll прощается со всеми пирами и закрывает соединения (см. bye.go)
 func (c *Connector) DisconnectAll() {
-	c.peers.Range(func(key, value any) bool {
-		peer := value.(*Peer)
-		peer.Close()
-		return true
-	})
-	c.peers = sync.Map{}
+	c.disconnectAll(DisconnectUser)
 }
 
 // GetActivePeers возвращает список ID всех активных пиров
@@ -409,16 +839,91 @@ func (c *Connector) GetActivePeers() []router.PeerID {
 	return peers
 }
 
+// SendAll отправляет данные всем активным пирам, не больше
+// maxSendAllWorkers одновременно. Возвращает ошибки отправки по ID пира,
+// пустая карта означает, что данные ушли всем
+func (c *Connector) SendAll(data []byte) map[router.PeerID]error {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		failures = make(map[router.PeerID]error)
+		sem      = make(chan struct{}, maxSendAllWorkers)
+	)
+	c.peers.Range(func(key, value any) bool {
+		peerID, peer := key.(router.PeerID), value.(*Peer)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := peer.Send(data); err != nil {
+				slog.Debug("Broadcast send failed", "peerID", hex.EncodeToString(peerID[:8])+"...", "error", err)
+				mu.Lock()
+				failures[peerID] = err
+				mu.Unlock()
+			}
+		}()
+		return true
+	})
+	wg.Wait()
+	return failures
+}
+
+// reservePeerSlot резервирует место под соединение с пиром.
+// Возвращает false если достигнут лимит MaxPeers
+func (c *Connector) reservePeerSlot(peerID router.PeerID) bool {
+	c.peerSlotsMu.Lock()
+	defer c.peerSlotsMu.Unlock()
+
+	if c.maxPeers > 0 && c.peerSlots[peerID] == 0 {
+		if _, connected := c.peers.Load(peerID); !connected {
+			// Считаем активных пиров и попытки подключения без повторов
+			count := len(c.peerSlots)
+			c.peers.Range(func(key, value any) bool {
+				if _, ok := c.peerSlots[key.(router.PeerID)]; !ok {
+					count++
+				}
+				return true
+			})
+			if count >= c.maxPeers {
+				return false
+			}
+		}
+	}
+
+	c.peerSlots[peerID]++
+	return true
+}
+
+// releasePeerSlot освобождает место, зарезервированное reservePeerSlot
+func (c *Connector) releasePeerSlot(peerID router.PeerID) {
+	c.peerSlotsMu.Lock()
+	defer c.peerSlotsMu.Unlock()
+
+	c.peerSlots[peerID]--
+	if c.peerSlots[peerID] <= 0 {
+		delete(c.peerSlots, peerID)
+	}
+}
+
 // AddToBlacklist добавляет пира в черный список и разрывает с ним соединение
 func (c *Connector) AddToBlacklist(peerID router.PeerID) {
-	c.blacklist.Store(peerID, struct{}{})
+	_, loaded := c.blacklist.LoadOrStore(peerID, struct{}{})
+	if !loaded && c.blacklistChanged != nil {
+		c.blacklistChanged(peerID, true)
+	}
 	// Разрываем существующее соединение если есть
 	c.Disconnect(peerID)
 }
 
 // RemoveFromBlacklist удаляет пира из черного списка
 func (c *Connector) RemoveFromBlacklist(peerID router.PeerID) {
-	c.blacklist.Delete(peerID)
+	_, loaded := c.blacklist.LoadAndDelete(peerID)
+	if loaded && c.blacklistChanged != nil {
+		c.blacklistChanged(peerID, false)
+	}
 }
 
 // IsBlacklisted проверяет находится ли пир в черном списке
@@ -438,20 +943,37 @@ func (c *Connector) GetBlacklist() []router.PeerID {
 	return blocked
 }
 
-// Connect инициирует WebRTC соединение с пиром по hex ID (асинхронно)
+// Connect инициирует WebRTC соединение с пиром по hex ID (асинхронно).
+// Результат приходит событием, см. также ConnectContext
 func (c *Connector) Connect(hexID string) error {
+	select {
+	case err := <-c.ConnectContext(context.Background(), hexID):
+		return err
+	default:
+		return nil
+	}
+}
+
+// prepareConnect проверяет, что к пиру можно подключаться
+func (c *Connector) prepareConnect(hexID string) (router.PeerID, error) {
+	select {
+	case <-c.done:
+		return router.PeerID{}, ErrConnectorClosed
+	default:
+	}
+
 	slog.Info("Initiating P2P connection", "peerID", hexID[:16]+"...")
 
 	// Парсим hex ID
 	peerIDBytes, err := hex.DecodeString(hexID)
 	if err != nil {
 		slog.Error("Invalid peer ID format", "hexID", hexID[:16]+"...", "error", err)
-		return fmt.Errorf("%w: %v", ErrInvalidIDFormat, err)
+		return router.PeerID{}, fmt.Errorf("%w: %v", ErrInvalidIDFormat, err)
 	}
 
 	if len(peerIDBytes) != router.PeerIDSize {
 		slog.Error("Invalid peer ID size", "expected", router.PeerIDSize, "got", len(peerIDBytes))
-		return fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidIDFormat, router.PeerIDSize, len(peerIDBytes))
+		return router.PeerID{}, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidIDFormat, router.PeerIDSize, len(peerIDBytes))
 	}
 
 	var peerID router.PeerID
@@ -460,98 +982,114 @@ func (c *Connector) Connect(hexID string) error {
 	// Проверяем черный список
 	if c.IsBlacklisted(peerID) {
 		slog.Warn("Attempted connection to blacklisted peer", "peerID", hexID[:16]+"...")
-		return fmt.Errorf("peer is blacklisted")
+		return router.PeerID{}, fmt.Errorf("peer is blacklisted")
 	}
 
 	// Проверяем что соединение еще не установлено
 	if _, exists := c.peers.Load(peerID); exists {
 		slog.Debug("Connection already exists", "peerID", hexID[:16]+"...")
-		return fmt.Errorf("connection already exists")
+		return router.PeerID{}, fmt.Errorf("connection already exists")
 	}
 
 	slog.Debug("Starting async connection", "peerID", hexID[:16]+"...")
-	// Запускаем подключение асинхронно
-	go c.connectAsync(peerID)
-	return nil
+	return peerID, nil
 }
 
-// connectAsync выполняет подключение в фоне
-func (c *Connector) connectAsync(peerID router.PeerID) {
+// connectAsync выполняет подключение в фоне. Результат попытки w
+// определяет emit, отмену ctx и закрытие коннектора - сама connectAsync
+func (c *Connector) connectAsync(ctx context.Context, peerID router.PeerID, w *connectWaiter) {
 	hexID := hex.EncodeToString(peerID[:8])
+
+	if err := ctx.Err(); err != nil {
+		c.abortConnect(peerID, w, err)
+		return
+	}
+
+	// SECURITY: Проверяем лимит соединений до создания PeerConnection
+	if !c.reservePeerSlot(peerID) {
+		slog.Warn("Max peers reached, refusing to connect", "peerID", hexID+"...", "maxPeers", c.maxPeers)
+		c.emit(Event{
+			Type:   EventConnectionFailed,
+			PeerID: peerID,
+			Error:  ErrMaxPeersReached,
+		})
+		return
+	}
+	defer c.releasePeerSlot(peerID)
+
 	slog.Debug("Creating WebRTC peer connection", "peerID", hexID+"...")
 
 	// Создаем PeerConnection
-	peerConn, err := webrtc.NewPeerConnection(c.config)
+	peerConn, err := c.api.NewPeerConnection(c.config)
 	if err != nil {
 		slog.Error("Failed to create peer connection", "peerID", hexID+"...", "error", err)
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("create peer connection: %w", err),
-		}
+		})
 		return
 	}
 	slog.Debug("Peer connection created", "peerID", hexID+"...")
 
-	peer := &Peer{
-		ID:        peerID,
-		conn:      peerConn,
-		connector: c,
+	// abort закрывает незавершенное соединение при отмене ctx или закрытии
+	// коннектора. EventConnectionFailed при этом не отправляется
+	abort := func(err error) {
+		c.abortConnect(peerID, w, err)
+		peerConn.Close()
+		c.pendingOffers.Delete(peerID)
 	}
 
-	// Создаем DataChannel
-	slog.Debug("Creating data channel", "peerID", hexID+"...")
-	dataChannel, err := peerConn.CreateDataChannel("data", nil)
-	if err != nil {
-		slog.Error("Failed to create data channel", "peerID", hexID+"...", "error", err)
-		peerConn.Close()
-		c.events <- Event{
-			Type:   EventConnectionFailed,
-			PeerID: peerID,
-			Error:  fmt.Errorf("create data channel: %w", err),
+	peer := newPeer(peerID, peerConn, c)
+	peer.initiator = true
+
+	// Создаем DataChannel'ы
+	for _, chCfg := range c.dataChannels {
+		slog.Debug("Creating data channel", "peerID", hexID+"...", "label", chCfg.Label)
+		ordered := chCfg.Ordered
+		dataChannel, err := peerConn.CreateDataChannel(chCfg.Label, &webrtc.DataChannelInit{
+			Ordered:        &ordered,
+			MaxRetransmits: chCfg.MaxRetransmits,
+		})
+		if err != nil {
+			slog.Error("Failed to create data channel", "peerID", hexID+"...", "label", chCfg.Label, "error", err)
+			peerConn.Close()
+			c.emit(Event{
+				Type:   EventConnectionFailed,
+				PeerID: peerID,
+				Error:  fmt.Errorf("create data channel %q: %w", chCfg.Label, err),
+			})
+			return
 		}
-		return
+		peer.addDataChannel(dataChannel)
+		c.setupDataChannel(peer, dataChannel)
 	}
-	peer.dataChannel = dataChannel
-	slog.Debug("Data channel created", "peerID", hexID+"...")
+	slog.Debug("Data channels created", "peerID", hexID+"...", "count", len(c.dataChannels))
 
 	// Настраиваем обработчики
-	c.setupDataChannel(peer, dataChannel)
 	c.setupConnectionHandlers(peer, peerConn)
+	peer.trickle = c.newTrickle(peerID)
+	c.trickleLocal(peer, peerConn)
 
 	// Создаем offer
 	offer, err := peerConn.CreateOffer(nil)
 	if err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("create offer: %w", err),
-		}
+		})
 		return
 	}
 
 	if err := peerConn.SetLocalDescription(offer); err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("set local description: %w", err),
-		}
-		return
-	}
-
-	// Ждем сбор ICE candidates
-	gatherComplete := webrtc.GatheringCompletePromise(peerConn)
-	select {
-	case <-gatherComplete:
-	case <-time.After(5 * time.Second):
-		peerConn.Close()
-		c.events <- Event{
-			Type:   EventConnectionFailed,
-			PeerID: peerID,
-			Error:  fmt.Errorf("ICE gathering timeout"),
-		}
+		})
 		return
 	}
 
@@ -559,49 +1097,43 @@ func (c *Connector) connectAsync(peerID router.PeerID) {
 	slog.Info("Sending KEY_EXCHANGE before SDP offer", "peerID", hexID+"...")
 	if err := c.sendKeyExchange(peerID); err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("send key exchange: %w", err),
-		}
+		})
 		return
 	}
 
 	// Ждем получения ключа от пира (с таймаутом)
-	timeout := time.After(5 * time.Second)
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
-
-waitForPeerKey:
-	for {
-		select {
-		case <-timeout:
-			slog.Error("Timeout waiting for peer key exchange", "peerID", hexID+"...")
-			peerConn.Close()
-			c.events <- Event{
-				Type:   EventConnectionFailed,
-				PeerID: peerID,
-				Error:  fmt.Errorf("timeout waiting for peer key exchange"),
-			}
-			return
-		case <-ticker.C:
-			// Проверяем есть ли ключ пира
-			if _, ok := c.peerEncKeys.Load(peerID); ok {
-				slog.Info("Received peer encryption key", "peerID", hexID+"...")
-				break waitForPeerKey
-			}
-		}
+	keyCtx, cancelKey := context.WithTimeout(ctx, c.keyExchangeTimeout)
+	err = c.waitPeerKey(keyCtx, peerID)
+	cancelKey()
+	if errors.Is(err, ErrConnectorClosed) || ctx.Err() != nil {
+		abort(err)
+		return
 	}
+	if err != nil {
+		slog.Error("Timeout waiting for peer key exchange", "peerID", hexID+"...")
+		peerConn.Close()
+		c.emit(Event{
+			Type:   EventConnectionFailed,
+			PeerID: peerID,
+			Error:  fmt.Errorf("timeout waiting for peer key exchange"),
+		})
+		return
+	}
+	slog.Info("Received peer encryption key", "peerID", hexID+"...")
 
 	// Кодируем offer
 	offerJSON, err := json.Marshal(peerConn.LocalDescription())
 	if err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("marshal offer: %w", err),
-		}
+		})
 		return
 	}
 
@@ -609,29 +1141,24 @@ waitForPeerKey:
 	encryptedOffer, err := c.encryptMessageForPeer(peerID, offerJSON)
 	if err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("encrypt offer: %w", err),
-		}
+		})
 		return
 	}
 
 	// SECURITY: Подписываем зашифрованный offer нашим Ed25519 приватным ключом
 	// Это предотвращает MITM атаки на сигнализацию
-	signature := SignMessage(encryptedOffer, c.edPrivKey)
-	signedMsg := SignedMessage{
-		Payload:   encryptedOffer,
-		Signature: signature,
-	}
-	signedMsgJSON, err := json.Marshal(signedMsg)
+	signedMsg, err := c.signEnvelope(peerID, encryptedOffer)
 	if err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
-			Error:  fmt.Errorf("marshal signed offer: %w", err),
-		}
+			Error:  fmt.Errorf("sign offer: %w", err),
+		})
 		return
 	}
 	slog.Debug("Sending signed encrypted offer", "peerID", hex.EncodeToString(peerID[:8])+"...")
@@ -641,127 +1168,211 @@ waitForPeerKey:
 	c.pendingOffers.Store(peerID, answerChan)
 
 	// Отправляем signed encrypted offer
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	respCh, err := c.cli.Send(ctx, peerID, signedMsgJSON)
+	respCh, err := c.sendSignaling(sendCtx, peerID, signedMsg)
+	if err != nil && ctx.Err() != nil {
+		abort(ctx.Err())
+		return
+	}
 	if err != nil {
 		peerConn.Close()
 		c.pendingOffers.Delete(peerID)
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("send offer: %w", err),
-		}
+		})
 		return
 	}
 
 	// Ждем подтверждение от сервера
 	select {
-	case resp := <-respCh:
-		if resp.Type != router.Success {
+	case resp, ok := <-respCh:
+		if !ok || resp.Type != router.Success {
+			// Канал закрыт без ответа по таймауту запроса
+			err := ErrConnectionTimeout
+			if ok {
+				err = fmt.Errorf("offer rejected: %w", routerResponseError(resp))
+			}
 			peerConn.Close()
 			c.pendingOffers.Delete(peerID)
-			c.events <- Event{
+			c.emit(Event{
 				Type:   EventConnectionFailed,
 				PeerID: peerID,
-				Error:  fmt.Errorf("offer rejected: type=%v", resp.Type),
-			}
+				Error:  err,
+			})
 			return
 		}
+		c.flushLocalCandidates(peer)
 	case <-time.After(10 * time.Second):
 		peerConn.Close()
 		c.pendingOffers.Delete(peerID)
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  ErrConnectionTimeout,
-		}
+		})
 		return
 	case <-ctx.Done():
-		peerConn.Close()
-		c.pendingOffers.Delete(peerID)
+		abort(ctx.Err())
+		return
+	case <-c.done:
+		abort(ErrConnectorClosed)
 		return
 	}
 
 	// Ждем answer
 	select {
-	case encryptedAnswer, ok := <-answerChan:
+	case answerJSON, ok := <-answerChan:
 		if !ok {
 			// Канал закрыт - наш offer был отменен из-за одновременного подключения
-			// Другая сторона обработает входящий offer
+			// Другая сторона обработает входящий offer, результат придет от него
 			peerConn.Close()
+			c.awaitConnect(ctx, peerID, w, nil)
 			return
 		}
-
-		// Расшифровываем answer
-		slog.Debug("Received encrypted answer, decrypting...", "peerID", hex.EncodeToString(peerID[:8])+"...")
-		answerJSON, err := c.decryptMessageFromPeer(peerID, encryptedAnswer)
-		if err != nil {
-			peerConn.Close()
-			c.events <- Event{
-				Type:   EventConnectionFailed,
-				PeerID: peerID,
-				Error:  fmt.Errorf("decrypt answer: %w", err),
-			}
-			return
-		}
+		slog.Debug("Received answer", "peerID", hex.EncodeToString(peerID[:8])+"...")
 
 		var answer webrtc.SessionDescription
 		if err := json.Unmarshal(answerJSON, &answer); err != nil {
 			peerConn.Close()
-			c.events <- Event{
+			c.emit(Event{
 				Type:   EventConnectionFailed,
 				PeerID: peerID,
 				Error:  fmt.Errorf("unmarshal answer: %w", err),
-			}
+			})
 			return
 		}
 
-		if err := peerConn.SetRemoteDescription(answer); err != nil {
+		if err := peer.trickle.setRemoteDescription(peerConn, answer); err != nil {
 			peerConn.Close()
-			c.events <- Event{
+			c.emit(Event{
 				Type:   EventConnectionFailed,
 				PeerID: peerID,
 				Error:  fmt.Errorf("set remote description: %w", err),
-			}
+			})
 			return
 		}
 
-		c.peers.Store(peerID, peer)
+		c.storePeer(peer)
+		c.awaitConnect(ctx, peerID, w, peerConn)
 
-	case <-time.After(30 * time.Second):
+	case <-time.After(c.iceConnectionTimeout):
 		peerConn.Close()
 		c.pendingOffers.Delete(peerID)
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  ErrConnectionTimeout,
-		}
+		})
 		return
 	case <-ctx.Done():
-		peerConn.Close()
-		c.pendingOffers.Delete(peerID)
+		abort(ctx.Err())
 		return
+	case <-c.done:
+		abort(ErrConnectorClosed)
+		return
+	}
+}
+
+// awaitConnect ждет результата попытки w после обмена SDP. Отмена ctx
+// завершает попытку и закрывает conn, если он задан
+func (c *Connector) awaitConnect(ctx context.Context, peerID router.PeerID, w *connectWaiter, conn *webrtc.PeerConnection) {
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		slog.Info("Connection attempt cancelled", "peerID", hex.EncodeToString(peerID[:8])+"...")
+		// Результат до закрытия: закрытие породит EventDisconnected
+		c.abortConnect(peerID, w, ctx.Err())
+		if conn != nil {
+			conn.Close()
+		}
+	case <-c.done:
 	}
 }
 
 // setupConnectionHandlers настраивает обработчики состояния соединения
 func (c *Connector) setupConnectionHandlers(peer *Peer, peerConn *webrtc.PeerConnection) {
+	hexID := hex.EncodeToString(peer.ID[:8])
+
+	peerConn.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		slog.Debug("ICE state changed", "peerID", hexID+"...", "state", state.String())
+		c.emit(Event{
+			Type:     EventICEStateChanged,
+			PeerID:   peer.ID,
+			ICEState: state,
+		})
+	})
+
 	peerConn.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		slog.Debug("Connection state changed", "peerID", hexID+"...", "state", state.String())
+		c.emit(Event{
+			Type:            EventConnectionStateChanged,
+			PeerID:          peer.ID,
+			ConnectionState: state,
+		})
+
 		switch state {
 		case webrtc.PeerConnectionStateConnected:
-			c.events <- Event{
+			peer.mu.Lock()
+			first := !peer.connected
+			restarted := peer.restarting
+			peer.connected = true
+			if restarted {
+				peer.restarting = false
+				close(peer.reconnected)
+			}
+			peer.mu.Unlock()
+			// Restart по инициативе пира проходит для нас незаметно
+			if !first && !restarted {
+				return
+			}
+			c.emit(Event{
 				Type:   EventConnected,
 				PeerID: peer.ID,
 				Peer:   peer,
-			}
+			})
 		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
-			c.peers.Delete(peer.ID)
-			c.events <- Event{
+			// Установленное соединение сначала пробуем восстановить
+			if state != webrtc.PeerConnectionStateClosed && c.beginICERestart(peer) {
+				return
+			}
+
+			peer.mu.Lock()
+			superseded := peer.superseded
+			negotiated := peer.negotiated && !peer.connected
+			fallback := state == webrtc.PeerConnectionStateFailed && c.relayFallback &&
+				peer.initiator && !peer.connected && !superseded
+			if fallback {
+				peer.superseded = true
+			}
+			peer.mu.Unlock()
+
+			// Пир уже заменен, удалять можно только свою запись
+			c.peers.CompareAndDelete(peer.ID, peer)
+			c.stopTrickle(peer.ID, peer.trickle)
+			if superseded {
+				return
+			}
+			if fallback {
+				select {
+				case <-c.done:
+				default:
+					go peerConn.Close()
+					c.spawn(func() { c.fallbackToRelay(peer.ID, ErrICEFailed) })
+				}
+				return
+			}
+			// Соединение после обмена SDP так и не установилось
+			if negotiated {
+				c.finishConnect(peer.ID, ErrConnectionClosed)
+			}
+			c.emit(Event{
 				Type:   EventDisconnected,
 				PeerID: peer.ID,
-			}
+			})
 		}
 	})
 }
@@ -769,25 +1380,89 @@ func (c *Connector) setupConnectionHandlers(peer *Peer, peerConn *webrtc.PeerCon
 // setupDataChannel настраивает обработчики для DataChannel
 func (c *Connector) setupDataChannel(peer *Peer, dc *webrtc.DataChannel) {
 	hexID := hex.EncodeToString(peer.ID[:8])
+	label := dc.Label()
+	c.setupBackpressure(peer, dc)
 
 	dc.OnOpen(func() {
-		slog.Info("Data channel opened", "peerID", hexID+"...")
+		slog.Info("Data channel opened", "peerID", hexID+"...", "label", label)
+		if label != DataChannelLabel {
+			return
+		}
+		// Обмен сеансовыми ключами идет по упорядоченному основному каналу
+		handshake, err := peer.session.start()
+		if err != nil {
+			slog.Error("Failed to start session key exchange", "peerID", hexID+"...", "error", err)
+			return
+		}
+		if handshake != nil {
+			if err := dc.Send(handshake); err != nil {
+				slog.Warn("Failed to send session handshake", "peerID", hexID+"...", "error", err)
+			}
+		}
 	})
 
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		slog.Debug("Received encrypted data", "peerID", hexID+"...", "encryptedBytes", len(msg.Data))
+		slog.Debug("Received encrypted data", "peerID", hexID+"...", "label", label, "encryptedBytes", len(msg.Data))
 
 		// Расшифровываем данные
-		decrypted, err := c.decryptDataChannelMessage(peer.ID, msg.Data)
+		decrypted, reply, err := c.decryptDataChannelMessage(peer, msg.Data)
+		if reply != nil {
+			if err := dc.Send(reply); err != nil {
+				slog.Warn("Failed to answer session handshake", "peerID", hexID+"...", "error", err)
+			}
+		}
+		if errors.Is(err, errReplayedMessage) || errors.Is(err, errMessageTooOld) {
+			slog.Debug("Dropped replayed data channel message", "peerID", hexID+"...", "label", label, "error", err)
+			return
+		}
 		if err != nil {
 			slog.Error("Failed to decrypt data channel message",
 				"peerID", hexID+"...",
 				"error", err)
-			c.events <- Event{
+			c.emit(Event{
 				Type:   EventError,
 				PeerID: peer.ID,
 				Error:  fmt.Errorf("decrypt data: %w", err),
+			})
+			return
+		}
+
+		// Handshake или подтверждение смены ключей
+		if decrypted == nil {
+			return
+		}
+		if peer.session.fragments() {
+			var complete bool
+			decrypted, complete, err = peer.reassembly.add(decrypted)
+			if err != nil {
+				slog.Warn("Dropping invalid message fragment", "peerID", hexID+"...", "label", label, "error", err)
+				c.emit(Event{
+					Type:   EventError,
+					PeerID: peer.ID,
+					Error:  fmt.Errorf("reassemble data: %w", err),
+				})
+				return
 			}
+				if !complete {
+				return
+			}
+		}
+		msgType, decrypted, err := peer.splitType(decrypted)
+		if err != nil {
+			slog.Warn("Dropping message of unknown type", "peerID", hexID+"...", "label", label, "error", err)
+			c.emit(Event{
+				Type:   EventError,
+				PeerID: peer.ID,
+				Error:  fmt.Errorf("message type: %w", err),
+			})
+			return
+		}
+		if msgType == msgRPC {
+			c.handleRPC(peer, decrypted)
+			return
+		}
+		if msgType == msgBye {
+			c.handleBye(peer, decrypted)
 			return
 		}
 
@@ -795,129 +1470,309 @@ func (c *Connector) setupDataChannel(peer *Peer, dc *webrtc.DataChannel) {
 			"peerID", hexID+"...",
 			"decryptedBytes", len(decrypted))
 
-		c.events <- Event{
-			Type:   EventDataReceived,
-			PeerID: peer.ID,
-			Peer:   peer,
-			Data:   decrypted,
-		}
+		c.emit(Event{
+			Type:    EventDataReceived,
+			PeerID:  peer.ID,
+			Peer:    peer,
+			Data:    decrypted,
+			Channel: label,
+		})
 	})
 
 	dc.OnClose(func() {
-		slog.Info("Data channel closed", "peerID", hexID+"...")
-		c.peers.Delete(peer.ID)
+		slog.Info("Data channel closed", "peerID", hexID+"...", "label", label)
+		peer.signalBufferLow()
+		// Без основного канала пир непригоден, остальные каналы вспомогательные
+		if label == DataChannelLabel {
+			c.peers.CompareAndDelete(peer.ID, peer)
+			peer.rpc.close()
+		}
 	})
 
 	dc.OnError(func(err error) {
 		// SCTP "User Initiated Abort" - это нормально при закрытии соединения
 		slog.Debug("Data channel error (will reconnect)", "peerID", hexID+"...", "error", err)
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventError,
 			PeerID: peer.ID,
 			Error:  err,
-		}
+		})
 	})
 }
 
-// Send отправляет данные пиру (с шифрованием)
+func newPeer(id router.PeerID, conn *webrtc.PeerConnection, c *Connector) *Peer {
+	peer := &Peer{
+		ID:           id,
+		conn:         conn,
+		dataChannels: make(map[string]*webrtc.DataChannel),
+		connector:    c,
+	}
+	if c != nil {
+		peer.session = newSession(c.LocalID(), id, c.edPrivKey, c.rekeyMessages, c.rekeyInterval)
+	}
+	return peer
+}
+
+// storePeer добавляет пира, завершившего обмен SDP, в peers
+func (c *Connector) storePeer(peer *Peer) {
+	peer.mu.Lock()
+	peer.negotiated = true
+	peer.mu.Unlock()
+	c.peers.Store(peer.ID, peer)
+}
+
+func (p *Peer) addDataChannel(dc *webrtc.DataChannel) {
+	p.mu.Lock()
+	p.dataChannels[dc.Label()] = dc
+	p.mu.Unlock()
+}
+
+// Send отправляет данные пиру (с шифрованием) по каналу DataChannelLabel
 func (p *Peer) Send(data []byte) error {
+	return p.SendWithContext(context.Background(), data)
+}
+
+// SendWithContext отправляет данные пиру по каналу DataChannelLabel.
+// Если буфер DataChannel переполнен и отправка зависла, отмена ctx
+// возвращает управление с ctx.Err(). Сама отправка при этом не
+// прерывается и может завершиться позже
+func (p *Peer) SendWithContext(ctx context.Context, data []byte) error {
+	return p.sendOnContext(ctx, DataChannelLabel, msgData, data)
+}
+
+// SendOn отправляет данные пиру (с шифрованием) по DataChannel с меткой
+// channel. Если у пира нет такого канала, возвращает ErrChannelNotFound
+func (p *Peer) SendOn(channel string, data []byte) error {
+	return p.sendOnContext(context.Background(), channel, msgData, data)
+}
+
+// SendOnWithContext отправляет данные по каналу channel. Отмена ctx
+// прерывает ожидание освобождения буфера канала
+func (p *Peer) SendOnWithContext(ctx context.Context, channel string, data []byte) error {
+	return p.sendOnContext(ctx, channel, msgData, data)
+}
+
+// sendOnContext выполняет отправку в горутине, чтобы вызывающий мог
+// отменить ожидание. Контекст без отмены горутины не требует
+func (p *Peer) sendOnContext(ctx context.Context, channel string, msgType byte, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return p.sendOn(ctx, channel, msgType, data)
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- p.sendOn(ctx, channel, msgType, data) }()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		slog.Warn("Send cancelled before completion",
+			"peerID", hex.EncodeToString(p.ID[:8])+"...",
+			"label", channel,
+			"error", ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// sendOn отправляет данные синхронно. Пока буфер канала полон, ждет его
+// освобождения или отмены ctx. msgType - данные Send или RPC (см. rpc.go)
+func (p *Peer) sendOn(ctx context.Context, channel string, msgType byte, data []byte) error {
+	if p.relay {
+		return p.sendRelay(channel, msgType, data)
+	}
+
 	hexID := hex.EncodeToString(p.ID[:8])
 	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	if p.dataChannel == nil {
-		slog.Error("Cannot send: data channel is nil", "peerID", hexID+"...")
-		return fmt.Errorf("data channel is nil")
+	dc, ok := p.dataChannels[channel]
+	p.mu.Unlock()
+	if !ok {
+		slog.Debug("Cannot send: data channel not found", "peerID", hexID+"...", "label", channel)
+		return fmt.Errorf("%w: %q", ErrChannelNotFound, channel)
 	}
 
-	state := p.dataChannel.ReadyState()
+	state := dc.ReadyState()
 	if state != webrtc.DataChannelStateOpen {
-		slog.Warn("Cannot send: data channel not open", "peerID", hexID+"...", "state", state.String())
-		return fmt.Errorf("data channel is not open: state=%v", state)
+		slog.Warn("Cannot send: data channel not open", "peerID", hexID+"...", "label", channel, "state", state.String())
+		return fmt.Errorf("data channel %q is not open: state=%v", channel, state)
+	}
+
+	if len(data) > MaxMessageSize {
+		return fmt.Errorf("send on %q: %w: %d bytes (max %d)", channel, ErrMessageTooLarge, len(data), MaxMessageSize)
+	}
+
+	// Первая отправка ждет обмена сеансовыми ключами, он начинается при
+	// открытии канала
+	if err := p.session.waitReady(p.connector.done); err != nil {
+		slog.Warn("Cannot send: no session key", "peerID", hexID+"...", "label", channel, "error", err)
+		return fmt.Errorf("send on %q: %w", channel, err)
+	}
+	data = p.withType(msgType, data)
+
+	// Пиру прежней версии сообщение уходит целиком
+	if !p.session.fragments() {
+		return p.sendEncrypted(ctx, dc, data)
+	}
+	for _, frame := range p.fragment(data) {
+		if err := p.sendEncrypted(ctx, dc, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendEncrypted шифрует и отправляет одно сообщение канала, дождавшись
+// места в его буфере
+func (p *Peer) sendEncrypted(ctx context.Context, dc *webrtc.DataChannel, data []byte) error {
+	hexID := hex.EncodeToString(p.ID[:8])
+	channel := dc.Label()
+	if err := p.waitBufferLow(ctx, dc); err != nil {
+		return fmt.Errorf("send on %q: %w", channel, err)
 	}
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	// Шифруем данные перед отправкой
-	encrypted, err := p.connector.encryptDataChannelMessage(p.ID, data)
+	encrypted, rekey, err := p.connector.encryptDataChannelMessage(p, data)
 	if err != nil {
 		slog.Error("Failed to encrypt data", "peerID", hexID+"...", "error", err)
 		return fmt.Errorf("encrypt data: %w", err)
 	}
+	if main := p.dataChannels[DataChannelLabel]; rekey != nil && main != nil {
+		slog.Debug("Rekeying data channel session", "peerID", hexID+"...")
+		if err := main.Send(rekey); err != nil {
+			slog.Warn("Failed to send session rekey", "peerID", hexID+"...", "error", err)
+		}
+	}
 
 	slog.Debug("Sending encrypted data",
 		"peerID", hexID+"...",
+		"label", channel,
 		"originalBytes", len(data),
 		"encryptedBytes", len(encrypted))
 
-	return p.dataChannel.Send(encrypted)
+	return dc.Send(encrypted)
 }
 
-// Close закрывает соединение с пиром
-func (p *Peer) Close() error {
-	hexID := hex.EncodeToString(p.ID[:8])
-	slog.Info("Closing peer connection", "peerID", hexID+"...")
+// Relayed сообщает, что данные идут через router, а не напрямую по WebRTC
+func (p *Peer) Relayed() bool {
+	return p.relay
+}
 
+// supersede помечает WebRTC соединение замененным relay-пиром
+func (p *Peer) supersede() {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	p.superseded = true
+	p.mu.Unlock()
+}
 
-	if p.conn != nil {
-		return p.conn.Close()
+// routerResponseError переводит неуспешный ответ router'а в ошибку с
+// понятным пользователю текстом. *router.RouterError доступен через errors.As
+func routerResponseError(resp router.ServerMessage) error {
+	if resp.Type == router.NotFound {
+		return ErrPeerNotFound
+	}
+
+	var rerr *router.RouterError
+	if !errors.As(resp.Err, &rerr) {
+		if resp.Err != nil {
+			return resp.Err
+		}
+		return fmt.Errorf("unexpected router response: type=%v", resp.Type)
+	}
+
+	switch rerr.Code() {
+	case router.ErrCodeRecipientWriteFailed:
+		return fmt.Errorf("peer is unreachable: %w", rerr)
+	case router.ErrCodeTooLarge:
+		return fmt.Errorf("message is too large for router: %w", rerr)
+	case router.ErrCodeRateLimited:
+		return fmt.Errorf("sending too fast: %w", rerr)
+	case router.ErrCodeForbidden:
+		return fmt.Errorf("peer is banned on router: %w", rerr)
+	case router.ErrCodeRecipientBusy:
+		return fmt.Errorf("peer is not keeping up: %w", rerr)
+	case router.ErrCodeOfflineQueueFull:
+		return fmt.Errorf("peer is offline with too many queued messages: %w", rerr)
+	default:
+		return fmt.Errorf("router failed to deliver: %w", rerr)
 	}
-	return nil
 }
 
 // handleIncoming обрабатывает входящие сообщения от router
 func (c *Connector) handleIncoming(income <-chan router.ServerMessage) {
-	for msg := range income {
+	for {
+		var msg router.ServerMessage
+		select {
+		case m, ok := <-income:
+			if !ok {
+				return
+			}
+			msg = m
+		case m := <-c.localSignals():
+			msg = m
+		case ids := <-c.cli.PeerListUpdates():
+			c.handlePeerList(ids)
+			continue
+		case <-c.done:
+			return
+		}
+
 		slog.Debug("Received message from peer",
 			"from", hex.EncodeToString(msg.SenderID[:8])+"...")
 
 		// ВАЖНО: Проверяем был ли у нас ключ от этого пира ДО расшифровки
 		_, hadKeyBefore := c.peerEncKeys.Load(msg.SenderID)
 
-		// SECURITY: Все сообщения теперь подписаны (включая KEY_EXCHANGE)
-		var signedMsg SignedMessage
-		if err := json.Unmarshal(msg.Payload, &signedMsg); err != nil {
-			slog.Error("Failed to unmarshal SignedMessage",
+		// SECURITY: Все сообщения теперь подписаны (включая KEY_EXCHANGE).
+		// decodeSignal верифицирует Ed25519 подпись конверта любого формата
+		envelope, binarySignal, err := decodeSignal(msg.Payload, ed25519.PublicKey(msg.SenderID[:]))
+		if errors.Is(err, errInvalidSignature) {
+			slog.Error("SECURITY ALERT: Invalid Ed25519 signature!",
 				"from", hex.EncodeToString(msg.SenderID[:8])+"...",
-				"error", err)
-			c.events <- Event{
+				"payloadSize", len(msg.Payload))
+			msg.Release()
+			c.emit(Event{
 				Type:   EventError,
 				PeerID: msg.SenderID,
-				Error:  fmt.Errorf("invalid message format: %w", err),
-			}
+				Error:  err,
+			})
 			continue
 		}
-
-		// SECURITY: Верифицируем Ed25519 подпись
-		slog.Debug("Verifying Ed25519 signature",
-			"from", hex.EncodeToString(msg.SenderID[:8])+"...")
-
-		senderPubKey := ed25519.PublicKey(msg.SenderID[:])
-		if !VerifySignature(signedMsg.Payload, signedMsg.Signature, senderPubKey) {
-			slog.Error("SECURITY ALERT: Invalid Ed25519 signature!",
+		if err != nil {
+			slog.Error("Failed to decode signaling message",
 				"from", hex.EncodeToString(msg.SenderID[:8])+"...",
-				"payloadSize", len(signedMsg.Payload),
-				"signatureSize", len(signedMsg.Signature))
-			c.events <- Event{
+				"error", err)
+			msg.Release()
+			c.emit(Event{
 				Type:   EventError,
 				PeerID: msg.SenderID,
-				Error:  fmt.Errorf("invalid Ed25519 signature - potential MITM attack"),
-			}
+				Error:  fmt.Errorf("invalid message format: %w", err),
+			})
 			continue
 		}
 
 		slog.Debug("Signature verified successfully",
-			"from", hex.EncodeToString(msg.SenderID[:8])+"...")
-		payloadToDecrypt := signedMsg.Payload
+			"from", hex.EncodeToString(msg.SenderID[:8])+"...",
+			"binary", binarySignal)
+		// До расшифровки: ответ на KEY_EXCHANGE уже уйдет в бинарном конверте
+		if binarySignal {
+			c.binarySignal.Store(msg.SenderID, struct{}{})
+		}
 
-		// Расшифровываем сообщение
-		decryptedPayload, err := c.decryptMessageFromPeer(msg.SenderID, payloadToDecrypt)
+		// Расшифровываем сообщение. Конверт ссылается на буфер msg, поэтому
+		// буфер возвращается в пул только после расшифровки в новый
+		decryptedPayload, err := c.decryptMessageFromPeer(msg.SenderID, envelope)
+		msg.Release()
 		if err != nil {
-			c.events <- Event{
+			c.emit(Event{
 				Type:   EventError,
 				PeerID: msg.SenderID,
 				Error:  fmt.Errorf("decrypt incoming message: %w", err),
-			}
+			})
 			continue
 		}
 
@@ -945,14 +1800,32 @@ func (c *Connector) handleIncoming(income <-chan router.ServerMessage) {
 			continue
 		}
 
+		// Relay-кадры идут в том же конверте, что и SDP, отличаются полем type
+		if frame, ok := parseRelayFrame(decryptedPayload); ok {
+			c.handleRelayFrame(msg.SenderID, frame)
+			continue
+		}
+
+		// Кандидаты trickle ICE тоже отличаются полем type
+		if candidate, ok := parseCandidateFrame(decryptedPayload); ok {
+			c.handleRemoteCandidate(msg.SenderID, candidate)
+			continue
+		}
+
+		// И просьба о ICE restart
+		if isRestartFrame(decryptedPayload) {
+			c.handleRestartRequest(msg.SenderID)
+			continue
+		}
+
 		// Парсим SessionDescription чтобы узнать тип
 		var sdp webrtc.SessionDescription
 		if err := json.Unmarshal(decryptedPayload, &sdp); err != nil {
-			c.events <- Event{
+			c.emit(Event{
 				Type:   EventError,
 				PeerID: msg.SenderID,
 				Error:  fmt.Errorf("unmarshal session description: %w", err),
-			}
+			})
 			continue
 		}
 
@@ -973,33 +1846,89 @@ func (c *Connector) handleIncoming(income <-chan router.ServerMessage) {
 					c.pendingOffers.Delete(msg.SenderID)
 					answerChan := ch.(chan []byte)
 					close(answerChan)
-					go c.handleIncomingOffer(msg.SenderID, decryptedPayload)
+					c.acceptOffer(msg.SenderID, decryptedPayload)
 				}
 				// Иначе игнорируем входящий offer - пусть другая сторона примет наш
 				continue
 			}
 
 			// Обычный входящий offer
-			go c.handleIncomingOffer(msg.SenderID, decryptedPayload)
+			c.acceptOffer(msg.SenderID, decryptedPayload)
 
 		case webrtc.SDPTypeAnswer:
 			// Это answer на наш offer
 			if ch, ok := c.pendingOffers.LoadAndDelete(msg.SenderID); ok {
 				answerChan := ch.(chan []byte)
-				// Отправляем encrypted answer (после проверки подписи, будет расшифрован в connectAsync)
+				// Отправляем расшифрованный answer в connectAsync
 				select {
-				case answerChan <- payloadToDecrypt:
+				case answerChan <- decryptedPayload:
 				default:
 				}
 			}
 			// Если нет pending offer - игнорируем (возможно уже обработали)
 
 		default:
-			c.events <- Event{
+			c.emit(Event{
 				Type:   EventError,
 				PeerID: msg.SenderID,
 				Error:  fmt.Errorf("unexpected SDP type: %v", sdp.Type),
-			}
+			})
+		}
+	}
+}
+
+// acceptOffer запускает обработку входящего offer: ICE restart существующего
+// соединения или новое входящее соединение
+func (c *Connector) acceptOffer(peerID router.PeerID, offerJSON []byte) {
+	if offer, ok := parseRestartOffer(offerJSON); ok {
+		c.acceptRestartOffer(peerID, offer)
+		return
+	}
+	// Кандидаты могут прийти раньше, чем горутина создаст PeerConnection
+	trickle := c.newTrickle(peerID)
+	c.spawn(func() { c.handleIncomingOffer(peerID, offerJSON, trickle) })
+}
+
+// handlePeerList подключается к пирам из списка router'а, которых выбрал
+// autoConnect и с которыми еще нет соединения или попытки подключения.
+// Одновременные встречные попытки разрешает perfect negotiation
+func (c *Connector) handlePeerList(ids []router.PeerID) {
+	if c.autoConnect == nil {
+		return
+	}
+	localID := c.LocalID()
+	for _, id := range ids {
+		if id == localID || c.IsBlacklisted(id) {
+			continue
+		}
+		if _, ok := c.peers.Load(id); ok {
+			continue
+		}
+		if _, ok := c.connecting.Load(id); ok {
+			continue
+		}
+		if !c.autoConnect(id) {
+			continue
+		}
+		slog.Info("Known peer is online, connecting", "peerID", hex.EncodeToString(id[:8])+"...")
+		// Результат придет событием, как у Connect
+		c.ConnectContext(context.Background(), hex.EncodeToString(id[:]))
+	}
+}
+
+// handleRouterErrors пересылает ошибки чтения router.Client как EventError
+// с пустым PeerID: после них сигнализация не работает
+func (c *Connector) handleRouterErrors() {
+	for {
+		select {
+		case err := <-c.cli.Errors():
+			slog.Error("Lost connection to router", "error", err)
+			c.emit(Event{
+				Type:  EventError,
+				Error: fmt.Errorf("%w: %w", ErrRouterDisconnected, err),
+			})
+		case <-c.done:
+			return
 		}
 	}
 }
@@ -1022,6 +1951,7 @@ func (c *Connector) checkOfferRateLimit(peerID router.PeerID) bool {
 	now := time.Now()
 
 	// Получаем или создаем counter для пира
+	c.trackOfferCounter(peerID, now)
 	counterVal, _ := c.offerCount.LoadOrStore(peerID, &offerCounter{
 		count: 0,
 		lastReset: now,
@@ -1038,11 +1968,11 @@ func (c *Connector) checkOfferRateLimit(peerID router.PeerID) bool {
 	}
 
 	// Проверяем лимит
-	if counter.count >= maxOffersPerMinute {
+	if counter.count >= c.maxOffersPerMinute {
 		slog.Warn("SECURITY: Rate limit exceeded for peer",
 			"peerID", hex.EncodeToString(peerID[:8])+"...",
 			"count", counter.count,
-			"limit", maxOffersPerMinute)
+			"limit", c.maxOffersPerMinute)
 		return false
 	}
 
@@ -1050,8 +1980,18 @@ func (c *Connector) checkOfferRateLimit(peerID router.PeerID) bool {
 	return true
 }
 
-// handleIncomingOffer обрабатывает входящий offer от удаленного пира
-func (c *Connector) handleIncomingOffer(peerID router.PeerID, offerJSON []byte) {
+// handleIncomingOffer обрабатывает входящий offer от удаленного пира.
+// trickle копит кандидаты пира, пришедшие вслед за offer
+func (c *Connector) handleIncomingOffer(peerID router.PeerID, offerJSON []byte, trickle *iceTrickle) {
+	// До установки обработчиков состояния очередь кандидатов убираем сами,
+	// дальше ее удалит закрытие PeerConnection
+	handlersSet := false
+	defer func() {
+		if !handlersSet {
+			c.stopTrickle(peerID, trickle)
+		}
+	}()
+
 	// SECURITY: Проверяем rate limit
 	if !c.checkOfferRateLimit(peerID) {
 		slog.Warn("Rejecting offer due to rate limit", "peerID", hex.EncodeToString(peerID[:8])+"...")
@@ -1074,51 +2014,69 @@ func (c *Connector) handleIncomingOffer(peerID router.PeerID, offerJSON []byte)
 		return
 	}
 
+	// Политика входящих соединений: незнакомого пира отбрасываем или ждем
+	// решения приложения
+	if !c.admitOffer(peerID) {
+		return
+	}
+
+	// SECURITY: Проверяем лимит соединений до создания PeerConnection
+	if !c.reservePeerSlot(peerID) {
+		slog.Warn("Max peers reached, rejecting offer", "peerID", hex.EncodeToString(peerID[:8])+"...", "maxPeers", c.maxPeers)
+		c.emit(Event{
+			Type:   EventConnectionFailed,
+			PeerID: peerID,
+			Error:  ErrMaxPeersReached,
+		})
+		return
+	}
+	defer c.releasePeerSlot(peerID)
+
 	// Парсим offer
 	var offer webrtc.SessionDescription
 	if err := json.Unmarshal(offerJSON, &offer); err != nil {
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventError,
 			PeerID: peerID,
 			Error:  fmt.Errorf("unmarshal offer: %w", err),
-		}
+		})
 		return
 	}
 
 	// Создаем PeerConnection
-	peerConn, err := webrtc.NewPeerConnection(c.config)
+	peerConn, err := c.api.NewPeerConnection(c.config)
 	if err != nil {
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("create peer connection: %w", err),
-		}
+		})
 		return
 	}
 
-	peer := &Peer{
-		ID:        peerID,
-		conn:      peerConn,
-		connector: c,
-	}
+	peer := newPeer(peerID, peerConn, c)
+	peer.trickle = trickle
 
-	// Устанавливаем обработчик для входящего DataChannel
+	// Устанавливаем обработчик для входящих DataChannel'ов, набор каналов
+	// определяет инициатор соединения
 	peerConn.OnDataChannel(func(dc *webrtc.DataChannel) {
-		peer.dataChannel = dc
+		peer.addDataChannel(dc)
 		c.setupDataChannel(peer, dc)
 	})
 
 	// Настраиваем обработчики состояния
 	c.setupConnectionHandlers(peer, peerConn)
+	handlersSet = true
+	c.trickleLocal(peer, peerConn)
 
 	// Устанавливаем remote description (offer)
-	if err := peerConn.SetRemoteDescription(offer); err != nil {
+	if err := trickle.setRemoteDescription(peerConn, offer); err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("set remote description: %w", err),
-		}
+		})
 		return
 	}
 
@@ -1126,35 +2084,21 @@ func (c *Connector) handleIncomingOffer(peerID router.PeerID, offerJSON []byte)
 	answer, err := peerConn.CreateAnswer(nil)
 	if err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("create answer: %w", err),
-		}
+		})
 		return
 	}
 
 	if err := peerConn.SetLocalDescription(answer); err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("set local description: %w", err),
-		}
-		return
-	}
-
-	// Ждем сбор ICE candidates
-	gatherComplete := webrtc.GatheringCompletePromise(peerConn)
-	select {
-	case <-gatherComplete:
-	case <-time.After(5 * time.Second):
-		peerConn.Close()
-		c.events <- Event{
-			Type:   EventConnectionFailed,
-			PeerID: peerID,
-			Error:  fmt.Errorf("ICE gathering timeout"),
-		}
+		})
 		return
 	}
 
@@ -1162,11 +2106,11 @@ func (c *Connector) handleIncomingOffer(peerID router.PeerID, offerJSON []byte)
 	answerJSON, err := json.Marshal(peerConn.LocalDescription())
 	if err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("marshal answer: %w", err),
-		}
+		})
 		return
 	}
 
@@ -1177,33 +2121,29 @@ func (c *Connector) handleIncomingOffer(peerID router.PeerID, offerJSON []byte)
 		slog.Warn("No peer key when sending answer, sending KEY_EXCHANGE", "peerID", hexID+"...")
 		if err := c.sendKeyExchange(peerID); err != nil {
 			peerConn.Close()
-			c.events <- Event{
+			c.emit(Event{
 				Type:   EventConnectionFailed,
 				PeerID: peerID,
 				Error:  fmt.Errorf("send key exchange: %w", err),
-			}
+			})
 			return
 		}
 		// Ждем ключ с таймаутом
-		timeout := time.After(5 * time.Second)
-		ticker := time.NewTicker(100 * time.Millisecond)
-		defer ticker.Stop()
-	waitForKey:
-		for {
-			select {
-			case <-timeout:
-				peerConn.Close()
-				c.events <- Event{
-					Type:   EventConnectionFailed,
-					PeerID: peerID,
-					Error:  fmt.Errorf("timeout waiting for peer key"),
-				}
-				return
-			case <-ticker.C:
-				if _, ok := c.peerEncKeys.Load(peerID); ok {
-					break waitForKey
-				}
-			}
+		keyCtx, cancelKey := context.WithTimeout(context.Background(), c.keyExchangeTimeout)
+		err := c.waitPeerKey(keyCtx, peerID)
+		cancelKey()
+		if errors.Is(err, ErrConnectorClosed) {
+			peerConn.Close()
+			return
+		}
+		if err != nil {
+			peerConn.Close()
+			c.emit(Event{
+				Type:   EventConnectionFailed,
+				PeerID: peerID,
+				Error:  fmt.Errorf("timeout waiting for peer key"),
+			})
+			return
 		}
 	}
 
@@ -1211,28 +2151,23 @@ func (c *Connector) handleIncomingOffer(peerID router.PeerID, offerJSON []byte)
 	encryptedAnswer, err := c.encryptMessageForPeer(peerID, answerJSON)
 	if err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("encrypt answer: %w", err),
-		}
+		})
 		return
 	}
 
 	// SECURITY: Подписываем зашифрованный answer нашим Ed25519 приватным ключом
-	signature := SignMessage(encryptedAnswer, c.edPrivKey)
-	signedMsg := SignedMessage{
-		Payload:   encryptedAnswer,
-		Signature: signature,
-	}
-	signedMsgJSON, err := json.Marshal(signedMsg)
+	signedMsg, err := c.signEnvelope(peerID, encryptedAnswer)
 	if err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
-			Error:  fmt.Errorf("marshal signed answer: %w", err),
-		}
+			Error:  fmt.Errorf("sign answer: %w", err),
+		})
 		return
 	}
 	slog.Debug("Sending signed encrypted answer", "peerID", hex.EncodeToString(peerID[:8])+"...")
@@ -1241,38 +2176,46 @@ func (c *Connector) handleIncomingOffer(peerID router.PeerID, offerJSON []byte)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	respCh, err := c.cli.Send(ctx, peerID, signedMsgJSON)
+	respCh, err := c.sendSignaling(ctx, peerID, signedMsg)
 	if err != nil {
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  fmt.Errorf("send answer: %w", err),
-		}
+		})
 		return
 	}
 
 	// Ждем подтверждение
 	select {
-	case resp := <-respCh:
-		if resp.Type == router.Success {
-			c.peers.Store(peerID, peer)
+	case resp, ok := <-respCh:
+		if ok && resp.Type == router.Success {
+			c.storePeer(peer)
+			c.flushLocalCandidates(peer)
 		} else {
+			// Канал закрыт без ответа по таймауту запроса
+			err := ErrConnectionTimeout
+			if ok {
+				err = fmt.Errorf("answer rejected: %w", routerResponseError(resp))
+			}
 			peerConn.Close()
-			c.events <- Event{
+			c.emit(Event{
 				Type:   EventConnectionFailed,
 				PeerID: peerID,
-				Error:  fmt.Errorf("answer rejected: type=%v", resp.Type),
-			}
+				Error:  err,
+			})
 		}
 	case <-time.After(10 * time.Second):
 		peerConn.Close()
-		c.events <- Event{
+		c.emit(Event{
 			Type:   EventConnectionFailed,
 			PeerID: peerID,
 			Error:  ErrConnectionTimeout,
-		}
+		})
 	case <-ctx.Done():
 		peerConn.Close()
+	case <-c.done:
+		peerConn.Close()
 	}
 }
@@ -1,21 +1,122 @@
 package p2p
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pion/logging"
+	"github.com/pion/transport/v3/vnet"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/goleak"
+
 	"github.com/udisondev/sendy/router"
 )
 
+// startTestRouter запускает router на свободном порту и возвращает его адрес
+func startTestRouter(t testing.TB, cfg router.RouterConfig) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	r := router.NewRouter(cfg)
+	go r.Serve(lis)
+
+	return lis.Addr().String()
+}
+
+// dialTestClient подключает к router клиента с ключом privkey
+func dialTestClient(t testing.TB, addr string, privkey ed25519.PrivateKey) (*router.Client, <-chan router.ServerMessage) {
+	t.Helper()
+
+	client := router.NewClient(privkey.Public().(ed25519.PublicKey), privkey)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	income, err := client.Dial(ctx, addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	return client, income
+}
+
+// newTestConnector создает коннектор нового пира, подключенного к router по
+// addr. Без addr коннектор не подключается к router'у
+func newTestConnector(t testing.TB, addr string, cfg ConnectorConfig) (*Connector, router.PeerID) {
+	t.Helper()
+
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	var peerID router.PeerID
+	copy(peerID[:], pubkey)
+	return newTestConnectorWithKey(t, addr, privkey, cfg), peerID
+}
+
+// newTestConnectorWithKey создает коннектор пира с ключом privkey. Коннектор
+// закрывается в Cleanup
+func newTestConnectorWithKey(t testing.TB, addr string, privkey ed25519.PrivateKey, cfg ConnectorConfig) *Connector {
+	t.Helper()
+
+	client := router.NewClient(privkey.Public().(ed25519.PublicKey), privkey)
+	var income <-chan router.ServerMessage
+	if addr != "" {
+		client, income = dialTestClient(t, addr, privkey)
+	}
+	connector, err := NewConnector(client, cfg, income, privkey)
+	if err != nil {
+		t.Fatalf("Failed to create connector: %v", err)
+	}
+	t.Cleanup(func() { connector.Close() })
+	return connector
+}
+
+// dialSilentPeer подключает к router пира без коннектора: сигнальные
+// сообщения до него доходят, но ответа на них нет
+func dialSilentPeer(t testing.TB, addr string) router.PeerID {
+	t.Helper()
+
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	var peerID router.PeerID
+	copy(peerID[:], pubkey)
+
+	_, income := dialTestClient(t, addr, privkey)
+	go func() {
+		for range income {
+		}
+	}()
+	return peerID
+}
+
+// collectEvents пересылает события коннектора в буферизованный канал
+func collectEvents(connector *Connector) chan Event {
+	events := make(chan Event, 10)
+	go func() {
+		for event := range connector.Events() {
+			events <- event
+		}
+	}()
+	return events
+}
+
 func TestWebRTCIntegration(t *testing.T) {
 	// Запускаем router сервер
 	addr := "localhost:18080"
 	go func() {
-		if err := router.Run(addr); err != nil {
+		if err := router.Run(addr, router.RouterConfig{}); err != nil {
 			t.Logf("Router server error: %v", err)
 		}
 	}()
@@ -127,6 +228,10 @@ func TestWebRTCIntegration(t *testing.T) {
 		}
 	}()
 
+	// Даем router'у зарегистрировать пиров: без ожидания сбора кандидатов
+	// KEY_EXCHANGE уходит раньше, чем router узнает о Peer2
+	time.Sleep(100 * time.Millisecond)
+
 	// Peer1 инициирует подключение к Peer2
 	t.Log("Peer1: Initiating connection to Peer2...")
 	hexID2 := hex.EncodeToString(peerID2[:])
@@ -152,6 +257,14 @@ func TestWebRTCIntegration(t *testing.T) {
 		t.Fatal("Timeout waiting for peer2 connection")
 	}
 
+	// После KEY_EXCHANGE пиры одной версии перешли на бинарный конверт
+	if _, ok := connector1.binarySignal.Load(peerID2); !ok {
+		t.Fatal("Peer1 did not switch to binary signaling")
+	}
+	if _, ok := connector2.binarySignal.Load(peerID1); !ok {
+		t.Fatal("Peer2 did not switch to binary signaling")
+	}
+
 	// Даем DataChannel время полностью открыться
 	time.Sleep(500 * time.Millisecond)
 
@@ -237,7 +350,7 @@ func TestWebRTCSimultaneousConnect(t *testing.T) {
 	// Запускаем router сервер
 	addr := "localhost:18081"
 	go func() {
-		if err := router.Run(addr); err != nil {
+		if err := router.Run(addr, router.RouterConfig{}); err != nil {
 			t.Logf("Router server error: %v", err)
 		}
 	}()
@@ -364,7 +477,7 @@ func BenchmarkWebRTCThroughput(b *testing.B) {
 	// Запускаем router сервер
 	addr := "localhost:18082"
 	go func() {
-		router.Run(addr)
+		router.Run(addr, router.RouterConfig{})
 	}()
 	time.Sleep(100 * time.Millisecond)
 
@@ -446,3 +559,1712 @@ func BenchmarkWebRTCThroughput(b *testing.B) {
 	fmt.Printf("\nReceived %d/%d messages (%.1f%%)\n",
 		receivedCount, b.N, float64(receivedCount)/float64(b.N)*100)
 }
+
+func TestMaxPeers(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	hub, _ := newTestConnector(t, addr, ConnectorConfig{MaxPeers: 2})
+	defer hub.DisconnectAll()
+
+	var remoteIDs []router.PeerID
+	for i := 0; i < 3; i++ {
+		remote, id := newTestConnector(t, addr, ConnectorConfig{})
+		defer remote.DisconnectAll()
+		go func() {
+			for range remote.Events() {
+			}
+		}()
+		remoteIDs = append(remoteIDs, id)
+	}
+
+	failed := make(chan Event, 3)
+	go func() {
+		for event := range hub.Events() {
+			if event.Type == EventConnectionFailed {
+				failed <- event
+			}
+		}
+	}()
+
+	// Подключаемся ко всем трем одновременно
+	for _, id := range remoteIDs {
+		go func() {
+			if err := hub.Connect(hex.EncodeToString(id[:])); err != nil {
+				t.Errorf("Connect failed: %v", err)
+			}
+		}()
+	}
+
+	select {
+	case event := <-failed:
+		if !errors.Is(event.Error, ErrMaxPeersReached) {
+			t.Fatalf("Expected ErrMaxPeersReached, got %v", event.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for third connection to fail")
+	}
+
+	// Только одна попытка должна упасть из-за лимита
+	select {
+	case event := <-failed:
+		if errors.Is(event.Error, ErrMaxPeersReached) {
+			t.Fatalf("More than one connection refused: %v", event.Error)
+		}
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if n := len(hub.GetActivePeers()); n > 2 {
+		t.Fatalf("Expected at most 2 active peers, got %d", n)
+	}
+}
+
+func TestConnectorCloseNoLeaks(t *testing.T) {
+	// Проверка после остальных Cleanup: они закрывают коннекторы, клиентов
+	// и router
+	ignore := goleak.IgnoreCurrent()
+	t.Cleanup(func() { goleak.VerifyNone(t, ignore) })
+
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	connector1, _ := newTestConnector(t, addr, ConnectorConfig{})
+	connector2, peerID2 := newTestConnector(t, addr, ConnectorConfig{})
+
+	connected := make(chan struct{})
+	events1Done := make(chan struct{})
+	events2Done := make(chan struct{})
+	go func() {
+		defer close(events1Done)
+		for event := range connector1.Events() {
+			if event.Type == EventConnected {
+				close(connected)
+			}
+		}
+	}()
+	go func() {
+		defer close(events2Done)
+		for range connector2.Events() {
+		}
+	}()
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	if err := connector1.Connect(hex.EncodeToString(peerID2[:])); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout waiting for connection")
+	}
+
+	if err := connector1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := connector2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Каналы событий должны быть закрыты
+	for _, done := range []chan struct{}{events1Done, events2Done} {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Events channel was not closed")
+		}
+	}
+
+	if err := connector1.Connect(hex.EncodeToString(peerID2[:])); !errors.Is(err, ErrConnectorClosed) {
+		t.Fatalf("Expected ErrConnectorClosed, got %v", err)
+	}
+}
+
+func TestNamedDataChannels(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	connector1, peerID1 := newTestConnector(t, addr, ConnectorConfig{})
+	connector2, peerID2 := newTestConnector(t, addr, ConnectorConfig{})
+
+	received := make(chan []byte, 1)
+	go func() {
+		for event := range connector1.Events() {
+			if event.Type == EventDataReceived {
+				received <- event.Data
+			}
+		}
+	}()
+	go func() {
+		for range connector2.Events() {
+		}
+	}()
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	if err := connector1.Connect(hex.EncodeToString(peerID2[:])); err != nil {
+		t.Fatal(err)
+	}
+
+	// Каналы отвечающей стороны появляются через OnDataChannel, ждем пока
+	// откроется "bulk"
+	payload := []byte("file chunk")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		peer, ok := connector2.GetPeer(peerID1)
+		if ok {
+			if err := peer.SendOn(BulkChannelLabel, payload); err == nil {
+				if err := peer.SendOn("missing", payload); !errors.Is(err, ErrChannelNotFound) {
+					t.Fatalf("Expected ErrChannelNotFound, got %v", err)
+				}
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for bulk channel")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case data := <-received:
+		if string(data) != string(payload) {
+			t.Fatalf("Payload mismatch: got %q, want %q", data, payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for data on bulk channel")
+	}
+
+	stats, ok := connector2.GetStats()[peerID1]
+	if !ok {
+		t.Fatal("Expected stats for connected peer")
+	}
+	if stats.State != webrtc.PeerConnectionStateConnected || stats.Relayed {
+		t.Fatalf("Unexpected state: %+v", stats)
+	}
+	if stats.BytesSent == 0 || stats.PacketsSent == 0 {
+		t.Fatalf("Expected traffic in stats: %+v", stats)
+	}
+	// На localhost пара кандидатов не идет через TURN
+	if stats.LocalCandidateType == webrtc.ICECandidateTypeUnknown || stats.RemoteCandidateType == webrtc.ICECandidateTypeUnknown {
+		t.Fatalf("Expected selected candidate pair: %+v", stats)
+	}
+	if stats.LocalCandidateType == webrtc.ICECandidateTypeRelay {
+		t.Fatalf("Unexpected relay candidate on loopback: %+v", stats)
+	}
+
+	// Сообщение шифрует одна сторона и расшифровывает другая
+	if n := connector2.Stats().MessagesEncrypted; n == 0 {
+		t.Fatal("Expected encrypted messages on sender")
+	}
+	if n := connector1.Stats().MessagesDecrypted; n == 0 {
+		t.Fatal("Expected decrypted messages on receiver")
+	}
+}
+
+// TestUnorderedDataChannel проверяет канал без порядка и повторных
+// отправок в сети с потерями: его сообщения теряются, но каждое приходит
+// не больше одного раза и с меткой своего канала, а надежный канал
+// доставляет все, обгоняемый сообщениями ненадежного
+func TestUnorderedDataChannel(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	// WebRTC идет через виртуальную сеть, которая после установки
+	// соединения теряет каждый десятый пакет
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "10.0.0.0/24",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Останавливается после Close коннекторов (Cleanup выполняются в обратном порядке)
+	t.Cleanup(func() { wan.Stop() })
+	var lossy atomic.Bool
+	var packets atomic.Uint64
+	wan.AddChunkFilter(func(vnet.Chunk) bool {
+		return !lossy.Load() || packets.Add(1)%10 != 0
+	})
+
+	const presenceLabel = "presence"
+	var noRetransmits uint16
+	channels := append(DefaultDataChannels(), DataChannelConfig{
+		Label:          presenceLabel,
+		Ordered:        false,
+		MaxRetransmits: &noRetransmits,
+	})
+
+	newConnector := func(ip string) (*Connector, router.PeerID) {
+		nw, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wan.AddNet(nw); err != nil {
+			t.Fatal(err)
+		}
+		return newTestConnector(t, addr, ConnectorConfig{DataChannels: channels, net: nw})
+	}
+
+	connector1, peerID1 := newConnector("10.0.0.1")
+	connector2, peerID2 := newConnector("10.0.0.2")
+	if err := wan.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan Event, 1024)
+	go func() {
+		for event := range connector2.Events() {
+			if event.Type == EventDataReceived {
+				received <- event
+			}
+		}
+	}()
+	go func() {
+		for range connector1.Events() {
+		}
+	}()
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := <-connector1.ConnectContext(ctx, hex.EncodeToString(peerID2[:])); err != nil {
+		t.Fatal(err)
+	}
+	peer1, ok := connector1.GetPeer(peerID2)
+	if !ok {
+		t.Fatal("Expected connected peer")
+	}
+
+	// Параметры канала доходят до отвечающей стороны через DCEP
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if peer2, ok := connector2.GetPeer(peerID1); ok {
+			peer2.mu.Lock()
+			dc := peer2.dataChannels[presenceLabel]
+			peer2.mu.Unlock()
+			if dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
+				if dc.Ordered() || dc.MaxRetransmits() == nil || *dc.MaxRetransmits() != 0 {
+					t.Fatalf("Unexpected presence channel options: ordered=%v maxRetransmits=%v", dc.Ordered(), dc.MaxRetransmits())
+				}
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for presence channel")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Сессионные ключи уже есть, иначе handshake мог бы потеряться вместе с пакетом
+	if err := peer1.session.waitReady(nil); err != nil {
+		t.Fatal(err)
+	}
+	lossy.Store(true)
+
+	// Пачка сообщений вперемешку с надежным каналом
+	const count = 500
+	const orderedCount = count / 50
+	for i := range count {
+		if err := peer1.SendOn(presenceLabel, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+		if i%50 == 0 {
+			if err := peer1.Send([]byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	seen := make(map[int]bool)
+	var ordered, overtaken int
+	var lastPresence int
+	timeout := time.After(20 * time.Second)
+	for ordered < orderedCount {
+		select {
+		case event := <-received:
+			n, err := strconv.Atoi(string(event.Data))
+			if err != nil || n < 0 || n >= count {
+				t.Fatalf("Unexpected payload %q on %q", event.Data, event.Channel)
+			}
+			switch event.Channel {
+			case DataChannelLabel:
+				if n != ordered*50 {
+					t.Fatalf("Ordered channel: got %d, want %d", n, ordered*50)
+				}
+				if n < lastPresence {
+					overtaken++
+				}
+				ordered++
+			case presenceLabel:
+				if seen[n] {
+					t.Fatalf("Message %d delivered twice", n)
+				}
+				seen[n] = true
+				lastPresence = max(lastPresence, n)
+			default:
+				t.Fatalf("Unexpected channel %q", event.Channel)
+			}
+		case <-timeout:
+			t.Fatalf("Timeout: %d of %d ordered messages delivered", ordered, orderedCount)
+		}
+	}
+
+	if len(seen) == 0 || len(seen) == count {
+		t.Fatalf("Expected some presence messages to be lost, delivered %d of %d", len(seen), count)
+	}
+	t.Logf("Presence: %d of %d delivered, ordered messages overtaken: %d", len(seen), count, overtaken)
+}
+
+// TestLargeMessages проверяет сообщения больше предела SCTP: 1 MB по
+// одному каналу и одновременные сообщения по двум каналам, фрагменты
+// которых чередуются
+func TestLargeMessages(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	connector1, _ := newTestConnector(t, addr, ConnectorConfig{})
+	connector2, peerID2 := newTestConnector(t, addr, ConnectorConfig{})
+
+	received := make(chan Event, 10)
+	go func() {
+		for event := range connector2.Events() {
+			if event.Type == EventDataReceived {
+				received <- event
+			}
+		}
+	}()
+	go func() {
+		for range connector1.Events() {
+		}
+	}()
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := <-connector1.ConnectContext(ctx, hex.EncodeToString(peerID2[:])); err != nil {
+		t.Fatal(err)
+	}
+	peer, ok := connector1.GetPeer(peerID2)
+	if !ok {
+		t.Fatal("Expected connected peer")
+	}
+	// Каналы открываются после установки соединения
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		peer.mu.Lock()
+		dc := peer.dataChannels[BulkChannelLabel]
+		peer.mu.Unlock()
+		if dc.ReadyState() == webrtc.DataChannelStateOpen {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for bulk channel")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	message := func(fill byte, size int) []byte {
+		data := bytes.Repeat([]byte{fill}, size)
+		binary.BigEndian.PutUint32(data, uint32(size))
+		return data
+	}
+	receive := func() Event {
+		t.Helper()
+		select {
+		case event := <-received:
+			return event
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timeout waiting for message")
+			return Event{}
+		}
+	}
+
+	large := message('a', 1<<20)
+	if err := peer.SendOn(BulkChannelLabel, large); err != nil {
+		t.Fatal(err)
+	}
+	if event := receive(); !bytes.Equal(event.Data, large) || event.Channel != BulkChannelLabel {
+		t.Fatalf("Got %d bytes on %q, want %d bytes", len(event.Data), event.Channel, len(large))
+	}
+	if n := connector1.Stats().MessagesEncrypted; n < uint64(len(large)/maxFragmentSize) {
+		t.Fatalf("Expected message to be sent in fragments, encrypted %d", n)
+	}
+
+	// Два сообщения отправляются одновременно по разным каналам
+	want := map[string][]byte{
+		DataChannelLabel: message('d', 1<<20+7),
+		BulkChannelLabel: message('b', 1<<20-3),
+	}
+	errs := make(chan error, len(want))
+	for label, data := range want {
+		go func() { errs <- peer.SendOn(label, data) }()
+	}
+	for range want {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for len(want) > 0 {
+		event := receive()
+		if !bytes.Equal(event.Data, want[event.Channel]) {
+			t.Fatalf("Message on %q corrupted: %d bytes", event.Channel, len(event.Data))
+		}
+		delete(want, event.Channel)
+	}
+
+	if err := peer.Send(make([]byte, MaxMessageSize+1)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Expected ErrMessageTooLarge, got %v", err)
+	}
+	if val, ok := connector2.peers.Load(connector1.LocalID()); ok {
+		if n := val.(*Peer).reassembly.pending(); n != 0 {
+			t.Fatalf("Expected no partial messages, got %d", n)
+		}
+	}
+}
+
+func TestDataChannelsConfigValidation(t *testing.T) {
+	_, privkey, _ := ed25519.GenerateKey(nil)
+
+	for name, channels := range map[string][]DataChannelConfig{
+		"MissingData": {{Label: BulkChannelLabel}},
+		"Duplicate":   {{Label: DataChannelLabel}, {Label: DataChannelLabel}},
+		"EmptyLabel":  {{Label: DataChannelLabel}, {Label: ""}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewConnector(nil, ConnectorConfig{DataChannels: channels}, nil, privkey); err == nil {
+				t.Fatal("Expected config error")
+			}
+		})
+	}
+}
+
+func TestRelayFallback(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	connector1, peerID1 := newTestConnector(t, addr, ConnectorConfig{RelayFallback: true})
+	connector2, peerID2 := newTestConnector(t, addr, ConnectorConfig{RelayFallback: true})
+	events1, events2 := collectEvents(connector1), collectEvents(connector2)
+
+	waitEvent := func(events chan Event, want EventType) Event {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case event := <-events:
+				if event.Type == want {
+					return event
+				}
+			case <-timeout:
+				t.Fatalf("Timeout waiting for event %d", want)
+			}
+		}
+	}
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	// Ключи обмениваются до SDP, к моменту отказа ICE они уже есть
+	if err := connector1.sendKeyExchange(peerID2); err != nil {
+		t.Fatal(err)
+	}
+	keyCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := connector1.waitPeerKey(keyCtx, peerID2); err != nil {
+		t.Fatalf("Timeout waiting for key exchange: %v", err)
+	}
+
+	// Эмулируем отказ ICE
+	go connector1.fallbackToRelay(peerID2, ErrICEFailed)
+
+	event1 := waitEvent(events1, EventConnectedRelay)
+	event2 := waitEvent(events2, EventConnectedRelay)
+	if !event1.Peer.Relayed() || !event2.Peer.Relayed() {
+		t.Fatal("Expected relayed peers")
+	}
+
+	// Оба канала работают через relay, неизвестный - нет
+	if err := event1.Peer.SendOn(BulkChannelLabel, []byte("file chunk")); err != nil {
+		t.Fatal(err)
+	}
+	if err := event2.Peer.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := event1.Peer.SendOn("missing", nil); !errors.Is(err, ErrChannelNotFound) {
+		t.Fatalf("Expected ErrChannelNotFound, got %v", err)
+	}
+
+	if event := waitEvent(events2, EventDataReceived); string(event.Data) != "file chunk" || event.Channel != BulkChannelLabel {
+		t.Fatalf("Peer2 got %q on %q", event.Data, event.Channel)
+	}
+	if data := waitEvent(events1, EventDataReceived).Data; string(data) != "hello" {
+		t.Fatalf("Peer1 got %q", data)
+	}
+
+	stats := connector1.GetStats()[peerID2]
+	if !stats.Relayed || stats.BytesSent != uint64(len("file chunk")) || stats.PacketsReceived != 1 {
+		t.Fatalf("Unexpected relay stats: %+v", stats)
+	}
+
+	// Данные шли с сеансовыми ключами, кадр без них после обмена отбрасывается
+	if !event1.Peer.session.isReady() || !event2.Peer.session.isReady() {
+		t.Fatal("Expected relay session keys on both sides")
+	}
+	if err := connector1.sendRelayFrame(peerID2, relayFrame{Op: relayOpData, Data: []byte("forged")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := event1.Peer.Send([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if data := waitEvent(events2, EventDataReceived).Data; string(data) != "after" {
+		t.Fatalf("Peer2 got %q, expected frame without session key to be dropped", data)
+	}
+
+	// RPC работает через relay с сеансовыми ключами
+	connector2.Handle("echo", func(ctx context.Context, peer *Peer, payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if resp, err := event1.Peer.Request(ctx, "echo", []byte("relayed")); err != nil || string(resp) != "relayed" {
+		t.Fatalf("Relay request failed: %q, %v", resp, err)
+	}
+
+	if err := connector1.Disconnect(peerID2); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(events2, EventDisconnected)
+	if _, ok := connector2.GetPeer(peerID1); ok {
+		t.Fatal("Relay peer must be removed after close")
+	}
+
+	// Инициатор прежней версии не отмечает session в open: relay работает
+	// без сеансовых ключей
+	if err := connector1.sendRelayFrame(peerID2, relayFrame{Op: relayOpOpen}); err != nil {
+		t.Fatal(err)
+	}
+	legacy := newRelayPeer(peerID2, connector1, false)
+	connector1.peers.Store(peerID2, legacy)
+	event2 = waitEvent(events2, EventConnectedRelay)
+	if event2.Peer.session != nil {
+		t.Fatal("Expected relay without session keys for old initiator")
+	}
+	if err := legacy.Send([]byte("legacy")); err != nil {
+		t.Fatal(err)
+	}
+	if event := waitEvent(events2, EventDataReceived); string(event.Data) != "legacy" || event.Channel != DataChannelLabel {
+		t.Fatalf("Peer2 got %q on %q", event.Data, event.Channel)
+	}
+	if err := event2.Peer.Send([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	if data := waitEvent(events1, EventDataReceived).Data; string(data) != "reply" {
+		t.Fatalf("Peer1 got %q", data)
+	}
+	if _, err := event2.Peer.Request(ctx, "echo", nil); !errors.Is(err, ErrRPCNotSupported) {
+		t.Fatalf("Expected ErrRPCNotSupported without session keys, got %v", err)
+	}
+}
+
+// TestTrickleICE проверяет, что соединение на localhost устанавливается без
+// ожидания сбора всех кандидатов
+func TestTrickleICE(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	// Недоступный STUN сервер: без trickle ICE ответ ждал бы таймаута сбора
+	cfg := ConnectorConfig{STUNServers: []string{"stun:192.0.2.1:3478"}}
+
+	connector1, peerID1 := newTestConnector(t, addr, cfg)
+	connector2, peerID2 := newTestConnector(t, addr, cfg)
+	events1, events2 := collectEvents(connector1), collectEvents(connector2)
+
+	waitConnected := func(events chan Event) {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case event := <-events:
+				switch event.Type {
+				case EventConnected:
+					return
+				case EventConnectionFailed:
+					t.Fatalf("Connection failed: %v", event.Error)
+				}
+			case <-timeout:
+				t.Fatal("Timeout waiting for connection")
+			}
+		}
+	}
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if err := connector1.Connect(hex.EncodeToString(peerID2[:])); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(events1)
+	waitConnected(events2)
+	elapsed := time.Since(start)
+	t.Logf("Connection established in %v", elapsed)
+
+	if elapsed > time.Second {
+		t.Fatalf("Connection setup took %v, expected under 1s", elapsed)
+	}
+	if _, ok := connector1.GetPeer(peerID2); !ok {
+		t.Fatal("Peer2 not found in connector1")
+	}
+	if _, ok := connector2.GetPeer(peerID1); !ok {
+		t.Fatal("Peer1 not found in connector2")
+	}
+}
+
+// TestICERestart проверяет, что ICE restart восстанавливает соединение без
+// EventDisconnected, в том числе при одновременном restart с обеих сторон
+func TestICERestart(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	connector1, peerID1 := newTestConnector(t, addr, ConnectorConfig{})
+	connector2, peerID2 := newTestConnector(t, addr, ConnectorConfig{})
+	events1, events2 := collectEvents(connector1), collectEvents(connector2)
+
+	waitEvent := func(events chan Event, want EventType) Event {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case event := <-events:
+				switch event.Type {
+				case want:
+					return event
+				case EventDisconnected, EventConnectionFailed:
+					t.Fatalf("Unexpected event %d while waiting for %d: %v", event.Type, want, event.Error)
+				}
+			case <-timeout:
+				t.Fatalf("Timeout waiting for event %d", want)
+			}
+		}
+	}
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	if err := connector1.Connect(hex.EncodeToString(peerID2[:])); err != nil {
+		t.Fatal(err)
+	}
+	peer1 := waitEvent(events1, EventConnected).Peer
+	peer2 := waitEvent(events2, EventConnected).Peer
+	time.Sleep(500 * time.Millisecond) // Даем время DataChannel открыться
+
+	exchange := func() {
+		t.Helper()
+		if err := peer1.Send([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if data := waitEvent(events2, EventDataReceived).Data; string(data) != "ping" {
+			t.Fatalf("Peer2 got %q", data)
+		}
+		if err := peer2.Send([]byte("pong")); err != nil {
+			t.Fatal(err)
+		}
+		if data := waitEvent(events1, EventDataReceived).Data; string(data) != "pong" {
+			t.Fatalf("Peer1 got %q", data)
+		}
+	}
+
+	// Offer отправляет пир с меньшим ID, другой пир просит о restart
+	sides := []struct {
+		name      string
+		connector *Connector
+		peer      *Peer
+		events    chan Event
+		remote    *Peer
+	}{
+		{"peer1", connector1, peer1, events1, peer2},
+		{"peer2", connector2, peer2, events2, peer1},
+	}
+	for _, side := range sides {
+		t.Run(side.name, func(t *testing.T) {
+			oldUfrag := iceUfrag(t, side.remote.conn.RemoteDescription())
+			if !side.connector.beginICERestart(side.peer) {
+				t.Fatal("Restart not started")
+			}
+			waitEvent(side.events, EventReconnecting)
+			if !side.peer.Reconnecting() {
+				t.Fatal("Peer must be reconnecting until ICE connects again")
+			}
+			waitEvent(side.events, EventConnected)
+			if side.peer.Reconnecting() {
+				t.Fatal("Peer must not be reconnecting after restart")
+			}
+			if iceUfrag(t, side.remote.conn.RemoteDescription()) == oldUfrag {
+				t.Fatal("Remote peer did not receive new ICE credentials")
+			}
+			exchange()
+		})
+	}
+
+	t.Run("both sides", func(t *testing.T) {
+		// Оба пира заметили обрыв одновременно
+		connector1.beginICERestart(peer1)
+		connector2.beginICERestart(peer2)
+		waitEvent(events1, EventReconnecting)
+		waitEvent(events2, EventReconnecting)
+		waitEvent(events1, EventConnected)
+		waitEvent(events2, EventConnected)
+		exchange()
+	})
+
+	if _, ok := connector1.GetPeer(peerID2); !ok {
+		t.Fatal("Peer2 not found in connector1")
+	}
+	if _, ok := connector2.GetPeer(peerID1); !ok {
+		t.Fatal("Peer1 not found in connector2")
+	}
+}
+
+// iceUfrag возвращает ICE ufrag из SDP
+func iceUfrag(t *testing.T, desc *webrtc.SessionDescription) string {
+	t.Helper()
+	for _, line := range strings.Split(desc.SDP, "\r\n") {
+		if ufrag, ok := strings.CutPrefix(line, "a=ice-ufrag:"); ok {
+			return ufrag
+		}
+	}
+	t.Fatal("No ice-ufrag in SDP")
+	return ""
+}
+
+// TestSendWithContext проверяет, что отмена контекста возвращает управление,
+// даже если отправка зависла
+func TestSendWithContext(t *testing.T) {
+	peer := newPeer(router.PeerID{1}, nil, nil)
+
+	// Зависшая отправка держит mu, следующая ждет его
+	peer.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := peer.SendWithContext(ctx, []byte("stuck"))
+	elapsed := time.Since(start)
+	peer.mu.Unlock()
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed > time.Second {
+		t.Fatalf("Send returned after %v, expected right after cancellation", elapsed)
+	}
+
+	// Отмененный контекст не начинает отправку
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := peer.SendWithContext(cancelled, []byte("late")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// Ошибка самой отправки возвращается как есть
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := peer.SendWithContext(ctx, []byte("hello")); !errors.Is(err, ErrChannelNotFound) {
+		t.Fatalf("Expected ErrChannelNotFound, got %v", err)
+	}
+}
+
+// TestWaitPeerKey проверяет, что ожидание ключа пира завершается по
+// KEY_EXCHANGE, а без него - по таймауту
+func TestWaitPeerKey(t *testing.T) {
+	c := &Connector{done: make(chan struct{})}
+	peerID := router.PeerID{1}
+
+	keyExchange := &EncryptedMessage{
+		SenderEncPubKey: [32]byte{2},
+		EncryptedData:   []byte("KEY_EXCHANGE_V1"),
+	}
+
+	// Ожидания, начатые до получения ключа
+	const waiters = 10
+	results := make(chan error, waiters)
+	for range waiters {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			results <- c.waitPeerKey(ctx, peerID)
+		}()
+	}
+
+	// Повторный KEY_EXCHANGE не должен сигналить второй раз (close закрытого канала)
+	for range 2 {
+		if _, err := c.decryptMessageFromPeer(peerID, keyExchange); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range waiters {
+		if err := <-results; err != nil {
+			t.Fatalf("Waiter failed: %v", err)
+		}
+	}
+
+	// Ожидание после получения ключа завершается сразу
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.waitPeerKey(ctx, peerID); err != nil {
+		t.Fatalf("Expected known key, got %v", err)
+	}
+
+	// Пир, не приславший ключ
+	start := time.Now()
+	if err := c.waitPeerKey(ctx, router.PeerID{3}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Timeout took %v", elapsed)
+	}
+
+	// Закрытие коннектора прерывает ожидание
+	close(c.done)
+	if err := c.waitPeerKey(context.Background(), router.PeerID{4}); !errors.Is(err, ErrConnectorClosed) {
+		t.Fatalf("Expected ErrConnectorClosed, got %v", err)
+	}
+}
+
+// TestWaitForPeer проверяет, что ожидание завершает событие соединения
+// или его неудачи, а без событий - ctx
+func TestWaitForPeer(t *testing.T) {
+	c := &Connector{done: make(chan struct{}), closed: true}
+	peerID := router.PeerID{1}
+	peer := &Peer{ID: peerID}
+
+	const waiters = 5
+	results := make(chan *Peer, waiters)
+	for range waiters {
+		go func() {
+			got, err := c.WaitForPeer(context.Background(), peerID)
+			if err != nil {
+				t.Errorf("WaitForPeer: %v", err)
+			}
+			results <- got
+		}()
+	}
+	// Ждем регистрации первого ожидания. Опоздавшие к событию найдут
+	// установленное соединение в peers
+	for {
+		if _, ok := c.peerWaiters.Load(peerID); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.emit(Event{Type: EventConnected, PeerID: peerID, Peer: peer})
+	peer.mu.Lock()
+	peer.connected = true
+	peer.mu.Unlock()
+	c.peers.Store(peerID, peer)
+	for range waiters {
+		if got := <-results; got != peer {
+			t.Fatalf("Expected connected peer, got %v", got)
+		}
+	}
+
+	// Уже установленное соединение возвращается сразу
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if got, err := c.WaitForPeer(ctx, peerID); err != nil || got != peer {
+		t.Fatalf("Expected connected peer, got %v, %v", got, err)
+	}
+
+	// Неудачная попытка
+	failedID := router.PeerID{2}
+	failed := make(chan error, 1)
+	go func() {
+		_, err := c.WaitForPeer(context.Background(), failedID)
+		failed <- err
+	}()
+	for {
+		if _, ok := c.peerWaiters.Load(failedID); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.emit(Event{Type: EventConnectionFailed, PeerID: failedID, Error: ErrICEFailed})
+	if err := <-failed; !errors.Is(err, ErrConnectionFailed) || !errors.Is(err, ErrICEFailed) {
+		t.Fatalf("Expected ErrConnectionFailed with cause, got %v", err)
+	}
+
+	// Без событий ожидание завершает ctx
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.WaitForPeer(ctx, router.PeerID{3}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// TestConnectContext проверяет результат ConnectContext: успешное
+// подключение, отмену зависшей попытки и ошибки проверки
+func TestConnectContext(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	connector1, _ := newTestConnector(t, addr, ConnectorConfig{})
+	connector2, peerID2 := newTestConnector(t, addr, ConnectorConfig{})
+	go func() {
+		for range connector1.Events() {
+		}
+	}()
+	go func() {
+		for range connector2.Events() {
+		}
+	}()
+
+	// Пир в сети router'а, который не отвечает на KEY_EXCHANGE
+	silentID := dialSilentPeer(t, addr)
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	t.Run("connected", func(t *testing.T) {
+		select {
+		case err := <-connector1.ConnectContext(context.Background(), hex.EncodeToString(peerID2[:])):
+			if err != nil {
+				t.Fatalf("Expected connection, got %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timeout waiting for connection")
+		}
+		if _, ok := connector1.GetPeer(peerID2); !ok {
+			t.Fatal("Peer not registered after successful connect")
+		}
+
+		// Повторное подключение отклоняется сразу
+		select {
+		case err := <-connector1.ConnectContext(context.Background(), hex.EncodeToString(peerID2[:])):
+			if err == nil {
+				t.Fatal("Expected error for existing connection")
+			}
+		default:
+			t.Fatal("Validation error not delivered before return")
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		attemptCtx, cancelAttempt := context.WithCancel(context.Background())
+		result := connector1.ConnectContext(attemptCtx, hex.EncodeToString(silentID[:]))
+
+		// Вторая попытка к тому же пиру, пока первая не завершилась
+		if err := <-connector1.ConnectContext(context.Background(), hex.EncodeToString(silentID[:])); !errors.Is(err, ErrConnectInProgress) {
+			t.Fatalf("Expected ErrConnectInProgress, got %v", err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		cancelAttempt()
+
+		select {
+		case err := <-result:
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("Expected context.Canceled, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Cancelled attempt did not finish")
+		}
+		if _, ok := connector1.connecting.Load(silentID); ok {
+			t.Fatal("Cancelled attempt still registered")
+		}
+		if _, ok := connector1.pendingOffers.Load(silentID); ok {
+			t.Fatal("Pending offer left after cancellation")
+		}
+	})
+
+	t.Run("invalid id", func(t *testing.T) {
+		if err := <-connector1.ConnectContext(context.Background(), strings.Repeat("zz", router.PeerIDSize)); !errors.Is(err, ErrInvalidIDFormat) {
+			t.Fatalf("Expected ErrInvalidIDFormat, got %v", err)
+		}
+	})
+}
+
+// TestAutoConnect проверяет, что коннектор подключается к пиру, выбранному
+// AutoConnect, как только router сообщает о нем в списке пиров
+func TestAutoConnect(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{EnablePeerList: true})
+
+	pubkey2, privkey2, _ := ed25519.GenerateKey(nil)
+	var peerID2 router.PeerID
+	copy(peerID2[:], pubkey2)
+
+	// Первый пир знает второго, второй о первом не знает
+	connector1, _ := newTestConnector(t, addr, ConnectorConfig{
+		AutoConnect: func(id router.PeerID) bool { return id == peerID2 },
+	})
+
+	connected := make(chan router.PeerID, 1)
+	go func() {
+		for event := range connector1.Events() {
+			if event.Type == EventConnected {
+				connected <- event.PeerID
+			}
+		}
+	}()
+
+	connector2 := newTestConnectorWithKey(t, addr, privkey2, ConnectorConfig{})
+	go func() {
+		for range connector2.Events() {
+		}
+	}()
+
+	select {
+	case id := <-connected:
+		if id != peerID2 {
+			t.Fatalf("Connected to unexpected peer %s", hex.EncodeToString(id[:8]))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout waiting for auto connect")
+	}
+}
+
+// TestSessionRekeyOverDataChannel проверяет смену сеансовых ключей на живом
+// соединении: сообщения по обоим каналам доходят через несколько эпох
+func TestSessionRekeyOverDataChannel(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	cfg := ConnectorConfig{RekeyMessages: 2}
+
+	connector1, _ := newTestConnector(t, addr, cfg)
+	connector2, peerID2 := newTestConnector(t, addr, cfg)
+
+	const messages = 10
+	received := make(chan string, 2*messages)
+	go func() {
+		for event := range connector2.Events() {
+			if event.Type == EventDataReceived {
+				received <- string(event.Data)
+			}
+		}
+	}()
+	go func() {
+		for range connector1.Events() {
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-connector1.ConnectContext(context.Background(), hex.EncodeToString(peerID2[:])):
+		if err != nil {
+			t.Fatalf("Expected connection, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout waiting for connection")
+	}
+	peer, _ := connector1.GetPeer(peerID2)
+
+	// Каналы открываются после EventConnected
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		open := 0
+		peer.mu.Lock()
+		for _, dc := range peer.dataChannels {
+			if dc.ReadyState() == webrtc.DataChannelStateOpen {
+				open++
+			}
+		}
+		peer.mu.Unlock()
+		if open == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for data channels")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Каждые два сообщения начинают rekey, ответ на него приходит, пока
+	// ждем доставки
+	got := make(map[string]bool)
+	for i := range messages {
+		if err := peer.Send([]byte(fmt.Sprintf("data %d", i))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		if err := peer.SendOn(BulkChannelLabel, []byte(fmt.Sprintf("bulk %d", i))); err != nil {
+			t.Fatalf("SendOn failed: %v", err)
+		}
+		for len(got) < 2*(i+1) {
+			select {
+			case msg := <-received:
+				got[msg] = true
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Received %d of %d messages", len(got), 2*(i+1))
+			}
+		}
+	}
+
+	peer.session.mu.Lock()
+	epoch := peer.session.sendEpoch
+	peer.session.mu.Unlock()
+	if epoch < 3 {
+		t.Fatalf("Expected several rekeys, session is at epoch %d", epoch)
+	}
+}
+
+// TestSendBackpressure проверяет, что отправка в цикле быстрее, чем канал
+// успевает передавать, не раздувает буфер DataChannel выше предела
+func TestSendBackpressure(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	const limit = 128 * 1024
+
+	connector1, _ := newTestConnector(t, addr, ConnectorConfig{MaxBufferedAmount: limit})
+	connector2, peerID2 := newTestConnector(t, addr, ConnectorConfig{MaxBufferedAmount: limit})
+
+	const messages = 300
+	received := make(chan struct{}, messages)
+	go func() {
+		for event := range connector2.Events() {
+			if event.Type == EventDataReceived {
+				received <- struct{}{}
+			}
+		}
+	}()
+	go func() {
+		for range connector1.Events() {
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-connector1.ConnectContext(context.Background(), hex.EncodeToString(peerID2[:])):
+		if err != nil {
+			t.Fatalf("Expected connection, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout waiting for connection")
+	}
+	peer, _ := connector1.GetPeer(peerID2)
+
+	var bulk *webrtc.DataChannel
+	deadline := time.Now().Add(10 * time.Second)
+	for bulk == nil || bulk.ReadyState() != webrtc.DataChannelStateOpen {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for bulk channel")
+		}
+		time.Sleep(50 * time.Millisecond)
+		peer.mu.Lock()
+		bulk = peer.dataChannels[BulkChannelLabel]
+		peer.mu.Unlock()
+	}
+
+	// 300 сообщений по 32 KB - почти 10 MB, без ожидания они целиком
+	// оказались бы в буфере
+	payload := make([]byte, 32*1024)
+	var maxBuffered uint64
+	for i := range messages {
+		if err := peer.SendOn(BulkChannelLabel, payload); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+		maxBuffered = max(maxBuffered, bulk.BufferedAmount())
+	}
+
+	// Одна отправка может превысить предел на размер сообщения
+	if maxBuffered > limit+uint64(len(payload))+1024 {
+		t.Fatalf("Buffered amount %d exceeds limit %d", maxBuffered, limit)
+	}
+	for i := range messages {
+		select {
+		case <-received:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Received %d of %d messages", i, messages)
+		}
+	}
+	t.Logf("Max buffered amount %d bytes", maxBuffered)
+}
+
+// TestControlLatencyUnderBulkLoad проверяет, что сообщения канала
+// DataChannelLabel доходят быстро, пока передача файла занимает канал
+// BulkChannelLabel
+func TestControlLatencyUnderBulkLoad(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	connector1, _ := newTestConnector(t, addr, ConnectorConfig{})
+	connector2, peerID2 := newTestConnector(t, addr, ConnectorConfig{})
+
+	control := make(chan string, 10)
+	var bulkReceived atomic.Int64
+	go func() {
+		for event := range connector2.Events() {
+			if event.Type != EventDataReceived {
+				continue
+			}
+			if strings.HasPrefix(string(event.Data), "control") {
+				control <- string(event.Data)
+			} else {
+				bulkReceived.Add(1)
+			}
+		}
+	}()
+	go func() {
+		for range connector1.Events() {
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-connector1.ConnectContext(context.Background(), hex.EncodeToString(peerID2[:])):
+		if err != nil {
+			t.Fatalf("Expected connection, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout waiting for connection")
+	}
+	peer, _ := connector1.GetPeer(peerID2)
+
+	payload := make([]byte, 32*1024)
+	deadline := time.Now().Add(10 * time.Second)
+	for peer.SendOn(BulkChannelLabel, payload) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for bulk channel")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Передача файла шлет чанки, пока не остановим
+	stop := make(chan struct{})
+	flooding := make(chan struct{})
+	go func() {
+		defer close(flooding)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := peer.SendOn(BulkChannelLabel, payload); err != nil {
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-flooding
+	}()
+
+	// Ждем, пока буфер bulk канала заполнится
+	for bulkReceived.Load() < 50 {
+		if time.Now().After(deadline) {
+			t.Fatal("Bulk transfer did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var worst time.Duration
+	for i := range 5 {
+		msg := fmt.Sprintf("control %d", i)
+		start := time.Now()
+		if err := peer.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-control:
+			if got != msg {
+				t.Fatalf("Expected %q, got %q", msg, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Control message %d was not delivered", i)
+		}
+		worst = max(worst, time.Since(start))
+	}
+	t.Logf("Worst control message latency %v, %d bulk messages received", worst, bulkReceived.Load())
+
+	// Сообщение ждет в очереди не больше maxBufferedAmount данных файла.
+	// С неупорядоченным "bulk" оно не доходило до конца передачи
+	if worst > 2*time.Second {
+		t.Fatalf("Control message took %v during bulk transfer", worst)
+	}
+}
+
+// TestSendAll проверяет рассылку всем активным пирам и отчет об ошибках
+func TestSendAll(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	sender, _ := newTestConnector(t, addr, ConnectorConfig{})
+	go func() {
+		for range sender.Events() {
+		}
+	}()
+
+	received := make(chan router.PeerID, 10)
+	var receivers []router.PeerID
+	for range 2 {
+		connector, peerID := newTestConnector(t, addr, ConnectorConfig{})
+		receivers = append(receivers, peerID)
+		go func() {
+			for event := range connector.Events() {
+				if event.Type == EventDataReceived && string(event.Data) == "broadcast" {
+					received <- peerID
+				}
+			}
+		}()
+	}
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, peerID := range receivers {
+		if err := <-sender.ConnectContext(ctx, hex.EncodeToString(peerID[:])); err != nil {
+			t.Fatal(err)
+		}
+		peer, ok := sender.GetPeer(peerID)
+		if !ok {
+			t.Fatal("Expected connected peer")
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			peer.mu.Lock()
+			dc := peer.dataChannels[DataChannelLabel]
+			peer.mu.Unlock()
+			if dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Timeout waiting for data channel")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// Пир без каналов: отправка ему завершается ошибкой, остальным - нет
+	broken := router.PeerID{9}
+	sender.peers.Store(broken, newPeer(broken, nil, nil))
+	defer sender.peers.Delete(broken)
+
+	failures := sender.SendAll([]byte("broadcast"))
+	if len(failures) != 1 || !errors.Is(failures[broken], ErrChannelNotFound) {
+		t.Fatalf("Expected only the broken peer to fail, got %v", failures)
+	}
+
+	got := make(map[router.PeerID]bool)
+	for range receivers {
+		select {
+		case peerID := <-received:
+			got[peerID] = true
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timeout waiting for broadcast")
+		}
+	}
+	for _, peerID := range receivers {
+		if !got[peerID] {
+			t.Fatalf("Peer %x did not receive broadcast", peerID[:8])
+		}
+	}
+}
+
+// TestRPC проверяет запросы между пирами: ответы, ошибки обработчика,
+// конкурентные запросы, таймаут с отменой на стороне пира и закрытие
+// соединения
+func TestRPC(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	connector1, peerID1 := newTestConnector(t, addr, ConnectorConfig{})
+	connector2, peerID2 := newTestConnector(t, addr, ConnectorConfig{})
+
+	cancelled := make(chan struct{}, 1)
+	connector2.Handle("echo", func(ctx context.Context, peer *Peer, payload []byte) ([]byte, error) {
+		if peer.ID != peerID1 {
+			return nil, fmt.Errorf("unexpected peer")
+		}
+		return payload, nil
+	})
+	connector2.Handle("fail", func(ctx context.Context, peer *Peer, payload []byte) ([]byte, error) {
+		return nil, fmt.Errorf("file is busy")
+	})
+	connector2.Handle("slow", func(ctx context.Context, peer *Peer, payload []byte) ([]byte, error) {
+		<-ctx.Done()
+		cancelled <- struct{}{}
+		return nil, ctx.Err()
+	})
+
+	received := make(chan Event, 10)
+	go func() {
+		for event := range connector2.Events() {
+			if event.Type == EventDataReceived {
+				received <- event
+			}
+		}
+	}()
+	go func() {
+		for range connector1.Events() {
+		}
+	}()
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := <-connector1.ConnectContext(ctx, hex.EncodeToString(peerID2[:])); err != nil {
+		t.Fatal(err)
+	}
+	peer, ok := connector1.GetPeer(peerID2)
+	if !ok {
+		t.Fatal("Expected connected peer")
+	}
+
+	resp, err := peer.Request(ctx, "echo", []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "ping" {
+		t.Fatalf("Expected echo, got %q", resp)
+	}
+
+	// Ping - встроенный метод, пир без обработчика тоже отвечает
+	if rtt, err := connector1.Ping(ctx, peerID2); err != nil || rtt <= 0 {
+		t.Fatalf("Ping failed: %v, %v", rtt, err)
+	}
+	connector2.Handle(pingMethod, nil)
+	if _, err := connector1.Ping(ctx, peerID2); err != nil {
+		t.Fatalf("Ping without handler failed: %v", err)
+	}
+	if _, err := connector1.Ping(ctx, router.PeerID{9}); err == nil {
+		t.Fatal("Expected error for ping to an unconnected peer")
+	}
+
+	// Ответ больше одного фрагмента
+	large := bytes.Repeat([]byte{0xab}, 100*1024)
+	if resp, err := peer.Request(ctx, "echo", large); err != nil || !bytes.Equal(resp, large) {
+		t.Fatalf("Large echo failed: %d bytes, %v", len(resp), err)
+	}
+
+	var rpcErr *RPCError
+	if _, err := peer.Request(ctx, "fail", nil); !errors.As(err, &rpcErr) || rpcErr.Message != "file is busy" {
+		t.Fatalf("Expected RPCError, got %v", err)
+	}
+	if _, err := peer.Request(ctx, "missing", nil); !errors.Is(err, ErrUnknownMethod) {
+		t.Fatalf("Expected ErrUnknownMethod, got %v", err)
+	}
+
+	// Обычные данные по-прежнему приходят событием, RPC - нет
+	if err := peer.Send([]byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-received:
+		if string(event.Data) != "plain" {
+			t.Fatalf("Expected plain data, got %q", event.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for plain data")
+	}
+
+	// Конкурентные запросы получают свои ответы
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload := fmt.Appendf(nil, "request-%d", i)
+			resp, err := peer.Request(ctx, "echo", payload)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(resp, payload) {
+				errs <- fmt.Errorf("request %d got %q", i, resp)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Таймаут запроса отменяет обработчик на стороне пира
+	short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	if _, err := peer.Request(short, "slow", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler was not cancelled")
+	}
+
+	// Закрытие соединения завершает ожидающий запрос
+	result := make(chan error, 1)
+	go func() {
+		_, err := peer.Request(ctx, "slow", nil)
+		result <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := connector2.Disconnect(peerID1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrPeerClosed) {
+			t.Fatalf("Expected ErrPeerClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request did not finish after disconnect")
+	}
+}
+
+// TestICEConnectionTimeout проверяет, что инициатор ждет answer не дольше
+// ICEConnectionTimeout
+func TestICEConnectionTimeout(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	connector, _ := newTestConnector(t, addr, ConnectorConfig{ICEConnectionTimeout: 300 * time.Millisecond})
+	go func() {
+		for range connector.Events() {
+		}
+	}()
+
+	// Пир подключен к router'у, но на offer не отвечает. Его ключ уже
+	// известен, поэтому offer уходит сразу после KEY_EXCHANGE
+	silentID := dialSilentPeer(t, addr)
+	keyExchange := &EncryptedMessage{SenderEncPubKey: [32]byte{7}, EncryptedData: []byte("KEY_EXCHANGE_V1")}
+	if _, err := connector.decryptMessageFromPeer(silentID, keyExchange); err != nil {
+		t.Fatal(err)
+	}
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := <-connector.ConnectContext(ctx, hex.EncodeToString(silentID[:])); !errors.Is(err, ErrConnectionTimeout) {
+		t.Fatalf("Expected ErrConnectionTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("Answer wait took %v, expected about ICEConnectionTimeout", elapsed)
+	}
+}
+
+// TestConnectionPolicyOffers проверяет политику входящих соединений между
+// настоящими пирами: ContactsOnly молча отбрасывает offer незнакомого пира,
+// Manual принимает его после Approve
+func TestConnectionPolicyOffers(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	connector1, peerID1 := newTestConnector(t, addr, ConnectorConfig{ICEConnectionTimeout: 500 * time.Millisecond})
+	connector2, peerID2 := newTestConnector(t, addr, ConnectorConfig{})
+	go func() {
+		for range connector1.Events() {
+		}
+	}()
+	requests := make(chan router.PeerID, 10)
+	go func() {
+		for event := range connector2.Events() {
+			if event.Type == EventConnectionRequest {
+				requests <- event.PeerID
+			}
+		}
+	}()
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hexID2 := hex.EncodeToString(peerID2[:])
+
+	connector2.SetConnectionPolicy(ConnectionPolicy{Mode: ConnectionContactsOnly})
+	if err := <-connector1.ConnectContext(ctx, hexID2); !errors.Is(err, ErrConnectionTimeout) {
+		t.Fatalf("Expected offer to be dropped, got %v", err)
+	}
+	if _, ok := connector2.GetPeer(peerID1); ok {
+		t.Fatal("Stranger must not be connected")
+	}
+
+	connector2.SetConnectionPolicy(ConnectionPolicy{Mode: ConnectionManual})
+	go func() {
+		select {
+		case peerID := <-requests:
+			connector2.Approve(peerID)
+		case <-ctx.Done():
+		}
+	}()
+	if err := <-connector1.ConnectContext(ctx, hexID2); err != nil {
+		t.Fatalf("Expected approved connection, got %v", err)
+	}
+	if _, err := connector2.WaitForPeer(ctx, peerID1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGracefulDisconnect проверяет, что пир узнает причину закрытия
+// соединения и не пытается его восстановить
+func TestGracefulDisconnect(t *testing.T) {
+	addr := startTestRouter(t, router.RouterConfig{})
+
+	connector1, peerID1 := newTestConnector(t, addr, ConnectorConfig{})
+	connector2, peerID2 := newTestConnector(t, addr, ConnectorConfig{})
+
+	disconnected := make(chan Event, 10)
+	var reconnecting atomic.Int32
+	go func() {
+		for event := range connector2.Events() {
+			switch event.Type {
+			case EventDisconnected:
+				disconnected <- event
+			case EventReconnecting:
+				reconnecting.Add(1)
+			}
+		}
+	}()
+	go func() {
+		for range connector1.Events() {
+		}
+	}()
+
+	// Даем router'у зарегистрировать пиров
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	connect := func() {
+		t.Helper()
+		if err := <-connector1.ConnectContext(ctx, hex.EncodeToString(peerID2[:])); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := connector2.WaitForPeer(ctx, peerID1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectReason := func(want DisconnectReason) {
+		t.Helper()
+		select {
+		case event := <-disconnected:
+			if event.PeerID != peerID1 || event.Reason != want {
+				t.Fatalf("Expected disconnect of peer 1 with reason %q, got %q", want, event.Reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for disconnect with reason %q", want)
+		}
+		if _, ok := connector2.GetPeer(peerID1); ok {
+			t.Fatal("Peer is still connected after bye")
+		}
+	}
+
+	connect()
+	if err := connector1.Disconnect(peerID2); err != nil {
+		t.Fatal(err)
+	}
+	expectReason(DisconnectUser)
+
+	connect()
+	connector1.Close()
+	expectReason(DisconnectShutdown)
+
+	// Второго EventDisconnected от закрытия соединения нет
+	select {
+	case event := <-disconnected:
+		t.Fatalf("Unexpected second disconnect: %+v", event)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if n := reconnecting.Load(); n != 0 {
+		t.Fatalf("Expected no ICE restart after bye, got %d", n)
+	}
+}
@@ -0,0 +1,140 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+func TestConnectorConfig(t *testing.T) {
+	// Нулевые значения заменяются значениями по умолчанию
+	c, _ := newTestConnector(t, "", ConnectorConfig{})
+	if c.keyExchangeTimeout != DefaultKeyExchangeTimeout || c.iceConnectionTimeout != DefaultICEConnectionTimeout ||
+		c.maxOffersPerMinute != DefaultMaxOffersPerMinute || cap(c.events) != DefaultEventBufferSize {
+		t.Fatalf("Unexpected defaults: key exchange %v, answer %v, offers %d, events %d",
+			c.keyExchangeTimeout, c.iceConnectionTimeout, c.maxOffersPerMinute, cap(c.events))
+	}
+
+	c, _ = newTestConnector(t, "", ConnectorConfig{
+		KeyExchangeTimeout:   20 * time.Second,
+		ICEConnectionTimeout: time.Minute,
+		MaxOffersPerMinute:   2,
+		EventBufferSize:      1000,
+	})
+	if c.keyExchangeTimeout != 20*time.Second || c.iceConnectionTimeout != time.Minute || cap(c.events) != 1000 {
+		t.Fatalf("Overrides not applied: key exchange %v, answer %v, events %d",
+			c.keyExchangeTimeout, c.iceConnectionTimeout, cap(c.events))
+	}
+	// Третий offer за минуту отбрасывается
+	peer := router.PeerID{1}
+	if !c.checkOfferRateLimit(peer) || !c.checkOfferRateLimit(peer) || c.checkOfferRateLimit(peer) {
+		t.Fatal("Expected a limit of 2 offers per minute")
+	}
+
+	_, privKey, _ := ed25519.GenerateKey(nil)
+	for name, cfg := range map[string]ConnectorConfig{
+		"KeyExchangeTimeout": {KeyExchangeTimeout: -time.Second},
+		"MaxOffersPerMinute": {MaxOffersPerMinute: -1},
+		"EventBufferSize":    {EventBufferSize: -1},
+		"MaxPeers":           {MaxPeers: -1},
+	} {
+		if _, err := NewConnector(nil, cfg, nil, privKey); err == nil {
+			t.Errorf("%s: expected error for a negative value", name)
+		}
+	}
+}
+
+// TestEventDelivery проверяет, что медленный читатель Events не блокирует
+// события соединений, а данные доходят все и по порядку
+func TestEventDelivery(t *testing.T) {
+	c, _ := newTestConnector(t, "", ConnectorConfig{EventBufferSize: 4})
+
+	// Никто не читает Events: события соединений не блокируются, лишние
+	// отбрасываются со счетчиком
+	const overflow = 10
+	emitted := make(chan struct{})
+	go func() {
+		defer close(emitted)
+		for range maxQueuedEvents + cap(c.events) + overflow {
+			c.emit(Event{Type: EventReconnecting, PeerID: router.PeerID{1}})
+		}
+	}()
+	select {
+	case <-emitted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("emit blocked without a reader")
+	}
+	// pumpEvents мог еще не перенести часть событий в канал
+	if dropped := c.Stats().DroppedEvents; dropped == 0 || dropped > overflow+uint64(cap(c.events)) {
+		t.Fatalf("Unexpected dropped events: %d", dropped)
+	}
+	if c.DroppedEvents() != c.Stats().DroppedEvents {
+		t.Fatalf("DroppedEvents %d differs from Stats %d", c.DroppedEvents(), c.Stats().DroppedEvents)
+	}
+
+	// Данные не отбрасываются: при заполненной очереди emit ждет читателя
+	const messages = 100
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := range messages {
+			c.emit(Event{Type: EventDataReceived, Data: []byte{byte(i)}})
+		}
+	}()
+	select {
+	case <-sent:
+		t.Fatal("Expected backpressure on data events")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	next := 0
+	for next < messages {
+		event := <-c.Events()
+		if event.Type != EventDataReceived {
+			continue
+		}
+		if event.Data[0] != byte(next) {
+			t.Fatalf("Expected message %d, got %d", next, event.Data[0])
+		}
+		next++
+		// Медленный читатель
+		if next%10 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	<-sent
+}
+
+// TestSetEventBufferSize проверяет, что новый размер очереди данных сразу
+// пропускает ждущие emit
+func TestSetEventBufferSize(t *testing.T) {
+	c, _ := newTestConnector(t, "", ConnectorConfig{EventBufferSize: 4})
+
+	var sent atomic.Int64
+	go func() {
+		for i := range 100 {
+			c.emit(Event{Type: EventDataReceived, Data: []byte{byte(i)}})
+			sent.Add(1)
+		}
+	}()
+	// Канал и очередь вмещают по 4 сообщения
+	time.Sleep(50 * time.Millisecond)
+	if n := sent.Load(); n > 9 {
+		t.Fatalf("Expected backpressure after 8 messages, %d sent", n)
+	}
+
+	c.SetEventBufferSize(50)
+	time.Sleep(50 * time.Millisecond)
+	if n := sent.Load(); n < 50 || n > 55 {
+		t.Fatalf("Expected about 54 messages sent with the larger buffer, got %d", n)
+	}
+
+	for next := range 100 {
+		if event := <-c.Events(); event.Data[0] != byte(next) {
+			t.Fatalf("Expected message %d, got %d", next, event.Data[0])
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Package admin предоставляет локальный JSON API для управления router сервером.
+//
+// Эндпоинты:
+//
+//   - GET  /peers                  - список подключенных пиров
+//   - POST /peers/{id}/disconnect  - отключить пира по hex ID
+//   - GET  /bans                   - список заблокированных пиров
+//   - POST /bans/{id}              - забанить пира
+//   - DELETE /bans/{id}            - разбанить пира
+//
+// API не имеет аутентификации, поэтому слушает только unix socket
+// или loopback адрес.
+package admin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+// Backend is the router functionality exposed by the admin API
+type Backend interface {
+	Peers() []router.PeerInfo
+	Disconnect(id router.PeerID) error
+	Bans() []router.PeerID
+	Ban(id router.PeerID) error
+	Unban(id router.PeerID) error
+}
+
+// PeerJSON is the JSON representation of a connected peer
+type PeerJSON struct {
+	ID          string    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// Handler returns an http.Handler serving the admin API
+func Handler(b Backend) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		peers := b.Peers()
+		resp := make([]PeerJSON, 0, len(peers))
+		for _, p := range peers {
+			resp = append(resp, PeerJSON{
+				ID:          hex.EncodeToString(p.ID[:]),
+				RemoteAddr:  p.RemoteAddr,
+				ConnectedAt: p.ConnectedAt,
+			})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc("POST /peers/{id}/disconnect", func(w http.ResponseWriter, r *http.Request) {
+		id, err := ParsePeerID(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := b.Disconnect(id); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, router.ErrPeerNotFound) {
+				status = http.StatusNotFound
+			}
+			writeError(w, status, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "disconnected"})
+	})
+
+	mux.HandleFunc("GET /bans", func(w http.ResponseWriter, r *http.Request) {
+		bans := b.Bans()
+		resp := make([]string, 0, len(bans))
+		for _, id := range bans {
+			resp = append(resp, hex.EncodeToString(id[:]))
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc("POST /bans/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := ParsePeerID(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := b.Ban(id); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "banned"})
+	})
+
+	mux.HandleFunc("DELETE /bans/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := ParsePeerID(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := b.Unban(id); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "unbanned"})
+	})
+
+	return mux
+}
+
+// Serve starts the admin API on addr. If addr looks like a host:port pair it
+// must be a loopback address, otherwise it is treated as a unix socket path.
+func Serve(addr string, b Backend) error {
+	lis, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+
+	slog.Info("Admin API listening", "address", addr)
+	if err := http.Serve(lis, Handler(b)); err != nil {
+		return fmt.Errorf("http.Serve: %w", err)
+	}
+	return nil
+}
+
+// Listen creates a listener for the admin API
+func Listen(addr string) (net.Listener, error) {
+	if host, _, err := net.SplitHostPort(addr); err == nil && !strings.Contains(addr, "/") {
+		ip := net.ParseIP(host)
+		if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("admin API must listen on a loopback address, got %q", addr)
+		}
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("net.Listen: %w", err)
+		}
+		return lis, nil
+	}
+
+	// Удаляем старый сокет, оставшийся после прошлого запуска
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove stale socket: %w", err)
+	}
+	lis, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen: %w", err)
+	}
+	if err := os.Chmod(addr, 0600); err != nil {
+		lis.Close()
+		return nil, fmt.Errorf("chmod socket: %w", err)
+	}
+	return lis, nil
+}
+
+// ParsePeerID parses hex encoded PeerID
+func ParsePeerID(hexID string) (router.PeerID, error) {
+	var id router.PeerID
+	b, err := hex.DecodeString(hexID)
+	if err != nil {
+		return id, fmt.Errorf("invalid peer id: %w", err)
+	}
+	if len(b) != router.PeerIDSize {
+		return id, fmt.Errorf("invalid peer id size: expected %d bytes, got %d", router.PeerIDSize, len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("Failed to write admin response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,148 @@
+package admin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/udisondev/sendy/router"
+)
+
+type fakeBackend struct {
+	peers        []router.PeerInfo
+	disconnected []router.PeerID
+	bans         []router.PeerID
+}
+
+func (f *fakeBackend) Peers() []router.PeerInfo { return f.peers }
+
+func (f *fakeBackend) Disconnect(id router.PeerID) error {
+	for _, p := range f.peers {
+		if p.ID == id {
+			f.disconnected = append(f.disconnected, id)
+			return nil
+		}
+	}
+	return router.ErrPeerNotFound
+}
+
+func (f *fakeBackend) Bans() []router.PeerID { return f.bans }
+
+func (f *fakeBackend) Ban(id router.PeerID) error {
+	f.bans = append(f.bans, id)
+	return nil
+}
+
+func (f *fakeBackend) Unban(id router.PeerID) error {
+	for i, b := range f.bans {
+		if b == id {
+			f.bans = append(f.bans[:i], f.bans[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	id := router.PeerID{1, 2, 3}
+	b := &fakeBackend{
+		peers: []router.PeerInfo{{ID: id, RemoteAddr: "127.0.0.1:1234", ConnectedAt: time.Now()}},
+	}
+	srv := httptest.NewServer(Handler(b))
+	defer srv.Close()
+
+	t.Run("ListPeers", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/peers")
+		if err != nil {
+			t.Fatalf("GET /peers: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var peers []PeerJSON
+		if err := json.NewDecoder(resp.Body).Decode(&peers); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if len(peers) != 1 || peers[0].ID != hex.EncodeToString(id[:]) || peers[0].RemoteAddr != "127.0.0.1:1234" {
+			t.Errorf("unexpected peers: %+v", peers)
+		}
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		resp, err := http.Post(srv.URL+"/peers/"+hex.EncodeToString(id[:])+"/disconnect", "", nil)
+		if err != nil {
+			t.Fatalf("POST disconnect: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected 200, got %d", resp.StatusCode)
+		}
+		if len(b.disconnected) != 1 || b.disconnected[0] != id {
+			t.Errorf("peer was not disconnected: %v", b.disconnected)
+		}
+	})
+
+	t.Run("DisconnectUnknown", func(t *testing.T) {
+		var unknown router.PeerID
+		resp, err := http.Post(srv.URL+"/peers/"+hex.EncodeToString(unknown[:])+"/disconnect", "", nil)
+		if err != nil {
+			t.Fatalf("POST disconnect: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("BanUnban", func(t *testing.T) {
+		url := srv.URL + "/bans/" + hex.EncodeToString(id[:])
+		resp, err := http.Post(url, "", nil)
+		if err != nil {
+			t.Fatalf("POST ban: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(b.bans) != 1 {
+			t.Fatalf("ban failed: status=%d bans=%v", resp.StatusCode, b.bans)
+		}
+
+		resp, err = http.Get(srv.URL + "/bans")
+		if err != nil {
+			t.Fatalf("GET /bans: %v", err)
+		}
+		var bans []string
+		json.NewDecoder(resp.Body).Decode(&bans)
+		resp.Body.Close()
+		if len(bans) != 1 || bans[0] != hex.EncodeToString(id[:]) {
+			t.Errorf("unexpected bans: %v", bans)
+		}
+
+		req, _ := http.NewRequest(http.MethodDelete, url, nil)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("DELETE ban: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(b.bans) != 0 {
+			t.Errorf("unban failed: status=%d bans=%v", resp.StatusCode, b.bans)
+		}
+	})
+
+	t.Run("InvalidID", func(t *testing.T) {
+		resp, err := http.Post(srv.URL+"/peers/zz/disconnect", "", nil)
+		if err != nil {
+			t.Fatalf("POST disconnect: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestListenRejectsPublicAddress(t *testing.T) {
+	if _, err := Listen("0.0.0.0:0"); err == nil {
+		t.Fatal("expected error for non-loopback address")
+	}
+}
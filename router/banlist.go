@@ -0,0 +1,125 @@
+package router
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrPeerBanned = errors.New("peer is banned")
+
+// Ban adds peer to the ban list. Banned peer can't authenticate and
+// messages to/from it are refused with Forbidden.
+func (r *Router) Ban(id PeerID) error {
+	r.banMu.Lock()
+	defer r.banMu.Unlock()
+
+	r.bans.Store(id, struct{}{})
+	slog.Info("Peer banned", "hexID", hex.EncodeToString(id[:]))
+	return r.saveBanList()
+}
+
+// Unban removes peer from the ban list
+func (r *Router) Unban(id PeerID) error {
+	r.banMu.Lock()
+	defer r.banMu.Unlock()
+
+	r.bans.Delete(id)
+	slog.Info("Peer unbanned", "hexID", hex.EncodeToString(id[:]))
+	return r.saveBanList()
+}
+
+// IsBanned reports whether peer is in the ban list
+func (r *Router) IsBanned(id PeerID) bool {
+	_, ok := r.bans.Load(id)
+	return ok
+}
+
+// Bans returns all banned peers
+func (r *Router) Bans() []PeerID {
+	var bans []PeerID
+	r.bans.Range(func(key, value any) bool {
+		bans = append(bans, key.(PeerID))
+		return true
+	})
+	return bans
+}
+
+// LoadBanList loads hex encoded peer IDs (one per line) from path and
+// persists further Ban/Unban calls to the same file. Missing file is
+// treated as an empty ban list.
+func (r *Router) LoadBanList(path string) error {
+	r.banMu.Lock()
+	defer r.banMu.Unlock()
+
+	r.banListPath = path
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open ban list: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		b, err := hex.DecodeString(text)
+		if err != nil || len(b) != PeerIDSize {
+			return fmt.Errorf("ban list line %d: invalid peer id %q", line, text)
+		}
+		var id PeerID
+		copy(id[:], b)
+		r.bans.Store(id, struct{}{})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read ban list: %w", err)
+	}
+
+	slog.Info("Ban list loaded", "path", path, "count", len(r.Bans()))
+	return nil
+}
+
+// saveBanList writes ban list to disk. Caller must hold banMu.
+func (r *Router) saveBanList() error {
+	if r.banListPath == "" {
+		return nil
+	}
+
+	var sb strings.Builder
+	for _, id := range r.Bans() {
+		sb.WriteString(hex.EncodeToString(id[:]))
+		sb.WriteByte('\n')
+	}
+
+	// Пишем во временный файл и переименовываем, чтобы не потерять список при сбое
+	tmp, err := os.CreateTemp(filepath.Dir(r.banListPath), ".banlist-*")
+	if err != nil {
+		return fmt.Errorf("create temp ban list: %w", err)
+	}
+	if _, err := tmp.WriteString(sb.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write ban list: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("close ban list: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), r.banListPath); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("rename ban list: %w", err)
+	}
+	return nil
+}
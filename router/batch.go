@@ -0,0 +1,114 @@
+package router
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// DefaultBatchWindow - окно накопления пачки для сигнальных сообщений:
+// заметно меньше задержки сети, но объединяет всплески KEY_EXCHANGE и SDP
+const DefaultBatchWindow = time.Millisecond
+
+// SetBatchWindow включает batching: пакеты, отправленные в течение window
+// после первого, уходят router'у одной пачкой BatchRecipient. Ответы
+// по-прежнему приходят на каждый Send. 0 выключает batching (по умолчанию).
+// Router должен поддерживать BatchRecipient
+func (c *Client) SetBatchWindow(window time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.batchWindow = window
+	if window <= 0 && c.conn != nil {
+		c.flushBatchLocked()
+	}
+}
+
+// Flush сразу отправляет накопленную пачку, не дожидаясь окна
+func (c *Client) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.connErr(); err != nil {
+		return err
+	}
+	return c.flushBatchLocked()
+}
+
+// appendBatchLocked добавляет пакет (заголовок и payload) в пачку. Возвращает
+// false, если пакет не помещается в пачку и должен быть отправлен отдельно;
+// накопленная пачка при этом уже отправлена, чтобы не нарушить порядок.
+// Вызывается под c.mu
+func (c *Client) appendBatchLocked(header, payload []byte) (bool, error) {
+	size := len(header) + len(payload)
+	maxEntries := int(c.maxPacketSize) - RequestIDSize - PeerIDSize
+
+	if size > maxEntries {
+		return false, c.flushBatchLocked()
+	}
+	if len(c.batch)+size > maxEntries {
+		if err := c.flushBatchLocked(); err != nil {
+			return false, err
+		}
+	}
+
+	if c.batchCount == 0 {
+		if c.batchTimer == nil {
+			c.batchTimer = time.AfterFunc(c.batchWindow, c.flushBatchTimer)
+		} else {
+			c.batchTimer.Reset(c.batchWindow)
+		}
+	}
+	c.batch = append(c.batch, header...)
+	c.batch = append(c.batch, payload...)
+	c.batchCount++
+	return true, nil
+}
+
+func (c *Client) flushBatchTimer() {
+	if err := c.Flush(); err != nil {
+		slog.Debug("Failed to flush batch", "error", err)
+	}
+}
+
+// flushBatchLocked отправляет накопленную пачку. Одиночный пакет уходит
+// как есть, без заголовка пачки. Вызывается под c.mu при c.conn != nil
+func (c *Client) flushBatchLocked() error {
+	if c.batchCount == 0 {
+		return nil
+	}
+	if c.batchTimer != nil {
+		c.batchTimer.Stop()
+	}
+
+	var err error
+	if c.batchCount == 1 {
+		_, err = c.conn.Write(c.batch)
+	} else {
+		// RequestID пачки не используется: ответы идут по RequestID сообщений
+		var header [PeerHeaderSize]byte
+		binary.BigEndian.PutUint32(header[0:4], uint32(RequestIDSize+PeerIDSize+len(c.batch)))
+		copy(header[4+RequestIDSize:], BatchRecipient[:])
+
+		bufs := net.Buffers{header[:], c.batch}
+		_, err = bufs.WriteTo(c.conn)
+	}
+	c.resetBatchLocked()
+
+	if err != nil {
+		// Частично записанная пачка ломает поток, читающая горутина
+		// завершит ожидающие запросы
+		c.conn.Close()
+	}
+	return err
+}
+
+// resetBatchLocked отбрасывает накопленную пачку. Вызывается под c.mu
+func (c *Client) resetBatchLocked() {
+	if c.batchTimer != nil {
+		c.batchTimer.Stop()
+	}
+	c.batch = c.batch[:0]
+	c.batchCount = 0
+}
@@ -5,66 +5,223 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Заголовок фрагментации в начале каждого payload:
+// Flag(1) [+ TotalLen(4) для fragFirst]
+const (
+	fragNone  byte = iota // Сообщение целиком в одном пакете
+	fragFirst             // Первый фрагмент, за флагом следует полная длина сообщения
+	fragCont              // Продолжение сообщения
+
+	fragFirstHeaderSize = 1 + 4
+)
+
+const (
+	// maxPartialSenders - сколько отправителей собирают сообщения
+	// одновременно. Недособранные сообщения вытесняются новыми
+	maxPartialSenders = 16
+	// maxPartialBytes - байт во всех недособранных сообщениях
+	maxPartialBytes = 2 * MaxMessageSize
+	// partialTimeout - сообщение без новых фрагментов дольше этого удаляется
+	partialTimeout = 30 * time.Second
+)
+
+var fragNoneHeader = []byte{fragNone}
+
+// ErrNotConnected возвращается при отправке до Dial или после разрыва соединения
+var ErrNotConnected = errors.New("client is not connected")
+
+// ErrClientClosed возвращается при отправке после Close
+var ErrClientClosed = errors.New("client is closed")
+
+// maxPooledPayload - буферы больше не возвращаются в пул, чтобы не держать память
+const maxPooledPayload = 64 * 1024
+
+// payloadPool хранит буферы, возвращенные через ServerMessage.Release
+var payloadPool sync.Pool
+
+func getPayloadBuf(n int) *[]byte {
+	bp, _ := payloadPool.Get().(*[]byte)
+	if bp == nil {
+		b := make([]byte, n)
+		return &b
+	}
+	if cap(*bp) < n {
+		*bp = make([]byte, n)
+	}
+	*bp = (*bp)[:n]
+	return bp
+}
+
+func putPayloadBuf(bp *[]byte) {
+	if cap(*bp) > maxPooledPayload {
+		return
+	}
+	payloadPool.Put(bp)
+}
+
+// partialIncome - недособранное сообщение отправителя
+type partialIncome struct {
+	buf     []byte
+	total   int       // заявленная длина сообщения
+	updated time.Time // время последнего фрагмента
+}
+
+// pendingRequest - запрос, ожидающий ответа router'а. Ответ, таймаут или
+// отмена ctx завершают его ровно один раз, см. takeRequest
+type pendingRequest struct {
+	ch      chan ServerMessage
+	timer   *time.Timer
+	stopCtx func() bool
+}
+
 type Client struct {
-	pubkey     ed25519.PublicKey
-	privkey    ed25519.PrivateKey
-	conn       net.Conn
-	mu         sync.Mutex
-	reqMap     map[RequestID]chan ServerMessage
-	writeBuf   [PeerHeaderSize]byte
-	reqTimeout time.Duration
+	pubkey        ed25519.PublicKey
+	privkey       ed25519.PrivateKey
+	conn          net.Conn
+	mu            sync.Mutex
+	reqMap        map[RequestID]*pendingRequest
+	writeBuf      [PeerHeaderSize + PeerIDSize + fragFirstHeaderSize]byte
+	writeBufs     [2][]byte // заголовок и payload для writev
+	reqTimeout    time.Duration
+	keepalive     time.Duration
+	maxPacketSize uint32
+
+	// Фрагменты одного сообщения не должны перемешиваться с другим
+	fragMu sync.Mutex
+	// Недособранные сообщения по отправителю (только для читающей горутины)
+	partial     map[PeerID]*partialIncome
+	partialSize int // байт во всех недособранных сообщениях
+
+	// Пачка сообщений, накопленных за batchWindow, см. batch.go
+	batchWindow time.Duration
+	batch       []byte
+	batchCount  int
+	batchTimer  *time.Timer
+
+	closed   bool
+	done     chan struct{} // закрывается в Close
+	readDone chan struct{} // закрывается при выходе читающей горутины
+	errs     chan error    // причины остановки чтения, см. Errors
+
+	peerLists chan []PeerID // списки пиров от router'а, см. PeerListUpdates
 }
 
 func NewClient(pubkey ed25519.PublicKey, privkey ed25519.PrivateKey) *Client {
 	return &Client{
-		pubkey:     pubkey,
-		privkey:    privkey,
-		reqMap:     make(map[RequestID]chan ServerMessage),
-		reqTimeout: 5 * time.Second,
+		pubkey:        pubkey,
+		privkey:       privkey,
+		reqMap:        make(map[RequestID]*pendingRequest),
+		reqTimeout:    5 * time.Second,
+		keepalive:     KeepaliveInterval,
+		maxPacketSize: MaxPacketSize,
+		partial:       make(map[PeerID]*partialIncome),
+		done:          make(chan struct{}),
+		errs:          make(chan error, 1),
+		peerLists:     make(chan []PeerID, 1),
 	}
 }
 
+// SetMaxPacketSize задает размер пакета, на который router'а рассчитан
+// клиент. Payload больше пакета отправляется фрагментами
+func (c *Client) SetMaxPacketSize(size uint32) {
+	if size < MinPacketSize {
+		size = MinPacketSize
+	}
+	c.mu.Lock()
+	c.maxPacketSize = size
+	c.mu.Unlock()
+}
+
 func (c *Client) SetRequestTimeout(timeout time.Duration) {
 	c.mu.Lock()
 	c.reqTimeout = timeout
 	c.mu.Unlock()
 }
 
+// SetKeepaliveInterval задает период keepalive сообщений, которые не дают
+// router'у закрыть соединение по таймауту простоя. Вызывать до Dial
+func (c *Client) SetKeepaliveInterval(interval time.Duration) {
+	c.mu.Lock()
+	c.keepalive = interval
+	c.mu.Unlock()
+}
+
 func (c *Client) GetPublicKey() ed25519.PublicKey {
 	return c.pubkey
 }
 
+// Dial подключается к router'у по TCP (host:port), unix socket (unix://)
+// или WebSocket (ws://, wss://). Канал income закрывается, когда соединение
+// разорвано, отменен ctx или вызван Close
 func (c *Client) Dial(ctx context.Context, addr string) (<-chan ServerMessage, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, fmt.Errorf("net.Dial: %w", err)
+	var conn net.Conn
+	ws := isWebSocketAddr(addr)
+	if ws {
+		wsc, err := dialWebSocket(ctx, addr)
+		if err != nil {
+			return nil, fmt.Errorf("websocket dial: %w", err)
+		}
+		conn = wsc
+	} else {
+		network := "tcp"
+		if path, ok := strings.CutPrefix(addr, UnixScheme); ok {
+			network, addr = "unix", path
+		}
+		nc, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("net.Dial: %w", err)
+		}
+		conn = nc
 	}
 
+	if err := c.signUp(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ws {
+		conn.(*wsConn).startFraming()
+	}
+
+	readDone := make(chan struct{})
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return nil, ErrClientClosed
+	}
 	c.conn = conn
+	c.readDone = readDone
+	c.mu.Unlock()
 
-	income := make(chan ServerMessage, 100)
 	go func() {
-		<-ctx.Done()
-		close(income)
-		conn.Close()
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-readDone:
+		}
 	}()
 
-	if err := c.signUp(conn); err != nil {
-		return nil, err
-	}
+	go c.keepaliveLoop(ctx)
 
+	// income пишет и закрывает только читающая горутина
+	income := make(chan ServerMessage, 100)
 	go func() {
-		defer conn.Close()
+		defer close(readDone)
+		defer close(income)
+		defer c.disconnect(conn)
 		for {
-			msg, err := c.readServerMessage()
+			msg, err := c.readServerMessage(conn)
 			if err != nil {
+				c.reportReadError(ctx, err)
 				return
 			}
 
@@ -73,23 +230,20 @@ func (c *Client) Dial(ctx context.Context, addr string) (<-chan ServerMessage, e
 				case income <- msg:
 				case <-ctx.Done():
 					return
-				}
-			} else {
-				c.mu.Lock()
-				ch, ok := c.reqMap[msg.RequestID]
-				if ok {
-					delete(c.reqMap, msg.RequestID)
-				}
-				c.mu.Unlock()
-				if !ok {
-					continue
-				}
-
-				select {
-				case ch <- msg:
-				case <-ctx.Done():
+				case <-c.done:
 					return
 				}
+				continue
+			}
+
+			if msg.Type == PeerList {
+				c.deliverPeerList(msg)
+				continue
+			}
+
+			// Канал буферизован, отправка не блокирует чтение
+			if req := c.takeRequest(msg.RequestID); req != nil {
+				req.ch <- msg
 			}
 		}
 	}()
@@ -97,6 +251,133 @@ func (c *Client) Dial(ctx context.Context, addr string) (<-chan ServerMessage, e
 	return income, nil
 }
 
+// Errors возвращает канал ошибок, из-за которых остановилось чтение от
+// router'а: разрыв соединения, нарушение протокола. Close и отмена ctx из
+// Dial ошибкой не считаются. Канал не закрывается, пока ошибку не прочитали,
+// следующие отбрасываются
+func (c *Client) Errors() <-chan error {
+	return c.errs
+}
+
+// PeerListUpdates возвращает канал списков подключенных к router'у пиров.
+// Router с RouterConfig.EnablePeerList присылает весь список при каждом
+// подключении и отключении пира, список включает и нас. Непрочитанный
+// список заменяется следующим. Канал не закрывается
+func (c *Client) PeerListUpdates() <-chan []PeerID {
+	return c.peerLists
+}
+
+// deliverPeerList передает список в PeerListUpdates, вытесняя
+// непрочитанный. Пишет в канал только читающая горутина
+func (c *Client) deliverPeerList(msg ServerMessage) {
+	ids := make([]PeerID, len(msg.Payload)/PeerIDSize)
+	for i := range ids {
+		copy(ids[i][:], msg.Payload[i*PeerIDSize:])
+	}
+	msg.Release()
+
+	select {
+	case <-c.peerLists:
+	default:
+	}
+	c.peerLists <- ids
+}
+
+// reportReadError передает в Errors ошибку, остановившую чтение
+func (c *Client) reportReadError(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+
+	select {
+	case c.errs <- err:
+	default:
+	}
+}
+
+// Close закрывает соединение, дожидается остановки чтения и завершает
+// ожидающие запросы ответом с Err = ErrClientClosed. Повторный вызов
+// ничего не делает
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.conn != nil {
+		// Накопленная пачка уходит до закрытия соединения
+		c.flushBatchLocked()
+	}
+	c.closed = true
+	close(c.done)
+	conn, readDone := c.conn, c.readDone
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	err := conn.Close()
+	<-readDone
+	return err
+}
+
+// disconnect закрывает соединение и завершает все ожидающие запросы
+// ответом с ошибкой, последующие Send возвращают ErrNotConnected
+// (ErrClientClosed после Close)
+func (c *Client) disconnect(conn net.Conn) {
+	conn.Close()
+
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+		c.resetBatchLocked()
+	}
+	reason := ErrNotConnected
+	if c.closed {
+		reason = ErrClientClosed
+	}
+	pending := c.reqMap
+	c.reqMap = make(map[RequestID]*pendingRequest)
+	c.mu.Unlock()
+
+	for reqID, req := range pending {
+		req.stop()
+		req.ch <- ServerMessage{Type: Error, RequestID: reqID, Err: reason}
+	}
+}
+
+// keepaliveLoop периодически отправляет keepalive сообщения router'у
+func (c *Client) keepaliveLoop(ctx context.Context) {
+	c.mu.Lock()
+	interval := c.keepalive
+	c.mu.Unlock()
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.writePeerMessage(PeerMessage{Recipient: KeepaliveRecipient}, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
 func (c *Client) signUp(conn net.Conn) error {
 	if _, err := conn.Write(c.pubkey); err != nil {
 		return fmt.Errorf("send public key: %w", err)
@@ -115,12 +396,122 @@ func (c *Client) signUp(conn net.Conn) error {
 	return nil
 }
 
-func (c *Client) readServerMessage() (ServerMessage, error) {
+// readServerMessage читает сообщения от router'а, собирая фрагментированные
+// Income сообщения. Возвращает только целые сообщения
+func (c *Client) readServerMessage(conn net.Conn) (ServerMessage, error) {
+	for {
+		msg, err := c.readServerPacket(conn)
+		if err != nil {
+			return msg, err
+		}
+		if msg.Type != Income || len(msg.Payload) == 0 {
+			return msg, nil
+		}
+
+		if msg.Payload[0] == fragNone {
+			msg.Payload = msg.Payload[1:]
+			return msg, nil
+		}
+
+		// Фрагмент копируется в собираемое сообщение, буфер пакета больше не нужен
+		payload, ok := c.reassemble(msg.SenderID, msg.Payload)
+		msg.Release()
+		if ok {
+			msg.Payload = payload
+			return msg, nil
+		}
+	}
+}
+
+// reassemble снимает заголовок фрагментации. Возвращает false пока
+// сообщение от отправителя не собрано целиком
+func (c *Client) reassemble(sender PeerID, payload []byte) ([]byte, bool) {
+	now := time.Now()
+	var msg *partialIncome
+	var data []byte
+	switch payload[0] {
+	case fragFirst:
+		if len(payload) < fragFirstHeaderSize {
+			return nil, false
+		}
+		total := binary.BigEndian.Uint32(payload[1:fragFirstHeaderSize])
+		c.dropPartial(sender)
+		if total > MaxMessageSize {
+			return nil, false
+		}
+		c.evictPartial(now)
+		// Длина задана отправителем, буфер растет по мере прихода фрагментов
+		msg = &partialIncome{total: int(total)}
+		c.partial[sender] = msg
+		data = payload[fragFirstHeaderSize:]
+
+	case fragCont:
+		var ok bool
+		if msg, ok = c.partial[sender]; !ok {
+			return nil, false
+		}
+		data = payload[1:]
+
+	default:
+		return nil, false
+	}
+
+	if len(msg.buf)+len(data) > msg.total {
+		// Фрагмент не помещается в заявленную длину
+		c.dropPartial(sender)
+		return nil, false
+	}
+	// SECURITY: ограничиваем память, которую отправители могут занять
+	// недособранными сообщениями
+	if c.partialSize+len(data) > maxPartialBytes {
+		c.dropPartial(sender)
+		return nil, false
+	}
+	msg.buf = append(msg.buf, data...)
+	msg.updated = now
+	c.partialSize += len(data)
+
+	if len(msg.buf) < msg.total {
+		return nil, false
+	}
+	c.dropPartial(sender)
+	return msg.buf, true
+}
+
+// dropPartial удаляет недособранное сообщение отправителя
+func (c *Client) dropPartial(sender PeerID) {
+	if msg, ok := c.partial[sender]; ok {
+		c.partialSize -= len(msg.buf)
+		delete(c.partial, sender)
+	}
+}
+
+// evictPartial освобождает место для нового сообщения: удаляет сообщения
+// без фрагментов дольше partialTimeout, а если отправителей все еще
+// maxPartialSenders - самое давнее
+func (c *Client) evictPartial(now time.Time) {
+	var oldest PeerID
+	var oldestTime time.Time
+	for sender, msg := range c.partial {
+		if now.Sub(msg.updated) > partialTimeout {
+			c.dropPartial(sender)
+			continue
+		}
+		if oldestTime.IsZero() || msg.updated.Before(oldestTime) {
+			oldest, oldestTime = sender, msg.updated
+		}
+	}
+	if len(c.partial) >= maxPartialSenders {
+		c.dropPartial(oldest)
+	}
+}
+
+func (c *Client) readServerPacket(conn net.Conn) (ServerMessage, error) {
 	var msg ServerMessage
 	var headerBuf [5]byte // MessageLen(4) + Type(1)
 
 	// Читаем MessageLen и Type
-	if _, err := io.ReadFull(c.conn, headerBuf[:]); err != nil {
+	if _, err := io.ReadFull(conn, headerBuf[:]); err != nil {
 		return msg, err
 	}
 
@@ -128,101 +519,296 @@ func (c *Client) readServerMessage() (ServerMessage, error) {
 	msg.Type = SMType(headerBuf[4])
 
 	// RequestID (12 bytes)
-	if _, err := io.ReadFull(c.conn, msg.RequestID[:]); err != nil {
+	if _, err := io.ReadFull(conn, msg.RequestID[:]); err != nil {
 		return msg, err
 	}
 
+	if msg.Type == PeerList {
+		return msg, readPeerList(conn, &msg, messageLen)
+	}
+	if msg.Type != Income {
+		return msg, readResponseTail(conn, &msg, messageLen)
+	}
+
 	// Для Income читаем SenderID и Payload
-	if msg.Type == Income {
-		if _, err := io.ReadFull(c.conn, msg.SenderID[:]); err != nil {
+	if _, err := io.ReadFull(conn, msg.SenderID[:]); err != nil {
+		return msg, err
+	}
+
+	// Вычисляем длину payload: messageLen - Type(1) - RequestID(12) - SenderID(32)
+	payloadLen := messageLen - 1 - RequestIDSize - PeerIDSize
+
+	if payloadLen > 0 {
+		msg.buf = getPayloadBuf(int(payloadLen))
+		msg.Payload = *msg.buf
+		if _, err := io.ReadFull(conn, msg.Payload); err != nil {
+			msg.Release()
 			return msg, err
 		}
+	}
+
+	return msg, nil
+}
+
+// readPeerList читает список пиров после RequestID: Count(4) + PeerID(32)*Count.
+// В Payload остаются подряд идущие PeerID
+func readPeerList(conn net.Conn, msg *ServerMessage, messageLen uint32) error {
+	if messageLen < 1+RequestIDSize+4 {
+		return fmt.Errorf("peer list is too short: %d bytes", messageLen)
+	}
+	var countBuf [4]byte
+	if _, err := io.ReadFull(conn, countBuf[:]); err != nil {
+		return err
+	}
+	count := binary.BigEndian.Uint32(countBuf[:])
+	listLen := messageLen - 1 - RequestIDSize - 4
+	if uint64(count)*PeerIDSize != uint64(listLen) {
+		return fmt.Errorf("peer list size mismatch: %d peers in %d bytes", count, listLen)
+	}
+
+	if listLen > 0 {
+		msg.buf = getPayloadBuf(int(listLen))
+		msg.Payload = *msg.buf
+		if _, err := io.ReadFull(conn, msg.Payload); err != nil {
+			msg.Release()
+			return err
+		}
+	}
+	return nil
+}
 
-		// Вычисляем длину payload: messageLen - Type(1) - RequestID(12) - SenderID(32)
-		payloadLen := messageLen - 1 - RequestIDSize - PeerIDSize
+// readResponseTail читает остаток ответа после RequestID: код ошибки для
+// Error. Неизвестные байты пропускаются для совместимости с новыми router'ами
+func readResponseTail(conn net.Conn, msg *ServerMessage, messageLen uint32) error {
+	var tail int64
+	if messageLen > 1+RequestIDSize {
+		tail = int64(messageLen - 1 - RequestIDSize)
+	}
 
-		if payloadLen > 0 {
-			msg.Payload = make([]byte, payloadLen)
-			if _, err := io.ReadFull(c.conn, msg.Payload); err != nil {
-				return msg, err
-			}
+	if msg.Type == Error && tail > 0 {
+		var code [1]byte
+		if _, err := io.ReadFull(conn, code[:]); err != nil {
+			return err
+		}
+		msg.Code = ErrorCode(code[0])
+		tail--
+	}
+	if tail > 0 {
+		if _, err := io.CopyN(io.Discard, conn, tail); err != nil {
+			return err
 		}
 	}
 
-	return msg, nil
+	switch msg.Type {
+	case Error:
+		msg.Err = &RouterError{code: msg.Code}
+	case Forbidden:
+		msg.Err = &RouterError{code: ErrCodeForbidden}
+	}
+	return nil
 }
 
+// Send отправляет payload получателю. Payload больше пакета разбивается на
+// фрагменты, получатель собирает их прозрачно. Ответ router'а для
+// фрагментированного сообщения - Success если доставлены все фрагменты,
+// иначе первый неуспешный ответ.
+//
+// Канал ответа закрывается без сообщения по таймауту запроса или отмене
+// ctx. При разрыве соединения или Close приходит ответ с заполненным Err
 func (c *Client) Send(ctx context.Context, recipient PeerID, payload []byte) (<-chan ServerMessage, error) {
-	var reqID RequestID
-	if _, err := rand.Read(reqID[:]); err != nil {
-		return nil, fmt.Errorf("generate request id: %w", err)
-	}
+	return c.send(ctx, recipient, payload, false)
+}
 
-	respCh := make(chan ServerMessage, 1)
+// SendQueued отправляет payload как Send, но router с очередью (см.
+// RouterConfig.OfflineQueueSize) сохранит его для отключенного получателя
+// и ответит Success. Router без очереди отвечает NotFound, как на Send
+func (c *Client) SendQueued(ctx context.Context, recipient PeerID, payload []byte) (<-chan ServerMessage, error) {
+	return c.send(ctx, recipient, payload, true)
+}
 
-	// Захватываем timeout до создания горутины
+func (c *Client) send(ctx context.Context, recipient PeerID, payload []byte, queued bool) (<-chan ServerMessage, error) {
 	c.mu.Lock()
-	timeout := c.reqTimeout
+	maxPayload := int(c.maxPacketSize) - RequestIDSize - PeerIDSize - fragFirstHeaderSize
 	c.mu.Unlock()
 
-	// Добавляем в мапу ДО отправки сообщения
-	c.mu.Lock()
-	c.reqMap[reqID] = respCh
-	c.mu.Unlock()
+	// Для QueueRecipient настоящий получатель идет перед заголовком фрагментации
+	var prefix []byte
+	to := recipient
+	if queued {
+		prefix = recipient[:]
+		to = QueueRecipient
+		maxPayload -= PeerIDSize
+	}
 
-	go func() {
-		<-time.After(timeout)
-		c.mu.Lock()
-		defer c.mu.Unlock()
+	if len(payload) <= maxPayload {
+		frag := fragNoneHeader
+		if queued {
+			frag = append(recipient[:len(recipient):len(recipient)], fragNone)
+		}
+		return c.sendPacket(ctx, to, frag, payload)
+	}
+	if len(payload) > MaxMessageSize {
+		return nil, fmt.Errorf("message is too big: %d bytes (max %d)", len(payload), MaxMessageSize)
+	}
 
-		ch, ok := c.reqMap[reqID]
-		if !ok {
-			return
+	c.fragMu.Lock()
+	var responses []<-chan ServerMessage
+	for of := 0; of < len(payload); of += maxPayload {
+		end := min(of+maxPayload, len(payload))
+
+		frag := make([]byte, len(prefix), len(prefix)+fragFirstHeaderSize)
+		copy(frag, prefix)
+		if of == 0 {
+			frag = append(frag, fragFirst, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(frag[len(prefix)+1:], uint32(len(payload)))
+		} else {
+			frag = append(frag, fragCont)
 		}
 
-		delete(c.reqMap, reqID)
-		close(ch)
+		respCh, err := c.sendPacket(ctx, to, frag, payload[of:end])
+		if err != nil {
+			c.fragMu.Unlock()
+			return nil, err
+		}
+		responses = append(responses, respCh)
+	}
+	c.fragMu.Unlock()
+
+	result := make(chan ServerMessage, 1)
+	go func() {
+		var resp ServerMessage
+		resp.Type = Success
+		for _, respCh := range responses {
+			msg, ok := <-respCh
+			if !ok {
+				// Таймаут или отмена одного из фрагментов
+				close(result)
+				return
+			}
+			if resp.Type == Success {
+				resp = msg
+			}
+		}
+		result <- resp
 	}()
 
+	return result, nil
+}
+
+// sendPacket отправляет один пакет с заголовком фрагментации frag
+func (c *Client) sendPacket(ctx context.Context, recipient PeerID, frag []byte, payload []byte) (<-chan ServerMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var reqID RequestID
+	if _, err := rand.Read(reqID[:]); err != nil {
+		return nil, fmt.Errorf("generate request id: %w", err)
+	}
+
+	req := &pendingRequest{ch: make(chan ServerMessage, 1)}
+	cancel := func() {
+		if req := c.takeRequest(reqID); req != nil {
+			close(req.ch)
+		}
+	}
+
+	// Регистрируем запрос ДО отправки сообщения. Таймер и ctx не могут
+	// сработать раньше, чем будут присвоены: takeRequest ждет c.mu
+	c.mu.Lock()
+	if err := c.connErr(); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.reqMap[reqID] = req
+	req.timer = time.AfterFunc(c.reqTimeout, cancel)
+	req.stopCtx = context.AfterFunc(ctx, cancel)
+	c.mu.Unlock()
+
 	msg := PeerMessage{
 		RequestID: reqID,
 		Recipient: recipient,
 		Payload:   payload,
 	}
 
-	if err := c.writePeerMessage(msg); err != nil {
-		c.mu.Lock()
-		delete(c.reqMap, reqID)
-		c.mu.Unlock()
+	if err := c.writePeerMessage(msg, frag); err != nil {
+		c.takeRequest(reqID)
 		return nil, err
 	}
 
-	return respCh, nil
+	return req.ch, nil
+}
+
+// takeRequest снимает запрос с ожидания и останавливает его таймер.
+// Возвращает nil, если запрос уже завершен
+func (c *Client) takeRequest(reqID RequestID) *pendingRequest {
+	c.mu.Lock()
+	req, ok := c.reqMap[reqID]
+	if ok {
+		delete(c.reqMap, reqID)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	req.stop()
+	return req
+}
+
+// connErr возвращает причину, по которой нельзя писать в соединение.
+// Вызывается под c.mu
+func (c *Client) connErr() error {
+	if c.closed {
+		return ErrClientClosed
+	}
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+func (req *pendingRequest) stop() {
+	req.timer.Stop()
+	req.stopCtx()
 }
 
-func (c *Client) writePeerMessage(msg PeerMessage) error {
-	// Вычисляем длину сообщения: RequestID(12) + Recipient(32) + Payload
-	messageLen := uint32(RequestIDSize + PeerIDSize + len(msg.Payload))
+// writePeerMessage отправляет пакет, frag - заголовок фрагментации перед
+// payload, у QueueRecipient вместе с настоящим получателем
+func (c *Client) writePeerMessage(msg PeerMessage, frag []byte) error {
+	// Вычисляем длину сообщения: RequestID(12) + Recipient(32) + Frag + Payload
+	messageLen := uint32(RequestIDSize + PeerIDSize + len(frag) + len(msg.Payload))
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if err := c.connErr(); err != nil {
+		return err
+	}
+
 	// Формируем заголовок: MessageLen(4) + RequestID(12) + Recipient(32)
 	binary.BigEndian.PutUint32(c.writeBuf[0:4], messageLen)
 	copy(c.writeBuf[4:4+RequestIDSize], msg.RequestID[:])
 	copy(c.writeBuf[4+RequestIDSize:4+RequestIDSize+PeerIDSize], msg.Recipient[:])
+	n := PeerHeaderSize + copy(c.writeBuf[PeerHeaderSize:], frag)
 
-	// Отправляем заголовок
-	if _, err := c.conn.Write(c.writeBuf[:]); err != nil {
-		return err
+	if c.batchWindow > 0 {
+		batched, err := c.appendBatchLocked(c.writeBuf[:n], msg.Payload)
+		if err != nil || batched {
+			return err
+		}
 	}
 
-	// Payload
+	// Заголовок и payload уходят одним writev
+	bufs := net.Buffers(c.writeBufs[:0])
+	bufs = append(bufs, c.writeBuf[:n])
 	if len(msg.Payload) > 0 {
-		if _, err := c.conn.Write(msg.Payload); err != nil {
-			return err
-		}
+		bufs = append(bufs, msg.Payload)
 	}
+	_, err := bufs.WriteTo(c.conn)
 
-	return nil
+	// Не держим ссылку на payload вызывающего
+	c.writeBufs[1] = nil
+
+	return err
 }
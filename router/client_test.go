@@ -0,0 +1,765 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestRouter запускает router на случайном порту
+func startTestRouter(t testing.TB, cfg RouterConfig) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	r := NewRouter(cfg)
+	go r.Serve(lis)
+
+	return lis.Addr().String()
+}
+
+// dialTestClient подключает нового клиента к router
+func dialTestClient(t testing.TB, addr string) (*Client, PeerID, <-chan ServerMessage) {
+	t.Helper()
+
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(pubKey, privKey)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	income, err := client.Dial(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var id PeerID
+	copy(id[:], pubKey)
+	return client, id, income
+}
+
+func waitResponse(t *testing.T, respCh <-chan ServerMessage) ServerMessage {
+	t.Helper()
+
+	select {
+	case msg, ok := <-respCh:
+		if !ok {
+			t.Fatal("Response channel closed (timeout)")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for response")
+	}
+	return ServerMessage{}
+}
+
+func TestClientFragmentation(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{})
+
+	sender1, _, _ := dialTestClient(t, addr)
+	sender2, _, _ := dialTestClient(t, addr)
+	_, recipientID, income := dialTestClient(t, addr)
+
+	time.Sleep(100 * time.Millisecond)
+
+	payload1 := make([]byte, 1024*1024)
+	payload2 := make([]byte, 1024*1024+123)
+	rand.Read(payload1)
+	rand.Read(payload2)
+
+	// Два отправителя одновременно шлют по 1MB одному получателю
+	ctx := context.Background()
+	resp1, err := sender1.Send(ctx, recipientID, payload1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp2, err := sender2.Send(ctx, recipientID, payload2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(map[int]bool)
+	for len(received) < 2 {
+		select {
+		case msg := <-income:
+			switch {
+			case bytes.Equal(msg.Payload, payload1):
+				received[1] = true
+			case bytes.Equal(msg.Payload, payload2):
+				received[2] = true
+			default:
+				t.Fatalf("Received corrupted payload of %d bytes", len(msg.Payload))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for reassembled payload")
+		}
+	}
+
+	if msg := waitResponse(t, resp1); msg.Type != Success {
+		t.Errorf("Expected Success for sender1, got %v", msg.Type)
+	}
+	if msg := waitResponse(t, resp2); msg.Type != Success {
+		t.Errorf("Expected Success for sender2, got %v", msg.Type)
+	}
+}
+
+func TestClientFragmentationSmallPackets(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{MaxPacketSize: MinPacketSize})
+
+	sender, _, _ := dialTestClient(t, addr)
+	sender.SetMaxPacketSize(MinPacketSize)
+	_, recipientID, income := dialTestClient(t, addr)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Короткое и длинное сообщения
+	small := []byte("hello")
+	large := make([]byte, 1024*1024)
+	rand.Read(large)
+
+	for _, payload := range [][]byte{small, large} {
+		respCh, err := sender.Send(context.Background(), recipientID, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case msg := <-income:
+			if !bytes.Equal(msg.Payload, payload) {
+				t.Fatalf("Payload mismatch: got %d bytes, want %d", len(msg.Payload), len(payload))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for payload")
+		}
+
+		if msg := waitResponse(t, respCh); msg.Type != Success {
+			t.Fatalf("Expected Success, got %v", msg.Type)
+		}
+	}
+}
+
+func TestClientFragmentationNotFound(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{})
+
+	sender, _, _ := dialTestClient(t, addr)
+	time.Sleep(100 * time.Millisecond)
+
+	var unknown PeerID
+	rand.Read(unknown[:])
+
+	respCh, err := sender.Send(context.Background(), unknown, make([]byte, 100*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := waitResponse(t, respCh); msg.Type != NotFound {
+		t.Fatalf("Expected NotFound, got %v", msg.Type)
+	}
+}
+
+// TestClientRouterErrorCode проверяет, что код ошибки router'а доходит до
+// клиента как *RouterError
+func TestClientRouterErrorCode(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{MaxPacketSize: MinPacketSize})
+
+	// Клиент рассчитан на больший пакет, чем принимает router
+	sender, _, _ := dialTestClient(t, addr)
+	time.Sleep(100 * time.Millisecond)
+
+	var unknown PeerID
+	rand.Read(unknown[:])
+
+	respCh, err := sender.Send(context.Background(), unknown, make([]byte, MinPacketSize+1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := waitResponse(t, respCh)
+	if msg.Type != Error || msg.Code != ErrCodeTooLarge {
+		t.Fatalf("Expected Error with TooLarge, got %v code %v", msg.Type, msg.Code)
+	}
+
+	var rerr *RouterError
+	if !errors.As(msg.Err, &rerr) {
+		t.Fatalf("Expected *RouterError, got %v", msg.Err)
+	}
+	if rerr.Code() != ErrCodeTooLarge {
+		t.Fatalf("Expected code TooLarge, got %v", rerr.Code())
+	}
+}
+
+func TestClientBatching(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	r := NewRouter(RouterConfig{})
+	go r.Serve(lis)
+
+	sender, _, _ := dialTestClient(t, lis.Addr().String())
+	_, receiverID, income := dialTestClient(t, lis.Addr().String())
+	time.Sleep(100 * time.Millisecond)
+
+	// Окно больше теста: пачку отправляет только Flush
+	sender.SetBatchWindow(time.Hour)
+
+	var unknown PeerID
+	rand.Read(unknown[:])
+
+	cases := []struct {
+		recipient PeerID
+		payload   string
+		want      SMType
+	}{
+		{receiverID, "first", Success},
+		{unknown, "lost", NotFound},
+		{receiverID, "second", Success},
+	}
+	var responses []<-chan ServerMessage
+	for _, tc := range cases {
+		respCh, err := sender.Send(context.Background(), tc.recipient, []byte(tc.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, respCh)
+	}
+
+	select {
+	case <-income:
+		t.Fatal("Message delivered before Flush")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := sender.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, respCh := range responses {
+		if msg := waitResponse(t, respCh); msg.Type != cases[i].want {
+			t.Fatalf("Message %d: expected %v, got %v", i, cases[i].want, msg.Type)
+		}
+	}
+	for _, want := range []string{"first", "second"} {
+		select {
+		case msg := <-income:
+			if string(msg.Payload) != want {
+				t.Fatalf("Expected %q, got %q", want, msg.Payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for %q", want)
+		}
+	}
+
+	if got := r.Metrics().BatchesReceived.Load(); got != 1 {
+		t.Fatalf("Expected 1 batch, got %d", got)
+	}
+}
+
+// TestClientBatchingWindow проверяет отправку пачки по окну и то, что
+// фрагментированное сообщение не обгоняет накопленные
+func TestClientBatchingWindow(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{})
+
+	sender, _, _ := dialTestClient(t, addr)
+	_, receiverID, income := dialTestClient(t, addr)
+	time.Sleep(100 * time.Millisecond)
+
+	sender.SetBatchWindow(10 * time.Millisecond)
+
+	large := make([]byte, 100*1024)
+	rand.Read(large)
+	payloads := [][]byte{[]byte("small"), large, []byte("last")}
+	for _, payload := range payloads {
+		if _, err := sender.Send(context.Background(), receiverID, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range payloads {
+		select {
+		case msg := <-income:
+			if !bytes.Equal(msg.Payload, want) {
+				t.Fatalf("Message %d: payload mismatch (%d bytes, want %d)", i, len(msg.Payload), len(want))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for message %d", i)
+		}
+	}
+}
+
+func TestServerMessageRelease(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{})
+
+	sender, _, _ := dialTestClient(t, addr)
+	_, recipientID, income := dialTestClient(t, addr)
+	time.Sleep(100 * time.Millisecond)
+
+	for _, payload := range [][]byte{[]byte("first"), []byte("second message")} {
+		if _, err := sender.Send(context.Background(), recipientID, payload); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-income:
+			if !bytes.Equal(msg.Payload, payload) {
+				t.Fatalf("Payload mismatch: got %q, want %q", msg.Payload, payload)
+			}
+			msg.Release()
+			if msg.Payload != nil {
+				t.Fatal("Payload must be nil after Release")
+			}
+			msg.Release()
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for payload")
+		}
+	}
+}
+
+// BenchmarkClientSendReceive сравнивает аллокации при доставке Income
+// с возвратом буфера в пул (Release) и без него
+func BenchmarkClientSendReceive(b *testing.B) {
+	for _, release := range []bool{false, true} {
+		name := "NoRelease"
+		if release {
+			name = "Release"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			addr := startTestRouter(b, RouterConfig{})
+			sender, _, _ := dialTestClient(b, addr)
+			_, recipientID, income := dialTestClient(b, addr)
+			time.Sleep(100 * time.Millisecond)
+
+			payload := make([]byte, 4096)
+			rand.Read(payload)
+			ctx := context.Background()
+
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				respCh, err := sender.Send(ctx, recipientID, payload)
+				if err != nil {
+					b.Fatal(err)
+				}
+				msg := <-income
+				if release {
+					msg.Release()
+				}
+				<-respCh
+			}
+		})
+	}
+}
+
+// startSilentRouter принимает одно соединение, проходит аутентификацию и
+// никогда не отвечает на сообщения. Закрытие возвращенного канала рвет соединение
+func startSilentRouter(t *testing.T) (string, chan struct{}) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	drop := make(chan struct{})
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		auth := make([]byte, PeerIDSize+ed25519.SignatureSize)
+		if _, err := io.ReadFull(conn, auth[:PeerIDSize]); err != nil {
+			return
+		}
+		if _, err := conn.Write(make([]byte, ChallangeSize)); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, auth[PeerIDSize:]); err != nil {
+			return
+		}
+
+		go io.Copy(io.Discard, conn)
+		<-drop
+	}()
+
+	return lis.Addr().String(), drop
+}
+
+func TestClientSendEarlyResponse(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{})
+	client, _, _ := dialTestClient(t, addr)
+	client.SetRequestTimeout(time.Hour)
+	time.Sleep(100 * time.Millisecond)
+
+	var unknown PeerID
+	rand.Read(unknown[:])
+
+	respCh, err := client.Send(context.Background(), unknown, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := waitResponse(t, respCh); msg.Type != NotFound {
+		t.Fatalf("Expected NotFound, got %v", msg.Type)
+	}
+
+	// Ответ снимает запрос с ожидания и останавливает его таймер
+	client.mu.Lock()
+	pending := len(client.reqMap)
+	client.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("Expected no pending requests, got %d", pending)
+	}
+}
+
+func TestClientSendContextCancel(t *testing.T) {
+	addr, _ := startSilentRouter(t)
+	client, _, _ := dialTestClient(t, addr)
+	client.SetRequestTimeout(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	respCh, err := client.Send(ctx, PeerID{1}, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case _, ok := <-respCh:
+		if ok {
+			t.Fatal("Expected channel to be closed without response")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Response channel was not closed on ctx cancel")
+	}
+
+	if _, err := client.Send(ctx, PeerID{1}, []byte("test")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled for canceled ctx, got %v", err)
+	}
+}
+
+func TestClientSendTimeout(t *testing.T) {
+	addr, _ := startSilentRouter(t)
+	client, _, _ := dialTestClient(t, addr)
+	client.SetRequestTimeout(100 * time.Millisecond)
+
+	start := time.Now()
+	respCh, err := client.Send(context.Background(), PeerID{1}, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-respCh:
+		if ok {
+			t.Fatal("Expected channel to be closed without response")
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Fatalf("Channel closed too early: %v", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Response channel was not closed on timeout")
+	}
+}
+
+func TestClientSendNotConnected(t *testing.T) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(pubKey, privKey)
+	if _, err := client.Send(context.Background(), PeerID{1}, []byte("test")); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Expected ErrNotConnected before Dial, got %v", err)
+	}
+
+	addr, drop := startSilentRouter(t)
+	client, _, _ = dialTestClient(t, addr)
+	client.SetRequestTimeout(time.Hour)
+
+	respCh, err := client.Send(context.Background(), PeerID{1}, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(drop)
+
+	// Разрыв соединения завершает ожидающие запросы
+	if msg := waitResponse(t, respCh); !errors.Is(msg.Err, ErrNotConnected) {
+		t.Fatalf("Expected ErrNotConnected response, got %+v", msg)
+	}
+
+	if _, err := client.Send(context.Background(), PeerID{1}, []byte("test")); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Expected ErrNotConnected after disconnect, got %v", err)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{})
+	client, _, income := dialTestClient(t, addr)
+	_, recipientID, recipientIncome := dialTestClient(t, addr)
+	time.Sleep(100 * time.Millisecond)
+
+	go func() {
+		for range recipientIncome {
+		}
+	}()
+
+	// Отправляем из нескольких горутин, пока клиент не будет закрыт
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				respCh, err := client.Send(context.Background(), recipientID, []byte("in flight"))
+				if errors.Is(err, ErrClientClosed) {
+					return
+				}
+				if err != nil {
+					// Запись могла упасть на закрытом сокете
+					continue
+				}
+				msg, ok := <-respCh
+				if ok && msg.Type != Success && !errors.Is(msg.Err, ErrClientClosed) {
+					t.Errorf("Unexpected response: %+v", msg)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	select {
+	case _, ok := <-income:
+		if ok {
+			t.Fatal("Expected income channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Income channel was not closed")
+	}
+
+	if _, err := client.Send(context.Background(), recipientID, []byte("after close")); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("Expected ErrClientClosed, got %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Second Close returned error: %v", err)
+	}
+}
+
+func TestClientClosePendingRequests(t *testing.T) {
+	addr, _ := startSilentRouter(t)
+	client, _, _ := dialTestClient(t, addr)
+	client.SetRequestTimeout(time.Hour)
+
+	respCh, err := client.Send(context.Background(), PeerID{1}, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	if msg := waitResponse(t, respCh); msg.Type != Error || !errors.Is(msg.Err, ErrClientClosed) {
+		t.Fatalf("Expected ErrClientClosed response, got %+v", msg)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	r := NewRouter(RouterConfig{})
+	go r.Serve(lis)
+
+	client, id, income := dialTestClient(t, lis.Addr().String())
+	time.Sleep(100 * time.Millisecond)
+
+	if err := r.Disconnect(id); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-client.Errors():
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("Expected EOF, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for read error")
+	}
+	if _, ok := <-income; ok {
+		t.Fatal("Expected income to be closed")
+	}
+
+	// Close - не ошибка
+	closed, _, _ := dialTestClient(t, lis.Addr().String())
+	closed.Close()
+	select {
+	case err := <-closed.Errors():
+		t.Fatalf("Unexpected error after Close: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// waitPeerList ждет список пиров из count элементов
+func waitPeerList(t *testing.T, client *Client, count int) []PeerID {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ids := <-client.PeerListUpdates():
+			if len(ids) == count {
+				return ids
+			}
+		case <-timeout:
+			t.Fatalf("Timeout waiting for peer list of %d peers", count)
+		}
+	}
+}
+
+func TestClientPeerList(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{EnablePeerList: true})
+
+	client1, id1, _ := dialTestClient(t, addr)
+	defer client1.Close()
+	if ids := waitPeerList(t, client1, 1); ids[0] != id1 {
+		t.Fatal("Expected peer list with ourselves")
+	}
+
+	client2, id2, _ := dialTestClient(t, addr)
+	ids := waitPeerList(t, client1, 2)
+	if !(ids[0] == id1 && ids[1] == id2) && !(ids[0] == id2 && ids[1] == id1) {
+		t.Fatal("Expected peer list with both peers")
+	}
+	waitPeerList(t, client2, 2)
+
+	// Отключение второго пира рассылается оставшимся
+	client2.Close()
+	if ids := waitPeerList(t, client1, 1); ids[0] != id1 {
+		t.Fatal("Expected peer list without disconnected peer")
+	}
+
+	// Список не мешает обычным сообщениям
+	respCh, err := client1.Send(context.Background(), id2, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := waitResponse(t, respCh); resp.Type != NotFound {
+		t.Fatalf("Expected NotFound, got %v", resp.Type)
+	}
+}
+
+// TestPeerListFullQueue проверяет, что рассылка списка не ждет пира с
+// полной очередью записи, а изменения до рассылки уходят одним списком
+func TestPeerListFullQueue(t *testing.T) {
+	r := NewRouter(RouterConfig{EnablePeerList: true})
+	stuck := &Peer{ID: PeerID{1}, writeQueue: make(chan []byte, 1), done: make(chan struct{})}
+	stuck.writeQueue <- nil
+	ready := &Peer{ID: PeerID{2}, writeQueue: make(chan []byte, 2), done: make(chan struct{})}
+	r.peers.Store(stuck.ID, stuck)
+	r.peers.Store(ready.ID, ready)
+
+	for range 3 {
+		r.schedulePeerList()
+	}
+	time.Sleep(2 * PeerListDelay)
+
+	if len(ready.writeQueue) != 1 {
+		t.Fatalf("Expected 1 peer list, got %d frames", len(ready.writeQueue))
+	}
+	frame := <-ready.writeQueue
+	if SMType(frame[4]) != PeerList || binary.BigEndian.Uint32(frame[4+1+RequestIDSize:]) != 2 {
+		t.Fatalf("Unexpected frame %x", frame)
+	}
+	if len(stuck.writeQueue) != 1 {
+		t.Fatal("Full queue of the stuck peer changed")
+	}
+}
+
+func TestClientPeerListDisabled(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{})
+
+	client1, _, _ := dialTestClient(t, addr)
+	defer client1.Close()
+	client2, _, _ := dialTestClient(t, addr)
+	defer client2.Close()
+
+	select {
+	case ids := <-client1.PeerListUpdates():
+		t.Fatalf("Unexpected peer list of %d peers", len(ids))
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestReassembleLimits(t *testing.T) {
+	c := NewClient(nil, nil)
+	first := func(total uint32, data []byte) []byte {
+		frag := binary.BigEndian.AppendUint32([]byte{fragFirst}, total)
+		return append(frag, data...)
+	}
+
+	// Заявленная длина не выделяется заранее
+	c.reassemble(PeerID{1}, first(MaxMessageSize, []byte("abc")))
+	if got := cap(c.partial[PeerID{1}].buf); got > 1024 {
+		t.Fatalf("Buffer of %d bytes preallocated", got)
+	}
+
+	// Новые отправители вытесняют самые давние
+	for i := range maxPartialSenders + 10 {
+		c.reassemble(PeerID{2, byte(i)}, first(100, []byte("abc")))
+	}
+	if len(c.partial) != maxPartialSenders {
+		t.Fatalf("Expected %d partial senders, got %d", maxPartialSenders, len(c.partial))
+	}
+	if _, ok := c.partial[PeerID{1}]; ok {
+		t.Fatal("Oldest sender not evicted")
+	}
+
+	// Фрагменты сверх общего лимита отбрасывают сообщение
+	clear(c.partial)
+	c.partialSize = maxPartialBytes - 1
+	if _, ok := c.reassemble(PeerID{3}, first(10, []byte("abc"))); ok {
+		t.Fatal("Message reassembled over the limit")
+	}
+	if _, ok := c.partial[PeerID{3}]; ok {
+		t.Fatal("Message over the limit kept")
+	}
+	c.partialSize = 0
+
+	// Фрагмент больше заявленной длины отбрасывает сообщение
+	c.reassemble(PeerID{4}, first(4, []byte("abc")))
+	if _, ok := c.reassemble(PeerID{4}, []byte{fragCont, 'd', 'e'}); ok {
+		t.Fatal("Oversized message reassembled")
+	}
+	if _, ok := c.partial[PeerID{4}]; ok {
+		t.Fatal("Oversized message kept")
+	}
+
+	c.reassemble(PeerID{5}, first(4, []byte("abc")))
+	if got, ok := c.reassemble(PeerID{5}, []byte{fragCont, 'd'}); !ok || string(got) != "abcd" {
+		t.Fatalf("Unexpected message %q, %v", got, ok)
+	}
+}
@@ -6,11 +6,24 @@ import (
 )
 
 const (
-	ChallangeSize  = 32
-	PeerIDSize     = ed25519.PublicKeySize
-	AuthTimeout    = 5 * time.Second // SECURITY: Увеличен с 1s до 5s для медленных соединений
-	WriteTimeout   = 5 * time.Second // SECURITY: Увеличен для консистентности
-	RequestIDSize  = 12
-	MaxPacketSize  = 32 * 1024 // 32 KB
-	PeerHeaderSize = 4 + RequestIDSize + PeerIDSize
+	ChallangeSize     = 32
+	PeerIDSize        = ed25519.PublicKeySize
+	AuthTimeout       = 5 * time.Second  // SECURITY: Увеличен с 1s до 5s для медленных соединений
+	WriteTimeout      = 5 * time.Second  // SECURITY: Увеличен для консистентности
+	IdleTimeout       = 90 * time.Second // Отключаем пира, если от него нет сообщений (включая keepalive)
+	KeepaliveInterval = 30 * time.Second // Должен быть заметно меньше IdleTimeout
+	RequestIDSize     = 12
+	MaxPacketSize     = 32 * 1024        // 32 KB
+	MinPacketSize     = 16 * 1024        // Буфер пакета используется и для CopyBuffer
+	MaxMessageSize    = 16 * 1024 * 1024 // Максимальный размер собранного из фрагментов сообщения
+	PeerHeaderSize    = 4 + RequestIDSize + PeerIDSize
+	QuotaWindow       = time.Hour              // Окно квоты трафика пира по умолчанию
+	OfflineQueueTTL   = 5 * time.Minute        // Сколько router хранит сообщение отключенному получателю по умолчанию
+	WriteQueueSize    = 256                    // Пакетов в очереди записи пира, сверх отвечаем ErrCodeRecipientBusy. Вмещает несколько фрагментированных сообщений
+	PeerListDelay     = 100 * time.Millisecond // Подключения и отключения за это время уходят одним списком пиров
+)
+
+const (
+	OfflineQueueMaxBytes      = 64 * 1024 * 1024 // Байт во всех очередях отключенных получателей по умолчанию
+	OfflineQueueMaxRecipients = 10000            // Отключенных получателей с очередью по умолчанию
 )
@@ -0,0 +1,79 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UnixScheme - префикс адреса unix socket: unix:///run/sendy/router.sock
+const UnixScheme = "unix://"
+
+// unixSocketPerm - права на сокет и создаваемую для него директорию
+const unixSocketPerm = 0700
+
+var ErrSocketInUse = errors.New("unix socket is in use")
+
+// Listen слушает addr: unix:///path для unix socket, иначе TCP host:port
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, UnixScheme); ok {
+		return listenUnix(path)
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen: %w", err)
+	}
+	return lis, nil
+}
+
+// listenUnix создает сокет с правами 0700. Сокет, оставшийся после
+// прошлого запуска, удаляется; занятый сокет или не сокет - ошибка
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty unix socket path")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), unixSocketPerm); err != nil {
+		return nil, fmt.Errorf("create socket directory: %w", err)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen: %w", err)
+	}
+	if err := os.Chmod(path, unixSocketPerm); err != nil {
+		lis.Close()
+		return nil, fmt.Errorf("chmod socket: %w", err)
+	}
+	return lis, nil
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat socket: %w", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	// На сокете кто-то слушает - не отбираем его
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: %s", ErrSocketInUse, path)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenUnixPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "router.sock")
+
+	lis, err := Listen(UnixScheme + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("Expected socket, got mode %v", fi.Mode())
+	}
+	if perm := fi.Mode().Perm(); perm != 0700 {
+		t.Fatalf("Expected socket permissions 0700, got %o", perm)
+	}
+
+	// Сокет занят работающим router'ом
+	if _, err := Listen(UnixScheme + path); !errors.Is(err, ErrSocketInUse) {
+		t.Fatalf("Expected ErrSocketInUse, got %v", err)
+	}
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "router.sock")
+
+	// Сокет остался после аварийного завершения
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	lis, err := Listen(UnixScheme + path)
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+	lis.Close()
+
+	// Обычный файл не удаляется
+	regular := filepath.Join(dir, "file")
+	if err := os.WriteFile(regular, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(UnixScheme + regular); err == nil {
+		t.Fatal("Expected error for non-socket file")
+	}
+	if _, err := os.Stat(regular); err != nil {
+		t.Fatalf("Regular file was removed: %v", err)
+	}
+}
+
+func TestUnixSocketReconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.sock")
+	addr := UnixScheme + path
+
+	startRouter := func() (*Router, net.Listener) {
+		lis, err := Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewRouter(RouterConfig{})
+		go r.Serve(lis)
+		return r, lis
+	}
+
+	sendNotFound := func(client *Client) {
+		t.Helper()
+		respCh, err := client.Send(context.Background(), PeerID{1}, []byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg := waitResponse(t, respCh); msg.Type != NotFound {
+			t.Fatalf("Expected NotFound, got %v", msg.Type)
+		}
+	}
+
+	r, lis := startRouter()
+	client, id, income := dialTestClient(t, addr)
+	time.Sleep(100 * time.Millisecond)
+	sendNotFound(client)
+
+	// Перезапуск router'а: соединение рвется, сокет создается заново
+	lis.Close()
+	if err := r.Disconnect(id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-income:
+		if ok {
+			t.Fatal("Expected income channel to be closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Client did not notice router shutdown")
+	}
+
+	_, lis = startRouter()
+	defer lis.Close()
+
+	income, err := client.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	defer client.Close()
+	go func() {
+		for range income {
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	sendNotFound(client)
+}
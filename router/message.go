@@ -1,7 +1,32 @@
 package router
 
+import "fmt"
+
 type RequestID [RequestIDSize]byte
 
+// KeepaliveRecipient is the recipient of keepalive messages. Router only
+// resets the idle timeout on them and does not reply.
+var KeepaliveRecipient = PeerID{}
+
+// BatchRecipient - получатель пачки сообщений. Payload пачки - подряд идущие
+// PeerMessage в обычном формате, router маршрутизирует каждое отдельно
+var BatchRecipient = PeerID{
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+}
+
+// QueueRecipient - получатель сообщения, которое router с очередью
+// (см. RouterConfig.OfflineQueueSize) сохранит для отключенного получателя.
+// Payload начинается с ID настоящего получателя, см. Client.SendQueued
+var QueueRecipient = PeerID{
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe,
+}
+
 type PeerMessage struct {
 	RequestID RequestID
 	Recipient PeerID
@@ -13,6 +38,26 @@ type ServerMessage struct {
 	RequestID RequestID
 	SenderID  PeerID
 	Payload   []byte
+	// Code уточняет причину для ответа Error
+	Code ErrorCode
+	// Err описывает неуспешный ответ: *RouterError для Error и Forbidden от
+	// router'а, ErrClientClosed/ErrNotConnected если запрос завершился
+	// локально без ответа (Type в этом случае Error)
+	Err error
+
+	buf *[]byte // буфер Payload из пула, см. Release
+}
+
+// Release возвращает буфер Payload в пул для переиспользования. После
+// вызова Payload использовать нельзя, вызывать не более одного раза.
+// Вызов не обязателен: без Release буфер просто соберет GC
+func (m *ServerMessage) Release() {
+	if m.buf == nil {
+		return
+	}
+	putPayloadBuf(m.buf)
+	m.buf = nil
+	m.Payload = nil
 }
 
 type SMType uint8
@@ -22,4 +67,55 @@ const (
 	Error
 	NotFound
 	Income
+	Forbidden // Отправитель или получатель забанен
+	PeerList  // Список подключенных пиров, см. RouterConfig.EnablePeerList
 )
+
+// ErrorCode передается одним байтом после RequestID в ответе Error
+type ErrorCode uint8
+
+const (
+	ErrCodeUnknown              ErrorCode = iota // Ответ без кода
+	ErrCodeRecipientWriteFailed                  // Не удалось записать сообщение получателю
+	ErrCodeTooLarge                              // Сообщение больше MaxPacketSize router'а
+	ErrCodeRateLimited                           // Превышен лимит отправителя
+	ErrCodeForbidden                             // Отправитель или получатель забанен
+	ErrCodeInternal                              // Внутренняя ошибка router'а
+	ErrCodeRecipientBusy                         // Очередь записи получателя заполнена
+	ErrCodeOfflineQueueFull                      // Очередь сообщений отключенного получателя заполнена
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrCodeRecipientWriteFailed:
+		return "recipient write failed"
+	case ErrCodeTooLarge:
+		return "message too large"
+	case ErrCodeRateLimited:
+		return "rate limited"
+	case ErrCodeForbidden:
+		return "forbidden"
+	case ErrCodeInternal:
+		return "internal router error"
+	case ErrCodeRecipientBusy:
+		return "recipient busy"
+	case ErrCodeOfflineQueueFull:
+		return "recipient offline queue full"
+	default:
+		return fmt.Sprintf("unknown error (%d)", uint8(c))
+	}
+}
+
+// RouterError - ошибка, которую вернул router на запрос
+type RouterError struct {
+	code ErrorCode
+}
+
+func (e *RouterError) Error() string {
+	return "router: " + e.code.String()
+}
+
+// Code возвращает код ошибки router'а
+func (e *RouterError) Code() ErrorCode {
+	return e.code
+}
@@ -0,0 +1,111 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Metrics holds router counters. All fields are updated atomically so the
+// hot path in handleConn/handleMessage never takes a lock.
+type Metrics struct {
+	PeersConnected      atomic.Int64
+	AuthFailures        atomic.Uint64
+	MessagesSuccess     atomic.Uint64
+	MessagesNotFound    atomic.Uint64
+	MessagesError       atomic.Uint64
+	MessagesForbidden   atomic.Uint64
+	MessagesRateLimited atomic.Uint64
+	MessagesBusy        atomic.Uint64
+	MessagesQueued      atomic.Uint64
+	MessagesQueueFull   atomic.Uint64
+	OfflineExpired      atomic.Uint64
+	BytesForwarded      atomic.Uint64
+	WriteTimeouts       atomic.Uint64
+	BatchesReceived     atomic.Uint64
+	ConnsRateLimited    atomic.Uint64
+}
+
+// WritePrometheus writes metrics in Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	metrics := []struct {
+		name    string
+		help    string
+		kind    string
+		samples []string
+	}{
+		{"sendy_router_peers_connected", "Number of currently authenticated peers.", "gauge", []string{
+			fmt.Sprintf("sendy_router_peers_connected %d", m.PeersConnected.Load()),
+		}},
+		{"sendy_router_messages_total", "Total number of routed messages by result.", "counter", []string{
+			fmt.Sprintf(`sendy_router_messages_total{result="success"} %d`, m.MessagesSuccess.Load()),
+			fmt.Sprintf(`sendy_router_messages_total{result="notfound"} %d`, m.MessagesNotFound.Load()),
+			fmt.Sprintf(`sendy_router_messages_total{result="error"} %d`, m.MessagesError.Load()),
+			fmt.Sprintf(`sendy_router_messages_total{result="forbidden"} %d`, m.MessagesForbidden.Load()),
+			fmt.Sprintf(`sendy_router_messages_total{result="ratelimited"} %d`, m.MessagesRateLimited.Load()),
+			fmt.Sprintf(`sendy_router_messages_total{result="busy"} %d`, m.MessagesBusy.Load()),
+			fmt.Sprintf(`sendy_router_messages_total{result="queued"} %d`, m.MessagesQueued.Load()),
+			fmt.Sprintf(`sendy_router_messages_total{result="queuefull"} %d`, m.MessagesQueueFull.Load()),
+		}},
+		{"sendy_router_bytes_forwarded_total", "Total number of payload bytes forwarded to recipients.", "counter", []string{
+			fmt.Sprintf("sendy_router_bytes_forwarded_total %d", m.BytesForwarded.Load()),
+		}},
+		{"sendy_router_auth_failures_total", "Total number of failed authentications.", "counter", []string{
+			fmt.Sprintf("sendy_router_auth_failures_total %d", m.AuthFailures.Load()),
+		}},
+		{"sendy_router_write_timeouts_total", "Total number of write timeouts to recipients.", "counter", []string{
+			fmt.Sprintf("sendy_router_write_timeouts_total %d", m.WriteTimeouts.Load()),
+		}},
+		{"sendy_router_batches_total", "Total number of received message batches.", "counter", []string{
+			fmt.Sprintf("sendy_router_batches_total %d", m.BatchesReceived.Load()),
+		}},
+		{"sendy_router_offline_expired_total", "Total number of queued messages for offline peers dropped after the queue TTL.", "counter", []string{
+			fmt.Sprintf("sendy_router_offline_expired_total %d", m.OfflineExpired.Load()),
+		}},
+		{"sendy_router_conns_rate_limited_total", "Total number of connections closed by the per-IP rate limit.", "counter", []string{
+			fmt.Sprintf("sendy_router_conns_rate_limited_total %d", m.ConnsRateLimited.Load()),
+		}},
+	}
+
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind); err != nil {
+			return err
+		}
+		for _, sample := range metric.samples {
+			if _, err := fmt.Fprintln(w, sample); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves metrics in Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := m.WritePrometheus(w); err != nil {
+		slog.Debug("Failed to write metrics", "error", err)
+	}
+}
+
+// ServeMetrics starts an HTTP server exposing metrics on /metrics
+func ServeMetrics(addr string, m *Metrics) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	slog.Info("Metrics listening", "address", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		return fmt.Errorf("http.ListenAndServe: %w", err)
+	}
+	return nil
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
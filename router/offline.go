@@ -0,0 +1,190 @@
+package router
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// offlineMessage - кадр Income для отключенного получателя
+type offlineMessage struct {
+	frame    []byte
+	queuedAt time.Time
+}
+
+// offlineQueue - сообщения, ждущие подключения получателя, старые первыми.
+// Поля защищены Router.offlineMu
+type offlineQueue struct {
+	msgs  []offlineMessage
+	timer *time.Timer // удаляет истекшие сообщения, nil у пустой очереди
+	// Очередь уже убрана из Router.offline: выдана получателю или истекла.
+	// Отправитель, успевший ее загрузить, берет новую
+	dead bool
+	// Очередь учтена в Router.offlineQueues
+	counted bool
+}
+
+// expireLocked удаляет сообщения очереди, пролежавшие OfflineQueueTTL, и
+// возвращает их число. Вызывается под offlineMu
+func (r *Router) expireLocked(q *offlineQueue, now time.Time) int {
+	n := 0
+	for n < len(q.msgs) && now.Sub(q.msgs[n].queuedAt) >= r.cfg.OfflineQueueTTL {
+		r.offlineBytes -= len(q.msgs[n].frame)
+		n++
+	}
+	clear(q.msgs[:n])
+	q.msgs = q.msgs[n:]
+	return n
+}
+
+// killLocked помечает очередь убранной из Router.offline и снимает ее
+// сообщения с учета. Вызывается под offlineMu
+func (r *Router) killLocked(q *offlineQueue) {
+	q.dead = true
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	for _, msg := range q.msgs {
+		r.offlineBytes -= len(msg.frame)
+	}
+	if q.counted {
+		q.counted = false
+		r.offlineQueues--
+	}
+}
+
+// queueOffline сохраняет сообщение для отключенного получателя до его
+// подключения, отправитель получает Success. Сверх OfflineQueueSize
+// сообщений получателя, OfflineQueueMaxBytes байт или
+// OfflineQueueMaxRecipients получателей во всех очередях отправитель
+// получает ErrCodeOfflineQueueFull
+func (r *Router) queueOffline(peer *Peer, src io.Reader, buf []byte, reqID []byte, recipient PeerID, payloadLen uint32) error {
+	// Кадр живет до OfflineQueueTTL, поэтому не из пула и без запаса
+	frame := make([]byte, incomeHeaderLen+payloadLen)
+	if _, err := io.ReadFull(src, frame[incomeHeaderLen:]); err != nil {
+		return fmt.Errorf("read payload: %w", err)
+	}
+	putIncomeHeader(frame, reqID, peer.ID)
+
+	now := time.Now()
+	var q *offlineQueue
+	for {
+		val, _ := r.offline.LoadOrStore(recipient, &offlineQueue{})
+		q = val.(*offlineQueue)
+		r.offlineMu.Lock()
+		if !q.dead {
+			break
+		}
+		r.offlineMu.Unlock()
+	}
+	expired := r.expireLocked(q, now)
+	// SECURITY: любой пир может слать сообщения случайным ID, поэтому
+	// память всех очередей ограничена, а не только каждой очереди
+	full := len(q.msgs) >= r.cfg.OfflineQueueSize ||
+		r.offlineBytes+len(frame) > r.cfg.OfflineQueueMaxBytes ||
+		!q.counted && r.offlineQueues >= r.cfg.OfflineQueueMaxRecipients
+	if !full {
+		if !q.counted {
+			q.counted = true
+			r.offlineQueues++
+		}
+		q.msgs = append(q.msgs, offlineMessage{frame: frame, queuedAt: now})
+		r.offlineBytes += len(frame)
+		if q.timer == nil {
+			q.timer = time.AfterFunc(r.cfg.OfflineQueueTTL, func() { r.expireOffline(recipient, q) })
+		}
+	} else if len(q.msgs) == 0 {
+		// Пустая очередь не должна остаться в Router.offline навсегда
+		r.killLocked(q)
+		r.offline.CompareAndDelete(recipient, q)
+	}
+	r.offlineMu.Unlock()
+	r.metrics.OfflineExpired.Add(uint64(expired))
+
+	if full {
+		slog.Debug("Offline queue is full, sending QueueFull",
+			"recipient", hex.EncodeToString(recipient[:8]),
+			"from", hex.EncodeToString(peer.ID[:8]))
+		r.metrics.MessagesQueueFull.Add(1)
+		return writeErrorResponse(peer, buf, reqID, ErrCodeOfflineQueueFull)
+	}
+
+	r.metrics.MessagesQueued.Add(1)
+	slog.Debug("Message queued for offline recipient",
+		"from", hex.EncodeToString(peer.ID[:8]),
+		"to", hex.EncodeToString(recipient[:8]),
+		"payloadLen", payloadLen)
+
+	// Получатель мог подключиться и забрать очередь, пока читался payload
+	if recipientPeer, ok := r.peers.Load(recipient); ok {
+		go r.drainOffline(recipientPeer)
+	}
+
+	binary.BigEndian.PutUint32(buf[0:4], 1+RequestIDSize)
+	buf[4] = byte(Success)
+	copy(buf[5:5+RequestIDSize], reqID)
+	return peer.writeResponse(buf[:5+RequestIDSize])
+}
+
+// expireOffline удаляет истекшие сообщения очереди q получателя id. Пустая
+// очередь убирается, иначе таймер взводится на следующее сообщение
+func (r *Router) expireOffline(id PeerID, q *offlineQueue) {
+	r.offlineMu.Lock()
+	defer r.offlineMu.Unlock()
+	if q.dead {
+		return
+	}
+
+	now := time.Now()
+	expired := r.expireLocked(q, now)
+	if len(q.msgs) == 0 {
+		r.killLocked(q)
+		r.offline.CompareAndDelete(id, q)
+	} else {
+		q.timer.Reset(r.cfg.OfflineQueueTTL - now.Sub(q.msgs[0].queuedAt))
+	}
+
+	if expired > 0 {
+		r.metrics.OfflineExpired.Add(uint64(expired))
+		slog.Debug("Offline messages expired", "recipient", hex.EncodeToString(id[:8]), "count", expired)
+	}
+}
+
+// drainOffline передает подключившемуся пиру сообщения, накопленные, пока
+// его не было. Если пир снова отключился, оставшиеся сообщения теряются
+func (r *Router) drainOffline(peer *Peer) {
+	val, ok := r.offline.LoadAndDelete(peer.ID)
+	if !ok {
+		return
+	}
+	q := val.(*offlineQueue)
+
+	r.offlineMu.Lock()
+	expired := r.expireLocked(q, time.Now())
+	r.killLocked(q)
+	msgs := q.msgs
+	q.msgs = nil
+	r.offlineMu.Unlock()
+	r.metrics.OfflineExpired.Add(uint64(expired))
+
+	hexID := hex.EncodeToString(peer.ID[:8])
+	for i, msg := range msgs {
+		// writeLoop возвращает кадры в пул
+		frame := r.fp.Get().([]byte)[:len(msg.frame)]
+		copy(frame, msg.frame)
+		if err := peer.enqueueWait(frame); err != nil {
+			r.fp.Put(frame[:cap(frame)])
+			r.metrics.MessagesError.Add(uint64(len(msgs) - i))
+			slog.Debug("Peer left before offline messages were delivered", "hexID", hexID, "lost", len(msgs)-i)
+			return
+		}
+		r.metrics.BytesForwarded.Add(uint64(len(msg.frame) - incomeHeaderLen))
+	}
+	if len(msgs) > 0 {
+		slog.Info("Delivered offline messages", "hexID", hexID, "count", len(msgs))
+	}
+}
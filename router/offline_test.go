@@ -0,0 +1,136 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOfflineQueue(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+	addr := startTestRouter(t, RouterConfig{OfflineQueueSize: 2, OfflineQueueTTL: ttl})
+	sender, senderID, _ := dialTestClient(t, addr)
+
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recipientID PeerID
+	copy(recipientID[:], pubKey)
+
+	send := func(payload string) ServerMessage {
+		t.Helper()
+		respCh, err := sender.SendQueued(context.Background(), recipientID, []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return waitResponse(t, respCh)
+	}
+	connect := func() (*Client, <-chan ServerMessage) {
+		t.Helper()
+		client := NewClient(pubKey, privKey)
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		income, err := client.Dial(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, income
+	}
+
+	// Без SendQueued отключенный получатель не найден, сообщение не хранится
+	respCh, err := sender.Send(context.Background(), recipientID, []byte("signal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := waitResponse(t, respCh); msg.Type != NotFound {
+		t.Fatalf("Expected NotFound for a plain message, got %v code %v", msg.Type, msg.Code)
+	}
+
+	// Очередь держит два сообщения, третье отклоняется
+	for i := range 2 {
+		if msg := send(fmt.Sprint("msg", i)); msg.Type != Success {
+			t.Fatalf("Expected Success for a queued message, got %v code %v", msg.Type, msg.Code)
+		}
+	}
+	if msg := send("msg2"); msg.Type != Error || msg.Code != ErrCodeOfflineQueueFull {
+		t.Fatalf("Expected OfflineQueueFull, got %v code %v", msg.Type, msg.Code)
+	}
+
+	// После аутентификации сообщения приходят по порядку
+	recipient, income := connect()
+	for i := range 2 {
+		select {
+		case msg := <-income:
+			if msg.Type != Income || msg.SenderID != senderID || string(msg.Payload) != fmt.Sprint("msg", i) {
+				t.Fatalf("Unexpected message %v from %x: %q", msg.Type, msg.SenderID[:4], msg.Payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Queued message %d was not delivered", i)
+		}
+	}
+	recipient.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// Сообщение старше TTL не доставляется
+	if msg := send("stale"); msg.Type != Success {
+		t.Fatalf("Expected Success for a queued message, got %v code %v", msg.Type, msg.Code)
+	}
+	time.Sleep(2 * ttl)
+	_, income = connect()
+	select {
+	case msg := <-income:
+		t.Fatalf("Expired message was delivered: %q", msg.Payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestOfflineQueueLimits(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{OfflineQueueSize: 4, OfflineQueueMaxRecipients: 1, OfflineQueueMaxBytes: 1024})
+	sender, _, _ := dialTestClient(t, addr)
+
+	send := func(recipient PeerID, payload []byte) ServerMessage {
+		t.Helper()
+		respCh, err := sender.SendQueued(context.Background(), recipient, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return waitResponse(t, respCh)
+	}
+
+	// Очередь есть только у одного получателя
+	if msg := send(PeerID{1}, []byte("msg")); msg.Type != Success {
+		t.Fatalf("Expected Success, got %v code %v", msg.Type, msg.Code)
+	}
+	if msg := send(PeerID{2}, []byte("msg")); msg.Type != Error || msg.Code != ErrCodeOfflineQueueFull {
+		t.Fatalf("Expected OfflineQueueFull for another recipient, got %v code %v", msg.Type, msg.Code)
+	}
+
+	// Байты всех очередей ограничены
+	if msg := send(PeerID{1}, make([]byte, 1024)); msg.Type != Error || msg.Code != ErrCodeOfflineQueueFull {
+		t.Fatalf("Expected OfflineQueueFull over the byte cap, got %v code %v", msg.Type, msg.Code)
+	}
+
+	// Подключенный получатель получает сообщение SendQueued сразу, в том
+	// числе фрагментированное
+	receiver, receiverID, income := dialTestClient(t, addr)
+	defer receiver.Close()
+	time.Sleep(100 * time.Millisecond)
+	payload := make([]byte, 3*MaxPacketSize)
+	rand.Read(payload)
+	if msg := send(receiverID, payload); msg.Type != Success {
+		t.Fatalf("Expected Success, got %v code %v", msg.Type, msg.Code)
+	}
+	select {
+	case msg := <-income:
+		if msg.Type != Income || !bytes.Equal(msg.Payload, payload) {
+			t.Fatalf("Unexpected message %v of %d bytes", msg.Type, len(msg.Payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message was not delivered")
+	}
+}
@@ -1,6 +1,7 @@
 package router
 
 import (
+	"errors"
 	"net"
 	"sync"
 	"time"
@@ -12,5 +13,62 @@ type Peer struct {
 	ID           PeerID
 	conn         net.Conn
 	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	remoteAddr   string
+	connectedAt  time.Time
+	quota        *windowCounter // nil, если квота отключена
 	mu           sync.Mutex
+
+	// Income для пира пишет только Router.writeLoop: медленный получатель
+	// не задерживает горутины отправителей
+	writeQueue chan []byte
+	done       chan struct{} // закрывается, когда соединение пира обслужено
+}
+
+var errWriteQueueFull = errors.New("write queue is full")
+
+// enqueue ставит кадр в очередь записи пира, не блокируясь
+func (p *Peer) enqueue(frame []byte) error {
+	select {
+	case <-p.done:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case p.writeQueue <- frame:
+		return nil
+	default:
+		return errWriteQueueFull
+	}
+}
+
+// enqueueWait ставит кадр в очередь записи пира, дожидаясь места, пока
+// соединение обслуживается
+func (p *Peer) enqueueWait(frame []byte) error {
+	select {
+	case p.writeQueue <- frame:
+		return nil
+	case <-p.done:
+		return net.ErrClosed
+	}
+}
+
+// write пишет пиру кадр целиком с таймаутом записи
+func (p *Peer) write(frame []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(p.writeTimeout))
+	_, err := p.conn.Write(frame)
+	p.conn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// writeResponse отправляет пиру ответ на его сообщение. Запись под mu, чтобы
+// ответ не попал в середину Income, который в это же соединение пишет
+// горутина другого пира
+func (p *Peer) writeResponse(b []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.conn.Write(b)
+	return err
 }
@@ -0,0 +1,68 @@
+package router
+
+import "sync"
+
+// peerMapShards - число шардов shardedPeerMap
+const peerMapShards = 256
+
+// shardedPeerMap - подключенные пиры, map[PeerID]*Peer. Записи разнесены
+// по peerMapShards независимым sync.Map по первому байту ID: подключения
+// и отключения тысяч пиров не конкурируют за одну карту. ID - публичный
+// ключ Ed25519, его первый байт распределен равномерно
+type shardedPeerMap struct {
+	shards [peerMapShards]sync.Map
+}
+
+func (m *shardedPeerMap) shard(id PeerID) *sync.Map {
+	return &m.shards[id[0]]
+}
+
+// Load возвращает пира по ID
+func (m *shardedPeerMap) Load(id PeerID) (*Peer, bool) {
+	val, ok := m.shard(id).Load(id)
+	if !ok {
+		return nil, false
+	}
+	return val.(*Peer), true
+}
+
+// Store сохраняет пира, заменяя прежнее соединение с тем же ID
+func (m *shardedPeerMap) Store(id PeerID, peer *Peer) {
+	m.shard(id).Store(id, peer)
+}
+
+// LoadAndDelete удаляет пира и возвращает его
+func (m *shardedPeerMap) LoadAndDelete(id PeerID) (*Peer, bool) {
+	val, ok := m.shard(id).LoadAndDelete(id)
+	if !ok {
+		return nil, false
+	}
+	return val.(*Peer), true
+}
+
+// Delete удаляет пира
+func (m *shardedPeerMap) Delete(id PeerID) {
+	m.shard(id).Delete(id)
+}
+
+// CompareAndDelete удаляет пира, только если ID все еще принадлежит peer
+func (m *shardedPeerMap) CompareAndDelete(id PeerID, peer *Peer) bool {
+	return m.shard(id).CompareAndDelete(id, peer)
+}
+
+// Range вызывает f для каждого пира, пока f возвращает true
+func (m *shardedPeerMap) Range(f func(id PeerID, peer *Peer) bool) {
+	for i := range m.shards {
+		stopped := false
+		m.shards[i].Range(func(key, value any) bool {
+			if !f(key.(PeerID), value.(*Peer)) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+}
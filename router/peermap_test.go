@@ -0,0 +1,126 @@
+package router
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestShardedPeerMap(t *testing.T) {
+	var m shardedPeerMap
+
+	// ID с одинаковым первым байтом попадают в один шард
+	a, b, c := PeerID{1, 1}, PeerID{1, 2}, PeerID{2}
+	peerA, peerB, peerC := &Peer{ID: a}, &Peer{ID: b}, &Peer{ID: c}
+	m.Store(a, peerA)
+	m.Store(b, peerB)
+	m.Store(c, peerC)
+
+	if got, ok := m.Load(b); !ok || got != peerB {
+		t.Fatalf("Unexpected peer for b: %v, %v", got, ok)
+	}
+	if _, ok := m.Load(PeerID{3}); ok {
+		t.Fatal("Expected unknown peer to be missing")
+	}
+
+	// Переподключение заменяет запись, старое соединение ее не удаляет
+	reconnected := &Peer{ID: a}
+	m.Store(a, reconnected)
+	if m.CompareAndDelete(a, peerA) {
+		t.Fatal("Old connection must not remove the new one")
+	}
+	if got, _ := m.Load(a); got != reconnected {
+		t.Fatal("Expected reconnected peer")
+	}
+
+	seen := make(map[PeerID]bool)
+	m.Range(func(id PeerID, peer *Peer) bool {
+		if peer.ID != id {
+			t.Fatalf("Peer %x stored under %x", peer.ID[:2], id[:2])
+		}
+		seen[id] = true
+		return true
+	})
+	if len(seen) != 3 {
+		t.Fatalf("Expected 3 peers, got %d", len(seen))
+	}
+	count := 0
+	m.Range(func(PeerID, *Peer) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Fatalf("Range must stop after false, visited %d", count)
+	}
+
+	if got, ok := m.LoadAndDelete(b); !ok || got != peerB {
+		t.Fatalf("Unexpected LoadAndDelete result: %v, %v", got, ok)
+	}
+	m.Delete(c)
+	if !m.CompareAndDelete(a, reconnected) {
+		t.Fatal("Expected CompareAndDelete to remove the current peer")
+	}
+	m.Range(func(id PeerID, _ *Peer) bool {
+		t.Fatalf("Unexpected peer %x after delete", id[:2])
+		return false
+	})
+}
+
+// peerStore - общий интерфейс sync.Map и shardedPeerMap для бенчмарка
+type peerStore interface {
+	load(id PeerID)
+	store(id PeerID, peer *Peer)
+}
+
+type syncMapStore struct{ m sync.Map }
+
+func (s *syncMapStore) load(id PeerID)              { s.m.Load(id) }
+func (s *syncMapStore) store(id PeerID, peer *Peer) { s.m.Store(id, peer) }
+
+type shardedStore struct{ m shardedPeerMap }
+
+func (s *shardedStore) load(id PeerID)              { s.m.Load(id) }
+func (s *shardedStore) store(id PeerID, peer *Peer) { s.m.Store(id, peer) }
+
+// BenchmarkPeerMap сравнивает sync.Map и shardedPeerMap при случайных
+// Load и Store из 10k горутин: каждая четвертая операция - подключение
+func BenchmarkPeerMap(b *testing.B) {
+	const peers = 10_000
+	ids := make([]PeerID, peers)
+	for i := range ids {
+		for j := range ids[i] {
+			ids[i][j] = byte(rand.IntN(256))
+		}
+	}
+	peer := &Peer{}
+
+	for _, bm := range []struct {
+		name  string
+		store func() peerStore
+	}{
+		{"SyncMap", func() peerStore { return &syncMapStore{} }},
+		{"Sharded", func() peerStore { return &shardedStore{} }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			s := bm.store()
+			for _, id := range ids {
+				s.store(id, peer)
+			}
+			b.SetParallelism(max(1, peers/runtime.GOMAXPROCS(0)))
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+				for pb.Next() {
+					id := ids[rng.IntN(peers)]
+					if rng.IntN(4) == 0 {
+						s.store(id, peer)
+					} else {
+						s.load(id)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package router
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// windowCounter - счетчик в скользящем окне (байты пира, соединения с IP).
+// Окно приближается двумя интервалами: значение предыдущего интервала
+// учитывается пропорционально доле, которая еще попадает в окно.
+//
+// Счетчики атомарные, но rotate и allow не атомарны целиком: при гонке
+// нескольких писателей счетчик может немного недосчитать, для лимитов это
+// допустимо
+type windowCounter struct {
+	start atomic.Int64 // начало текущего интервала, UnixNano
+	cur   atomic.Uint64
+	prev  atomic.Uint64
+}
+
+func newWindowCounter(now time.Time) *windowCounter {
+	q := &windowCounter{}
+	q.start.Store(now.UnixNano())
+	return q
+}
+
+// usage возвращает сумму в окне, заканчивающемся в now
+func (q *windowCounter) usage(now time.Time, window time.Duration) uint64 {
+	elapsed := time.Duration(now.UnixNano() - q.start.Load())
+	cur, prev := q.cur.Load(), q.prev.Load()
+
+	switch {
+	case elapsed >= 2*window:
+		return 0
+	case elapsed >= window:
+		// Текущий интервал уже стал предыдущим
+		prev, cur = cur, 0
+		elapsed -= window
+	}
+	return cur + uint64(float64(prev)*(1-float64(elapsed)/float64(window)))
+}
+
+// rotate начинает новый интервал, если текущий закончился
+func (q *windowCounter) rotate(now time.Time, window time.Duration) {
+	start := q.start.Load()
+	elapsed := time.Duration(now.UnixNano() - start)
+
+	switch {
+	case elapsed < window:
+		return
+	case elapsed < 2*window:
+		q.prev.Store(q.cur.Load())
+		q.start.Store(start + int64(window))
+	default:
+		q.prev.Store(0)
+		q.start.Store(now.UnixNano())
+	}
+	q.cur.Store(0)
+}
+
+// allow учитывает n, если сумма в окне с ним не превышает limit
+func (q *windowCounter) allow(n, limit uint64, now time.Time, window time.Duration) bool {
+	q.rotate(now, window)
+	if q.usage(now, window)+n > limit {
+		return false
+	}
+	q.cur.Add(n)
+	return true
+}
+
+// quotaFor возвращает квоту пира. Квота переживает переподключение, иначе
+// ее можно было бы сбросить, переподключившись
+func (r *Router) quotaFor(id PeerID) *windowCounter {
+	val, _ := r.quotas.LoadOrStore(id, newWindowCounter(time.Now()))
+	return val.(*windowCounter)
+}
+
+// releaseQuota удаляет квоту отключившегося пира, когда его трафик выйдет из окна
+func (r *Router) releaseQuota(id PeerID, quota *windowCounter) {
+	time.AfterFunc(2*r.cfg.QuotaWindow, func() {
+		if _, connected := r.peers.Load(id); connected {
+			return
+		}
+		if quota.usage(time.Now(), r.cfg.QuotaWindow) == 0 {
+			r.quotas.CompareAndDelete(id, quota)
+		}
+	})
+}
+
+// checkQuota учитывает payload сообщения в квоте пира. false - квота исчерпана
+func (r *Router) checkQuota(peer *Peer, payloadLen uint32) bool {
+	if peer.quota == nil {
+		return true
+	}
+	if peer.quota.allow(uint64(payloadLen), r.cfg.QuotaBytes, time.Now(), r.cfg.QuotaWindow) {
+		return true
+	}
+	slog.Warn("Peer quota exceeded",
+		"from", hex.EncodeToString(peer.ID[:8]),
+		"payloadLen", payloadLen,
+		"quota", r.cfg.QuotaBytes,
+		"window", r.cfg.QuotaWindow)
+	return false
+}
@@ -0,0 +1,84 @@
+package router
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestWindowCounter(t *testing.T) {
+	window := time.Minute
+	start := time.Unix(1000, 0)
+	q := newWindowCounter(start)
+
+	if !q.allow(600, 1000, start, window) {
+		t.Fatal("Expected 600 bytes to fit")
+	}
+	if q.allow(500, 1000, start.Add(30*time.Second), window) {
+		t.Fatal("Expected 1100 bytes to exceed quota")
+	}
+
+	// Через полтора окна от первого интервала в окне остается половина: 300 байт
+	now := start.Add(window + 30*time.Second)
+	if got := q.usage(now, window); got != 300 {
+		t.Fatalf("Expected usage 300, got %d", got)
+	}
+	if !q.allow(700, 1000, now, window) {
+		t.Fatal("Expected 700 bytes to fit after window slides")
+	}
+	if q.allow(1, 1000, now, window) {
+		t.Fatal("Expected quota to be exhausted")
+	}
+
+	// Через два окна без трафика квота полностью восстанавливается
+	if got := q.usage(now.Add(2*window), window); got != 0 {
+		t.Fatalf("Expected usage 0, got %d", got)
+	}
+	if !q.allow(1000, 1000, now.Add(2*window), window) {
+		t.Fatal("Expected full quota after two idle windows")
+	}
+}
+
+func TestRouterQuota(t *testing.T) {
+	const window = 200 * time.Millisecond
+	addr := startTestRouter(t, RouterConfig{QuotaBytes: 1000, QuotaWindow: window})
+
+	sender, _, _ := dialTestClient(t, addr)
+	_, receiverID, income := dialTestClient(t, addr)
+	time.Sleep(100 * time.Millisecond)
+
+	send := func(size int) ServerMessage {
+		t.Helper()
+		payload := make([]byte, size)
+		rand.Read(payload)
+		respCh, err := sender.Send(context.Background(), receiverID, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return waitResponse(t, respCh)
+	}
+
+	if msg := send(600); msg.Type != Success {
+		t.Fatalf("Expected Success, got %v", msg.Type)
+	}
+	<-income
+
+	msg := send(600)
+	if msg.Type != Error || msg.Code != ErrCodeRateLimited {
+		t.Fatalf("Expected Error with RateLimited, got %v code %v", msg.Type, msg.Code)
+	}
+
+	// Сообщение сверх квоты не доставлено, соединение пригодно для следующих
+	select {
+	case m := <-income:
+		t.Fatalf("Unexpected delivery of %d bytes over quota", len(m.Payload))
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	time.Sleep(2 * window)
+	if msg := send(600); msg.Type != Success {
+		t.Fatalf("Expected Success after window slides, got %v code %v", msg.Type, msg.Code)
+	}
+	<-income
+}
@@ -0,0 +1,63 @@
+package router
+
+import (
+	"log/slog"
+	"net"
+	"time"
+)
+
+// connRateWindow - окно лимита MaxConnsPerIPPerMinute
+const connRateWindow = time.Minute
+
+// allowConn учитывает новое соединение с адреса addr. false - лимит
+// соединений с этого IP исчерпан и соединение нужно закрыть
+func (r *Router) allowConn(addr net.Addr) bool {
+	limit := r.cfg.MaxConnsPerIPPerMinute
+	if limit <= 0 {
+		return true
+	}
+	ip := remoteIP(addr)
+	if ip == "" {
+		// Unix socket - локальные клиенты не ограничиваются
+		return true
+	}
+
+	now := time.Now()
+	r.sweepConnCounters(now)
+
+	val, _ := r.connCounters.LoadOrStore(ip, newWindowCounter(now))
+	if val.(*windowCounter).allow(1, uint64(limit), now, connRateWindow) {
+		return true
+	}
+
+	r.metrics.ConnsRateLimited.Add(1)
+	slog.Warn("Connection rate limit exceeded, closing connection", "ip", ip, "limit", limit)
+	return false
+}
+
+// sweepConnCounters раз в окно удаляет счетчики IP, которые из него вышли
+func (r *Router) sweepConnCounters(now time.Time) {
+	last := r.connSweepAt.Load()
+	if now.UnixNano()-last < int64(connRateWindow) || !r.connSweepAt.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	r.connCounters.Range(func(key, value any) bool {
+		if value.(*windowCounter).usage(now, connRateWindow) == 0 {
+			r.connCounters.CompareAndDelete(key, value)
+		}
+		return true
+	})
+}
+
+// remoteIP возвращает IP из адреса вида host:port, "" - если его нет
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,56 @@
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnRateLimit(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	r := NewRouter(RouterConfig{MaxConnsPerIPPerMinute: 3})
+	go r.Serve(lis)
+	addr := lis.Addr().String()
+
+	for range 3 {
+		dialTestClient(t, addr)
+	}
+
+	pubKey, privKey, _ := ed25519.GenerateKey(rand.Reader)
+	client := NewClient(pubKey, privKey)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Dial(ctx, addr); err == nil {
+		client.Close()
+		t.Fatal("Expected connection over the limit to be rejected")
+	}
+
+	if got := r.Metrics().ConnsRateLimited.Load(); got != 1 {
+		t.Fatalf("Expected 1 rate limited connection, got %d", got)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	cases := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}, "10.0.0.1"},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1234}, "::1"},
+		{wsAddr("192.168.1.5:4567"), "192.168.1.5"},
+		{&net.UnixAddr{Name: "/run/sendy.sock", Net: "unix"}, ""},
+	}
+	for _, tc := range cases {
+		if got := remoteIP(tc.addr); got != tc.want {
+			t.Errorf("remoteIP(%v) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
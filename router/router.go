@@ -11,27 +11,220 @@ import (
 	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func Run(addr string) error {
-	lis, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("net.Listen: %w", err)
+// Router routes messages between authenticated peers
+type Router struct {
+	peers    shardedPeerMap
+	authPool sync.Pool
+	hp       sync.Pool
+	fp       sync.Pool // кадры Income в очередях записи
+	metrics  *Metrics
+	cfg      RouterConfig
+
+	quotas sync.Map // map[PeerID]*windowCounter
+
+	connCounters sync.Map // map[string]*windowCounter - новые соединения по IP
+	connSweepAt  atomic.Int64
+
+	// Сообщения отключенным получателям, см. RouterConfig.OfflineQueueSize
+	offline       sync.Map // map[PeerID]*offlineQueue
+	offlineMu     sync.Mutex
+	offlineBytes  int // байт во всех очередях, под offlineMu
+	offlineQueues int // очередей с сообщениями, под offlineMu
+
+	bans        sync.Map // map[PeerID]struct{}
+	banMu       sync.Mutex
+	banListPath string
+
+	// Рассылки списка пиров идут по очереди, иначе старый список может
+	// прийти после нового
+	peerListMu      sync.Mutex
+	peerListPending atomic.Bool // рассылка запланирована, см. schedulePeerList
+}
+
+// RouterConfig holds router settings
+type RouterConfig struct {
+	// MetricsAddr is the HTTP address serving /metrics in Prometheus text
+	// format. Metrics server is disabled if empty.
+	MetricsAddr string
+	// BanListPath is the file with banned peer IDs. Ban list is kept only
+	// in memory if empty.
+	BanListPath string
+	// IdleTimeout closes peer connection if nothing was read from it for
+	// this long. Clients send keepalives every KeepaliveInterval.
+	// Defaults to IdleTimeout if zero.
+	IdleTimeout time.Duration
+	// MaxPacketSize limits size of a single packet. Client splits larger
+	// payloads into fragments. Defaults to MaxPacketSize if zero.
+	MaxPacketSize uint32
+	// AuthTimeout limits the authentication handshake. Defaults to
+	// AuthTimeout if zero.
+	AuthTimeout time.Duration
+	// WriteTimeout limits a single write to a peer. Defaults to
+	// WriteTimeout if zero.
+	WriteTimeout time.Duration
+	// WSAddr is the HTTP address serving the WebSocket transport on
+	// WebSocketPath. WebSocket transport is disabled if empty.
+	WSAddr string
+	// WSCertFile and WSKeyFile enable TLS (wss://) for the WebSocket transport.
+	WSCertFile string
+	WSKeyFile  string
+	// QuotaBytes limits payload bytes a peer can route within QuotaWindow.
+	// Messages over the quota are refused with ErrCodeRateLimited. Quota is
+	// disabled if zero.
+	QuotaBytes uint64
+	// QuotaWindow is the sliding window of QuotaBytes. Defaults to
+	// QuotaWindow if zero.
+	QuotaWindow time.Duration
+	// MaxConnsPerIPPerMinute limits new connections from a single IP within
+	// a sliding minute. Connections over the limit are closed before
+	// authentication. Unlimited if zero.
+	MaxConnsPerIPPerMinute int
+	// EnablePeerList sends the list of connected peers to every peer
+	// whenever peers connect or disconnect. Changes within PeerListDelay are
+	// sent as one list. Each update carries the whole list, so traffic grows
+	// with the square of the number of peers. A peer whose write queue is
+	// full misses the update and gets the next one.
+	EnablePeerList bool
+	// OfflineQueueSize keeps up to this many messages for each recipient
+	// that is not connected and delivers them once it authenticates. Only
+	// messages sent with Client.SendQueued are kept: the sender gets
+	// Success for a queued message and ErrCodeOfflineQueueFull when the
+	// queue is full. Other messages to offline peers get NotFound as before,
+	// so signaling is never delivered late. Queuing is disabled if zero.
+	OfflineQueueSize int
+	// OfflineQueueTTL drops queued messages not delivered for this long.
+	// Defaults to OfflineQueueTTL if zero.
+	OfflineQueueTTL time.Duration
+	// OfflineQueueMaxBytes caps bytes queued for all offline recipients
+	// together. Defaults to OfflineQueueMaxBytes if zero.
+	OfflineQueueMaxBytes int
+	// OfflineQueueMaxRecipients caps how many offline recipients have
+	// queued messages. Defaults to OfflineQueueMaxRecipients if zero.
+	OfflineQueueMaxRecipients int
+}
+
+// DefaultRouterConfig returns the default router settings
+func DefaultRouterConfig() RouterConfig {
+	return RouterConfig{
+		IdleTimeout:   IdleTimeout,
+		MaxPacketSize: MaxPacketSize,
+		AuthTimeout:   AuthTimeout,
+		WriteTimeout:  WriteTimeout,
+		QuotaWindow:   QuotaWindow,
+
+		OfflineQueueTTL:           OfflineQueueTTL,
+		OfflineQueueMaxBytes:      OfflineQueueMaxBytes,
+		OfflineQueueMaxRecipients: OfflineQueueMaxRecipients,
 	}
+}
 
-	var peers sync.Map
-	authPool := sync.Pool{
-		New: func() any {
-			return make([]byte, ed25519.PublicKeySize+ChallangeSize+ed25519.SignatureSize)
-		},
+// PeerInfo describes a connected peer
+type PeerInfo struct {
+	ID          PeerID
+	RemoteAddr  string
+	ConnectedAt time.Time
+}
+
+var ErrPeerNotFound = errors.New("peer not found")
+
+// incomeHeaderLen - заголовок Income: MessageLen(4) + Type(1) + RequestID(12) + SenderID(32)
+const incomeHeaderLen = 4 + 1 + RequestIDSize + PeerIDSize
+
+// NewRouter creates a new Router instance
+func NewRouter(cfg RouterConfig) *Router {
+	def := DefaultRouterConfig()
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = def.IdleTimeout
+	}
+	if cfg.MaxPacketSize == 0 {
+		cfg.MaxPacketSize = def.MaxPacketSize
+	}
+	if cfg.MaxPacketSize < MinPacketSize {
+		cfg.MaxPacketSize = MinPacketSize
+	}
+	if cfg.AuthTimeout <= 0 {
+		cfg.AuthTimeout = def.AuthTimeout
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = def.WriteTimeout
+	}
+	if cfg.QuotaWindow <= 0 {
+		cfg.QuotaWindow = def.QuotaWindow
+	}
+	if cfg.OfflineQueueTTL <= 0 {
+		cfg.OfflineQueueTTL = def.OfflineQueueTTL
 	}
-	hp := sync.Pool{
-		New: func() any {
-			return make([]byte, MaxPacketSize)
+	if cfg.OfflineQueueMaxBytes <= 0 {
+		cfg.OfflineQueueMaxBytes = def.OfflineQueueMaxBytes
+	}
+	if cfg.OfflineQueueMaxRecipients <= 0 {
+		cfg.OfflineQueueMaxRecipients = def.OfflineQueueMaxRecipients
+	}
+
+	return &Router{
+		authPool: sync.Pool{
+			New: func() any {
+				return make([]byte, ed25519.PublicKeySize+ChallangeSize+ed25519.SignatureSize)
+			},
+		},
+		hp: sync.Pool{
+			New: func() any {
+				return make([]byte, cfg.MaxPacketSize)
+			},
+		},
+		fp: sync.Pool{
+			New: func() any {
+				return make([]byte, incomeHeaderLen+cfg.MaxPacketSize)
+			},
 		},
+		metrics: &Metrics{},
+		cfg:     cfg,
+	}
+}
+
+// Run starts the router on addr. If cfg.MetricsAddr is not empty, metrics
+// are exposed over HTTP in Prometheus text format on that address.
+func Run(addr string, cfg RouterConfig) error {
+	r := NewRouter(cfg)
+	if cfg.BanListPath != "" {
+		if err := r.LoadBanList(cfg.BanListPath); err != nil {
+			return err
+		}
+	}
+	if cfg.MetricsAddr != "" {
+		go func() {
+			if err := ServeMetrics(cfg.MetricsAddr, r.Metrics()); err != nil {
+				slog.Error("Metrics server error", "error", err)
+			}
+		}()
+	}
+	if cfg.WSAddr != "" {
+		go func() {
+			if err := r.ServeWebSocket(cfg.WSAddr, cfg.WSCertFile, cfg.WSKeyFile); err != nil {
+				slog.Error("WebSocket server error", "error", err)
+			}
+		}()
+	}
+	return r.ListenAndServe(addr)
+}
+
+// ListenAndServe listens on addr and serves peers. addr is a TCP host:port
+// or a unix socket address like unix:///run/sendy/router.sock
+func (r *Router) ListenAndServe(addr string) error {
+	lis, err := Listen(addr)
+	if err != nil {
+		return err
 	}
-	slog.Info("Router listening", "address", addr)
+	return r.Serve(lis)
+}
+
+// Serve accepts connections on lis until it fails
+func (r *Router) Serve(lis net.Listener) error {
+	slog.Info("Router listening", "address", lis.Addr().String())
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
@@ -40,16 +233,62 @@ func Run(addr string) error {
 		}
 
 		slog.Debug("Accepted new connection", "remoteAddr", conn.RemoteAddr().String())
-		go handleConn(conn, &peers, &authPool, &hp)
+		// Закрываем до запуска горутины: лимит защищает от исчерпания горутин и дескрипторов
+		if !r.allowConn(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		go r.handleConn(conn)
 	}
 }
 
-func handleConn(conn net.Conn, peers *sync.Map, authPool *sync.Pool, hp *sync.Pool) {
+// Metrics returns router metrics
+func (r *Router) Metrics() *Metrics {
+	return r.metrics
+}
+
+// Peers returns information about all connected peers
+func (r *Router) Peers() []PeerInfo {
+	var peers []PeerInfo
+	r.peers.Range(func(_ PeerID, peer *Peer) bool {
+		peers = append(peers, PeerInfo{
+			ID:          peer.ID,
+			RemoteAddr:  peer.remoteAddr,
+			ConnectedAt: peer.connectedAt,
+		})
+		return true
+	})
+	return peers
+}
+
+// Disconnect closes the connection of a connected peer
+func (r *Router) Disconnect(id PeerID) error {
+	peer, ok := r.peers.Load(id)
+	if !ok {
+		return ErrPeerNotFound
+	}
+	slog.Info("Disconnecting peer", "hexID", hex.EncodeToString(id[:]))
+	return peer.conn.Close()
+}
+
+// disconnectAll закрывает соединения всех пиров
+func (r *Router) disconnectAll() {
+	r.peers.Range(func(_ PeerID, peer *Peer) bool {
+		peer.conn.Close()
+		return true
+	})
+}
+
+func (r *Router) handleConn(conn net.Conn) {
 	remoteAddr := conn.RemoteAddr().String()
 	defer conn.Close()
 
 	slog.Debug("Starting authentication", "remoteAddr", remoteAddr)
-	id, err := auth(conn, AuthTimeout, authPool)
+	id, err := r.auth(conn, r.cfg.AuthTimeout)
+	if errors.Is(err, ErrPeerBanned) {
+		slog.Warn("Rejected banned peer", "hexID", hex.EncodeToString(id[:]), "remoteAddr", remoteAddr)
+		return
+	}
 	if err != nil {
 		slog.Error("Failed to authenticate new connection", "remoteAddr", remoteAddr, "error", err)
 		return
@@ -58,24 +297,53 @@ func handleConn(conn net.Conn, peers *sync.Map, authPool *sync.Pool, hp *sync.Po
 	hexID := hex.EncodeToString(id[:])
 	slog.Info("Peer authenticated", "hexID", hexID, "remoteAddr", remoteAddr)
 
+	if ws, ok := conn.(*wsConn); ok {
+		ws.startFraming()
+	}
+
 	peer := &Peer{
 		ID:           id,
 		conn:         conn,
-		writeTimeout: WriteTimeout,
+		writeTimeout: r.cfg.WriteTimeout,
+		idleTimeout:  r.cfg.IdleTimeout,
+		remoteAddr:   remoteAddr,
+		connectedAt:  time.Now(),
+		writeQueue:   make(chan []byte, WriteQueueSize),
+		done:         make(chan struct{}),
+	}
+	defer close(peer.done)
+	go r.writeLoop(peer)
+	if r.cfg.QuotaBytes > 0 {
+		peer.quota = r.quotaFor(id)
 	}
-	peers.Store(id, peer)
+	r.peers.Store(id, peer)
+	r.metrics.PeersConnected.Add(1)
 	slog.Debug("Peer stored in map", "hexID", hexID)
+	r.schedulePeerList()
+	if r.cfg.OfflineQueueSize > 0 {
+		go r.drainOffline(peer)
+	}
 
 	defer func() {
-		peers.Delete(id)
+		// Не удаляем запись, если пир уже переподключился с новым соединением
+		removed := r.peers.CompareAndDelete(id, peer)
+		r.metrics.PeersConnected.Add(-1)
+		if peer.quota != nil {
+			r.releaseQuota(id, peer.quota)
+		}
 		slog.Debug("Peer removed from map", "hexID", hexID)
+		if removed {
+			r.schedulePeerList()
+		}
 	}()
 
 	for {
-		if err := handleMessage(peer, peers, hp); err != nil {
+		if err := r.handleMessage(peer); err != nil {
 			// EOF or closed connection is normal - peer disconnected gracefully
 			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				slog.Info("Peer disconnected gracefully", "hexID", hexID)
+			} else if isTimeout(err) {
+				slog.Info("Peer idle timeout, evicting", "hexID", hexID, "idleTimeout", peer.idleTimeout)
 			} else {
 				slog.Error("Failed to read message from peer", "hexID", hexID, "error", err)
 			}
@@ -84,26 +352,111 @@ func handleConn(conn net.Conn, peers *sync.Map, authPool *sync.Pool, hp *sync.Po
 	}
 }
 
-func handleMessage(peer *Peer, peers *sync.Map, hp *sync.Pool) error {
-	buf := hp.Get().([]byte)
-	defer hp.Put(buf)
+func (r *Router) handleMessage(peer *Peer) error {
+	buf := r.hp.Get().([]byte)
+	defer r.hp.Put(buf)
+
+	// Half-open соединения отваливаются по таймауту простоя
+	peer.conn.SetReadDeadline(time.Now().Add(peer.idleTimeout))
 
 	// Read header: MessageLen(4) + RequestID(12) + Recipient(32) = 48 bytes
 	if _, err := io.ReadFull(peer.conn, buf[:PeerHeaderSize]); err != nil {
 		return fmt.Errorf("read header: %w", err)
 	}
 
+	// Заголовок прочитан - сбрасываем таймаут простоя для чтения payload
+	peer.conn.SetReadDeadline(time.Now().Add(peer.idleTimeout))
+
 	// Parse message length
 	mlen := binary.BigEndian.Uint32(buf[:4])
-	if mlen > MaxPacketSize {
-		slog.Warn("Message too big", "from", hex.EncodeToString(peer.ID[:8]), "size", mlen, "max", MaxPacketSize)
+	maxPacketSize := r.cfg.MaxPacketSize
+	if mlen > maxPacketSize {
+		slog.Warn("Message too big", "from", hex.EncodeToString(peer.ID[:8]), "size", mlen, "max", maxPacketSize)
+		r.metrics.MessagesError.Add(1)
+		// Payload не читаем, поэтому поток рассинхронизирован: отвечаем и
+		// закрываем соединение
+		writeErrorResponse(peer, buf, buf[4:4+RequestIDSize], ErrCodeTooLarge)
 		return fmt.Errorf("message input is too big: %d bytes", mlen)
 	}
 
+	// Длина включает уже прочитанные RequestID и Recipient, меньшее значение
+	// рассинхронизирует поток
+	if mlen < RequestIDSize+PeerIDSize {
+		r.metrics.MessagesError.Add(1)
+		return fmt.Errorf("malformed message: length %d", mlen)
+	}
+
+	var recipient PeerID
+	copy(recipient[:], buf[4+RequestIDSize:PeerHeaderSize])
+	if recipient == BatchRecipient {
+		return r.routeBatch(peer, buf, mlen-RequestIDSize-PeerIDSize)
+	}
+
+	return r.routeMessage(peer, peer.conn, buf)
+}
+
+// routeBatch маршрутизирует каждое сообщение пачки BatchRecipient как
+// обычное, ответы приходят по RequestID каждого сообщения. Сама пачка ответа
+// не получает
+func (r *Router) routeBatch(peer *Peer, buf []byte, size uint32) error {
+	r.metrics.BatchesReceived.Add(1)
+	src := &io.LimitedReader{R: peer.conn, N: int64(size)}
+
+	for src.N > 0 {
+		if src.N < PeerHeaderSize {
+			r.metrics.MessagesError.Add(1)
+			return fmt.Errorf("malformed batch: %d trailing bytes", src.N)
+		}
+		if _, err := io.ReadFull(src, buf[:PeerHeaderSize]); err != nil {
+			return fmt.Errorf("read batch entry header: %w", err)
+		}
+
+		mlen := binary.BigEndian.Uint32(buf[:4])
+		if mlen < RequestIDSize+PeerIDSize || int64(mlen-RequestIDSize-PeerIDSize) > src.N {
+			r.metrics.MessagesError.Add(1)
+			return fmt.Errorf("malformed batch entry: length %d, %d bytes left", mlen, src.N)
+		}
+		if PeerID(buf[4+RequestIDSize:PeerHeaderSize]) == BatchRecipient {
+			r.metrics.MessagesError.Add(1)
+			return fmt.Errorf("malformed batch: nested batch")
+		}
+
+		if err := r.routeMessage(peer, src, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeMessage доставляет сообщение, заголовок которого уже прочитан в
+// buf[:PeerHeaderSize], payload читается из src
+func (r *Router) routeMessage(peer *Peer, src io.Reader, buf []byte) error {
+	mlen := binary.BigEndian.Uint32(buf[:4])
+	maxPacketSize := r.cfg.MaxPacketSize
+
+	// Настоящий получатель QueueRecipient - в начале payload
+	queued := PeerID(buf[4+RequestIDSize:PeerHeaderSize]) == QueueRecipient
+	if queued {
+		if mlen < RequestIDSize+2*PeerIDSize {
+			r.metrics.MessagesError.Add(1)
+			return fmt.Errorf("malformed queued message: length %d", mlen)
+		}
+		if _, err := io.ReadFull(src, buf[4+RequestIDSize:PeerHeaderSize]); err != nil {
+			return fmt.Errorf("read queued recipient: %w", err)
+		}
+		switch PeerID(buf[4+RequestIDSize : PeerHeaderSize]) {
+		case BatchRecipient, QueueRecipient, KeepaliveRecipient:
+			r.metrics.MessagesError.Add(1)
+			return fmt.Errorf("malformed queued message: reserved recipient")
+		}
+		mlen -= PeerIDSize
+		binary.BigEndian.PutUint32(buf[:4], mlen)
+	}
+
 	// Parse RequestID and Recipient from buffer
 	// Store reqID at end of buffer to avoid overlap during copy
 	of := 4
-	reqIDOffset := MaxPacketSize - RequestIDSize
+	reqIDOffset := maxPacketSize - RequestIDSize
 	copy(buf[reqIDOffset:reqIDOffset+RequestIDSize], buf[of:of+RequestIDSize])
 	reqID := buf[reqIDOffset : reqIDOffset+RequestIDSize]
 	of += RequestIDSize
@@ -120,103 +473,206 @@ func handleMessage(peer *Peer, peers *sync.Map, hp *sync.Pool) error {
 		"payloadLen", payloadLen,
 		"reqID", hex.EncodeToString(reqID[:4]))
 
+	// Keepalive только продлевает таймаут простоя
+	if recipient == KeepaliveRecipient && payloadLen == 0 {
+		return nil
+	}
+
+	// Banned peers can neither send nor receive messages
+	if r.IsBanned(peer.ID) || r.IsBanned(recipient) {
+		slog.Debug("Banned peer in message, sending Forbidden",
+			"recipient", hex.EncodeToString(recipient[:8]),
+			"from", hex.EncodeToString(peer.ID[:8]))
+		r.metrics.MessagesForbidden.Add(1)
+		return rejectMessage(peer, src, buf, reqID, payloadLen, Forbidden)
+	}
+
+	if !r.checkQuota(peer, payloadLen) {
+		r.metrics.MessagesRateLimited.Add(1)
+		if err := discardPayload(src, buf, payloadLen); err != nil {
+			return err
+		}
+		return writeErrorResponse(peer, buf, reqID, ErrCodeRateLimited)
+	}
+
 	// Find recipient peer
-	recipientVal, ok := peers.Load(recipient)
+	recipientPeer, ok := r.peers.Load(recipient)
+	if !ok && queued && r.cfg.OfflineQueueSize > 0 {
+		return r.queueOffline(peer, src, buf, reqID, recipient, payloadLen)
+	}
 	if !ok {
 		slog.Debug("Recipient not found, sending NotFound",
 			"recipient", hex.EncodeToString(recipient[:8]),
 			"from", hex.EncodeToString(peer.ID[:8]))
-		// Recipient not found - skip payload and send NotFound
-		if payloadLen > 0 {
-			// Use part of buffer for CopyBuffer (avoid allocation in io.Copy)
-			discardBuf := buf[PeerHeaderSize : PeerHeaderSize+8192]
-			if _, err := io.CopyBuffer(io.Discard, io.LimitReader(peer.conn, int64(payloadLen)), discardBuf); err != nil {
-				return fmt.Errorf("discard payload: %w", err)
-			}
-		}
-		// Reuse buf for NotFound: MessageLen(4) + Type(1) + RequestID(12) = 17 bytes
-		binary.BigEndian.PutUint32(buf[0:4], 1+RequestIDSize)
-		buf[4] = byte(NotFound)
-		copy(buf[5:5+RequestIDSize], reqID)
-		_, err := peer.conn.Write(buf[:5+RequestIDSize])
-		return err
+		r.metrics.MessagesNotFound.Add(1)
+		return rejectMessage(peer, src, buf, reqID, payloadLen, NotFound)
 	}
 
-	recipientPeer := recipientVal.(*Peer)
+	// Income собирается целиком в кадре из пула, запишет его writeLoop
+	// получателя: MessageLen(4) + Type(1) + RequestID(12) + SenderID(32) + Payload
+	frame := r.fp.Get().([]byte)[:incomeHeaderLen+payloadLen]
+	if _, err := io.ReadFull(src, frame[incomeHeaderLen:]); err != nil {
+		r.fp.Put(frame[:cap(frame)])
+		return fmt.Errorf("read payload: %w", err)
+	}
+	putIncomeHeader(frame, reqID, peer.ID)
+
+	if err := recipientPeer.enqueue(frame); err != nil {
+		r.fp.Put(frame[:cap(frame)])
+		slog.Debug("Failed to queue message for recipient",
+			"from", hex.EncodeToString(peer.ID[:8]),
+			"to", hex.EncodeToString(recipient[:8]),
+			"error", err)
+		if errors.Is(err, errWriteQueueFull) {
+			r.metrics.MessagesBusy.Add(1)
+			return writeErrorResponse(peer, buf, reqID, ErrCodeRecipientBusy)
+		}
+		r.metrics.MessagesError.Add(1)
+		return writeErrorResponse(peer, buf, reqID, ErrCodeRecipientWriteFailed)
+	}
+	r.metrics.BytesForwarded.Add(uint64(payloadLen))
+	r.metrics.MessagesSuccess.Add(1)
+	slog.Debug("Message queued for recipient",
+		"from", hex.EncodeToString(peer.ID[:8]),
+		"to", hex.EncodeToString(recipient[:8]),
+		"payloadLen", payloadLen)
 
-	// Reuse buf for Income: MessageLen(4) + Type(1) + RequestID(12) + SenderID(32)
-	incomeHeaderLen := 4 + 1 + RequestIDSize + PeerIDSize
-	binary.BigEndian.PutUint32(buf[0:4], uint32(1+RequestIDSize+PeerIDSize+payloadLen))
-	buf[4] = byte(Income)
+	// Send Success to sender (reuse buf). Success означает, что сообщение
+	// принято в очередь записи получателя
+	binary.BigEndian.PutUint32(buf[0:4], 1+RequestIDSize)
+	buf[4] = byte(Success)
 	copy(buf[5:5+RequestIDSize], reqID)
-	copy(buf[5+RequestIDSize:5+RequestIDSize+PeerIDSize], peer.ID[:])
-
-	// Send Income to recipient
-	recipientPeer.mu.Lock()
-	recipientPeer.conn.SetWriteDeadline(time.Now().Add(recipientPeer.writeTimeout))
-
-	// Write Income header
-	if _, err := recipientPeer.conn.Write(buf[:incomeHeaderLen]); err != nil {
-		recipientPeer.conn.SetWriteDeadline(time.Time{})
-		recipientPeer.mu.Unlock()
+	return peer.writeResponse(buf[:5+RequestIDSize])
+}
 
-		// Send error - send Error to sender
-		binary.BigEndian.PutUint32(buf[0:4], 1+RequestIDSize)
-		buf[4] = byte(Error)
-		copy(buf[5:5+RequestIDSize], reqID)
-		peer.conn.Write(buf[:5+RequestIDSize])
-		return fmt.Errorf("send to recipient: %w", err)
+// writeLoop пишет пиру кадры из его очереди, пока соединение обслуживается.
+// После ошибки записи поток мог оборваться посреди кадра, поэтому соединение
+// закрывается: чтение в handleConn завершится и уберет пира
+func (r *Router) writeLoop(peer *Peer) {
+	for {
+		select {
+		case frame := <-peer.writeQueue:
+			err := peer.write(frame)
+			// Список пиров общий для всех получателей и не из пула
+			if frame[4] == byte(Income) {
+				r.fp.Put(frame[:cap(frame)])
+			}
+			if err != nil {
+				if isTimeout(err) {
+					r.metrics.WriteTimeouts.Add(1)
+				}
+				r.metrics.MessagesError.Add(1)
+				slog.Debug("Failed to write to peer", "hexID", hex.EncodeToString(peer.ID[:8]), "error", err)
+				peer.conn.Close()
+				return
+			}
+		case <-peer.done:
+			return
+		}
 	}
+}
 
-	// Zero-copy: copy payload directly from sender conn to recipient conn
-	if payloadLen > 0 {
-		// Use part of buffer for CopyBuffer (avoid allocation in io.Copy)
-		copyBuf := buf[incomeHeaderLen : incomeHeaderLen+8192]
-		_, err := io.CopyBuffer(recipientPeer.conn, io.LimitReader(peer.conn, int64(payloadLen)), copyBuf)
-		recipientPeer.conn.SetWriteDeadline(time.Time{})
-		recipientPeer.mu.Unlock()
+// schedulePeerList планирует рассылку списка пиров через PeerListDelay.
+// Изменения до рассылки попадут в тот же список
+func (r *Router) schedulePeerList() {
+	if !r.cfg.EnablePeerList {
+		return
+	}
+	if r.peerListPending.CompareAndSwap(false, true) {
+		time.AfterFunc(PeerListDelay, r.broadcastPeerList)
+	}
+}
 
-		if err != nil {
-			slog.Error("Failed to copy payload to recipient",
-				"from", hex.EncodeToString(peer.ID[:8]),
-				"to", hex.EncodeToString(recipient[:8]),
-				"payloadLen", payloadLen,
-				"error", err)
+// broadcastPeerList ставит в очередь записи всех подключенных пиров список
+// подключенных пиров: MessageLen(4) + Type(1) + RequestID(12, нули) + Count(4) + PeerID(32)*Count.
+// Список включает и самого получателя. Пир с полной очередью пропускается:
+// он получит следующий список
+func (r *Router) broadcastPeerList() {
+	r.peerListMu.Lock()
+	defer r.peerListMu.Unlock()
+	// Изменения после снимка планируют новую рассылку
+	r.peerListPending.Store(false)
+
+	var peers []*Peer
+	r.peers.Range(func(_ PeerID, peer *Peer) bool {
+		peers = append(peers, peer)
+		return true
+	})
+
+	headerLen := 4 + 1 + RequestIDSize
+	frame := make([]byte, headerLen+4+len(peers)*PeerIDSize)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(frame)-4))
+	frame[4] = byte(PeerList)
+	binary.BigEndian.PutUint32(frame[headerLen:headerLen+4], uint32(len(peers)))
+	for i, peer := range peers {
+		copy(frame[headerLen+4+i*PeerIDSize:], peer.ID[:])
+	}
 
-			// Send error - send Error to sender
-			binary.BigEndian.PutUint32(buf[0:4], 1+RequestIDSize)
-			buf[4] = byte(Error)
-			copy(buf[5:5+RequestIDSize], reqID)
-			peer.conn.Write(buf[:5+RequestIDSize])
-			return fmt.Errorf("copy payload: %w", err)
+	for _, peer := range peers {
+		if err := peer.enqueue(frame); err != nil {
+			slog.Debug("Peer list skipped", "hexID", hex.EncodeToString(peer.ID[:8]), "error", err)
 		}
-	} else {
-		recipientPeer.conn.SetWriteDeadline(time.Time{})
-		recipientPeer.mu.Unlock()
 	}
+	slog.Debug("Peer list sent", "peers", len(peers))
+}
 
-	slog.Debug("Message delivered successfully",
-		"from", hex.EncodeToString(peer.ID[:8]),
-		"to", hex.EncodeToString(recipient[:8]),
-		"payloadLen", payloadLen)
+// putIncomeHeader заполняет заголовок Income в кадре, payload которого уже
+// лежит в frame[incomeHeaderLen:]
+func putIncomeHeader(frame []byte, reqID []byte, sender PeerID) {
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(frame)-4))
+	frame[4] = byte(Income)
+	copy(frame[5:5+RequestIDSize], reqID)
+	copy(frame[5+RequestIDSize:incomeHeaderLen], sender[:])
+}
 
-	// Send Success to sender (reuse buf)
+// rejectMessage skips payload of undeliverable message in src and answers
+// sender with status typ
+func rejectMessage(peer *Peer, src io.Reader, buf []byte, reqID []byte, payloadLen uint32, typ SMType) error {
+	if err := discardPayload(src, buf, payloadLen); err != nil {
+		return err
+	}
+	// Reuse buf for response: MessageLen(4) + Type(1) + RequestID(12) = 17 bytes
 	binary.BigEndian.PutUint32(buf[0:4], 1+RequestIDSize)
-	buf[4] = byte(Success)
+	buf[4] = byte(typ)
 	copy(buf[5:5+RequestIDSize], reqID)
-	_, err := peer.conn.Write(buf[:5+RequestIDSize])
-	return err
+	return peer.writeResponse(buf[:5+RequestIDSize])
+}
+
+// discardPayload пропускает payload сообщения в src
+func discardPayload(src io.Reader, buf []byte, payloadLen uint32) error {
+	if payloadLen == 0 {
+		return nil
+	}
+	// Use part of buffer for CopyBuffer (avoid allocation in io.Copy)
+	discardBuf := buf[PeerHeaderSize : PeerHeaderSize+8192]
+	if _, err := io.CopyBuffer(io.Discard, io.LimitReader(src, int64(payloadLen)), discardBuf); err != nil {
+		return fmt.Errorf("discard payload: %w", err)
+	}
+	return nil
+}
+
+// writeErrorResponse отвечает отправителю Error с кодом причины:
+// MessageLen(4) + Type(1) + RequestID(12) + Code(1). reqID может лежать в buf
+func writeErrorResponse(peer *Peer, buf []byte, reqID []byte, code ErrorCode) error {
+	var id RequestID
+	copy(id[:], reqID)
+
+	binary.BigEndian.PutUint32(buf[0:4], 1+RequestIDSize+1)
+	buf[4] = byte(Error)
+	copy(buf[5:5+RequestIDSize], id[:])
+	buf[5+RequestIDSize] = byte(code)
+	return peer.writeResponse(buf[:6+RequestIDSize])
 }
 
 var ErrAuthFailed = errors.New("authentication failed")
 
-func auth(conn net.Conn, timeout time.Duration, authPool *sync.Pool) (PeerID, error) {
+func (r *Router) auth(conn net.Conn, timeout time.Duration) (PeerID, error) {
 	id := PeerID{}
 	conn.SetDeadline(time.Now().Add(timeout))
 	defer conn.SetDeadline(time.Time{})
 
-	buf := authPool.Get().([]byte)
-	defer authPool.Put(buf)
+	buf := r.authPool.Get().([]byte)
+	defer r.authPool.Put(buf)
 
 	of := 0
 	pubkey := buf[of:ed25519.PublicKeySize]
@@ -229,6 +685,12 @@ func auth(conn net.Conn, timeout time.Duration, authPool *sync.Pool) (PeerID, er
 		return id, fmt.Errorf("read public key: %w", err)
 	}
 
+	// Забаненного пира отключаем сразу, не тратя время на challenge
+	copy(id[:], pubkey)
+	if r.IsBanned(id) {
+		return id, ErrPeerBanned
+	}
+
 	if _, err := rand.Read(challange); err != nil {
 		return id, fmt.Errorf("generate challange: %w", err)
 	}
@@ -242,10 +704,9 @@ func auth(conn net.Conn, timeout time.Duration, authPool *sync.Pool) (PeerID, er
 	}
 
 	if !ed25519.Verify(pubkey, challange, sig) {
+		r.metrics.AuthFailures.Add(1)
 		return id, ErrAuthFailed
 	}
 
-	copy(id[:], pubkey)
-
 	return id, nil
 }
@@ -1,13 +1,18 @@
 package router
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/binary"
 	"io"
+	"math"
 	mrand "math/rand"
 	"net"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -25,27 +30,8 @@ func TestRouterThroughput(t *testing.T) {
 
 	addr = lis.Addr().String()
 
-	var peers sync.Map
-	authPool := sync.Pool{
-		New: func() any {
-			return make([]byte, ed25519.PublicKeySize+ChallangeSize+ed25519.SignatureSize)
-		},
-	}
-	hp := sync.Pool{
-		New: func() any {
-			return make([]byte, MaxPacketSize)
-		},
-	}
-
-	go func() {
-		for {
-			conn, err := lis.Accept()
-			if err != nil {
-				return
-			}
-			go handleConn(conn, &peers, &authPool, &hp)
-		}
-	}()
+	r := NewRouter(RouterConfig{})
+	go r.Serve(lis)
 
 	// Создаем два клиента
 	client1, privKey1 := createAuthenticatedClient(t, addr)
@@ -126,27 +112,8 @@ func TestRouter10KPeers(t *testing.T) {
 
 	addr = lis.Addr().String()
 
-	var peers sync.Map
-	authPool := sync.Pool{
-		New: func() any {
-			return make([]byte, ed25519.PublicKeySize+ChallangeSize+ed25519.SignatureSize)
-		},
-	}
-	hp := sync.Pool{
-		New: func() any {
-			return make([]byte, MaxPacketSize)
-		},
-	}
-
-	go func() {
-		for {
-			conn, err := lis.Accept()
-			if err != nil {
-				return
-			}
-			go handleConn(conn, &peers, &authPool, &hp)
-		}
-	}()
+	r := NewRouter(RouterConfig{})
+	go r.Serve(lis)
 
 	// Создаем 10,000 клиентов
 	peerCount := 10000
@@ -306,6 +273,77 @@ func BenchmarkRouterZeroCopy(b *testing.B) {
 	}
 }
 
+// BenchmarkBurstLatency измеряет задержку Send -> Success для всплеска
+// мелких сигнальных сообщений с batching и без. p50/p99/stddev - в
+// микросекундах на сообщение
+func BenchmarkBurstLatency(b *testing.B) {
+	const burst = 32
+
+	for _, bc := range []struct {
+		name   string
+		window time.Duration
+	}{
+		{"Unbatched", 0},
+		{"Batched", DefaultBatchWindow},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			addr := startTestRouter(b, RouterConfig{})
+			sender, _, _ := dialTestClient(b, addr)
+			_, receiverID, income := dialTestClient(b, addr)
+			time.Sleep(100 * time.Millisecond)
+			sender.SetBatchWindow(bc.window)
+
+			go func() {
+				for msg := range income {
+					msg.Release()
+				}
+			}()
+
+			payload := make([]byte, 256) // размер KEY_EXCHANGE/SDP порядка сотен байт
+			latencies := make([]time.Duration, 0, b.N*burst)
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < burst; j++ {
+					start := time.Now()
+					respCh, err := sender.Send(context.Background(), receiverID, payload)
+					if err != nil {
+						b.Fatal(err)
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if msg, ok := <-respCh; !ok || msg.Type != Success {
+							b.Error("Message not delivered")
+							return
+						}
+						mu.Lock()
+						latencies = append(latencies, time.Since(start))
+						mu.Unlock()
+					}()
+				}
+				wg.Wait()
+			}
+			b.StopTimer()
+
+			slices.Sort(latencies)
+			var sum, sumSq float64
+			for _, l := range latencies {
+				us := float64(l.Microseconds())
+				sum += us
+				sumSq += us * us
+			}
+			n := float64(len(latencies))
+			mean := sum / n
+			b.ReportMetric(float64(latencies[len(latencies)/2].Microseconds()), "p50-us")
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-us")
+			b.ReportMetric(math.Sqrt(max(sumSq/n-mean*mean, 0)), "stddev-us")
+		})
+	}
+}
+
 // Вспомогательные функции
 
 func createAuthenticatedClient(tb testing.TB, addr string) (net.Conn, ed25519.PrivateKey) {
@@ -397,6 +435,15 @@ func readServerMessage(conn net.Conn) (ServerMessage, error) {
 		return msg, err
 	}
 
+	// Error несет код причины
+	if msg.Type == Error {
+		code := make([]byte, 1)
+		if _, err := io.ReadFull(conn, code); err != nil {
+			return msg, err
+		}
+		msg.Code = ErrorCode(code[0])
+	}
+
 	// Для Income читаем SenderID и Payload
 	if msg.Type == Income {
 		if _, err := io.ReadFull(conn, msg.SenderID[:]); err != nil {
@@ -428,27 +475,8 @@ func TestClientBasic(t *testing.T) {
 
 	addr = lis.Addr().String()
 
-	var peers sync.Map
-	authPool := sync.Pool{
-		New: func() any {
-			return make([]byte, ed25519.PublicKeySize+ChallangeSize+ed25519.SignatureSize)
-		},
-	}
-	hp := sync.Pool{
-		New: func() any {
-			return make([]byte, MaxPacketSize)
-		},
-	}
-
-	go func() {
-		for {
-			conn, err := lis.Accept()
-			if err != nil {
-				return
-			}
-			go handleConn(conn, &peers, &authPool, &hp)
-		}
-	}()
+	r := NewRouter(RouterConfig{})
+	go r.Serve(lis)
 
 	// Создаем два клиента
 	pubKey1, privKey1, err := ed25519.GenerateKey(rand.Reader)
@@ -525,27 +553,8 @@ func TestClientTimeout(t *testing.T) {
 
 	addr = lis.Addr().String()
 
-	var peers sync.Map
-	authPool := sync.Pool{
-		New: func() any {
-			return make([]byte, ed25519.PublicKeySize+ChallangeSize+ed25519.SignatureSize)
-		},
-	}
-	hp := sync.Pool{
-		New: func() any {
-			return make([]byte, MaxPacketSize)
-		},
-	}
-
-	go func() {
-		for {
-			conn, err := lis.Accept()
-			if err != nil {
-				return
-			}
-			go handleConn(conn, &peers, &authPool, &hp)
-		}
-	}()
+	r := NewRouter(RouterConfig{})
+	go r.Serve(lis)
 
 	// Создаем клиент
 	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
@@ -600,3 +609,352 @@ func TestClientTimeout(t *testing.T) {
 	}
 }
 
+
+func TestMetrics(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	addr := lis.Addr().String()
+
+	r := NewRouter(RouterConfig{})
+	metrics := r.Metrics()
+	go r.Serve(lis)
+
+	client, privKey := createAuthenticatedClient(t, addr)
+	defer client.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if got := metrics.PeersConnected.Load(); got != 1 {
+		t.Fatalf("Expected 1 active peer, got %d", got)
+	}
+
+	// Сообщение самому себе - доставляется
+	var self PeerID
+	copy(self[:], privKey.Public().(ed25519.PublicKey))
+
+	var reqID RequestID
+	rand.Read(reqID[:])
+	if err := writePeerMessage(client, PeerMessage{RequestID: reqID, Recipient: self, Payload: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	// Income + Success
+	for i := 0; i < 2; i++ {
+		if _, err := readServerMessage(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Сообщение несуществующему пиру - NotFound
+	var unknown PeerID
+	rand.Read(unknown[:])
+	if err := writePeerMessage(client, PeerMessage{RequestID: reqID, Recipient: unknown, Payload: []byte("lost")}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := readServerMessage(client); err != nil || msg.Type != NotFound {
+		t.Fatalf("Expected NotFound, got %v (err=%v)", msg.Type, err)
+	}
+
+	if got := metrics.MessagesSuccess.Load(); got != 1 {
+		t.Errorf("Expected 1 routed message, got %d", got)
+	}
+	if got := metrics.MessagesNotFound.Load(); got != 1 {
+		t.Errorf("Expected 1 NotFound, got %d", got)
+	}
+	if got := metrics.BytesForwarded.Load(); got != 5 {
+		t.Errorf("Expected 5 forwarded bytes, got %d", got)
+	}
+
+	var b strings.Builder
+	if err := metrics.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `sendy_router_messages_total{result="success"} 1`) {
+		t.Errorf("Unexpected exposition output:\n%s", b.String())
+	}
+
+	// Неверная подпись - ошибка аутентификации
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	conn.Write(pub)
+	challange := make([]byte, ChallangeSize)
+	if _, err := io.ReadFull(conn, challange); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(make([]byte, ed25519.SignatureSize))
+	time.Sleep(100 * time.Millisecond)
+
+	if got := metrics.AuthFailures.Load(); got != 1 {
+		t.Errorf("Expected 1 auth failure, got %d", got)
+	}
+}
+
+func TestBanList(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	addr := lis.Addr().String()
+	banListPath := filepath.Join(t.TempDir(), "banlist")
+
+	r := NewRouter(RouterConfig{})
+	if err := r.LoadBanList(banListPath); err != nil {
+		t.Fatal(err)
+	}
+	go r.Serve(lis)
+
+	client, privKey := createAuthenticatedClient(t, addr)
+	defer client.Close()
+	spammer, spammerKey := createAuthenticatedClient(t, addr)
+	defer spammer.Close()
+
+	var clientID, spammerID PeerID
+	copy(clientID[:], privKey.Public().(ed25519.PublicKey))
+	copy(spammerID[:], spammerKey.Public().(ed25519.PublicKey))
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := r.Ban(spammerID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Сообщение от забаненного пира - Forbidden
+	var reqID RequestID
+	rand.Read(reqID[:])
+	if err := writePeerMessage(spammer, PeerMessage{RequestID: reqID, Recipient: clientID, Payload: []byte("spam")}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := readServerMessage(spammer); err != nil || msg.Type != Forbidden {
+		t.Fatalf("Expected Forbidden from banned sender, got %v (err=%v)", msg.Type, err)
+	}
+
+	// Сообщение забаненному пиру - Forbidden
+	if err := writePeerMessage(client, PeerMessage{RequestID: reqID, Recipient: spammerID, Payload: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := readServerMessage(client); err != nil || msg.Type != Forbidden {
+		t.Fatalf("Expected Forbidden to banned recipient, got %v (err=%v)", msg.Type, err)
+	}
+
+	// Бан сохраняется в файл и загружается новым роутером
+	r2 := NewRouter(RouterConfig{})
+	if err := r2.LoadBanList(banListPath); err != nil {
+		t.Fatal(err)
+	}
+	if !r2.IsBanned(spammerID) {
+		t.Fatal("Ban was not persisted")
+	}
+
+	// Повторное подключение забаненного пира обрывается сразу после публичного ключа
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(spammerKey.Public().(ed25519.PublicKey))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, ChallangeSize)); err == nil {
+		t.Fatal("Expected banned peer to be disconnected before challenge")
+	}
+
+	if err := r.Unban(spammerID); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Bans()) != 0 {
+		t.Fatalf("Expected empty ban list, got %d", len(r.Bans()))
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	addr := lis.Addr().String()
+
+	r := NewRouter(RouterConfig{IdleTimeout: 200 * time.Millisecond})
+	go r.Serve(lis)
+
+	// Клиент аутентифицируется и замолкает
+	silent, _ := createAuthenticatedClient(t, addr)
+	defer silent.Close()
+
+	// Клиент с keepalive не должен быть отключен
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(pubKey, privKey)
+	client.SetKeepaliveInterval(50 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := client.Dial(ctx, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := len(r.Peers()); got != 2 {
+		t.Fatalf("Expected 2 peers, got %d", got)
+	}
+
+	// Router должен закрыть молчащее соединение
+	silent.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected silent connection to be closed")
+	} else if isTimeout(err) {
+		t.Fatal("Silent peer was not evicted")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	peers := r.Peers()
+	if len(peers) != 1 {
+		t.Fatalf("Expected 1 peer after eviction, got %d", len(peers))
+	}
+	if !bytes.Equal(peers[0].ID[:], pubKey) {
+		t.Fatal("Wrong peer evicted")
+	}
+}
+
+// TestSlowRecipient проверяет, что получатель, который не читает
+// соединение, не задерживает отправителя: сверх очереди записи router
+// сразу отвечает ErrCodeRecipientBusy, а сообщения другим пирам доходят
+func TestSlowRecipient(t *testing.T) {
+	addr := startTestRouter(t, RouterConfig{WriteTimeout: time.Minute})
+
+	slow, slowKey := createAuthenticatedClient(t, addr)
+	defer slow.Close()
+	var slowID PeerID
+	copy(slowID[:], slowKey.Public().(ed25519.PublicKey))
+
+	sender, _, _ := dialTestClient(t, addr)
+	_, receiverID, income := dialTestClient(t, addr)
+	time.Sleep(100 * time.Millisecond)
+
+	payload := make([]byte, 16*1024)
+	busy := false
+	// Очередь и буферы сокетов вмещают несколько мегабайт
+	for i := 0; i < 2000 && !busy; i++ {
+		respCh, err := sender.Send(context.Background(), slowID, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg := waitResponse(t, respCh); {
+		case msg.Type == Error && msg.Code == ErrCodeRecipientBusy:
+			busy = true
+		case msg.Type != Success:
+			t.Fatalf("Expected Success or RecipientBusy, got %v code %v", msg.Type, msg.Code)
+		}
+	}
+	if !busy {
+		t.Fatal("Expected RecipientBusy from a recipient that does not read")
+	}
+
+	respCh, err := sender.Send(context.Background(), receiverID, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := waitResponse(t, respCh); msg.Type != Success {
+		t.Fatalf("Expected Success, got %v code %v", msg.Type, msg.Code)
+	}
+	select {
+	case msg := <-income:
+		if string(msg.Payload) != "hello" {
+			t.Fatalf("Unexpected payload %q", msg.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message to another peer was not delivered")
+	}
+}
+
+// TestShortMessageLength проверяет, что заголовок с длиной меньше
+// RequestID+Recipient закрывает соединение, а не роняет router
+func TestShortMessageLength(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	r := NewRouter(RouterConfig{})
+	go r.Serve(lis)
+	addr := lis.Addr().String()
+
+	_, recipientID, _ := dialTestClient(t, addr)
+	conn, _ := createAuthenticatedClient(t, addr)
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	header := make([]byte, PeerHeaderSize)
+	binary.BigEndian.PutUint32(header, 10)
+	copy(header[4+RequestIDSize:], recipientID[:])
+	if _, err := conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); isTimeout(err) {
+		t.Fatal("Expected connection to be closed")
+	}
+	if got := r.Metrics().MessagesError.Load(); got != 1 {
+		t.Fatalf("Expected 1 error, got %d", got)
+	}
+
+	// Router продолжает работать
+	sender, _, _ := dialTestClient(t, addr)
+	time.Sleep(100 * time.Millisecond)
+	respCh, err := sender.Send(context.Background(), recipientID, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := waitResponse(t, respCh); msg.Type != Success {
+		t.Fatalf("Expected Success, got %v code %v", msg.Type, msg.Code)
+	}
+}
+
+func TestRouterConfigDefaults(t *testing.T) {
+	r := NewRouter(RouterConfig{})
+	if r.cfg != DefaultRouterConfig() {
+		t.Fatalf("Expected default config, got %+v", r.cfg)
+	}
+
+	r = NewRouter(RouterConfig{MaxPacketSize: 1024})
+	if r.cfg.MaxPacketSize != MinPacketSize {
+		t.Fatalf("Expected MaxPacketSize clamped to %d, got %d", MinPacketSize, r.cfg.MaxPacketSize)
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	r := NewRouter(RouterConfig{AuthTimeout: 100 * time.Millisecond})
+	go r.Serve(lis)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Не отправляем публичный ключ: router должен закрыть соединение
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected connection to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("Router did not close connection after AuthTimeout")
+	}
+}
@@ -0,0 +1,247 @@
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketPath - путь, на котором router принимает WebSocket соединения
+const WebSocketPath = "/ws"
+
+// wsConn передает протокол router'а поверх WebSocket в бинарных кадрах.
+// Аутентификация идет как по TCP: каждая запись - отдельный кадр, только
+// challenge router отправляет текстовым кадром в hex, чтобы браузерный
+// клиент мог прочитать его как строку. После startFraming записи
+// накапливаются до конца сообщения (по MessageLen) и каждое
+// PeerMessage/ServerMessage уходит ровно одним кадром
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+	server bool // соединение принято router'ом
+
+	mu            sync.Mutex
+	framing       bool
+	buf           []byte
+	challengeSent bool
+
+	// Прочитанный challenge, который еще не отдан Read. Только у клиента
+	challenge     []byte
+	challengeRead bool
+}
+
+func newWSConn(ws *websocket.Conn, remote net.Addr, server bool) *wsConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{Conn: ws, remote: remote, server: server}
+}
+
+// wsChallengeCodec передает challenge текстовым кадром в hex
+var wsChallengeCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		return []byte(hex.EncodeToString(v.([]byte))), websocket.TextFrame, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		if payloadType != websocket.TextFrame {
+			return fmt.Errorf("challenge is not a text frame")
+		}
+		challenge, err := hex.DecodeString(string(data))
+		if err != nil {
+			return fmt.Errorf("decode challenge: %w", err)
+		}
+		*v.(*[]byte) = challenge
+		return nil
+	},
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	if !c.server && !c.challengeRead {
+		c.challengeRead = true
+		if err := wsChallengeCodec.Receive(c.Conn, &c.challenge); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.challenge) > 0 {
+		n := copy(p, c.challenge)
+		c.challenge = c.challenge[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// startFraming включается после аутентификации
+func (c *wsConn) startFraming() {
+	c.mu.Lock()
+	c.framing = true
+	c.mu.Unlock()
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.framing {
+		// Первая запись router'а - challenge
+		if c.server && !c.challengeSent {
+			c.challengeSent = true
+			if err := wsChallengeCodec.Send(c.Conn, p); err != nil {
+				return 0, err
+			}
+			return len(p), nil
+		}
+		return c.Conn.Write(p)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// Сначала набираем MessageLen, затем само сообщение
+		need := 4 - len(c.buf)
+		if need <= 0 {
+			need = 4 + int(binary.BigEndian.Uint32(c.buf[:4])) - len(c.buf)
+		}
+		n := min(need, len(p))
+		c.buf = append(c.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(c.buf) >= 4 && len(c.buf) == 4+int(binary.BigEndian.Uint32(c.buf[:4])) {
+			_, err := c.Conn.Write(c.buf)
+			c.buf = c.buf[:0]
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// wsAddr - адрес HTTP клиента, websocket.Conn на сервере отдает вместо него Origin
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+// WebSocketHandler возвращает http.Handler, который обслуживает пиров по
+// WebSocket. Пиры TCP и WebSocket транспортов видят друг друга
+func (r *Router) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		// Origin не проверяется: клиенты не браузеры, доступ дает только
+		// аутентификация ключом
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			addr := wsAddr(ws.Request().RemoteAddr)
+			if !r.allowConn(addr) {
+				ws.Close()
+				return
+			}
+			r.handleConn(newWSConn(ws, addr, true))
+		},
+	}
+}
+
+// ServeWebSocket обслуживает WebSocket транспорт на addr по пути WebSocketPath.
+// Если заданы certFile и keyFile, соединения принимаются по TLS (wss://)
+func (r *Router) ServeWebSocket(addr, certFile, keyFile string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	return r.serveWebSocket(context.Background(), lis, certFile, keyFile)
+}
+
+// RunWS запускает router, который принимает пиров только по WebSocket на
+// addr (путь WebSocketPath), например для браузерных клиентов. Протокол
+// тот же, что по TCP, включая аутентификацию: каждое сообщение - бинарный
+// кадр, кроме challenge, который приходит текстовым кадром в hex. Работает
+// до отмены ctx, затем закрывает соединения пиров и
+// возвращает nil. Чтобы обслуживать TCP и WebSocket одним router'ом,
+// используйте Run с RouterConfig.WSAddr
+func RunWS(ctx context.Context, addr string, cfg RouterConfig) error {
+	r := NewRouter(cfg)
+	if cfg.BanListPath != "" {
+		if err := r.LoadBanList(cfg.BanListPath); err != nil {
+			return err
+		}
+	}
+	if cfg.MetricsAddr != "" {
+		go func() {
+			if err := ServeMetrics(cfg.MetricsAddr, r.Metrics()); err != nil {
+				slog.Error("Metrics server error", "error", err)
+			}
+		}()
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	return r.serveWebSocket(ctx, lis, cfg.WSCertFile, cfg.WSKeyFile)
+}
+
+// serveWebSocket обслуживает WebSocket транспорт на lis до отмены ctx
+func (r *Router) serveWebSocket(ctx context.Context, lis net.Listener, certFile, keyFile string) error {
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, r.WebSocketHandler())
+	srv := &http.Server{Handler: mux}
+
+	// http.Server не закрывает соединения, переданные WebSocket, поэтому
+	// пиров отключаем сами
+	stop := context.AfterFunc(ctx, func() {
+		srv.Close()
+		r.disconnectAll()
+	})
+	defer stop()
+
+	slog.Info("Router WebSocket listening", "address", lis.Addr().String(), "path", WebSocketPath, "tls", certFile != "")
+	var err error
+	if certFile != "" && keyFile != "" {
+		err = srv.ServeTLS(lis, certFile, keyFile)
+	} else {
+		err = srv.Serve(lis)
+	}
+	if errors.Is(err, http.ErrServerClosed) && ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// isWebSocketAddr сообщает, нужно ли подключаться к addr по WebSocket
+func isWebSocketAddr(addr string) bool {
+	return strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://")
+}
+
+// dialWebSocket подключается к router'у по ws:// или wss:// адресу
+func dialWebSocket(ctx context.Context, addr string) (*wsConn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parse address: %w", err)
+	}
+
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" {
+		origin = "https://" + u.Host
+	}
+
+	cfg, err := websocket.NewConfig(addr, origin)
+	if err != nil {
+		return nil, fmt.Errorf("websocket config: %w", err)
+	}
+	ws, err := cfg.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(ws, wsAddr(u.Host), false), nil
+}
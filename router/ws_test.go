@@ -0,0 +1,228 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// TestWebSocketTransport проверяет доставку между пирами TCP и WebSocket
+// транспортов одного router'а
+func TestWebSocketTransport(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	r := NewRouter(RouterConfig{})
+	go r.Serve(lis)
+
+	srv := httptest.NewServer(r.WebSocketHandler())
+	defer srv.Close()
+	wsAddr := "ws" + strings.TrimPrefix(srv.URL, "http") + WebSocketPath
+
+	tcpClient, tcpID, tcpIncome := dialTestClient(t, lis.Addr().String())
+	wsClient, wsID, wsIncome := dialTestClient(t, wsAddr)
+	time.Sleep(100 * time.Millisecond)
+
+	if len(r.Peers()) != 2 {
+		t.Fatalf("Expected 2 peers, got %d", len(r.Peers()))
+	}
+
+	large := make([]byte, 256*1024)
+	rand.Read(large)
+
+	cases := []struct {
+		name      string
+		sender    *Client
+		senderID  PeerID
+		recipient PeerID
+		income    <-chan ServerMessage
+	}{
+		{"TCPToWS", tcpClient, tcpID, wsID, wsIncome},
+		{"WSToTCP", wsClient, wsID, tcpID, tcpIncome},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, payload := range [][]byte{[]byte("hello"), large} {
+				respCh, err := tc.sender.Send(context.Background(), tc.recipient, payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				select {
+				case msg := <-tc.income:
+					if msg.SenderID != tc.senderID {
+						t.Fatalf("Unexpected sender %x", msg.SenderID[:8])
+					}
+					if !bytes.Equal(msg.Payload, payload) {
+						t.Fatalf("Payload mismatch: got %d bytes, want %d", len(msg.Payload), len(payload))
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("Timeout waiting for payload")
+				}
+
+				if msg := waitResponse(t, respCh); msg.Type != Success {
+					t.Fatalf("Expected Success, got %v", msg.Type)
+				}
+			}
+		})
+	}
+
+	// NotFound приходит и по WebSocket
+	var unknown PeerID
+	rand.Read(unknown[:])
+	respCh, err := wsClient.Send(context.Background(), unknown, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := waitResponse(t, respCh); msg.Type != NotFound {
+		t.Fatalf("Expected NotFound, got %v", msg.Type)
+	}
+}
+
+func TestWebSocketAuthFailure(t *testing.T) {
+	r := NewRouter(RouterConfig{})
+	srv := httptest.NewServer(r.WebSocketHandler())
+	defer srv.Close()
+
+	pubKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	// Подпись чужим ключом
+	client := NewClient(pubKey, otherKey)
+	income, err := client.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http")+WebSocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-income:
+		if ok {
+			t.Fatal("Expected connection to be closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Router did not close connection with bad signature")
+	}
+	if r.Metrics().AuthFailures.Load() != 1 {
+		t.Fatalf("Expected 1 auth failure, got %d", r.Metrics().AuthFailures.Load())
+	}
+}
+
+// TestWebSocketTextChallenge проверяет, что challenge приходит текстовым
+// кадром в hex, как его прочитает браузерный клиент
+func TestWebSocketTextChallenge(t *testing.T) {
+	r := NewRouter(RouterConfig{})
+	srv := httptest.NewServer(r.WebSocketHandler())
+	defer srv.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+WebSocketPath, "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	pubKey, privKey, _ := ed25519.GenerateKey(rand.Reader)
+	if err := websocket.Message.Send(ws, []byte(pubKey)); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetDeadline(time.Now().Add(2 * time.Second))
+	var text string
+	if err := websocket.Message.Receive(ws, &text); err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := hex.DecodeString(text)
+	if err != nil || len(challenge) != ChallangeSize {
+		t.Fatalf("Expected hex challenge of %d bytes, got %q", ChallangeSize, text)
+	}
+	if err := websocket.Message.Send(ws, ed25519.Sign(privKey, challenge)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if len(r.Peers()) != 1 {
+		t.Fatalf("Expected authenticated peer, got %d peers", len(r.Peers()))
+	}
+}
+
+// TestRunWS проверяет router только с WebSocket транспортом и его
+// остановку отменой контекста
+func TestRunWS(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- RunWS(ctx, addr, RouterConfig{}) }()
+
+	wsAddr := "ws://" + addr + WebSocketPath
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Router did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sender, senderID, _ := dialTestClient(t, wsAddr)
+	_, recipientID, income := dialTestClient(t, wsAddr)
+	time.Sleep(100 * time.Millisecond)
+
+	respCh, err := sender.Send(context.Background(), recipientID, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-income:
+		if msg.SenderID != senderID || string(msg.Payload) != "hello" {
+			t.Fatalf("Unexpected message: %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for payload")
+	}
+	if msg := waitResponse(t, respCh); msg.Type != Success {
+		t.Fatalf("Expected Success, got %v", msg.Type)
+	}
+
+	// Отмена закрывает и сервер, и соединения пиров
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected nil after cancel, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunWS did not return after cancel")
+	}
+	for {
+		select {
+		case _, ok := <-income:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Peer connection was not closed")
+		}
+	}
+}